@@ -0,0 +1,136 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package checks
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// Names of the parameters checked against a Policy by convention. Libraries
+// using policies may check other parameters, e.g. the budget of a specific
+// aggregation.
+const (
+	EpsilonParameter = epsilonName
+	DeltaParameter   = deltaName
+)
+
+// Severity is the outcome of a parameter exceeding a Limit.
+type Severity int
+
+const (
+	// SeverityWarning reports the violation, see Policy.OnWarning, and accepts
+	// the parameter.
+	SeverityWarning Severity = iota
+	// SeverityError rejects the parameter.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Limit is an upper bound on a privacy parameter, e.g. "warn if ε > 2" or
+// "error if δ > 1e-5".
+type Limit struct {
+	// Parameter is the name of the parameter the limit applies to, e.g.
+	// EpsilonParameter.
+	Parameter string
+	// Max is the largest value of the parameter accepted without violating the
+	// limit.
+	Max      float64
+	Severity Severity
+}
+
+// Violation is a parameter value exceeding a Limit.
+type Violation struct {
+	Limit Limit
+	Value float64
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s is %g, exceeds the limit of %g (%v)", v.Limit.Parameter, v.Value, v.Limit.Max, v.Limit.Severity)
+}
+
+// Policy is a set of limits on privacy parameters configured by the
+// application, so that pipelines follow the privacy policy of the organization
+// running them. The checks of this package only enforce the limits needed for
+// the parameters to be valid.
+type Policy struct {
+	Limits []Limit
+	// OnWarning is called with each violation of a limit with SeverityWarning.
+	// If nil, violations are logged as warnings.
+	OnWarning func(Violation)
+}
+
+// Validate returns an error if a limit of the policy is invalid.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for i, l := range p.Limits {
+		if l.Parameter == "" {
+			return fmt.Errorf("Limits[%d]: Parameter must be set", i)
+		}
+		if math.IsNaN(l.Max) {
+			return fmt.Errorf("Limits[%d]: Max cannot be NaN", i)
+		}
+		if l.Severity != SeverityWarning && l.Severity != SeverityError {
+			return fmt.Errorf("Limits[%d]: unknown %v", i, l.Severity)
+		}
+	}
+	return nil
+}
+
+// Check checks value against the limits of the policy on parameter. It reports
+// the violations of limits with SeverityWarning, and returns an error listing
+// the violations of limits with SeverityError. A nil policy accepts all values.
+func (p *Policy) Check(parameter string, value float64) error {
+	if p == nil {
+		return nil
+	}
+	var errs []string
+	for _, l := range p.Limits {
+		if l.Parameter != parameter || !(value > l.Max) {
+			continue
+		}
+		v := Violation{Limit: l, Value: value}
+		if l.Severity == SeverityError {
+			errs = append(errs, v.String())
+			continue
+		}
+		if p.OnWarning != nil {
+			p.OnWarning(v)
+		} else {
+			log.Warningf("Privacy policy violation: %v", v)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("privacy policy violated: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package checks
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	limits := []Limit{
+		{Parameter: EpsilonParameter, Max: 2, Severity: SeverityWarning},
+		{Parameter: EpsilonParameter, Max: 10, Severity: SeverityError},
+		{Parameter: DeltaParameter, Max: 1e-5, Severity: SeverityError},
+	}
+	for _, tc := range []struct {
+		desc         string
+		parameter    string
+		value        float64
+		wantWarnings int
+		wantErr      bool
+	}{
+		{"epsilon within limits", EpsilonParameter, 1, 0, false},
+		{"epsilon equal to warning limit", EpsilonParameter, 2, 0, false},
+		{"epsilon above warning limit", EpsilonParameter, 3, 1, false},
+		{"epsilon above error limit", EpsilonParameter, 11, 1, true},
+		{"delta within limits", DeltaParameter, 1e-6, 0, false},
+		{"delta above error limit", DeltaParameter, 1e-4, 0, true},
+		{"parameter without limits", "AggregationEpsilon", 100, 0, false},
+	} {
+		var warnings []Violation
+		p := &Policy{Limits: limits, OnWarning: func(v Violation) { warnings = append(warnings, v) }}
+		err := p.Check(tc.parameter, tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Check with %s: got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if len(warnings) != tc.wantWarnings {
+			t.Errorf("Check with %s: got warnings %v, want %d warnings", tc.desc, warnings, tc.wantWarnings)
+		}
+	}
+}
+
+func TestNilPolicyAcceptsAllValues(t *testing.T) {
+	var p *Policy
+	if err := p.Validate(); err != nil {
+		t.Errorf("Validate: got error %v", err)
+	}
+	if err := p.Check(EpsilonParameter, math.Inf(1)); err != nil {
+		t.Errorf("Check: got error %v", err)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		limit   Limit
+		wantErr bool
+	}{
+		{"valid limit", Limit{Parameter: DeltaParameter, Max: 1e-5, Severity: SeverityError}, false},
+		{"no parameter", Limit{Max: 1}, true},
+		{"NaN max", Limit{Parameter: EpsilonParameter, Max: math.NaN()}, true},
+		{"unknown severity", Limit{Parameter: EpsilonParameter, Max: 1, Severity: Severity(2)}, true},
+	} {
+		p := &Policy{Limits: []Limit{tc.limit}}
+		if err := p.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("Validate with %s: got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package conformance provides test cases that implementations of the Laplace
+// and Gaussian mechanisms, e.g. in other languages or behind a service, can run
+// to check that they are compatible with the noise package.
+//
+// Each Case specifies a mechanism, its parameters and an input value. It comes
+// with two kinds of expectations:
+//   - Golden holds the first noisy values output by the noise package when its
+//     randomness comes from rand.NewDeterministicStream(Key). Only
+//     implementations that sample noise with the same algorithms and the same
+//     AES-CTR random stream can reproduce them; CheckGolden checks them.
+//   - Mean and Variance are the statistics of the noise distribution. Any
+//     implementation of the mechanism must match them; CheckDistribution
+//     checks the statistics of NumSamples noisy values against them.
+//
+// The cases are also available as JSON in cases.json, for implementations
+// that can't run Go code.
+package conformance
+
+import (
+	_ "embed" // Embeds cases.json.
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/go/v3/rand"
+	"github.com/google/differential-privacy/go/v3/stattestutils"
+)
+
+//go:embed cases.json
+var casesJSON []byte
+
+// Mechanism names used in Case.Mechanism.
+const (
+	Laplace  = "laplace"
+	Gaussian = "gaussian"
+)
+
+// maxStandardErrors is the number of standard errors that the sample mean and
+// variance may deviate from Mean and Variance in CheckDistribution. Correct
+// implementations fail a check with probability less than 10⁻⁶.
+const maxStandardErrors = 5.0
+
+// Case is a conformance test case for a noise mechanism.
+type Case struct {
+	// Name identifies the case.
+	Name string `json:"name"`
+	// Mechanism is either Laplace or Gaussian.
+	Mechanism string `json:"mechanism"`
+	// Integer is whether noise is added to an integer value, i.e. with
+	// AddNoiseInt64 instead of AddNoiseFloat64.
+	Integer bool `json:"integer"`
+	// Parameters of the mechanism.
+	L0Sensitivity   int64   `json:"l0_sensitivity"`
+	LInfSensitivity float64 `json:"linf_sensitivity"`
+	Epsilon         float64 `json:"epsilon"`
+	Delta           float64 `json:"delta"`
+	// Value is the raw value that noise is added to.
+	Value float64 `json:"value"`
+	// Key is the 16-byte key of the deterministic random stream that Golden is
+	// generated with. In cases.json, it is base64-encoded.
+	Key []byte `json:"key"`
+	// Golden holds the first noisy values output by the noise package with a
+	// deterministic random stream created from Key.
+	Golden []float64 `json:"golden"`
+	// NumSamples is the number of noisy values that CheckDistribution expects.
+	NumSamples int `json:"num_samples"`
+	// Mean and Variance are the expected mean and variance of noisy values.
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	// Kurtosis is the expected fourth standardized moment of noisy values, used
+	// to compute the standard error of their variance.
+	Kurtosis float64 `json:"kurtosis"`
+}
+
+// Cases returns the conformance test cases.
+func Cases() ([]Case, error) {
+	var cases []Case
+	if err := json.Unmarshal(casesJSON, &cases); err != nil {
+		return nil, fmt.Errorf("conformance.Cases: couldn't parse cases.json: %w", err)
+	}
+	return cases, nil
+}
+
+// Samples returns n noisy values output by the noise package for c, using a
+// deterministic random stream created from c.Key.
+func Samples(c Case, n int) ([]float64, error) {
+	var kind noise.Kind
+	switch c.Mechanism {
+	case Laplace:
+		kind = noise.LaplaceNoise
+	case Gaussian:
+		kind = noise.GaussianNoise
+	default:
+		return nil, fmt.Errorf("conformance.Samples: unknown mechanism %q in case %s", c.Mechanism, c.Name)
+	}
+	stream, err := rand.NewDeterministicStream(c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("conformance.Samples: case %s: %w", c.Name, err)
+	}
+	mechanism := noise.ToNoiseWithStream(kind, stream)
+	samples := make([]float64, n)
+	for i := range samples {
+		if c.Integer {
+			noisy, err := mechanism.AddNoiseInt64(int64(c.Value), c.L0Sensitivity, int64(c.LInfSensitivity), c.Epsilon, c.Delta)
+			if err != nil {
+				return nil, fmt.Errorf("conformance.Samples: case %s: %w", c.Name, err)
+			}
+			samples[i] = float64(noisy)
+		} else {
+			noisy, err := mechanism.AddNoiseFloat64(c.Value, c.L0Sensitivity, c.LInfSensitivity, c.Epsilon, c.Delta)
+			if err != nil {
+				return nil, fmt.Errorf("conformance.Samples: case %s: %w", c.Name, err)
+			}
+			samples[i] = noisy
+		}
+	}
+	return samples, nil
+}
+
+// CheckGolden returns an error if the first values of samples, generated by
+// an implementation with a deterministic random stream created from c.Key,
+// differ from c.Golden.
+func CheckGolden(c Case, samples []float64) error {
+	if len(samples) < len(c.Golden) {
+		return fmt.Errorf("case %s: got %d samples, want at least %d", c.Name, len(samples), len(c.Golden))
+	}
+	for i, want := range c.Golden {
+		if samples[i] != want {
+			return fmt.Errorf("case %s: sample %d is %v, want %v", c.Name, i, samples[i], want)
+		}
+	}
+	return nil
+}
+
+// CheckDistribution returns an error if the sample mean or variance of
+// samples, c.NumSamples noisy values generated by an implementation for c,
+// deviate from c.Mean or c.Variance by more than maxStandardErrors standard
+// errors.
+func CheckDistribution(c Case, samples []float64) error {
+	if len(samples) != c.NumSamples {
+		return fmt.Errorf("case %s: got %d samples, want %d", c.Name, len(samples), c.NumSamples)
+	}
+	n := float64(len(samples))
+	mean, variance := stattestutils.SampleMean(samples), stattestutils.SampleVariance(samples)
+	meanErr := math.Sqrt(c.Variance / n)
+	if math.Abs(mean-c.Mean) > maxStandardErrors*meanErr {
+		return fmt.Errorf("case %s: sample mean is %f, want %f ± %f", c.Name, mean, c.Mean, maxStandardErrors*meanErr)
+	}
+	varianceErr := c.Variance * math.Sqrt((c.Kurtosis-1)/n)
+	if math.Abs(variance-c.Variance) > maxStandardErrors*varianceErr {
+		return fmt.Errorf("case %s: sample variance is %f, want %f ± %f", c.Name, variance, c.Variance, maxStandardErrors*varianceErr)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package conformance
+
+import (
+	"encoding/json"
+	"flag"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden values of cases.json with the noise package")
+
+// goldenLength is the number of golden values per case written by -update.
+const goldenLength = 10
+
+// Checks that the noise package conforms to its own test cases, i.e. that the
+// golden values are up to date, and that its noise has the expected
+// distribution.
+func TestNoisePackageConforms(t *testing.T) {
+	cases, err := Cases()
+	if err != nil {
+		t.Fatalf("Cases: %v", err)
+	}
+	if *update {
+		for i := range cases {
+			cases[i].Golden, err = Samples(cases[i], goldenLength)
+			if err != nil {
+				t.Fatalf("Samples: %v", err)
+			}
+		}
+		b, err := json.MarshalIndent(cases, "", "  ")
+		if err != nil {
+			t.Fatalf("couldn't marshal cases: %v", err)
+		}
+		if err := os.WriteFile("cases.json", append(b, '\n'), 0644); err != nil {
+			t.Fatalf("couldn't write cases.json: %v", err)
+		}
+		return
+	}
+	for _, c := range cases {
+		samples, err := Samples(c, c.NumSamples)
+		if err != nil {
+			t.Fatalf("Samples: %v", err)
+		}
+		if err := CheckGolden(c, samples); err != nil {
+			t.Errorf("CheckGolden: %v, run the test with -update if the change to the noise package is intended", err)
+		}
+		if err := CheckDistribution(c, samples); err != nil {
+			t.Errorf("CheckDistribution: %v", err)
+		}
+	}
+}
+
+// Checks that the expected statistics of the cases are those of the Laplace
+// and Gaussian distributions with the cases' parameters.
+func TestExpectedStatistics(t *testing.T) {
+	cases, err := Cases()
+	if err != nil {
+		t.Fatalf("Cases: %v", err)
+	}
+	for _, c := range cases {
+		var variance, kurtosis float64
+		switch c.Mechanism {
+		case Laplace:
+			b := float64(c.L0Sensitivity) * c.LInfSensitivity / c.Epsilon
+			variance, kurtosis = 2*b*b, 6
+		case Gaussian:
+			sigma := noise.SigmaForGaussian(c.L0Sensitivity, c.LInfSensitivity, c.Epsilon, c.Delta)
+			variance, kurtosis = sigma*sigma, 3
+		default:
+			t.Errorf("case %s: unknown mechanism %q", c.Name, c.Mechanism)
+			continue
+		}
+		if c.Mean != c.Value {
+			t.Errorf("case %s: Mean is %f, want the raw value %f", c.Name, c.Mean, c.Value)
+		}
+		if math.Abs(c.Variance-variance) > 1e-9*variance {
+			t.Errorf("case %s: Variance is %f, want %f", c.Name, c.Variance, variance)
+		}
+		if c.Kurtosis != kurtosis {
+			t.Errorf("case %s: Kurtosis is %f, want %f", c.Name, c.Kurtosis, kurtosis)
+		}
+		if len(c.Key) != 16 {
+			t.Errorf("case %s: Key has %d bytes, want 16", c.Name, len(c.Key))
+		}
+	}
+}
+
+// Checks that CheckDistribution rejects noise that is biased or has the wrong
+// scale.
+func TestCheckDistributionRejectsWrongNoise(t *testing.T) {
+	cases, err := Cases()
+	if err != nil {
+		t.Fatalf("Cases: %v", err)
+	}
+	c := cases[0]
+	samples, err := Samples(c, c.NumSamples)
+	if err != nil {
+		t.Fatalf("Samples: %v", err)
+	}
+	biased := make([]float64, len(samples))
+	scaled := make([]float64, len(samples))
+	for i, s := range samples {
+		biased[i] = s + math.Sqrt(c.Variance)/10
+		scaled[i] = c.Mean + (s-c.Mean)*1.1
+	}
+	if err := CheckDistribution(c, biased); err == nil {
+		t.Errorf("CheckDistribution: got no error for biased noise, want error")
+	}
+	if err := CheckDistribution(c, scaled); err == nil {
+		t.Errorf("CheckDistribution: got no error for noise with the wrong scale, want error")
+	}
+}
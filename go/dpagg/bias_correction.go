@@ -0,0 +1,81 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"fmt"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+)
+
+// BiasCorrectionOptions widens the clamping range of BoundedSumFloat64 and
+// BoundedMean from [Lower, Upper] to [Lower - MaxExcess, Upper + MaxExcess],
+// at the cost of additional privacy budget.
+//
+// With these options, the aggregation additionally computes a differentially
+// private sum of the clipped mass, i.e. of e - clamp(e) for each entry e,
+// itself clamped to [-MaxExcess, MaxExcess], and adds it to the result. The
+// result thus estimates the aggregate of the entries clamped to the widened
+// range. This reduces the clamping bias of entries between the two ranges,
+// e.g. of a moderate tail beyond Upper, but doesn't correct the bias of
+// entries outside of the widened range: it is equivalent to clamping to the
+// widened range, with the noise of the main aggregation calibrated to
+// [Lower, Upper] and the noise of the clipped mass calibrated to MaxExcess.
+//
+// The clipped mass is computed with its own privacy budget: an aggregation
+// with bias correction consumes Epsilon + BiasCorrection.Epsilon and
+// Delta + BiasCorrection.Delta in total.
+type BiasCorrectionOptions struct {
+	Epsilon float64 // Privacy parameter ε for the clipped mass. Required.
+	Delta   float64 // Privacy parameter δ for the clipped mass. Required with Gaussian noise, must be 0 with Laplace noise.
+	// Maximum clipped mass of a single entry. Required; must be positive.
+	MaxExcess float64
+}
+
+// newClippedMass returns the BoundedSumFloat64 used to compute the clipped
+// mass of an aggregation with the given contribution bounds and noise.
+func newClippedMass(opt *BiasCorrectionOptions, maxPartitionsContributed, maxContributionsPerPartition int64, n noise.Noise) (*BoundedSumFloat64, error) {
+	if err := checks.CheckEpsilonStrict(opt.Epsilon); err != nil {
+		return nil, fmt.Errorf("bias correction: %w", err)
+	}
+	if opt.MaxExcess <= 0 {
+		return nil, fmt.Errorf("bias correction: MaxExcess must be positive, got %f", opt.MaxExcess)
+	}
+	clippedMass, err := NewBoundedSumFloat64(&BoundedSumFloat64Options{
+		Epsilon:                      opt.Epsilon,
+		Delta:                        opt.Delta,
+		MaxPartitionsContributed:     maxPartitionsContributed,
+		Lower:                        -opt.MaxExcess,
+		Upper:                        opt.MaxExcess,
+		Noise:                        n,
+		maxContributionsPerPartition: maxContributionsPerPartition,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bias correction: %w", err)
+	}
+	return clippedMass, nil
+}
+
+// clippedMassEquallyInitialized returns true if both clipped masses are
+// disabled, or if both are enabled and equally initialized.
+func clippedMassEquallyInitialized(cm1, cm2 *BoundedSumFloat64) bool {
+	if cm1 == nil || cm2 == nil {
+		return cm1 == nil && cm2 == nil
+	}
+	return bsEquallyInitializedFloat64(cm1, cm2)
+}
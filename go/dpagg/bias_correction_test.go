@@ -0,0 +1,228 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"testing"
+)
+
+func getNoiselessBiasCorrectedBSF(t *testing.T) *BoundedSumFloat64 {
+	t.Helper()
+	bs, err := NewBoundedSumFloat64(&BoundedSumFloat64Options{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		maxContributionsPerPartition: 2,
+		Lower:                        0,
+		Upper:                        5,
+		Noise:                        noNoise{},
+		BiasCorrection:               &BiasCorrectionOptions{Epsilon: ln3, MaxExcess: 10},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless bias-corrected BSF: %v", err)
+	}
+	return bs
+}
+
+func getNoiselessBiasCorrectedBM(t *testing.T) *BoundedMean {
+	t.Helper()
+	bm, err := NewBoundedMean(&BoundedMeanOptions{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 2,
+		Lower:                        0,
+		Upper:                        5,
+		Noise:                        noNoise{},
+		BiasCorrection:               &BiasCorrectionOptions{Epsilon: ln3, MaxExcess: 10},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless bias-corrected BM: %v", err)
+	}
+	return bm
+}
+
+func TestNewBiasCorrectionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		opt  *BiasCorrectionOptions
+	}{
+		{"zero epsilon", &BiasCorrectionOptions{Epsilon: 0, MaxExcess: 1}},
+		{"negative epsilon", &BiasCorrectionOptions{Epsilon: -1, MaxExcess: 1}},
+		{"zero MaxExcess", &BiasCorrectionOptions{Epsilon: ln3, MaxExcess: 0}},
+		{"negative MaxExcess", &BiasCorrectionOptions{Epsilon: ln3, MaxExcess: -1}},
+	} {
+		if _, err := NewBoundedSumFloat64(&BoundedSumFloat64Options{
+			Epsilon:                  ln3,
+			MaxPartitionsContributed: 1,
+			Lower:                    0,
+			Upper:                    5,
+			BiasCorrection:           tc.opt,
+		}); err == nil {
+			t.Errorf("NewBoundedSumFloat64: with %s got no error", tc.desc)
+		}
+		if _, err := NewBoundedMean(&BoundedMeanOptions{
+			Epsilon:                      ln3,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			Lower:                        0,
+			Upper:                        5,
+			BiasCorrection:               tc.opt,
+		}); err == nil {
+			t.Errorf("NewBoundedMean: with %s got no error", tc.desc)
+		}
+	}
+}
+
+func TestBoundedSumFloat64BiasCorrection(t *testing.T) {
+	bs := getNoiselessBiasCorrectedBSF(t)
+	bs.Add(1)
+	bs.Add(8)  // Clamped to 5, clipped mass 3.
+	bs.Add(30) // Clamped to 5, clipped mass 25 clamped to 10.
+	bs.Add(-2) // Clamped to 0, clipped mass -2.
+	got, err := bs.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want := 22.0 // 1 + 8 + 15 - 2
+	if !ApproxEqual(got, want) {
+		t.Errorf("Result: with bias correction got %f, want %f", got, want)
+	}
+}
+
+func TestBoundedSumFloat64AddManyBiasCorrection(t *testing.T) {
+	bs := getNoiselessBiasCorrectedBSF(t)
+	bs.AddMany([]float64{8, 30}) // Clipped masses 3 and 10.
+	got, err := bs.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want := 23.0
+	if !ApproxEqual(got, want) {
+		t.Errorf("AddMany: with bias correction got %f, want %f", got, want)
+	}
+}
+
+func TestBoundedMeanBiasCorrection(t *testing.T) {
+	bm := getNoiselessBiasCorrectedBM(t)
+	bm.Add(1)
+	bm.Add(8)  // Clamped to 5, clipped mass 3.
+	bm.Add(30) // Clamped to 5, clipped mass 25 clamped to 10.
+	bm.Add(-2) // Clamped to 0, clipped mass -2.
+	got, err := bm.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want := 5.5 // (1 + 8 + 15 - 2) / 4
+	if !ApproxEqual(got, want) {
+		t.Errorf("Result: with bias correction got %f, want %f", got, want)
+	}
+}
+
+func TestBoundedMeanBiasCorrectionClampsToExtendedBounds(t *testing.T) {
+	bm := getNoiselessBiasCorrectedBM(t)
+	bm.AddPreAggregated(60, 2) // Clamped to 10, clipped mass 50 clamped to 20.
+	got, err := bm.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want := 15.0
+	if !ApproxEqual(got, want) {
+		t.Errorf("Result: with bias correction got %f, want %f", got, want)
+	}
+}
+
+func TestMergeBiasCorrected(t *testing.T) {
+	bs1, bs2 := getNoiselessBiasCorrectedBSF(t), getNoiselessBiasCorrectedBSF(t)
+	bs1.Add(8)
+	bs2.Add(9)
+	if err := bs1.Merge(bs2); err != nil {
+		t.Fatalf("Merge: got error %v", err)
+	}
+	got, err := bs1.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if want := 17.0; !ApproxEqual(got, want) {
+		t.Errorf("Merge: with bias correction got %f, want %f", got, want)
+	}
+
+	bm1, bm2 := getNoiselessBiasCorrectedBM(t), getNoiselessBiasCorrectedBM(t)
+	bm1.Add(8)
+	bm2.Add(9)
+	if err := bm1.Merge(bm2); err != nil {
+		t.Fatalf("Merge: got error %v", err)
+	}
+	gotMean, err := bm1.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if want := 8.5; !ApproxEqual(gotMean, want) {
+		t.Errorf("Merge: with bias correction got %f, want %f", gotMean, want)
+	}
+}
+
+func TestMergeBiasCorrectedWithUncorrectedFails(t *testing.T) {
+	bs := getNoiselessBiasCorrectedBSF(t)
+	bs2, err := NewBoundedSumFloat64(&BoundedSumFloat64Options{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		maxContributionsPerPartition: 2,
+		Lower:                        0,
+		Upper:                        5,
+		Noise:                        noNoise{},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless BSF: %v", err)
+	}
+	if err := bs.Merge(bs2); err == nil {
+		t.Errorf("Merge: with and without bias correction got no error")
+	}
+}
+
+func TestBiasCorrectedSerialization(t *testing.T) {
+	bs := getNoiselessBiasCorrectedBSF(t)
+	bs.Add(8)
+	bytes, err := encode(bs)
+	if err != nil {
+		t.Fatalf("encode(BoundedSumFloat64) error: %v", err)
+	}
+	bsUnmarshalled := new(BoundedSumFloat64)
+	if err := decode(bsUnmarshalled, bytes); err != nil {
+		t.Fatalf("decode(BoundedSumFloat64) error: %v", err)
+	}
+	bsUnmarshalled.Noise = noNoise{}
+	bsUnmarshalled.clippedMass.Noise = noNoise{}
+	got, err := bsUnmarshalled.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if want := 8.0; !ApproxEqual(got, want) {
+		t.Errorf("decode(encode(_)): with bias correction got %f, want %f", got, want)
+	}
+}
+
+func TestBiasCorrectedConfidenceIntervalFails(t *testing.T) {
+	bs := getNoiselessBiasCorrectedBSF(t)
+	bs.Result()
+	if _, err := bs.ComputeConfidenceInterval(0.1); err == nil {
+		t.Errorf("BoundedSumFloat64.ComputeConfidenceInterval: with bias correction got no error")
+	}
+	bm := getNoiselessBiasCorrectedBM(t)
+	bm.Result()
+	if _, err := bm.ComputeConfidenceInterval(0.1); err == nil {
+		t.Errorf("BoundedMean.ComputeConfidenceInterval: with bias correction got no error")
+	}
+}
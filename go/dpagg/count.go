@@ -29,8 +29,10 @@ import (
 //
 // It supports privacy units that contribute to multiple partitions (via the
 // MaxPartitionsContributed parameter) by scaling the added noise appropriately.
-// However, it does not support multiple contributions to a single partition from
-// the same privacy unit. For that use case, BoundedSumInt64 should be used instead.
+// A privacy unit contributing several times to a single partition can be counted
+// with a single call to IncrementBy if the MaxIncrement option is set; other
+// multiple contributions to a single partition are not supported. For that use
+// case, BoundedSumInt64 should be used instead.
 //
 // The provided differentially private count is an unbiased estimate of the raw
 // count meaning that its expected value is equal to the raw count.
@@ -48,6 +50,7 @@ type Count struct {
 	delta           float64
 	l0Sensitivity   int64
 	lInfSensitivity int64
+	maxIncrement    int64 // 0 if IncrementBy isn't limited to the contribution of a single privacy unit.
 	Noise           noise.Noise
 	noiseKind       noise.Kind // necessary for serializing noise.Noise information
 
@@ -62,6 +65,7 @@ func countEquallyInitialized(c1, c2 *Count) bool {
 		c1.delta == c2.delta &&
 		c1.l0Sensitivity == c2.l0Sensitivity &&
 		c1.lInfSensitivity == c2.lInfSensitivity &&
+		c1.maxIncrement == c2.maxIncrement &&
 		c1.noiseKind == c2.noiseKind &&
 		c1.state == c2.state
 }
@@ -72,6 +76,11 @@ type CountOptions struct {
 	Delta                    float64     // Privacy parameter δ. Required with Gaussian noise, must be 0 with Laplace noise.
 	MaxPartitionsContributed int64       // How many distinct partitions may a single privacy unit contribute to? Required.
 	Noise                    noise.Noise // Type of noise used. Defaults to Laplace noise.
+	// By how much may a single privacy unit increment the count of a single partition?
+	// If set, each call to IncrementBy counts the contributions of a single privacy unit,
+	// e.g. a pre-counted batch of its events, and the noise is scaled to MaxIncrement.
+	// Optional; if not set, each privacy unit increments the count by at most one.
+	MaxIncrement int64
 	// How many times may a single privacy unit contribute to a single partition?
 	// Defaults to 1. This is only needed for other aggregation functions using Count;
 	// which is why the option is not exported.
@@ -93,6 +102,12 @@ func NewCount(opt *CountOptions) (*Count, error) {
 	if lInf == 0 {
 		lInf = 1
 	}
+	if opt.MaxIncrement < 0 {
+		return nil, fmt.Errorf("NewCount: MaxIncrement must be non-negative, got %d", opt.MaxIncrement)
+	}
+	if opt.MaxIncrement > 0 {
+		lInf *= opt.MaxIncrement
+	}
 
 	n := opt.Noise
 	if n == nil {
@@ -111,6 +126,7 @@ func NewCount(opt *CountOptions) (*Count, error) {
 		delta:           del,
 		l0Sensitivity:   l0,
 		lInfSensitivity: lInf,
+		maxIncrement:    opt.MaxIncrement,
 		Noise:           n,
 		noiseKind:       noise.ToKind(n),
 		count:           0,
@@ -124,11 +140,15 @@ func (c *Count) Increment() error {
 }
 
 // IncrementBy increments the count by the given value.
-// Note that this shouldn't be used to count multiple contributions to a
-// single partition from the same privacy unit.
 //
-// It could, for example, be used to increment the count by k privacy
-// units at once.
+// If the MaxIncrement option is set, count is the number of contributions of a
+// single privacy unit to the partition, e.g. a pre-counted batch of its events,
+// and IncrementBy returns an error if its absolute value is larger than
+// MaxIncrement. Each privacy unit must then be counted with a single call.
+//
+// Otherwise, this shouldn't be used to count multiple contributions to a
+// single partition from the same privacy unit. It could, for example, be used
+// to increment the count by k privacy units at once.
 //
 // Note that decrementing counts by inputting a negative value is allowed,
 // for example if you want to remove some users you have previously added.
@@ -136,6 +156,9 @@ func (c *Count) IncrementBy(count int64) error {
 	if c.state != defaultState {
 		return fmt.Errorf("Count cannot be amended: %v", c.state.errorMessage())
 	}
+	if c.maxIncrement > 0 && (count > c.maxIncrement || count < -c.maxIncrement) {
+		return fmt.Errorf("IncrementBy: count %d exceeds MaxIncrement %d in absolute value", count, c.maxIncrement)
+	}
 	c.count += count
 	return nil
 }
@@ -277,6 +300,7 @@ type encodableCount struct {
 	Delta           float64
 	L0Sensitivity   int64
 	LInfSensitivity int64
+	MaxIncrement    int64
 	NoiseKind       noise.Kind
 	Count           int64
 }
@@ -291,6 +315,7 @@ func (c *Count) GobEncode() ([]byte, error) {
 		Delta:           c.delta,
 		L0Sensitivity:   c.l0Sensitivity,
 		LInfSensitivity: c.lInfSensitivity,
+		MaxIncrement:    c.maxIncrement,
 		NoiseKind:       noise.ToKind(c.Noise),
 		Count:           c.count,
 	}
@@ -310,6 +335,7 @@ func (c *Count) GobDecode(data []byte) error {
 		delta:           enc.Delta,
 		l0Sensitivity:   enc.L0Sensitivity,
 		lInfSensitivity: enc.LInfSensitivity,
+		maxIncrement:    enc.MaxIncrement,
 		noiseKind:       enc.NoiseKind,
 		Noise:           noise.ToNoise(enc.NoiseKind),
 		count:           enc.Count,
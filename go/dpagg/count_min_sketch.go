@@ -0,0 +1,318 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+)
+
+// maxCountMinSketchCells is the maximum number of cells of a CountMinSketch,
+// i.e. of Width*Depth.
+const maxCountMinSketchCells = 1 << 24
+
+// CountMinSketch calculates a differentially private count-min sketch of a
+// collection of keys, which answers approximate frequency queries over key
+// domains that are too large for an exact count per key.
+//
+// The sketch has Depth rows of Width cells. Each row has its own hash
+// function, and adding a key increments one cell per row. Noise is added to
+// every cell, whether keys were added to it or not, so the noisy sketch can be
+// released and queried for any key, including keys that were never added.
+//
+// A privacy unit contributing to MaxPartitionsContributed keys changes
+// Depth*MaxPartitionsContributed cells, so the noise added to each cell is
+// scaled accordingly: a larger Depth makes estimates more robust to
+// collisions, but noisier.
+//
+// The hash functions are fixed, so that sketches are mergeable; they don't
+// protect against adversarially chosen keys colliding.
+//
+// Not thread-safe.
+type CountMinSketch struct {
+	// Parameters
+	epsilon         float64
+	delta           float64
+	l0Sensitivity   int64
+	lInfSensitivity int64
+	width           int64
+	depth           int64
+	Noise           noise.Noise
+	noiseKind       noise.Kind // necessary for serializing noise.Noise information
+
+	// State variables
+	cells []int64
+	state aggregationState
+}
+
+func countMinSketchEquallyInitialized(s1, s2 *CountMinSketch) bool {
+	return s1.epsilon == s2.epsilon &&
+		s1.delta == s2.delta &&
+		s1.l0Sensitivity == s2.l0Sensitivity &&
+		s1.lInfSensitivity == s2.lInfSensitivity &&
+		s1.width == s2.width &&
+		s1.depth == s2.depth &&
+		s1.noiseKind == s2.noiseKind &&
+		s1.state == s2.state
+}
+
+// CountMinSketchOptions contains the options necessary to initialize a
+// CountMinSketch.
+type CountMinSketchOptions struct {
+	Epsilon                  float64     // Privacy parameter ε. Required.
+	Delta                    float64     // Privacy parameter δ. Required with Gaussian noise, must be 0 with Laplace noise.
+	MaxPartitionsContributed int64       // How many distinct keys may a single privacy unit contribute to? Required.
+	Noise                    noise.Noise // Type of noise used. Defaults to Laplace noise.
+	// How many times may a single privacy unit contribute to a single key?
+	// Defaults to 1.
+	MaxContributionsPerPartition int64
+	// Number of cells of each row. The estimate of a key overcounts it by the
+	// counts of the keys colliding with it; without noise, the overcount is at
+	// most e/Width times the total count with probability 1-exp(-Depth).
+	// Required.
+	Width int64
+	// Number of rows, i.e. of hash functions. Required.
+	Depth int64
+}
+
+// NewCountMinSketch returns a new CountMinSketch, with all cells at 0.
+func NewCountMinSketch(opt *CountMinSketchOptions) (*CountMinSketch, error) {
+	if opt == nil {
+		opt = &CountMinSketchOptions{} // Prevents panicking due to a nil pointer dereference.
+	}
+	if opt.MaxPartitionsContributed <= 0 {
+		return nil, fmt.Errorf("NewCountMinSketch: MaxPartitionsContributed must be strictly positive, got %d", opt.MaxPartitionsContributed)
+	}
+	if opt.Width <= 0 || opt.Depth <= 0 {
+		return nil, fmt.Errorf("NewCountMinSketch: Width and Depth must be strictly positive, got Width=%d and Depth=%d", opt.Width, opt.Depth)
+	}
+	if opt.Width > maxCountMinSketchCells/opt.Depth {
+		return nil, fmt.Errorf("NewCountMinSketch: Width*Depth must be at most %d, got Width=%d and Depth=%d", maxCountMinSketchCells, opt.Width, opt.Depth)
+	}
+	lInf := opt.MaxContributionsPerPartition
+	if lInf < 0 {
+		return nil, fmt.Errorf("NewCountMinSketch: MaxContributionsPerPartition must be non-negative, got %d", lInf)
+	}
+	if lInf == 0 {
+		lInf = 1
+	}
+	// Each key of a privacy unit changes one cell per row.
+	if opt.MaxPartitionsContributed > math.MaxInt64/opt.Depth {
+		return nil, fmt.Errorf("NewCountMinSketch: MaxPartitionsContributed*Depth overflows, got MaxPartitionsContributed=%d and Depth=%d", opt.MaxPartitionsContributed, opt.Depth)
+	}
+	l0 := opt.MaxPartitionsContributed * opt.Depth
+
+	n := opt.Noise
+	if n == nil {
+		n = noise.Laplace()
+	}
+	// Check that the parameters are compatible with the noise chosen by calling
+	// the noise on some placeholder value.
+	eps, del := opt.Epsilon, opt.Delta
+	_, err := n.AddNoiseInt64(0, l0, lInf, eps, del)
+	if err != nil {
+		return nil, fmt.Errorf("NewCountMinSketch: %w", err)
+	}
+
+	return &CountMinSketch{
+		epsilon:         eps,
+		delta:           del,
+		l0Sensitivity:   l0,
+		lInfSensitivity: lInf,
+		width:           opt.Width,
+		depth:           opt.Depth,
+		Noise:           n,
+		noiseKind:       noise.ToKind(n),
+		cells:           make([]int64, opt.Width*opt.Depth),
+		state:           defaultState,
+	}, nil
+}
+
+// Increment adds a single contribution of a privacy unit to key.
+func (s *CountMinSketch) Increment(key []byte) error {
+	return s.IncrementBy(key, 1)
+}
+
+// IncrementBy adds count contributions of a single privacy unit to key, e.g. a
+// pre-counted batch of its events. It returns an error if the absolute value
+// of count is larger than MaxContributionsPerPartition. Each privacy unit must
+// be added to each of its keys with a single call.
+func (s *CountMinSketch) IncrementBy(key []byte, count int64) error {
+	if s.state != defaultState {
+		return fmt.Errorf("CountMinSketch cannot be amended: %v", s.state.errorMessage())
+	}
+	if count > s.lInfSensitivity || count < -s.lInfSensitivity {
+		return fmt.Errorf("IncrementBy: count %d exceeds MaxContributionsPerPartition %d in absolute value", count, s.lInfSensitivity)
+	}
+	for row := int64(0); row < s.depth; row++ {
+		s.cells[row*s.width+countMinSketchColumn(key, row, s.width)] += count
+	}
+	return nil
+}
+
+// Merge merges s2 into s (i.e., adds to s all entries that were added to s2).
+// s2 is consumed by this operation: it may not be used after it is merged
+// into s.
+func (s *CountMinSketch) Merge(s2 *CountMinSketch) error {
+	return s.MergeContext(context.Background(), s2)
+}
+
+// MergeContext is like Merge, but returns ctx.Err() if ctx is done before the
+// merge completes. Cells are moved from s2 to s as they are merged, so both
+// remain usable, and calling MergeContext again resumes the merge.
+func (s *CountMinSketch) MergeContext(ctx context.Context, s2 *CountMinSketch) error {
+	if err := checkMergeCountMinSketch(s, s2); err != nil {
+		return err
+	}
+	for i, c := range s2.cells {
+		if i%contextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		s.cells[i] += c
+		s2.cells[i] = 0
+	}
+	s2.state = merged
+	return nil
+}
+
+func checkMergeCountMinSketch(s1, s2 *CountMinSketch) error {
+	if s1.state != defaultState {
+		return fmt.Errorf("checkMergeCountMinSketch: s1 cannot be merged with another CountMinSketch instance: %v", s1.state.errorMessage())
+	}
+	if s2.state != defaultState {
+		return fmt.Errorf("checkMergeCountMinSketch: s2 cannot be merged with another CountMinSketch instance: %v", s2.state.errorMessage())
+	}
+	if !countMinSketchEquallyInitialized(s1, s2) {
+		return fmt.Errorf("checkMergeCountMinSketch: s1 and s2 are not compatible")
+	}
+	return nil
+}
+
+// Result returns a differentially private version of the sketch, with noise
+// added to every cell. The method can be called only once.
+func (s *CountMinSketch) Result() (*NoisyCountMinSketch, error) {
+	if s.state != defaultState {
+		return nil, fmt.Errorf("CountMinSketch's noised result cannot be computed: %s", s.state.errorMessage())
+	}
+	s.state = resultReturned
+	noisy := &NoisyCountMinSketch{Width: s.width, Depth: s.depth, Cells: make([]int64, len(s.cells))}
+	for i, c := range s.cells {
+		var err error
+		noisy.Cells[i], err = s.Noise.AddNoiseInt64(c, s.l0Sensitivity, s.lInfSensitivity, s.epsilon, s.delta)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return noisy, nil
+}
+
+// NoisyCountMinSketch is the differentially private output of a
+// CountMinSketch. It can be released, and queried for any key without
+// consuming privacy budget.
+type NoisyCountMinSketch struct {
+	Width, Depth int64
+	// Noisy cells, row by row.
+	Cells []int64
+}
+
+// Estimate returns the estimated count of key, i.e. the smallest of its noisy
+// cells. Collisions with other keys make the raw cells overcount key, which
+// taking the smallest cell mitigates; but the noise can make the estimate
+// smaller than the true count, in particular with a large Depth.
+func (s *NoisyCountMinSketch) Estimate(key []byte) int64 {
+	estimate := int64(math.MaxInt64)
+	for row := int64(0); row < s.Depth; row++ {
+		if c := s.Cells[row*s.Width+countMinSketchColumn(key, row, s.Width)]; c < estimate {
+			estimate = c
+		}
+	}
+	return estimate
+}
+
+// countMinSketchColumn returns the cell of key in the given row, using the
+// FNV-1a hash of the row index and key.
+func countMinSketchColumn(key []byte, row, width int64) int64 {
+	h := fnv.New64a()
+	var rowBytes [8]byte
+	binary.LittleEndian.PutUint64(rowBytes[:], uint64(row))
+	h.Write(rowBytes[:])
+	h.Write(key)
+	return int64(h.Sum64() % uint64(width))
+}
+
+// encodableCountMinSketch can be encoded by the gob package.
+type encodableCountMinSketch struct {
+	Epsilon         float64
+	Delta           float64
+	L0Sensitivity   int64
+	LInfSensitivity int64
+	Width           int64
+	Depth           int64
+	NoiseKind       noise.Kind
+	Cells           []int64
+}
+
+// GobEncode encodes CountMinSketch.
+func (s *CountMinSketch) GobEncode() ([]byte, error) {
+	if s.state != defaultState && s.state != serialized {
+		return nil, fmt.Errorf("CountMinSketch object cannot be serialized: %s", s.state.errorMessage())
+	}
+	enc := encodableCountMinSketch{
+		Epsilon:         s.epsilon,
+		Delta:           s.delta,
+		L0Sensitivity:   s.l0Sensitivity,
+		LInfSensitivity: s.lInfSensitivity,
+		Width:           s.width,
+		Depth:           s.depth,
+		NoiseKind:       noise.ToKind(s.Noise),
+		Cells:           s.cells,
+	}
+	s.state = serialized
+	return encode(enc)
+}
+
+// GobDecode decodes CountMinSketch.
+func (s *CountMinSketch) GobDecode(data []byte) error {
+	var enc encodableCountMinSketch
+	err := decode(&enc, data)
+	if err != nil {
+		return fmt.Errorf("couldn't decode CountMinSketch from bytes")
+	}
+	if int64(len(enc.Cells)) != enc.Width*enc.Depth {
+		return fmt.Errorf("couldn't decode CountMinSketch from bytes: got %d cells, want Width*Depth=%d", len(enc.Cells), enc.Width*enc.Depth)
+	}
+	*s = CountMinSketch{
+		epsilon:         enc.Epsilon,
+		delta:           enc.Delta,
+		l0Sensitivity:   enc.L0Sensitivity,
+		lInfSensitivity: enc.LInfSensitivity,
+		width:           enc.Width,
+		depth:           enc.Depth,
+		noiseKind:       enc.NoiseKind,
+		Noise:           noise.ToNoise(enc.NoiseKind),
+		cells:           enc.Cells,
+		state:           defaultState,
+	}
+	return nil
+}
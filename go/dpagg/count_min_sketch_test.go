@@ -0,0 +1,264 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/go-cmp/cmp"
+)
+
+func getNoiselessCountMinSketch(t *testing.T, width, depth int64) *CountMinSketch {
+	t.Helper()
+	s, err := NewCountMinSketch(&CountMinSketchOptions{
+		Epsilon:                  ln3,
+		MaxPartitionsContributed: 1,
+		Noise:                    noNoise{},
+		Width:                    width,
+		Depth:                    depth,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless count-min sketch: %v", err)
+	}
+	return s
+}
+
+func TestNewCountMinSketchErrors(t *testing.T) {
+	valid := CountMinSketchOptions{Epsilon: ln3, MaxPartitionsContributed: 1, Width: 100, Depth: 3}
+	for _, tc := range []struct {
+		desc   string
+		modify func(*CountMinSketchOptions)
+	}{
+		{"MaxPartitionsContributed unset", func(o *CountMinSketchOptions) { o.MaxPartitionsContributed = 0 }},
+		{"negative MaxContributionsPerPartition", func(o *CountMinSketchOptions) { o.MaxContributionsPerPartition = -1 }},
+		{"Width unset", func(o *CountMinSketchOptions) { o.Width = 0 }},
+		{"Depth unset", func(o *CountMinSketchOptions) { o.Depth = 0 }},
+		{"too many cells", func(o *CountMinSketchOptions) { o.Width, o.Depth = maxCountMinSketchCells, 2 }},
+		{"epsilon unset", func(o *CountMinSketchOptions) { o.Epsilon = 0 }},
+		{"delta set with Laplace noise", func(o *CountMinSketchOptions) { o.Delta = 1e-5 }},
+	} {
+		opt := valid
+		tc.modify(&opt)
+		if _, err := NewCountMinSketch(&opt); err == nil {
+			t.Errorf("NewCountMinSketch: when %s got no error", tc.desc)
+		}
+	}
+	if _, err := NewCountMinSketch(&valid); err != nil {
+		t.Errorf("NewCountMinSketch(%+v): %v", valid, err)
+	}
+}
+
+func TestCountMinSketchEstimate(t *testing.T) {
+	s := getNoiselessCountMinSketch(t, 1000, 4)
+	want := map[string]int64{"a": 3, "b": 1, "c": 10}
+	for key, count := range want {
+		for i := int64(0); i < count; i++ {
+			if err := s.Increment([]byte(key)); err != nil {
+				t.Fatalf("Increment(%q): %v", key, err)
+			}
+		}
+	}
+	noisy, err := s.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	// With 1000 cells per row and 3 keys, the keys don't collide in every row.
+	want["d"] = 0
+	for key, count := range want {
+		if got := noisy.Estimate([]byte(key)); got != count {
+			t.Errorf("Estimate(%q): got %d, want %d", key, got, count)
+		}
+	}
+}
+
+func TestCountMinSketchEstimateOvercountsCollisions(t *testing.T) {
+	// With a single cell per row, all keys collide.
+	s := getNoiselessCountMinSketch(t, 1, 2)
+	for i := 0; i < 5; i++ {
+		if err := s.Increment([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Increment(%d): %v", i, err)
+		}
+	}
+	noisy, err := s.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if got := noisy.Estimate([]byte("0")); got != 5 {
+		t.Errorf("Estimate(%q): got %d, want 5", "0", got)
+	}
+}
+
+func TestCountMinSketchIncrementBy(t *testing.T) {
+	s, err := NewCountMinSketch(&CountMinSketchOptions{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 3,
+		Noise:                        noNoise{},
+		Width:                        100,
+		Depth:                        2,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize s: %v", err)
+	}
+	if err := s.IncrementBy([]byte("a"), 3); err != nil {
+		t.Errorf("IncrementBy(3) with MaxContributionsPerPartition=3: %v", err)
+	}
+	if err := s.IncrementBy([]byte("a"), -4); err == nil {
+		t.Errorf("IncrementBy(-4) with MaxContributionsPerPartition=3 returned no error")
+	}
+}
+
+func TestCountMinSketchMerge(t *testing.T) {
+	s1 := getNoiselessCountMinSketch(t, 100, 3)
+	s2 := getNoiselessCountMinSketch(t, 100, 3)
+	s1.Increment([]byte("a"))
+	s2.Increment([]byte("a"))
+	s2.Increment([]byte("b"))
+	if err := s1.Merge(s2); err != nil {
+		t.Fatalf("Couldn't merge s1 and s2: %v", err)
+	}
+	noisy, err := s1.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if got := noisy.Estimate([]byte("a")); got != 2 {
+		t.Errorf("Merge: Estimate(%q) got %d, want 2", "a", got)
+	}
+	if s2.state != merged {
+		t.Errorf("Merge: for s2.state got %v, want Merged", s2.state)
+	}
+}
+
+func TestCountMinSketchMergeContextCancelled(t *testing.T) {
+	s1 := getNoiselessCountMinSketch(t, 100, 3)
+	s2 := getNoiselessCountMinSketch(t, 100, 3)
+	s1.Increment([]byte("a"))
+	s2.Increment([]byte("a"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s1.MergeContext(ctx, s2); !errors.Is(err, context.Canceled) {
+		t.Errorf("MergeContext with a cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+	if s2.state != defaultState {
+		t.Errorf("MergeContext with a cancelled context: for s2.state got %v, want Default", s2.state)
+	}
+	// The merge can be resumed after the cancellation.
+	if err := s1.MergeContext(context.Background(), s2); err != nil {
+		t.Fatalf("Couldn't merge s1 and s2: %v", err)
+	}
+	noisy, err := s1.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if got := noisy.Estimate([]byte("a")); got != 2 {
+		t.Errorf("MergeContext: Estimate(%q) got %d, want 2", "a", got)
+	}
+}
+
+func TestCountMinSketchCheckMergeCompatibility(t *testing.T) {
+	for _, tc := range []struct {
+		desc         string
+		width, depth int64
+		wantErr      bool
+	}{
+		{"same dimensions", 100, 3, false},
+		{"different width", 50, 3, true},
+		{"different depth", 100, 2, true},
+	} {
+		s1 := getNoiselessCountMinSketch(t, 100, 3)
+		s2 := getNoiselessCountMinSketch(t, tc.width, tc.depth)
+		if err := checkMergeCountMinSketch(s1, s2); (err != nil) != tc.wantErr {
+			t.Errorf("checkMergeCountMinSketch: when %s for err got %v, wantErr %t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCountMinSketchSerialization(t *testing.T) {
+	s, err := NewCountMinSketch(&CountMinSketchOptions{
+		Epsilon:                  ln3,
+		Delta:                    1e-5,
+		MaxPartitionsContributed: 2,
+		Noise:                    noise.Gaussian(),
+		Width:                    10,
+		Depth:                    3,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize s: %v", err)
+	}
+	s.Increment([]byte("a"))
+	want := &CountMinSketch{
+		epsilon:         s.epsilon,
+		delta:           s.delta,
+		l0Sensitivity:   s.l0Sensitivity,
+		lInfSensitivity: s.lInfSensitivity,
+		width:           s.width,
+		depth:           s.depth,
+		noiseKind:       s.noiseKind,
+		cells:           append([]int64(nil), s.cells...),
+	}
+	bytes, err := encode(s)
+	if err != nil {
+		t.Fatalf("encode(CountMinSketch) error: %v", err)
+	}
+	got := new(CountMinSketch)
+	if err := decode(got, bytes); err != nil {
+		t.Fatalf("decode(CountMinSketch) error: %v", err)
+	}
+	got.Noise = nil
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(CountMinSketch{})); diff != "" {
+		t.Errorf("decode(encode(_)) returned diff (-want +got):\n%s", diff)
+	}
+	if s.state != serialized {
+		t.Errorf("CountMinSketch should have its state set to Serialized, got %v, want Serialized", s.state)
+	}
+}
+
+// mockCountMinSketchNoise checks that the noise of a CountMinSketch is scaled
+// to the number of cells that a privacy unit can change.
+type mockCountMinSketchNoise struct {
+	t *testing.T
+	noise.Noise
+}
+
+func (mn mockCountMinSketchNoise) AddNoiseInt64(x, l0, lInf int64, eps, del float64) (int64, error) {
+	if l0 != 6 || lInf != 2 {
+		mn.t.Errorf("AddNoiseInt64: got l0=%d and lInf=%d, want l0=6 (MaxPartitionsContributed*Depth) and lInf=2", l0, lInf)
+	}
+	return x, nil
+}
+
+func TestCountMinSketchNoiseIsCorrectlyCalled(t *testing.T) {
+	s, err := NewCountMinSketch(&CountMinSketchOptions{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     2,
+		MaxContributionsPerPartition: 2,
+		Noise:                        mockCountMinSketchNoise{t: t},
+		Width:                        10,
+		Depth:                        3,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize s: %v", err)
+	}
+	s.Increment([]byte("a"))
+	if _, err := s.Result(); err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+}
@@ -116,6 +116,34 @@ func TestNewCount(t *testing.T) {
 			},
 			nil,
 			true},
+		{"MaxIncrement is set",
+			&CountOptions{
+				Epsilon:                  ln3,
+				MaxPartitionsContributed: 1,
+				MaxIncrement:             5,
+				Noise:                    noise.Laplace(),
+			},
+			&Count{
+				epsilon:         ln3,
+				delta:           0,
+				l0Sensitivity:   1,
+				lInfSensitivity: 5,
+				maxIncrement:    5,
+				Noise:           noise.Laplace(),
+				noiseKind:       noise.LaplaceNoise,
+				count:           0,
+				state:           defaultState,
+			},
+			false},
+		{"Negative MaxIncrement",
+			&CountOptions{
+				Epsilon:                  ln3,
+				MaxPartitionsContributed: 1,
+				MaxIncrement:             -1,
+				Noise:                    noise.Laplace(),
+			},
+			nil,
+			true},
 	} {
 		c, err := NewCount(tc.opt)
 		if (err != nil) != tc.wantErr {
@@ -132,6 +160,7 @@ func compareCount(c1, c2 *Count) bool {
 		c1.delta == c2.delta &&
 		c1.l0Sensitivity == c2.l0Sensitivity &&
 		c1.lInfSensitivity == c2.lInfSensitivity &&
+		c1.maxIncrement == c2.maxIncrement &&
 		c1.Noise == c2.Noise &&
 		c1.noiseKind == c2.noiseKind &&
 		c1.count == c2.count &&
@@ -155,6 +184,11 @@ func TestCountSerialization(t *testing.T) {
 			MaxPartitionsContributed: 5,
 			Noise:                    noise.Gaussian(),
 		}},
+		{"MaxIncrement", &CountOptions{
+			Epsilon:                  ln3,
+			MaxPartitionsContributed: 1,
+			MaxIncrement:             10,
+		}},
 	} {
 		c, err := NewCount(tc.opts)
 		if err != nil {
@@ -247,6 +281,32 @@ func TestCountIncrementBy_NegativeValues(t *testing.T) {
 	}
 }
 
+func TestCountIncrementByWithMaxIncrement(t *testing.T) {
+	c, err := NewCount(&CountOptions{
+		Epsilon:                  ln3,
+		Delta:                    tenten,
+		MaxPartitionsContributed: 1,
+		MaxIncrement:             3,
+		Noise:                    noNoise{},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize count: %v", err)
+	}
+	for _, k := range []int64{3, 1, -3} {
+		if err := c.IncrementBy(k); err != nil {
+			t.Errorf("IncrementBy(%d): got error %v", k, err)
+		}
+	}
+	for _, k := range []int64{4, -4} {
+		if err := c.IncrementBy(k); err == nil {
+			t.Errorf("IncrementBy(%d): got no error, want error since MaxIncrement is 3", k)
+		}
+	}
+	if c.count != 1 {
+		t.Errorf("IncrementBy: got count %d, want %d", c.count, 1)
+	}
+}
+
 func TestCountMerge(t *testing.T) {
 	c1 := getNoiselessCount(t)
 	c2 := getNoiselessCount(t)
@@ -0,0 +1,212 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/rand"
+)
+
+// RandomizedResponse is an ε-label differentially private mechanism for
+// releasing categorical labels, e.g. for producing training data whose labels
+// must be protected.
+//
+// Labels are integers in [0, NumLabels). Without a prior, each label is
+// reported truthfully with probability exp(ε)/(exp(ε)+k-1) and replaced by
+// one of the k-1 other labels chosen uniformly at random otherwise, where k is
+// NumLabels.
+//
+// If a prior over the labels is known (from public data, or from a model
+// trained on a disjoint dataset), RandomizedResponse uses the
+// "randomized response with prior" mechanism from
+// https://arxiv.org/abs/2102.06062: it only ever reports one of the k' labels
+// with the highest prior, where k' maximizes the probability of reporting the
+// true label. A true label outside of those k' labels is replaced by one of
+// them chosen uniformly at random.
+//
+// Use DebiasCounts to obtain unbiased estimates of the true label histogram
+// from the reported labels.
+type RandomizedResponse struct {
+	epsilon   float64
+	numLabels int
+	// keptLabels are the labels that can be reported, in decreasing order of
+	// prior probability.
+	keptLabels []int
+	isKept     []bool
+}
+
+// RandomizedResponseOptions contains the options necessary to initialize a
+// RandomizedResponse.
+type RandomizedResponseOptions struct {
+	Epsilon   float64 // Privacy parameter ε. Required.
+	NumLabels int     // Number of possible labels. Must be at least 2. Required.
+	// Prior probability of each label. If set, must have NumLabels
+	// non-negative entries. Entries do not need to sum to 1. Optional.
+	Prior []float64
+}
+
+// NewRandomizedResponse returns a new RandomizedResponse.
+func NewRandomizedResponse(opt *RandomizedResponseOptions) (*RandomizedResponse, error) {
+	if opt == nil {
+		opt = &RandomizedResponseOptions{} // Prevents panicking due to a nil pointer dereference.
+	}
+	if err := checks.CheckEpsilonStrict(opt.Epsilon); err != nil {
+		return nil, fmt.Errorf("NewRandomizedResponse: %w", err)
+	}
+	if opt.NumLabels < 2 {
+		return nil, fmt.Errorf("NewRandomizedResponse: NumLabels is %d, must be at least 2", opt.NumLabels)
+	}
+	labels := make([]int, opt.NumLabels)
+	for i := range labels {
+		labels[i] = i
+	}
+	keptLabels := labels
+	if opt.Prior != nil {
+		if len(opt.Prior) != opt.NumLabels {
+			return nil, fmt.Errorf("NewRandomizedResponse: Prior has %d entries, must have NumLabels=%d entries", len(opt.Prior), opt.NumLabels)
+		}
+		var total float64
+		for i, p := range opt.Prior {
+			if math.IsNaN(p) || math.IsInf(p, 0) || p < 0 {
+				return nil, fmt.Errorf("NewRandomizedResponse: Prior[%d] is %f, must be finite and non-negative", i, p)
+			}
+			total += p
+		}
+		if total <= 0 {
+			return nil, fmt.Errorf("NewRandomizedResponse: Prior must have at least one positive entry")
+		}
+		keptLabels = topLabelsByPrior(labels, opt.Prior, opt.Epsilon)
+	}
+	isKept := make([]bool, opt.NumLabels)
+	for _, l := range keptLabels {
+		isKept[l] = true
+	}
+	return &RandomizedResponse{
+		epsilon:    opt.Epsilon,
+		numLabels:  opt.NumLabels,
+		keptLabels: keptLabels,
+		isKept:     isKept,
+	}, nil
+}
+
+// topLabelsByPrior returns the k labels with the highest prior, where k
+// maximizes the probability that the true label is reported, i.e.
+// (sum of the k largest priors) * exp(ε)/(exp(ε)+k-1).
+func topLabelsByPrior(labels []int, prior []float64, epsilon float64) []int {
+	sorted := make([]int, len(labels))
+	copy(sorted, labels)
+	sort.SliceStable(sorted, func(i, j int) bool { return prior[sorted[i]] > prior[sorted[j]] })
+	bestK, bestScore := 1, math.Inf(-1)
+	var cumulative float64
+	for k := 1; k <= len(sorted); k++ {
+		cumulative += prior[sorted[k-1]]
+		score := cumulative * truthProbability(epsilon, k)
+		if score > bestScore {
+			bestK, bestScore = k, score
+		}
+	}
+	return sorted[:bestK]
+}
+
+// truthProbability returns the probability that k-ary randomized response
+// reports the true label.
+func truthProbability(epsilon float64, k int) float64 {
+	return 1 / (1 + float64(k-1)*math.Exp(-epsilon))
+}
+
+// Randomize returns a randomized version of label.
+func (rr *RandomizedResponse) Randomize(label int) (int, error) {
+	if label < 0 || label >= rr.numLabels {
+		return 0, fmt.Errorf("Randomize: label is %d, must be in [0, %d)", label, rr.numLabels)
+	}
+	k := len(rr.keptLabels)
+	if !rr.isKept[label] {
+		return rr.keptLabels[rand.I63n(int64(k))], nil
+	}
+	if rand.Uniform() <= truthProbability(rr.epsilon, k) {
+		return label, nil
+	}
+	// Pick one of the k-1 other kept labels uniformly at random.
+	other := rr.keptLabels[rand.I63n(int64(k-1))]
+	if other == label {
+		other = rr.keptLabels[k-1]
+	}
+	return other, nil
+}
+
+// KeptLabels returns the labels that Randomize can output, in decreasing order
+// of prior probability. If no prior was specified, all labels are kept.
+func (rr *RandomizedResponse) KeptLabels() []int {
+	kept := make([]int, len(rr.keptLabels))
+	copy(kept, rr.keptLabels)
+	return kept
+}
+
+// TransitionProbability returns the probability that Randomize reports the
+// label reported when called with trueLabel. This can be used e.g. for
+// correcting the loss of a model trained on randomized labels.
+func (rr *RandomizedResponse) TransitionProbability(trueLabel, reported int) (float64, error) {
+	if trueLabel < 0 || trueLabel >= rr.numLabels || reported < 0 || reported >= rr.numLabels {
+		return 0, fmt.Errorf("TransitionProbability: labels must be in [0, %d), got trueLabel=%d and reported=%d", rr.numLabels, trueLabel, reported)
+	}
+	if !rr.isKept[reported] {
+		return 0, nil
+	}
+	k := len(rr.keptLabels)
+	if !rr.isKept[trueLabel] {
+		return 1 / float64(k), nil
+	}
+	p := truthProbability(rr.epsilon, k)
+	if trueLabel == reported {
+		return p, nil
+	}
+	return (1 - p) / float64(k-1), nil
+}
+
+// DebiasCounts returns unbiased estimates of the number of records having each
+// label, given the number of times each label was reported by Randomize.
+// observedCounts must have NumLabels entries. The estimates can be negative.
+//
+// DebiasCounts is only supported when all labels are kept: if a prior
+// restricted the set of reported labels, the counts of labels that are never
+// reported cannot be recovered.
+func (rr *RandomizedResponse) DebiasCounts(observedCounts []int64) ([]float64, error) {
+	if len(observedCounts) != rr.numLabels {
+		return nil, fmt.Errorf("DebiasCounts: observedCounts has %d entries, must have %d", len(observedCounts), rr.numLabels)
+	}
+	if len(rr.keptLabels) != rr.numLabels {
+		return nil, fmt.Errorf("DebiasCounts: only %d of %d labels are kept due to the prior, counts cannot be debiased", len(rr.keptLabels), rr.numLabels)
+	}
+	var n float64
+	for i, c := range observedCounts {
+		if c < 0 {
+			return nil, fmt.Errorf("DebiasCounts: observedCounts[%d] is %d, must be non-negative", i, c)
+		}
+		n += float64(c)
+	}
+	p := truthProbability(rr.epsilon, rr.numLabels)
+	q := (1 - p) / float64(rr.numLabels-1)
+	debiased := make([]float64, rr.numLabels)
+	for i, c := range observedCounts {
+		debiased[i] = (float64(c) - n*q) / (p - q)
+	}
+	return debiased, nil
+}
@@ -0,0 +1,191 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewRandomizedResponse(t *testing.T) {
+	for _, tc := range []struct {
+		desc           string
+		opt            *RandomizedResponseOptions
+		wantKeptLabels []int
+		wantErr        bool
+	}{
+		{"no prior keeps all labels",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 3},
+			[]int{0, 1, 2},
+			false},
+		{"nil options",
+			nil,
+			nil,
+			true},
+		{"epsilon is not set",
+			&RandomizedResponseOptions{NumLabels: 3},
+			nil,
+			true},
+		{"single label",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 1},
+			nil,
+			true},
+		{"prior with wrong length",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 3, Prior: []float64{0.5, 0.5}},
+			nil,
+			true},
+		{"negative prior",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 2, Prior: []float64{-0.5, 1.5}},
+			nil,
+			true},
+		{"all-zero prior",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 2, Prior: []float64{0, 0}},
+			nil,
+			true},
+		{"uniform prior keeps all labels",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 3, Prior: []float64{1, 1, 1}},
+			[]int{0, 1, 2},
+			false},
+		// With ε=1, keeping only labels 2 and 0 yields a probability of reporting
+		// the true label of 0.9*e/(e+1) ≈ 0.658, higher than keeping only label 2
+		// (0.6) or labels 2, 0 and 1 (0.95*e/(e+2) ≈ 0.547).
+		{"skewed prior keeps most likely labels",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 4, Prior: []float64{0.3, 0.05, 0.6, 0.05}},
+			[]int{2, 0},
+			false},
+		{"extremely skewed prior keeps a single label",
+			&RandomizedResponseOptions{Epsilon: 1, NumLabels: 3, Prior: []float64{0.01, 0.98, 0.01}},
+			[]int{1},
+			false},
+	} {
+		rr, err := NewRandomizedResponse(tc.opt)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("NewRandomizedResponse: when %s for err got %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if diff := cmp.Diff(tc.wantKeptLabels, rr.KeptLabels()); diff != "" {
+			t.Errorf("KeptLabels: when %s got diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestRandomizedResponseRandomizeOutOfRange(t *testing.T) {
+	rr, err := NewRandomizedResponse(&RandomizedResponseOptions{Epsilon: 1, NumLabels: 3})
+	if err != nil {
+		t.Fatalf("Couldn't initialize rr: %v", err)
+	}
+	for _, label := range []int{-1, 3} {
+		if _, err := rr.Randomize(label); err == nil {
+			t.Errorf("Randomize(%d): got no error, want error", label)
+		}
+	}
+}
+
+func TestRandomizedResponseTransitionProbabilities(t *testing.T) {
+	for _, opt := range []*RandomizedResponseOptions{
+		{Epsilon: 0.5, NumLabels: 5},
+		{Epsilon: 1, NumLabels: 4, Prior: []float64{0.3, 0.05, 0.6, 0.05}},
+	} {
+		rr, err := NewRandomizedResponse(opt)
+		if err != nil {
+			t.Fatalf("Couldn't initialize rr: %v", err)
+		}
+		for trueLabel := 0; trueLabel < opt.NumLabels; trueLabel++ {
+			var total float64
+			for reported := 0; reported < opt.NumLabels; reported++ {
+				p, err := rr.TransitionProbability(trueLabel, reported)
+				if err != nil {
+					t.Fatalf("TransitionProbability(%d, %d): got err %v", trueLabel, reported, err)
+				}
+				total += p
+				// The probability ratio of any output between two inputs must be
+				// bounded by exp(ε).
+				for otherLabel := 0; otherLabel < opt.NumLabels; otherLabel++ {
+					q, _ := rr.TransitionProbability(otherLabel, reported)
+					if p > math.Exp(opt.Epsilon)*q+1e-12 {
+						t.Errorf("TransitionProbability(%d, %d)=%f > exp(ε) * TransitionProbability(%d, %d)=%f", trueLabel, reported, p, otherLabel, reported, q)
+					}
+				}
+			}
+			if !ApproxEqual(total, 1) {
+				t.Errorf("TransitionProbability(%d, ·) sums to %f, want 1", trueLabel, total)
+			}
+		}
+	}
+}
+
+func TestRandomizedResponseRandomizeDistribution(t *testing.T) {
+	epsilon, numLabels, numSamples := 1.0, 3, 100000
+	rr, err := NewRandomizedResponse(&RandomizedResponseOptions{Epsilon: epsilon, NumLabels: numLabels})
+	if err != nil {
+		t.Fatalf("Couldn't initialize rr: %v", err)
+	}
+	counts := make([]int, numLabels)
+	for i := 0; i < numSamples; i++ {
+		got, err := rr.Randomize(0)
+		if err != nil {
+			t.Fatalf("Randomize(0): got err %v", err)
+		}
+		counts[got]++
+	}
+	for label, c := range counts {
+		want, _ := rr.TransitionProbability(0, label)
+		got := float64(c) / float64(numSamples)
+		// The standard deviation of got is at most 0.0016, so this fails with
+		// negligible probability.
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("Randomize(0) returned %d with frequency %f, want %f", label, got, want)
+		}
+	}
+}
+
+func TestRandomizedResponseDebiasCounts(t *testing.T) {
+	rr, err := NewRandomizedResponse(&RandomizedResponseOptions{Epsilon: math.Log(3), NumLabels: 3})
+	if err != nil {
+		t.Fatalf("Couldn't initialize rr: %v", err)
+	}
+	// With ε=ln(3) and 3 labels, a label is kept with probability 3/5 and
+	// replaced by each other label with probability 1/5. The expected reported
+	// counts for true counts {100, 50, 0} are thus {70, 50, 30}.
+	got, err := rr.DebiasCounts([]int64{70, 50, 30})
+	if err != nil {
+		t.Fatalf("DebiasCounts: got err %v", err)
+	}
+	want := []float64{100, 50, 0}
+	if diff := cmp.Diff(want, got, cmp.Comparer(ApproxEqual)); diff != "" {
+		t.Errorf("DebiasCounts: got diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := rr.DebiasCounts([]int64{1, 2}); err == nil {
+		t.Errorf("DebiasCounts with wrong number of counts: got no error, want error")
+	}
+	if _, err := rr.DebiasCounts([]int64{1, -2, 3}); err == nil {
+		t.Errorf("DebiasCounts with negative counts: got no error, want error")
+	}
+
+	rrWithPrior, err := NewRandomizedResponse(&RandomizedResponseOptions{Epsilon: 1, NumLabels: 4, Prior: []float64{0.3, 0.05, 0.6, 0.05}})
+	if err != nil {
+		t.Fatalf("Couldn't initialize rrWithPrior: %v", err)
+	}
+	if _, err := rrWithPrior.DebiasCounts([]int64{0, 0, 10, 10}); err == nil {
+		t.Errorf("DebiasCounts with restricted labels: got no error, want error")
+	}
+}
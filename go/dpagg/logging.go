@@ -0,0 +1,92 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"sync/atomic"
+)
+
+// LogLevel is the severity of a LogEntry.
+type LogLevel int
+
+// Log levels.
+const (
+	LogInfo LogLevel = iota
+	LogWarning
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogInfo:
+		return "Info"
+	case LogWarning:
+		return "Warning"
+	}
+	return "Unknown"
+}
+
+// LogEntry is a diagnostic emitted by the library.
+//
+// Entries are privacy-safe by construction: Message describes the event
+// without depending on the data, and Params only holds numeric parameters
+// (e.g. privacy budgets, bounds, contribution limits) and counts that are
+// already differentially private. Entries never contain input values or
+// partition keys, so they can be forwarded to a logging stack without further
+// redaction.
+type LogEntry struct {
+	Level LogLevel
+	// Function that emitted the entry, e.g. "NewBoundedSumInt64".
+	Source  string
+	Message string
+	Params  map[string]float64
+}
+
+// Logger receives the diagnostics of dpagg and of libraries built on it, like
+// Privacy on Beam. Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(entry LogEntry)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogEntry) {}
+
+type loggerHolder struct{ l Logger }
+
+var logger atomic.Pointer[loggerHolder]
+
+func init() {
+	logger.Store(&loggerHolder{nopLogger{}})
+}
+
+// SetLogger sets the Logger receiving the diagnostics of the library. By
+// default, diagnostics are dropped; SetLogger(nil) restores this behavior.
+//
+// Diagnostics are also logged with glog, regardless of the Logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger.Store(&loggerHolder{l})
+}
+
+// Log sends entry to the Logger set with SetLogger. It is meant for libraries
+// built on dpagg, which must only log entries satisfying the constraints of
+// LogEntry.
+func Log(entry LogEntry) {
+	logger.Load().l.Log(entry)
+}
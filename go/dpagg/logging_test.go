@@ -0,0 +1,79 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type recordingLogger struct {
+	mux     sync.Mutex
+	entries []LogEntry
+}
+
+func (l *recordingLogger) Log(entry LogEntry) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+func TestLoggerReceivesSensitivityOverflow(t *testing.T) {
+	l := &recordingLogger{}
+	SetLogger(l)
+	t.Cleanup(func() { SetLogger(nil) })
+
+	// With an unrecognised noise, the overflow of the lInf sensitivity is
+	// logged instead of returning an error.
+	_, err := NewBoundedSumInt64(&BoundedSumInt64Options{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		maxContributionsPerPartition: 2,
+		Lower:                        0,
+		Upper:                        math.MaxInt64,
+		Noise:                        noNoise{},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize BoundedSumInt64: %v", err)
+	}
+	want := []LogEntry{{
+		Level:   LogWarning,
+		Source:  "NewBoundedSumInt64",
+		Message: "lInf sensitivity overflows, using the largest representable value instead",
+		Params: map[string]float64{
+			"Lower":                        0,
+			"Upper":                        math.MaxInt64,
+			"MaxContributionsPerPartition": 2,
+		},
+	}}
+	if diff := cmp.Diff(want, l.entries); diff != "" {
+		t.Errorf("Logged entries (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetLoggerNil(t *testing.T) {
+	l := &recordingLogger{}
+	SetLogger(l)
+	SetLogger(nil)
+	Log(LogEntry{Level: LogInfo, Source: "TestSetLoggerNil", Message: "dropped"})
+	if len(l.entries) != 0 {
+		t.Errorf("SetLogger(nil): got %d entries logged to the previous Logger, want 0", len(l.entries))
+	}
+}
@@ -62,7 +62,10 @@ type BoundedMean struct {
 	// The midpoint between lower and upper bounds. It cannot be set by the user;
 	// it will be calculated based on the lower and upper values.
 	midPoint float64
-	state    aggregationState
+	// Sum of the clipped mass used for bias correction, nil if bias
+	// correction is disabled.
+	clippedMass *BoundedSumFloat64
+	state       aggregationState
 }
 
 func bmEquallyInitialized(bm1, bm2 *BoundedMean) bool {
@@ -71,7 +74,8 @@ func bmEquallyInitialized(bm1, bm2 *BoundedMean) bool {
 		bm1.midPoint == bm2.midPoint &&
 		bm1.state == bm2.state &&
 		countEquallyInitialized(&bm1.Count, &bm2.Count) &&
-		bsEquallyInitializedFloat64(&bm1.NormalizedSum, &bm2.NormalizedSum)
+		bsEquallyInitializedFloat64(&bm1.NormalizedSum, &bm2.NormalizedSum) &&
+		clippedMassEquallyInitialized(bm1.clippedMass, bm2.clippedMass)
 }
 
 // BoundedMeanOptions contains the options necessary to initialize a BoundedMean.
@@ -83,6 +87,9 @@ type BoundedMeanOptions struct {
 	// Lower and Upper bounds for clamping. Required; must be such that Lower < Upper.
 	Lower, Upper float64
 	Noise        noise.Noise // Type of noise used in BoundedMean. Defaults to Laplace noise.
+	// Widens the clamping range of the result with additional privacy budget.
+	// Optional; see BiasCorrectionOptions.
+	BiasCorrection *BiasCorrectionOptions
 }
 
 // NewBoundedMean returns a new BoundedMean.
@@ -179,12 +186,21 @@ func NewBoundedMean(opt *BoundedMeanOptions) (*BoundedMean, error) {
 		return nil, fmt.Errorf("couldn't initialize normalized sum for NewBoundedMean: %w", err)
 	}
 
+	var clippedMass *BoundedSumFloat64
+	if opt.BiasCorrection != nil {
+		clippedMass, err = newClippedMass(opt.BiasCorrection, maxPartitionsContributed, maxContributionsPerPartition, n)
+		if err != nil {
+			return nil, fmt.Errorf("NewBoundedMean: %w", err)
+		}
+	}
+
 	return &BoundedMean{
 		lower:         lower,
 		upper:         upper,
 		midPoint:      midPoint,
 		Count:         *count,
 		NormalizedSum: *normalizedSum,
+		clippedMass:   clippedMass,
 		state:         defaultState,
 	}, nil
 }
@@ -203,6 +219,11 @@ func (bm *BoundedMean) Add(e float64) error {
 			return fmt.Errorf("couldn't clamp input value %v: %w", e, err)
 		}
 
+		if bm.clippedMass != nil {
+			if err := bm.clippedMass.Add(e - clamped); err != nil {
+				return fmt.Errorf("couldn't add clipped mass of input value %v: %w", e, err)
+			}
+		}
 		x := clamped - bm.midPoint
 		bm.NormalizedSum.Add(x)
 		bm.Count.Increment()
@@ -210,10 +231,63 @@ func (bm *BoundedMean) Add(e float64) error {
 	return nil
 }
 
+// AddPreAggregated adds a partial aggregate of count entries whose sum is
+// sum to a BoundedMean, e.g. a partial aggregate computed on the device of a
+// privacy unit. This is equivalent to calling Add on each of the entries, but
+// doesn't require the raw entries.
+//
+// The partial aggregate must only contain entries of a single privacy unit.
+// To preserve the sensitivity of the BoundedMean, it is capped as if its
+// entries had been added individually: if count is larger than
+// MaxContributionsPerPartition, count is capped to
+// MaxContributionsPerPartition and sum is scaled down by the same factor;
+// then, sum is clamped to [count*Lower, count*Upper]. Like Add, it skips NaN
+// sums. With bias correction, the clipped mass of the partial aggregate is
+// clamped to [-count*MaxExcess, count*MaxExcess].
+func (bm *BoundedMean) AddPreAggregated(sum float64, count int64) error {
+	if bm.state != defaultState {
+		return fmt.Errorf("BoundedMean cannot be amended: %v", bm.state.errorMessage())
+	}
+	if count < 0 {
+		return fmt.Errorf("count of a pre-aggregated input must be non-negative, was %d instead", count)
+	}
+	if math.IsNaN(sum) || count == 0 {
+		return nil
+	}
+	// The L_∞ sensitivity of Count is MaxContributionsPerPartition.
+	if maxCount := bm.Count.lInfSensitivity; count > maxCount {
+		sum = sum * float64(maxCount) / float64(count)
+		count = maxCount
+	}
+	n := float64(count)
+	maxDistFromMidpoint := bm.upper - bm.midPoint
+	normalizedSum, err := ClampFloat64(sum-n*bm.midPoint, -n*maxDistFromMidpoint, n*maxDistFromMidpoint)
+	if err != nil {
+		return fmt.Errorf("couldn't clamp pre-aggregated sum %v: %w", sum, err)
+	}
+	// The clamped normalized sum can be larger than the bounds of
+	// NormalizedSum, which apply to individual entries, so it is added to the
+	// state directly.
+	bm.NormalizedSum.sum += normalizedSum
+	if bm.clippedMass != nil {
+		excess := sum - n*bm.midPoint - normalizedSum
+		clippedMass, err := ClampFloat64(excess, n*bm.clippedMass.lower, n*bm.clippedMass.upper)
+		if err != nil {
+			return fmt.Errorf("couldn't clamp clipped mass of pre-aggregated sum %v: %w", sum, err)
+		}
+		bm.clippedMass.sum += clippedMass
+	}
+	return bm.Count.IncrementBy(count)
+}
+
 // Result returns a differentially private estimate of the average of bounded
 // elements added so far. The method can be called only once.
 //
 // Note that the returned value is not an unbiased estimate of the raw bounded mean.
+//
+// If bias correction is enabled, the differentially private clipped mass is
+// added to the normalized sum, and the result is clamped to
+// [Lower - MaxExcess, Upper + MaxExcess] instead of [Lower, Upper].
 func (bm *BoundedMean) Result() (float64, error) {
 	if bm.state != defaultState {
 		return 0, fmt.Errorf("BoundedMean's noised result cannot be computed: " + bm.state.errorMessage())
@@ -228,7 +302,16 @@ func (bm *BoundedMean) Result() (float64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("couldn't compute dp sum: %w", err)
 	}
-	clamped, err := ClampFloat64(noisedSum/noisedCountClamped+bm.midPoint, bm.lower, bm.upper)
+	lower, upper := bm.lower, bm.upper
+	if bm.clippedMass != nil {
+		noisedClippedMass, err := bm.clippedMass.Result()
+		if err != nil {
+			return 0, fmt.Errorf("couldn't compute dp clipped mass: %w", err)
+		}
+		noisedSum += noisedClippedMass
+		lower, upper = lower+bm.clippedMass.lower, upper+bm.clippedMass.upper
+	}
+	clamped, err := ClampFloat64(noisedSum/noisedCountClamped+bm.midPoint, lower, upper)
 	if err != nil {
 		return 0, fmt.Errorf("couldn't clamp the result: %w", err)
 	}
@@ -240,10 +323,14 @@ func (bm *BoundedMean) Result() (float64, error) {
 // noised data and the privacy parameters. Thus no privacy budget is consumed by this operation.
 //
 // Result() needs to be called before ComputeConfidenceInterval, otherwise this will return an error.
+// Confidence intervals are not supported with bias correction.
 func (bm *BoundedMean) ComputeConfidenceInterval(alpha float64) (noise.ConfidenceInterval, error) {
 	if bm.state != resultReturned {
 		return noise.ConfidenceInterval{}, fmt.Errorf("Result() must be called before calling ComputeConfidenceInterval()")
 	}
+	if bm.clippedMass != nil {
+		return noise.ConfidenceInterval{}, fmt.Errorf("ComputeConfidenceInterval() is not supported with bias correction")
+	}
 	// The confidence interval of bounded mean is derived from confidence intervals of the mean's numerator and denominator.
 	// The respective confidence levels 1 - alphaNum and 1 - alphaDen can be chosen arbitrarily as long as (1 - alphaNum) *
 	// (1 - alphaDen) = 1 - alpha. The following is a brute force search for alphaNum that minimizes the size of the
@@ -318,6 +405,11 @@ func (bm *BoundedMean) Merge(bm2 *BoundedMean) error {
 	if err := checkMergeBoundedMean(bm, bm2); err != nil {
 		return err
 	}
+	if bm.clippedMass != nil {
+		if err := bm.clippedMass.Merge(bm2.clippedMass); err != nil {
+			return err
+		}
+	}
 	bm.NormalizedSum.Merge(&bm2.NormalizedSum)
 	bm.Count.Merge(&bm2.Count)
 	bm2.state = merged
@@ -350,6 +442,7 @@ func (bm *BoundedMean) GobEncode() ([]byte, error) {
 		EncodableCount:         &bm.Count,
 		EncodableNormalizedSum: &bm.NormalizedSum,
 		MidPoint:               bm.midPoint,
+		ClippedMass:            bm.clippedMass,
 	}
 	bm.state = serialized
 	return encode(enc)
@@ -368,6 +461,7 @@ func (bm *BoundedMean) GobDecode(data []byte) error {
 		Count:         *enc.EncodableCount,
 		NormalizedSum: *enc.EncodableNormalizedSum,
 		midPoint:      enc.MidPoint,
+		clippedMass:   enc.ClippedMass,
 		state:         defaultState,
 	}
 	return nil
@@ -380,4 +474,5 @@ type encodableBoundedMeanFloat64 struct {
 	EncodableCount         *Count
 	EncodableNormalizedSum *BoundedSumFloat64
 	MidPoint               float64
+	ClippedMass            *BoundedSumFloat64
 }
@@ -80,16 +80,17 @@ func TestNewBoundedMean(t *testing.T) {
 					state:           defaultState,
 				},
 				NormalizedSum: BoundedSumFloat64{
-					epsilon:         ln3 * 0.5,
-					delta:           0,
-					l0Sensitivity:   1,
-					lInfSensitivity: 6,
-					lower:           -3,
-					upper:           3,
-					noiseKind:       noise.LaplaceNoise,
-					Noise:           noise.Laplace(),
-					sum:             0,
-					state:           defaultState,
+					epsilon:                      ln3 * 0.5,
+					delta:                        0,
+					l0Sensitivity:                1,
+					lInfSensitivity:              6,
+					lower:                        -3,
+					upper:                        3,
+					noiseKind:                    noise.LaplaceNoise,
+					maxContributionsPerPartition: 2,
+					Noise:                        noise.Laplace(),
+					sum:                          0,
+					state:                        defaultState,
 				},
 			},
 			false},
@@ -218,6 +219,77 @@ func TestBMAddIgnoresNaN(t *testing.T) {
 	}
 }
 
+func TestBMAddPreAggregated(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		add  func(bm *BoundedMean)
+		want float64
+	}{
+		{
+			desc: "sum inside bounds",
+			add:  func(bm *BoundedMean) { bm.AddPreAggregated(9, 3) },
+			want: 3,
+		},
+		{
+			desc: "sum outside bounds", // sum is clamped to 2*upper = 10
+			add:  func(bm *BoundedMean) { bm.AddPreAggregated(30, 2) },
+			want: 5,
+		},
+		{
+			desc: "count above MaxContributionsPerPartition", // sum is scaled down to 12 and count capped to 3
+			add:  func(bm *BoundedMean) { bm.AddPreAggregated(16, 4) },
+			want: 4,
+		},
+		{
+			desc: "mixed with raw entries",
+			add: func(bm *BoundedMean) {
+				bm.Add(1)
+				bm.AddPreAggregated(9, 3)
+			},
+			want: 2.5,
+		},
+		{
+			desc: "NaN sum",
+			add: func(bm *BoundedMean) {
+				bm.Add(1)
+				bm.AddPreAggregated(math.NaN(), 2)
+			},
+			want: 1,
+		},
+	} {
+		bm, err := NewBoundedMean(&BoundedMeanOptions{
+			Epsilon:                      ln3,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 3,
+			Lower:                        -1,
+			Upper:                        5,
+			Noise:                        noNoise{},
+		})
+		if err != nil {
+			t.Fatalf("Couldn't initialize mean: %v", err)
+		}
+		tc.add(bm)
+		got, err := bm.Result()
+		if err != nil {
+			t.Fatalf("Couldn't compute dp result: %v", err)
+		}
+		if !ApproxEqual(got, tc.want) {
+			t.Errorf("AddPreAggregated: with %s got %f, want %f", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestBMAddPreAggregatedErrors(t *testing.T) {
+	bm := getNoiselessBM(t)
+	if err := bm.AddPreAggregated(1, -1); err == nil {
+		t.Errorf("AddPreAggregated: with negative count got no error")
+	}
+	bm.Result()
+	if err := bm.AddPreAggregated(1, 1); err == nil {
+		t.Errorf("AddPreAggregated: after Result got no error")
+	}
+}
+
 func TestBMReturnsEntryIfSingleEntryIsAdded(t *testing.T) {
 	bm := getNoiselessBM(t)
 	// lower = -1, upper = 5
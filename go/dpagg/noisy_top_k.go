@@ -0,0 +1,96 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/rand"
+)
+
+// NoisyTopKOptions contains the options necessary to call NoisyTopK.
+type NoisyTopKOptions struct {
+	Epsilon float64 // Privacy parameter ε. Required.
+	// Number of candidates to select. Must be in [1, number of scores].
+	// Required.
+	K int
+	// Maximum change of each score when a privacy unit is added or removed,
+	// e.g. the maximum number of contributions of a privacy unit to each
+	// candidate if scores are counts. Required.
+	Sensitivity float64
+	// Whether adding a privacy unit can only increase the scores, or only
+	// decrease them, like for counts. This halves the noise. Optional.
+	Monotonic bool
+}
+
+// NoisyTopK returns the indices of K candidates with the highest scores, in
+// decreasing order of noisy score, with ε-differential privacy. The scores
+// themselves are not released.
+//
+// It uses the one-shot Gumbel mechanism from https://arxiv.org/abs/1905.04273:
+// Gumbel noise of scale 2·K·Sensitivity/ε (K·Sensitivity/ε if Monotonic) is
+// added to each score once, and the K largest noisy scores are returned. This
+// is equivalent to the peeling exponential mechanism, i.e. to selecting the K
+// candidates one after the other with the exponential mechanism with budget
+// ε/K, each time among the candidates that weren't selected yet, but only
+// needs a single pass over the scores.
+func NoisyTopK(scores []float64, opt *NoisyTopKOptions) ([]int, error) {
+	if opt == nil {
+		opt = &NoisyTopKOptions{} // Prevents panicking due to a nil pointer dereference.
+	}
+	if err := checks.CheckEpsilonStrict(opt.Epsilon); err != nil {
+		return nil, fmt.Errorf("NoisyTopK: %w", err)
+	}
+	if opt.K < 1 || opt.K > len(scores) {
+		return nil, fmt.Errorf("NoisyTopK: K is %d, must be in [1, %d]", opt.K, len(scores))
+	}
+	if err := checks.CheckLInfSensitivity(opt.Sensitivity); err != nil {
+		return nil, fmt.Errorf("NoisyTopK: %w", err)
+	}
+	for i, score := range scores {
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			return nil, fmt.Errorf("NoisyTopK: scores[%d] is %f, must be finite", i, score)
+		}
+	}
+
+	scale := float64(opt.K) * opt.Sensitivity / opt.Epsilon
+	if !opt.Monotonic {
+		scale *= 2
+	}
+	noisyScores := make([]float64, len(scores))
+	indices := make([]int, len(scores))
+	for i, score := range scores {
+		noisyScores[i] = score + scale*gumbel(rand.Uniform)
+		indices[i] = i
+	}
+	sort.Slice(indices, func(i, j int) bool { return noisyScores[indices[i]] > noisyScores[indices[j]] })
+	return indices[:opt.K], nil
+}
+
+// gumbel returns a sample from the standard Gumbel distribution, computed from
+// samples of uniform, which returns values in (0,1] like rand.Uniform.
+func gumbel(uniform func() float64) float64 {
+	// A uniform sample of 1 would give +Inf, so the sample is drawn from (0,1).
+	u := uniform()
+	for u == 1 {
+		u = uniform()
+	}
+	return -math.Log(-math.Log(u))
+}
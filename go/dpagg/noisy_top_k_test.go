@@ -0,0 +1,134 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNoisyTopKInvalidOptions(t *testing.T) {
+	scores := []float64{1, 2, 3}
+	for _, tc := range []struct {
+		desc   string
+		scores []float64
+		opt    *NoisyTopKOptions
+	}{
+		{"nil options", scores, nil},
+		{"zero epsilon", scores, &NoisyTopKOptions{K: 1, Sensitivity: 1}},
+		{"zero K", scores, &NoisyTopKOptions{Epsilon: ln3, Sensitivity: 1}},
+		{"K larger than the number of scores", scores, &NoisyTopKOptions{Epsilon: ln3, K: 4, Sensitivity: 1}},
+		{"no scores", nil, &NoisyTopKOptions{Epsilon: ln3, K: 1, Sensitivity: 1}},
+		{"zero sensitivity", scores, &NoisyTopKOptions{Epsilon: ln3, K: 1}},
+		{"infinite sensitivity", scores, &NoisyTopKOptions{Epsilon: ln3, K: 1, Sensitivity: math.Inf(1)}},
+		{"NaN score", []float64{1, math.NaN()}, &NoisyTopKOptions{Epsilon: ln3, K: 1, Sensitivity: 1}},
+		{"infinite score", []float64{1, math.Inf(-1)}, &NoisyTopKOptions{Epsilon: ln3, K: 1, Sensitivity: 1}},
+	} {
+		if _, err := NoisyTopK(tc.scores, tc.opt); err == nil {
+			t.Errorf("NoisyTopK with %s: got no error, want error", tc.desc)
+		}
+	}
+}
+
+// Tests that NoisyTopK returns the top K candidates in decreasing order when
+// the gaps between the scores are much larger than the noise.
+func TestNoisyTopKLargeGaps(t *testing.T) {
+	scores := []float64{0, 3000, 1000, 4000, 2000}
+	for _, k := range []int{1, 3, 5} {
+		got, err := NoisyTopK(scores, &NoisyTopKOptions{Epsilon: 100, K: k, Sensitivity: 1})
+		if err != nil {
+			t.Fatalf("NoisyTopK with K=%d: got error %v", k, err)
+		}
+		if want := []int{3, 1, 4, 2, 0}[:k]; !cmp.Equal(got, want) {
+			t.Errorf("NoisyTopK with K=%d: got %v, want %v", k, got, want)
+		}
+	}
+}
+
+// Tests that NoisyTopK selects candidates with the probabilities of the peeling
+// exponential mechanism.
+func TestNoisyTopKDistribution(t *testing.T) {
+	scores := []float64{0, 1, 2}
+	for _, tc := range []struct {
+		desc string
+		opt  *NoisyTopKOptions
+		// Probability of each sequence of selected candidates.
+		want map[[2]int]float64
+	}{
+		{
+			// Each candidate is selected with probability proportional to
+			// exp(ε·score/2) = 2^score.
+			desc: "K=1",
+			opt:  &NoisyTopKOptions{Epsilon: 2 * math.Log(2), K: 1, Sensitivity: 1},
+			want: map[[2]int]float64{{0}: 1.0 / 7, {1}: 2.0 / 7, {2}: 4.0 / 7},
+		},
+		{
+			desc: "K=1 with monotonic scores",
+			opt:  &NoisyTopKOptions{Epsilon: math.Log(2), K: 1, Sensitivity: 1, Monotonic: true},
+			want: map[[2]int]float64{{0}: 1.0 / 7, {1}: 2.0 / 7, {2}: 4.0 / 7},
+		},
+		{
+			desc: "K=1 with a larger sensitivity",
+			opt:  &NoisyTopKOptions{Epsilon: 2 * math.Log(2), K: 1, Sensitivity: 2},
+			want: map[[2]int]float64{{0}: 1 / (3 + math.Sqrt2), {1}: math.Sqrt2 / (3 + math.Sqrt2), {2}: 2 / (3 + math.Sqrt2)},
+		},
+		{
+			// Each of the two selections uses ε/2, so the weights are also 2^score.
+			desc: "K=2",
+			opt:  &NoisyTopKOptions{Epsilon: 4 * math.Log(2), K: 2, Sensitivity: 1},
+			want: map[[2]int]float64{
+				{0, 1}: 1.0 / 7 * 2 / 6, {0, 2}: 1.0 / 7 * 4 / 6,
+				{1, 0}: 2.0 / 7 * 1 / 5, {1, 2}: 2.0 / 7 * 4 / 5,
+				{2, 0}: 4.0 / 7 * 1 / 3, {2, 1}: 4.0 / 7 * 2 / 3,
+			},
+		},
+	} {
+		const numTrials = 70000
+		got := make(map[[2]int]int)
+		for i := 0; i < numTrials; i++ {
+			selected, err := NoisyTopK(scores, tc.opt)
+			if err != nil {
+				t.Fatalf("NoisyTopK with %s: got error %v", tc.desc, err)
+			}
+			var key [2]int
+			copy(key[:], selected)
+			got[key]++
+		}
+		for key, p := range tc.want {
+			want := numTrials * p
+			// The standard deviation of each count is at most sqrt(numTrials)/2 ≈ 132.
+			if math.Abs(float64(got[key])-want) > 700 {
+				t.Errorf("NoisyTopK with %s selected %v %d times out of %d, want about %f", tc.desc, key[:tc.opt.K], got[key], numTrials, want)
+			}
+		}
+	}
+}
+
+// Tests that gumbel doesn't return +Inf when the uniform sample is 1.
+func TestGumbelIsFinite(t *testing.T) {
+	samples := []float64{1, 1, 0.5}
+	uniform := func() float64 {
+		u := samples[0]
+		samples = samples[1:]
+		return u
+	}
+	if got, want := gumbel(uniform), -math.Log(-math.Log(0.5)); got != want {
+		t.Errorf("gumbel with uniform samples 1, 1 and 0.5: got %f, want %f", got, want)
+	}
+}
@@ -0,0 +1,399 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+)
+
+// maxMomentOrder is the largest order supported by BoundedNthMoment. The
+// sensitivity of the sum of the n-th powers grows exponentially with n, so
+// higher orders would be too noisy to be useful.
+const maxMomentOrder = 8
+
+// BoundedNthMoment calculates a differentially private n-th central moment of
+// a collection of float64 values, i.e. the mean of (x - μ)ⁿ where μ is the mean
+// of the values, as well as the corresponding standardized moment, i.e. the
+// central moment divided by σⁿ where σ is the standard deviation of the values.
+// The standardized moments of orders 3 and 4 are the skewness and the
+// kurtosis.
+//
+// Like BoundedVariance, it computes a noisy count and noisy sums of the powers
+// of the values relative to the midpoint of [lower, upper], from the first to
+// the n-th power, and derives the moment from them. The budget is split evenly
+// between these n+1 noisy quantities.
+//
+// BoundedNthMoment supports privacy units that contribute to multiple
+// partitions (via the MaxPartitionsContributed parameter) as well as
+// contribute to the same partition multiple times (via the
+// MaxContributionsPerPartition parameter), by scaling the added noise
+// appropriately.
+//
+// For general details and key definitions, see
+// https://github.com/google/differential-privacy/blob/main/differential_privacy.md#key-definitions.
+//
+// Note: Do not use when your results may cause overflows for float64 values. This
+// aggregation is not hardened for such applications yet.
+//
+// Not thread-safe.
+type BoundedNthMoment struct {
+	// Parameters
+	lower float64
+	upper float64
+	order int
+
+	// State variables
+	Count Count
+	// NormalizedSums[k] is the sum of (x - midPoint)ᵏ⁺¹ over the values x.
+	NormalizedSums []BoundedSumFloat64
+	// The midpoint between lower and upper bounds. It cannot be set by the user;
+	// it will be calculated based on the lower and upper values.
+	midPoint float64
+	state    aggregationState
+}
+
+func bnmEquallyInitialized(bnm1, bnm2 *BoundedNthMoment) bool {
+	if bnm1.lower != bnm2.lower ||
+		bnm1.upper != bnm2.upper ||
+		bnm1.order != bnm2.order ||
+		bnm1.midPoint != bnm2.midPoint ||
+		bnm1.state != bnm2.state ||
+		len(bnm1.NormalizedSums) != len(bnm2.NormalizedSums) ||
+		!countEquallyInitialized(&bnm1.Count, &bnm2.Count) {
+		return false
+	}
+	for i := range bnm1.NormalizedSums {
+		if !bsEquallyInitializedFloat64(&bnm1.NormalizedSums[i], &bnm2.NormalizedSums[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// BoundedNthMomentOptions contains the options necessary to initialize a BoundedNthMoment.
+type BoundedNthMomentOptions struct {
+	Epsilon                      float64 // Privacy parameter ε. Required.
+	Delta                        float64 // Privacy parameter δ. Required with Gaussian noise, must be 0 with Laplace noise.
+	MaxPartitionsContributed     int64   // How many distinct partitions may a single user contribute to? Required.
+	MaxContributionsPerPartition int64   // How many times may a single user contribute to a single partition? Required.
+	// Lower and Upper bounds for clamping. Required; must be such that Lower < Upper.
+	Lower, Upper float64
+	// Order n of the moment. Required; must be between 2 and 8.
+	Order int
+	Noise noise.Noise // Type of noise used in BoundedNthMoment. Defaults to Laplace noise.
+}
+
+// NewBoundedNthMoment returns a new BoundedNthMoment.
+func NewBoundedNthMoment(opt *BoundedNthMomentOptions) (*BoundedNthMoment, error) {
+	if opt == nil {
+		opt = &BoundedNthMomentOptions{} // Prevents panicking due to a nil pointer dereference.
+	}
+
+	if opt.Order < 2 || opt.Order > maxMomentOrder {
+		return nil, fmt.Errorf("NewBoundedNthMoment: Order must be between 2 and %d, got %d", maxMomentOrder, opt.Order)
+	}
+	maxContributionsPerPartition := opt.MaxContributionsPerPartition
+	if err := checks.CheckMaxContributionsPerPartition(maxContributionsPerPartition); err != nil {
+		return nil, fmt.Errorf("NewBoundedNthMoment: %w", err)
+	}
+	maxPartitionsContributed := opt.MaxPartitionsContributed
+	if maxPartitionsContributed == 0 {
+		return nil, fmt.Errorf("NewBoundedNthMoment: MaxPartitionsContributed must be set")
+	}
+
+	n := opt.Noise
+	if n == nil {
+		n = noise.Laplace()
+	}
+	// Check bounds & use them to compute L_∞ sensitivity.
+	lower, upper := opt.Lower, opt.Upper
+	if lower == 0 && upper == 0 {
+		return nil, fmt.Errorf("NewBoundedNthMoment: Lower and Upper must be set (automatic bounds determination is not implemented yet). Lower and Upper cannot be both 0")
+	}
+	switch noise.ToKind(opt.Noise) {
+	case noise.Unrecognised:
+		if err := checks.CheckBoundsFloat64IgnoreOverflows(lower, upper); err != nil {
+			return nil, fmt.Errorf("NewBoundedNthMoment: CheckBoundFloat64IgnoreOverflows: %w", err)
+		}
+	default:
+		if err := checks.CheckBoundsFloat64(lower, upper); err != nil {
+			return nil, fmt.Errorf("NewBoundedNthMoment: CheckBoundsFloat64: %w", err)
+		}
+	}
+	if err := checks.CheckBoundsNotEqual(lower, upper); err != nil {
+		return nil, fmt.Errorf("NewBoundedNthMoment: CheckBoundsNotEqual: %w", err)
+	}
+	// In case lower or upper bound is infinity, midPoint is set to 0.0 to prevent getting
+	// a NaN midPoint or maxDistFromMidpoint.
+	midPoint := 0.0
+	if !math.IsInf(lower, 0) && !math.IsInf(upper, 0) {
+		// (lower + upper) / 2 may cause an overflow if lower and upper are large values.
+		midPoint = lower + (upper-lower)/2.0
+	}
+	maxDistFromMidpoint := upper - midPoint
+
+	// We split the budget equally between the count and the order normalized sums.
+	shares := float64(opt.Order + 1)
+	eps, del := opt.Epsilon/shares, opt.Delta/shares
+
+	// Check that the parameters are compatible with the noise chosen by calling
+	// the noise on some placeholder value.
+	n.AddNoiseFloat64(0, 1, 1, eps, del)
+
+	count, err := NewCount(&CountOptions{
+		Epsilon:                      eps,
+		Delta:                        del,
+		MaxPartitionsContributed:     maxPartitionsContributed,
+		Noise:                        n,
+		maxContributionsPerPartition: maxContributionsPerPartition,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't initialize count for NewBoundedNthMoment: %w", err)
+	}
+
+	// The k-th powers of the values relative to the midpoint are within
+	// [-dᵏ, dᵏ] for odd k, and within [0, dᵏ] for even k, where d is the
+	// distance between the midpoint and the bounds.
+	sums := make([]BoundedSumFloat64, opt.Order)
+	for k := 1; k <= opt.Order; k++ {
+		maxPower := math.Pow(maxDistFromMidpoint, float64(k))
+		minPower := -maxPower
+		if k%2 == 0 {
+			minPower = 0
+		}
+		sum, err := NewBoundedSumFloat64(&BoundedSumFloat64Options{
+			Epsilon:                      eps,
+			Delta:                        del,
+			MaxPartitionsContributed:     maxPartitionsContributed,
+			Lower:                        minPower,
+			Upper:                        maxPower,
+			Noise:                        n,
+			maxContributionsPerPartition: maxContributionsPerPartition,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't initialize normalized sum of order %d for NewBoundedNthMoment: %w", k, err)
+		}
+		sums[k-1] = *sum
+	}
+
+	return &BoundedNthMoment{
+		lower:          lower,
+		upper:          upper,
+		order:          opt.Order,
+		midPoint:       midPoint,
+		Count:          *count,
+		NormalizedSums: sums,
+		state:          defaultState,
+	}, nil
+}
+
+// Add an entry to a BoundedNthMoment. It skips NaN entries and doesn't count them in
+// the final result because introducing even a single NaN entry will result in a NaN
+// moment regardless of other entries, which would break the indistinguishability
+// property required for differential privacy.
+func (bnm *BoundedNthMoment) Add(e float64) error {
+	if bnm.state != defaultState {
+		return fmt.Errorf("BoundedNthMoment cannot be amended: %v", bnm.state.errorMessage())
+	}
+	if !math.IsNaN(e) {
+		clamped, err := ClampFloat64(e, bnm.lower, bnm.upper)
+		if err != nil {
+			return fmt.Errorf("couldn't clamp input value %v, err %w", e, err)
+		}
+		normalizedVal := clamped - bnm.midPoint
+		power := 1.0
+		for k := range bnm.NormalizedSums {
+			power *= normalizedVal
+			bnm.NormalizedSums[k].Add(power)
+		}
+		bnm.Count.Increment()
+	}
+	return nil
+}
+
+// centralMoments returns the noisy second and n-th central moments of the
+// elements added so far.
+func (bnm *BoundedNthMoment) centralMoments() (second, nth float64, err error) {
+	bnm.state = resultReturned
+
+	noisedCount, err := bnm.Count.Result()
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't compute dp count: %w", err)
+	}
+	noisedCountClamped := math.Max(1.0, float64(noisedCount))
+	// rawMoments[k] is the noisy mean of (x - midPoint)ᵏ.
+	rawMoments := make([]float64, bnm.order+1)
+	rawMoments[0] = 1
+	for k := range bnm.NormalizedSums {
+		noisedSum, err := bnm.NormalizedSums[k].Result()
+		if err != nil {
+			return 0, 0, fmt.Errorf("couldn't compute dp normalized sum of order %d: %w", k+1, err)
+		}
+		rawMoments[k+1] = noisedSum / noisedCountClamped
+	}
+
+	// Central moments are invariant to translation, so they can be computed
+	// from the moments relative to the midpoint with the binomial theorem:
+	// E[(x - μ)ⁿ] = Σⱼ C(n, j) E[(x - m)ʲ] (m - μ)ⁿ⁻ʲ, where μ - m = rawMoments[1].
+	second = centralMomentFromRawMoments(rawMoments, 2)
+	second, err = ClampFloat64(second, 0, computeMaxVariance(bnm.lower, bnm.upper))
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't clamp the second central moment: %w", err)
+	}
+	// The distance between the values and their mean is at most upper - lower.
+	maxMoment := math.Pow(bnm.upper-bnm.lower, float64(bnm.order))
+	minMoment := -maxMoment
+	if bnm.order%2 == 0 {
+		minMoment = 0
+	}
+	nth, err = ClampFloat64(centralMomentFromRawMoments(rawMoments, bnm.order), minMoment, maxMoment)
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't clamp the central moment: %w", err)
+	}
+	return second, nth, nil
+}
+
+// centralMomentFromRawMoments returns the central moment of order n given the
+// moments rawMoments[k] relative to some point, for k from 0 to at least n.
+func centralMomentFromRawMoments(rawMoments []float64, n int) float64 {
+	shift := -rawMoments[1]
+	moment := 0.0
+	binomial := 1.0
+	for j := n; j >= 0; j-- {
+		// binomial is C(n, j).
+		moment += binomial * rawMoments[j] * math.Pow(shift, float64(n-j))
+		binomial = binomial * float64(j) / float64(n-j+1)
+	}
+	return moment
+}
+
+// Result returns a differentially private estimate of the n-th central moment
+// of bounded elements added so far. The method can be called only once, and
+// not after StandardizedResult.
+//
+// Note that the returned value is not an unbiased estimate of the raw bounded
+// central moment.
+func (bnm *BoundedNthMoment) Result() (float64, error) {
+	if bnm.state != defaultState {
+		return 0, fmt.Errorf("BoundedNthMoment's noised result cannot be computed: %s", bnm.state.errorMessage())
+	}
+	_, nth, err := bnm.centralMoments()
+	return nth, err
+}
+
+// StandardizedResult returns a differentially private estimate of the n-th
+// standardized moment of bounded elements added so far, i.e. the n-th central
+// moment divided by the n/2-th power of the variance, both computed from the
+// same noisy sums. It returns NaN if the noisy variance is zero. The method can
+// be called only once, and not after Result.
+func (bnm *BoundedNthMoment) StandardizedResult() (float64, error) {
+	if bnm.state != defaultState {
+		return 0, fmt.Errorf("BoundedNthMoment's noised result cannot be computed: %s", bnm.state.errorMessage())
+	}
+	second, nth, err := bnm.centralMoments()
+	if err != nil {
+		return 0, err
+	}
+	if second == 0 {
+		return math.NaN(), nil
+	}
+	return nth / math.Pow(second, float64(bnm.order)/2), nil
+}
+
+// Merge merges bnm2 into bnm (i.e., adds to bnm all entries that were added to
+// bnm2). bnm2 is consumed by this operation: bnm2 may not be used after it is
+// merged into bnm.
+func (bnm *BoundedNthMoment) Merge(bnm2 *BoundedNthMoment) error {
+	if err := checkMergeBoundedNthMoment(bnm, bnm2); err != nil {
+		return err
+	}
+	for k := range bnm.NormalizedSums {
+		bnm.NormalizedSums[k].Merge(&bnm2.NormalizedSums[k])
+	}
+	bnm.Count.Merge(&bnm2.Count)
+	bnm2.state = merged
+	return nil
+}
+
+func checkMergeBoundedNthMoment(bnm1, bnm2 *BoundedNthMoment) error {
+	if bnm1.state != defaultState {
+		return fmt.Errorf("checkMergeBoundedNthMoment: bnm1 cannot be merged with another BoundedNthMoment instance: %v", bnm1.state.errorMessage())
+	}
+	if bnm2.state != defaultState {
+		return fmt.Errorf("checkMergeBoundedNthMoment: bnm2 cannot be merged with another BoundedNthMoment instance: %v", bnm2.state.errorMessage())
+	}
+
+	if !bnmEquallyInitialized(bnm1, bnm2) {
+		return fmt.Errorf("checkMergeBoundedNthMoment: bnm1 and bnm2 are not compatible")
+	}
+
+	return nil
+}
+
+// GobEncode encodes BoundedNthMoment.
+func (bnm *BoundedNthMoment) GobEncode() ([]byte, error) {
+	if bnm.state != defaultState && bnm.state != serialized {
+		return nil, fmt.Errorf("BoundedNthMoment object cannot be serialized: %s", bnm.state.errorMessage())
+	}
+	enc := encodableBoundedNthMoment{
+		Lower:          bnm.lower,
+		Upper:          bnm.upper,
+		Order:          bnm.order,
+		EncodableCount: &bnm.Count,
+		Midpoint:       bnm.midPoint,
+	}
+	for k := range bnm.NormalizedSums {
+		enc.EncodableNormalizedSums = append(enc.EncodableNormalizedSums, &bnm.NormalizedSums[k])
+	}
+	bnm.state = serialized
+	return encode(enc)
+}
+
+// GobDecode decodes BoundedNthMoment.
+func (bnm *BoundedNthMoment) GobDecode(data []byte) error {
+	var enc encodableBoundedNthMoment
+	err := decode(&enc, data)
+	if err != nil {
+		return fmt.Errorf("couldn't decode BoundedNthMoment from bytes")
+	}
+	*bnm = BoundedNthMoment{
+		lower:    enc.Lower,
+		upper:    enc.Upper,
+		order:    enc.Order,
+		Count:    *enc.EncodableCount,
+		midPoint: enc.Midpoint,
+		state:    defaultState,
+	}
+	for _, sum := range enc.EncodableNormalizedSums {
+		bnm.NormalizedSums = append(bnm.NormalizedSums, *sum)
+	}
+	return nil
+}
+
+// encodableBoundedNthMoment can be encoded by the gob package.
+type encodableBoundedNthMoment struct {
+	Lower                   float64
+	Upper                   float64
+	Order                   int
+	EncodableCount          *Count
+	EncodableNormalizedSums []*BoundedSumFloat64
+	Midpoint                float64
+}
@@ -0,0 +1,317 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/go-cmp/cmp"
+)
+
+func getNoiselessBNM(t *testing.T, lower, upper float64, order int) *BoundedNthMoment {
+	t.Helper()
+	bnm, err := NewBoundedNthMoment(&BoundedNthMomentOptions{
+		Epsilon:                      ln3,
+		Delta:                        tenten,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		Lower:                        lower,
+		Upper:                        upper,
+		Order:                        order,
+		Noise:                        noNoise{},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless BNM: %v", err)
+	}
+	return bnm
+}
+
+func TestNewBoundedNthMomentErrors(t *testing.T) {
+	valid := func() *BoundedNthMomentOptions {
+		return &BoundedNthMomentOptions{
+			Epsilon:                      ln3,
+			Lower:                        -1,
+			Upper:                        5,
+			Order:                        3,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+		}
+	}
+	for _, tc := range []struct {
+		desc    string
+		modify  func(*BoundedNthMomentOptions)
+		wantErr bool
+	}{
+		{"valid options", func(*BoundedNthMomentOptions) {}, false},
+		{"Order is not set", func(opt *BoundedNthMomentOptions) { opt.Order = 0 }, true},
+		{"Order is 1", func(opt *BoundedNthMomentOptions) { opt.Order = 1 }, true},
+		{"Order is too large", func(opt *BoundedNthMomentOptions) { opt.Order = 9 }, true},
+		{"MaxPartitionsContributed is not set", func(opt *BoundedNthMomentOptions) { opt.MaxPartitionsContributed = 0 }, true},
+		{"MaxContributionsPerPartition is not set", func(opt *BoundedNthMomentOptions) { opt.MaxContributionsPerPartition = 0 }, true},
+		{"Epsilon is not set", func(opt *BoundedNthMomentOptions) { opt.Epsilon = 0 }, true},
+		{"Lower and Upper are not set", func(opt *BoundedNthMomentOptions) { opt.Lower, opt.Upper = 0, 0 }, true},
+		{"Upper is smaller than Lower", func(opt *BoundedNthMomentOptions) { opt.Lower, opt.Upper = 5, -1 }, true},
+	} {
+		opt := valid()
+		tc.modify(opt)
+		if _, err := NewBoundedNthMoment(opt); (err != nil) != tc.wantErr {
+			t.Errorf("NewBoundedNthMoment: when %s got err %v, wantErr %t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestNewBoundedNthMomentSplitsBudget(t *testing.T) {
+	bnm, err := NewBoundedNthMoment(&BoundedNthMomentOptions{
+		Epsilon:                      1,
+		Lower:                        -1,
+		Upper:                        5,
+		Order:                        3,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize bnm: %v", err)
+	}
+	if bnm.Count.epsilon != 0.25 {
+		t.Errorf("NewBoundedNthMoment: got count epsilon %f, want 0.25", bnm.Count.epsilon)
+	}
+	// The distance between the midpoint 2 and the bounds is 3.
+	for k, want := range []struct{ lower, upper float64 }{{-3, 3}, {0, 9}, {-27, 27}} {
+		sum := bnm.NormalizedSums[k]
+		if sum.epsilon != 0.25 || sum.lower != want.lower || sum.upper != want.upper {
+			t.Errorf("NewBoundedNthMoment: got sum of order %d with epsilon %f and bounds [%f, %f], want 0.25 and [%f, %f]",
+				k+1, sum.epsilon, sum.lower, sum.upper, want.lower, want.upper)
+		}
+	}
+}
+
+func TestBNMAdd(t *testing.T) {
+	// The values 0, 0, 0, 10 have a mean of 2.5, a variance of 18.75, a third
+	// central moment of 93.75 and a fourth central moment of 820.3125, so their
+	// skewness is 2/√3 and their kurtosis is 7/3.
+	for _, tc := range []struct {
+		order            int
+		want             float64
+		wantStandardized float64
+	}{
+		{2, 18.75, 1},
+		{3, 93.75, 2 / math.Sqrt(3)},
+		{4, 820.3125, 7.0 / 3},
+	} {
+		bnm := getNoiselessBNM(t, 0, 10, tc.order)
+		standardized := getNoiselessBNM(t, 0, 10, tc.order)
+		for _, v := range []float64{0, 0, 0, 10} {
+			bnm.Add(v)
+			standardized.Add(v)
+		}
+		got, err := bnm.Result()
+		if err != nil {
+			t.Fatalf("Couldn't compute dp result: %v", err)
+		}
+		if !ApproxEqual(got, tc.want) {
+			t.Errorf("Result: with order %d got %f, want %f", tc.order, got, tc.want)
+		}
+		got, err = standardized.StandardizedResult()
+		if err != nil {
+			t.Fatalf("Couldn't compute dp standardized result: %v", err)
+		}
+		if !ApproxEqual(got, tc.wantStandardized) {
+			t.Errorf("StandardizedResult: with order %d got %f, want %f", tc.order, got, tc.wantStandardized)
+		}
+	}
+}
+
+func TestBNMMatchesBoundedVariance(t *testing.T) {
+	lower, upper := -1.0, 5.0
+	bnm := getNoiselessBNM(t, lower, upper, 2)
+	bv := getNoiselessBV(t, lower, upper)
+	for _, v := range []float64{1.5, 2.5, 3.5, 4.5, -10, 7} {
+		bnm.Add(v)
+		bv.Add(v)
+	}
+	got, err := bnm.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want, err := bv.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp variance: %v", err)
+	}
+	if !ApproxEqual(got, want) {
+		t.Errorf("Result: with order 2 got %f, want the variance %f", got, want)
+	}
+}
+
+func TestBNMAddIgnoresNaN(t *testing.T) {
+	bnm := getNoiselessBNM(t, 0, 10, 3)
+	bnm.Add(math.NaN())
+	bnm.Add(0)
+	bnm.Add(10)
+	got, err := bnm.StandardizedResult()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	// Two distinct values have a skewness of 0.
+	if !ApproxEqual(got, 0) {
+		t.Errorf("StandardizedResult: when NaN was added got %f, want 0", got)
+	}
+}
+
+func TestBNMStandardizedResultWithoutVariance(t *testing.T) {
+	bnm := getNoiselessBNM(t, 0, 10, 4)
+	bnm.Add(3)
+	bnm.Add(3)
+	got, err := bnm.StandardizedResult()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if !math.IsNaN(got) {
+		t.Errorf("StandardizedResult: with identical values got %f, want NaN", got)
+	}
+}
+
+func TestBoundedNthMomentResultSetsStateCorrectly(t *testing.T) {
+	bnm := getNoiselessBNM(t, 0, 10, 3)
+	if _, err := bnm.Result(); err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if bnm.state != resultReturned {
+		t.Errorf("BoundedNthMoment should have its state set to ResultReturned, got %v, want ResultReturned", bnm.state)
+	}
+	if _, err := bnm.StandardizedResult(); err == nil {
+		t.Errorf("StandardizedResult: after Result got no error")
+	}
+}
+
+func TestMergeBoundedNthMoment(t *testing.T) {
+	bnm1 := getNoiselessBNM(t, 0, 10, 3)
+	bnm2 := getNoiselessBNM(t, 0, 10, 3)
+	bnm1.Add(0)
+	bnm1.Add(0)
+	bnm2.Add(0)
+	bnm2.Add(10)
+	err := bnm1.Merge(bnm2)
+	if err != nil {
+		t.Fatalf("Couldn't merge bnm1 and bnm2: %v", err)
+	}
+	got, err := bnm1.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want := 93.75 // Would be 0.0 if merge didn't work.
+	if !ApproxEqual(got, want) {
+		t.Errorf("Merge: when merging 2 instances of BoundedNthMoment got %f, want %f", got, want)
+	}
+	if bnm2.state != merged {
+		t.Errorf("Merge: when merging 2 instances of BoundedNthMoment for bnm2.state got %v, want Merged", bnm2.state)
+	}
+}
+
+func TestCheckMergeBoundedNthMomentCompatibility(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		modify  func(*BoundedNthMomentOptions)
+		wantErr bool
+	}{
+		{"same options", func(*BoundedNthMomentOptions) {}, false},
+		{"different order", func(opt *BoundedNthMomentOptions) { opt.Order = 4 }, true},
+		{"different epsilon", func(opt *BoundedNthMomentOptions) { opt.Epsilon = 2 * ln3 }, true},
+		{"different bounds", func(opt *BoundedNthMomentOptions) { opt.Upper = 6 }, true},
+		{"different noise", func(opt *BoundedNthMomentOptions) { opt.Noise = noise.Gaussian(); opt.Delta = tenten }, true},
+	} {
+		opt1 := &BoundedNthMomentOptions{
+			Epsilon:                      ln3,
+			Lower:                        -1,
+			Upper:                        5,
+			Order:                        3,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			Noise:                        noise.Laplace(),
+		}
+		opt2 := *opt1
+		tc.modify(&opt2)
+		bnm1, err := NewBoundedNthMoment(opt1)
+		if err != nil {
+			t.Fatalf("Couldn't initialize bnm1: %v", err)
+		}
+		bnm2, err := NewBoundedNthMoment(&opt2)
+		if err != nil {
+			t.Fatalf("Couldn't initialize bnm2: %v", err)
+		}
+		if err := checkMergeBoundedNthMoment(bnm1, bnm2); (err != nil) != tc.wantErr {
+			t.Errorf("CheckMerge: when %s for err got %v, wantErr %t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func compareBoundedNthMoment(bnm1, bnm2 *BoundedNthMoment) bool {
+	if len(bnm1.NormalizedSums) != len(bnm2.NormalizedSums) {
+		return false
+	}
+	for k := range bnm1.NormalizedSums {
+		if !compareBoundedSumFloat64(&bnm1.NormalizedSums[k], &bnm2.NormalizedSums[k]) {
+			return false
+		}
+	}
+	return bnm1.lower == bnm2.lower &&
+		bnm1.upper == bnm2.upper &&
+		bnm1.order == bnm2.order &&
+		compareCount(&bnm1.Count, &bnm2.Count) &&
+		bnm1.midPoint == bnm2.midPoint &&
+		bnm1.state == bnm2.state
+}
+
+// Tests that serialization for BoundedNthMoment works as expected.
+func TestBNMSerialization(t *testing.T) {
+	opts := &BoundedNthMomentOptions{
+		Lower:                        -100,
+		Upper:                        555,
+		Order:                        4,
+		Epsilon:                      ln3,
+		Delta:                        1e-5,
+		MaxPartitionsContributed:     5,
+		MaxContributionsPerPartition: 6,
+		Noise:                        noise.Gaussian(),
+	}
+	bnm, err := NewBoundedNthMoment(opts)
+	if err != nil {
+		t.Fatalf("Couldn't initialize bnm: %v", err)
+	}
+	bnm.Add(1)
+	bnmUnchanged, err := NewBoundedNthMoment(opts)
+	if err != nil {
+		t.Fatalf("Couldn't initialize bnmUnchanged: %v", err)
+	}
+	bnmUnchanged.Add(1)
+	bytes, err := encode(bnm)
+	if err != nil {
+		t.Fatalf("encode(BoundedNthMoment) error: %v", err)
+	}
+	bnmUnmarshalled := new(BoundedNthMoment)
+	if err := decode(bnmUnmarshalled, bytes); err != nil {
+		t.Fatalf("decode(BoundedNthMoment) error: %v", err)
+	}
+	// Check that encoding -> decoding is the identity function.
+	if !cmp.Equal(bnmUnchanged, bnmUnmarshalled, cmp.Comparer(compareBoundedNthMoment)) {
+		t.Errorf("decode(encode(_)): got %+v, want %+v", bnmUnmarshalled, bnmUnchanged)
+	}
+	if bnm.state != serialized {
+		t.Errorf("BoundedNthMoment should have its state set to Serialized, got %v , want Serialized", bnm.state)
+	}
+}
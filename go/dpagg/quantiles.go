@@ -17,8 +17,13 @@
 package dpagg
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/google/differential-privacy/go/v3/checks"
 	"github.com/google/differential-privacy/go/v3/noise"
@@ -34,8 +39,16 @@ const (
 	// considered during the search for a particular quantile. The idea of alpha is to filter out
 	// noisy empty nodes. This is a post processing parameter with no privacy implications.
 	alpha = 0.0075
+	// Weight of the uniform distribution in the mixture with a public prior that determines the
+	// leaves of a QuantileTree. It guarantees that every value of [lower, upper] is mapped to a
+	// leaf of positive width, even where the prior is 0.
+	priorUniformWeight = 0.05
 )
 
+// contextCheckInterval is the number of entries that merges process between
+// checks of their context, so that checking doesn't dominate their cost.
+const contextCheckInterval = 1024
+
 // BoundedQuantiles calculates a differentially private quantiles of a collection
 // of float64 values using a quantile tree mechanism.
 // See https://github.com/google/differential-privacy/blob/main/common_docs/Differentially_Private_Quantile_Trees.pdf.
@@ -65,6 +78,11 @@ type BoundedQuantiles struct {
 	Noise           noise.Noise
 	noiseKind       noise.Kind // necessary for serializing noise.Noise information
 
+	// Cumulative distribution of the public prior mixed with the uniform distribution, at the
+	// len(priorCDF)-1 buckets of equal width partitioning [lower, upper]. Nil if no prior is used,
+	// in which case the leaves partition [lower, upper] into intervals of equal size.
+	priorCDF []float64
+
 	// State variables
 	tree              map[int]int64
 	noisedTree        map[int]float64
@@ -87,6 +105,16 @@ type BoundedQuantilesOptions struct {
 	// algorithm, which might become obsolote if another algorithm is used.
 	TreeHeight      int // Height of the QuantileTree. Defaults to defaultTreeHeight.
 	BranchingFactor int // Number of children of every non-leaf node. Defaults to defaultBranchingFactor.
+	// Publicly known prior distribution of the values, e.g. a histogram published in a previous
+	// release, given as non-negative weights of len(Prior) buckets of equal width partitioning
+	// [Lower, Upper]. Optional.
+	//
+	// When set, the leaves of the QuantileTree are sized such that each covers an equal share of
+	// the prior (mixed with a small uniform component), instead of an equal share of [Lower, Upper].
+	// Leaves are then narrower where the prior is dense, which improves the accuracy of the
+	// quantiles in those regions. This doesn't consume privacy budget, but the prior must not
+	// depend on the data being aggregated.
+	Prior []float64
 }
 
 // NewBoundedQuantiles returns a new BoundedQuantiles.
@@ -136,6 +164,10 @@ func NewBoundedQuantiles(opt *BoundedQuantilesOptions) (*BoundedQuantiles, error
 	if err := checks.CheckBranchingFactor(branchingFactor); err != nil {
 		return nil, fmt.Errorf("NewBoundedQuantiles: %v", err)
 	}
+	priorCDF, err := newPriorCDF(opt.Prior)
+	if err != nil {
+		return nil, fmt.Errorf("NewBoundedQuantiles: %w", err)
+	}
 	numNodes := getNumNodes(treeHeight, branchingFactor)
 	numLeaves := getNumLeaves(treeHeight, branchingFactor)
 	// The following assumes that nodes are indexed in a breadth first fashion from left to right.
@@ -154,7 +186,7 @@ func NewBoundedQuantiles(opt *BoundedQuantilesOptions) (*BoundedQuantiles, error
 
 	// Check that the parameters are compatible with the noise chosen by calling
 	// the noise on some placeholder value.
-	_, err := n.AddNoiseFloat64(0, l0Sensitivity, lInfSensitivity, eps, del)
+	_, err = n.AddNoiseFloat64(0, l0Sensitivity, lInfSensitivity, eps, del)
 	if err != nil {
 		return nil, fmt.Errorf("NewBoundedQuantiles: %w", err)
 	}
@@ -166,6 +198,7 @@ func NewBoundedQuantiles(opt *BoundedQuantilesOptions) (*BoundedQuantiles, error
 		upper:             upper,
 		treeHeight:        treeHeight,
 		branchingFactor:   branchingFactor,
+		priorCDF:          priorCDF,
 		l0Sensitivity:     l0Sensitivity,
 		lInfSensitivity:   lInfSensitivity,
 		Noise:             n,
@@ -211,6 +244,14 @@ func (bq *BoundedQuantiles) Add(e float64) error {
 //
 // Note that the returned values is not an unbiased estimate of the raw bounded quantile.
 func (bq *BoundedQuantiles) Result(rank float64) (float64, error) {
+	return bq.ResultContext(context.Background(), rank)
+}
+
+// ResultContext is like Result, but returns ctx.Err() if ctx is done before
+// the quantile is found. The noised counts computed until then are kept, so
+// calling ResultContext again later neither consumes more privacy budget nor
+// returns a different result.
+func (bq *BoundedQuantiles) ResultContext(ctx context.Context, rank float64) (float64, error) {
 	if bq.state != defaultState && bq.state != resultReturned {
 		return 0, fmt.Errorf("BoundedQuantiles' noised result cannot be computed: %v", bq.state.errorMessage())
 	}
@@ -224,6 +265,9 @@ func (bq *BoundedQuantiles) Result(rank float64) (float64, error) {
 	index := rootIndex
 	// Search for the index of the leaf node containg the specified quantile, starting at the root.
 	for index < bq.leftmostLeafIndex {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		leftmostChildIndex := bq.getLeftmostChild(index)
 		rightmostChildIndex := bq.getRightmostChild(index)
 
@@ -284,28 +328,148 @@ func (bq *BoundedQuantiles) Result(rank float64) (float64, error) {
 	return (1-rank)*bq.getLeftValue(index) + rank*bq.getRightValue(index), nil
 }
 
+// ComputeConfidenceInterval computes a confidence interval that contains the
+// raw quantile of the specified rank of the clamped values added to bq with a
+// probability greater than or equal to 1 - alpha. Like Result, it adjusts the
+// rank to be between 0.005 and 0.995.
+//
+// The interval is computed from the noised node counts of the tree: with
+// probability 1 - alpha, the noise of every node count is within the
+// confidence interval of a single count at level alpha / (number of nodes).
+// Under this event, the bounds bracket the values at which the raw
+// cumulative count of the clamped values reaches rank times their raw total
+// count, which is estimated with the noised counts of the children of the
+// root. The interval is therefore conservative. No privacy budget is consumed
+// by this operation: node counts are noised at most once, and reused by Result
+// and ComputeConfidenceInterval.
+//
+// Result() needs to be called before ComputeConfidenceInterval, otherwise this
+// will return an error.
+func (bq *BoundedQuantiles) ComputeConfidenceInterval(rank, alpha float64) (noise.ConfidenceInterval, error) {
+	if bq.state != resultReturned {
+		return noise.ConfidenceInterval{}, fmt.Errorf("Result() must be called before calling ComputeConfidenceInterval()")
+	}
+	if rank < 0.0 || rank > 1.0 {
+		return noise.ConfidenceInterval{}, fmt.Errorf("rank %f must be >= 0 and <= 1", rank)
+	}
+	if err := checks.CheckAlpha(alpha); err != nil {
+		return noise.ConfidenceInterval{}, err
+	}
+	rank = adjustRank(rank)
+
+	// The root isn't noised, so there are leftmostLeafIndex+numLeaves-1 noised nodes.
+	numNoisedNodes := bq.leftmostLeafIndex + bq.numLeaves - 1
+	nodeConfInt, err := bq.Noise.ComputeConfidenceIntervalFloat64(0, bq.l0Sensitivity, bq.lInfSensitivity, bq.epsilon, bq.delta, alpha/float64(numNoisedNodes))
+	if err != nil {
+		return noise.ConfidenceInterval{}, err
+	}
+	margin := nodeConfInt.UpperBound
+	totalCount := 0.0
+	for i := bq.getLeftmostChild(rootIndex); i <= bq.getRightmostChild(rootIndex); i++ {
+		noisedCount, err := bq.getNoisedCount(i)
+		if err != nil {
+			return noise.ConfidenceInterval{}, fmt.Errorf("couldn't get noised count for node %d: %w", i, err)
+		}
+		totalCount += noisedCount
+	}
+	totalMargin := float64(bq.branchingFactor) * margin
+	lower, err := bq.lowerConfidenceBound(rank*(totalCount-totalMargin), margin)
+	if err != nil {
+		return noise.ConfidenceInterval{}, err
+	}
+	upper, err := bq.upperConfidenceBound(rank*(totalCount+totalMargin), margin)
+	if err != nil {
+		return noise.ConfidenceInterval{}, err
+	}
+	return noise.ConfidenceInterval{LowerBound: lower, UpperBound: upper}, nil
+}
+
+// lowerConfidenceBound returns the largest value found by descending the tree
+// such that fewer than target clamped values are smaller than it, assuming that
+// the noise of each node count is within [-margin, margin].
+func (bq *BoundedQuantiles) lowerConfidenceBound(target, margin float64) (float64, error) {
+	bound := bq.lower
+	// Noised count of the values smaller than the leftmost value of the
+	// current node, and the number of noised node counts it sums.
+	prefixCount, numNodes := 0.0, 0
+	for index := rootIndex; index < bq.leftmostLeafIndex; {
+		next := -1
+		for i := bq.getLeftmostChild(index); i <= bq.getRightmostChild(index); i++ {
+			noisedCount, err := bq.getNoisedCount(i)
+			if err != nil {
+				return 0, fmt.Errorf("couldn't get noised count for node %d: %w", i, err)
+			}
+			if prefixCount+noisedCount+float64(numNodes+1)*margin >= target {
+				next = i
+				break
+			}
+			prefixCount += noisedCount
+			numNodes++
+			bound = bq.getRightValue(i)
+		}
+		if next < 0 {
+			break
+		}
+		index = next
+	}
+	return bound, nil
+}
+
+// upperConfidenceBound returns the smallest value found by descending the tree
+// such that at least target clamped values are smaller than or equal to it,
+// assuming that
+// the noise of each node count is within [-margin, margin].
+func (bq *BoundedQuantiles) upperConfidenceBound(target, margin float64) (float64, error) {
+	bound := bq.upper
+	prefixCount, numNodes := 0.0, 0
+	for index := rootIndex; index < bq.leftmostLeafIndex; {
+		next := -1
+		for i := bq.getLeftmostChild(index); i <= bq.getRightmostChild(index); i++ {
+			noisedCount, err := bq.getNoisedCount(i)
+			if err != nil {
+				return 0, fmt.Errorf("couldn't get noised count for node %d: %w", i, err)
+			}
+			if prefixCount+noisedCount-float64(numNodes+1)*margin >= target {
+				bound = bq.getRightValue(i)
+				next = i
+				break
+			}
+			prefixCount += noisedCount
+			numNodes++
+		}
+		if next < 0 {
+			break
+		}
+		index = next
+	}
+	return bound, nil
+}
+
 // getIndex returns the index of the leaf node associated with the provided value, assuming that
-// the leaf nodes partition the range betwen lower and upper into intervals of equal size.
+// the leaf nodes partition the range betwen lower and upper into intervals of equal size, or of
+// equal prior mass if a prior is used.
 func (bq *BoundedQuantiles) getIndex(value float64) int {
-	indexFromLeftmostLeaf := int((value - bq.lower) / (bq.upper - bq.lower) * float64(bq.numLeaves))
-	if value == bq.upper {
+	indexFromLeftmostLeaf := int(bq.toPriorScale(value) * float64(bq.numLeaves))
+	if value == bq.upper || indexFromLeftmostLeaf >= bq.numLeaves {
 		indexFromLeftmostLeaf = bq.numLeaves - 1
 	}
 	return bq.leftmostLeafIndex + indexFromLeftmostLeaf
 }
 
 // getLeftValue returns the smallest value mapped to the subtree of the provided index, assuming that
-// the leaf nodes partition the range betwen lower and upper into intervals of equal size.
+// the leaf nodes partition the range betwen lower and upper into intervals of equal size, or of
+// equal prior mass if a prior is used.
 func (bq *BoundedQuantiles) getLeftValue(index int) float64 {
 	// Traverse the tree towards the leaves starting at the provided index always taking the leftmost branch.
 	for index < bq.leftmostLeafIndex {
 		index = bq.getLeftmostChild(index)
 	}
-	return (bq.upper-bq.lower)*(float64((index-bq.leftmostLeafIndex))/float64(bq.numLeaves)) + bq.lower
+	return bq.fromPriorScale(float64((index - bq.leftmostLeafIndex)) / float64(bq.numLeaves))
 }
 
 // getRightValue returns the greatest value mapped to the subtree of the provided index, assuming that
-// the leaf nodes partition the range betwen lower and upper into intervals of equal size.
+// the leaf nodes partition the range betwen lower and upper into intervals of equal size, or of
+// equal prior mass if a prior is used.
 func (bq *BoundedQuantiles) getRightValue(index int) float64 {
 	// Traverse the tree towards the leaves starting at the provided index always taking the rightmost branch.
 	for index < bq.leftmostLeafIndex {
@@ -314,7 +478,72 @@ func (bq *BoundedQuantiles) getRightValue(index int) float64 {
 	// The returned value bounds the range of values for which getIndex returns the specified index.
 	// This bound is not itself contained in that range, i.e., getIndex will return the next index
 	// when called for the bound.
-	return (bq.upper-bq.lower)*(float64((index-bq.leftmostLeafIndex+1))/float64(bq.numLeaves)) + bq.lower
+	return bq.fromPriorScale(float64((index - bq.leftmostLeafIndex + 1)) / float64(bq.numLeaves))
+}
+
+// toPriorScale maps a value between lower and upper to the fraction of the prior that is smaller
+// than it, which is between 0.0 and 1.0. Without a prior, it is the fraction of the range between
+// lower and upper that is smaller than the value.
+func (bq *BoundedQuantiles) toPriorScale(value float64) float64 {
+	fraction := (value - bq.lower) / (bq.upper - bq.lower)
+	if bq.priorCDF == nil {
+		return fraction
+	}
+	// Interpolate the cumulative distribution of the prior linearly within its buckets.
+	numBuckets := len(bq.priorCDF) - 1
+	bucket := math.Min(math.Max(0.0, fraction*float64(numBuckets)), float64(numBuckets))
+	i := int(bucket)
+	if i == numBuckets {
+		return 1.0
+	}
+	return bq.priorCDF[i] + (bucket-float64(i))*(bq.priorCDF[i+1]-bq.priorCDF[i])
+}
+
+// fromPriorScale is the inverse of toPriorScale: it maps a fraction of the prior between 0.0 and
+// 1.0 to the value between lower and upper such that this fraction of the prior is smaller than it.
+func (bq *BoundedQuantiles) fromPriorScale(fraction float64) float64 {
+	if bq.priorCDF == nil {
+		return (bq.upper-bq.lower)*fraction + bq.lower
+	}
+	if fraction >= 1.0 {
+		return bq.upper
+	}
+	// Find the bucket i such that priorCDF[i] <= fraction < priorCDF[i+1]. Buckets have positive
+	// mass thanks to the uniform component of the prior, so the interpolation is well defined.
+	i := sort.SearchFloat64s(bq.priorCDF, fraction)
+	if i == len(bq.priorCDF) || bq.priorCDF[i] > fraction {
+		i--
+	}
+	i = max(i, 0)
+	bucket := float64(i) + (fraction-bq.priorCDF[i])/(bq.priorCDF[i+1]-bq.priorCDF[i])
+	return (bq.upper-bq.lower)*(bucket/float64(len(bq.priorCDF)-1)) + bq.lower
+}
+
+// newPriorCDF returns the cumulative distribution of the mixture of the provided prior with the
+// uniform distribution, or nil if prior is empty. It returns an error if the weights of the prior
+// are not finite and non-negative, or if they sum to 0.
+func newPriorCDF(prior []float64) ([]float64, error) {
+	if len(prior) == 0 {
+		return nil, nil
+	}
+	total := 0.0
+	for i, w := range prior {
+		if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+			return nil, fmt.Errorf("Prior[%d] is %f, must be finite and non-negative", i, w)
+		}
+		total += w
+	}
+	if total == 0 || math.IsInf(total, 0) {
+		return nil, fmt.Errorf("weights of the Prior sum to %f, must be positive and finite", total)
+	}
+	cdf := make([]float64, len(prior)+1)
+	uniformWeight := priorUniformWeight / float64(len(prior))
+	for i, w := range prior {
+		cdf[i+1] = cdf[i] + (1-priorUniformWeight)*w/total + uniformWeight
+	}
+	// Avoid rounding errors at the upper end of the range.
+	cdf[len(prior)] = 1.0
+	return cdf, nil
 }
 
 func (bq *BoundedQuantiles) getLeftmostChild(index int) int {
@@ -356,16 +585,151 @@ func getNumLeaves(treeHeight, branchingFactor int) int {
 	return int(math.Pow(float64(branchingFactor), float64(treeHeight)))
 }
 
+// QuantileTreeMechanism describes how a BoundedQuantiles applies its privacy
+// budget and noise, so that its configuration can be reviewed without reading
+// the implementation of the quantile tree mechanism.
+type QuantileTreeMechanism struct {
+	// Privacy budget (ε,δ) of the whole tree.
+	Epsilon, Delta float64
+	NoiseKind      noise.Kind
+	// Bounds of the values; values are clamped to [Lower, Upper].
+	Lower, Upper    float64
+	TreeHeight      int
+	BranchingFactor int
+	// MaxPartitionsContributed and MaxContributionsPerPartition of the
+	// aggregation.
+	MaxPartitionsContributed, MaxContributionsPerPartition int64
+	// Sensitivities the noise of each node count is calibrated to. Each
+	// contribution increments one node count per level, so L0Sensitivity is
+	// TreeHeight times MaxPartitionsContributed.
+	L0Sensitivity   int64
+	LInfSensitivity float64
+	// Whether the leaves are sized according to a public Prior rather than
+	// evenly over [Lower, Upper].
+	UsesPrior bool
+	// Levels of the tree below the root, from the top down. The root isn't
+	// noised nor used.
+	Levels []QuantileTreeLevel
+}
+
+// QuantileTreeLevel describes a level of the tree of a BoundedQuantiles.
+type QuantileTreeLevel struct {
+	// Depth of the level, 1 being the children of the root and TreeHeight the
+	// leaves.
+	Depth int
+	// Number of nodes of the level.
+	NumNodes int
+	// Width of the range of values counted by each node of the level. If the
+	// tree uses a Prior, nodes are narrower where the prior is dense and this
+	// is their average width.
+	NodeWidth float64
+	// Standard deviation of the noise added to each node count of the level. It
+	// is the same for all levels: the budget is split evenly between them.
+	NoiseStandardDeviation float64
+}
+
+// Mechanism describes how bq applies its privacy budget and noise.
+//
+// The whole budget of bq is used to noise the counts of the nodes of its tree
+// once: the noised count of a node is drawn the first time Result reads it,
+// and reused by subsequent calls to Result, for any rank. Computing several
+// quantiles therefore doesn't consume more privacy budget than computing one.
+// Result only post-processes noised counts; it ignores child nodes
+// contributing less than a fraction of 0.0075 of the total count of their
+// siblings, which has no privacy implications.
+func (bq *BoundedQuantiles) Mechanism() QuantileTreeMechanism {
+	m := QuantileTreeMechanism{
+		Epsilon:                      bq.epsilon,
+		Delta:                        bq.delta,
+		NoiseKind:                    bq.noiseKind,
+		Lower:                        bq.lower,
+		Upper:                        bq.upper,
+		TreeHeight:                   bq.treeHeight,
+		BranchingFactor:              bq.branchingFactor,
+		MaxPartitionsContributed:     bq.l0Sensitivity / int64(bq.treeHeight),
+		MaxContributionsPerPartition: int64(bq.lInfSensitivity),
+		L0Sensitivity:                bq.l0Sensitivity,
+		LInfSensitivity:              bq.lInfSensitivity,
+		UsesPrior:                    bq.priorCDF != nil,
+	}
+	var stdDev float64
+	switch bq.noiseKind {
+	case noise.LaplaceNoise:
+		stdDev = math.Sqrt2 * float64(bq.l0Sensitivity) * bq.lInfSensitivity / bq.epsilon
+	case noise.GaussianNoise:
+		stdDev = noise.SigmaForGaussian(bq.l0Sensitivity, bq.lInfSensitivity, bq.epsilon, bq.delta)
+	}
+	numNodes := 1
+	for depth := 1; depth <= bq.treeHeight; depth++ {
+		numNodes *= bq.branchingFactor
+		m.Levels = append(m.Levels, QuantileTreeLevel{
+			Depth:                  depth,
+			NumNodes:               numNodes,
+			NodeWidth:              (bq.upper - bq.lower) / float64(numNodes),
+			NoiseStandardDeviation: stdDev,
+		})
+	}
+	return m
+}
+
+// String documents the mechanism in a human-readable form.
+func (m QuantileTreeMechanism) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Quantile tree on [%g, %g] with height %d and branching factor %d, using (ε=%g, δ=%g) with %s noise.\n",
+		m.Lower, m.Upper, m.TreeHeight, m.BranchingFactor, m.Epsilon, m.Delta, noiseName(m.NoiseKind))
+	fmt.Fprintf(&b, "Each privacy unit contributes to at most %d partitions and %d times per partition, and to one node per level for each contribution: "+
+		"node counts are noised with l0 sensitivity %d and lInf sensitivity %g.\n",
+		m.MaxPartitionsContributed, m.MaxContributionsPerPartition, m.L0Sensitivity, m.LInfSensitivity)
+	if m.UsesPrior {
+		fmt.Fprintf(&b, "Leaves cover equal shares of a public prior, which doesn't consume privacy budget.\n")
+	}
+	fmt.Fprintf(&b, "Each node count is noised once and reused for all ranks.\n")
+	for _, l := range m.Levels {
+		fmt.Fprintf(&b, "  level %d: %d nodes of width %g, noise standard deviation %g\n", l.Depth, l.NumNodes, l.NodeWidth, l.NoiseStandardDeviation)
+	}
+	return b.String()
+}
+
+func noiseName(k noise.Kind) string {
+	switch k {
+	case noise.LaplaceNoise:
+		return "Laplace"
+	case noise.GaussianNoise:
+		return "Gaussian"
+	default:
+		if m, ok := noise.RegisteredMechanism(k); ok {
+			return m.Name
+		}
+		return "unrecognised"
+	}
+}
+
 // Merge merges bq2 into bq (i.e., adds to bq all entries that were added to
 // bq2). bq2 is consumed by this operation: bq2 may not be used after it is
 // merged into bq.
 func (bq *BoundedQuantiles) Merge(bq2 *BoundedQuantiles) error {
+	return bq.MergeContext(context.Background(), bq2)
+}
+
+// MergeContext is like Merge, but returns ctx.Err() if ctx is done before the
+// merge completes. Counts are moved from bq2 to bq as they are merged, so both
+// remain usable: the entries that were not merged yet are still in bq2, and
+// calling MergeContext again resumes the merge.
+func (bq *BoundedQuantiles) MergeContext(ctx context.Context, bq2 *BoundedQuantiles) error {
 	if err := checkMergeBoundedQuantiles(bq, bq2); err != nil {
 		return err
 	}
 
+	i := 0
 	for index, count := range bq2.tree {
+		if i%contextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		i++
 		bq.tree[index] += count
+		delete(bq2.tree, index)
 	}
 	bq2.state = merged
 	return nil
@@ -396,6 +760,7 @@ func bqEquallyInitialized(bq1, bq2 *BoundedQuantiles) bool {
 		bq1.treeHeight == bq2.treeHeight &&
 		bq1.branchingFactor == bq2.branchingFactor &&
 		bq1.noiseKind == bq2.noiseKind &&
+		slices.Equal(bq1.priorCDF, bq2.priorCDF) &&
 		bq1.state == bq2.state
 }
 
@@ -413,6 +778,7 @@ type encodableBoundedQuantiles struct {
 	LeftmostLeafIndex int
 	NoiseKind         noise.Kind
 	QuantileTree      map[int]int64
+	PriorCDF          []float64
 }
 
 // GobEncode encodes BoundedQuantiles.
@@ -420,7 +786,13 @@ func (bq *BoundedQuantiles) GobEncode() ([]byte, error) {
 	if bq.state != defaultState && bq.state != serialized {
 		return nil, fmt.Errorf("BoundedQuantiles object cannot be serialized: " + bq.state.errorMessage())
 	}
-	enc := encodableBoundedQuantiles{
+	enc := bq.encodable()
+	bq.state = serialized
+	return encode(enc)
+}
+
+func (bq *BoundedQuantiles) encodable() encodableBoundedQuantiles {
+	return encodableBoundedQuantiles{
 		Epsilon:           bq.epsilon,
 		Delta:             bq.delta,
 		L0Sensitivity:     bq.l0Sensitivity,
@@ -433,9 +805,8 @@ func (bq *BoundedQuantiles) GobEncode() ([]byte, error) {
 		LeftmostLeafIndex: bq.leftmostLeafIndex,
 		NoiseKind:         noise.ToKind(bq.Noise),
 		QuantileTree:      bq.tree,
+		PriorCDF:          bq.priorCDF,
 	}
-	bq.state = serialized
-	return encode(enc)
 }
 
 // GobDecode decodes BoundedQuantiles.
@@ -458,9 +829,45 @@ func (bq *BoundedQuantiles) GobDecode(data []byte) error {
 		Noise:             noise.ToNoise(enc.NoiseKind),
 		numLeaves:         enc.NumLeaves,
 		leftmostLeafIndex: enc.LeftmostLeafIndex,
+		priorCDF:          enc.PriorCDF,
 		tree:              enc.QuantileTree,
 		noisedTree:        make(map[int]float64),
 		state:             defaultState,
 	}
 	return nil
 }
+
+// SerializedSize returns the size in bytes of the serialized form of bq, i.e.
+// the length of the output of GobEncode. Unlike GobEncode, it doesn't change
+// the state of bq, so bq can still be used afterwards.
+//
+// It can be used to predict how much data is shuffled when BoundedQuantiles
+// objects are sent between machines, e.g. by a Beam pipeline.
+func (bq *BoundedQuantiles) SerializedSize() (int, error) {
+	if bq.state != defaultState && bq.state != serialized {
+		return 0, fmt.Errorf("BoundedQuantiles object cannot be serialized: " + bq.state.errorMessage())
+	}
+	data, err := encode(bq.encodable())
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// quantileTreeEntrySize is the size in bytes of a key and value of the maps
+// storing the (noised) quantile tree: an int and an int64 or a float64.
+const quantileTreeEntrySize = 16
+
+// MemoryFootprint returns an estimate of the memory used by bq, in bytes. The
+// estimate grows with the number of nodes of the quantile tree that received
+// entries, and is at most proportional to BranchingFactor^TreeHeight.
+func (bq *BoundedQuantiles) MemoryFootprint() int {
+	return int(reflect.TypeOf(*bq).Size()) + 8*len(bq.priorCDF) + mapFootprint(len(bq.tree)) + mapFootprint(len(bq.noisedTree))
+}
+
+// mapFootprint estimates the memory used by a map of the quantile tree with
+// the given number of entries. Go maps store one byte of hash per entry in
+// addition to the entry itself, and are 81.25% full on average.
+func mapFootprint(numEntries int) int {
+	return int(float64(numEntries) * (quantileTreeEntrySize + 1) / 0.8125)
+}
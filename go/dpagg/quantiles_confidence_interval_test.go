@@ -0,0 +1,132 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+)
+
+// rawQuantile returns the smallest of the sorted values such that at least a
+// fraction rank of the values are smaller than or equal to it.
+func rawQuantile(sorted []float64, rank float64) float64 {
+	i := int(math.Ceil(rank*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+// Tests that without noise, BoundedQuantiles.ComputeConfidenceInterval()
+// returns the leaf of the tree containing the raw quantile.
+func TestBoundedQuantilesComputeConfidenceInterval_Noiseless(t *testing.T) {
+	bq := getNoiselessBQ(t, 0, 10)
+	var values []float64
+	for i := 0; i < 1000; i++ {
+		v := float64(i) / 100
+		values = append(values, v)
+		bq.Add(v)
+	}
+	leafWidth := 10 / float64(bq.numLeaves)
+	for _, rank := range []float64{0.1, 0.5, 0.9} {
+		if _, err := bq.Result(rank); err != nil {
+			t.Fatalf("Couldn't compute dp result for rank=%f: %v", rank, err)
+		}
+		confInt, err := bq.ComputeConfidenceInterval(rank, arbitraryAlpha)
+		if err != nil {
+			t.Fatalf("Couldn't compute confidence interval for rank=%f: %v", rank, err)
+		}
+		raw := rawQuantile(values, rank)
+		if confInt.LowerBound > raw+numericalTolerance || confInt.UpperBound < raw-numericalTolerance {
+			t.Errorf("For rank=%f, confidence interval=%+v should contain the raw quantile %f", rank, confInt, raw)
+		}
+		if width := confInt.UpperBound - confInt.LowerBound; width > leafWidth+numericalTolerance {
+			t.Errorf("For rank=%f, confidence interval=%+v has width %f, want at most the width of a leaf %f", rank, confInt, width, leafWidth)
+		}
+	}
+}
+
+// Tests that BoundedQuantiles.ComputeConfidenceInterval() contains the raw
+// quantile.
+func TestBoundedQuantilesComputeConfidenceInterval_ContainsRawQuantile(t *testing.T) {
+	for _, tc := range []struct {
+		n     noise.Noise
+		delta float64
+	}{
+		{noise.Laplace(), 0},
+		{noise.Gaussian(), tenten},
+	} {
+		for i := 0; i < 10; i++ {
+			bq, err := NewBoundedQuantiles(&BoundedQuantilesOptions{
+				Epsilon:                      ln3,
+				Delta:                        tc.delta,
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				Lower:                        0,
+				Upper:                        10,
+				Noise:                        tc.n,
+			})
+			if err != nil {
+				t.Fatalf("With %v, couldn't initialize BoundedQuantiles: %v", tc.n, err)
+			}
+			values := make([]float64, 10000)
+			for j := range values {
+				// Squaring the values makes the distribution skewed.
+				values[j] = 10 * math.Pow(rand.Float64(), 2)
+				bq.Add(values[j])
+			}
+			sort.Float64s(values)
+			for _, rank := range []float64{0.25, 0.5, 0.75} {
+				if _, err := bq.Result(rank); err != nil {
+					t.Fatalf("With %v, couldn't compute dp result for rank=%f: %v", tc.n, rank, err)
+				}
+				confInt, err := bq.ComputeConfidenceInterval(rank, 0.01)
+				if err != nil {
+					t.Fatalf("With %v, couldn't compute confidence interval for rank=%f: %v", tc.n, rank, err)
+				}
+				if raw := rawQuantile(values, rank); confInt.LowerBound > raw || confInt.UpperBound < raw {
+					t.Errorf("With %v and rank=%f, confidence interval=%+v should contain the raw quantile %f", tc.n, rank, confInt, raw)
+				}
+			}
+		}
+	}
+}
+
+func TestBoundedQuantilesComputeConfidenceInterval_Errors(t *testing.T) {
+	bq := getNoiselessBQ(t, 0, 10)
+	bq.Add(1)
+	if _, err := bq.ComputeConfidenceInterval(0.5, arbitraryAlpha); err == nil {
+		t.Errorf("ComputeConfidenceInterval before Result: got no error, want error")
+	}
+	if _, err := bq.Result(0.5); err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	for _, tc := range []struct {
+		desc        string
+		rank, alpha float64
+	}{
+		{"negative rank", -0.1, arbitraryAlpha},
+		{"rank larger than 1", 1.1, arbitraryAlpha},
+		{"alpha of 0", 0.5, 0},
+		{"alpha of 1", 0.5, 1},
+	} {
+		if _, err := bq.ComputeConfidenceInterval(tc.rank, tc.alpha); err == nil {
+			t.Errorf("ComputeConfidenceInterval with %s: got no error, want error", tc.desc)
+		}
+	}
+}
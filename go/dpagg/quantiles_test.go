@@ -17,6 +17,8 @@
 package dpagg
 
 import (
+	"context"
+	"errors"
 	"math"
 	"math/rand"
 	"reflect"
@@ -200,6 +202,45 @@ func TestNewBoundedQuantiles(t *testing.T) {
 			},
 			nil,
 			true},
+		{"Prior has a negative weight",
+			&BoundedQuantilesOptions{
+				Epsilon:                      ln3,
+				Delta:                        tenten,
+				Lower:                        -1,
+				Upper:                        5,
+				Noise:                        noise.Gaussian(),
+				MaxContributionsPerPartition: 2,
+				MaxPartitionsContributed:     1,
+				Prior:                        []float64{1, -1, 2},
+			},
+			nil,
+			true},
+		{"Prior has a NaN weight",
+			&BoundedQuantilesOptions{
+				Epsilon:                      ln3,
+				Delta:                        tenten,
+				Lower:                        -1,
+				Upper:                        5,
+				Noise:                        noise.Gaussian(),
+				MaxContributionsPerPartition: 2,
+				MaxPartitionsContributed:     1,
+				Prior:                        []float64{1, math.NaN()},
+			},
+			nil,
+			true},
+		{"Prior sums to 0",
+			&BoundedQuantilesOptions{
+				Epsilon:                      ln3,
+				Delta:                        tenten,
+				Lower:                        -1,
+				Upper:                        5,
+				Noise:                        noise.Gaussian(),
+				MaxContributionsPerPartition: 2,
+				MaxPartitionsContributed:     1,
+				Prior:                        []float64{0, 0},
+			},
+			nil,
+			true},
 	} {
 		got, err := NewBoundedQuantiles(tc.opt)
 		if (err != nil) != tc.wantErr {
@@ -335,6 +376,66 @@ func TestBQMultipleCallsForTheSameRank(t *testing.T) {
 	}
 }
 
+func TestBQResultContextCancelled(t *testing.T) {
+	lower, upper := -5.0, 5.0
+	bq := getNoiselessBQ(t, lower, upper)
+	want := getNoiselessBQ(t, lower, upper)
+	for _, i := range createEntries() {
+		bq.Add(i)
+		want.Add(i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bq.ResultContext(ctx, 0.5); !errors.Is(err, context.Canceled) {
+		t.Errorf("ResultContext with a cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+	// The result can still be computed after the cancellation.
+	got, err := bq.Result(0.5)
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	wantResult, err := want.Result(0.5)
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	if got != wantResult {
+		t.Errorf("Result after a cancelled ResultContext: got %f, want %f", got, wantResult)
+	}
+}
+
+func TestBQMergeContextCancelled(t *testing.T) {
+	lower, upper := -5.0, 5.0
+	bq1 := getNoiselessBQ(t, lower, upper)
+	bq2 := getNoiselessBQ(t, lower, upper)
+	want := getNoiselessBQ(t, lower, upper)
+	for i, e := range createEntries() {
+		if i%2 == 0 {
+			bq1.Add(e)
+		} else {
+			bq2.Add(e)
+		}
+		want.Add(e)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bq1.MergeContext(ctx, bq2); !errors.Is(err, context.Canceled) {
+		t.Errorf("MergeContext with a cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+	if bq2.state != defaultState {
+		t.Errorf("MergeContext with a cancelled context: for bq2.state got %v, want Default", bq2.state)
+	}
+	// The merge can be resumed after the cancellation.
+	if err := bq1.MergeContext(context.Background(), bq2); err != nil {
+		t.Fatalf("Couldn't merge bq1 and bq2: %v", err)
+	}
+	if diff := cmp.Diff(want.tree, bq1.tree); diff != "" {
+		t.Errorf("MergeContext: got tree diff (-want +got):\n%s", diff)
+	}
+	if bq2.state != merged {
+		t.Errorf("MergeContext: for bq2.state got %v, want Merged", bq2.state)
+	}
+}
+
 // Tests that Result() is invariant to entry order.
 func TestBQInvariantToEntryOrder(t *testing.T) {
 	lower, upper := -5.0, 5.0
@@ -413,6 +514,102 @@ func TestBQIncreasesMonotonically(t *testing.T) {
 	}
 }
 
+func TestBQPriorLeavesHaveEqualPriorMass(t *testing.T) {
+	// Three quarters of the prior are on [0, 5], and one quarter on [5, 10].
+	bq, err := NewBoundedQuantiles(&BoundedQuantilesOptions{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		Lower:                        0,
+		Upper:                        10,
+		TreeHeight:                   1,
+		BranchingFactor:              2,
+		Noise:                        noNoise{},
+		Prior:                        []float64{3, 1},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize bq: %v", err)
+	}
+	// The prior is mixed with the uniform distribution with weight 0.05, so [0, 5] has mass
+	// 0.95·0.75 + 0.05·0.5 and the leaves are split at the value v of [0, 5] where it reaches 0.5.
+	split := 5 * 0.5 / (0.95*0.75 + 0.05*0.5)
+	if got := bq.getRightValue(bq.leftmostLeafIndex); !ApproxEqual(got, split) {
+		t.Errorf("getRightValue(leftmost leaf): got %f, want %f", got, split)
+	}
+	if got := bq.getLeftValue(bq.leftmostLeafIndex + 1); !ApproxEqual(got, split) {
+		t.Errorf("getLeftValue(rightmost leaf): got %f, want %f", got, split)
+	}
+	if got := bq.getLeftValue(bq.leftmostLeafIndex); got != 0 {
+		t.Errorf("getLeftValue(leftmost leaf): got %f, want 0", got)
+	}
+	if got := bq.getRightValue(bq.leftmostLeafIndex + 1); got != 10 {
+		t.Errorf("getRightValue(rightmost leaf): got %f, want 10", got)
+	}
+	for _, tc := range []struct {
+		value float64
+		want  int
+	}{
+		{0, bq.leftmostLeafIndex},
+		{split - 0.01, bq.leftmostLeafIndex},
+		{split + 0.01, bq.leftmostLeafIndex + 1},
+		{10, bq.leftmostLeafIndex + 1},
+	} {
+		if got := bq.getIndex(tc.value); got != tc.want {
+			t.Errorf("getIndex(%f): got %d, want %d", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestBQPriorImprovesAccuracyInDenseRegion(t *testing.T) {
+	lower, upper := 0.0, 100.0
+	// A prior that puts most of its mass on [0, 1], where the values are.
+	prior := make([]float64, 100)
+	prior[0] = 99
+	for i := 1; i < len(prior); i++ {
+		prior[i] = 0.01
+	}
+	newBQ := func(prior []float64) *BoundedQuantiles {
+		bq, err := NewBoundedQuantiles(&BoundedQuantilesOptions{
+			Epsilon:                      ln3,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			Lower:                        lower,
+			Upper:                        upper,
+			TreeHeight:                   2,
+			BranchingFactor:              10,
+			Noise:                        noNoise{},
+			Prior:                        prior,
+		})
+		if err != nil {
+			t.Fatalf("Couldn't initialize bq: %v", err)
+		}
+		return bq
+	}
+	withoutPrior, withPrior := newBQ(nil), newBQ(prior)
+	// The values are on [0, 1], and the quantile of rank r is r².
+	for i := 0; i < 1000; i++ {
+		v := math.Pow(float64(i)/1000, 2)
+		withoutPrior.Add(v)
+		withPrior.Add(v)
+	}
+	for _, rank := range []float64{0.1, 0.25, 0.5, 0.75, 0.9} {
+		gotWithout, err := withoutPrior.Result(rank)
+		if err != nil {
+			t.Fatalf("Couldn't compute result without prior for rank=%f: %v", rank, err)
+		}
+		gotWith, err := withPrior.Result(rank)
+		if err != nil {
+			t.Fatalf("Couldn't compute result with prior for rank=%f: %v", rank, err)
+		}
+		// Without the prior, all values are in the leftmost leaf of width 1. With the prior, leaves
+		// are narrower than 0.02 on [0, 1].
+		want := rank * rank
+		if errWith, errWithout := math.Abs(gotWith-want), math.Abs(gotWithout-want); errWith > 0.02 || errWith >= errWithout {
+			t.Errorf("Result(%f): got %f with prior and %f without, want the former within 0.02 of %f", rank, gotWith, gotWithout, want)
+		}
+	}
+}
+
 func TestBoundedQuantilesResultSetsStateCorrectly(t *testing.T) {
 	lower, upper := -5.0, 5.0
 	bq := getNoiselessBQ(t, lower, upper)
@@ -755,6 +952,27 @@ func TestCheckMergeBoundedQuantilesCompatibility(t *testing.T) {
 				Noise:                        noise.Gaussian(),
 			},
 			true},
+		{"different prior",
+			&BoundedQuantilesOptions{
+				Epsilon:                      ln3,
+				Delta:                        tenten,
+				Lower:                        -1,
+				Upper:                        5,
+				MaxContributionsPerPartition: 2,
+				MaxPartitionsContributed:     2,
+				Noise:                        noise.Gaussian(),
+				Prior:                        []float64{1, 2, 3},
+			},
+			&BoundedQuantilesOptions{
+				Epsilon:                      ln3,
+				Delta:                        tenten,
+				Lower:                        -1,
+				Upper:                        5,
+				MaxContributionsPerPartition: 2,
+				MaxPartitionsContributed:     2,
+				Noise:                        noise.Gaussian(),
+			},
+			true},
 	} {
 		bq1, err := NewBoundedQuantiles(tc.opt1)
 		if err != nil {
@@ -1054,6 +1272,15 @@ func TestBQSerialization(t *testing.T) {
 			BranchingFactor:              12,
 			Noise:                        noise.Gaussian(),
 		}},
+		{"prior", &BoundedQuantilesOptions{
+			Epsilon:                      ln3,
+			Lower:                        0,
+			Upper:                        10,
+			Delta:                        0,
+			MaxContributionsPerPartition: 1,
+			MaxPartitionsContributed:     1,
+			Prior:                        []float64{5, 1, 0, 3},
+		}},
 	} {
 		bq, err := NewBoundedQuantiles(tc.opts)
 		if err != nil {
@@ -1107,6 +1334,99 @@ func TestBQSerializationStateChecks(t *testing.T) {
 	}
 }
 
+func TestBQSerializedSize(t *testing.T) {
+	bq := getNoiselessBQ(t, -5, 5)
+	bq.Add(1.0)
+	bq.Add(2.0)
+	got, err := bq.SerializedSize()
+	if err != nil {
+		t.Fatalf("SerializedSize: got error %v", err)
+	}
+	if bq.state != defaultState {
+		t.Errorf("SerializedSize: BoundedQuantiles should keep its state, got %v, want defaultState", bq.state)
+	}
+	bytes, err := bq.GobEncode()
+	if err != nil {
+		t.Fatalf("GobEncode: got error %v", err)
+	}
+	if got != len(bytes) {
+		t.Errorf("SerializedSize: got %d, want len(GobEncode())=%d", got, len(bytes))
+	}
+}
+
+// Tests that SerializedSize() returns errors correctly with different BoundedQuantiles aggregation states.
+func TestBQSerializedSizeStateChecks(t *testing.T) {
+	for _, tc := range []struct {
+		state   aggregationState
+		wantErr bool
+	}{
+		{defaultState, false},
+		{merged, true},
+		{serialized, false},
+		{resultReturned, true},
+	} {
+		bq := getNoiselessBQ(t, -5, 5)
+		bq.state = tc.state
+
+		if _, err := bq.SerializedSize(); (err != nil) != tc.wantErr {
+			t.Errorf("SerializedSize: when state %v for err got %v, wantErr %t", tc.state, err, tc.wantErr)
+		}
+	}
+}
+
+func TestBQMemoryFootprint(t *testing.T) {
+	bq := getNoiselessBQ(t, -5, 5)
+	empty := bq.MemoryFootprint()
+	bq.Add(1.0)
+	oneEntry := bq.MemoryFootprint()
+	if oneEntry <= empty {
+		t.Errorf("MemoryFootprint: got %d after adding an entry, want more than %d for an empty BoundedQuantiles", oneEntry, empty)
+	}
+	// Adding the same value again doesn't create new nodes in the tree.
+	bq.Add(1.0)
+	if got := bq.MemoryFootprint(); got != oneEntry {
+		t.Errorf("MemoryFootprint: got %d after adding the same entry twice, want %d", got, oneEntry)
+	}
+}
+
+func TestBQMechanism(t *testing.T) {
+	bq, err := NewBoundedQuantiles(&BoundedQuantilesOptions{
+		Epsilon:                      2,
+		MaxPartitionsContributed:     2,
+		MaxContributionsPerPartition: 3,
+		Lower:                        0,
+		Upper:                        16,
+		TreeHeight:                   2,
+		BranchingFactor:              4,
+		Noise:                        noise.Laplace(),
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize bq: %v", err)
+	}
+	// l0 = TreeHeight·MaxPartitionsContributed = 4 and lInf = 3, so the Laplace noise of each
+	// node has standard deviation √2·4·3/2.
+	stdDev := math.Sqrt2 * 6
+	want := QuantileTreeMechanism{
+		Epsilon:                      2,
+		NoiseKind:                    noise.LaplaceNoise,
+		Lower:                        0,
+		Upper:                        16,
+		TreeHeight:                   2,
+		BranchingFactor:              4,
+		MaxPartitionsContributed:     2,
+		MaxContributionsPerPartition: 3,
+		L0Sensitivity:                4,
+		LInfSensitivity:              3,
+		Levels: []QuantileTreeLevel{
+			{Depth: 1, NumNodes: 4, NodeWidth: 4, NoiseStandardDeviation: stdDev},
+			{Depth: 2, NumNodes: 16, NodeWidth: 1, NoiseStandardDeviation: stdDev},
+		},
+	}
+	if diff := cmp.Diff(want, bq.Mechanism(), cmpopts.EquateApprox(1e-12, 0)); diff != "" {
+		t.Errorf("Mechanism: got diff (-want +got):\n%s", diff)
+	}
+}
+
 func compareBoundedQuantiles(bq1, bq2 *BoundedQuantiles) bool {
 	return bq1.l0Sensitivity == bq2.l0Sensitivity &&
 		bq1.lInfSensitivity == bq2.lInfSensitivity &&
@@ -1118,6 +1438,7 @@ func compareBoundedQuantiles(bq1, bq2 *BoundedQuantiles) bool {
 		bq1.leftmostLeafIndex == bq2.leftmostLeafIndex &&
 		bq1.Noise == bq2.Noise &&
 		bq1.noiseKind == bq2.noiseKind &&
+		reflect.DeepEqual(bq1.priorCDF, bq2.priorCDF) &&
 		reflect.DeepEqual(bq1.tree, bq2.tree) &&
 		reflect.DeepEqual(bq1.noisedTree, bq2.noisedTree) &&
 		bq1.state == bq2.state
@@ -19,6 +19,7 @@ package dpagg
 import (
 	"fmt"
 	"math"
+	"strings"
 
 	"github.com/google/differential-privacy/go/v3/checks"
 	"github.com/google/differential-privacy/go/v3/noise"
@@ -93,17 +94,29 @@ import (
 //
 // See https://github.com/google/differential-privacy/blob/main/common_docs/pre_thresholding.md
 // for more information.
+//
+// If AllowWeightedIncrements is set in PreAggSelectPartitionOptions, privacy IDs
+// can also be counted with a weight in [0, 1] using IncrementByWeight, e.g. when
+// an upstream stage samples privacy IDs and weights them accordingly. The
+// selection then depends on the total weight w of the partition: it is the
+// selection for ⌊w⌋ privacy IDs with probability 1-(w-⌊w⌋), and for ⌊w⌋+1
+// privacy IDs otherwise. Since the weight of a privacy ID is at most 1, this is
+// as differentially private as the selection for integer counts.
 type PreAggSelectPartition struct {
 	// parameters
-	epsilon       float64
-	delta         float64
-	l0Sensitivity int64
-	preThreshold  int64
+	epsilon                 float64
+	delta                   float64
+	l0Sensitivity           int64
+	preThreshold            int64
+	allowWeightedIncrements bool
 
 	// State variables
 	// idCount is the count of unique privacy IDs in the partition.
 	idCount int64
-	state   aggregationState
+	// weightDeficit is the sum of 1-weight over the privacy IDs counted with
+	// IncrementByWeight, so that the total weight is idCount-weightDeficit.
+	weightDeficit float64
+	state         aggregationState
 }
 
 func preAggSelectPartitionEquallyInitialized(s1, s2 *PreAggSelectPartition) bool {
@@ -111,7 +124,8 @@ func preAggSelectPartitionEquallyInitialized(s1, s2 *PreAggSelectPartition) bool
 		s1.delta == s2.delta &&
 		s1.l0Sensitivity == s2.l0Sensitivity &&
 		s1.state == s2.state &&
-		s1.preThreshold == s2.preThreshold
+		s1.preThreshold == s2.preThreshold &&
+		s1.allowWeightedIncrements == s2.allowWeightedIncrements
 }
 
 // PreAggSelectPartitionOptions is used to set the privacy parameters when
@@ -132,6 +146,9 @@ type PreAggSelectPartitionOptions struct {
 	// MaxPartitionsContributed is the number of distinct partitions a single
 	// privacy unit can contribute to. Required.
 	MaxPartitionsContributed int64
+	// AllowWeightedIncrements enables IncrementByWeight, which counts privacy
+	// IDs with a weight in [0, 1] instead of 1. Optional.
+	AllowWeightedIncrements bool
 }
 
 // NewPreAggSelectPartition constructs a new PreAggSelectPartition from opt.
@@ -149,10 +166,11 @@ func NewPreAggSelectPartition(opt *PreAggSelectPartitionOptions) (*PreAggSelectP
 	}
 
 	s := PreAggSelectPartition{
-		epsilon:       opt.Epsilon,
-		delta:         opt.Delta,
-		preThreshold:  opt.PreThreshold,
-		l0Sensitivity: opt.MaxPartitionsContributed,
+		epsilon:                 opt.Epsilon,
+		delta:                   opt.Delta,
+		preThreshold:            opt.PreThreshold,
+		l0Sensitivity:           opt.MaxPartitionsContributed,
+		allowWeightedIncrements: opt.AllowWeightedIncrements,
 	}
 
 	if err := checks.CheckDeltaStrict(s.delta); err != nil {
@@ -192,6 +210,32 @@ func (s *PreAggSelectPartition) IncrementBy(count int64) error {
 	return nil
 }
 
+// IncrementByWeight counts a single privacy ID with the given weight. Weights
+// larger than 1 are capped at 1, so that a privacy ID never counts for more
+// than one in the selection. It requires AllowWeightedIncrements.
+// The caller must ensure this method is called at most once per privacy ID.
+func (s *PreAggSelectPartition) IncrementByWeight(weight float64) error {
+	if s.state != defaultState {
+		return fmt.Errorf("PreAggSelectPartition cannot be amended: %v", s.state.errorMessage())
+	}
+	if !s.allowWeightedIncrements {
+		return fmt.Errorf("IncrementByWeight requires AllowWeightedIncrements to be set")
+	}
+	if math.IsNaN(weight) || weight < 0 {
+		return fmt.Errorf("IncrementByWeight: weight must be non-negative, got %f", weight)
+	}
+	s.idCount++
+	s.weightDeficit += 1 - math.Min(weight, 1)
+	return nil
+}
+
+// IDCount returns the number of privacy IDs counted so far. It is not
+// differentially private: it must only be used to implement other partition
+// selection mechanisms on top of the counting of PreAggSelectPartition.
+func (s *PreAggSelectPartition) IDCount() int64 {
+	return s.idCount
+}
+
 // Merge merges s2 into s (i.e., add the idCount of s2 to s). This implicitly
 // assumes that s and s2 act on distinct privacy IDs. s2 is consumed by this
 // operation: s2 may not be used after it is merged into s.
@@ -204,6 +248,7 @@ func (s *PreAggSelectPartition) Merge(s2 *PreAggSelectPartition) error {
 	}
 
 	s.idCount += s2.idCount
+	s.weightDeficit += s2.weightDeficit
 	s2.state = merged
 	return nil
 }
@@ -238,6 +283,16 @@ func (s *PreAggSelectPartition) ShouldKeepPartition() (bool, error) {
 	// PreThreshold is set to 1 as the default, subtract it here so it has no effect.
 	// This subtraction also ensures that idCount will always be > 0 if preThreshold = idsCount.
 	s.idCount = s.idCount - (s.preThreshold - 1)
+	if s.weightDeficit > 0 {
+		// Randomly round the total weight to one of its neighboring integers, so
+		// that the probability of keeping the partition interpolates between them.
+		weight := math.Max(float64(s.idCount)-s.weightDeficit, 0)
+		rounded := math.Floor(weight)
+		if rand.Uniform() < weight-rounded {
+			rounded++
+		}
+		s.idCount = int64(rounded)
+	}
 
 	if s.l0Sensitivity > 3 { // Gaussian thresholding outperforms in this case.
 		c, err := NewCount(&CountOptions{
@@ -265,6 +320,38 @@ func (s *PreAggSelectPartition) ShouldKeepPartition() (bool, error) {
 	return rand.Uniform() < prob, nil
 }
 
+// KeepPartitionProbability returns the probability that ShouldKeepPartition
+// returns true for the privacy IDs counted so far, including the random
+// rounding of weighted increments. Unlike ShouldKeepPartition, it is
+// deterministic and doesn't consume the PreAggSelectPartition, but it is not
+// differentially private: it must only be used in tests, or to analyze the
+// utility of partition selection.
+func (s *PreAggSelectPartition) KeepPartitionProbability() (float64, error) {
+	if s.state != defaultState {
+		return 0, fmt.Errorf("PreAggSelectPartition's KeepPartitionProbability cannot be computed: %v", s.state.errorMessage())
+	}
+	if s.idCount < s.preThreshold {
+		return 0, nil
+	}
+	idCount := s.idCount - (s.preThreshold - 1)
+	if s.weightDeficit <= 0 {
+		return s.keepProbabilityAfterPreThreshold(idCount)
+	}
+	// ShouldKeepPartition rounds the weight up with probability weight-rounded,
+	// so the probability interpolates linearly between both neighbors.
+	weight := math.Max(float64(idCount)-s.weightDeficit, 0)
+	rounded := math.Floor(weight)
+	lower, err := s.keepProbabilityAfterPreThreshold(int64(rounded))
+	if err != nil {
+		return 0, err
+	}
+	upper, err := s.keepProbabilityAfterPreThreshold(int64(rounded) + 1)
+	if err != nil {
+		return 0, err
+	}
+	return lower + (weight-rounded)*(upper-lower), nil
+}
+
 // sumExpPowers returns the evaluation of
 //
 //	exp(minPower * ε) + exp((minPower+1) * ε) + ... + exp((numPowers+minPower-1) * ε)
@@ -389,6 +476,119 @@ func (s *PreAggSelectPartition) GetHardThreshold() (int, error) {
 	}
 }
 
+// PartitionSelectionCalibration describes how likely a PreAggSelectPartition
+// is to keep a partition depending on the number of privacy IDs in it, to
+// answer questions like "how many privacy IDs does a partition need to appear
+// in the output?" before running the partition selection.
+type PartitionSelectionCalibration struct {
+	// Options of the PreAggSelectPartition.
+	Epsilon, Delta                         float64
+	MaxPartitionsContributed, PreThreshold int64
+	// GaussianThresholding is whether partitions are selected by thresholding a
+	// count with Gaussian noise, which is the case when MaxPartitionsContributed
+	// is larger than 3. Otherwise, the optimal "magic" partition selection is
+	// used. See PreAggSelectPartition.
+	GaussianThresholding bool
+	// Probabilities of keeping a partition, by increasing number of privacy IDs
+	// starting from 0.
+	Probabilities []KeepPartitionProbability
+}
+
+// KeepPartitionProbability is the probability of keeping a partition with
+// IDCount privacy IDs.
+type KeepPartitionProbability struct {
+	IDCount     int64
+	Probability float64
+}
+
+// CalibratePartitionSelection returns the probability that a
+// PreAggSelectPartition with options opt keeps a partition with n privacy IDs,
+// for each n from 0 to maxIDCount. It doesn't depend on any data, so it
+// doesn't consume privacy budget.
+//
+// With magic partition selection, probabilities are exact. With Gaussian
+// thresholding, they approximate the discrete Gaussian noise of the count by a
+// continuous Gaussian distribution.
+func CalibratePartitionSelection(opt *PreAggSelectPartitionOptions, maxIDCount int64) (PartitionSelectionCalibration, error) {
+	s, err := NewPreAggSelectPartition(opt)
+	if err != nil {
+		return PartitionSelectionCalibration{}, fmt.Errorf("CalibratePartitionSelection: %w", err)
+	}
+	if maxIDCount < 0 {
+		return PartitionSelectionCalibration{}, fmt.Errorf("CalibratePartitionSelection: maxIDCount (%d) must be non-negative", maxIDCount)
+	}
+	c := PartitionSelectionCalibration{
+		Epsilon:                  s.epsilon,
+		Delta:                    s.delta,
+		MaxPartitionsContributed: s.l0Sensitivity,
+		PreThreshold:             s.preThreshold,
+		GaussianThresholding:     s.l0Sensitivity > 3,
+	}
+	for n := int64(0); n <= maxIDCount; n++ {
+		prob, err := s.keepProbability(n)
+		if err != nil {
+			return PartitionSelectionCalibration{}, fmt.Errorf("CalibratePartitionSelection: %w", err)
+		}
+		c.Probabilities = append(c.Probabilities, KeepPartitionProbability{IDCount: n, Probability: prob})
+	}
+	return c, nil
+}
+
+// keepProbability returns the probability that ShouldKeepPartition returns
+// true for a partition with idCount privacy IDs.
+func (s *PreAggSelectPartition) keepProbability(idCount int64) (float64, error) {
+	if idCount < s.preThreshold {
+		return 0, nil
+	}
+	return s.keepProbabilityAfterPreThreshold(idCount - (s.preThreshold - 1))
+}
+
+// keepProbabilityAfterPreThreshold is like keepProbability, for a number of
+// privacy IDs from which PreThreshold-1 was already subtracted.
+func (s *PreAggSelectPartition) keepProbabilityAfterPreThreshold(idCount int64) (float64, error) {
+	if s.l0Sensitivity > 3 {
+		gaussian := noise.Gaussian()
+		threshold, err := gaussian.Threshold(s.l0Sensitivity, 1, s.epsilon, s.delta/2, s.delta/2)
+		if err != nil {
+			return 0, err
+		}
+		sigma := noise.SigmaForGaussian(s.l0Sensitivity, 1, s.epsilon, s.delta/2)
+		// The noisy count is an integer, so it is at least ⌈threshold⌉ iff it is
+		// more than ⌈threshold⌉-0.5.
+		z := (math.Ceil(threshold) - 0.5 - float64(idCount)) / sigma
+		return 0.5 * math.Erfc(z/math.Sqrt2), nil
+	}
+	return keepPartitionProbability(idCount, s.l0Sensitivity, s.epsilon, s.delta)
+}
+
+// MinIDCount returns the smallest number of privacy IDs in c.Probabilities
+// for which a partition is kept with probability at least probability, and
+// false if there is none.
+func (c PartitionSelectionCalibration) MinIDCount(probability float64) (int64, bool) {
+	for _, p := range c.Probabilities {
+		if p.Probability >= probability {
+			return p.IDCount, true
+		}
+	}
+	return 0, false
+}
+
+// String documents the calibration as a human-readable table.
+func (c PartitionSelectionCalibration) String() string {
+	var b strings.Builder
+	algorithm := "magic partition selection"
+	if c.GaussianThresholding {
+		algorithm = "Gaussian thresholding"
+	}
+	fmt.Fprintf(&b, "Partition selection with (ε=%g, δ=%g), %d partitions contributed per privacy unit and pre-threshold %d, using %s.\n",
+		c.Epsilon, c.Delta, c.MaxPartitionsContributed, c.PreThreshold, algorithm)
+	fmt.Fprintf(&b, "  privacy IDs  keep probability\n")
+	for _, p := range c.Probabilities {
+		fmt.Fprintf(&b, "  %11d  %g\n", p.IDCount, p.Probability)
+	}
+	return b.String()
+}
+
 // encodablePreAggSelectPartition can be encoded by the gob package.
 type encodablePreAggSelectPartition struct {
 	Epsilon       float64
@@ -397,6 +597,9 @@ type encodablePreAggSelectPartition struct {
 	IDCount       int64
 	State         aggregationState
 	PreThreshold  int64
+	// Fields for weighted increments.
+	AllowWeightedIncrements bool
+	WeightDeficit           float64
 }
 
 // GobEncode encodes PreAggSelectPartition.
@@ -411,6 +614,9 @@ func (s *PreAggSelectPartition) GobEncode() ([]byte, error) {
 		IDCount:       s.idCount,
 		State:         s.state,
 		PreThreshold:  s.preThreshold,
+
+		AllowWeightedIncrements: s.allowWeightedIncrements,
+		WeightDeficit:           s.weightDeficit,
 	}
 	s.state = serialized
 	return encode(enc)
@@ -430,6 +636,9 @@ func (s *PreAggSelectPartition) GobDecode(data []byte) error {
 		idCount:       enc.IDCount,
 		state:         enc.State,
 		preThreshold:  enc.PreThreshold,
+
+		allowWeightedIncrements: enc.AllowWeightedIncrements,
+		weightDeficit:           enc.WeightDeficit,
 	}
 	return nil
 }
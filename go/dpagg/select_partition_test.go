@@ -133,7 +133,9 @@ func comparePreAggSelectPartitionSelection(s1, s2 *PreAggSelectPartition) bool {
 		s1.l0Sensitivity == s2.l0Sensitivity &&
 		s1.idCount == s2.idCount &&
 		s1.state == s2.state &&
-		s1.preThreshold == s2.preThreshold
+		s1.preThreshold == s2.preThreshold &&
+		s1.allowWeightedIncrements == s2.allowWeightedIncrements &&
+		s1.weightDeficit == s2.weightDeficit
 }
 
 // Tests that serialization for PreAggSelectPartition works as expected.
@@ -153,6 +155,12 @@ func TestPreAggSelectPartitionSerialization(t *testing.T) {
 			MaxPartitionsContributed: 5,
 			PreThreshold:             10,
 		}},
+		{"weighted increments", &PreAggSelectPartitionOptions{
+			Epsilon:                  ln3,
+			Delta:                    1e-5,
+			MaxPartitionsContributed: 1,
+			AllowWeightedIncrements:  true,
+		}},
 	} {
 		s, err := NewPreAggSelectPartition(tc.opts)
 		if err != nil {
@@ -223,6 +231,48 @@ func TestPreAggSelectPartitionIncrementBy_NegativeValues(t *testing.T) {
 	}
 }
 
+func TestPreAggSelectPartitionIncrementByWeight(t *testing.T) {
+	s, err := NewPreAggSelectPartition(&PreAggSelectPartitionOptions{
+		Epsilon:                  ln3,
+		Delta:                    1e-5,
+		MaxPartitionsContributed: 1,
+		AllowWeightedIncrements:  true,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't initialize s: %v", err)
+	}
+	for _, weight := range []float64{0.25, 1, 2} { // 2 is capped at 1.
+		if err := s.IncrementByWeight(weight); err != nil {
+			t.Fatalf("IncrementByWeight(%f): got error %v", weight, err)
+		}
+	}
+	if s.idCount != 3 || s.weightDeficit != 0.75 {
+		t.Errorf("IncrementByWeight: got idCount=%d and weightDeficit=%f, want 3 and 0.75", s.idCount, s.weightDeficit)
+	}
+	for _, weight := range []float64{-0.5, math.NaN()} {
+		if err := s.IncrementByWeight(weight); err == nil {
+			t.Errorf("IncrementByWeight(%f): got no error, want error", weight)
+		}
+	}
+}
+
+func TestPreAggSelectPartitionIncrementByWeight_RequiresOption(t *testing.T) {
+	s := getTestPreAggSelectPartition(t)
+	if err := s.IncrementByWeight(0.5); err == nil {
+		t.Errorf("IncrementByWeight without AllowWeightedIncrements: got no error, want error")
+	}
+}
+
+func TestPreAggSelectPartitionIDCount(t *testing.T) {
+	s1, s2 := getTestPreAggSelectPartition(t), getTestPreAggSelectPartition(t)
+	s1.IncrementBy(3)
+	s2.Increment()
+	s1.Merge(s2)
+	if got := s1.IDCount(); got != 4 {
+		t.Errorf("IDCount: got %d, want 4", got)
+	}
+}
+
 func TestPreAggSelectPartitionKeepPartitionProbability(t *testing.T) {
 	for _, tc := range []struct {
 		name          string
@@ -516,6 +566,58 @@ func TestPreAggSelectPartition(t *testing.T) {
 	}
 }
 
+// Tests that the probability of keeping a partition with a fractional total
+// weight interpolates between the probabilities for the neighboring counts.
+func TestPreAggSelectPartition_WeightedIncrements(t *testing.T) {
+	opts := &PreAggSelectPartitionOptions{
+		Epsilon:                  math.Log(2),
+		Delta:                    0.3,
+		MaxPartitionsContributed: 1,
+		AllowWeightedIncrements:  true,
+	}
+	prob1, err := keepPartitionProbability(1, 1, opts.Epsilon, opts.Delta)
+	if err != nil {
+		t.Fatalf("Couldn't compute keepPartitionProbability: %v", err)
+	}
+	prob2, err := keepPartitionProbability(2, 1, opts.Epsilon, opts.Delta)
+	if err != nil {
+		t.Fatalf("Couldn't compute keepPartitionProbability: %v", err)
+	}
+	// The total weight is 1.5, so the partition is kept with probability
+	// (0.3+0.8)/2 = 0.55. This test is non-deterministic: the average of
+	// 100,000 trials is within 0.55 +/- 0.01 with probability at least
+	// 1 - 1e-9, so we retry up to 2 times upon failure.
+	wantSelectionRate := (prob1 + prob2) / 2
+	const numTrials, tolerance, retriesForFlakiness = 100_000, 0.01, 2
+	for testAttempt := 0; testAttempt <= retriesForFlakiness; testAttempt++ {
+		var selections int
+		for trial := 0; trial < numTrials; trial++ {
+			s, err := NewPreAggSelectPartition(opts)
+			if err != nil {
+				t.Fatalf("Couldn't initialize s: %v", err)
+			}
+			s.Increment()
+			s.IncrementByWeight(0.5)
+			should, err := s.ShouldKeepPartition()
+			if err != nil {
+				t.Fatalf("Couldn't compute ShouldKeepPartition: %v", err)
+			}
+			if should {
+				selections++
+			}
+		}
+		gotSelectionRate := float64(selections) / numTrials
+		if math.Abs(wantSelectionRate-gotSelectionRate) <= tolerance {
+			return
+		}
+		if testAttempt == retriesForFlakiness {
+			t.Errorf("Failed on attempt %d: wantSelectionRate: %v, gotSelectionRate: %v", testAttempt, wantSelectionRate, gotSelectionRate)
+		} else {
+			t.Logf("Failed on attempt %d: wantSelectionRate: %v, gotSelectionRate: %v", testAttempt, wantSelectionRate, gotSelectionRate)
+		}
+	}
+}
+
 // Tests that an idCount smaller than the prethreshold deterministically returns false.
 func TestPreAggSelectPartition_CountSmallerThanPreThresholdReturnsFalse(t *testing.T) {
 	for _, tc := range []struct {
@@ -564,6 +666,167 @@ func TestPreAggSelectPartition_CountGreaterThanPreThresholdReturnsTrue(t *testin
 	}
 }
 
+// Tests that CalibratePartitionSelection returns the probabilities of magic
+// partition selection, and applies the pre-threshold.
+func TestCalibratePartitionSelection(t *testing.T) {
+	opts := &PreAggSelectPartitionOptions{
+		Epsilon:                  ln3,
+		Delta:                    1e-5,
+		MaxPartitionsContributed: 2,
+		PreThreshold:             3,
+	}
+	c, err := CalibratePartitionSelection(opts, 50)
+	if err != nil {
+		t.Fatalf("CalibratePartitionSelection: %v", err)
+	}
+	if c.GaussianThresholding {
+		t.Errorf("CalibratePartitionSelection: got Gaussian thresholding, want magic partition selection")
+	}
+	if len(c.Probabilities) != 51 {
+		t.Fatalf("CalibratePartitionSelection: got %d probabilities, want 51", len(c.Probabilities))
+	}
+	for n, p := range c.Probabilities {
+		want := 0.0
+		if n >= 3 {
+			want, err = keepPartitionProbability(int64(n)-2, 2, ln3, 1e-5)
+			if err != nil {
+				t.Fatalf("keepPartitionProbability: %v", err)
+			}
+		}
+		if p.IDCount != int64(n) || p.Probability != want {
+			t.Errorf("CalibratePartitionSelection: got %+v, want {IDCount:%d Probability:%g}", p, n, want)
+		}
+	}
+	s, err := NewPreAggSelectPartition(&PreAggSelectPartitionOptions{Epsilon: ln3, Delta: 1e-5, MaxPartitionsContributed: 2})
+	if err != nil {
+		t.Fatalf("Couldn't initialize s: %v", err)
+	}
+	hardThreshold, err := s.GetHardThreshold()
+	if err != nil {
+		t.Fatalf("GetHardThreshold: %v", err)
+	}
+	// The pre-threshold of 3 shifts the hard threshold by 2.
+	if got, ok := c.MinIDCount(1); !ok || got != int64(hardThreshold)+2 {
+		t.Errorf("MinIDCount(1): got (%d, %t), want (%d, true)", got, ok, hardThreshold+2)
+	}
+}
+
+// Tests that the probabilities returned by CalibratePartitionSelection with
+// Gaussian thresholding match the selection rate of PreAggSelectPartition.
+func TestCalibratePartitionSelection_GaussianThresholding(t *testing.T) {
+	opts := &PreAggSelectPartitionOptions{
+		Epsilon:                  ln3,
+		Delta:                    1e-5,
+		MaxPartitionsContributed: 4,
+	}
+	c, err := CalibratePartitionSelection(opts, 100)
+	if err != nil {
+		t.Fatalf("CalibratePartitionSelection: %v", err)
+	}
+	if !c.GaussianThresholding {
+		t.Errorf("CalibratePartitionSelection: got magic partition selection, want Gaussian thresholding")
+	}
+	n, ok := c.MinIDCount(0.5)
+	if !ok {
+		t.Fatalf("MinIDCount(0.5): got no count, want one")
+	}
+	// This test is non-deterministic: the selection rate over 100,000 trials is
+	// within 0.01 of the probability with probability at least 1 - 1e-9, so we
+	// retry up to 2 times upon failure.
+	want := c.Probabilities[n].Probability
+	const numTrials, tolerance, retriesForFlakiness = 100_000, 0.01, 2
+	for testAttempt := 0; testAttempt <= retriesForFlakiness; testAttempt++ {
+		var selections int
+		for trial := 0; trial < numTrials; trial++ {
+			s, err := NewPreAggSelectPartition(opts)
+			if err != nil {
+				t.Fatalf("Couldn't initialize s: %v", err)
+			}
+			s.IncrementBy(n)
+			should, err := s.ShouldKeepPartition()
+			if err != nil {
+				t.Fatalf("Couldn't compute ShouldKeepPartition: %v", err)
+			}
+			if should {
+				selections++
+			}
+		}
+		got := float64(selections) / numTrials
+		if math.Abs(want-got) <= tolerance {
+			return
+		}
+		if testAttempt == retriesForFlakiness {
+			t.Errorf("Failed on attempt %d: want selection rate %v for %d privacy IDs, got %v", testAttempt, want, n, got)
+		} else {
+			t.Logf("Failed on attempt %d: want selection rate %v for %d privacy IDs, got %v", testAttempt, want, n, got)
+		}
+	}
+}
+
+func TestCalibratePartitionSelection_InvalidArguments(t *testing.T) {
+	if _, err := CalibratePartitionSelection(&PreAggSelectPartitionOptions{Epsilon: ln3, Delta: 1e-5}, 10); err == nil {
+		t.Errorf("CalibratePartitionSelection without MaxPartitionsContributed: got no error, want error")
+	}
+	if _, err := CalibratePartitionSelection(&PreAggSelectPartitionOptions{Epsilon: ln3, Delta: 1e-5, MaxPartitionsContributed: 1}, -1); err == nil {
+		t.Errorf("CalibratePartitionSelection with negative maxIDCount: got no error, want error")
+	}
+}
+
+// Tests that KeepPartitionProbability matches CalibratePartitionSelection, and
+// interpolates between neighboring counts with weighted increments.
+func TestKeepPartitionProbability(t *testing.T) {
+	opts := &PreAggSelectPartitionOptions{
+		Epsilon:                  ln3,
+		Delta:                    1e-5,
+		MaxPartitionsContributed: 1,
+		PreThreshold:             2,
+		AllowWeightedIncrements:  true,
+	}
+	c, err := CalibratePartitionSelection(opts, 20)
+	if err != nil {
+		t.Fatalf("CalibratePartitionSelection: %v", err)
+	}
+	for _, p := range c.Probabilities {
+		s, err := NewPreAggSelectPartition(opts)
+		if err != nil {
+			t.Fatalf("Couldn't initialize s: %v", err)
+		}
+		s.IncrementBy(p.IDCount)
+		got, err := s.KeepPartitionProbability()
+		if err != nil {
+			t.Fatalf("KeepPartitionProbability with %d privacy IDs: got error %v", p.IDCount, err)
+		}
+		if got != p.Probability {
+			t.Errorf("KeepPartitionProbability with %d privacy IDs: got %g, want %g", p.IDCount, got, p.Probability)
+		}
+	}
+
+	// 10 privacy IDs with a weight of 1 and 1 with a weight of 0.25 have a total
+	// weight of 10.25 above the pre-threshold of 1.
+	s, err := NewPreAggSelectPartition(opts)
+	if err != nil {
+		t.Fatalf("Couldn't initialize s: %v", err)
+	}
+	s.IncrementBy(10)
+	s.IncrementByWeight(0.25)
+	got, err := s.KeepPartitionProbability()
+	if err != nil {
+		t.Fatalf("KeepPartitionProbability with weighted increments: got error %v", err)
+	}
+	want := 0.75*c.Probabilities[10].Probability + 0.25*c.Probabilities[11].Probability
+	if math.Abs(got-want) > 1e-12 {
+		t.Errorf("KeepPartitionProbability with weighted increments: got %g, want %g", got, want)
+	}
+
+	// KeepPartitionProbability doesn't consume s.
+	if _, err := s.ShouldKeepPartition(); err != nil {
+		t.Errorf("ShouldKeepPartition after KeepPartitionProbability: got error %v", err)
+	}
+	if _, err := s.KeepPartitionProbability(); err == nil {
+		t.Errorf("KeepPartitionProbability after ShouldKeepPartition: got no error, want error")
+	}
+}
+
 func TestMergePreAggSelectPartition(t *testing.T) {
 	wantFinalS1 := &PreAggSelectPartition{
 		epsilon:       0.1,
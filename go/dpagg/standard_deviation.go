@@ -60,6 +60,8 @@ type BoundedStandardDeviationOptions struct {
 	// Lower and Upper bounds for clamping. Required; must be such that Lower < Upper.
 	Lower, Upper float64
 	Noise        noise.Noise // Type of noise used in BoundedStandardDeviation. Defaults to Laplace noise.
+	// Mean of the values, if it is already known. See BoundedVarianceOptions.KnownMean. Optional.
+	KnownMean *float64
 }
 
 // NewBoundedStandardDeviation returns a new BoundedStandardDeviation.
@@ -72,6 +74,7 @@ func NewBoundedStandardDeviation(opt *BoundedStandardDeviationOptions) (*Bounded
 		Upper:                        opt.Upper,
 		Noise:                        opt.Noise,
 		MaxContributionsPerPartition: opt.MaxContributionsPerPartition,
+		KnownMean:                    opt.KnownMean,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("couldn't initialize BoundedVariance for NewBoundedStandardDeviation: %w", err)
@@ -81,28 +81,30 @@ func TestNewBoundedStandardDeviation(t *testing.T) {
 						state:           defaultState,
 					},
 					NormalizedSum: BoundedSumFloat64{
-						epsilon:         ln3 / 3,
-						delta:           0,
-						l0Sensitivity:   1,
-						lInfSensitivity: 6,
-						lower:           -3,
-						upper:           3,
-						noiseKind:       noise.LaplaceNoise,
-						Noise:           noise.Laplace(),
-						sum:             0,
-						state:           defaultState,
+						epsilon:                      ln3 / 3,
+						delta:                        0,
+						l0Sensitivity:                1,
+						lInfSensitivity:              6,
+						lower:                        -3,
+						upper:                        3,
+						noiseKind:                    noise.LaplaceNoise,
+						maxContributionsPerPartition: 2,
+						Noise:                        noise.Laplace(),
+						sum:                          0,
+						state:                        defaultState,
 					},
 					NormalizedSumOfSquares: BoundedSumFloat64{
-						epsilon:         ln3 - ln3/3 - ln3/3,
-						delta:           0,
-						l0Sensitivity:   1,
-						lInfSensitivity: 18,
-						lower:           0,
-						upper:           9,
-						noiseKind:       noise.LaplaceNoise,
-						Noise:           noise.Laplace(),
-						sum:             0,
-						state:           defaultState,
+						epsilon:                      ln3 - ln3/3 - ln3/3,
+						delta:                        0,
+						l0Sensitivity:                1,
+						lInfSensitivity:              18,
+						lower:                        0,
+						upper:                        9,
+						noiseKind:                    noise.LaplaceNoise,
+						maxContributionsPerPartition: 2,
+						Noise:                        noise.Laplace(),
+						sum:                          0,
+						state:                        defaultState,
 					},
 				}},
 			false},
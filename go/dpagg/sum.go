@@ -24,6 +24,7 @@ import (
 	log "github.com/golang/glog"
 	"github.com/google/differential-privacy/go/v3/checks"
 	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/go/v3/rand"
 )
 
 // BoundedSumInt64 calculates a differentially private sum of a collection of
@@ -32,7 +33,7 @@ import (
 // appropriately. However, it assumes that for each BoundedSumInt64 instance
 // (partition), each privacy unit contributes at most one value. If a privacy unit
 // contributes more, the contributions should be pre-aggregated before passing them
-// to BoundedSumInt64.
+// to BoundedSumInt64, or passed together to AddMany.
 //
 // The provided differentially private sum is an unbiased estimate of the raw
 // bounded sum in the sense that its expected value is equal to the raw bounded sum.
@@ -54,6 +55,8 @@ type BoundedSumInt64 struct {
 	upper           int64
 	Noise           noise.Noise
 	noiseKind       noise.Kind // necessary for serializing noise.Noise information
+	// Used by AddMany to cap the contributions of a privacy unit.
+	maxContributionsPerPartition int64
 
 	// State variables
 	sum       int64
@@ -68,6 +71,7 @@ func bsEquallyInitializedint64(s1, s2 *BoundedSumInt64) bool {
 		s1.lInfSensitivity == s2.lInfSensitivity &&
 		s1.lower == s2.lower &&
 		s1.upper == s2.upper &&
+		s1.maxContributionsPerPartition == s2.maxContributionsPerPartition &&
 		s1.noiseKind == s2.noiseKind &&
 		s1.state == s2.state
 }
@@ -101,6 +105,9 @@ func NewBoundedSumInt64(opt *BoundedSumInt64Options) (*BoundedSumInt64, error) {
 	if maxContributionsPerPartition == 0 {
 		maxContributionsPerPartition = 1
 	}
+	if err := checks.CheckMaxContributionsPerPartition(maxContributionsPerPartition); err != nil {
+		return nil, fmt.Errorf("NewBoundedSumInt64: %w", err)
+	}
 
 	n := opt.Noise
 	if n == nil {
@@ -126,6 +133,16 @@ func NewBoundedSumInt64(opt *BoundedSumInt64Options) (*BoundedSumInt64, error) {
 		if noise.ToKind(opt.Noise) == noise.Unrecognised {
 			// Ignore sensitivity overflows if noise is not recognised.
 			log.Warningf("NewBoundedSumInt64: getLInfInt failed with %q, using largest representable integer as lInf_sensitivity", err.Error())
+			Log(LogEntry{
+				Level:   LogWarning,
+				Source:  "NewBoundedSumInt64",
+				Message: "lInf sensitivity overflows, using the largest representable value instead",
+				Params: map[string]float64{
+					"Lower":                        float64(lower),
+					"Upper":                        float64(upper),
+					"MaxContributionsPerPartition": float64(maxContributionsPerPartition),
+				},
+			})
 		} else {
 			return nil, fmt.Errorf("NewBoundedSumInt64: %w", err)
 		}
@@ -139,16 +156,17 @@ func NewBoundedSumInt64(opt *BoundedSumInt64Options) (*BoundedSumInt64, error) {
 	}
 
 	return &BoundedSumInt64{
-		epsilon:         eps,
-		delta:           del,
-		l0Sensitivity:   l0,
-		lInfSensitivity: lInf,
-		lower:           lower,
-		upper:           upper,
-		Noise:           n,
-		noiseKind:       noise.ToKind(n),
-		sum:             0,
-		state:           defaultState,
+		epsilon:                      eps,
+		delta:                        del,
+		l0Sensitivity:                l0,
+		lInfSensitivity:              lInf,
+		lower:                        lower,
+		upper:                        upper,
+		Noise:                        n,
+		noiseKind:                    noise.ToKind(n),
+		maxContributionsPerPartition: maxContributionsPerPartition,
+		sum:                          0,
+		state:                        defaultState,
 	}, nil
 }
 
@@ -203,6 +221,48 @@ func (bs *BoundedSumInt64) Add(e int64) error {
 	return nil
 }
 
+// AddMany adds all the values contributed by a single privacy unit to the
+// partition of the BoundedSumInt64. If there are more values than a privacy
+// unit may contribute to a single partition, i.e. one unless the
+// BoundedSumInt64 is used by another aggregation function, a random subset
+// of that size is kept.
+// The values are clamped before being added.
+//
+// AddMany doesn't modify values.
+func (bs *BoundedSumInt64) AddMany(values []int64) error {
+	if bs.state != defaultState {
+		return fmt.Errorf("BoundedSumInt64 cannot be amended: %v", bs.state.errorMessage())
+	}
+	var sum int64
+	for _, i := range sampleIndices(len(values), bs.maxContributionsPerPartition) {
+		clamped, err := ClampInt64(values[i], bs.lower, bs.upper)
+		if err != nil {
+			return fmt.Errorf("couldn't clamp input value %v, err %v", values[i], err)
+		}
+		sum += clamped
+	}
+	bs.sum += sum
+	return nil
+}
+
+// sampleIndices returns the indices of a uniformly random subset of size
+// min(n, k) of [0, n).
+func sampleIndices(n int, k int64) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	if int64(n) <= k {
+		return indices
+	}
+	// Partial Fisher-Yates shuffle.
+	for i := 0; i < int(k); i++ {
+		j := i + int(rand.I63n(int64(n-i)))
+		indices[i], indices[j] = indices[j], indices[i]
+	}
+	return indices[:k]
+}
+
 // Merge merges bs2 into bs (i.e., adds to bs all entries that were added to
 // bs2). bs2 is consumed by this operation: bs2 may not be used after it is
 // merged into bs.
@@ -304,14 +364,15 @@ func (bs *BoundedSumInt64) ComputeConfidenceInterval(alpha float64) (noise.Confi
 
 // encodableBoundedSumFloat64 can be encoded by the gob package.
 type encodableBoundedSumInt64 struct {
-	Epsilon         float64
-	Delta           float64
-	L0Sensitivity   int64
-	LInfSensitivity int64
-	Lower           int64
-	Upper           int64
-	NoiseKind       noise.Kind
-	Sum             int64
+	Epsilon                      float64
+	Delta                        float64
+	L0Sensitivity                int64
+	LInfSensitivity              int64
+	Lower                        int64
+	Upper                        int64
+	NoiseKind                    noise.Kind
+	MaxContributionsPerPartition int64
+	Sum                          int64
 }
 
 // GobEncode encodes BoundedSumInt64.
@@ -320,14 +381,15 @@ func (bs *BoundedSumInt64) GobEncode() ([]byte, error) {
 		return nil, fmt.Errorf("BoundedSumInt64 object cannot be serialized: " + bs.state.errorMessage())
 	}
 	enc := encodableBoundedSumInt64{
-		Epsilon:         bs.epsilon,
-		Delta:           bs.delta,
-		L0Sensitivity:   bs.l0Sensitivity,
-		LInfSensitivity: bs.lInfSensitivity,
-		Lower:           bs.lower,
-		Upper:           bs.upper,
-		NoiseKind:       noise.ToKind(bs.Noise),
-		Sum:             bs.sum,
+		Epsilon:                      bs.epsilon,
+		Delta:                        bs.delta,
+		L0Sensitivity:                bs.l0Sensitivity,
+		LInfSensitivity:              bs.lInfSensitivity,
+		Lower:                        bs.lower,
+		Upper:                        bs.upper,
+		NoiseKind:                    noise.ToKind(bs.Noise),
+		MaxContributionsPerPartition: bs.maxContributionsPerPartition,
+		Sum:                          bs.sum,
 	}
 	bs.state = serialized
 	return encode(enc)
@@ -341,16 +403,17 @@ func (bs *BoundedSumInt64) GobDecode(data []byte) error {
 		return fmt.Errorf("couldn't decode BoundedSumInt64 from bytes")
 	}
 	*bs = BoundedSumInt64{
-		epsilon:         enc.Epsilon,
-		delta:           enc.Delta,
-		l0Sensitivity:   enc.L0Sensitivity,
-		lInfSensitivity: enc.LInfSensitivity,
-		lower:           enc.Lower,
-		upper:           enc.Upper,
-		noiseKind:       enc.NoiseKind,
-		Noise:           noise.ToNoise(enc.NoiseKind),
-		sum:             enc.Sum,
-		state:           defaultState,
+		epsilon:                      enc.Epsilon,
+		delta:                        enc.Delta,
+		l0Sensitivity:                enc.L0Sensitivity,
+		lInfSensitivity:              enc.LInfSensitivity,
+		lower:                        enc.Lower,
+		upper:                        enc.Upper,
+		noiseKind:                    enc.NoiseKind,
+		Noise:                        noise.ToNoise(enc.NoiseKind),
+		maxContributionsPerPartition: enc.MaxContributionsPerPartition,
+		sum:                          enc.Sum,
+		state:                        defaultState,
 	}
 	return nil
 }
@@ -361,7 +424,7 @@ func (bs *BoundedSumInt64) GobDecode(data []byte) error {
 // appropriately. However, it assumes that for each BoundedSumFloat64 instance
 // (partition), each privacy unit contributes at most one value. If a privacy unit
 // contributes more, the contributions should be pre-aggregated before passing them
-// to BoundedSumFloat64.
+// to BoundedSumFloat64, or passed together to AddMany.
 //
 // The provided differentially private sum is an unbiased estimate of the raw
 // bounded sum meaning that its expected value is equal to the raw bounded sum.
@@ -380,6 +443,11 @@ type BoundedSumFloat64 struct {
 	upper           float64
 	Noise           noise.Noise
 	noiseKind       noise.Kind // necessary for serializing noise.Noise information
+	// Used by AddMany to cap the contributions of a privacy unit.
+	maxContributionsPerPartition int64
+	// Sum of the clipped mass used for bias correction, nil if bias
+	// correction is disabled.
+	clippedMass *BoundedSumFloat64
 
 	// State variables
 	sum       float64
@@ -394,8 +462,10 @@ func bsEquallyInitializedFloat64(s1, s2 *BoundedSumFloat64) bool {
 		s1.lInfSensitivity == s2.lInfSensitivity &&
 		s1.lower == s2.lower &&
 		s1.upper == s2.upper &&
+		s1.maxContributionsPerPartition == s2.maxContributionsPerPartition &&
 		s1.noiseKind == s2.noiseKind &&
-		s1.state == s2.state
+		s1.state == s2.state &&
+		clippedMassEquallyInitialized(s1.clippedMass, s2.clippedMass)
 }
 
 // BoundedSumFloat64Options contains the options necessary to initialize a BoundedSumFloat64.
@@ -410,6 +480,9 @@ type BoundedSumFloat64Options struct {
 	// Defaults to 1. This is only needed for other aggregation functions using BoundedSum;
 	// which is why the option is not exported.
 	maxContributionsPerPartition int64
+	// Widens the clamping range of the result with additional privacy budget.
+	// Optional; see BiasCorrectionOptions.
+	BiasCorrection *BiasCorrectionOptions
 }
 
 // NewBoundedSumFloat64 returns a new BoundedSumFloat64, whose sum is initialized at 0.
@@ -427,6 +500,9 @@ func NewBoundedSumFloat64(opt *BoundedSumFloat64Options) (*BoundedSumFloat64, er
 	if maxContributionsPerPartition == 0 {
 		maxContributionsPerPartition = 1
 	}
+	if err := checks.CheckMaxContributionsPerPartition(maxContributionsPerPartition); err != nil {
+		return nil, fmt.Errorf("NewBoundedSumFloat64: %w", err)
+	}
 
 	n := opt.Noise
 	if n == nil {
@@ -452,6 +528,16 @@ func NewBoundedSumFloat64(opt *BoundedSumFloat64Options) (*BoundedSumFloat64, er
 		if noise.ToKind(opt.Noise) == noise.Unrecognised {
 			// Ignore sensitivity overflows if noise is not recognised.
 			log.Warningf("NewBoundedSumFloat64: getLInfFloat failed with %q, using largest representable integer as lInf_sensitivity", err.Error())
+			Log(LogEntry{
+				Level:   LogWarning,
+				Source:  "NewBoundedSumFloat64",
+				Message: "lInf sensitivity overflows, using the largest representable value instead",
+				Params: map[string]float64{
+					"Lower":                        float64(lower),
+					"Upper":                        float64(upper),
+					"MaxContributionsPerPartition": float64(maxContributionsPerPartition),
+				},
+			})
 		} else {
 			return nil, fmt.Errorf("NewBoundedSumFloat64: %w", err)
 		}
@@ -463,18 +549,27 @@ func NewBoundedSumFloat64(opt *BoundedSumFloat64Options) (*BoundedSumFloat64, er
 	if err != nil {
 		return nil, fmt.Errorf("NewBoundedSumFloat64: %w", err)
 	}
+	var clippedMass *BoundedSumFloat64
+	if opt.BiasCorrection != nil {
+		clippedMass, err = newClippedMass(opt.BiasCorrection, l0, maxContributionsPerPartition, n)
+		if err != nil {
+			return nil, fmt.Errorf("NewBoundedSumFloat64: %w", err)
+		}
+	}
 
 	return &BoundedSumFloat64{
-		epsilon:         eps,
-		delta:           del,
-		l0Sensitivity:   l0,
-		lInfSensitivity: lInf,
-		lower:           lower,
-		upper:           upper,
-		Noise:           n,
-		noiseKind:       noise.ToKind(n),
-		sum:             0,
-		state:           defaultState,
+		epsilon:                      eps,
+		delta:                        del,
+		l0Sensitivity:                l0,
+		lInfSensitivity:              lInf,
+		lower:                        lower,
+		upper:                        upper,
+		Noise:                        n,
+		noiseKind:                    noise.ToKind(n),
+		maxContributionsPerPartition: maxContributionsPerPartition,
+		clippedMass:                  clippedMass,
+		sum:                          0,
+		state:                        defaultState,
 	}, nil
 }
 
@@ -521,11 +616,54 @@ func (bs *BoundedSumFloat64) Add(e float64) error {
 		if err != nil {
 			return fmt.Errorf("couldn't clamp input value %v, err %w", e, err)
 		}
+		if bs.clippedMass != nil {
+			if err := bs.clippedMass.Add(e - clamped); err != nil {
+				return fmt.Errorf("couldn't add clipped mass of input value %v, err %w", e, err)
+			}
+		}
 		bs.sum += clamped
 	}
 	return nil
 }
 
+// AddMany adds all the values contributed by a single privacy unit to the
+// partition of the BoundedSumFloat64. If there are more values than a privacy
+// unit may contribute to a single partition, i.e. one unless the
+// BoundedSumFloat64 is used by another aggregation function, a random subset
+// of that size is kept.
+// The values are clamped before being added, and NaN values are ignored like
+// in Add.
+//
+// AddMany doesn't modify values.
+func (bs *BoundedSumFloat64) AddMany(values []float64) error {
+	if bs.state != defaultState {
+		return fmt.Errorf("BoundedSumFloat64 cannot be amended: %v", bs.state.errorMessage())
+	}
+	var sum, clippedMass float64
+	for _, i := range sampleIndices(len(values), bs.maxContributionsPerPartition) {
+		if math.IsNaN(values[i]) {
+			continue
+		}
+		clamped, err := ClampFloat64(values[i], bs.lower, bs.upper)
+		if err != nil {
+			return fmt.Errorf("couldn't clamp input value %v, err %w", values[i], err)
+		}
+		sum += clamped
+		if bs.clippedMass != nil {
+			excess, err := ClampFloat64(values[i]-clamped, bs.clippedMass.lower, bs.clippedMass.upper)
+			if err != nil {
+				return fmt.Errorf("couldn't clamp clipped mass of input value %v, err %w", values[i], err)
+			}
+			clippedMass += excess
+		}
+	}
+	bs.sum += sum
+	if bs.clippedMass != nil {
+		bs.clippedMass.sum += clippedMass
+	}
+	return nil
+}
+
 // Merge merges bs2 into bs (i.e., adds to bs all entries that were added to
 // bs2). bs2 is consumed by this operation: bs2 may not be used after it is
 // merged into bs.
@@ -533,6 +671,11 @@ func (bs *BoundedSumFloat64) Merge(bs2 *BoundedSumFloat64) error {
 	if err := checkMergeBoundedSumFloat64(bs, bs2); err != nil {
 		return err
 	}
+	if bs.clippedMass != nil {
+		if err := bs.clippedMass.Merge(bs2.clippedMass); err != nil {
+			return err
+		}
+	}
 	bs.sum += bs2.sum
 	bs2.state = merged
 	return nil
@@ -563,6 +706,10 @@ func checkMergeBoundedSumFloat64(bs1, bs2 *BoundedSumFloat64) error {
 // by the caller of this method, e.g., by snapping the result to the closest
 // value representing a bounded sum that is possible. Note that such post
 // processing introduces bias to the result.
+//
+// If bias correction is enabled, the differentially private clipped mass is
+// added to the result, which is then an unbiased estimate of the sum of the
+// elements clamped to [Lower - MaxExcess, Upper + MaxExcess] instead.
 func (bs *BoundedSumFloat64) Result() (float64, error) {
 	if bs.state != defaultState {
 		return 0, fmt.Errorf("BoundedSumFloat64's noised result cannot be computed: " + bs.state.errorMessage())
@@ -570,7 +717,14 @@ func (bs *BoundedSumFloat64) Result() (float64, error) {
 	bs.state = resultReturned
 	var err error
 	bs.noisedSum, err = bs.Noise.AddNoiseFloat64(bs.sum, bs.l0Sensitivity, bs.lInfSensitivity, bs.epsilon, bs.delta)
-	return bs.noisedSum, err
+	if err != nil || bs.clippedMass == nil {
+		return bs.noisedSum, err
+	}
+	noisedClippedMass, err := bs.clippedMass.Result()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't compute dp clipped mass: %w", err)
+	}
+	return bs.noisedSum + noisedClippedMass, nil
 }
 
 // ThresholdedResult is similar to Result() but applies thresholding to the
@@ -600,10 +754,15 @@ func (bs *BoundedSumFloat64) ThresholdedResult(thresholdDelta float64) (*float64
 // an error.
 //
 // See https://github.com/google/differential-privacy/tree/main/common_docs/confidence_intervals.md.
+//
+// Confidence intervals are not supported with bias correction.
 func (bs *BoundedSumFloat64) ComputeConfidenceInterval(alpha float64) (noise.ConfidenceInterval, error) {
 	if bs.state != resultReturned {
 		return noise.ConfidenceInterval{}, fmt.Errorf("Result() must be called before calling ComputeConfidenceInterval()")
 	}
+	if bs.clippedMass != nil {
+		return noise.ConfidenceInterval{}, fmt.Errorf("ComputeConfidenceInterval() is not supported with bias correction")
+	}
 	confInt, err := bs.Noise.ComputeConfidenceIntervalFloat64(bs.noisedSum, bs.l0Sensitivity, bs.lInfSensitivity, bs.epsilon, bs.delta, alpha)
 	if err != nil {
 		return noise.ConfidenceInterval{}, err
@@ -621,14 +780,16 @@ func (bs *BoundedSumFloat64) ComputeConfidenceInterval(alpha float64) (noise.Con
 
 // encodableBoundedSumFloat64 can be encoded by the gob package.
 type encodableBoundedSumFloat64 struct {
-	Epsilon         float64
-	Delta           float64
-	L0Sensitivity   int64
-	LInfSensitivity float64
-	Lower           float64
-	Upper           float64
-	NoiseKind       noise.Kind
-	Sum             float64
+	Epsilon                      float64
+	Delta                        float64
+	L0Sensitivity                int64
+	LInfSensitivity              float64
+	Lower                        float64
+	Upper                        float64
+	NoiseKind                    noise.Kind
+	MaxContributionsPerPartition int64
+	Sum                          float64
+	ClippedMass                  *BoundedSumFloat64
 }
 
 // GobEncode encodes BoundedSumInt64.
@@ -637,14 +798,16 @@ func (bs *BoundedSumFloat64) GobEncode() ([]byte, error) {
 		return nil, fmt.Errorf("BoundedSumFloat64 object cannot be serialized: " + bs.state.errorMessage())
 	}
 	enc := encodableBoundedSumFloat64{
-		Epsilon:         bs.epsilon,
-		Delta:           bs.delta,
-		L0Sensitivity:   bs.l0Sensitivity,
-		LInfSensitivity: bs.lInfSensitivity,
-		Lower:           bs.lower,
-		Upper:           bs.upper,
-		NoiseKind:       noise.ToKind(bs.Noise),
-		Sum:             bs.sum,
+		Epsilon:                      bs.epsilon,
+		Delta:                        bs.delta,
+		L0Sensitivity:                bs.l0Sensitivity,
+		LInfSensitivity:              bs.lInfSensitivity,
+		Lower:                        bs.lower,
+		Upper:                        bs.upper,
+		NoiseKind:                    noise.ToKind(bs.Noise),
+		MaxContributionsPerPartition: bs.maxContributionsPerPartition,
+		Sum:                          bs.sum,
+		ClippedMass:                  bs.clippedMass,
 	}
 	bs.state = serialized
 	return encode(enc)
@@ -658,16 +821,18 @@ func (bs *BoundedSumFloat64) GobDecode(data []byte) error {
 		return fmt.Errorf("couldn't decode BoundedSumFloat64 from bytes")
 	}
 	*bs = BoundedSumFloat64{
-		epsilon:         enc.Epsilon,
-		delta:           enc.Delta,
-		l0Sensitivity:   enc.L0Sensitivity,
-		lInfSensitivity: enc.LInfSensitivity,
-		lower:           enc.Lower,
-		upper:           enc.Upper,
-		noiseKind:       enc.NoiseKind,
-		Noise:           noise.ToNoise(enc.NoiseKind),
-		sum:             enc.Sum,
-		state:           defaultState,
+		epsilon:                      enc.Epsilon,
+		delta:                        enc.Delta,
+		l0Sensitivity:                enc.L0Sensitivity,
+		lInfSensitivity:              enc.LInfSensitivity,
+		lower:                        enc.Lower,
+		upper:                        enc.Upper,
+		noiseKind:                    enc.NoiseKind,
+		Noise:                        noise.ToNoise(enc.NoiseKind),
+		maxContributionsPerPartition: enc.MaxContributionsPerPartition,
+		clippedMass:                  enc.ClippedMass,
+		sum:                          enc.Sum,
+		state:                        defaultState,
 	}
 	return nil
 }
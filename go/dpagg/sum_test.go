@@ -67,6 +67,7 @@ func compareBoundedSumInt64(bs1, bs2 *BoundedSumInt64) bool {
 		bs1.upper == bs2.upper &&
 		bs1.Noise == bs2.Noise &&
 		bs1.noiseKind == bs2.noiseKind &&
+		bs1.maxContributionsPerPartition == bs2.maxContributionsPerPartition &&
 		bs1.sum == bs2.sum &&
 		bs1.state == bs2.state
 }
@@ -148,6 +149,7 @@ func compareBoundedSumFloat64(bs1, bs2 *BoundedSumFloat64) bool {
 		bs1.upper == bs2.upper &&
 		bs1.Noise == bs2.Noise &&
 		bs1.noiseKind == bs2.noiseKind &&
+		bs1.maxContributionsPerPartition == bs2.maxContributionsPerPartition &&
 		bs1.sum == bs2.sum &&
 		bs1.state == bs2.state
 }
@@ -308,16 +310,17 @@ func TestNewBoundedSumInt64(t *testing.T) {
 				Noise:                    noNoise{},
 			},
 			&BoundedSumInt64{
-				epsilon:         ln3,
-				delta:           0,
-				l0Sensitivity:   1,
-				lInfSensitivity: 5,
-				lower:           -1,
-				upper:           5,
-				Noise:           noNoise{},
-				noiseKind:       noise.Unrecognised,
-				sum:             0,
-				state:           defaultState,
+				epsilon:                      ln3,
+				delta:                        0,
+				l0Sensitivity:                1,
+				lInfSensitivity:              5,
+				lower:                        -1,
+				upper:                        5,
+				Noise:                        noNoise{},
+				noiseKind:                    noise.Unrecognised,
+				maxContributionsPerPartition: 1,
+				sum:                          0,
+				state:                        defaultState,
 			},
 			false},
 		{"Noise is not set",
@@ -330,16 +333,17 @@ func TestNewBoundedSumInt64(t *testing.T) {
 				maxContributionsPerPartition: 2,
 			},
 			&BoundedSumInt64{
-				epsilon:         ln3,
-				delta:           0,
-				l0Sensitivity:   1,
-				lInfSensitivity: 10,
-				lower:           -1,
-				upper:           5,
-				Noise:           noise.Laplace(),
-				noiseKind:       noise.LaplaceNoise,
-				sum:             0,
-				state:           defaultState,
+				epsilon:                      ln3,
+				delta:                        0,
+				l0Sensitivity:                1,
+				lInfSensitivity:              10,
+				lower:                        -1,
+				upper:                        5,
+				Noise:                        noise.Laplace(),
+				noiseKind:                    noise.LaplaceNoise,
+				maxContributionsPerPartition: 2,
+				sum:                          0,
+				state:                        defaultState,
 			},
 			false},
 		{"Epsilon is not set",
@@ -398,18 +402,30 @@ func TestNewBoundedSumInt64(t *testing.T) {
 				Noise:                    noNoise{},
 			},
 			&BoundedSumInt64{
-				epsilon:         ln3,
-				delta:           0,
-				l0Sensitivity:   1,
-				lInfSensitivity: 5,
-				lower:           5,
-				upper:           5,
-				Noise:           noNoise{},
-				noiseKind:       noise.Unrecognised,
-				sum:             0,
-				state:           defaultState,
+				epsilon:                      ln3,
+				delta:                        0,
+				l0Sensitivity:                1,
+				lInfSensitivity:              5,
+				lower:                        5,
+				upper:                        5,
+				Noise:                        noNoise{},
+				noiseKind:                    noise.Unrecognised,
+				maxContributionsPerPartition: 1,
+				sum:                          0,
+				state:                        defaultState,
 			},
 			false},
+		{"Negative MaxContributionsPerPartition",
+			&BoundedSumInt64Options{
+				Epsilon:                      ln3,
+				MaxPartitionsContributed:     1,
+				maxContributionsPerPartition: -1,
+				Lower:                        -1,
+				Upper:                        5,
+				Noise:                        noNoise{},
+			},
+			nil,
+			true},
 		{"Upper<Lower",
 			&BoundedSumInt64Options{
 				Epsilon:                  ln3,
@@ -460,16 +476,17 @@ func TestNewBoundedSumFloat64(t *testing.T) {
 				Noise:                    noNoise{},
 			},
 			&BoundedSumFloat64{
-				epsilon:         ln3,
-				delta:           0,
-				l0Sensitivity:   1,
-				lInfSensitivity: 5,
-				lower:           -1,
-				upper:           5,
-				Noise:           noNoise{},
-				noiseKind:       noise.Unrecognised,
-				sum:             0,
-				state:           defaultState,
+				epsilon:                      ln3,
+				delta:                        0,
+				l0Sensitivity:                1,
+				lInfSensitivity:              5,
+				lower:                        -1,
+				upper:                        5,
+				Noise:                        noNoise{},
+				noiseKind:                    noise.Unrecognised,
+				maxContributionsPerPartition: 1,
+				sum:                          0,
+				state:                        defaultState,
 			},
 			false},
 		{"Noise is not set",
@@ -482,16 +499,17 @@ func TestNewBoundedSumFloat64(t *testing.T) {
 				maxContributionsPerPartition: 2,
 			},
 			&BoundedSumFloat64{
-				epsilon:         ln3,
-				delta:           0,
-				l0Sensitivity:   1,
-				lInfSensitivity: 10,
-				lower:           -1,
-				upper:           5,
-				Noise:           noise.Laplace(),
-				noiseKind:       noise.LaplaceNoise,
-				sum:             0,
-				state:           defaultState,
+				epsilon:                      ln3,
+				delta:                        0,
+				l0Sensitivity:                1,
+				lInfSensitivity:              10,
+				lower:                        -1,
+				upper:                        5,
+				Noise:                        noise.Laplace(),
+				noiseKind:                    noise.LaplaceNoise,
+				maxContributionsPerPartition: 2,
+				sum:                          0,
+				state:                        defaultState,
 			},
 			false},
 		{"Epsilon is not set",
@@ -550,18 +568,30 @@ func TestNewBoundedSumFloat64(t *testing.T) {
 				Noise:                    noNoise{},
 			},
 			&BoundedSumFloat64{
-				epsilon:         ln3,
-				delta:           0,
-				l0Sensitivity:   1,
-				lInfSensitivity: 5,
-				lower:           5,
-				upper:           5,
-				Noise:           noNoise{},
-				noiseKind:       noise.Unrecognised,
-				sum:             0,
-				state:           defaultState,
+				epsilon:                      ln3,
+				delta:                        0,
+				l0Sensitivity:                1,
+				lInfSensitivity:              5,
+				lower:                        5,
+				upper:                        5,
+				Noise:                        noNoise{},
+				noiseKind:                    noise.Unrecognised,
+				maxContributionsPerPartition: 1,
+				sum:                          0,
+				state:                        defaultState,
 			},
 			false},
+		{"Negative MaxContributionsPerPartition",
+			&BoundedSumFloat64Options{
+				Epsilon:                      ln3,
+				MaxPartitionsContributed:     1,
+				maxContributionsPerPartition: -1,
+				Lower:                        -1,
+				Upper:                        5,
+				Noise:                        noNoise{},
+			},
+			nil,
+			true},
 		{"Upper<Lower",
 			&BoundedSumFloat64Options{
 				Epsilon:                  ln3,
@@ -630,6 +660,102 @@ func TestAddFloat64IgnoresNaN(t *testing.T) {
 	}
 }
 
+func TestAddManyInt64(t *testing.T) {
+	bsi, err := NewBoundedSumInt64(&BoundedSumInt64Options{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		maxContributionsPerPartition: 3,
+		Lower:                        -1,
+		Upper:                        5,
+		Noise:                        noNoise{},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless BSI: %v", err)
+	}
+	values := []int64{4, 4, 4, 4, 4}
+	bsi.AddMany(values)      // Only 3 of the values are kept.
+	bsi.AddMany([]int64{10}) // Clamped to 5.
+	got, err := bsi.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	const want = 17
+	if got != want {
+		t.Errorf("AddMany: when {4, 4, 4, 4, 4} and {10} were added got %d, want %d", got, want)
+	}
+	if diff := cmp.Diff([]int64{4, 4, 4, 4, 4}, values); diff != "" {
+		t.Errorf("AddMany modified its input (-want +got):\n%s", diff)
+	}
+}
+
+func TestAddManyFloat64(t *testing.T) {
+	bsf, err := NewBoundedSumFloat64(&BoundedSumFloat64Options{
+		Epsilon:                      ln3,
+		MaxPartitionsContributed:     1,
+		maxContributionsPerPartition: 2,
+		Lower:                        -1,
+		Upper:                        5,
+		Noise:                        noNoise{},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless BSF: %v", err)
+	}
+	bsf.AddMany([]float64{1.5, 1.5, 1.5})  // Only 2 of the values are kept.
+	bsf.AddMany([]float64{-3, math.NaN()}) // -3 is clamped to -1 and NaN is ignored.
+	got, err := bsf.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want := 2.0
+	if !ApproxEqual(got, want) {
+		t.Errorf("AddMany: when {1.5, 1.5, 1.5} and {-3, NaN} were added got %f, want %f", got, want)
+	}
+}
+
+func TestAddManyKeepsRandomValues(t *testing.T) {
+	// With MaxContributionsPerPartition = 1, each of the values must be kept
+	// with probability 1/2.
+	var kept0 int
+	const numTrials = 1000
+	for i := 0; i < numTrials; i++ {
+		bsi, err := NewBoundedSumInt64(&BoundedSumInt64Options{
+			Epsilon:                  ln3,
+			MaxPartitionsContributed: 1,
+			Lower:                    -1,
+			Upper:                    5,
+			Noise:                    noNoise{},
+		})
+		if err != nil {
+			t.Fatalf("Couldn't get noiseless BSI: %v", err)
+		}
+		bsi.AddMany([]int64{0, 1})
+		got, err := bsi.Result()
+		if err != nil {
+			t.Fatalf("Couldn't compute dp result: %v", err)
+		}
+		if got == 0 {
+			kept0++
+		}
+	}
+	// 400 and 600 are more than 6 standard deviations away from 500.
+	if kept0 < 400 || kept0 > 600 {
+		t.Errorf("AddMany: kept the first of 2 values %d times out of %d, want about %d", kept0, numTrials, numTrials/2)
+	}
+}
+
+func TestAddManyStateChecks(t *testing.T) {
+	bsi := getNoiselessBSI(t)
+	bsi.Result()
+	if err := bsi.AddMany([]int64{1}); err == nil {
+		t.Errorf("AddMany on BoundedSumInt64 after Result: got no error")
+	}
+	bsf := getNoiselessBSF(t)
+	bsf.Result()
+	if err := bsf.AddMany([]float64{1}); err == nil {
+		t.Errorf("AddMany on BoundedSumFloat64 after Result: got no error")
+	}
+}
+
 func TestMergeBoundedSumInt64(t *testing.T) {
 	bs1 := getNoiselessBSI(t)
 	bs2 := getNoiselessBSI(t)
@@ -767,7 +893,7 @@ func TestCheckMergeBoundedSumInt64Compatibility(t *testing.T) {
 				Upper:                    5,
 			},
 			true},
-		{"different maxContributionsPerPartition",
+		{"different MaxContributionsPerPartition",
 			&BoundedSumInt64Options{
 				Epsilon:                      ln3,
 				Lower:                        -1,
@@ -958,7 +1084,7 @@ func TestCheckMergeBoundedSumFloat64Compatibility(t *testing.T) {
 				Upper:                    5,
 			},
 			true},
-		{"different maxContributionsPerPartition",
+		{"different MaxContributionsPerPartition",
 			&BoundedSumFloat64Options{
 				Epsilon:                      ln3,
 				Lower:                        -1,
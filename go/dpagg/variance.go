@@ -59,19 +59,30 @@ type BoundedVariance struct {
 	// The midpoint between lower and upper bounds. It cannot be set by the user;
 	// it will be calculated based on the lower and upper values.
 	midPoint float64
-	state    aggregationState
+	// Set if the variance is computed around a known mean. In that case,
+	// NormalizedSum is unused.
+	knownMean *float64
+	state     aggregationState
 }
 
 func bvEquallyInitialized(bv1, bv2 *BoundedVariance) bool {
 	return bv1.lower == bv2.lower &&
 		bv1.upper == bv2.upper &&
 		bv1.midPoint == bv2.midPoint &&
+		knownMeansEqual(bv1.knownMean, bv2.knownMean) &&
 		bv1.state == bv2.state &&
 		countEquallyInitialized(&bv1.Count, &bv2.Count) &&
 		bsEquallyInitializedFloat64(&bv1.NormalizedSum, &bv2.NormalizedSum) &&
 		bsEquallyInitializedFloat64(&bv1.NormalizedSumOfSquares, &bv2.NormalizedSumOfSquares)
 }
 
+func knownMeansEqual(m1, m2 *float64) bool {
+	if m1 == nil || m2 == nil {
+		return m1 == m2
+	}
+	return *m1 == *m2
+}
+
 // BoundedVarianceOptions contains the options necessary to initialize a BoundedVariance.
 type BoundedVarianceOptions struct {
 	Epsilon                      float64 // Privacy parameter ε. Required.
@@ -81,6 +92,13 @@ type BoundedVarianceOptions struct {
 	// Lower and Upper bounds for clamping. Required; must be such that Lower < Upper.
 	Lower, Upper float64
 	Noise        noise.Noise // Type of noise used in BoundedVariance. Defaults to Laplace noise.
+	// Mean of the values, if it is already known, e.g. because a differentially
+	// private mean of the same values was released. The variance is then
+	// computed as the mean of the squared differences between the values and
+	// KnownMean, which splits the budget between two noisy quantities instead
+	// of three and doesn't spend budget on re-estimating the mean. Must be
+	// within [Lower, Upper]. Optional.
+	KnownMean *float64
 }
 
 // NewBoundedVariance returns a new BoundedVariance.
@@ -130,6 +148,10 @@ func NewBoundedVariance(opt *BoundedVarianceOptions) (*BoundedVariance, error) {
 	}
 	sumMaxDistFromMidpoint := upper - midPoint
 
+	if opt.KnownMean != nil {
+		return newBoundedVarianceWithKnownMean(opt, n, midPoint)
+	}
+
 	eps, del := opt.Epsilon, opt.Delta
 	// We split the budget equally in three to calculate the count, the normalized sum and
 	// normalized sum of squares.
@@ -210,6 +232,61 @@ func NewBoundedVariance(opt *BoundedVarianceOptions) (*BoundedVariance, error) {
 	}, nil
 }
 
+// newBoundedVarianceWithKnownMean returns a new BoundedVariance computing the
+// variance around opt.KnownMean. opt must have been validated by
+// NewBoundedVariance.
+func newBoundedVarianceWithKnownMean(opt *BoundedVarianceOptions, n noise.Noise, midPoint float64) (*BoundedVariance, error) {
+	mean := *opt.KnownMean
+	if math.IsNaN(mean) || mean < opt.Lower || mean > opt.Upper {
+		return nil, fmt.Errorf("NewBoundedVariance: KnownMean must be within [Lower, Upper], got %f", mean)
+	}
+	// Squared distances to the mean are within [0, maxSquaredDist]. Like in
+	// BoundedMean, they are normalized around the midpoint of this interval to
+	// halve the sensitivity of their sum.
+	maxSquaredDist := math.Max(math.Pow(opt.Lower-mean, 2), math.Pow(opt.Upper-mean, 2))
+	halfMaxSquaredDist := maxSquaredDist / 2
+
+	// We split the budget equally in two to calculate the count and the
+	// normalized sum of squares.
+	countEpsilon := opt.Epsilon / 2
+	countDelta := opt.Delta / 2
+	sumOfSquaresEpsilon := opt.Epsilon - countEpsilon
+	sumOfSquaresDelta := opt.Delta - countDelta
+
+	count, err := NewCount(&CountOptions{
+		Epsilon:                      countEpsilon,
+		Delta:                        countDelta,
+		MaxPartitionsContributed:     opt.MaxPartitionsContributed,
+		Noise:                        n,
+		maxContributionsPerPartition: opt.MaxContributionsPerPartition,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't initialize count for NewBoundedVariance: %w", err)
+	}
+	normalizedSumOfSquares, err := NewBoundedSumFloat64(&BoundedSumFloat64Options{
+		Epsilon:                      sumOfSquaresEpsilon,
+		Delta:                        sumOfSquaresDelta,
+		MaxPartitionsContributed:     opt.MaxPartitionsContributed,
+		Lower:                        -halfMaxSquaredDist,
+		Upper:                        halfMaxSquaredDist,
+		Noise:                        n,
+		maxContributionsPerPartition: opt.MaxContributionsPerPartition,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't initialize sum of squares for NewBoundedVariance: %w", err)
+	}
+
+	return &BoundedVariance{
+		lower:                  opt.Lower,
+		upper:                  opt.Upper,
+		midPoint:               midPoint,
+		knownMean:              &mean,
+		Count:                  *count,
+		NormalizedSumOfSquares: *normalizedSumOfSquares,
+		state:                  defaultState,
+	}, nil
+}
+
 // computeMaxVariance returns the maximum possible variance that could result from
 // given lower and upper bounds. Used as an upper bound to the noisy variance.
 func computeMaxVariance(lower, upper float64) float64 {
@@ -230,6 +307,13 @@ func (bv *BoundedVariance) Add(e float64) error {
 			return fmt.Errorf("couldn't clamp input value %v, err %w", e, err)
 		}
 
+		if bv.knownMean != nil {
+			// NormalizedSumOfSquares.upper is half of the maximum squared
+			// distance to the mean.
+			bv.NormalizedSumOfSquares.Add(math.Pow(clamped-*bv.knownMean, 2) - bv.NormalizedSumOfSquares.upper)
+			bv.Count.Increment()
+			return nil
+		}
 		normalizedValSquared := math.Pow(clamped-bv.midPoint, 2)
 		bv.NormalizedSumOfSquares.Add(normalizedValSquared)
 		normalizedVal := clamped - bv.midPoint
@@ -254,6 +338,18 @@ func (bv *BoundedVariance) Result() (float64, error) {
 		return 0, fmt.Errorf("couldn't compute dp count: %w", err)
 	}
 	noisedCountClamped := math.Max(1.0, float64(noisedCount))
+	if bv.knownMean != nil {
+		noisedSumOfSquares, err := bv.NormalizedSumOfSquares.Result()
+		if err != nil {
+			return 0, fmt.Errorf("couldn't compute dp normalized sum of squares: %w", err)
+		}
+		meanOfSquares := noisedSumOfSquares/noisedCountClamped + bv.NormalizedSumOfSquares.upper
+		clamped, err := ClampFloat64(meanOfSquares, 0.0, computeMaxVariance(bv.lower, bv.upper))
+		if err != nil {
+			return 0, fmt.Errorf("couldn't clamp the result: %w", err)
+		}
+		return clamped, nil
+	}
 	noisedSum, err := bv.NormalizedSum.Result()
 	if err != nil {
 		return 0, fmt.Errorf("couldn't compute dp normalized sum: %w", err)
@@ -281,7 +377,9 @@ func (bv *BoundedVariance) Merge(bv2 *BoundedVariance) error {
 		return err
 	}
 	bv.NormalizedSumOfSquares.Merge(&bv2.NormalizedSumOfSquares)
-	bv.NormalizedSum.Merge(&bv2.NormalizedSum)
+	if bv.knownMean == nil {
+		bv.NormalizedSum.Merge(&bv2.NormalizedSum)
+	}
 	bv.Count.Merge(&bv2.Count)
 	bv2.state = merged
 	return nil
@@ -311,9 +409,12 @@ func (bv *BoundedVariance) GobEncode() ([]byte, error) {
 		Lower:                           bv.lower,
 		Upper:                           bv.upper,
 		EncodableCount:                  &bv.Count,
-		EncodableNormalizedSum:          &bv.NormalizedSum,
 		EncodableNormalizedSumOfSquares: &bv.NormalizedSumOfSquares,
 		Midpoint:                        bv.midPoint,
+		KnownMean:                       bv.knownMean,
+	}
+	if bv.knownMean == nil {
+		enc.EncodableNormalizedSum = &bv.NormalizedSum
 	}
 	bv.state = serialized
 	return encode(enc)
@@ -330,11 +431,14 @@ func (bv *BoundedVariance) GobDecode(data []byte) error {
 		lower:                  enc.Lower,
 		upper:                  enc.Upper,
 		Count:                  *enc.EncodableCount,
-		NormalizedSum:          *enc.EncodableNormalizedSum,
 		NormalizedSumOfSquares: *enc.EncodableNormalizedSumOfSquares,
 		midPoint:               enc.Midpoint,
+		knownMean:              enc.KnownMean,
 		state:                  defaultState,
 	}
+	if enc.EncodableNormalizedSum != nil {
+		bv.NormalizedSum = *enc.EncodableNormalizedSum
+	}
 	return nil
 }
 
@@ -346,4 +450,5 @@ type encodableBoundedVariance struct {
 	EncodableNormalizedSum          *BoundedSumFloat64
 	EncodableNormalizedSumOfSquares *BoundedSumFloat64
 	Midpoint                        float64
+	KnownMean                       *float64
 }
@@ -80,28 +80,30 @@ func TestNewBoundedVariance(t *testing.T) {
 					state:           defaultState,
 				},
 				NormalizedSum: BoundedSumFloat64{
-					epsilon:         ln3 / 3,
-					delta:           0,
-					l0Sensitivity:   1,
-					lInfSensitivity: 6,
-					lower:           -3,
-					upper:           3,
-					noiseKind:       noise.LaplaceNoise,
-					Noise:           noise.Laplace(),
-					sum:             0,
-					state:           defaultState,
+					epsilon:                      ln3 / 3,
+					delta:                        0,
+					l0Sensitivity:                1,
+					lInfSensitivity:              6,
+					lower:                        -3,
+					upper:                        3,
+					noiseKind:                    noise.LaplaceNoise,
+					maxContributionsPerPartition: 2,
+					Noise:                        noise.Laplace(),
+					sum:                          0,
+					state:                        defaultState,
 				},
 				NormalizedSumOfSquares: BoundedSumFloat64{
-					epsilon:         ln3 - ln3/3 - ln3/3,
-					delta:           0,
-					l0Sensitivity:   1,
-					lInfSensitivity: 18,
-					lower:           0,
-					upper:           9,
-					noiseKind:       noise.LaplaceNoise,
-					Noise:           noise.Laplace(),
-					sum:             0,
-					state:           defaultState,
+					epsilon:                      ln3 - ln3/3 - ln3/3,
+					delta:                        0,
+					l0Sensitivity:                1,
+					lInfSensitivity:              18,
+					lower:                        0,
+					upper:                        9,
+					noiseKind:                    noise.LaplaceNoise,
+					maxContributionsPerPartition: 2,
+					Noise:                        noise.Laplace(),
+					sum:                          0,
+					state:                        defaultState,
 				},
 			},
 			false},
@@ -217,6 +219,51 @@ func TestBVAdd(t *testing.T) {
 	}
 }
 
+func TestBVWithKnownMean(t *testing.T) {
+	bv, err := NewBoundedVariance(&BoundedVarianceOptions{
+		Epsilon:                      ln3,
+		Delta:                        tenten,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		Lower:                        -1,
+		Upper:                        5,
+		Noise:                        noNoise{},
+		KnownMean:                    float64Ptr(3),
+	})
+	if err != nil {
+		t.Fatalf("Couldn't get noiseless BV with known mean: %v", err)
+	}
+	bv.Add(1.5)
+	bv.Add(2.5)
+	bv.Add(3.5)
+	bv.Add(4.5)
+	bv.Add(math.NaN())
+	got, err := bv.Result()
+	if err != nil {
+		t.Fatalf("Couldn't compute dp result: %v", err)
+	}
+	want := 1.25
+	if !ApproxEqual(got, want) {
+		t.Errorf("Add: with known mean %f got %f, want %f", 3.0, got, want)
+	}
+}
+
+func TestBVWithKnownMeanOutsideBounds(t *testing.T) {
+	for _, mean := range []float64{-2, 6, math.NaN()} {
+		_, err := NewBoundedVariance(&BoundedVarianceOptions{
+			Epsilon:                      ln3,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			Lower:                        -1,
+			Upper:                        5,
+			KnownMean:                    float64Ptr(mean),
+		})
+		if err == nil {
+			t.Errorf("NewBoundedVariance: with KnownMean %f outside of [-1, 5] got no error", mean)
+		}
+	}
+}
+
 func TestBVAddIgnoresNaN(t *testing.T) {
 	lower, upper := -1.0, 5.0
 	bv := getNoiselessBV(t, lower, upper)
@@ -806,6 +853,7 @@ func compareBoundedVariance(bv1, bv2 *BoundedVariance) bool {
 		compareBoundedSumFloat64(&bv1.NormalizedSum, &bv2.NormalizedSum) &&
 		compareBoundedSumFloat64(&bv1.NormalizedSumOfSquares, &bv2.NormalizedSumOfSquares) &&
 		bv1.midPoint == bv2.midPoint &&
+		knownMeansEqual(bv1.knownMean, bv2.knownMean) &&
 		bv1.state == bv2.state
 }
 
@@ -832,6 +880,14 @@ func TestBVSerialization(t *testing.T) {
 			MaxContributionsPerPartition: 6,
 			Noise:                        noise.Gaussian(),
 		}},
+		{"known mean", &BoundedVarianceOptions{
+			Epsilon:                      ln3,
+			Lower:                        0,
+			Upper:                        1,
+			MaxContributionsPerPartition: 1,
+			MaxPartitionsContributed:     1,
+			KnownMean:                    float64Ptr(0.25),
+		}},
 	} {
 		bv, err := NewBoundedVariance(tc.opts)
 		if err != nil {
@@ -879,3 +935,7 @@ func TestBoundedVarianceSerializationStateChecks(t *testing.T) {
 		}
 	}
 }
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
@@ -44,7 +44,9 @@ var (
 	gaussianSigmaAccuracy = 1e-3
 )
 
-type gaussian struct{}
+type gaussian struct {
+	stream *rand.Stream // Source of randomness, cryptographically secure if nil.
+}
 
 // Gaussian returns a Noise instance that adds Gaussian noise to its input.
 //
@@ -58,24 +60,24 @@ func Gaussian() Noise {
 
 // AddNoiseFloat64 adds Gaussian noise to the specified float64, so that its
 // output is (ε,δ)-differentially private.
-func (gaussian) AddNoiseFloat64(x float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+func (g gaussian) AddNoiseFloat64(x float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
 	if err := checkArgsGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
 		return 0, err
 	}
 
 	sigma := SigmaForGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta)
-	return addGaussianFloat64(x, sigma), nil
+	return addGaussianFloat64(g.stream, x, sigma), nil
 }
 
 // AddNoiseInt64 adds Gaussian noise to the specified int64, so that the
 // output is (ε,δ)-differentially private.
-func (gaussian) AddNoiseInt64(x, l0Sensitivity, lInfSensitivity int64, epsilon, delta float64) (int64, error) {
+func (g gaussian) AddNoiseInt64(x, l0Sensitivity, lInfSensitivity int64, epsilon, delta float64) (int64, error) {
 	if err := checkArgsGaussian(l0Sensitivity, float64(lInfSensitivity), epsilon, delta); err != nil {
 		return 0, err
 	}
 
 	sigma := SigmaForGaussian(l0Sensitivity, float64(lInfSensitivity), epsilon, delta)
-	return addGaussianInt64(x, sigma), nil
+	return addGaussianInt64(g.stream, x, sigma), nil
 }
 
 // Threshold returns the smallest threshold k to use in a differentially private
@@ -168,26 +170,26 @@ func checkArgsConfidenceIntervalGaussian(l0Sensitivity int64, lInfSensitivity, e
 }
 
 // addGaussianFloat64 adds Gaussian noise of scale σ to the specified float64.
-func addGaussianFloat64(x, sigma float64) float64 {
+func addGaussianFloat64(stream *rand.Stream, x, sigma float64) float64 {
 	granularity := ceilPowerOfTwo(2.0 * sigma / binomialBound)
 
 	// sqrtN is chosen in a way that places it in the interval between binomialBound
 	// and binomialBound / 2. This ensures that the respective binomial distribution
 	// consists of enough Bernoulli samples to closely approximate a Gaussian distribution.
 	sqrtN := 2.0 * sigma / granularity
-	sample := symmetricBinomial(sqrtN)
+	sample := symmetricBinomial(stream, sqrtN)
 	return roundToMultipleOfPowerOfTwo(x, granularity) + float64(sample)*granularity
 }
 
 // addGaussianInt64 adds Gaussian noise of scale σ to the specified int64.
-func addGaussianInt64(x int64, sigma float64) int64 {
+func addGaussianInt64(stream *rand.Stream, x int64, sigma float64) int64 {
 	granularity := ceilPowerOfTwo(2.0 * sigma / binomialBound)
 
 	// sqrtN is chosen in a way that places it in the interval between binomialBound
 	// and binomialBound / 2. This ensures that the respective binomial distribution
 	// consists of enough Bernoulli samples to closely approximate a Gaussian distribution.
 	sqrtN := 2.0 * sigma / granularity
-	sample := symmetricBinomial(sqrtN)
+	sample := symmetricBinomial(stream, sqrtN)
 	if granularity < 1 {
 		return x + int64(math.Round(float64(sample)*granularity))
 	}
@@ -219,22 +221,22 @@ func inverseCDFGaussian(sigma, p float64) float64 {
 // 0.5 each. The sampling technique is based on Bringmann et al.'s rejection sampling
 // approach proposed in "Internal DLA: Efficient Simulation of a Physical Growth Model"
 // (https://people.mpi-inf.mpg.de/~kbringma/paper/2014ICALP.pdf).
-func symmetricBinomial(sqrtN float64) int64 {
+func symmetricBinomial(stream *rand.Stream, sqrtN float64) int64 {
 	stepSize := int64(math.Round(math.Sqrt2*sqrtN + 1.0))
 	var result int64
 	i := 0
 	for true {
 		// 1 is subtracted from the geometric sample to count the number of Bernoulli fails
 		// rather than the number of trials until the first success.
-		boundedGeometricSample := int64(math.Min(rand.Geometric()-1.0, float64(geometricBound)))
+		boundedGeometricSample := int64(math.Min(stream.Geometric()-1.0, float64(geometricBound)))
 		twoSidedGeometricSample := boundedGeometricSample
-		if rand.Boolean() {
+		if stream.Boolean() {
 			twoSidedGeometricSample = -twoSidedGeometricSample - 1
 		}
 
-		result = stepSize*twoSidedGeometricSample + rand.I63n(stepSize)
+		result = stepSize*twoSidedGeometricSample + stream.I63n(stepSize)
 		resultProbability := binomialProbability(sqrtN, result)
-		rejectProbability := rand.Uniform()
+		rejectProbability := stream.Uniform()
 		if resultProbability > 0.0 &&
 			rejectProbability < resultProbability*float64(stepSize)*math.Pow(2.0, float64(boundedGeometricSample))/4.0 {
 			break
@@ -21,6 +21,7 @@ import (
 	"math"
 
 	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/rand"
 )
 
 // Kind is an enum type. Its values are the supported noise distributions types
@@ -34,7 +35,8 @@ const (
 	Unrecognised
 )
 
-// ToNoise converts a Kind into a Noise instance.
+// ToNoise converts a Kind into a Noise instance. Kinds registered with
+// Register are converted using the New function of their mechanism.
 func ToNoise(k Kind) Noise {
 	switch k {
 	case GaussianNoise:
@@ -44,21 +46,55 @@ func ToNoise(k Kind) Noise {
 	case Unrecognised:
 		log.Warningf("ToNoise: Unrecognised noise specified, returning nil")
 	default:
+		if m, ok := RegisteredMechanism(k); ok {
+			return m.New()
+		}
 		log.Warningf("ToNoise: unknown kind (%v) specified, returning nil", k)
 	}
 	return nil
 }
 
+// ToNoiseWithStream converts a Kind into a Noise instance that draws its
+// randomness from stream instead of a cryptographically secure random number
+// generator. With a stream created by rand.NewDeterministicStream, the noise
+// added by the Noise instance is a deterministic function of the stream's key
+// and of the sequence of calls to the Noise instance.
+//
+// The noise is sampled using the same mechanisms as ToNoise, but it is only
+// differentially private if the stream is unpredictable to the adversary. In
+// particular, the key of a deterministic stream must be secret, and must not be
+// reused to add noise to different data: noise added with the same key to two
+// versions of the data cancels out in their difference.
+//
+// Mechanisms registered with Register don't support streams: ToNoiseWithStream
+// returns nil for their Kinds.
+func ToNoiseWithStream(k Kind, stream *rand.Stream) Noise {
+	switch k {
+	case GaussianNoise:
+		return gaussian{stream: stream}
+	case LaplaceNoise:
+		return laplace{stream: stream}
+	case Unrecognised:
+		log.Warningf("ToNoiseWithStream: Unrecognised noise specified, returning nil")
+	default:
+		log.Warningf("ToNoiseWithStream: unknown kind (%v) specified, returning nil", k)
+	}
+	return nil
+}
+
 // ToKind converts a Noise instance into a Kind.
 func ToKind(n Noise) Kind {
-	switch n {
-	case Gaussian():
+	switch n.(type) {
+	case gaussian:
 		return GaussianNoise
-	case Laplace():
+	case laplace:
 		return LaplaceNoise
 	case nil:
 		log.Warningf("ToKind: nil noise specified, returning Unresognised")
 	default:
+		if k, ok := registeredKind(n); ok {
+			return k
+		}
 		log.Warningf("ToKind: unknown Noise (%v) specified, returning Unresognised", n)
 	}
 	return Unrecognised
@@ -0,0 +1,111 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package noise
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/differential-privacy/go/v3/rand"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+// LaplaceShareInt64 returns a share of discrete Laplace noise, for deployments
+// where numShares non-colluding aggregators each add a share of the noise to
+// an int64 aggregate, e.g. with secure aggregation.
+//
+// The sum of numShares independent shares follows a discrete Laplace
+// distribution with scale l1Sensitivity / ε, i.e. the probability of a value
+// k is proportional to exp(-ε|k| / l1Sensitivity), which makes the aggregate
+// ε-differentially private. This relies on the discrete Laplace distribution
+// being infinitely divisible: each share is the difference of two independent
+// Pólya random variables with parameter 1 / numShares.
+//
+// The guarantee only holds if all numShares shares are added. If up to t
+// aggregators may omit their share or reveal it, each of the n aggregators
+// should add a share computed with numShares = n - t.
+func LaplaceShareInt64(l0Sensitivity, lInfSensitivity int64, epsilon float64, numShares int) (int64, error) {
+	if err := checkArgsLaplace(l0Sensitivity, float64(lInfSensitivity), epsilon, 0); err != nil {
+		return 0, err
+	}
+	if err := checkNumShares(numShares); err != nil {
+		return 0, err
+	}
+	// A discrete Laplace random variable with parameter p = exp(-λ) is the
+	// difference of two independent geometric random variables with success
+	// probability 1-p, and a geometric random variable is the sum of
+	// numShares independent Pólya random variables with parameter
+	// 1 / numShares.
+	lambda := epsilon / float64(l0Sensitivity*lInfSensitivity)
+	r := 1 / float64(numShares)
+	return polya(r, lambda) - polya(r, lambda), nil
+}
+
+// GaussianShareFloat64 returns a share of Gaussian noise, for deployments
+// where numShares non-colluding aggregators each add a share of the noise to
+// a float64 aggregate, e.g. with secure aggregation.
+//
+// Each share is Gaussian noise whose variance is 1 / numShares of the variance
+// that Gaussian().AddNoiseFloat64 would use for the same parameters, so that
+// the sum of numShares independent shares makes the aggregate
+// (ε,δ)-differentially private.
+//
+// The guarantee only holds if all numShares shares are added. If up to t
+// aggregators may omit their share or reveal it, each of the n aggregators
+// should add a share computed with numShares = n - t.
+func GaussianShareFloat64(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64, numShares int) (float64, error) {
+	if err := checkArgsGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	if err := checkNumShares(numShares); err != nil {
+		return 0, err
+	}
+	sigma := SigmaForGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta)
+	return addGaussianFloat64(nil, 0, sigma/math.Sqrt(float64(numShares))), nil
+}
+
+func checkNumShares(numShares int) error {
+	if numShares <= 0 {
+		return fmt.Errorf("numShares must be strictly positive, got %d", numShares)
+	}
+	return nil
+}
+
+// polya returns a sample from a Pólya (i.e. negative binomial) distribution
+// with parameter r > 0 and success probability p = exp(-λ), counting the
+// number of successes before r failures. It is sampled as a Poisson random
+// variable whose mean follows a Gamma distribution with shape r and rate
+// (1-p) / p = exp(λ) - 1.
+func polya(r, lambda float64) int64 {
+	mean := distuv.Gamma{Alpha: r, Beta: math.Expm1(lambda), Src: secureSource{}}.Rand()
+	if mean == 0 {
+		return 0
+	}
+	return int64(distuv.Poisson{Lambda: mean, Src: secureSource{}}.Rand())
+}
+
+// secureSource is a cryptographically secure source of randomness for the
+// distributions of the distuv package.
+type secureSource struct{}
+
+// Uint64 returns a uniformly random uint64.
+func (secureSource) Uint64() uint64 {
+	return rand.U64()
+}
+
+// Seed is a no-op.
+func (secureSource) Seed(_ uint64) {}
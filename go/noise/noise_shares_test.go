@@ -0,0 +1,122 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package noise
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/stattestutils"
+)
+
+func TestLaplaceShareInt64Statistics(t *testing.T) {
+	const numberOfSamples = 50000
+	for _, tc := range []struct {
+		l0Sensitivity, lInfSensitivity int64
+		epsilon                        float64
+		numShares                      int
+	}{
+		{l0Sensitivity: 1, lInfSensitivity: 1, epsilon: 1, numShares: 1},
+		{l0Sensitivity: 1, lInfSensitivity: 1, epsilon: 1, numShares: 5},
+		{l0Sensitivity: 2, lInfSensitivity: 3, epsilon: ln3, numShares: 10},
+	} {
+		// The sum of the shares follows a discrete Laplace distribution with
+		// parameter p = exp(-ε/l1Sensitivity), whose variance is 2p/(1-p)².
+		p := math.Exp(-tc.epsilon / float64(tc.l0Sensitivity*tc.lInfSensitivity))
+		wantVariance := 2 * p / ((1 - p) * (1 - p))
+		samples := make([]float64, numberOfSamples)
+		for i := range samples {
+			var sum int64
+			for j := 0; j < tc.numShares; j++ {
+				share, err := LaplaceShareInt64(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.numShares)
+				if err != nil {
+					t.Fatalf("Couldn't generate share: %v", err)
+				}
+				sum += share
+			}
+			samples[i] = float64(sum)
+		}
+		mean, variance := stattestutils.SampleMean(samples), stattestutils.SampleVariance(samples)
+		// The tolerances are set to the 99.9995% quantile of the anticipated
+		// distributions of the sample mean and variance, as in
+		// TestLaplaceStatistics.
+		meanErrorTolerance := 4.41717 * math.Sqrt(wantVariance/float64(numberOfSamples))
+		varianceErrorTolerance := 4.41717 * math.Sqrt(5.0) * wantVariance / math.Sqrt(float64(numberOfSamples))
+		if !nearEqual(mean, 0, meanErrorTolerance) {
+			t.Errorf("got mean of the sum of shares = %f, want 0 (parameters %+v)", mean, tc)
+		}
+		if !nearEqual(variance, wantVariance, varianceErrorTolerance) {
+			t.Errorf("got variance of the sum of shares = %f, want %f (parameters %+v)", variance, wantVariance, tc)
+		}
+	}
+}
+
+func TestGaussianShareFloat64Statistics(t *testing.T) {
+	const numberOfSamples = 50000
+	for _, tc := range []struct {
+		l0Sensitivity            int64
+		lInfSensitivity, epsilon float64
+		delta                    float64
+		numShares                int
+	}{
+		{l0Sensitivity: 1, lInfSensitivity: 1, epsilon: ln3, delta: 1e-5, numShares: 1},
+		{l0Sensitivity: 1, lInfSensitivity: 1, epsilon: ln3, delta: 1e-5, numShares: 5},
+		{l0Sensitivity: 4, lInfSensitivity: 2.5, epsilon: 1, delta: 1e-10, numShares: 10},
+	} {
+		sigma := SigmaForGaussian(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta)
+		wantVariance := sigma * sigma
+		samples := make([]float64, numberOfSamples)
+		for i := range samples {
+			for j := 0; j < tc.numShares; j++ {
+				share, err := GaussianShareFloat64(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta, tc.numShares)
+				if err != nil {
+					t.Fatalf("Couldn't generate share: %v", err)
+				}
+				samples[i] += share
+			}
+		}
+		mean, variance := stattestutils.SampleMean(samples), stattestutils.SampleVariance(samples)
+		// The sample variance of Gaussian samples has a standard deviation of
+		// sqrt(2) * variance / sqrt(numberOfSamples).
+		meanErrorTolerance := 4.41717 * sigma / math.Sqrt(float64(numberOfSamples))
+		varianceErrorTolerance := 4.41717 * math.Sqrt2 * wantVariance / math.Sqrt(float64(numberOfSamples))
+		if !nearEqual(mean, 0, meanErrorTolerance) {
+			t.Errorf("got mean of the sum of shares = %f, want 0 (parameters %+v)", mean, tc)
+		}
+		if !nearEqual(variance, wantVariance, varianceErrorTolerance) {
+			t.Errorf("got variance of the sum of shares = %f, want %f (parameters %+v)", variance, wantVariance, tc)
+		}
+	}
+}
+
+func TestNoiseSharesInvalidParameters(t *testing.T) {
+	if _, err := LaplaceShareInt64(1, 1, 1, 0); err == nil {
+		t.Errorf("LaplaceShareInt64: with numShares=0 got no error")
+	}
+	if _, err := LaplaceShareInt64(1, 1, 0, 3); err == nil {
+		t.Errorf("LaplaceShareInt64: with epsilon=0 got no error")
+	}
+	if _, err := LaplaceShareInt64(0, 1, 1, 3); err == nil {
+		t.Errorf("LaplaceShareInt64: with l0Sensitivity=0 got no error")
+	}
+	if _, err := GaussianShareFloat64(1, 1, 1, 1e-5, -1); err == nil {
+		t.Errorf("GaussianShareFloat64: with numShares=-1 got no error")
+	}
+	if _, err := GaussianShareFloat64(1, 1, 1, 0, 3); err == nil {
+		t.Errorf("GaussianShareFloat64: with delta=0 got no error")
+	}
+}
@@ -17,8 +17,11 @@
 package noise
 
 import (
+	"bytes"
 	"math"
 	"testing"
+
+	"github.com/google/differential-privacy/go/v3/rand"
 )
 
 var (
@@ -54,3 +57,39 @@ func approxEqual(a, b float64) bool {
 	}
 	return math.Abs(a-b) <= 1e-6*maxMagnitude
 }
+
+func TestToNoiseWithStream(t *testing.T) {
+	for _, k := range []Kind{GaussianNoise, LaplaceNoise} {
+		newNoise := func(key byte) Noise {
+			stream, err := rand.NewDeterministicStream(bytes.Repeat([]byte{key}, 32))
+			if err != nil {
+				t.Fatalf("NewDeterministicStream: %v", err)
+			}
+			return ToNoiseWithStream(k, stream)
+		}
+		delta := 0.0
+		if k == GaussianNoise {
+			delta = 1e-5
+		}
+		n1, n2, n3 := newNoise(1), newNoise(1), newNoise(2)
+		if got := ToKind(n1); got != k {
+			t.Errorf("ToKind(ToNoiseWithStream(%v)) = %v, want %v", k, got, k)
+		}
+		var differs bool
+		for i := 0; i < 10; i++ {
+			x1, err := n1.AddNoiseFloat64(0, 1, 1, 1, delta)
+			if err != nil {
+				t.Fatalf("AddNoiseFloat64 with %v: %v", k, err)
+			}
+			x2, _ := n2.AddNoiseFloat64(0, 1, 1, 1, delta)
+			x3, _ := n3.AddNoiseFloat64(0, 1, 1, 1, delta)
+			if x1 != x2 {
+				t.Fatalf("With %v, got noisy values %v and %v with the same key, want equal values", k, x1, x2)
+			}
+			differs = differs || x1 != x3
+		}
+		if !differs {
+			t.Errorf("With %v, got the same noisy values with different keys", k)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package noise
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// BudgetConsumption declares which privacy parameters a noise mechanism
+// consumes.
+type BudgetConsumption int
+
+const (
+	// UnspecifiedConsumption is invalid, mechanisms must declare their budget
+	// consumption explicitly.
+	UnspecifiedConsumption BudgetConsumption = iota
+	// EpsilonOnly is the consumption of ε-differentially private mechanisms,
+	// such as Laplace noise. They must be called with δ = 0.
+	EpsilonOnly
+	// EpsilonDelta is the consumption of (ε,δ)-differentially private
+	// mechanisms, such as Gaussian noise. They must be called with 0 < δ < 1.
+	EpsilonDelta
+)
+
+// Mechanism describes a custom noise mechanism registered with Register.
+type Mechanism struct {
+	// Name of the mechanism, used in logs and error messages. Required.
+	Name string
+	// New returns a Noise instance of the mechanism. All instances it returns
+	// must have the same dynamic type, which must not be the type of the noise of
+	// another Kind. Required.
+	New func() Noise
+	// Consumption declares the privacy parameters consumed by the mechanism.
+	// Required.
+	Consumption BudgetConsumption
+}
+
+var registry = struct {
+	mu     sync.RWMutex
+	byKind map[Kind]Mechanism
+	byType map[reflect.Type]Kind
+}{
+	byKind: make(map[Kind]Mechanism),
+	byType: make(map[reflect.Type]Kind),
+}
+
+// Register registers a custom noise mechanism with Kind k, so that ToNoise and
+// ToKind support it. This lets libraries built on top of this package, such as
+// Privacy on Beam, use noise mechanisms that aren't part of it.
+//
+// k must be larger than Unrecognised and not registered yet. Since Kinds are
+// used to serialize noise mechanisms, a mechanism must be registered with the
+// same Kind in every binary using it, typically in an init function.
+func Register(k Kind, m Mechanism) error {
+	if k <= Unrecognised {
+		return fmt.Errorf("Register: Kind must be larger than %d, got %d", Unrecognised, k)
+	}
+	if m.Name == "" {
+		return fmt.Errorf("Register: Name of the mechanism with Kind %d must be set", k)
+	}
+	if m.New == nil {
+		return fmt.Errorf("Register: New of mechanism %s must be set", m.Name)
+	}
+	if m.Consumption != EpsilonOnly && m.Consumption != EpsilonDelta {
+		return fmt.Errorf("Register: Consumption of mechanism %s must be EpsilonOnly or EpsilonDelta, got %d", m.Name, m.Consumption)
+	}
+	n := m.New()
+	if n == nil {
+		return fmt.Errorf("Register: New of mechanism %s returned nil", m.Name)
+	}
+	t := reflect.TypeOf(n)
+	switch n.(type) {
+	case gaussian, laplace:
+		return fmt.Errorf("Register: mechanism %s can't use the built-in noise type %v", m.Name, t)
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if other, ok := registry.byKind[k]; ok {
+		return fmt.Errorf("Register: Kind %d is already registered for mechanism %s", k, other.Name)
+	}
+	if other, ok := registry.byType[t]; ok {
+		return fmt.Errorf("Register: noise type %v is already registered with Kind %d", t, other)
+	}
+	registry.byKind[k] = m
+	registry.byType[t] = k
+	return nil
+}
+
+// RegisteredMechanism returns the mechanism registered with Kind k, and whether
+// there is one.
+func RegisteredMechanism(k Kind) (Mechanism, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	m, ok := registry.byKind[k]
+	return m, ok
+}
+
+// Consumption returns the privacy parameters consumed by the noise of Kind k,
+// or UnspecifiedConsumption if k is neither a built-in nor a registered Kind.
+func Consumption(k Kind) BudgetConsumption {
+	switch k {
+	case GaussianNoise:
+		return EpsilonDelta
+	case LaplaceNoise:
+		return EpsilonOnly
+	}
+	if m, ok := RegisteredMechanism(k); ok {
+		return m.Consumption
+	}
+	return UnspecifiedConsumption
+}
+
+// registeredKind returns the Kind registered for the type of n, and whether
+// there is one.
+func registeredKind(n Noise) (Kind, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	k, ok := registry.byType[reflect.TypeOf(n)]
+	return k, ok
+}
@@ -0,0 +1,96 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package noise
+
+import (
+	"testing"
+)
+
+// customLaplace is a custom mechanism for tests, which adds Laplace noise.
+type customLaplace struct {
+	laplace
+}
+
+const customLaplaceKind Kind = 100
+
+func init() {
+	if err := Register(customLaplaceKind, Mechanism{
+		Name:        "custom Laplace",
+		New:         func() Noise { return customLaplace{} },
+		Consumption: EpsilonOnly,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// otherNoise is a custom mechanism that isn't registered.
+type otherNoise struct {
+	laplace
+}
+
+func TestRegisteredMechanism(t *testing.T) {
+	n := ToNoise(customLaplaceKind)
+	if _, ok := n.(customLaplace); !ok {
+		t.Errorf("ToNoise(%d) = %#v, want a customLaplace", customLaplaceKind, n)
+	}
+	if got := ToKind(customLaplace{}); got != customLaplaceKind {
+		t.Errorf("ToKind(customLaplace{}) = %d, want %d", got, customLaplaceKind)
+	}
+	if got := ToKind(otherNoise{}); got != Unrecognised {
+		t.Errorf("ToKind(otherNoise{}) = %d, want Unrecognised", got)
+	}
+	if _, err := n.AddNoiseFloat64(0, 1, 1, 1, 0); err != nil {
+		t.Errorf("AddNoiseFloat64: got error %v", err)
+	}
+	for _, tc := range []struct {
+		kind Kind
+		want BudgetConsumption
+	}{
+		{GaussianNoise, EpsilonDelta},
+		{LaplaceNoise, EpsilonOnly},
+		{customLaplaceKind, EpsilonOnly},
+		{Unrecognised, UnspecifiedConsumption},
+		{customLaplaceKind + 1, UnspecifiedConsumption},
+	} {
+		if got := Consumption(tc.kind); got != tc.want {
+			t.Errorf("Consumption(%d) = %d, want %d", tc.kind, got, tc.want)
+		}
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	newOther := func() Noise { return otherNoise{} }
+	for _, tc := range []struct {
+		desc string
+		kind Kind
+		m    Mechanism
+	}{
+		{"built-in kind", LaplaceNoise, Mechanism{Name: "other", New: newOther, Consumption: EpsilonOnly}},
+		{"Unrecognised kind", Unrecognised, Mechanism{Name: "other", New: newOther, Consumption: EpsilonOnly}},
+		{"registered kind", customLaplaceKind, Mechanism{Name: "other", New: newOther, Consumption: EpsilonOnly}},
+		{"registered type", customLaplaceKind + 1, Mechanism{Name: "other", New: func() Noise { return customLaplace{} }, Consumption: EpsilonOnly}},
+		{"built-in type", customLaplaceKind + 1, Mechanism{Name: "other", New: Laplace, Consumption: EpsilonOnly}},
+		{"no name", customLaplaceKind + 1, Mechanism{New: newOther, Consumption: EpsilonOnly}},
+		{"no New", customLaplaceKind + 1, Mechanism{Name: "other", Consumption: EpsilonOnly}},
+		{"New returning nil", customLaplaceKind + 1, Mechanism{Name: "other", New: func() Noise { return nil }, Consumption: EpsilonOnly}},
+		{"no consumption", customLaplaceKind + 1, Mechanism{Name: "other", New: newOther}},
+	} {
+		if err := Register(tc.kind, tc.m); err == nil {
+			t.Errorf("Register with %s: got no error", tc.desc)
+		}
+	}
+}
@@ -20,8 +20,11 @@ package rand
 
 import (
 	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
 	cryptorand "crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math"
 	"math/bits"
@@ -34,25 +37,70 @@ import (
 // TODO: Add test coverage for the various exported
 // noise-generating functions.
 
-var (
-	randBufLock sync.Mutex
-	randBuf     io.Reader = bufio.NewReaderSize(cryptorand.Reader, 65536)
+// secure is the Stream used by the functions of this package.
+var secure = newStream(bufio.NewReaderSize(cryptorand.Reader, 65536))
 
-	randBitLock sync.Mutex
-	randBitBuf  uint8
-	randBitPos  int8 = math.MaxInt8
-)
+// A Stream generates random numbers from a stream of random bytes. The
+// functions of this package use a Stream reading from a cryptographically
+// secure random number generator; use NewDeterministicStream to generate
+// reproducible random numbers instead.
+//
+// A nil *Stream is valid and uses the same cryptographically secure random
+// number generator as the functions of this package.
+type Stream struct {
+	bufLock sync.Mutex
+	buf     io.Reader
+
+	bitLock sync.Mutex
+	bitBuf  uint8
+	bitPos  int8
+}
+
+func newStream(r io.Reader) *Stream {
+	return &Stream{buf: r, bitPos: math.MaxInt8}
+}
+
+// NewDeterministicStream returns a Stream whose random bytes are the AES-CTR
+// keystream of key, which must be 16, 24 or 32 bytes long. Streams created with
+// the same key generate the same sequence of random numbers.
+//
+// The numbers generated by the Stream are only unpredictable to parties that
+// don't know key, so key must be uniformly random and kept secret.
+func NewDeterministicStream(key []byte) (*Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("rand.NewDeterministicStream: %w", err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	return newStream(cipher.StreamReader{S: cipher.NewCTR(block, iv), R: zeroReader{}}), nil
+}
+
+// zeroReader is an infinite stream of zero bytes.
+type zeroReader struct{}
 
-func readRandBuf(b []byte) (int, error) {
-	randBufLock.Lock()
-	defer randBufLock.Unlock()
-	return io.ReadFull(randBuf, b)
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+func (s *Stream) read(b []byte) (int, error) {
+	if s == nil {
+		s = secure
+	}
+	s.bufLock.Lock()
+	defer s.bufLock.Unlock()
+	return io.ReadFull(s.buf, b)
 }
 
 // U64 returns a uniformly random uint64.
 func U64() uint64 {
+	return secure.U64()
+}
+
+// U64 returns a uniformly random uint64.
+func (s *Stream) U64() uint64 {
 	var r [8]uint8
-	if _, err := readRandBuf(r[:]); err != nil {
+	if _, err := s.read(r[:]); err != nil {
 		log.Fatalf("out of randomness, should never happen: %v", err)
 	}
 	return binary.LittleEndian.Uint64(r[:])
@@ -60,8 +108,13 @@ func U64() uint64 {
 
 // U8 returns a uniformly random uint8.
 func U8() uint8 {
+	return secure.U8()
+}
+
+// U8 returns a uniformly random uint8.
+func (s *Stream) U8() uint8 {
 	var r [1]uint8
-	if _, err := readRandBuf(r[:]); err != nil {
+	if _, err := s.read(r[:]); err != nil {
 		log.Fatalf("out of randomness, should never happen: %v", err)
 	}
 	return r[0]
@@ -69,7 +122,12 @@ func U8() uint8 {
 
 // Sign returns +1.0 or -1.0 with equal probabilities.
 func Sign() float64 {
-	if Boolean() {
+	return secure.Sign()
+}
+
+// Sign returns +1.0 or -1.0 with equal probabilities.
+func (s *Stream) Sign() float64 {
+	if s.Boolean() {
 		return 1.0
 	}
 	return -1.0
@@ -77,25 +135,39 @@ func Sign() float64 {
 
 // Boolean returns true or false with equal probability.
 func Boolean() bool {
-	randBitLock.Lock()
-	defer randBitLock.Unlock()
-	if randBitPos > 7 { // Out of random bits.
-		randBitBuf = U8()
-		randBitPos = 0
+	return secure.Boolean()
+}
+
+// Boolean returns true or false with equal probability.
+func (s *Stream) Boolean() bool {
+	if s == nil {
+		s = secure
 	}
-	res := randBitBuf&(1<<randBitPos) > 0
-	randBitPos++
+	s.bitLock.Lock()
+	defer s.bitLock.Unlock()
+	if s.bitPos > 7 { // Out of random bits.
+		s.bitBuf = s.U8()
+		s.bitPos = 0
+	}
+	res := s.bitBuf&(1<<s.bitPos) > 0
+	s.bitPos++
 	return res
 }
 
 // I63n returns an integer from the set {0,...,n-1} uniformly at random.
 // The value of n must be positive.
 func I63n(n int64) int64 {
+	return secure.I63n(n)
+}
+
+// I63n returns an integer from the set {0,...,n-1} uniformly at random.
+// The value of n must be positive.
+func (s *Stream) I63n(n int64) int64 {
 	largestMultipleOfN := (math.MaxInt64 / n) * n
 	var positiveRandomInteger int64
 	for true {
 		// Draw random 64 bit sequence and set sign bit to 0.
-		positiveRandomInteger = int64(U64()) & 0x7fffffffffffffff
+		positiveRandomInteger = int64(s.U64()) & 0x7fffffffffffffff
 		if positiveRandomInteger < largestMultipleOfN {
 			break
 		}
@@ -109,8 +181,15 @@ func I63n(n int64) int64 {
 //
 // See http://g/go-nuts/GndbDnHKHuw/VNSrkl9vBQAJ for details.
 func Uniform() float64 {
-	i := U64() % (1 << 53)
-	r := (1 + float64(i)/(1<<53)) / math.Pow(2, Geometric())
+	return secure.Uniform()
+}
+
+// Uniform returns a float64 from the interval (0,1] such that each float
+// in the interval is returned with positive probability and the resulting
+// distribution simulates a continuous uniform distribution on (0, 1].
+func (s *Stream) Uniform() float64 {
+	i := s.U64() % (1 << 53)
+	r := (1 + float64(i)/(1<<53)) / math.Pow(2, s.Geometric())
 	// We want to avoid returning 0, since we're taking the log of the output.
 	if r == 0 {
 		return 1
@@ -121,12 +200,18 @@ func Uniform() float64 {
 // Geometric returns a float64 that counts the number of Bernoulli trials until
 // the first success for a success probability of 0.5.
 func Geometric() float64 {
+	return secure.Geometric()
+}
+
+// Geometric returns a float64 that counts the number of Bernoulli trials until
+// the first success for a success probability of 0.5.
+func (s *Stream) Geometric() float64 {
 	// 1 plus the number of leading zeros from an infinite stream of random bits
 	// follows the desired geometric distribution.
 	b := 1
 	var r uint8
 	for r == 0 {
-		r = U8()
+		r = s.U8()
 		b += bits.LeadingZeros8(r)
 	}
 	return float64(b)
@@ -143,7 +228,7 @@ type randSource struct{}
 // Int63 returns a uniformly random int64 in [0, 1<<63).
 func (rs randSource) Int63() int64 {
 	var r [8]uint8
-	if _, err := readRandBuf(r[:]); err != nil {
+	if _, err := secure.read(r[:]); err != nil {
 		log.Fatalf("out of randomness, should never happen: %v", err)
 	}
 	i := int64(binary.LittleEndian.Uint64(r[:]))
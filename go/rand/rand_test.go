@@ -22,10 +22,10 @@ import (
 )
 
 func TestBooleanBufIsShifting(t *testing.T) {
-	randBuf = bytes.NewReader([]byte{
+	s := newStream(bytes.NewReader([]byte{
 		0b00100100,
 		0b10010000,
-	})
+	}))
 	for pos, want := range []bool{
 		// first byte
 		false,
@@ -46,8 +46,41 @@ func TestBooleanBufIsShifting(t *testing.T) {
 		false,
 		true,
 	} {
-		if got := Boolean(); got != want {
+		if got := s.Boolean(); got != want {
 			t.Errorf("Boolean: got %v, want %v in %v-th iteration", got, want, pos)
 		}
 	}
 }
+
+func TestDeterministicStream(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	s1, err := NewDeterministicStream(key)
+	if err != nil {
+		t.Fatalf("NewDeterministicStream: %v", err)
+	}
+	s2, err := NewDeterministicStream(key)
+	if err != nil {
+		t.Fatalf("NewDeterministicStream: %v", err)
+	}
+	s3, err := NewDeterministicStream(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatalf("NewDeterministicStream: %v", err)
+	}
+	var differs bool
+	for i := 0; i < 100; i++ {
+		u1, u2, u3 := s1.Uniform(), s2.Uniform(), s3.Uniform()
+		if u1 != u2 {
+			t.Fatalf("Uniform: got %v and %v in %v-th iteration with the same key, want equal values", u1, u2, i)
+		}
+		differs = differs || u1 != u3
+	}
+	if !differs {
+		t.Errorf("Uniform: got the same values with different keys")
+	}
+}
+
+func TestNewDeterministicStreamInvalidKey(t *testing.T) {
+	if _, err := NewDeterministicStream([]byte{1, 2, 3}); err == nil {
+		t.Errorf("NewDeterministicStream with a 3-byte key: got no error")
+	}
+}
@@ -0,0 +1,197 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package dpquery compiles simple SQL-like queries with differentially private
+// aggregate functions into Privacy on Beam transforms.
+//
+// For example, on a PrivatePCollection of structs with fields Day and
+// Duration,
+//
+//	outputs, err := dpquery.Run(s, pcol,
+//		"SELECT Day, DP_COUNT(*), DP_MEAN(Duration, 0, 60) FROM visits GROUP BY Day",
+//		dpquery.Params{
+//			AggregationEpsilon:           1,
+//			PartitionSelectionEpsilon:    1,
+//			PartitionSelectionDelta:      1e-5,
+//			MaxPartitionsContributed:     3,
+//			MaxContributionsPerPartition: 2,
+//		})
+//
+// returns a PCollection<K,int64> with the number of visits per day and a
+// PCollection<K,float64> with the mean duration of visits per day.
+//
+// # Beam SQL
+//
+// DP aggregate functions can't be registered as Beam SQL functions: Beam SQL
+// queries are run by a Java expansion service, which can't call into Go
+// code. Instead, non-private parts of a pipeline (e.g. joins and filters) can
+// be written with Beam SQL, and their output aggregated with RunOnRows:
+//
+//	rows := sql.Transform(s, "SELECT v.UserID, v.Day, v.Duration FROM visits v JOIN ...",
+//		sql.Input("visits", visits), sql.OutputType(reflect.TypeOf(visitRow{})))
+//	outputs, err := dpquery.RunOnRows(s, rows, spec, "UserID",
+//		"SELECT Day, DP_COUNT(*) FROM rows GROUP BY Day", params)
+//
+// The rows must not be aggregated across privacy identifiers before RunOnRows,
+// e.g. with a GROUP BY in the Beam SQL query: RunOnRows assumes that each row
+// is contributed by a single privacy identifier.
+package dpquery
+
+import (
+	"fmt"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// Params specifies the parameters shared by all the aggregates of a query.
+type Params struct {
+	// Noise type (which is either pbeam.LaplaceNoise{} or
+	// pbeam.GaussianNoise{}).
+	//
+	// Defaults to the noise of the PrivacySpec.
+	NoiseKind pbeam.NoiseKind
+	// Differential privacy budget consumed by the aggregates of the query. It
+	// is split evenly between them. If the query has a single aggregate, both
+	// epsilon and delta can be left 0; in that case the entire budget reserved
+	// for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection. Partitions
+	// are selected once for the whole query, so that all the aggregates have
+	// the same partitions.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one partition selection, this can be left unset; in
+	// that case the entire budget reserved for partition selection in the
+	// PrivacySpec is consumed.
+	PartitionSelectionEpsilon, PartitionSelectionDelta float64
+	// List of partitions present in the output, if they are known in advance.
+	// See pbeam.CountParams.PublicPartitions for details.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct keys that a given privacy identifier can
+	// influence.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of rows that a given privacy identifier can
+	// contribute to each key. Used by DP_COUNT and DP_MEAN; DP_SUM bounds the
+	// sum of the values of a privacy identifier for each key with its bounds
+	// instead.
+	//
+	// Required if the query has a DP_COUNT or DP_MEAN aggregate.
+	MaxContributionsPerPartition int64
+}
+
+// Run parses query with Parse and computes its aggregates on pcol, which must
+// be a PrivatePCollection<T> where T is a struct (e.g. created with
+// pbeam.MakePrivateFromStruct) whose fields are named in the query. The name of
+// the table in the FROM clause is only informative: it always refers to pcol.
+//
+// Run returns one PCollection per aggregate of the query, in order:
+// PCollection<K,int64> for DP_COUNT, PCollection<K,int64> or
+// PCollection<K,float64> for DP_SUM depending on the type of the summed field,
+// and PCollection<K,float64> for DP_MEAN, where K is the type of the key field.
+func Run(s beam.Scope, pcol pbeam.PrivatePCollection, query string, params Params) ([]beam.PCollection, error) {
+	s = s.Scope("dpquery.Run")
+	q, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkParams(q, params); err != nil {
+		return nil, fmt.Errorf("dpquery.Run: %w", err)
+	}
+	aggEpsilon := params.AggregationEpsilon / float64(len(q.Aggregates))
+	aggDelta := params.AggregationDelta / float64(len(q.Aggregates))
+
+	keys := pbeam.ExtractStructFields(s, pcol, q.KeyField, "")
+	partitions := params.PublicPartitions
+	if partitions == nil {
+		partitions = pbeam.SelectPartitions(s, keys, pbeam.SelectPartitionsParams{
+			Epsilon:                  params.PartitionSelectionEpsilon,
+			Delta:                    params.PartitionSelectionDelta,
+			MaxPartitionsContributed: params.MaxPartitionsContributed,
+		})
+	}
+
+	outputs := make([]beam.PCollection, len(q.Aggregates))
+	for i, agg := range q.Aggregates {
+		switch agg.Kind {
+		case Count:
+			outputs[i] = pbeam.Count(s, keys, pbeam.CountParams{
+				NoiseKind:                params.NoiseKind,
+				AggregationEpsilon:       aggEpsilon,
+				AggregationDelta:         aggDelta,
+				PublicPartitions:         partitions,
+				MaxPartitionsContributed: params.MaxPartitionsContributed,
+				MaxValue:                 params.MaxContributionsPerPartition,
+			})
+		case Sum:
+			outputs[i] = pbeam.SumPerKey(s, pbeam.ExtractStructFields(s, pcol, q.KeyField, agg.Field), pbeam.SumParams{
+				NoiseKind:                params.NoiseKind,
+				AggregationEpsilon:       aggEpsilon,
+				AggregationDelta:         aggDelta,
+				PublicPartitions:         partitions,
+				MaxPartitionsContributed: params.MaxPartitionsContributed,
+				MinValue:                 agg.MinValue,
+				MaxValue:                 agg.MaxValue,
+			})
+		case Mean:
+			outputs[i] = pbeam.MeanPerKey(s, pbeam.ExtractStructFields(s, pcol, q.KeyField, agg.Field), pbeam.MeanParams{
+				NoiseKind:                    params.NoiseKind,
+				AggregationEpsilon:           aggEpsilon,
+				AggregationDelta:             aggDelta,
+				PublicPartitions:             partitions,
+				MaxPartitionsContributed:     params.MaxPartitionsContributed,
+				MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+				MinValue:                     agg.MinValue,
+				MaxValue:                     agg.MaxValue,
+			})
+		}
+	}
+	return outputs, nil
+}
+
+// RunOnRows creates a PrivatePCollection from col, which must be a
+// PCollection<T> where T is a struct, e.g. the output of a Beam SQL transform
+// with a struct output type, using the field specified by idFieldPath as the
+// privacy identifier, and runs query on it with Run.
+//
+// See pbeam.MakePrivateFromStruct for the format of idFieldPath.
+func RunOnRows(s beam.Scope, col beam.PCollection, spec *pbeam.PrivacySpec, idFieldPath, query string, params Params) ([]beam.PCollection, error) {
+	s = s.Scope("dpquery.RunOnRows")
+	return Run(s, pbeam.MakePrivateFromStruct(s, col, spec, idFieldPath), query, params)
+}
+
+func checkParams(q *Query, params Params) error {
+	if len(q.Aggregates) > 1 && params.AggregationEpsilon == 0 {
+		return fmt.Errorf("AggregationEpsilon must be set when the query has more than one aggregate, got %d aggregates", len(q.Aggregates))
+	}
+	if params.PublicPartitions != nil && (params.PartitionSelectionEpsilon != 0 || params.PartitionSelectionDelta != 0) {
+		return fmt.Errorf("PartitionSelectionEpsilon and PartitionSelectionDelta must be unset when PublicPartitions are specified")
+	}
+	if params.MaxPartitionsContributed <= 0 {
+		return fmt.Errorf("MaxPartitionsContributed must be set to a positive value, got %d", params.MaxPartitionsContributed)
+	}
+	for _, agg := range q.Aggregates {
+		if (agg.Kind == Count || agg.Kind == Mean) && params.MaxContributionsPerPartition <= 0 {
+			return fmt.Errorf("MaxContributionsPerPartition must be set to a positive value for %v, got %d", agg.Kind, params.MaxContributionsPerPartition)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpquery
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(visit{}))
+}
+
+func TestMain(m *testing.M) {
+	ptest.MainWithDefault(m, "direct")
+}
+
+type visit struct {
+	UserID   string
+	Day      int
+	Duration float64
+}
+
+func TestRun(t *testing.T) {
+	var visits []visit
+	for i := 0; i < 10; i++ {
+		visits = append(visits, visit{UserID: fmt.Sprintf("user%d", i), Day: 1, Duration: 5})
+	}
+	for i := 0; i < 5; i++ {
+		visits = append(visits, visit{UserID: fmt.Sprintf("user%d", i), Day: 2, Duration: 2})
+	}
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, visits)
+	spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+		AggregationEpsilon: 3,
+		TestMode:           pbeam.TestModeWithoutContributionBounding,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create PrivacySpec: %v", err)
+	}
+	pcol := pbeam.MakePrivateFromStruct(s, col, spec, "UserID")
+
+	outputs, err := Run(s, pcol,
+		"SELECT Day, DP_COUNT(*), DP_SUM(Duration, 0, 10), DP_MEAN(Duration, 0, 10) FROM visits GROUP BY Day",
+		Params{
+			AggregationEpsilon:           3,
+			PublicPartitions:             []int{1, 2},
+			MaxPartitionsContributed:     2,
+			MaxContributionsPerPartition: 1,
+		})
+	if err != nil {
+		t.Fatalf("Run: got error %v", err)
+	}
+	if len(outputs) != 3 {
+		t.Fatalf("Run: got %d outputs, want 3", len(outputs))
+	}
+
+	wantCounts := beam.ParDo(s, testutils.PairII64ToKV, beam.CreateList(s, []testutils.PairII64{{1, 10}, {2, 5}}))
+	testutils.ApproxEqualsKVInt64(t, s, outputs[0], wantCounts, 0)
+	wantSums := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{1, 50}, {2, 10}}))
+	testutils.ApproxEqualsKVFloat64(t, s, outputs[1], wantSums, 1e-10)
+	wantMeans := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{1, 5}, {2, 2}}))
+	testutils.ApproxEqualsKVFloat64(t, s, outputs[2], wantMeans, 1e-10)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestRunOnRows(t *testing.T) {
+	var visits []visit
+	for i := 0; i < 10; i++ {
+		visits = append(visits, visit{UserID: fmt.Sprintf("user%d", i), Day: i % 2, Duration: 1})
+	}
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, visits)
+	spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           pbeam.TestModeWithoutContributionBounding,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create PrivacySpec: %v", err)
+	}
+
+	outputs, err := RunOnRows(s, col, spec, "UserID",
+		"SELECT Day, DP_COUNT(*) FROM rows GROUP BY Day",
+		Params{
+			PublicPartitions:             []int{0, 1},
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+		})
+	if err != nil {
+		t.Fatalf("RunOnRows: got error %v", err)
+	}
+
+	want := beam.ParDo(s, testutils.PairII64ToKV, beam.CreateList(s, []testutils.PairII64{{0, 5}, {1, 5}}))
+	testutils.ApproxEqualsKVInt64(t, s, outputs[0], want, 0)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("RunOnRows: %v", err)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		query  string
+		params Params
+	}{
+		{
+			desc:   "invalid query",
+			query:  "SELECT Day FROM visits GROUP BY Day",
+			params: Params{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1},
+		},
+		{
+			desc:   "several aggregates without AggregationEpsilon",
+			query:  "SELECT Day, DP_COUNT(*), DP_SUM(Duration, 0, 10) FROM visits GROUP BY Day",
+			params: Params{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1},
+		},
+		{
+			desc:   "missing MaxPartitionsContributed",
+			query:  "SELECT Day, DP_SUM(Duration, 0, 10) FROM visits GROUP BY Day",
+			params: Params{},
+		},
+		{
+			desc:   "missing MaxContributionsPerPartition",
+			query:  "SELECT Day, DP_MEAN(Duration, 0, 10) FROM visits GROUP BY Day",
+			params: Params{MaxPartitionsContributed: 1},
+		},
+		{
+			desc:  "public partitions with partition selection budget",
+			query: "SELECT Day, DP_COUNT(*) FROM visits GROUP BY Day",
+			params: Params{
+				PartitionSelectionEpsilon:    1,
+				PublicPartitions:             []int{1},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+		},
+	} {
+		_, s := beam.NewPipelineWithRoot()
+		if _, err := Run(s, pbeam.PrivatePCollection{}, tc.query, tc.params); err == nil {
+			t.Errorf("Run with %s: got no error", tc.desc)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpquery
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// AggregateKind is the kind of a DP aggregate function.
+type AggregateKind int
+
+const (
+	// Count is DP_COUNT(*).
+	Count AggregateKind = iota
+	// Sum is DP_SUM(field, min, max).
+	Sum
+	// Mean is DP_MEAN(field, min, max).
+	Mean
+)
+
+func (k AggregateKind) String() string {
+	switch k {
+	case Count:
+		return "DP_COUNT"
+	case Sum:
+		return "DP_SUM"
+	case Mean:
+		return "DP_MEAN"
+	default:
+		return fmt.Sprintf("AggregateKind(%d)", int(k))
+	}
+}
+
+// Aggregate is a DP aggregate function in the SELECT list of a query.
+type Aggregate struct {
+	Kind AggregateKind
+	// Field that is aggregated. Empty for DP_COUNT(*).
+	Field string
+	// Bounds of the contributions to the aggregate. Unset for DP_COUNT(*).
+	MinValue, MaxValue float64
+}
+
+// Query is a parsed query of the form
+//
+//	SELECT key, aggregate, ... FROM table GROUP BY key
+type Query struct {
+	// Field that the rows are grouped by.
+	KeyField string
+	// Name of the table in the FROM clause.
+	Table string
+	// Aggregates in the SELECT list, in order.
+	Aggregates []Aggregate
+}
+
+// Parse parses a query of the form
+//
+//	SELECT key, aggregate, ... FROM table GROUP BY key
+//
+// where each aggregate is one of DP_COUNT(*), DP_SUM(field, min, max) and
+// DP_MEAN(field, min, max). Keywords and function names are case-insensitive.
+// Fields are the names of fields of the rows, with dots separating the names
+// of nested fields, e.g. "Visit.Duration".
+func Parse(query string) (*Query, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	q, err := p.parseQuery()
+	if err != nil {
+		return nil, fmt.Errorf("dpquery.Parse: %w", err)
+	}
+	return q, nil
+}
+
+type tokenKind int
+
+const (
+	identToken tokenKind = iota
+	numberToken
+	symbolToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(query string) ([]token, error) {
+	var tokens []token
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{identToken, string(runes[i:j])})
+			i = j
+		case unicode.IsDigit(r) || r == '-' || r == '+' || r == '.':
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E' ||
+				((runes[j] == '-' || runes[j] == '+') && (runes[j-1] == 'e' || runes[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{numberToken, string(runes[i:j])})
+			i = j
+		case strings.ContainsRune("(),*;", r):
+			tokens = append(tokens, token{symbolToken, string(r)})
+			i++
+		default:
+			return nil, fmt.Errorf("dpquery.Parse: unexpected character %q at offset %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) next() (token, error) {
+	t, ok := p.peek()
+	if !ok {
+		return token{}, fmt.Errorf("unexpected end of query")
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	t, err := p.next()
+	if err != nil {
+		return fmt.Errorf("expected %s: %w", keyword, err)
+	}
+	if t.kind != identToken || !strings.EqualFold(t.text, keyword) {
+		return fmt.Errorf("expected %s, got %q", keyword, t.text)
+	}
+	return nil
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	t, err := p.next()
+	if err != nil {
+		return fmt.Errorf("expected %q: %w", symbol, err)
+	}
+	if t.kind != symbolToken || t.text != symbol {
+		return fmt.Errorf("expected %q, got %q", symbol, t.text)
+	}
+	return nil
+}
+
+func (p *parser) identifier() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", fmt.Errorf("expected identifier: %w", err)
+	}
+	if t.kind != identToken {
+		return "", fmt.Errorf("expected identifier, got %q", t.text)
+	}
+	return t.text, nil
+}
+
+func (p *parser) number() (float64, error) {
+	t, err := p.next()
+	if err != nil {
+		return 0, fmt.Errorf("expected number: %w", err)
+	}
+	if t.kind != numberToken {
+		return 0, fmt.Errorf("expected number, got %q", t.text)
+	}
+	f, err := strconv.ParseFloat(t.text, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid number %q", t.text)
+	}
+	return f, nil
+}
+
+func (p *parser) parseQuery() (*Query, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	q := &Query{}
+	var err error
+	if q.KeyField, err = p.identifier(); err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != symbolToken || t.text != "," {
+			break
+		}
+		p.pos++
+		agg, err := p.parseAggregate()
+		if err != nil {
+			return nil, err
+		}
+		q.Aggregates = append(q.Aggregates, agg)
+	}
+	if len(q.Aggregates) == 0 {
+		return nil, fmt.Errorf("the SELECT list must contain at least one aggregate after the key")
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if q.Table, err = p.identifier(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("GROUP"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("BY"); err != nil {
+		return nil, err
+	}
+	groupBy, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	if groupBy != q.KeyField {
+		return nil, fmt.Errorf("the query must be grouped by the selected key %s, got %s", q.KeyField, groupBy)
+	}
+	if t, ok := p.peek(); ok && t.kind == symbolToken && t.text == ";" {
+		p.pos++
+	}
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q after GROUP BY clause", t.text)
+	}
+	return q, nil
+}
+
+func (p *parser) parseAggregate() (Aggregate, error) {
+	name, err := p.identifier()
+	if err != nil {
+		return Aggregate{}, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return Aggregate{}, err
+	}
+	var agg Aggregate
+	switch strings.ToUpper(name) {
+	case "DP_COUNT":
+		agg.Kind = Count
+		if err := p.expectSymbol("*"); err != nil {
+			return Aggregate{}, fmt.Errorf("DP_COUNT: %w", err)
+		}
+	case "DP_SUM", "DP_MEAN":
+		agg.Kind = Sum
+		if strings.EqualFold(name, "DP_MEAN") {
+			agg.Kind = Mean
+		}
+		if agg.Field, err = p.identifier(); err != nil {
+			return Aggregate{}, fmt.Errorf("%v: %w", agg.Kind, err)
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return Aggregate{}, fmt.Errorf("%v: %w", agg.Kind, err)
+		}
+		if agg.MinValue, err = p.number(); err != nil {
+			return Aggregate{}, fmt.Errorf("%v: %w", agg.Kind, err)
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return Aggregate{}, fmt.Errorf("%v: %w", agg.Kind, err)
+		}
+		if agg.MaxValue, err = p.number(); err != nil {
+			return Aggregate{}, fmt.Errorf("%v: %w", agg.Kind, err)
+		}
+		if agg.MinValue > agg.MaxValue {
+			return Aggregate{}, fmt.Errorf("%v: lower bound %f must not exceed upper bound %f", agg.Kind, agg.MinValue, agg.MaxValue)
+		}
+	default:
+		return Aggregate{}, fmt.Errorf("unknown aggregate function %s, must be one of DP_COUNT, DP_SUM and DP_MEAN", name)
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return Aggregate{}, fmt.Errorf("%v: %w", agg.Kind, err)
+	}
+	return agg, nil
+}
@@ -0,0 +1,84 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpquery
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		query string
+		want  *Query
+	}{
+		{
+			desc:  "single aggregate",
+			query: "SELECT key, DP_COUNT(*) FROM input GROUP BY key",
+			want:  &Query{KeyField: "key", Table: "input", Aggregates: []Aggregate{{Kind: Count}}},
+		},
+		{
+			desc:  "several aggregates",
+			query: "SELECT key, DP_COUNT(*), DP_SUM(x, -1.5, 2e3), DP_MEAN(Visit.Duration, 0, 10) FROM input GROUP BY key",
+			want: &Query{KeyField: "key", Table: "input", Aggregates: []Aggregate{
+				{Kind: Count},
+				{Kind: Sum, Field: "x", MinValue: -1.5, MaxValue: 2000},
+				{Kind: Mean, Field: "Visit.Duration", MinValue: 0, MaxValue: 10},
+			}},
+		},
+		{
+			desc:  "lower case keywords and trailing semicolon",
+			query: "select day, dp_mean(x, 0, 10) from visits group by day;",
+			want:  &Query{KeyField: "day", Table: "visits", Aggregates: []Aggregate{{Kind: Mean, Field: "x", MinValue: 0, MaxValue: 10}}},
+		},
+	} {
+		got, err := Parse(tc.query)
+		if err != nil {
+			t.Errorf("Parse(%q) with %s: got error %v", tc.query, tc.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Parse(%q) with %s: got diff (-want +got):\n%s", tc.query, tc.desc, diff)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		query string
+	}{
+		{"empty query", ""},
+		{"missing SELECT", "key, DP_COUNT(*) FROM input GROUP BY key"},
+		{"no aggregate", "SELECT key FROM input GROUP BY key"},
+		{"unknown aggregate", "SELECT key, DP_MEDIAN(x, 0, 1) FROM input GROUP BY key"},
+		{"count of a field", "SELECT key, DP_COUNT(x) FROM input GROUP BY key"},
+		{"missing bounds", "SELECT key, DP_SUM(x) FROM input GROUP BY key"},
+		{"invalid bounds", "SELECT key, DP_SUM(x, 1, 0) FROM input GROUP BY key"},
+		{"infinite bound", "SELECT key, DP_SUM(x, 0, 1e400) FROM input GROUP BY key"},
+		{"missing GROUP BY", "SELECT key, DP_COUNT(*) FROM input"},
+		{"grouped by another field", "SELECT key, DP_COUNT(*) FROM input GROUP BY other"},
+		{"trailing tokens", "SELECT key, DP_COUNT(*) FROM input GROUP BY key LIMIT 10"},
+		{"unexpected character", "SELECT key, DP_COUNT(*) FROM input WHERE x > 0 GROUP BY key"},
+	} {
+		if got, err := Parse(tc.query); err == nil {
+			t.Errorf("Parse(%q) with %s: got %+v, want error", tc.query, tc.desc, got)
+		}
+	}
+}
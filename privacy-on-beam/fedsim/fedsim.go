@@ -0,0 +1,242 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package fedsim simulates federated analytics with Privacy on Beam, so that
+// designs mixing on-device and central processing can be evaluated end-to-end
+// before any device is involved.
+//
+// In federated analytics, devices bound their contributions and compute
+// partial aggregates over their local events, and a server merges the partial
+// aggregates and adds differentially private noise. fedsim simulates both
+// sides over a population of simulated devices:
+//
+//	reports, err := fedsim.SimulateDevices(devices, fedsim.ClientParams{
+//		MaxPartitionsContributed:     3,
+//		MaxContributionsPerPartition: 10,
+//		MinValue:                     0,
+//		MaxValue:                     60,
+//		DropoutRate:                  0.2,
+//	}, seed)
+//	...
+//	pcol := fedsim.ServerInput(s, beam.CreateList(s, reports), spec)
+//	means := pbeam.MeanPerKeyFromClientAggregates(s, pcol, pbeam.MeanParams{...})
+//
+// The outputs can then be compared to Exact, which computes the statistics of
+// all events without contribution bounding, dropout or noise.
+package fedsim
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(Report{}))
+	beam.RegisterType(reflect.TypeOf(decodedReport{}))
+	register.Function1x2[Report, decodedReport, error](decodeReport)
+	register.Function1x2[decodedReport, string, pbeam.ClientAggregate](partitionAggregate)
+}
+
+// Event is a value recorded on a device for a partition, e.g. the duration of
+// a session in an app.
+type Event struct {
+	Partition string
+	Value     float64
+}
+
+// Device is a simulated device, holding the events of a single privacy unit.
+type Device struct {
+	ID     string
+	Events []Event
+}
+
+// ClientParams specifies the processing done on each simulated device.
+type ClientParams struct {
+	// The maximum number of distinct partitions that a device reports on. If
+	// a device has events in more partitions, random partitions are dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of events of a partition that a device aggregates. If
+	// a device has more events in a partition, random events are dropped.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Values of events are clamped to [MinValue, MaxValue] before being
+	// aggregated on the device.
+	//
+	// Required.
+	MinValue, MaxValue float64
+	// Fraction of the devices that don't report at all, e.g. because they are
+	// offline or not eligible.
+	//
+	// Optional; must be in [0, 1).
+	DropoutRate float64
+}
+
+func checkClientParams(params ClientParams) error {
+	if params.MaxPartitionsContributed <= 0 {
+		return fmt.Errorf("MaxPartitionsContributed must be set to a positive value, was %d instead", params.MaxPartitionsContributed)
+	}
+	if err := checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition); err != nil {
+		return err
+	}
+	if err := checks.CheckBoundsFloat64(params.MinValue, params.MaxValue); err != nil {
+		return err
+	}
+	if math.IsNaN(params.DropoutRate) || params.DropoutRate < 0 || params.DropoutRate >= 1 {
+		return fmt.Errorf("DropoutRate must be in [0, 1), got %f", params.DropoutRate)
+	}
+	return nil
+}
+
+// Report is the partial aggregate of a partition sent by a device to the
+// server.
+type Report struct {
+	DeviceID  string
+	Partition string
+	// Aggregate of the events of the device in the partition, encoded with
+	// pbeam.EncodeClientAggregate as it would be sent over the network.
+	Aggregate []byte
+}
+
+// SimulateDevices simulates the client side of federated analytics on
+// devices, and returns the reports that they send to the server. The
+// simulation is deterministic for a given seed.
+func SimulateDevices(devices []Device, params ClientParams, seed int64) ([]Report, error) {
+	if err := checkClientParams(params); err != nil {
+		return nil, fmt.Errorf("fedsim.SimulateDevices: %v", err)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	var reports []Report
+	for _, d := range devices {
+		if rng.Float64() < params.DropoutRate {
+			continue
+		}
+		reports = append(reports, simulateDevice(d, params, rng)...)
+	}
+	return reports, nil
+}
+
+// simulateDevice bounds the contributions of a device and aggregates its
+// events per partition.
+func simulateDevice(d Device, params ClientParams, rng *rand.Rand) []Report {
+	byPartition := make(map[string][]float64)
+	for _, e := range d.Events {
+		byPartition[e.Partition] = append(byPartition[e.Partition], e.Value)
+	}
+	// Sort the partitions so that the simulation only depends on the seed.
+	partitions := make([]string, 0, len(byPartition))
+	for p := range byPartition {
+		partitions = append(partitions, p)
+	}
+	sort.Strings(partitions)
+	rng.Shuffle(len(partitions), func(i, j int) { partitions[i], partitions[j] = partitions[j], partitions[i] })
+	if int64(len(partitions)) > params.MaxPartitionsContributed {
+		partitions = partitions[:params.MaxPartitionsContributed]
+	}
+
+	reports := make([]Report, 0, len(partitions))
+	for _, p := range partitions {
+		values := byPartition[p]
+		rng.Shuffle(len(values), func(i, j int) { values[i], values[j] = values[j], values[i] })
+		if int64(len(values)) > params.MaxContributionsPerPartition {
+			values = values[:params.MaxContributionsPerPartition]
+		}
+		var agg pbeam.ClientAggregate
+		for _, v := range values {
+			agg.Sum += math.Min(math.Max(v, params.MinValue), params.MaxValue)
+			agg.Count++
+		}
+		reports = append(reports, Report{DeviceID: d.ID, Partition: p, Aggregate: pbeam.EncodeClientAggregate(agg)})
+	}
+	return reports
+}
+
+// ServerInput simulates the server side of federated analytics: it decodes
+// the reports of the devices, a PCollection<Report>, and returns them as a
+// PrivatePCollection<string,pbeam.ClientAggregate> keyed by partition, whose
+// privacy unit is the device. It can be aggregated with
+// pbeam.MeanPerKeyFromClientAggregates, or with pbeam.SumPerKey on the Sum or
+// Count of the aggregates.
+//
+// The pipeline fails on reports that can't be decoded.
+func ServerInput(s beam.Scope, reports beam.PCollection, spec *pbeam.PrivacySpec) pbeam.PrivatePCollection {
+	s = s.Scope("fedsim.ServerInput")
+	decoded := beam.ParDo(s, decodeReport, reports)
+	pcol := pbeam.MakePrivateFromStruct(s, decoded, spec, "DeviceID")
+	return pbeam.ParDo(s, partitionAggregate, pcol)
+}
+
+// decodedReport is a Report whose aggregate was decoded.
+type decodedReport struct {
+	DeviceID  string
+	Partition string
+	Aggregate pbeam.ClientAggregate
+}
+
+func decodeReport(r Report) (decodedReport, error) {
+	agg, err := pbeam.DecodeClientAggregate(r.Aggregate)
+	if err != nil {
+		return decodedReport{}, fmt.Errorf("fedsim: couldn't decode the report of device %q for partition %q: %v", r.DeviceID, r.Partition, err)
+	}
+	return decodedReport{DeviceID: r.DeviceID, Partition: r.Partition, Aggregate: agg}, nil
+}
+
+func partitionAggregate(r decodedReport) (string, pbeam.ClientAggregate) {
+	return r.Partition, r.Aggregate
+}
+
+// ExactStatistics are the statistics of the events of a partition, computed
+// without contribution bounding, dropout or noise.
+type ExactStatistics struct {
+	Devices int64 // Number of distinct devices with events in the partition.
+	Count   int64 // Number of events.
+	Sum     float64
+	Mean    float64
+}
+
+// Exact computes the statistics of all the events of devices in each
+// partition, to measure the error that a design introduces end-to-end.
+func Exact(devices []Device) map[string]ExactStatistics {
+	stats := make(map[string]ExactStatistics)
+	for _, d := range devices {
+		seen := make(map[string]bool)
+		for _, e := range d.Events {
+			st := stats[e.Partition]
+			if !seen[e.Partition] {
+				seen[e.Partition] = true
+				st.Devices++
+			}
+			st.Count++
+			st.Sum += e.Value
+			stats[e.Partition] = st
+		}
+	}
+	for p, st := range stats {
+		st.Mean = st.Sum / float64(st.Count)
+		stats[p] = st
+	}
+	return stats
+}
@@ -0,0 +1,196 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fedsim
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(partitionMean{}))
+	register.Function1x2[partitionMean, string, float64](partitionMeanToKV)
+}
+
+func TestMain(m *testing.M) {
+	ptest.MainWithDefault(m, "direct")
+}
+
+type partitionMean struct {
+	Partition string
+	Mean      float64
+}
+
+func partitionMeanToKV(m partitionMean) (string, float64) {
+	return m.Partition, m.Mean
+}
+
+func TestSimulateDevicesBoundsContributions(t *testing.T) {
+	var events []Event
+	for p := 0; p < 5; p++ {
+		for i := 0; i < 4; i++ {
+			events = append(events, Event{Partition: fmt.Sprintf("p%d", p), Value: 100})
+		}
+	}
+	reports, err := SimulateDevices([]Device{{ID: "device", Events: events}}, ClientParams{
+		MaxPartitionsContributed:     2,
+		MaxContributionsPerPartition: 3,
+		MinValue:                     0,
+		MaxValue:                     10,
+	}, 0)
+	if err != nil {
+		t.Fatalf("SimulateDevices: got error %v", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("SimulateDevices: got %d reports, want 2", len(reports))
+	}
+	if reports[0].Partition == reports[1].Partition {
+		t.Errorf("SimulateDevices: got two reports for partition %q, want distinct partitions", reports[0].Partition)
+	}
+	for _, r := range reports {
+		agg, err := pbeam.DecodeClientAggregate(r.Aggregate)
+		if err != nil {
+			t.Fatalf("DecodeClientAggregate: got error %v", err)
+		}
+		// Each partition keeps 3 events, whose values are clamped to 10.
+		if want := (pbeam.ClientAggregate{Sum: 30, Count: 3}); agg != want {
+			t.Errorf("SimulateDevices: got aggregate %+v for partition %q, want %+v", agg, r.Partition, want)
+		}
+	}
+}
+
+func TestSimulateDevicesIsDeterministic(t *testing.T) {
+	var devices []Device
+	for d := 0; d < 20; d++ {
+		var events []Event
+		for i := 0; i < 10; i++ {
+			events = append(events, Event{Partition: fmt.Sprintf("p%d", i%4), Value: float64(i)})
+		}
+		devices = append(devices, Device{ID: fmt.Sprintf("device%d", d), Events: events})
+	}
+	params := ClientParams{MaxPartitionsContributed: 2, MaxContributionsPerPartition: 1, MinValue: 0, MaxValue: 10, DropoutRate: 0.5}
+	reports1, err := SimulateDevices(devices, params, 42)
+	if err != nil {
+		t.Fatalf("SimulateDevices: got error %v", err)
+	}
+	reports2, err := SimulateDevices(devices, params, 42)
+	if err != nil {
+		t.Fatalf("SimulateDevices: got error %v", err)
+	}
+	if diff := cmp.Diff(reports1, reports2); diff != "" {
+		t.Errorf("SimulateDevices with the same seed: got different reports (-first +second):\n%s", diff)
+	}
+}
+
+func TestSimulateDevicesDropout(t *testing.T) {
+	var devices []Device
+	for d := 0; d < 1000; d++ {
+		devices = append(devices, Device{ID: fmt.Sprintf("device%d", d), Events: []Event{{Partition: "p", Value: 1}}})
+	}
+	reports, err := SimulateDevices(devices, ClientParams{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, MinValue: 0, MaxValue: 1, DropoutRate: 0.5}, 0)
+	if err != nil {
+		t.Fatalf("SimulateDevices: got error %v", err)
+	}
+	// Each device reports with probability 0.5; 400 and 600 are more than 6
+	// standard deviations away from the expected 500 reports.
+	if len(reports) < 400 || len(reports) > 600 {
+		t.Errorf("SimulateDevices with DropoutRate=0.5: got %d reports from 1000 devices, want about 500", len(reports))
+	}
+}
+
+func TestCheckClientParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  ClientParams
+		wantErr bool
+	}{
+		{"valid params", ClientParams{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, MinValue: 0, MaxValue: 1}, false},
+		{"valid params with dropout", ClientParams{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, MinValue: 0, MaxValue: 1, DropoutRate: 0.1}, false},
+		{"no MaxPartitionsContributed", ClientParams{MaxContributionsPerPartition: 1, MinValue: 0, MaxValue: 1}, true},
+		{"no MaxContributionsPerPartition", ClientParams{MaxPartitionsContributed: 1, MinValue: 0, MaxValue: 1}, true},
+		{"MinValue > MaxValue", ClientParams{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, MinValue: 1, MaxValue: 0}, true},
+		{"negative DropoutRate", ClientParams{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, MinValue: 0, MaxValue: 1, DropoutRate: -0.1}, true},
+		{"DropoutRate of 1", ClientParams{MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, MinValue: 0, MaxValue: 1, DropoutRate: 1}, true},
+	} {
+		if err := checkClientParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestExact(t *testing.T) {
+	devices := []Device{
+		{ID: "device0", Events: []Event{{"a", 1}, {"a", 3}, {"b", 10}}},
+		{ID: "device1", Events: []Event{{"a", 5}}},
+	}
+	want := map[string]ExactStatistics{
+		"a": {Devices: 2, Count: 3, Sum: 9, Mean: 3},
+		"b": {Devices: 1, Count: 1, Sum: 10, Mean: 10},
+	}
+	if diff := cmp.Diff(want, Exact(devices)); diff != "" {
+		t.Errorf("Exact: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestServerInputMeans(t *testing.T) {
+	// Each device has 2 events per partition, with values that are within the
+	// client-side bounds, so the means match Exact.
+	var devices []Device
+	for d := 0; d < 10; d++ {
+		devices = append(devices, Device{ID: fmt.Sprintf("device%d", d), Events: []Event{
+			{"a", 1}, {"a", 3}, {"b", float64(d)}, {"b", float64(d)},
+		}})
+	}
+	reports, err := SimulateDevices(devices, ClientParams{MaxPartitionsContributed: 2, MaxContributionsPerPartition: 2, MinValue: 0, MaxValue: 10}, 0)
+	if err != nil {
+		t.Fatalf("SimulateDevices: got error %v", err)
+	}
+	exact := Exact(devices)
+	p, s := beam.NewPipelineWithRoot()
+	spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           pbeam.TestModeWithContributionBounding,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create PrivacySpec: %v", err)
+	}
+	pcol := ServerInput(s, beam.CreateList(s, reports), spec)
+	got := pbeam.MeanPerKeyFromClientAggregates(s, pcol, pbeam.MeanParams{
+		MaxPartitionsContributed:     2,
+		MaxContributionsPerPartition: 2,
+		MinValue:                     0,
+		MaxValue:                     10,
+		PublicPartitions:             []string{"a", "b"},
+	})
+
+	want := beam.ParDo(s, partitionMeanToKV, beam.CreateList(s, []partitionMean{
+		{"a", exact["a"].Mean},
+		{"b", exact["b"].Mean},
+	}))
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-10)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("MeanPerKeyFromClientAggregates on ServerInput: %v", err)
+	}
+}
@@ -75,3 +75,27 @@ func TestCodec_Encode_Decode(t *testing.T) {
 		t.Errorf("Expected (%v, %v) but got (%v, %v) instead.", inputK, inputV, outputK, outputV)
 	}
 }
+
+func TestPairCoder(t *testing.T) {
+	for _, p := range []Pair{
+		{K: []byte{1, 2, 3}, V: []byte{4, 5}},
+		{K: []byte{1}},
+		{V: []byte{1}},
+		{},
+	} {
+		data, err := encodePair(p)
+		if err != nil {
+			t.Fatalf("encodePair(%v): got error %v", p, err)
+		}
+		got, err := decodePair(data)
+		if err != nil {
+			t.Fatalf("decodePair(encodePair(%v)): got error %v", p, err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("decodePair(encodePair(%v)) = %v", p, got)
+		}
+		if _, err := decodePair(data[:len(data)-1]); err == nil {
+			t.Errorf("decodePair with truncated encoding of %v: got no error", p)
+		}
+	}
+}
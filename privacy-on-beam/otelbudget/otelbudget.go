@@ -0,0 +1,136 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package otelbudget exports the privacy budgets of a pbeam.PrivacySpec as
+// OpenTelemetry metrics, so that privacy budget consumption can be monitored
+// like any other production quota.
+//
+// For example, the following reports the budget consumed by a pipeline with
+// the meter provider of the binary running the pipeline:
+//
+//	spec, err := pbeam.NewPrivacySpec(params)
+//	...
+//	reg, err := otelbudget.Register(otel.Meter("my-pipeline"), spec,
+//		attribute.String("pipeline", "daily-visits"))
+//	if err != nil {
+//		return err
+//	}
+//	defer reg.Unregister()
+//	// Construct and run the pipeline.
+//
+// Privacy budget is consumed during pipeline construction, so the metrics
+// describe the parameters of the pipeline and the budget consumed by each of
+// its runs. They don't contain any data processed by the pipeline.
+package otelbudget
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Names of the metrics reported by Register.
+const (
+	TotalEpsilonMetric     = "pbeam.budget.epsilon.total"
+	ConsumedEpsilonMetric  = "pbeam.budget.epsilon.consumed"
+	TotalDeltaMetric       = "pbeam.budget.delta.total"
+	ConsumedDeltaMetric    = "pbeam.budget.delta.consumed"
+	ConsumedFractionMetric = "pbeam.budget.consumed_fraction"
+	InflationMetric        = "pbeam.budget.inflation"
+)
+
+// BudgetAttribute is the attribute identifying the budget of a PrivacySpec
+// that a metric describes: "aggregation" or "partition_selection".
+const BudgetAttribute = attribute.Key("pbeam.budget")
+
+// Register registers gauges with meter that report the privacy budgets of
+// spec each time metrics are collected:
+//   - the total and consumed ε and δ of each budget;
+//   - the consumed fraction of each budget, which is the largest of the
+//     consumed fractions of its ε and δ, as for pbeam.BudgetAlarm;
+//   - the factor by which each budget is inflated to account for retried
+//     bundles, see pbeam.PrivacySpecParams.MaxReleasesPerPartition.
+//
+// Each observation has the BudgetAttribute attribute and attrs, which can be
+// used e.g. to identify the pipeline. Call Unregister on the returned
+// registration to stop reporting metrics.
+func Register(meter metric.Meter, spec *pbeam.PrivacySpec, attrs ...attribute.KeyValue) (metric.Registration, error) {
+	if spec == nil {
+		return nil, fmt.Errorf("otelbudget.Register: spec must be set")
+	}
+	gauges := []struct {
+		name, desc string
+		value      func(pbeam.BudgetUsage) float64
+	}{
+		{TotalEpsilonMetric, "Total ε of the privacy budget.", func(u pbeam.BudgetUsage) float64 { return u.TotalEpsilon }},
+		{ConsumedEpsilonMetric, "ε of the privacy budget consumed by the pipeline.", func(u pbeam.BudgetUsage) float64 { return u.ConsumedEpsilon }},
+		{TotalDeltaMetric, "Total δ of the privacy budget.", func(u pbeam.BudgetUsage) float64 { return u.TotalDelta }},
+		{ConsumedDeltaMetric, "δ of the privacy budget consumed by the pipeline.", func(u pbeam.BudgetUsage) float64 { return u.ConsumedDelta }},
+		{ConsumedFractionMetric, "Fraction of the privacy budget consumed by the pipeline.", consumedFraction},
+		{InflationMetric, "Factor by which the consumed privacy budget is inflated to account for retried bundles.", func(u pbeam.BudgetUsage) float64 { return u.Inflation }},
+	}
+	instruments := make([]metric.Float64ObservableGauge, len(gauges))
+	observables := make([]metric.Observable, len(gauges))
+	for i, g := range gauges {
+		gauge, err := meter.Float64ObservableGauge(g.name, metric.WithDescription(g.desc), metric.WithUnit("1"))
+		if err != nil {
+			return nil, fmt.Errorf("otelbudget.Register: couldn't create gauge %s: %w", g.name, err)
+		}
+		instruments[i] = gauge
+		observables[i] = gauge
+	}
+	reg, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for _, usage := range spec.BudgetUsage() {
+			opt := metric.WithAttributes(append([]attribute.KeyValue{BudgetAttribute.String(budgetName(usage.Budget))}, attrs...)...)
+			for i, g := range gauges {
+				o.ObserveFloat64(instruments[i], g.value(usage), opt)
+			}
+		}
+		return nil
+	}, observables...)
+	if err != nil {
+		return nil, fmt.Errorf("otelbudget.Register: couldn't register callback: %w", err)
+	}
+	return reg, nil
+}
+
+// consumedFraction returns the largest of the consumed fractions of the ε and
+// δ of a budget.
+func consumedFraction(u pbeam.BudgetUsage) float64 {
+	var fraction float64
+	if u.TotalEpsilon > 0 {
+		fraction = u.ConsumedEpsilon / u.TotalEpsilon
+	}
+	if u.TotalDelta > 0 {
+		fraction = math.Max(fraction, u.ConsumedDelta/u.TotalDelta)
+	}
+	return fraction
+}
+
+func budgetName(bt pbeam.BudgetType) string {
+	switch bt {
+	case pbeam.AggregationBudget:
+		return "aggregation"
+	case pbeam.PartitionSelectionBudget:
+		return "partition_selection"
+	default:
+		return fmt.Sprintf("unknown_%d", int(bt))
+	}
+}
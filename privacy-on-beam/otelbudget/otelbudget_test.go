@@ -0,0 +1,121 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package otelbudget
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/embedded"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// fakeMeter records the callback registered with it.
+type fakeMeter struct {
+	noop.Meter
+	callback metric.Callback
+}
+
+type fakeGauge struct {
+	noop.Float64ObservableGauge
+	name string
+}
+
+func (m *fakeMeter) Float64ObservableGauge(name string, _ ...metric.Float64ObservableGaugeOption) (metric.Float64ObservableGauge, error) {
+	return fakeGauge{name: name}, nil
+}
+
+func (m *fakeMeter) RegisterCallback(f metric.Callback, _ ...metric.Observable) (metric.Registration, error) {
+	m.callback = f
+	return noop.Registration{}, nil
+}
+
+// fakeObserver records observations by metric name and attributes.
+type fakeObserver struct {
+	embedded.Observer
+	values map[string]float64
+}
+
+func (o *fakeObserver) ObserveFloat64(obs metric.Float64Observable, v float64, opts ...metric.ObserveOption) {
+	attrs := metric.NewObserveConfig(opts).Attributes()
+	budget, _ := attrs.Value(BudgetAttribute)
+	pipeline, _ := attrs.Value("pipeline")
+	o.values[fmt.Sprintf("%s{%s,%s}", obs.(fakeGauge).name, budget.AsString(), pipeline.AsString())] = v
+}
+
+func (o *fakeObserver) ObserveInt64(metric.Int64Observable, int64, ...metric.ObserveOption) {}
+
+func TestRegister(t *testing.T) {
+	spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create PrivacySpec: %v", err)
+	}
+	meter := &fakeMeter{}
+	if _, err := Register(meter, spec, attribute.String("pipeline", "test")); err != nil {
+		t.Fatalf("Register: got error %v", err)
+	}
+
+	_, s := beam.NewPipelineWithRoot()
+	col := beam.ParDo(s, testutils.PairToKV, beam.CreateList(s, testutils.MakePairsWithFixedV(10, 0)))
+	pbeam.Count(s, pbeam.MakePrivate(s, col, spec), pbeam.CountParams{
+		AggregationEpsilon:       0.5,
+		PartitionSelectionParams: pbeam.PartitionSelectionParams{Epsilon: 0.25, Delta: 1e-6},
+		MaxPartitionsContributed: 1,
+		MaxValue:                 1,
+	})
+
+	o := &fakeObserver{values: map[string]float64{}}
+	if err := meter.callback(context.Background(), o); err != nil {
+		t.Fatalf("callback: got error %v", err)
+	}
+	want := map[string]float64{
+		"pbeam.budget.epsilon.total{aggregation,test}":            1,
+		"pbeam.budget.epsilon.consumed{aggregation,test}":         0.5,
+		"pbeam.budget.delta.total{aggregation,test}":              0,
+		"pbeam.budget.delta.consumed{aggregation,test}":           0,
+		"pbeam.budget.consumed_fraction{aggregation,test}":        0.5,
+		"pbeam.budget.inflation{aggregation,test}":                1,
+		"pbeam.budget.epsilon.total{partition_selection,test}":    1,
+		"pbeam.budget.epsilon.consumed{partition_selection,test}": 0.25,
+		"pbeam.budget.delta.total{partition_selection,test}":      1e-5,
+		"pbeam.budget.delta.consumed{partition_selection,test}":   1e-6,
+		// The consumed fraction is the largest of 0.25 and 1e-6/1e-5.
+		"pbeam.budget.consumed_fraction{partition_selection,test}": 0.25,
+		"pbeam.budget.inflation{partition_selection,test}":         1,
+	}
+	if diff := cmp.Diff(want, o.values, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("Register: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegisterWithoutSpec(t *testing.T) {
+	if _, err := Register(&fakeMeter{}, nil); err == nil {
+		t.Errorf("Register with a nil spec: got no error")
+	}
+}
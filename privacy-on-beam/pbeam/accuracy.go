@@ -0,0 +1,192 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// AccuracyDerivation describes how the AggregationEpsilon of an aggregation
+// was derived from an accuracy target by an accuracy-first entry point, e.g.
+// CountPerKeyWithAccuracy. It is reported in AggregationRegisteredEvent.
+type AccuracyDerivation struct {
+	// Accuracy target and budget cap that AggregationEpsilon was derived from.
+	Bound      ErrorBound
+	MaxEpsilon float64
+	// Noise added by the aggregation, with the derived AggregationEpsilon as
+	// NoiseParams.Epsilon.
+	NoiseParams OutputNoiseParams
+	// Largest distance between a noisy output and the raw output, at the
+	// confidence level of Bound. At most the maximum error of Bound.
+	MaxError float64
+}
+
+// CountWithAccuracyParams specifies the parameters associated with a
+// CountPerKeyWithAccuracy aggregation.
+type CountWithAccuracyParams struct {
+	// Parameters of the count. Count.AggregationEpsilon must be left unset: it
+	// is derived from Bound. Count.AggregationDelta is required with
+	// GaussianNoise.
+	//
+	// Required.
+	Count CountParams
+	// Accuracy target of the noisy counts.
+	//
+	// Required.
+	Bound ErrorBound
+	// Largest ε that can be spent on the noise of the counts. It must be
+	// available in the aggregation budget of the PrivacySpec.
+	//
+	// Required.
+	MaxEpsilon float64
+}
+
+// CountPerKeyWithAccuracy is like Count, but instead of taking the ε used for
+// noising the counts, it uses the minimal ε with which the noisy counts meet
+// params.Bound, as computed by SolveEpsilonForErrorBound. If the bound can't
+// be met with at most params.MaxEpsilon, the aggregation is invalid and no
+// budget is consumed.
+//
+// The derivation of ε is reported in the AggregationRegisteredEvent of the
+// Count. Note that the bound only accounts for the noise, not for contribution
+// bounding or partition selection, and that LongTail and Total partitions are
+// noised with their own budget.
+//
+// CountPerKeyWithAccuracy transforms a PrivatePCollection<V> into a
+// PCollection<V, int64>.
+func CountPerKeyWithAccuracy(s beam.Scope, pcol PrivatePCollection, params CountWithAccuracyParams) beam.PCollection {
+	s = s.Scope("pbeam.CountPerKeyWithAccuracy")
+	pcol = extractTaggedStructFields(s, pcol, false)
+	_, partitionT := beam.ValidateKVType(pcol.col)
+
+	derivation, err := deriveAggregationEpsilon(pcol.privacySpec, params.Count.NoiseKind, params.Count.AggregationEpsilon, params.Count.AggregationDelta,
+		params.Count.MaxPartitionsContributed, float64(params.Count.MaxValue), params.Bound, params.MaxEpsilon)
+	if err != nil {
+		return pcol.privacySpec.invalidAggregation(s, "CountPerKeyWithAccuracy",
+			fmt.Errorf("pbeam.CountPerKeyWithAccuracy: %v", err), partitionT.Type(), reflect.TypeOf(int64(0)))
+	}
+	params.Count.AggregationEpsilon = derivation.NoiseParams.Epsilon
+	return countWithDerivation(s, pcol, params.Count, derivation, nil)
+}
+
+// SumWithAccuracyParams specifies the parameters associated with a
+// SumPerKeyWithAccuracy aggregation.
+type SumWithAccuracyParams struct {
+	// Parameters of the sum. Sum.AggregationEpsilon must be left unset: it is
+	// derived from Bound. Sum.AggregationDelta is required with GaussianNoise.
+	//
+	// Required.
+	Sum SumParams
+	// Accuracy target of the noisy sums.
+	//
+	// Required.
+	Bound ErrorBound
+	// Largest ε that can be spent on the noise of the sums. It must be
+	// available in the aggregation budget of the PrivacySpec.
+	//
+	// Required.
+	MaxEpsilon float64
+}
+
+// SumPerKeyWithAccuracy is like SumPerKey, but instead of taking the ε used
+// for noising the sums, it uses the minimal ε with which the noisy sums meet
+// params.Bound, as computed by SolveEpsilonForErrorBound. If the bound can't be
+// met with at most params.MaxEpsilon, the aggregation is invalid and no budget
+// is consumed.
+//
+// The derivation of ε is reported in the AggregationRegisteredEvent of the
+// SumPerKey. See CountPerKeyWithAccuracy for what the bound accounts for. If
+// Sum.Transform is set, the bound applies to the sums of the transformed
+// values.
+//
+// SumPerKeyWithAccuracy transforms a PrivatePCollection<K,V> like SumPerKey.
+func SumPerKeyWithAccuracy(s beam.Scope, pcol PrivatePCollection, params SumWithAccuracyParams) beam.PCollection {
+	s = s.Scope("pbeam.SumPerKeyWithAccuracy")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	_, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("SumPerKeyWithAccuracy must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("SumPerKeyWithAccuracy: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "SumPerKeyWithAccuracy", fmt.Errorf("pbeam.SumPerKeyWithAccuracy: %v", err),
+			pcol.codec.KType.T, sumOutputType(pcol.codec.VType.T, params.Sum.NormalizeContributions))
+	}
+
+	// Sums are noised with the bounds of the transformed values, if any.
+	lower, upper := params.Sum.MinValue, params.Sum.MaxValue
+	if params.Sum.Transform != nil {
+		var err error
+		lower, upper, err = transformBounds(params.Sum.Transform, lower, upper)
+		if err != nil {
+			return invalid(err)
+		}
+	}
+	derivation, err := deriveAggregationEpsilon(pcol.privacySpec, params.Sum.NoiseKind, params.Sum.AggregationEpsilon, params.Sum.AggregationDelta,
+		params.Sum.MaxPartitionsContributed, math.Max(math.Abs(lower), math.Abs(upper)), params.Bound, params.MaxEpsilon)
+	if err != nil {
+		return invalid(err)
+	}
+	params.Sum.AggregationEpsilon = derivation.NoiseParams.Epsilon
+	return sumPerKeyWithDerivation(s, pcol, params.Sum, derivation)
+}
+
+// deriveAggregationEpsilon returns the minimal AggregationEpsilon with which the
+// outputs of an aggregation with the given noise parameters meet bound, in
+// the derivation of that ε. It returns an error if the bound can't be met with
+// at most maxEpsilon.
+func deriveAggregationEpsilon(spec *PrivacySpec, noiseKind NoiseKind, aggregationEpsilon, aggregationDelta float64, maxPartitionsContributed int64, maxContribution float64, bound ErrorBound, maxEpsilon float64) (*AccuracyDerivation, error) {
+	if aggregationEpsilon != 0 {
+		return nil, fmt.Errorf("AggregationEpsilon must be left unset, it is derived from Bound, was %f instead", aggregationEpsilon)
+	}
+	if noiseKind == nil {
+		noiseKind = spec.noiseKind
+	}
+	if noiseKind == nil {
+		noiseKind = LaplaceNoise{}
+	}
+	noiseParams := OutputNoiseParams{
+		NoiseKind:                noiseKind,
+		Delta:                    aggregationDelta,
+		MaxPartitionsContributed: maxPartitionsContributed,
+		MaxContribution:          maxContribution,
+	}
+	solution, err := SolveEpsilonForErrorBound(ErrorBoundParams{NoiseParams: noiseParams, Bound: bound, MaxEpsilon: maxEpsilon})
+	if err != nil {
+		return nil, err
+	}
+	if !solution.Feasible {
+		wantMaxError, _ := bound.maxError()
+		return nil, fmt.Errorf("Bound can't be met with at most MaxEpsilon=%g: the maximum error with MaxEpsilon is %g, want at most %g", maxEpsilon, solution.MaxError, wantMaxError)
+	}
+	noiseParams.Epsilon = solution.Epsilon
+	log.Infof("derived AggregationEpsilon=%g (MaxEpsilon=%g) for a maximum error of %g from the error bound %+v", solution.Epsilon, maxEpsilon, solution.MaxError, bound)
+	return &AccuracyDerivation{
+		Bound:       bound,
+		MaxEpsilon:  maxEpsilon,
+		NoiseParams: noiseParams,
+		MaxError:    solution.MaxError,
+	}, nil
+}
@@ -0,0 +1,171 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// Checks that CountPerKeyWithAccuracy counts with the ε derived from the
+// error bound, and reports its derivation.
+func TestCountPerKeyWithAccuracy(t *testing.T) {
+	var events []AggregationRegisteredEvent
+	p, s, col, want := ptest.CreateList2(testutils.MakePairsWithFixedV(10, 0), []testutils.PairII64{{0, 10}})
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:      1,
+		TestMode:                TestModeWithoutContributionBounding,
+		OnAggregationRegistered: func(e AggregationRegisteredEvent) { events = append(events, e) },
+	}))
+	bound := AbsoluteErrorBound{MaxError: 10}
+	got := CountPerKeyWithAccuracy(s, pcol, CountWithAccuracyParams{
+		Count: CountParams{
+			MaxPartitionsContributed: 1,
+			MaxValue:                 1,
+			PublicPartitions:         []int{0},
+		},
+		Bound:      bound,
+		MaxEpsilon: 1,
+	})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("CountPerKeyWithAccuracy did not return the expected counts: %v", err)
+	}
+
+	// With Laplace noise, the half-width of the 95% confidence interval is
+	// l0·lInf·ln(20)/ε.
+	epsilon := math.Log(20) / 10
+	wantEvents := []AggregationRegisteredEvent{{
+		Aggregation:        "Count",
+		AggregationEpsilon: epsilon,
+		Accuracy: &AccuracyDerivation{
+			Bound:      bound,
+			MaxEpsilon: 1,
+			NoiseParams: OutputNoiseParams{
+				NoiseKind:                LaplaceNoise{},
+				Epsilon:                  epsilon,
+				MaxPartitionsContributed: 1,
+				MaxContribution:          1,
+			},
+			MaxError: 10,
+		},
+	}}
+	if diff := cmp.Diff(wantEvents, events, cmpopts.EquateApprox(1e-9, 0)); diff != "" {
+		t.Errorf("CountPerKeyWithAccuracy: got events diff (-want +got):\n%s", diff)
+	}
+}
+
+// Checks that SumPerKeyWithAccuracy derives ε from the largest absolute value
+// of the bounds of the sums.
+func TestSumPerKeyWithAccuracy(t *testing.T) {
+	var events []AggregationRegisteredEvent
+	_, s, col := ptest.CreateList([]testutils.TripleWithIntValue{{ID: 0, Partition: 0, Value: 1}})
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:      1,
+		OnAggregationRegistered: func(e AggregationRegisteredEvent) { events = append(events, e) },
+	}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	SumPerKeyWithAccuracy(s, pcol, SumWithAccuracyParams{
+		Sum: SumParams{
+			MaxPartitionsContributed: 2,
+			MinValue:                 -5,
+			MaxValue:                 2,
+			PublicPartitions:         []int{0},
+		},
+		Bound:      RelativeErrorBound{MaxRelativeError: 0.1, ExpectedValue: 1000},
+		MaxEpsilon: 1,
+	})
+
+	wantEpsilon := 2 * 5 * math.Log(20) / 100
+	if len(events) != 1 || events[0].Aggregation != "SumPerKey" || events[0].Accuracy == nil {
+		t.Fatalf("SumPerKeyWithAccuracy: got events %+v, want a single SumPerKey event with an AccuracyDerivation", events)
+	}
+	if got := events[0].AggregationEpsilon; !cmp.Equal(got, wantEpsilon, cmpopts.EquateApprox(1e-9, 0)) {
+		t.Errorf("SumPerKeyWithAccuracy: got AggregationEpsilon=%g, want %g", got, wantEpsilon)
+	}
+	if got := events[0].Accuracy.NoiseParams.MaxContribution; got != 5 {
+		t.Errorf("SumPerKeyWithAccuracy: got MaxContribution=%g, want 5", got)
+	}
+}
+
+// Checks that CountPerKeyWithAccuracy is invalid, and doesn't consume any
+// budget, if ε can't be derived.
+func TestCountPerKeyWithAccuracyInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		params CountWithAccuracyParams
+	}{
+		{
+			desc: "AggregationEpsilon set",
+			params: CountWithAccuracyParams{
+				Count:      CountParams{AggregationEpsilon: 0.5, MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: []int{0}},
+				Bound:      AbsoluteErrorBound{MaxError: 10},
+				MaxEpsilon: 1,
+			},
+		},
+		{
+			desc: "no bound",
+			params: CountWithAccuracyParams{
+				Count:      CountParams{MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: []int{0}},
+				MaxEpsilon: 1,
+			},
+		},
+		{
+			desc: "no MaxEpsilon",
+			params: CountWithAccuracyParams{
+				Count: CountParams{MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: []int{0}},
+				Bound: AbsoluteErrorBound{MaxError: 10},
+			},
+		},
+		{
+			desc: "infeasible bound",
+			params: CountWithAccuracyParams{
+				Count:      CountParams{MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: []int{0}},
+				Bound:      AbsoluteErrorBound{MaxError: 1},
+				MaxEpsilon: 1,
+			},
+		},
+		{
+			desc: "Gaussian noise without AggregationDelta",
+			params: CountWithAccuracyParams{
+				Count:      CountParams{NoiseKind: GaussianNoise{}, MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: []int{0}},
+				Bound:      AbsoluteErrorBound{MaxError: 10},
+				MaxEpsilon: 1,
+			},
+		},
+	} {
+		_, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+		col = beam.ParDo(s, testutils.PairToKV, col)
+		spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+		CountPerKeyWithAccuracy(s, MakePrivate(s, col, spec), tc.params)
+		if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "CountPerKeyWithAccuracy" {
+			t.Errorf("With %s, ValidationErrors() = %v, want a single error for CountPerKeyWithAccuracy", tc.desc, errs)
+		}
+		if consumed := spec.BudgetUsage()[0].ConsumedEpsilon; consumed != 0 {
+			t.Errorf("With %s, consumed epsilon=%f of the aggregation budget, want 0", tc.desc, consumed)
+		}
+	}
+}
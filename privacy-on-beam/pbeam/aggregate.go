@@ -0,0 +1,594 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(AggregateResult{}))
+	register.Combiner3[aggregateAccum, []float64, *AggregateResult](&aggregateFn{})
+	register.Function3x0[beam.V, *AggregateResult, func(beam.V, AggregateResult)](dropThresholdedPartitionsAggregate)
+	register.Emitter2[beam.V, AggregateResult]()
+	register.Function2x2[beam.W, *AggregateResult, beam.W, AggregateResult](dereferenceValueAggregate)
+}
+
+// AggregateParams specifies the parameters associated with an Aggregate
+// aggregation.
+type AggregateParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	//
+	// The budget is split evenly between the count, the sum and, if Ranks is
+	// set, the quantiles. The mean is derived from the noisy count and sum, so
+	// it doesn't consume budget of its own.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation. Partition selection is done once for all statistics, so
+	// they are all output for the same partitions.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. See MeanParams.PublicPartitions for details.
+	//
+	// PublicPartitions needs to be a beam.PCollection, slice, or array. The
+	// underlying type needs to match the partition type of the PrivatePCollection.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct values that a given privacy identifier
+	// can influence. A larger MaxPartitionsContributed leads to less data loss
+	// due to contribution bounding, but to more noise in each statistic.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of contributions from a given privacy identifier
+	// for each key. A larger MaxContributionsPerPartition leads to less data
+	// loss due to contribution bounding, but to more noise in each statistic.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Contributions are clamped to [MinValue, MaxValue] before the sum, the
+	// mean and the quantiles are computed.
+	//
+	// Required.
+	MinValue, MaxValue float64
+	// Percentile ranks of the quantiles to compute, see QuantilesParams.Ranks.
+	//
+	// Optional; if not set, no quantiles are computed.
+	Ranks []float64
+}
+
+// AggregateResult contains the statistics output by AggregatePerKey for a
+// partition.
+type AggregateResult struct {
+	// Count is the differentially private number of values.
+	Count int64
+	// Sum is the differentially private sum of the clamped values. Like Mean,
+	// it is derived from Count and a noisy sum of the values.
+	Sum float64
+	// Mean is the differentially private mean of the clamped values, within
+	// [MinValue, MaxValue].
+	Mean float64
+	// Quantiles are the differentially private quantiles of the ranks in
+	// AggregateParams.Ranks, in the same order.
+	Quantiles []float64
+}
+
+// AggregatePerKey computes the count, sum, mean and, optionally, quantiles of
+// the values associated with each key in a PrivatePCollection<K,V>, adding
+// differentially private noise to the statistics and doing pre-aggregation
+// thresholding to remove partitions with a low number of distinct privacy
+// identifiers.
+//
+// Compared to calling CountPerKey, SumPerKey, MeanPerKey and QuantilesPerKey
+// separately, AggregatePerKey bounds contributions and selects partitions
+// once for all statistics. This avoids repeated shuffles, and the statistics
+// are output for a consistent set of partitions.
+//
+// It is also possible to manually specify the list of partitions
+// present in the output, in which case the partition selection/thresholding
+// step is skipped.
+//
+// AggregatePerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,AggregateResult>.
+//
+// Note: Do not use when your results may cause overflows for float64 values.
+// This aggregation is not hardened for such applications yet.
+func AggregatePerKey(s beam.Scope, pcol PrivatePCollection, params AggregateParams) beam.PCollection {
+	s = s.Scope("pbeam.AggregatePerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("AggregatePerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("AggregatePerKey: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "AggregatePerKey", err, pcol.codec.KType.T, reflect.TypeOf(AggregateResult{}))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("AggregatePerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.AggregatePerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("AggregatePerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.AggregatePerKey: %v", err))
+	}
+
+	err = checkAggregatePerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.AggregatePerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("AggregatePerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for AggregatePerKey: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},V>
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+
+	// Convert value to float64.
+	// Result is PCollection<kv.Pair{ID,K},float64>.
+	_, valueT := beam.ValidateKVType(decoded)
+	if err := checkNumericType(valueT); err != nil {
+		log.Fatalf("AggregatePerKey: %v", err)
+	}
+	converted := convertValues(s, spec, reflect.Float64, decoded)
+
+	// Combine all values for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition values unless in test mode without contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>.
+	combined := beam.CombinePerKey(s, newExpandFloat64ValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)), converted)
+	combined = traceStage(s, *spec, "AggregatePerKey.boundContributionsPerPartition", combined)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "AggregatePerKey.boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		return addPublicPartitionsForAggregate(s, *spec, params, noiseKind, partialKV)
+	}
+	// Compute the statistics for each partition. Result is PCollection<partition, *AggregateResult>.
+	fn, err := newAggregateFn(*spec, params, noiseKind, false, false)
+	if err != nil {
+		log.Fatalf("Couldn't get aggregateFn for AggregatePerKey: %v", err)
+	}
+	results := beam.CombinePerKey(s, fn, partialKV)
+	results = traceStage(s, *spec, "AggregatePerKey.aggregate", results)
+	reportNoiseDraws(s, results)
+	// Finally, drop thresholded partitions.
+	return beam.ParDo(s, dropThresholdedPartitionsAggregate, results)
+}
+
+func addPublicPartitionsForAggregate(s beam.Scope, spec PrivacySpec, params AggregateParams, noiseKind noise.Kind, partialKV beam.PCollection) beam.PCollection {
+	// Calculate statistics with empty public partitions added. Result is PCollection<partition, *AggregateResult>.
+	// First, add empty slice to all public partitions.
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	// Second, add noise to all public partitions (all of which are empty-valued).
+	fn, err := newAggregateFn(spec, params, noiseKind, true, true)
+	if err != nil {
+		log.Fatalf("Couldn't get aggregateFn for AggregatePerKey: %v", err)
+	}
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	// Third, compute noisy statistics for partitions in the actual data.
+	fn, err = newAggregateFn(spec, params, noiseKind, true, false)
+	if err != nil {
+		log.Fatalf("Couldn't get aggregateFn for AggregatePerKey: %v", err)
+	}
+	results := beam.CombinePerKey(s, fn, partialKV)
+	results = traceStage(s, spec, "AggregatePerKey.aggregate", results)
+	reportNoiseDraws(s, results)
+	// Fourth, co-group the noisy statistics with the noisy empty public
+	// partitions, and emit the noisy empty value for public partitions not found
+	// in the data.
+	results = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, results, noisyEmptyPublicPartitions))
+	// Fifth, dereference *AggregateResult results and return.
+	return beam.ParDo(s, dereferenceValueAggregate, results)
+}
+
+func checkAggregatePerKeyParams(params AggregateParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsFloat64(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsNotEqual(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	for i, rank := range params.Ranks {
+		if rank < 0.0 || rank > 1.0 {
+			return fmt.Errorf("Ranks[%d]=%f must be >= 0 and <= 1", i, rank)
+		}
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+// dropThresholdedPartitionsAggregate drops thresholded AggregateResult
+// partitions, i.e. those that have nil r, by emitting only non-thresholded
+// partitions.
+func dropThresholdedPartitionsAggregate(v beam.V, r *AggregateResult, emit func(beam.V, AggregateResult)) {
+	if r != nil {
+		emit(v, *r)
+	}
+}
+
+func dereferenceValueAggregate(key beam.W, value *AggregateResult) (k beam.W, v AggregateResult) {
+	return key, *value
+}
+
+type aggregateAccum struct {
+	Count *dpagg.Count
+	// Sum of the differences between the clamped values and the midpoint of
+	// [MinValue, MaxValue], like in dpagg.BoundedMean.
+	NormalizedSum    *dpagg.BoundedSumFloat64
+	BQ               *dpagg.BoundedQuantiles // nil if no quantiles are computed.
+	SP               *dpagg.PreAggSelectPartition
+	PublicPartitions bool
+}
+
+// aggregateFn is a differentially private combineFn for computing the count,
+// sum, mean and quantiles of values. Do not initialize it yourself, use
+// newAggregateFn to create an aggregateFn instance.
+type aggregateFn struct {
+	// Privacy spec parameters (set during initial construction).
+	NoiseEpsilon                 float64
+	PartitionSelectionEpsilon    float64
+	NoiseDelta                   float64
+	PartitionSelectionDelta      float64
+	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	Lower                        float64
+	Upper                        float64
+	Ranks                        []float64
+	NoiseKind                    noise.Kind
+	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
+	PublicPartitions             bool        // Set to true if public partitions are used.
+	TestMode                     TestMode
+	EmptyPartitions              bool // Set to true if this combineFn is for adding noise to empty public partitions.
+}
+
+// newAggregateFn returns an aggregateFn with the given budget and parameters.
+func newAggregateFn(spec PrivacySpec, params AggregateParams, noiseKind noise.Kind, publicPartitions bool, emptyPartitions bool) (*aggregateFn, error) {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
+		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	return &aggregateFn{
+		NoiseEpsilon:                 params.AggregationEpsilon,
+		NoiseDelta:                   params.AggregationDelta,
+		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
+		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		Lower:                        params.MinValue,
+		Upper:                        params.MaxValue,
+		Ranks:                        params.Ranks,
+		NoiseKind:                    noiseKind,
+		PublicPartitions:             publicPartitions,
+		TestMode:                     spec.testMode,
+		EmptyPartitions:              emptyPartitions,
+	}, nil
+}
+
+func (fn *aggregateFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+// bounds returns the bounds to which values are clamped for the count, sum and
+// mean. They are not clamped in test mode without contribution bounding.
+func (fn *aggregateFn) bounds() (lower, upper float64) {
+	if fn.TestMode == TestModeWithoutContributionBounding && !fn.EmptyPartitions {
+		return math.Inf(-1), math.Inf(1)
+	}
+	return fn.Lower, fn.Upper
+}
+
+// midPoint returns the midpoint of the bounds, which values are normalized
+// with before being summed.
+func (fn *aggregateFn) midPoint() float64 {
+	lower, upper := fn.bounds()
+	if math.IsInf(lower, 0) || math.IsInf(upper, 0) {
+		return 0
+	}
+	return lower + (upper-lower)/2
+}
+
+func (fn *aggregateFn) CreateAccumulator() (aggregateAccum, error) {
+	// The budget is split evenly between the count, the normalized sum and
+	// the quantiles.
+	parts := 2.0
+	if len(fn.Ranks) > 0 {
+		parts = 3
+	}
+	eps, del := fn.NoiseEpsilon/parts, fn.NoiseDelta/parts
+	maxIncrement := fn.MaxContributionsPerPartition
+	if fn.TestMode == TestModeWithoutContributionBounding {
+		maxIncrement = 0
+	}
+	count, err := dpagg.NewCount(&dpagg.CountOptions{
+		Epsilon:                  eps,
+		Delta:                    del,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		Noise:                    fn.noise,
+		MaxIncrement:             maxIncrement,
+	})
+	if err != nil {
+		return aggregateAccum{}, err
+	}
+	// The normalized values of a privacy identifier are summed before being
+	// added, so the normalized sum is bounded for MaxContributionsPerPartition
+	// values.
+	_, upper := fn.bounds()
+	maxNormalizedSum := float64(fn.MaxContributionsPerPartition) * (upper - fn.midPoint())
+	normalizedSum, err := dpagg.NewBoundedSumFloat64(&dpagg.BoundedSumFloat64Options{
+		Epsilon:                  eps,
+		Delta:                    del,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		Lower:                    -maxNormalizedSum,
+		Upper:                    maxNormalizedSum,
+		Noise:                    fn.noise,
+	})
+	if err != nil {
+		return aggregateAccum{}, err
+	}
+	accum := aggregateAccum{Count: count, NormalizedSum: normalizedSum, PublicPartitions: fn.PublicPartitions}
+	if len(fn.Ranks) > 0 {
+		// Like in QuantilesPerKey, values are always clamped for the quantiles.
+		accum.BQ, err = dpagg.NewBoundedQuantiles(&dpagg.BoundedQuantilesOptions{
+			Epsilon:                      eps,
+			Delta:                        del,
+			MaxPartitionsContributed:     fn.MaxPartitionsContributed,
+			MaxContributionsPerPartition: fn.MaxContributionsPerPartition,
+			Lower:                        fn.Lower,
+			Upper:                        fn.Upper,
+			Noise:                        fn.noise,
+		})
+		if err != nil {
+			return aggregateAccum{}, err
+		}
+	}
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *aggregateFn) AddInput(a aggregateAccum, values []float64) (aggregateAccum, error) {
+	// The values of a privacy identifier are counted with a single call to
+	// IncrementBy, and the privacy identifier is counted once for partition
+	// selection.
+	if err := a.Count.IncrementBy(int64(len(values))); err != nil {
+		return a, err
+	}
+	lower, upper := fn.bounds()
+	midPoint := fn.midPoint()
+	var normalizedSum float64
+	for _, v := range values {
+		// NaN values are ignored like in dpagg.BoundedSumFloat64.
+		if !math.IsNaN(v) {
+			normalizedSum += math.Min(math.Max(v, lower), upper) - midPoint
+		}
+		if a.BQ != nil {
+			if err := a.BQ.Add(v); err != nil {
+				return a, err
+			}
+		}
+	}
+	if err := a.NormalizedSum.Add(normalizedSum); err != nil {
+		return a, err
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *aggregateFn) MergeAccumulators(a, b aggregateAccum) (aggregateAccum, error) {
+	if err := a.Count.Merge(b.Count); err != nil {
+		return a, err
+	}
+	if err := a.NormalizedSum.Merge(b.NormalizedSum); err != nil {
+		return a, err
+	}
+	if a.BQ != nil {
+		if err := a.BQ.Merge(b.BQ); err != nil {
+			return a, err
+		}
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+func (fn *aggregateFn) ExtractOutput(a aggregateAccum) (*AggregateResult, error) {
+	if fn.TestMode.isEnabled() {
+		a.Count.Noise = noNoise{}
+		a.NormalizedSum.Noise = noNoise{}
+		if a.BQ != nil {
+			a.BQ.Noise = noNoise{}
+		}
+	}
+	a.Count.Noise = auditNoise(a.Count.Noise, "Aggregate")
+	a.NormalizedSum.Noise = auditNoise(a.NormalizedSum.Noise, "Aggregate")
+	if a.BQ != nil {
+		a.BQ.Noise = auditNoise(a.BQ.Noise, "Aggregate")
+	}
+	if !fn.TestMode.isEnabled() && !a.PublicPartitions {
+		keep, err := fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !keep {
+			return nil, err
+		}
+	}
+	count, err := a.Count.Result()
+	if err != nil {
+		return nil, err
+	}
+	normalizedSum, err := a.NormalizedSum.Result()
+	if err != nil {
+		return nil, err
+	}
+	// The sum and the mean are post-processed from the noisy count and
+	// normalized sum, like in dpagg.BoundedMean.
+	midPoint := fn.midPoint()
+	lower, upper := fn.bounds()
+	mean, err := dpagg.ClampFloat64(normalizedSum/math.Max(1, float64(count))+midPoint, lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	result := &AggregateResult{
+		Count: count,
+		Sum:   normalizedSum + float64(count)*midPoint,
+		Mean:  mean,
+	}
+	if a.BQ != nil {
+		result.Quantiles = make([]float64, len(fn.Ranks))
+		for i, rank := range fn.Ranks {
+			result.Quantiles[i], err = a.BQ.Result(rank)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (fn *aggregateFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *aggregateFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
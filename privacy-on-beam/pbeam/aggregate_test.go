@@ -0,0 +1,249 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, AggregateResult, string](formatAggregateResultFn)
+}
+
+// formatAggregateResultFn formats an AggregateResult, rounding the quantiles
+// which are slightly noisy even without noise.
+func formatAggregateResultFn(partition int, r AggregateResult) string {
+	quantiles := make([]string, len(r.Quantiles))
+	for i, q := range r.Quantiles {
+		quantiles[i] = fmt.Sprintf("%.1f", q)
+	}
+	return fmt.Sprintf("%d: count=%d, sum=%.1f, mean=%.1f, quantiles=%v", partition, r.Count, r.Sum, r.Mean, quantiles)
+}
+
+func TestAggregatePerKeyNoNoise(t *testing.T) {
+	// Partition 0 has 100 values equal to 1 and 100 values equal to 3.
+	// Partition 1 has 50 values equal to 2.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, 1),
+		testutils.MakeTripleWithFloatValueStartingFromKey(100, 100, 0, 3),
+		testutils.MakeTripleWithFloatValueStartingFromKey(200, 50, 1, 2))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := AggregatePerKey(s, pcol, AggregateParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     4,
+		Ranks:                        []float64{0.5},
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatAggregateResultFn, got),
+		"0: count=200, sum=400.0, mean=2.0, quantiles=[2.0]",
+		"1: count=50, sum=100.0, mean=2.0, quantiles=[2.0]")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestAggregatePerKeyNoNoise: AggregatePerKey(%v) = %v, error %v", col, got, err)
+	}
+}
+
+func TestAggregatePerKeyClampsValues(t *testing.T) {
+	// Values are clamped to 0 and 4.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, -10),
+		testutils.MakeTripleWithFloatValueStartingFromKey(100, 300, 0, 10))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := AggregatePerKey(s, pcol, AggregateParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     4,
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatAggregateResultFn, got),
+		"0: count=400, sum=1200.0, mean=3.0, quantiles=[]")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestAggregatePerKeyClampsValues: AggregatePerKey(%v) = %v, error %v", col, got, err)
+	}
+}
+
+func TestAggregatePerKeyWithPartitionsNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		inMemory bool
+	}{
+		{"public partitions as a PCollection", false},
+		{"in-memory public partitions", true},
+	} {
+		// Partition 1 is not public, and public partition 2 is empty.
+		triples := testutils.ConcatenateTriplesWithFloatValue(
+			testutils.MakeTripleWithFloatValue(100, 0, 1),
+			testutils.MakeTripleWithFloatValueStartingFromKey(100, 50, 1, 2))
+		publicPartitionsSlice := []int{0, 2}
+		p, s, col := ptest.CreateList(triples)
+		col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+		var publicPartitions any
+		if tc.inMemory {
+			publicPartitions = publicPartitionsSlice
+		} else {
+			publicPartitions = beam.CreateList(s, publicPartitionsSlice)
+		}
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           TestModeWithContributionBounding,
+			}))
+		pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+		got := AggregatePerKey(s, pcol, AggregateParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinValue:                     0,
+			MaxValue:                     4,
+			PublicPartitions:             publicPartitions,
+		})
+
+		passert.Equals(s, beam.ParDo(s, formatAggregateResultFn, got),
+			"0: count=100, sum=100.0, mean=1.0, quantiles=[]",
+			"2: count=0, sum=0.0, mean=2.0, quantiles=[]")
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestAggregatePerKeyWithPartitionsNoNoise with %s: AggregatePerKey(%v) = %v, error %v", tc.desc, col, got, err)
+		}
+	}
+}
+
+func TestCheckAggregatePerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		params        AggregateParams
+		noiseKind     noise.Kind
+		partitionType reflect.Type
+		wantErr       bool
+	}{
+		{
+			desc: "valid parameters",
+			params: AggregateParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+				Ranks:                        []float64{0.5},
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc: "valid parameters with public partitions",
+			params: AggregateParams{
+				AggregationEpsilon:           1.0,
+				PublicPartitions:             []int{0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: reflect.TypeOf(0),
+			wantErr:       false,
+		},
+		{
+			desc: "negative aggregationEpsilon",
+			params: AggregateParams{
+				AggregationEpsilon:           -1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "rank out of bounds",
+			params: AggregateParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+				Ranks:                        []float64{1.5},
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "MaxValue equal to MinValue",
+			params: AggregateParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxContributionsPerPartition",
+			params: AggregateParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+				MinValue:                 -5.0,
+				MaxValue:                 5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkAggregatePerKeyParams(tc.params, tc.noiseKind, tc.partitionType); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -20,6 +20,7 @@ package pbeam
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"math/rand"
@@ -45,7 +46,8 @@ func init() {
 	register.DoFn1x3[pairFloat64, beam.W, float64, error](&decodePairFloat64Fn{})
 	register.DoFn2x3[beam.U, kv.Pair, beam.U, beam.W, error](&dropValuesFn{})
 	register.DoFn2x3[kv.Pair, []byte, beam.W, kv.Pair, error](&encodeKVFn{})
-	register.DoFn2x3[beam.W, kv.Pair, kv.Pair, beam.V, error](&encodeIDKFn{})
+	register.DoFn5x1[context.Context, beam.W, kv.Pair, func(kv.Pair, beam.V), func(DeadLetter), error](&encodeIDKFn{})
+	register.Emitter2[kv.Pair, beam.V]()
 	register.DoFn2x3[kv.Pair, beam.V, beam.W, kv.Pair, error](&decodeIDKFn{})
 	register.DoFn1x3[pairArrayFloat64, beam.W, []float64, error](&decodePairArrayFloat64Fn{})
 
@@ -55,8 +57,6 @@ func init() {
 	register.Function2x2[kv.Pair, int64, []byte, pairInt64](rekeyInt64)
 	register.Function2x2[kv.Pair, float64, []byte, pairFloat64](rekeyFloat64)
 	register.Function2x2[kv.Pair, []float64, []byte, pairArrayFloat64](rekeyArrayFloat64)
-	register.Function2x2[beam.W, int64, beam.W, int64](clampNegativePartitionsInt64)
-	register.Function2x2[beam.W, float64, beam.W, float64](clampNegativePartitionsFloat64)
 	register.Function3x0[beam.V, *int64, func(beam.V, int64)](dropThresholdedPartitionsInt64)
 	register.Emitter2[beam.V, int64]()
 	register.Function3x0[beam.V, *float64, func(beam.V, float64)](dropThresholdedPartitionsFloat64)
@@ -65,8 +65,6 @@ func init() {
 	register.Emitter2[beam.V, []float64]()
 	register.Function2x2[beam.W, *int64, beam.W, int64](dereferenceValueInt64)
 	register.Function2x2[beam.W, *float64, beam.W, float64](dereferenceValueFloat64)
-	register.Function2x3[kv.Pair, beam.V, kv.Pair, int64, error](convertToInt64Fn)
-	register.Function2x3[kv.Pair, beam.V, kv.Pair, float64, error](convertToFloat64Fn)
 }
 
 // randBool returns a uniformly random boolean. The randomness used here is not
@@ -114,6 +112,16 @@ func boundContributions(s beam.Scope, kvCol beam.PCollection, contributionLimit
 	return beam.ParDo(s, flattenValues, sampled)
 }
 
+// maxContributionsPerPartition returns the per-partition contribution bound to
+// apply while collecting the values of each privacy ID and partition: 0, i.e.
+// no bound, in test mode without contribution bounding.
+func maxContributionsPerPartition(spec PrivacySpec, limit int64) int64 {
+	if spec.testMode == TestModeWithoutContributionBounding {
+		return 0
+	}
+	return limit
+}
+
 // Given a PCollection<K,[]V>, flattens the second argument to return a PCollection<K,V>.
 func flattenValues(key beam.W, values []beam.V, emit func(beam.W, beam.V)) {
 	for _, v := range values {
@@ -287,6 +295,7 @@ type boundedSumInt64Fn struct {
 	NoiseDelta                float64
 	PartitionSelectionDelta   float64
 	PreThreshold              int64
+	PartitionSelector         *encodedPartitionSelector
 	MaxPartitionsContributed  int64
 	Lower                     int64
 	Upper                     int64
@@ -294,11 +303,12 @@ type boundedSumInt64Fn struct {
 	noise                     noise.Noise // Set during Setup phase according to NoiseKind.
 	PublicPartitions          bool
 	TestMode                  TestMode
+	DeferNoise                bool // If set, sums are output without noise, which is added by addSeededNoise.
 }
 
 // newBoundedSumInt64Fn returns a boundedSumInt64Fn with the given budget and parameters.
 func newBoundedSumInt64Fn(spec PrivacySpec, params SumParams, noiseKind noise.Kind, publicPartitions bool) (*boundedSumInt64Fn, error) {
-	if noiseKind != noise.GaussianNoise && noiseKind != noise.LaplaceNoise {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
 		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
 	}
 	return &boundedSumInt64Fn{
@@ -307,18 +317,20 @@ func newBoundedSumInt64Fn(spec PrivacySpec, params SumParams, noiseKind noise.Ki
 		PartitionSelectionEpsilon: params.PartitionSelectionParams.Epsilon,
 		PartitionSelectionDelta:   params.PartitionSelectionParams.Delta,
 		PreThreshold:              spec.preThreshold,
+		PartitionSelector:         spec.partitionSelector,
 		MaxPartitionsContributed:  params.MaxPartitionsContributed,
 		Lower:                     int64(params.MinValue),
 		Upper:                     int64(params.MaxValue),
 		NoiseKind:                 noiseKind,
 		PublicPartitions:          publicPartitions,
 		TestMode:                  spec.testMode,
+		DeferNoise:                spec.seedsNoise(),
 	}, nil
 }
 
 func (fn *boundedSumInt64Fn) Setup() {
 	fn.noise = noise.ToNoise(fn.NoiseKind)
-	if fn.TestMode.isEnabled() {
+	if fn.TestMode.isEnabled() || fn.DeferNoise {
 		fn.noise = noNoise{}
 	}
 }
@@ -382,13 +394,14 @@ func (fn *boundedSumInt64Fn) MergeAccumulators(a, b boundedSumAccumInt64) (bound
 }
 
 func (fn *boundedSumInt64Fn) ExtractOutput(a boundedSumAccumInt64) (*int64, error) {
-	if fn.TestMode.isEnabled() {
+	if fn.TestMode.isEnabled() || fn.DeferNoise {
 		a.BS.Noise = noNoise{}
 	}
+	a.BS.Noise = auditNoise(a.BS.Noise, "BoundedSumInt64")
 	var err error
 	shouldKeepPartition := fn.TestMode.isEnabled() || a.PublicPartitions // If in test mode or public partitions are specified, we always keep the partition.
 	if !shouldKeepPartition {                                            // If not, we need to perform private partition selection.
-		shouldKeepPartition, err = a.SP.ShouldKeepPartition()
+		shouldKeepPartition, err = fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
 		if err != nil {
 			return nil, err
 		}
@@ -405,6 +418,15 @@ func (fn *boundedSumInt64Fn) String() string {
 	return fmt.Sprintf("%#v", fn)
 }
 
+func (fn *boundedSumInt64Fn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
+
 type boundedSumAccumFloat64 struct {
 	BS               *dpagg.BoundedSumFloat64
 	SP               *dpagg.PreAggSelectPartition
@@ -420,6 +442,7 @@ type boundedSumFloat64Fn struct {
 	NoiseDelta                float64
 	PartitionSelectionDelta   float64
 	PreThreshold              int64
+	PartitionSelector         *encodedPartitionSelector
 	MaxPartitionsContributed  int64
 	Lower                     float64
 	Upper                     float64
@@ -428,11 +451,12 @@ type boundedSumFloat64Fn struct {
 	noise            noise.Noise
 	PublicPartitions bool
 	TestMode         TestMode
+	DeferNoise       bool // If set, sums are output without noise, which is added by addSeededNoise.
 }
 
 // newBoundedSumFloat64Fn returns a boundedSumFloat64Fn with the given budget and parameters.
 func newBoundedSumFloat64Fn(spec PrivacySpec, params SumParams, noiseKind noise.Kind, publicPartitions bool) (*boundedSumFloat64Fn, error) {
-	if noiseKind != noise.GaussianNoise && noiseKind != noise.LaplaceNoise {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
 		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
 	}
 	return &boundedSumFloat64Fn{
@@ -441,18 +465,20 @@ func newBoundedSumFloat64Fn(spec PrivacySpec, params SumParams, noiseKind noise.
 		PartitionSelectionEpsilon: params.PartitionSelectionParams.Epsilon,
 		PartitionSelectionDelta:   params.PartitionSelectionParams.Delta,
 		PreThreshold:              spec.preThreshold,
+		PartitionSelector:         spec.partitionSelector,
 		MaxPartitionsContributed:  params.MaxPartitionsContributed,
 		Lower:                     params.MinValue,
 		Upper:                     params.MaxValue,
 		NoiseKind:                 noiseKind,
 		PublicPartitions:          publicPartitions,
 		TestMode:                  spec.testMode,
+		DeferNoise:                spec.seedsNoise(),
 	}, nil
 }
 
 func (fn *boundedSumFloat64Fn) Setup() {
 	fn.noise = noise.ToNoise(fn.NoiseKind)
-	if fn.TestMode.isEnabled() {
+	if fn.TestMode.isEnabled() || fn.DeferNoise {
 		fn.noise = noNoise{}
 	}
 }
@@ -512,13 +538,14 @@ func (fn *boundedSumFloat64Fn) MergeAccumulators(a, b boundedSumAccumFloat64) (b
 }
 
 func (fn *boundedSumFloat64Fn) ExtractOutput(a boundedSumAccumFloat64) (*float64, error) {
-	if fn.TestMode.isEnabled() {
+	if fn.TestMode.isEnabled() || fn.DeferNoise {
 		a.BS.Noise = noNoise{}
 	}
+	a.BS.Noise = auditNoise(a.BS.Noise, "BoundedSumFloat64")
 	var err error
 	shouldKeepPartition := fn.TestMode.isEnabled() || a.PublicPartitions // If in test mode or public partitions are specified, we always keep the partition.
 	if !shouldKeepPartition {                                            // If not, we need to perform private partition selection.
-		shouldKeepPartition, err = a.SP.ShouldKeepPartition()
+		shouldKeepPartition, err = fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
 		if err != nil {
 			return nil, err
 		}
@@ -535,6 +562,15 @@ func (fn *boundedSumFloat64Fn) String() string {
 	return fmt.Sprintf("%#v", fn)
 }
 
+func (fn *boundedSumFloat64Fn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
+
 // findDereferenceValueFn dereferences a *int64 to int64 or *float64 to float64.
 func findDereferenceValueFn(kind reflect.Kind) (any, error) {
 	switch kind {
@@ -590,33 +626,6 @@ func dropThresholdedPartitionsFloat64Slice(v beam.V, r []float64, emit func(beam
 	}
 }
 
-func findClampNegativePartitionsFn(kind reflect.Kind) (any, error) {
-	switch kind {
-	case reflect.Int64:
-		return clampNegativePartitionsInt64, nil
-	case reflect.Float64:
-		return clampNegativePartitionsFloat64, nil
-	default:
-		return nil, fmt.Errorf("kind(%v) should be int64 or float64", kind)
-	}
-}
-
-// Clamp negative partitions to zero for int64 partitions, e.g., as a post aggregation step for Count.
-func clampNegativePartitionsInt64(k beam.W, r int64) (beam.W, int64) {
-	if r < 0 {
-		return k, 0
-	}
-	return k, r
-}
-
-// Clamp negative partitions to zero for float64 partitions.
-func clampNegativePartitionsFloat64(k beam.W, r float64) (beam.W, float64) {
-	if r < 0 {
-		return k, 0
-	}
-	return k, r
-}
-
 type dropValuesFn struct {
 	Codec *kv.Codec
 }
@@ -652,17 +661,20 @@ func (fn *encodeKVFn) ProcessElement(pair kv.Pair, codedV []byte) (beam.W, kv.Pa
 
 // encodeIDKFn takes a PCollection<ID,kv.Pair{K,V}> as input, and returns a
 // PCollection<kv.Pair{ID,K},V>; where ID and K have been coded, and V has been
-// decoded.
+// decoded. Records that can't be encoded or decoded are emitted as dead letters
+// if SkipMalformed is set.
 type encodeIDKFn struct {
 	IDType         beam.EncodedType    // Type information of the privacy ID
 	idEnc          beam.ElementEncoder // Encoder for privacy ID, set during Setup() according to IDType
 	InputPairCodec *kv.Codec           // Codec for the input kv.Pair{K,V}
+	SkipMalformed  bool                // Whether to emit malformed records as dead letters instead of failing
 }
 
-func newEncodeIDKFn(idType typex.FullType, kvCodec *kv.Codec) *encodeIDKFn {
+func newEncodeIDKFn(idType typex.FullType, kvCodec *kv.Codec, skipMalformed bool) *encodeIDKFn {
 	return &encodeIDKFn{
 		IDType:         beam.EncodedType{idType.Type()},
 		InputPairCodec: kvCodec,
+		SkipMalformed:  skipMalformed,
 	}
 }
 
@@ -671,13 +683,17 @@ func (fn *encodeIDKFn) Setup() error {
 	return fn.InputPairCodec.Setup()
 }
 
-func (fn *encodeIDKFn) ProcessElement(id beam.W, pair kv.Pair) (kv.Pair, beam.V, error) {
+func (fn *encodeIDKFn) ProcessElement(ctx context.Context, id beam.W, pair kv.Pair, emit func(kv.Pair, beam.V), emitDeadLetter func(DeadLetter)) error {
 	var idBuf bytes.Buffer
 	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
-		return kv.Pair{}, nil, fmt.Errorf("pbeam.encodeIDKFn.ProcessElement: couldn't encode ID %v: %w", id, err)
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "encodeIDKFn", fmt.Errorf("pbeam.encodeIDKFn.ProcessElement: couldn't encode ID %v: %w", id, err), emitDeadLetter)
 	}
 	_, v, err := fn.InputPairCodec.Decode(pair)
-	return kv.Pair{idBuf.Bytes(), pair.K}, v, err
+	if err != nil {
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "encodeIDKFn", err, emitDeadLetter)
+	}
+	emit(kv.Pair{idBuf.Bytes(), pair.K}, v)
+	return nil
 }
 
 // decodeIDKFn is the reverse operation of encodeIDKFn. It takes a PCollection<kv.Pair{ID,K},V>
@@ -727,19 +743,29 @@ func convertToFloat64Fn(idk kv.Pair, i beam.V) (kv.Pair, float64, error) {
 }
 
 type expandValuesAccum struct {
-	Values [][]byte
+	Values   [][]byte
+	Compress bool // Whether the coder compresses Values.
+	// Number of values added to the accumulator. If it is larger than the
+	// MaxValues of the CombineFn, Values is a uniformly random sample of them.
+	Count int64
 }
 
 // expandValuesCombineFn converts a PCollection<K,V> to PCollection<K,[]V> where each value
 // corresponding to the same key are collected in a slice. Resulting PCollection has a
 // single slice for each key.
+//
+// If MaxValues is positive, the slices hold at most MaxValues values, sampled
+// uniformly at random with reservoir sampling. This bounds the memory used per
+// key, even for keys with many more values than the contribution bounds allow.
 type expandValuesCombineFn struct {
-	VType beam.EncodedType
-	vEnc  beam.ElementEncoder
+	VType     beam.EncodedType
+	Compress  bool  // Whether accumulators are compressed when shuffled.
+	MaxValues int64 // Maximum number of values kept per key, unbounded if 0.
+	vEnc      beam.ElementEncoder
 }
 
-func newExpandValuesCombineFn(vType beam.EncodedType) *expandValuesCombineFn {
-	return &expandValuesCombineFn{VType: vType}
+func newExpandValuesCombineFn(vType beam.EncodedType, compress bool, maxValues int64) *expandValuesCombineFn {
+	return &expandValuesCombineFn{VType: vType, Compress: compress, MaxValues: maxValues}
 }
 
 func (fn *expandValuesCombineFn) Setup() {
@@ -747,47 +773,116 @@ func (fn *expandValuesCombineFn) Setup() {
 }
 
 func (fn *expandValuesCombineFn) CreateAccumulator() expandValuesAccum {
-	return expandValuesAccum{Values: make([][]byte, 0)}
+	return expandValuesAccum{Values: make([][]byte, 0), Compress: fn.Compress}
 }
 
 func (fn *expandValuesCombineFn) AddInput(a expandValuesAccum, value beam.V) (expandValuesAccum, error) {
+	a.Count++
+	// Once the accumulator is full, the value replaces a random kept value with
+	// probability MaxValues/Count.
+	i := int64(len(a.Values))
+	if fn.MaxValues > 0 && i >= fn.MaxValues {
+		if i = rand.Int63n(a.Count); i >= fn.MaxValues {
+			return a, nil
+		}
+	}
 	var vBuf bytes.Buffer
 	if err := fn.vEnc.Encode(value, &vBuf); err != nil {
 		return a, fmt.Errorf("pbeam.expandValuesCombineFn.AddInput: couldn't encode V %v: %w", value, err)
 	}
-	a.Values = append(a.Values, vBuf.Bytes())
+	if i == int64(len(a.Values)) {
+		a.Values = append(a.Values, vBuf.Bytes())
+	} else {
+		a.Values[i] = vBuf.Bytes()
+	}
 	return a, nil
 }
 
 func (fn *expandValuesCombineFn) MergeAccumulators(a, b expandValuesAccum) expandValuesAccum {
-	a.Values = append(a.Values, b.Values...)
+	if fn.MaxValues > 0 && int64(len(a.Values)+len(b.Values)) > fn.MaxValues {
+		a.Values = mergeSamples(a.Values, b.Values, a.Count, b.Count, fn.MaxValues)
+	} else {
+		a.Values = append(a.Values, b.Values...)
+	}
+	a.Count += b.Count
 	return a
 }
 
+// mergeSamples returns a uniformly random sample of k values out of the nx+ny
+// values of which x and y are uniformly random samples of min(nx,k) and
+// min(ny,k) values. It modifies x and y.
+func mergeSamples[T any](x, y []T, nx, ny, k int64) []T {
+	merged := make([]T, 0, k)
+	for int64(len(merged)) < k {
+		// Each of the remaining nx+ny values is equally likely to be picked next.
+		if rand.Int63n(nx+ny) < nx {
+			merged, x = appendRandom(merged, x)
+			nx--
+		} else {
+			merged, y = appendRandom(merged, y)
+			ny--
+		}
+	}
+	return merged
+}
+
+// appendRandom moves a random value of from to the end of to.
+func appendRandom[T any](to, from []T) ([]T, []T) {
+	i := rand.Intn(len(from))
+	to = append(to, from[i])
+	from[i] = from[len(from)-1]
+	return to, from[:len(from)-1]
+}
+
 func (fn *expandValuesCombineFn) ExtractOutput(a expandValuesAccum) [][]byte {
 	return a.Values
 }
 
 type expandFloat64ValuesAccum struct {
 	Values []float64
+	// Number of values added to the accumulator. If it is larger than the
+	// MaxValues of the CombineFn, Values is a uniformly random sample of them.
+	Count int64
 }
 
 // expandFloat64ValuesCombineFn converts a PCollection<K,float64> to PCollection<K,[]float64>
 // where each value corresponding to the same key are collected in a slice. Resulting
 // PCollection has a single slice for each key.
-type expandFloat64ValuesCombineFn struct{}
+//
+// If MaxValues is positive, the slices hold at most MaxValues values, sampled
+// uniformly at random with reservoir sampling. With MaxValues set to
+// MaxContributionsPerPartition and privacy ID and partition pairs as keys, this
+// does per-partition contribution bounding while collecting the values, without
+// a separate bounding stage and its shuffle.
+type expandFloat64ValuesCombineFn struct {
+	MaxValues int64 // Maximum number of values kept per key, unbounded if 0.
+}
+
+func newExpandFloat64ValuesCombineFn(maxValues int64) *expandFloat64ValuesCombineFn {
+	return &expandFloat64ValuesCombineFn{MaxValues: maxValues}
+}
 
 func (fn *expandFloat64ValuesCombineFn) CreateAccumulator() expandFloat64ValuesAccum {
 	return expandFloat64ValuesAccum{Values: make([]float64, 0)}
 }
 
 func (fn *expandFloat64ValuesCombineFn) AddInput(a expandFloat64ValuesAccum, value float64) expandFloat64ValuesAccum {
-	a.Values = append(a.Values, value)
+	a.Count++
+	if fn.MaxValues <= 0 || int64(len(a.Values)) < fn.MaxValues {
+		a.Values = append(a.Values, value)
+	} else if i := rand.Int63n(a.Count); i < fn.MaxValues {
+		a.Values[i] = value
+	}
 	return a
 }
 
 func (fn *expandFloat64ValuesCombineFn) MergeAccumulators(a, b expandFloat64ValuesAccum) expandFloat64ValuesAccum {
-	a.Values = append(a.Values, b.Values...)
+	if fn.MaxValues > 0 && int64(len(a.Values)+len(b.Values)) > fn.MaxValues {
+		a.Values = mergeSamples(a.Values, b.Values, a.Count, b.Count, fn.MaxValues)
+	} else {
+		a.Values = append(a.Values, b.Values...)
+	}
+	a.Count += b.Count
 	return a
 }
 
@@ -822,7 +917,7 @@ func checkPartitionSelectionEpsilon(epsilon float64, publicPartitions any) error
 //	AggregationDelta == 0; when laplace noise is used
 //	0 < AggregationDelta < 1; otherwise
 func checkAggregationDelta(delta float64, noiseKind noise.Kind) error {
-	if noiseKind == noise.LaplaceNoise {
+	if noise.Consumption(noiseKind) == noise.EpsilonOnly {
 		return checks.CheckNoDelta(delta, "AggregationDelta")
 	}
 	return checks.CheckDeltaStrict(delta, "AggregationDelta")
@@ -22,6 +22,7 @@ import (
 
 	"github.com/google/differential-privacy/go/v3/noise"
 	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/typex"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -524,3 +525,80 @@ func TestCheckNumericType(t *testing.T) {
 		}
 	}
 }
+
+// Checks that expandValuesCombineFn keeps at most MaxValues values per key.
+func TestExpandValuesCombineFnMaxValues(t *testing.T) {
+	fn := newExpandValuesCombineFn(beam.EncodedType{T: reflect.TypeOf(0)}, false, 5)
+	fn.Setup()
+	var accums []expandValuesAccum
+	for _, n := range []int{3, 4, 100} {
+		a := fn.CreateAccumulator()
+		for i := 0; i < n; i++ {
+			var err error
+			if a, err = fn.AddInput(a, i); err != nil {
+				t.Fatalf("AddInput: got error %v", err)
+			}
+		}
+		if want := min(n, 5); len(a.Values) != want || a.Count != int64(n) {
+			t.Errorf("After adding %d values, got %d values and Count=%d, want %d values and Count=%d", n, len(a.Values), a.Count, want, n)
+		}
+		accums = append(accums, a)
+	}
+	// Merging unsaturated accumulators keeps all their values.
+	a := fn.MergeAccumulators(accums[0], fn.CreateAccumulator())
+	if len(a.Values) != 3 || a.Count != 3 {
+		t.Errorf("MergeAccumulators with an empty accumulator: got %d values and Count=%d, want 3 values and Count=3", len(a.Values), a.Count)
+	}
+	a = fn.MergeAccumulators(accums[1], accums[2])
+	if len(a.Values) != 5 || a.Count != 104 {
+		t.Errorf("MergeAccumulators: got %d values and Count=%d, want 5 values and Count=104", len(a.Values), a.Count)
+	}
+	a = fn.MergeAccumulators(accums[0], a)
+	if len(a.Values) != 5 || a.Count != 107 {
+		t.Errorf("MergeAccumulators: got %d values and Count=%d, want 5 values and Count=107", len(a.Values), a.Count)
+	}
+}
+
+// Checks that mergeSamples picks each value with the same probability.
+func TestMergeSamplesIsUniform(t *testing.T) {
+	const runs = 10000
+	picked := make(map[byte]int)
+	for r := 0; r < runs; r++ {
+		// x is a sample of 2 out of 2 values, and y of 2 out of 6 values.
+		x := [][]byte{{0}, {1}}
+		y := [][]byte{{2}, {3}}
+		for _, v := range mergeSamples(x, y, 2, 6, 2) {
+			picked[v[0]]++
+		}
+	}
+	// Each of the 8 values is picked with probability 1/4, so each value of x is
+	// picked ≈2500 times, and the values of y ≈6*2500 times in total.
+	for _, v := range []byte{0, 1} {
+		if picked[v] < 2200 || picked[v] > 2800 {
+			t.Errorf("Value %d of x was picked %d times out of %d, want ≈2500", v, picked[v], runs)
+		}
+	}
+	if got := picked[2] + picked[3]; got < 14400 || got > 15600 {
+		t.Errorf("Values of y were picked %d times out of %d, want ≈15000", got, 2*runs)
+	}
+}
+
+// Checks that expandFloat64ValuesCombineFn keeps at most MaxValues values per key.
+func TestExpandFloat64ValuesCombineFnMaxValues(t *testing.T) {
+	for _, maxValues := range []int64{0, 3} {
+		fn := newExpandFloat64ValuesCombineFn(maxValues)
+		a, b := fn.CreateAccumulator(), fn.CreateAccumulator()
+		for i := 0; i < 10; i++ {
+			a = fn.AddInput(a, float64(i))
+			b = fn.AddInput(b, float64(-i))
+		}
+		got := fn.ExtractOutput(fn.MergeAccumulators(a, b))
+		want := 20
+		if maxValues > 0 {
+			want = int(maxValues)
+		}
+		if len(got) != want {
+			t.Errorf("With MaxValues=%d, got %d values, want %d", maxValues, len(got), want)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/rand"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(ArgMaxValue{}))
+	register.Combiner3[expandArgMaxValuesAccum, ArgMaxValue, []float64](&expandArgMaxValuesCombineFn{})
+	register.Combiner3[argMaxAccum, []float64, *int64](&argMaxFn{})
+}
+
+// ArgMaxValue is a contribution to the score of a candidate, as aggregated by
+// ArgMaxPerKey.
+type ArgMaxValue struct {
+	// Index of the candidate, in [0, NumCandidates).
+	Candidate int64
+	// Value added to the score of the candidate with ArgMaxSum. Ignored with
+	// ArgMaxCount.
+	Value float64
+}
+
+// ArgMaxScore is the score of the candidates of ArgMaxPerKey.
+type ArgMaxScore int
+
+const (
+	// ArgMaxCount scores each candidate with its number of contributions.
+	ArgMaxCount ArgMaxScore = iota
+	// ArgMaxSum scores each candidate with the sum of the values of its
+	// contributions, each clamped to [MinValue, MaxValue].
+	ArgMaxSum
+)
+
+// ArgMaxMechanism is the report-noisy-max mechanism used by ArgMaxPerKey.
+type ArgMaxMechanism int
+
+const (
+	// GumbelNoisyMax adds Gumbel noise to the scores, which is equivalent to
+	// the exponential mechanism: each candidate is selected with a probability
+	// proportional to exp(ε·score/(2·sensitivity)).
+	GumbelNoisyMax ArgMaxMechanism = iota
+	// ExponentialNoisyMax adds exponential noise to the scores, which is
+	// equivalent to the permute-and-flip mechanism: its expected error is
+	// never larger than with GumbelNoisyMax with the same ε.
+	ExponentialNoisyMax
+)
+
+// ArgMaxParams specifies the parameters associated with an ArgMaxPerKey
+// aggregation.
+type ArgMaxParams struct {
+	// Differential privacy budget consumed by this aggregation. Report noisy
+	// max doesn't need a delta, and consumes AggregationEpsilon once for all
+	// candidates. If there is only one aggregation, AggregationEpsilon can be
+	// left 0; in that case, the entire budget reserved for aggregation in the
+	// PrivacySpec is consumed.
+	AggregationEpsilon float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. See MeanParams.PublicPartitions for details.
+	//
+	// PublicPartitions needs to be a beam.PCollection, slice, or array. The
+	// underlying type needs to match the partition type of the PrivatePCollection.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct keys that a given privacy identifier
+	// can influence. If a privacy identifier is associated to more keys,
+	// random keys will be dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of contributions that a given privacy identifier can
+	// make to a key, across all candidates. If a privacy identifier is
+	// associated to more contributions for a key, random contributions will be
+	// dropped.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Number of candidates. The Candidate of each ArgMaxValue must be in
+	// [0, NumCandidates).
+	//
+	// Required; must be at least 2.
+	NumCandidates int64
+	// Score of the candidates. Defaults to ArgMaxCount.
+	Score ArgMaxScore
+	// Bounds of the values of the contributions, with ArgMaxSum. Values outside
+	// of these bounds are clamped. Must be left unset with ArgMaxCount.
+	MinValue, MaxValue float64
+	// Report-noisy-max mechanism. Defaults to GumbelNoisyMax.
+	Mechanism ArgMaxMechanism
+}
+
+// ArgMaxPerKey selects the candidate with the highest score, i.e. the highest
+// count or sum of contributions, for each key in a
+// PrivatePCollection<K,ArgMaxValue> using report noisy max, and does
+// pre-aggregation thresholding to remove partitions with a low number of
+// distinct privacy identifiers.
+//
+// Noise is added to the score of each candidate, and the candidate with the
+// largest noisy score is selected, without releasing the scores. This consumes
+// AggregationEpsilon once for all candidates, instead of once per candidate if
+// their scores were released with Count or SumPerKey and compared. In test
+// mode, the candidate with the highest score is selected, and ties are broken
+// in favor of the candidate with the smallest index.
+//
+// It is also possible to manually specify the list of partitions
+// present in the output, in which case the partition selection/thresholding
+// step is skipped. The candidate selected for public partitions without data
+// is uniformly random.
+//
+// ArgMaxPerKey transforms a PrivatePCollection<K,ArgMaxValue> into a
+// PCollection<K,int64>, whose values are indices of candidates.
+func ArgMaxPerKey(s beam.Scope, pcol PrivatePCollection, params ArgMaxParams) beam.PCollection {
+	s = s.Scope("pbeam.ArgMaxPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("ArgMaxPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("ArgMaxPerKey: no codec found for the input PrivatePCollection.")
+	}
+	if pcol.codec.VType.T != reflect.TypeOf(ArgMaxValue{}) {
+		log.Fatalf("ArgMaxPerKey: values must be of type ArgMaxValue, got %v instead", pcol.codec.VType.T)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "ArgMaxPerKey", err, pcol.codec.KType.T, reflect.TypeOf(int64(0)))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("ArgMaxPerKey", &params.AggregationEpsilon, nil, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+	// The noise of the scores isn't derived from a seed.
+	err = spec.checkNoNoiseSeedKey("ArgMaxPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ArgMaxPerKey: %v", err))
+	}
+
+	err = checkArgMaxPerKeyParams(params, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ArgMaxPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("ArgMaxPerKey", params.AggregationEpsilon, 0, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for ArgMaxPerKey: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},ArgMaxValue>
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+
+	// Combine all contributions for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition of them unless in test mode without contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>, with candidates and values interleaved.
+	combined := beam.CombinePerKey(s, &expandArgMaxValuesCombineFn{MaxValues: maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)}, decoded)
+	combined = traceStage(s, *spec, "ArgMaxPerKey.boundContributionsPerPartition", combined)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "ArgMaxPerKey.boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		return addPublicPartitionsForArgMax(s, *spec, params, partialKV)
+	}
+	// Select the candidate of each partition. Result is PCollection<partition, int64>.
+	argMaxes := beam.CombinePerKey(s, newArgMaxFn(*spec, params, false), partialKV)
+	argMaxes = traceStage(s, *spec, "ArgMaxPerKey.aggregate", argMaxes)
+	// Finally, drop thresholded partitions.
+	return beam.ParDo(s, dropThresholdedPartitionsInt64, argMaxes)
+}
+
+func addPublicPartitionsForArgMax(s beam.Scope, spec PrivacySpec, params ArgMaxParams, partialKV beam.PCollection) beam.PCollection {
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	fn := newArgMaxFn(spec, params, true)
+	emptyArgMaxes := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	argMaxes := beam.CombinePerKey(s, fn, partialKV)
+	argMaxes = traceStage(s, spec, "ArgMaxPerKey.aggregate", argMaxes)
+	argMaxes = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, argMaxes, emptyArgMaxes))
+	return beam.ParDo(s, dereferenceValueInt64, argMaxes)
+}
+
+func checkArgMaxPerKeyParams(params ArgMaxParams, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	if params.NumCandidates < 2 {
+		return fmt.Errorf("NumCandidates must be at least 2, got %d", params.NumCandidates)
+	}
+	switch params.Score {
+	case ArgMaxCount:
+		if params.MinValue != 0 || params.MaxValue != 0 {
+			return fmt.Errorf("MinValue and MaxValue must be left unset with ArgMaxCount, got %f and %f", params.MinValue, params.MaxValue)
+		}
+	case ArgMaxSum:
+		err = checks.CheckBoundsFloat64(params.MinValue, params.MaxValue)
+		if err != nil {
+			return err
+		}
+		err = checks.CheckBoundsNotEqual(params.MinValue, params.MaxValue)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown Score %d", params.Score)
+	}
+	if params.Mechanism != GumbelNoisyMax && params.Mechanism != ExponentialNoisyMax {
+		return fmt.Errorf("unknown Mechanism %d", params.Mechanism)
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+type expandArgMaxValuesAccum struct {
+	Values []ArgMaxValue
+	// Number of values added to the accumulator. If it is larger than the
+	// MaxValues of the CombineFn, Values is a uniformly random sample of them.
+	Count int64
+}
+
+// expandArgMaxValuesCombineFn converts a PCollection<K,ArgMaxValue> to a
+// PCollection<K,[]float64>, where the candidates and values of each key are
+// interleaved in a single slice: [c₀, v₀, c₁, v₁, …], like
+// expandWeightedValuesCombineFn.
+//
+// If MaxValues is positive, at most MaxValues values are kept per key,
+// sampled uniformly at random with reservoir sampling.
+type expandArgMaxValuesCombineFn struct {
+	MaxValues int64
+}
+
+func (fn *expandArgMaxValuesCombineFn) CreateAccumulator() expandArgMaxValuesAccum {
+	return expandArgMaxValuesAccum{}
+}
+
+func (fn *expandArgMaxValuesCombineFn) AddInput(a expandArgMaxValuesAccum, value ArgMaxValue) expandArgMaxValuesAccum {
+	a.Count++
+	i := int64(len(a.Values))
+	if fn.MaxValues > 0 && i >= fn.MaxValues {
+		if i = rand.I63n(a.Count); i >= fn.MaxValues {
+			return a
+		}
+		a.Values[i] = value
+		return a
+	}
+	a.Values = append(a.Values, value)
+	return a
+}
+
+func (fn *expandArgMaxValuesCombineFn) MergeAccumulators(a, b expandArgMaxValuesAccum) expandArgMaxValuesAccum {
+	if fn.MaxValues > 0 && int64(len(a.Values)+len(b.Values)) > fn.MaxValues {
+		a.Values = mergeSamples(a.Values, b.Values, a.Count, b.Count, fn.MaxValues)
+	} else {
+		a.Values = append(a.Values, b.Values...)
+	}
+	a.Count += b.Count
+	return a
+}
+
+func (fn *expandArgMaxValuesCombineFn) ExtractOutput(a expandArgMaxValuesAccum) []float64 {
+	interleaved := make([]float64, 0, 2*len(a.Values))
+	for _, v := range a.Values {
+		interleaved = append(interleaved, float64(v.Candidate), v.Value)
+	}
+	return interleaved
+}
+
+type argMaxAccum struct {
+	Scores           []float64 // Score of each candidate.
+	SP               *dpagg.PreAggSelectPartition
+	PublicPartitions bool
+}
+
+// argMaxFn is a differentially private combineFn for selecting the candidate
+// with the highest score, whose input are the interleaved candidates and
+// values output by expandArgMaxValuesCombineFn. Do not initialize it yourself,
+// use newArgMaxFn to create an argMaxFn instance.
+type argMaxFn struct {
+	// Privacy spec parameters (set during initial construction).
+	Epsilon                      float64
+	PartitionSelectionEpsilon    float64
+	PartitionSelectionDelta      float64
+	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	NumCandidates                int64
+	Score                        ArgMaxScore
+	MinValue, MaxValue           float64
+	Mechanism                    ArgMaxMechanism
+	PublicPartitions             bool // Set to true if public partitions are used.
+	TestMode                     TestMode
+}
+
+// newArgMaxFn returns an argMaxFn with the given budget and parameters.
+func newArgMaxFn(spec PrivacySpec, params ArgMaxParams, publicPartitions bool) *argMaxFn {
+	return &argMaxFn{
+		Epsilon:                      params.AggregationEpsilon,
+		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
+		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		NumCandidates:                params.NumCandidates,
+		Score:                        params.Score,
+		MinValue:                     params.MinValue,
+		MaxValue:                     params.MaxValue,
+		Mechanism:                    params.Mechanism,
+		PublicPartitions:             publicPartitions,
+		TestMode:                     spec.testMode,
+	}
+}
+
+func (fn *argMaxFn) CreateAccumulator() (argMaxAccum, error) {
+	accum := argMaxAccum{Scores: make([]float64, fn.NumCandidates), PublicPartitions: fn.PublicPartitions}
+	var err error
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *argMaxFn) AddInput(a argMaxAccum, interleaved []float64) (argMaxAccum, error) {
+	for i := 0; i+1 < len(interleaved); i += 2 {
+		c := int64(interleaved[i])
+		if c < 0 || c >= fn.NumCandidates {
+			return a, fmt.Errorf("pbeam.argMaxFn.AddInput: got Candidate %d, want a candidate in [0, %d)", c, fn.NumCandidates)
+		}
+		if fn.Score == ArgMaxSum {
+			a.Scores[c] += math.Min(math.Max(interleaved[i+1], fn.MinValue), fn.MaxValue)
+		} else {
+			a.Scores[c]++
+		}
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *argMaxFn) MergeAccumulators(a, b argMaxAccum) (argMaxAccum, error) {
+	for i := range a.Scores {
+		a.Scores[i] += b.Scores[i]
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+func (fn *argMaxFn) ExtractOutput(a argMaxAccum) (*int64, error) {
+	if !fn.TestMode.isEnabled() && !a.PublicPartitions {
+		keep, err := fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !keep {
+			return nil, err
+		}
+	}
+	var argMax int
+	if fn.TestMode.isEnabled() {
+		for i, score := range a.Scores {
+			if score > a.Scores[argMax] {
+				argMax = i
+			}
+		}
+	} else {
+		// Each privacy identifier changes each score of a partition by at most
+		// sensitivity, and contributes to at most MaxPartitionsContributed
+		// partitions.
+		sensitivity := float64(fn.MaxContributionsPerPartition)
+		if fn.Score == ArgMaxSum {
+			sensitivity *= math.Max(math.Abs(fn.MinValue), math.Abs(fn.MaxValue))
+		}
+		var err error
+		argMax, err = reportNoisyMax(a.Scores, fn.Epsilon/float64(fn.MaxPartitionsContributed), sensitivity, fn.Mechanism)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := int64(argMax)
+	return &result, nil
+}
+
+func (fn *argMaxFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *argMaxFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
+
+// reportNoisyMax returns the index of the largest score after adding noise
+// of scale 2·sensitivity/epsilon to each score, which is epsilon-DP if adding
+// or removing a privacy identifier changes each score by at most sensitivity.
+//
+// With GumbelNoisyMax, this is dpagg.NoisyTopK with K=1, which is equivalent
+// to sampling from the exponential mechanism, i.e. selecting each index with a
+// probability proportional to exp(epsilon·score/(2·sensitivity)), and avoids
+// overflows in exp for large scores.
+func reportNoisyMax(scores []float64, epsilon, sensitivity float64, mechanism ArgMaxMechanism) (int, error) {
+	if mechanism != ExponentialNoisyMax {
+		top, err := dpagg.NoisyTopK(scores, &dpagg.NoisyTopKOptions{Epsilon: epsilon, K: 1, Sensitivity: sensitivity})
+		if err != nil {
+			return 0, err
+		}
+		return top[0], nil
+	}
+	scale := 2 * sensitivity / epsilon
+	best, bestScore := 0, math.Inf(-1)
+	for i, score := range scores {
+		if noisy := score - scale*math.Log(rand.Uniform()); noisy > bestScore {
+			best, bestScore = i, noisy
+		}
+	}
+	return best, nil
+}
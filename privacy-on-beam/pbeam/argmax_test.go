@@ -0,0 +1,257 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[argMaxRecord, int, argMaxRecord](extractIDFromArgMaxRecordFn)
+	register.Function1x2[argMaxRecord, int, ArgMaxValue](argMaxRecordToKVFn)
+	register.Function2x1[int, int64, string](formatArgMaxFn)
+}
+
+type argMaxRecord struct {
+	ID, Partition int
+	Candidate     int64
+	Value         float64
+}
+
+func extractIDFromArgMaxRecordFn(r argMaxRecord) (int, argMaxRecord) {
+	return r.ID, r
+}
+
+func argMaxRecordToKVFn(r argMaxRecord) (int, ArgMaxValue) {
+	return r.Partition, ArgMaxValue{Candidate: r.Candidate, Value: r.Value}
+}
+
+func formatArgMaxFn(partition int, candidate int64) string {
+	return fmt.Sprintf("%d:%d", partition, candidate)
+}
+
+// makeArgMaxRecords returns n records with consecutive IDs starting from
+// firstID.
+func makeArgMaxRecords(firstID, n, partition int, candidate int64, value float64) []argMaxRecord {
+	records := make([]argMaxRecord, n)
+	for i := range records {
+		records[i] = argMaxRecord{ID: firstID + i, Partition: partition, Candidate: candidate, Value: value}
+	}
+	return records
+}
+
+// makeArgMaxPerKeyInput returns records where, in partition 0, candidate 0 has
+// 40 contributions of 100 and candidate 1 has 60 contributions of 4 and, in
+// partition 1, candidate 2 has 50 contributions of 1 and candidate 0 has 10
+// contributions of 1.
+func makeArgMaxPerKeyInput() []argMaxRecord {
+	var records []argMaxRecord
+	records = append(records, makeArgMaxRecords(0, 40, 0, 0, 100)...)
+	records = append(records, makeArgMaxRecords(40, 60, 0, 1, 4)...)
+	records = append(records, makeArgMaxRecords(100, 50, 1, 2, 1)...)
+	records = append(records, makeArgMaxRecords(150, 10, 1, 0, 1)...)
+	return records
+}
+
+func TestArgMaxPerKeyNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		params ArgMaxParams
+		want   []string
+	}{
+		{
+			desc:   "count",
+			params: ArgMaxParams{Score: ArgMaxCount},
+			want:   []string{"0:1", "1:2"},
+		},
+		{
+			// Values are clamped to [0, 5]: the score of candidate 0 in partition 0
+			// is 40·5=200, and the score of candidate 1 is 60·4=240.
+			desc:   "sum",
+			params: ArgMaxParams{Score: ArgMaxSum, MinValue: 0, MaxValue: 5},
+			want:   []string{"0:1", "1:2"},
+		},
+		{
+			// Without clamping, candidate 0 would have the highest sum in partition 0.
+			desc:   "sum with large bounds",
+			params: ArgMaxParams{Score: ArgMaxSum, MinValue: 0, MaxValue: 100},
+			want:   []string{"0:0", "1:2"},
+		},
+	} {
+		p, s, col := ptest.CreateList(makeArgMaxPerKeyInput())
+		col = beam.ParDo(s, extractIDFromArgMaxRecordFn, col)
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon:        1,
+				PartitionSelectionEpsilon: 1,
+				PartitionSelectionDelta:   1e-5,
+				TestMode:                  TestModeWithContributionBounding,
+			}))
+		pcol = ParDo(s, argMaxRecordToKVFn, pcol)
+		tc.params.MaxPartitionsContributed = 1
+		tc.params.MaxContributionsPerPartition = 1
+		tc.params.NumCandidates = 3
+		got := ArgMaxPerKey(s, pcol, tc.params)
+
+		passert.Equals(s, beam.ParDo(s, formatArgMaxFn, got), beam.CreateList(s, tc.want))
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("ArgMaxPerKey with %s did not return the expected candidates: %v", tc.desc, err)
+		}
+	}
+}
+
+// Checks that ArgMaxPerKey selects the candidate with the highest score when
+// it is much higher than the scores of the other candidates.
+func TestArgMaxPerKeyAddsNoise(t *testing.T) {
+	for _, mechanism := range []ArgMaxMechanism{GumbelNoisyMax, ExponentialNoisyMax} {
+		p, s, col := ptest.CreateList(makeArgMaxPerKeyInput())
+		col = beam.ParDo(s, extractIDFromArgMaxRecordFn, col)
+		// With ε=100, the probability of selecting another candidate than the one
+		// with the highest count is less than 3·exp(-100·20/2), which is negligible.
+		pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 100}))
+		pcol = ParDo(s, argMaxRecordToKVFn, pcol)
+		got := ArgMaxPerKey(s, pcol, ArgMaxParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			NumCandidates:                3,
+			Mechanism:                    mechanism,
+			PublicPartitions:             []int{0, 1},
+		})
+
+		passert.Equals(s, beam.ParDo(s, formatArgMaxFn, got), beam.CreateList(s, []string{"0:1", "1:2"}))
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("ArgMaxPerKey with mechanism %d did not return the expected candidates: %v", mechanism, err)
+		}
+	}
+}
+
+// Checks that report noisy max selects candidates with the probabilities of
+// the exponential mechanism with Gumbel noise, and of the permute-and-flip
+// mechanism with exponential noise.
+func TestReportNoisyMax(t *testing.T) {
+	scores := []float64{0, 1, 2}
+	// exp(ε·score/(2·sensitivity)) is proportional to 1, 2, 4.
+	epsilon, sensitivity := 2*math.Log(2), 1.0
+	for _, tc := range []struct {
+		mechanism ArgMaxMechanism
+		want      []float64
+	}{
+		{GumbelNoisyMax, []float64{1.0 / 7, 2.0 / 7, 4.0 / 7}},
+		// Permute-and-flip accepts candidates in a random order with probabilities
+		// 1/4, 1/2 and 1, averaged over the 6 orders.
+		{ExponentialNoisyMax, []float64{5.0 / 48, 11.0 / 48, 32.0 / 48}},
+	} {
+		const numTrials = 70000
+		got := make([]int, len(scores))
+		for i := 0; i < numTrials; i++ {
+			selected, err := reportNoisyMax(scores, epsilon, sensitivity, tc.mechanism)
+			if err != nil {
+				t.Fatalf("reportNoisyMax with mechanism %d: got error %v", tc.mechanism, err)
+			}
+			got[selected]++
+		}
+		for i, p := range tc.want {
+			want := numTrials * p
+			// The standard deviation of each count is at most sqrt(numTrials)/2 ≈ 132.
+			if math.Abs(float64(got[i])-want) > 700 {
+				t.Errorf("reportNoisyMax with mechanism %d selected candidate %d %d times out of %d, want about %f", tc.mechanism, i, got[i], numTrials, want)
+			}
+		}
+	}
+}
+
+func TestCheckArgMaxPerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		params        ArgMaxParams
+		partitionType reflect.Type
+		wantErr       bool
+	}{
+		{
+			desc:          "valid parameters",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 2},
+			partitionType: nil,
+			wantErr:       false,
+		},
+		{
+			desc:          "valid parameters with sum",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 2, Score: ArgMaxSum, MinValue: -1, MaxValue: 1},
+			partitionType: nil,
+			wantErr:       false,
+		},
+		{
+			desc:          "zero aggregationEpsilon",
+			params:        ArgMaxParams{PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 2},
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc:          "single candidate",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 1},
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc:          "bounds with count",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 2, MaxValue: 1},
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc:          "equal bounds with sum",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 2, Score: ArgMaxSum, MinValue: 1, MaxValue: 1},
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc:          "unknown mechanism",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 2, Mechanism: 2},
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc:          "zero MaxContributionsPerPartition",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, NumCandidates: 2},
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc:          "zero MaxPartitionsContributed",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxContributionsPerPartition: 1, NumCandidates: 2},
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc:          "non-zero partition selection delta with public partitions",
+			params:        ArgMaxParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumCandidates: 2, PublicPartitions: []int{0}},
+			partitionType: reflect.TypeOf(0),
+			wantErr:       true,
+		},
+	} {
+		if err := checkArgMaxPerKeyParams(tc.params, tc.partitionType); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/rand"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(NoisyBloomFilter{}))
+	register.Function3x0[[]byte, partitionValues, func([]byte, []byte)](emitBloomFilterValues)
+	register.Emitter2[[]byte, []byte]()
+	register.Combiner3[[]byte, []byte, []byte](&bloomFilterFn{})
+	register.DoFn2x3[[]byte, []byte, beam.W, []byte, error](&decodeBloomFilterPartitionFn{})
+	register.DoFn4x0[beam.W, func(*int64) bool, func(*[]byte) bool, func(beam.W, NoisyBloomFilter)](&randomizeBloomFilterFn{})
+	register.Iter1[int64]()
+	register.Iter1[[]byte]()
+	register.Emitter2[beam.W, NoisyBloomFilter]()
+}
+
+// maxBloomFilterBits is the maximum number of bits of the Bloom filter of a
+// partition.
+const maxBloomFilterBits = 1 << 24
+
+// BloomFilterParams specifies the parameters associated with a
+// BloomFilterPerKey aggregation.
+type BloomFilterParams struct {
+	// Differential privacy budget consumed by this aggregation. Bits are
+	// randomized with randomized response, which doesn't need a delta. If there
+	// is only one aggregation, AggregationEpsilon can be left 0; in that case,
+	// the entire budget reserved for aggregation in the PrivacySpec is
+	// consumed.
+	AggregationEpsilon float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. You should only use this in either of the following cases:
+	//  1. The list of partitions is data-independent. For example, if you are
+	//     aggregating a metric by hour, you could provide a list of all possible
+	//     hourly period.
+	//  2. You use a differentially private operation to come up with the list of
+	//     partitions. For example, you could use the output of a SelectPartitions
+	//     operation or the keys of a DistinctPrivacyID operation as the list of
+	//     public partitions.
+	//
+	// PublicPartitions needs to be a beam.PCollection, slice, or array. The
+	// underlying type needs to match the partition type of the PrivatePCollection.
+	//
+	// Prefer slices or arrays if the list of public partitions is small and
+	// can fit into memory (e.g., up to a million). Prefer beam.PCollection
+	// otherwise.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct partitions that a given privacy identifier
+	// can influence. If a privacy identifier is associated with more
+	// partitions, random partitions will be dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of distinct values that a given privacy identifier
+	// can add to the Bloom filter of a partition. If a privacy identifier is
+	// associated with more values in a partition, random values will be
+	// dropped.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Number of bits of the Bloom filter of each partition.
+	//
+	// Required.
+	NumBits int64
+	// Number of bits set by each value, i.e. of hash functions.
+	//
+	// Required.
+	NumHashes int64
+}
+
+// BloomFilterPerKey computes a differentially private Bloom filter of the
+// values present in each partition of a PrivatePCollection<K,V>, which can be
+// released for approximate membership queries instead of the lists of values.
+//
+// Each privacy identifier adds at most MaxContributionsPerPartition distinct
+// values to the filters of at most MaxPartitionsContributed partitions, and
+// each value sets NumHashes bits, so removing a privacy identifier changes at
+// most MaxPartitionsContributed*MaxContributionsPerPartition*NumHashes bits.
+// Each bit of each filter is then flipped with randomized response, with an
+// ε split evenly between these bits. Partitions are selected with
+// differentially private partition selection, unless PublicPartitions are
+// specified.
+//
+// The random flips cause both false positives and false negatives: see
+// NoisyBloomFilter for how to query the filters.
+//
+// BloomFilterPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,NoisyBloomFilter>.
+func BloomFilterPerKey(s beam.Scope, pcol PrivatePCollection, params BloomFilterParams) beam.PCollection {
+	s = s.Scope("pbeam.BloomFilterPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("BloomFilterPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("BloomFilterPerKey: no codec found for the input PrivatePCollection.")
+	}
+	partitionT := pcol.codec.KType.T
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "BloomFilterPerKey", err, partitionT, reflect.TypeOf(NoisyBloomFilter{}))
+	}
+
+	// The randomness of the flips isn't derived from a seed.
+	spec := pcol.privacySpec
+	err := spec.checkNoNoiseSeedKey("BloomFilterPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.BloomFilterPerKey: %v", err))
+	}
+	// Get privacy parameters. The partition selection budget is used by
+	// SelectPartitions.
+	budget, err := spec.reserveBudget("BloomFilterPerKey", &params.AggregationEpsilon, nil, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+	err = checkBloomFilterParams(params, partitionT)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.BloomFilterPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("BloomFilterPerKey", params.AggregationEpsilon, 0, 0, 0)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, partitionT)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for BloomFilterPerKey: %v", err)
+	}
+
+	// First, rekey by kv.Pair{ID,K}, collect the distinct values of each key
+	// and do per-partition contribution bounding.
+	rekeyed := parDoWithDeadLetters(s, spec, newEncodeIDKWithCodedValueFn(idT, spec.skipMalformedRecords), pcol.col) // PCollection<kv.Pair{ID,K}, codedV>.
+	distinct := beam.CombinePerKey(s,
+		newDistinctValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)),
+		rekeyed) // PCollection<kv.Pair{ID,K}, []codedV>.
+	perID := beam.ParDo(s, rekeyPartitionValues, distinct) // PCollection<codedID, partitionValues>.
+	// Second, do cross-partition contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		perID = boundContributions(s, perID, params.MaxPartitionsContributed)
+		perID = traceStage(s, *spec, "BloomFilterPerKey.boundContributions", perID)
+	}
+
+	// Select the partitions to output.
+	var partitions beam.PCollection
+	switch p := params.PublicPartitions.(type) {
+	case nil:
+		idK := beam.ParDo(s, newDecodeIDPartitionValuesFn(idT, partitionT), perID,
+			beam.TypeDefinition{Var: beam.UType, T: idT.Type()},
+			beam.TypeDefinition{Var: beam.WType, T: partitionT}) // PCollection<ID, K>.
+		partitions = selectPartitionsWithBudget(s, PrivatePCollection{col: idK, privacySpec: spec}, SelectPartitionsParams{
+			Epsilon:                  params.PartitionSelectionParams.Epsilon,
+			Delta:                    params.PartitionSelectionParams.Delta,
+			MaxPartitionsContributed: params.MaxPartitionsContributed,
+		}, budget)
+	case beam.PCollection:
+		partitions = p
+	default:
+		partitions = beam.Reshuffle(s, beam.CreateList(s, p))
+	}
+
+	// Set the bits of the values of each partition.
+	values := beam.ParDo(s, emitBloomFilterValues, perID) // PCollection<codedK, codedV>.
+	bits := beam.CombinePerKey(s, &bloomFilterFn{NumBits: params.NumBits, NumHashes: params.NumHashes}, values)
+	decoded := beam.ParDo(s, newDecodeBloomFilterPartitionFn(partitionT), bits,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT}) // PCollection<K, bits>.
+
+	// Randomize the filters of the selected partitions, including those without
+	// any value.
+	grouped := beam.CoGroupByKey(s, beam.ParDo(s, addZeroValuesToPublicPartitionsInt64, partitions), decoded)
+	return beam.ParDo(s, newRandomizeBloomFilterFn(*spec, params), grouped)
+}
+
+func checkBloomFilterParams(params BloomFilterParams, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	if params.NumBits <= 0 || params.NumBits > maxBloomFilterBits {
+		return fmt.Errorf("NumBits must be in (0, %d], got %d", maxBloomFilterBits, params.NumBits)
+	}
+	if params.NumHashes <= 0 || params.NumHashes > params.NumBits {
+		return fmt.Errorf("NumHashes must be in (0, NumBits], got %d with NumBits=%d", params.NumHashes, params.NumBits)
+	}
+	return nil
+}
+
+// emitBloomFilterValues transforms a PCollection<codedID,partitionValues{codedK,[]codedV}>
+// into a PCollection<codedK,codedV>.
+func emitBloomFilterValues(_ []byte, pv partitionValues, emit func([]byte, []byte)) {
+	for _, v := range pv.Values {
+		emit(pv.K, v)
+	}
+}
+
+// bloomFilterFn sets the bits of the coded values of a partition in a bit
+// array of NumBits bits.
+type bloomFilterFn struct {
+	NumBits, NumHashes int64
+}
+
+func (fn *bloomFilterFn) CreateAccumulator() []byte {
+	return make([]byte, (fn.NumBits+7)/8)
+}
+
+func (fn *bloomFilterFn) AddInput(a []byte, v []byte) []byte {
+	for _, i := range bloomFilterIndices(v, fn.NumBits, fn.NumHashes) {
+		a[i/8] |= 1 << (i % 8)
+	}
+	return a
+}
+
+func (fn *bloomFilterFn) MergeAccumulators(a, b []byte) []byte {
+	for i := range a {
+		a[i] |= b[i]
+	}
+	return a
+}
+
+func (fn *bloomFilterFn) ExtractOutput(a []byte) []byte {
+	return a
+}
+
+// bloomFilterIndices returns the indices of the bits of a coded value, using
+// double hashing with the FNV-1a and FNV-1 hashes of the value.
+func bloomFilterIndices(v []byte, numBits, numHashes int64) []int64 {
+	h1, h2 := fnv.New64a(), fnv.New64()
+	h1.Write(v)
+	h2.Write(v)
+	a, b := h1.Sum64(), h2.Sum64()|1
+	indices := make([]int64, numHashes)
+	for i := range indices {
+		indices[i] = int64((a + uint64(i)*b) % uint64(numBits))
+	}
+	return indices
+}
+
+// decodeBloomFilterPartitionFn transforms a PCollection<codedK,bits> into a
+// PCollection<K,bits>.
+type decodeBloomFilterPartitionFn struct {
+	KType beam.EncodedType
+	kDec  beam.ElementDecoder
+}
+
+func newDecodeBloomFilterPartitionFn(kType reflect.Type) *decodeBloomFilterPartitionFn {
+	return &decodeBloomFilterPartitionFn{KType: beam.EncodedType{kType}}
+}
+
+func (fn *decodeBloomFilterPartitionFn) Setup() {
+	fn.kDec = beam.NewElementDecoder(fn.KType.T)
+}
+
+func (fn *decodeBloomFilterPartitionFn) ProcessElement(codedK, bits []byte) (beam.W, []byte, error) {
+	k, err := fn.kDec.Decode(bytes.NewBuffer(codedK))
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.decodeBloomFilterPartitionFn: couldn't decode partition: %w", err)
+	}
+	return k, bits, nil
+}
+
+// randomizeBloomFilterFn flips each bit of the filter of each selected
+// partition with probability FlipProbability, after a CoGroupByKey of the
+// selected partitions and of the filters. Filters of partitions that weren't
+// selected are dropped.
+type randomizeBloomFilterFn struct {
+	NumBits, NumHashes int64
+	FlipProbability    float64
+	TestMode           TestMode
+}
+
+func newRandomizeBloomFilterFn(spec PrivacySpec, params BloomFilterParams) *randomizeBloomFilterFn {
+	// Randomized response with ε' on each bit is ε'-DP; removing a privacy
+	// identifier changes at most l0Sensitivity bits.
+	l0Sensitivity := float64(params.MaxPartitionsContributed) * float64(params.MaxContributionsPerPartition) * float64(params.NumHashes)
+	return &randomizeBloomFilterFn{
+		NumBits:         params.NumBits,
+		NumHashes:       params.NumHashes,
+		FlipProbability: 1 / (1 + math.Exp(params.AggregationEpsilon/l0Sensitivity)),
+		TestMode:        spec.testMode,
+	}
+}
+
+func (fn *randomizeBloomFilterFn) ProcessElement(k beam.W, isSelected func(*int64) bool, bitsIter func(*[]byte) bool, emit func(beam.W, NoisyBloomFilter)) {
+	var ignoredZero int64
+	if !isSelected(&ignoredZero) {
+		return
+	}
+	filter := NoisyBloomFilter{NumBits: fn.NumBits, NumHashes: fn.NumHashes, Bits: make([]byte, (fn.NumBits+7)/8)}
+	var bits []byte
+	for bitsIter(&bits) {
+		for i := range bits {
+			filter.Bits[i] |= bits[i]
+		}
+	}
+	if !fn.TestMode.isEnabled() {
+		filter.FlipProbability = fn.FlipProbability
+		for i := int64(0); i < fn.NumBits; i++ {
+			if rand.Uniform() < fn.FlipProbability {
+				filter.Bits[i/8] ^= 1 << (i % 8)
+			}
+		}
+	}
+	emit(k, filter)
+}
+
+// NoisyBloomFilter is a differentially private Bloom filter of the values of
+// a partition, output by BloomFilterPerKey.
+//
+// Each bit was flipped with probability FlipProbability, so a value that was
+// added to the filter can have some of its bits unset, and a value that
+// wasn't can have all of its bits set. MightContain requires all bits of a
+// value to be set, and is only accurate when FlipProbability is small; with a
+// larger FlipProbability, compare SetBits to what is expected for values
+// that were added, i.e. NumHashes*(1-FlipProbability), and for values that
+// weren't.
+type NoisyBloomFilter struct {
+	NumBits, NumHashes int64
+	// Bits of the filter; bit i is the (i%8)-th least significant bit of
+	// Bits[i/8].
+	Bits []byte
+	// Probability with which each bit was flipped. It is 0 in test mode.
+	FlipProbability float64
+}
+
+// SetBits returns how many of the NumHashes bits of value are set in the
+// filter. value must have the value type of the PrivatePCollection that the
+// filter was computed on.
+func (f NoisyBloomFilter) SetBits(value any) (int64, error) {
+	var buf bytes.Buffer
+	if err := beam.NewElementEncoder(reflect.TypeOf(value)).Encode(value, &buf); err != nil {
+		return 0, fmt.Errorf("couldn't encode value %v: %v", value, err)
+	}
+	var set int64
+	for _, i := range bloomFilterIndices(buf.Bytes(), f.NumBits, f.NumHashes) {
+		if f.Bits[i/8]&(1<<(i%8)) != 0 {
+			set++
+		}
+	}
+	return set, nil
+}
+
+// MightContain returns whether all the bits of value are set in the filter.
+// See SetBits.
+func (f NoisyBloomFilter) MightContain(value any) (bool, error) {
+	set, err := f.SetBits(value)
+	return set == f.NumHashes, err
+}
@@ -0,0 +1,156 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x2[int, NoisyBloomFilter, string, error](formatBloomFilterMembers)
+}
+
+// formatBloomFilterMembers formats the values in [0, 10) that the filter of
+// partition k might contain.
+func formatBloomFilterMembers(k int, f NoisyBloomFilter) (string, error) {
+	var members []int
+	for v := 0; v < 10; v++ {
+		ok, err := f.MightContain(v)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			members = append(members, v)
+		}
+	}
+	return fmt.Sprintf("%d: %v", k, members), nil
+}
+
+func TestBloomFilterPerKeyNoNoise(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		testutils.MakeTripleWithIntValue(3, 0, 0),
+		testutils.MakeTripleWithIntValueStartingFromKey(3, 2, 0, 1),
+		testutils.MakeTripleWithIntValueStartingFromKey(5, 1, 0, 2),
+		testutils.MakeTripleWithIntValueStartingFromKey(6, 4, 1, 5))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	// With 10000 bits and 3 hashes, false positives among 10 values are
+	// negligible.
+	got := BloomFilterPerKey(s, pcol, BloomFilterParams{
+		PublicPartitions:             []int{0, 1, 2},
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		NumBits:                      10000,
+		NumHashes:                    3,
+	})
+	passert.Equals(s, beam.ParDo(s, formatBloomFilterMembers, got),
+		"0: [0 1 2]",
+		"1: [5]",
+		// Partition 2 is an empty public partition.
+		"2: []")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestBloomFilterPerKeyNoNoise: BloomFilterPerKey(%v) = %v: %v", col, got, err)
+	}
+}
+
+func TestNoisyBloomFilterSetBits(t *testing.T) {
+	fn := &bloomFilterFn{NumBits: 100000, NumHashes: 4}
+	var buf bytes.Buffer
+	if err := beam.NewElementEncoder(reflect.TypeOf("")).Encode("added", &buf); err != nil {
+		t.Fatalf("Couldn't encode value: %v", err)
+	}
+	f := NoisyBloomFilter{NumBits: 100000, NumHashes: 4, Bits: fn.AddInput(fn.CreateAccumulator(), buf.Bytes())}
+
+	for _, tc := range []struct {
+		value    string
+		wantBits int64
+		wantIn   bool
+	}{
+		{"added", 4, true},
+		{"not added", 0, false},
+	} {
+		bits, err := f.SetBits(tc.value)
+		if err != nil {
+			t.Fatalf("SetBits(%q): %v", tc.value, err)
+		}
+		if bits != tc.wantBits {
+			t.Errorf("SetBits(%q) = %d, want %d", tc.value, bits, tc.wantBits)
+		}
+		in, err := f.MightContain(tc.value)
+		if err != nil {
+			t.Fatalf("MightContain(%q): %v", tc.value, err)
+		}
+		if in != tc.wantIn {
+			t.Errorf("MightContain(%q) = %t, want %t", tc.value, in, tc.wantIn)
+		}
+	}
+}
+
+func TestBloomFilterFlipProbability(t *testing.T) {
+	// Removing a privacy identifier changes at most 2*1*3=6 bits, so each bit
+	// is randomized with ε=ln(3), i.e. flipped with probability 1/4.
+	fn := newRandomizeBloomFilterFn(PrivacySpec{}, BloomFilterParams{
+		AggregationEpsilon:           6 * math.Log(3),
+		MaxPartitionsContributed:     2,
+		MaxContributionsPerPartition: 1,
+		NumBits:                      100,
+		NumHashes:                    3,
+	})
+	if math.Abs(fn.FlipProbability-0.25) > 1e-9 {
+		t.Errorf("FlipProbability = %f, want 0.25", fn.FlipProbability)
+	}
+}
+
+func TestCheckBloomFilterParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  BloomFilterParams
+		wantErr bool
+	}{
+		{"valid params", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumBits: 100, NumHashes: 3}, false},
+		{"valid params with public partitions", BloomFilterParams{AggregationEpsilon: 1, PublicPartitions: []int{0}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumBits: 100, NumHashes: 3}, false},
+		{"no AggregationEpsilon", BloomFilterParams{PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumBits: 100, NumHashes: 3}, true},
+		{"no partition selection delta", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumBits: 100, NumHashes: 3}, true},
+		{"no MaxPartitionsContributed", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxContributionsPerPartition: 1, NumBits: 100, NumHashes: 3}, true},
+		{"no MaxContributionsPerPartition", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, NumBits: 100, NumHashes: 3}, true},
+		{"no NumBits", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumHashes: 3}, true},
+		{"too many bits", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumBits: maxBloomFilterBits + 1, NumHashes: 3}, true},
+		{"no NumHashes", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumBits: 100}, true},
+		{"more hashes than bits", BloomFilterParams{AggregationEpsilon: 1, PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1, Delta: 1e-5}, MaxPartitionsContributed: 1, MaxContributionsPerPartition: 1, NumBits: 2, NumHashes: 3}, true},
+	} {
+		if err := checkBloomFilterParams(tc.params, reflect.TypeOf(0)); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
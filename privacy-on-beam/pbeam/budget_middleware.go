@@ -0,0 +1,70 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+)
+
+// BudgetRequest is a request of an aggregation to get or consume budget from
+// the aggregation or partition selection budget of a PrivacySpec.
+type BudgetRequest struct {
+	Budget BudgetType
+	// Budget requested by the aggregation. If both are 0, the aggregation
+	// requests the entire budget, which is only possible if no budget has been
+	// consumed yet.
+	Epsilon, Delta float64
+	// If DryRun is set, the aggregation only computes the budget it would get,
+	// e.g. to validate its parameters, and the budget isn't consumed.
+	// Aggregations consume the budget they use with a separate request, with
+	// the budget returned by the dry run.
+	DryRun bool
+}
+
+// BudgetHandler handles a BudgetRequest, and returns the budget the
+// aggregation uses. It is called during pipeline construction.
+type BudgetHandler func(BudgetRequest) (epsilon, delta float64, err error)
+
+// BudgetMiddleware wraps the BudgetHandler of a PrivacySpec, e.g. to log the
+// requests, to modify them before passing them to next, or to consume the
+// budget from another accountant too. A middleware may return an error
+// without calling next to refuse a request.
+//
+// Middleware must not give an aggregation more budget than next returned:
+// the PrivacySpec only accounts for the budget consumed by next.
+type BudgetMiddleware func(next BudgetHandler) BudgetHandler
+
+// request handles a budget request, going through the middleware of the
+// budget.
+func (budget *privacyBudget) request(req BudgetRequest) (eps, del float64, err error) {
+	handler := BudgetHandler(budget.handle)
+	for i := len(budget.middleware) - 1; i >= 0; i-- {
+		handler = budget.middleware[i](handler)
+	}
+	return handler(req)
+}
+
+// handle is the innermost BudgetHandler of a budget.
+func (budget *privacyBudget) handle(req BudgetRequest) (eps, del float64, err error) {
+	if req.Budget != budget.budgetType {
+		return 0, 0, fmt.Errorf("budget request for the %v sent to the %v", req.Budget, budget.budgetType)
+	}
+	if req.DryRun {
+		return budget.getDirect(req.Epsilon, req.Delta)
+	}
+	return budget.consumeDirect(req.Epsilon, req.Delta)
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// recordingMiddleware returns a BudgetMiddleware appending its name and the
+// requests it sees to log.
+func recordingMiddleware(name string, log *[]string, requests *[]BudgetRequest) BudgetMiddleware {
+	return func(next BudgetHandler) BudgetHandler {
+		return func(req BudgetRequest) (float64, float64, error) {
+			*log = append(*log, name)
+			*requests = append(*requests, req)
+			return next(req)
+		}
+	}
+}
+
+func TestBudgetMiddlewareOrder(t *testing.T) {
+	var log []string
+	var requests []BudgetRequest
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		BudgetMiddleware: []BudgetMiddleware{
+			recordingMiddleware("outer", &log, &requests),
+			recordingMiddleware("inner", &log, &requests),
+		},
+	})
+	if _, _, err := spec.aggregationBudget.get(0.5, 0); err != nil {
+		t.Fatalf("get: got error %v", err)
+	}
+	if _, _, err := spec.partitionSelectionBudget.consume(0.5, 1e-6); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"outer", "inner", "outer", "inner"}, log); diff != "" {
+		t.Errorf("BudgetMiddleware called in unexpected order (-want +got):\n%s", diff)
+	}
+	wantRequests := []BudgetRequest{
+		{Budget: AggregationBudget, Epsilon: 0.5, DryRun: true},
+		{Budget: AggregationBudget, Epsilon: 0.5, DryRun: true},
+		{Budget: PartitionSelectionBudget, Epsilon: 0.5, Delta: 1e-6},
+		{Budget: PartitionSelectionBudget, Epsilon: 0.5, Delta: 1e-6},
+	}
+	if diff := cmp.Diff(wantRequests, requests); diff != "" {
+		t.Errorf("BudgetMiddleware got unexpected requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestBudgetMiddlewareRefusesRequest(t *testing.T) {
+	refuse := func(next BudgetHandler) BudgetHandler {
+		return func(req BudgetRequest) (float64, float64, error) {
+			if !req.DryRun && req.Epsilon > 0.5 {
+				return 0, 0, errors.New("epsilon too large")
+			}
+			return next(req)
+		}
+	}
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		BudgetMiddleware:   []BudgetMiddleware{refuse},
+	})
+	if _, _, err := spec.aggregationBudget.consume(1, 0); err == nil {
+		t.Errorf("consume: refused request got no error")
+	}
+	if got := spec.BudgetUsage()[0].ConsumedEpsilon; got != 0 {
+		t.Errorf("BudgetUsage: after refused request got ConsumedEpsilon=%f, want 0", got)
+	}
+	if _, _, err := spec.aggregationBudget.consume(0.5, 0); err != nil {
+		t.Errorf("consume: accepted request got error %v", err)
+	}
+}
+
+func TestBudgetMiddlewareReducesBudget(t *testing.T) {
+	// Aggregations use half of the budget they consume.
+	halve := func(next BudgetHandler) BudgetHandler {
+		return func(req BudgetRequest) (float64, float64, error) {
+			eps, del, err := next(req)
+			return eps / 2, del / 2, err
+		}
+	}
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		BudgetMiddleware:   []BudgetMiddleware{halve},
+	})
+	eps, _, err := spec.aggregationBudget.consume(0, 0)
+	if err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if eps != 0.5 {
+		t.Errorf("consume: got epsilon=%f, want 0.5", eps)
+	}
+	if got := spec.BudgetUsage()[0].ConsumedEpsilon; got != 1 {
+		t.Errorf("BudgetUsage: got ConsumedEpsilon=%f, want 1", got)
+	}
+}
+
+func TestNewPrivacySpecNilBudgetMiddleware(t *testing.T) {
+	if _, err := NewPrivacySpec(PrivacySpecParams{AggregationEpsilon: 1, BudgetMiddleware: []BudgetMiddleware{nil}}); err == nil {
+		t.Errorf("NewPrivacySpec: with nil BudgetMiddleware got no error")
+	}
+}
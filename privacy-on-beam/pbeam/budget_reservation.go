@@ -0,0 +1,96 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+)
+
+// reservedBudget is the budget of an aggregation, got from a PrivacySpec
+// before the aggregation validates its parameters. It is only consumed once
+// the aggregation commits it, so that invalid aggregations don't consume any
+// budget.
+type reservedBudget struct {
+	spec        *PrivacySpec
+	aggregation string
+	// Aggregation budget of the aggregation. delta is nil if the aggregation
+	// doesn't use an aggregation δ.
+	epsilon, delta *float64
+	// Partition selection budget of the aggregation, nil if it doesn't select
+	// partitions.
+	partitionSelection *PartitionSelectionParams
+}
+
+// reserveBudget gets the aggregation budget (*epsilon,*delta) of an
+// aggregation from ps, and its partition selection budget if
+// partitionSelection isn't nil, and replaces them with the budget the
+// aggregation gets, e.g. the entire budget left if they are 0. The budget is
+// not consumed: the aggregation must call commit once it has validated its
+// parameters.
+func (ps *PrivacySpec) reserveBudget(aggregation string, epsilon, delta *float64, partitionSelection *PartitionSelectionParams) (*reservedBudget, error) {
+	budget := &reservedBudget{spec: ps, aggregation: aggregation, epsilon: epsilon, delta: delta, partitionSelection: partitionSelection}
+	err := budget.request(ps.aggregationBudget.get, ps.partitionSelectionBudget.get)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get %v", err)
+	}
+	return budget, nil
+}
+
+// commit consumes the reserved budget, and replaces it with the budget
+// consumed, which the aggregation must use.
+func (budget *reservedBudget) commit() error {
+	err := budget.request(budget.spec.aggregationBudget.consume, budget.spec.partitionSelectionBudget.consume)
+	if err != nil {
+		return fmt.Errorf("Couldn't consume %v", err)
+	}
+	return nil
+}
+
+// request requests the reserved budget with requestAggregation and
+// requestPartitionSelection, and replaces it with the budget they return.
+func (budget *reservedBudget) request(requestAggregation, requestPartitionSelection func(epsilon, delta float64) (eps, del float64, err error)) error {
+	var delta float64
+	if budget.delta != nil {
+		delta = *budget.delta
+	}
+	eps, del, err := requestAggregation(*budget.epsilon, delta)
+	if err != nil {
+		return fmt.Errorf("aggregation budget for %s: %v", budget.aggregation, err)
+	}
+	*budget.epsilon = eps
+	if budget.delta != nil {
+		*budget.delta = del
+	}
+	if budget.partitionSelection != nil {
+		ps := budget.partitionSelection
+		ps.Epsilon, ps.Delta, err = requestPartitionSelection(ps.Epsilon, ps.Delta)
+		if err != nil {
+			return fmt.Errorf("partition selection budget for %s: %v", budget.aggregation, err)
+		}
+	}
+	return nil
+}
+
+// privatePartitionSelection returns params, the partition selection budget of
+// an aggregation, if the aggregation selects partitions privately, i.e. if
+// publicPartitions is nil, and nil otherwise.
+func privatePartitionSelection(publicPartitions any, params *PartitionSelectionParams) *PartitionSelectionParams {
+	if publicPartitions != nil {
+		return nil
+	}
+	return params
+}
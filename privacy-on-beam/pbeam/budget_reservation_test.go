@@ -0,0 +1,82 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestReserveBudget(t *testing.T) {
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+	})
+	// The aggregation requests the entire aggregation budget.
+	var epsilon, delta float64
+	partitionSelection := PartitionSelectionParams{Epsilon: 0.5, Delta: 1e-11}
+	budget, err := spec.reserveBudget("Aggregation", &epsilon, &delta, &partitionSelection)
+	if err != nil {
+		t.Fatalf("reserveBudget: got error %v", err)
+	}
+	if epsilon != 1 || partitionSelection.Epsilon != 0.5 || partitionSelection.Delta != 1e-11 {
+		t.Errorf("reserveBudget: got epsilon=%f and partition selection budget %+v, want 1 and the requested budget", epsilon, partitionSelection)
+	}
+	unused := []BudgetUsage{
+		{Budget: AggregationBudget, TotalEpsilon: 1, Inflation: 1},
+		{Budget: PartitionSelectionBudget, TotalEpsilon: 1, TotalDelta: 1e-10, Inflation: 1},
+	}
+	if diff := cmp.Diff(unused, spec.BudgetUsage()); diff != "" {
+		t.Errorf("BudgetUsage after reserveBudget: got diff (-want +got):\n%s", diff)
+	}
+
+	if err := budget.commit(); err != nil {
+		t.Fatalf("commit: got error %v", err)
+	}
+	want := []BudgetUsage{
+		{Budget: AggregationBudget, ConsumedEpsilon: 1, TotalEpsilon: 1, Inflation: 1},
+		{Budget: PartitionSelectionBudget, ConsumedEpsilon: 0.5, ConsumedDelta: 1e-11, TotalEpsilon: 1, TotalDelta: 1e-10, Inflation: 1},
+	}
+	if diff := cmp.Diff(want, spec.BudgetUsage(), cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("BudgetUsage after commit: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReserveBudgetErrors(t *testing.T) {
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1})
+	epsilon := 2.0
+	if _, err := spec.reserveBudget("Aggregation", &epsilon, nil, nil); err == nil || !strings.HasPrefix(err.Error(), "Couldn't get aggregation budget for Aggregation") {
+		t.Errorf("reserveBudget with too much budget: got error %v, want an error getting the aggregation budget", err)
+	}
+
+	epsilon = 0.5
+	budget, err := spec.reserveBudget("Aggregation", &epsilon, nil, nil)
+	if err != nil {
+		t.Fatalf("reserveBudget: got error %v", err)
+	}
+	// Another aggregation consumes the budget before the first one commits it.
+	if _, _, err := spec.aggregationBudget.consume(0.8, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if err := budget.commit(); err == nil || !strings.HasPrefix(err.Error(), "Couldn't consume aggregation budget for Aggregation") {
+		t.Errorf("commit with too much budget: got error %v, want an error consuming the aggregation budget", err)
+	}
+}
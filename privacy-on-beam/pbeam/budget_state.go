@@ -0,0 +1,125 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// budgetStateEncodingVersion is the version of the encoding used by
+// ExportBudgetState. It is the first byte of every budget state.
+const budgetStateEncodingVersion byte = 1
+
+// encodedBudgetStateSize is the size in bytes of a budget state: a version
+// byte, followed by the total and remaining ε and δ of the aggregation and
+// partition selection budgets encoded as little-endian 64-bit values, and by
+// their HMAC-SHA256.
+const encodedBudgetStateSize = 1 + 2*4*8 + sha256.Size
+
+// minBudgetStateKeyLength is the minimum length of the keys signing budget
+// states, in bytes.
+const minBudgetStateKeyLength = 32
+
+// ExportBudgetState returns an opaque token holding the budget of the
+// PrivacySpec that hasn't been consumed yet, signed with key. Passing it as
+// PrivacySpecParams.BudgetState to NewPrivacySpec in another program makes that
+// program's PrivacySpec start with this remaining budget, so that a sequence of
+// separate binaries jointly respect the budget of the first one.
+//
+// Aggregations consume their budget when they are added to the pipeline, so
+// export the state after constructing the pipeline. key must be at least 32
+// uniformly random bytes kept secret from the programs' inputs, and the token
+// must only be given to the next program of the sequence: the signature
+// prevents forging or modifying tokens, but not restoring the same token in
+// several programs, each of which could then consume the whole remaining
+// budget.
+func (ps *PrivacySpec) ExportBudgetState(key []byte) ([]byte, error) {
+	if len(key) < minBudgetStateKeyLength {
+		return nil, fmt.Errorf("budget state key must be at least %d bytes long, got %d bytes", minBudgetStateKeyLength, len(key))
+	}
+	b := make([]byte, 1, encodedBudgetStateSize)
+	b[0] = budgetStateEncodingVersion
+	b = ps.aggregationBudget.appendState(b)
+	b = ps.partitionSelectionBudget.appendState(b)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(b), nil
+}
+
+// appendState appends the total and remaining budget to b.
+func (budget *privacyBudget) appendState(b []byte) []byte {
+	budget.mux.Lock()
+	defer budget.mux.Unlock()
+	for _, v := range []float64{budget.totalEpsilon, budget.totalDelta, budget.epsilon, budget.delta} {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+// restoreBudgetState sets the remaining budgets of spec to those held by
+// state, after checking its signature and that it was exported by a
+// PrivacySpec with the same total budgets.
+//
+// The restored budgets aren't marked as partially consumed: the first
+// aggregation of the program may consume the entire remaining budget.
+func restoreBudgetState(spec *PrivacySpec, state, key []byte) error {
+	if len(key) < minBudgetStateKeyLength {
+		return fmt.Errorf("BudgetStateKey must be at least %d bytes long, got %d bytes", minBudgetStateKeyLength, len(key))
+	}
+	if len(state) != encodedBudgetStateSize {
+		return fmt.Errorf("budget state must be %d bytes long, got %d bytes", encodedBudgetStateSize, len(state))
+	}
+	payload, signature := state[:len(state)-sha256.Size], state[len(state)-sha256.Size:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("invalid budget state signature, the budget state was modified or signed with a different key")
+	}
+	if payload[0] != budgetStateEncodingVersion {
+		return fmt.Errorf("unsupported budget state encoding version %d, expected %d", payload[0], budgetStateEncodingVersion)
+	}
+	values := payload[1:]
+	for _, budget := range []*privacyBudget{spec.aggregationBudget, spec.partitionSelectionBudget} {
+		var v [4]float64
+		for i := range v {
+			v[i] = math.Float64frombits(binary.LittleEndian.Uint64(values[8*i:]))
+		}
+		values = values[32:]
+		if err := budget.restoreState(v[0], v[1], v[2], v[3]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (budget *privacyBudget) restoreState(totalEpsilon, totalDelta, epsilon, delta float64) error {
+	budget.mux.Lock()
+	defer budget.mux.Unlock()
+	if totalEpsilon != budget.totalEpsilon || totalDelta != budget.totalDelta {
+		return fmt.Errorf("the %v of the budget state is epsilon=%f and delta=%e, but the %v of the PrivacySpec is epsilon=%f and delta=%e",
+			budget.budgetType, totalEpsilon, totalDelta, budget.budgetType, budget.totalEpsilon, budget.totalDelta)
+	}
+	if !(epsilon >= 0 && epsilon <= totalEpsilon && delta >= 0 && delta <= totalDelta) {
+		return fmt.Errorf("invalid remaining %v in budget state: epsilon=%f and delta=%e", budget.budgetType, epsilon, delta)
+	}
+	budget.epsilon, budget.delta = epsilon, delta
+	return nil
+}
@@ -0,0 +1,154 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+var budgetStateKey = bytes.Repeat([]byte{42}, minBudgetStateKeyLength)
+
+func budgetStateParams() PrivacySpecParams {
+	return PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+	}
+}
+
+// Checks that a PrivacySpec restored from the budget state of another one
+// starts with the remaining budget of the latter.
+func TestBudgetStateRoundTrip(t *testing.T) {
+	spec := privacySpec(t, budgetStateParams())
+	if _, _, err := spec.aggregationBudget.consume(0.3, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if _, _, err := spec.partitionSelectionBudget.consume(0.5, 1e-11); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	state, err := spec.ExportBudgetState(budgetStateKey)
+	if err != nil {
+		t.Fatalf("ExportBudgetState: got error %v", err)
+	}
+
+	params := budgetStateParams()
+	params.BudgetState = state
+	params.BudgetStateKey = budgetStateKey
+	restored := privacySpec(t, params)
+	if diff := cmp.Diff(spec.BudgetUsage(), restored.BudgetUsage(), cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("BudgetUsage of the restored PrivacySpec: got diff (-want +got):\n%s", diff)
+	}
+	// The first aggregation of the restored PrivacySpec can consume the entire
+	// remaining budget, but not more.
+	eps, del, err := restored.aggregationBudget.consume(0, 0)
+	if err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if !cmp.Equal([]float64{eps, del}, []float64{0.7, 0}, cmpopts.EquateApprox(0, 1e-12)) {
+		t.Errorf("consume(0, 0): got (epsilon,delta)=(%f,%e), expected=(%f,%e)", eps, del, 0.7, 0.0)
+	}
+	if _, _, err := restored.partitionSelectionBudget.consume(0.6, 0); err == nil {
+		t.Errorf("consume(0.6, 0): got no error when consuming more than the remaining partition selection budget")
+	}
+}
+
+// Checks that the budget of aggregations added to the pipeline before
+// exporting the budget state isn't available to the next program, including
+// aggregations which get their budget before validating their parameters.
+func TestBudgetStateAfterAggregations(t *testing.T) {
+	spec := privacySpec(t, budgetStateParams())
+	_, s, col := ptest.CreateList(testutils.MakeTripleWithIntValue(10, 0, 1))
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	pcol := ParDo(s, testutils.TripleWithIntValueToKV, MakePrivate(s, col, spec))
+	SumPerKey(s, pcol, SumParams{
+		AggregationEpsilon:       0.4,
+		PartitionSelectionParams: PartitionSelectionParams{Epsilon: 0.5, Delta: 1e-11},
+		MaxPartitionsContributed: 1,
+		MinValue:                 0,
+		MaxValue:                 1,
+	})
+	MeanPerKey(s, pcol, MeanParams{
+		AggregationEpsilon:           0.6,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     1,
+		PublicPartitions:             []int{0},
+	})
+	state, err := spec.ExportBudgetState(budgetStateKey)
+	if err != nil {
+		t.Fatalf("ExportBudgetState: got error %v", err)
+	}
+
+	params := budgetStateParams()
+	params.BudgetState = state
+	params.BudgetStateKey = budgetStateKey
+	restored := privacySpec(t, params)
+	want := []BudgetUsage{
+		{Budget: AggregationBudget, ConsumedEpsilon: 1, TotalEpsilon: 1, Inflation: 1},
+		{Budget: PartitionSelectionBudget, ConsumedEpsilon: 0.5, ConsumedDelta: 1e-11, TotalEpsilon: 1, TotalDelta: 1e-10, Inflation: 1},
+	}
+	if diff := cmp.Diff(want, restored.BudgetUsage(), cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("BudgetUsage of the restored PrivacySpec: got diff (-want +got):\n%s", diff)
+	}
+	if _, _, err := restored.aggregationBudget.consume(0.1, 0); err == nil {
+		t.Errorf("consume(0.1, 0): got no error when consuming aggregation budget already consumed by SumPerKey and MeanPerKey")
+	}
+}
+
+func TestBudgetStateErrors(t *testing.T) {
+	spec := privacySpec(t, budgetStateParams())
+	state, err := spec.ExportBudgetState(budgetStateKey)
+	if err != nil {
+		t.Fatalf("ExportBudgetState: got error %v", err)
+	}
+	tampered := append([]byte(nil), state...)
+	tampered[1] ^= 1
+	otherKey := bytes.Repeat([]byte{7}, minBudgetStateKeyLength)
+	otherBudget := budgetStateParams()
+	otherBudget.AggregationEpsilon = 2
+
+	for _, tc := range []struct {
+		desc   string
+		params PrivacySpecParams
+		state  []byte
+		key    []byte
+	}{
+		{"tampered state", budgetStateParams(), tampered, budgetStateKey},
+		{"truncated state", budgetStateParams(), state[:len(state)-1], budgetStateKey},
+		{"wrong key", budgetStateParams(), state, otherKey},
+		{"key too short", budgetStateParams(), state, budgetStateKey[:minBudgetStateKeyLength-1]},
+		{"different total budget", otherBudget, state, budgetStateKey},
+	} {
+		tc.params.BudgetState = tc.state
+		tc.params.BudgetStateKey = tc.key
+		if _, err := NewPrivacySpec(tc.params); err == nil {
+			t.Errorf("With %s, got no error", tc.desc)
+		}
+	}
+
+	if _, err := spec.ExportBudgetState(budgetStateKey[:minBudgetStateKeyLength-1]); err == nil {
+		t.Errorf("ExportBudgetState with a key too short: got no error")
+	}
+}
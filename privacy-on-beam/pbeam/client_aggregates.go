@@ -0,0 +1,314 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(ClientAggregate{}))
+	register.Function2x1[ClientAggregate, ClientAggregate, ClientAggregate](mergeClientAggregates)
+	register.Function2x2[kv.Pair, ClientAggregate, []byte, pairClientAggregate](rekeyClientAggregate)
+	register.DoFn1x3[pairClientAggregate, beam.W, ClientAggregate, error](&decodePairClientAggregateFn{})
+	register.Combiner3[boundedMeanAccum, ClientAggregate, *float64](&clientAggregateMeanFn{})
+}
+
+// clientAggregateEncodingVersion is the version of the encoding used by
+// EncodeClientAggregate. It is the first byte of every encoded
+// ClientAggregate.
+const clientAggregateEncodingVersion byte = 1
+
+// encodedClientAggregateSize is the size in bytes of an encoded
+// ClientAggregate: a version byte, followed by the sum and the count encoded
+// as little-endian 64-bit values.
+const encodedClientAggregateSize = 17
+
+// ClientAggregate is a partial aggregate computed by a client (e.g. on the
+// device of a user) over the values that a single privacy unit contributes to
+// a single partition: Count values whose sum is Sum.
+//
+// Client aggregates don't contain any noise: the differentially private noise
+// is added centrally, after the client aggregates are merged in a pipeline.
+// Since SumPerKey already bounds the total contribution of a privacy unit to
+// each partition, client-side sums and counts can be aggregated with
+// SumPerKey on their Sum or Count field. MeanPerKeyFromClientAggregates
+// computes means, which need both fields.
+type ClientAggregate struct {
+	Sum   float64
+	Count int64
+}
+
+// EncodeClientAggregate encodes a ClientAggregate to be sent by a client to
+// the server. The encoding is versioned, so that the server can reject
+// aggregates encoded in an unsupported format.
+func EncodeClientAggregate(agg ClientAggregate) []byte {
+	b := make([]byte, encodedClientAggregateSize)
+	b[0] = clientAggregateEncodingVersion
+	binary.LittleEndian.PutUint64(b[1:9], math.Float64bits(agg.Sum))
+	binary.LittleEndian.PutUint64(b[9:], uint64(agg.Count))
+	return b
+}
+
+// DecodeClientAggregate decodes a ClientAggregate encoded with
+// EncodeClientAggregate. It returns an error if the encoding is malformed or
+// the decoded aggregate is invalid, so that the server can drop reports from
+// misbehaving clients.
+func DecodeClientAggregate(b []byte) (ClientAggregate, error) {
+	if len(b) != encodedClientAggregateSize {
+		return ClientAggregate{}, fmt.Errorf("encoded ClientAggregate must be %d bytes long, got %d bytes", encodedClientAggregateSize, len(b))
+	}
+	if b[0] != clientAggregateEncodingVersion {
+		return ClientAggregate{}, fmt.Errorf("unsupported ClientAggregate encoding version %d, expected %d", b[0], clientAggregateEncodingVersion)
+	}
+	agg := ClientAggregate{
+		Sum:   math.Float64frombits(binary.LittleEndian.Uint64(b[1:9])),
+		Count: int64(binary.LittleEndian.Uint64(b[9:])),
+	}
+	if math.IsNaN(agg.Sum) || math.IsInf(agg.Sum, 0) {
+		return ClientAggregate{}, fmt.Errorf("ClientAggregate sum must be finite, got %f", agg.Sum)
+	}
+	if agg.Count < 0 {
+		return ClientAggregate{}, fmt.Errorf("ClientAggregate count must be non-negative, got %d", agg.Count)
+	}
+	return agg, nil
+}
+
+// MeanPerKeyFromClientAggregates obtains the mean of the values associated
+// with each key from the partial aggregates computed by clients, adding
+// differentially private noise to the means and doing pre-aggregation
+// thresholding to remove means with a low number of distinct privacy
+// identifiers.
+//
+// It takes the same parameters as MeanPerKey and provides the same privacy
+// guarantees. All client aggregates of a privacy identifier for a partition
+// are first merged. The merged aggregate is then capped as if its values had
+// been added individually to the mean: its count is capped to
+// params.MaxContributionsPerPartition (scaling its sum down accordingly) and
+// its sum is clamped to [count*MinValue, count*MaxValue]. Finally, each
+// privacy identifier contributes to at most params.MaxPartitionsContributed
+// partitions.
+//
+// MeanPerKeyFromClientAggregates transforms a PrivatePCollection<K,ClientAggregate>
+// into a PCollection<K,float64>.
+func MeanPerKeyFromClientAggregates(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.PCollection {
+	s = s.Scope("pbeam.MeanPerKeyFromClientAggregates")
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("MeanPerKeyFromClientAggregates must be used on a PrivatePCollection of type <K,ClientAggregate>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("MeanPerKeyFromClientAggregates: no codec found for the input PrivatePCollection.")
+	}
+	if pcol.codec.VType.T != reflect.TypeOf(ClientAggregate{}) {
+		log.Fatalf("MeanPerKeyFromClientAggregates must be used on a PrivatePCollection of type <K,ClientAggregate>, got value type %v instead", pcol.codec.VType.T)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "MeanPerKeyFromClientAggregates", err, pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("MeanPerKeyFromClientAggregates", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.MeanPerKeyFromClientAggregates: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("MeanPerKeyFromClientAggregates")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.MeanPerKeyFromClientAggregates: %v", err))
+	}
+
+	err = checkMeanPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.MeanPerKeyFromClientAggregates: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("MeanPerKeyFromClientAggregates", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for MeanPerKeyFromClientAggregates: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID and merge all
+	// client aggregates of each <id, partition>. Per-partition contribution
+	// bounding is done when adding the merged aggregates to the mean.
+	// Result is PCollection<kv.Pair{ID,K},ClientAggregate>.
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+	merged := beam.CombinePerKey(s, mergeClientAggregates, decoded)
+
+	// Result is PCollection<ID, pairClientAggregate>.
+	rekeyed := beam.ParDo(s, rekeyClientAggregate, merged)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, ClientAggregate>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairClientAggregateFn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Compute the mean for each partition. Result is PCollection<partition, float64>.
+	meanFn, err := newClientAggregateMeanFn(*spec, params, noiseKind, params.PublicPartitions != nil)
+	if err != nil {
+		log.Fatalf("Couldn't get clientAggregateMeanFn for MeanPerKeyFromClientAggregates: %v", err)
+	}
+	means := beam.CombinePerKey(s, meanFn, partialKV)
+	reportNoiseDraws(s, means)
+	if params.PublicPartitions == nil {
+		// Drop thresholded partitions.
+		return beam.ParDo(s, dropThresholdedPartitionsFloat64, means)
+	}
+	// Add noisy means for empty public partitions.
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	boundedMeanFn, err := newBoundedMeanFn(*spec, params, noiseKind, true, true)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedMeanFn for MeanPerKeyFromClientAggregates: %v", err)
+	}
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, boundedMeanFn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	return mergeMeansWithEmptyPublicPartitions(s, means, noisyEmptyPublicPartitions)
+}
+
+// mergeClientAggregates merges two client aggregates of the same privacy
+// identifier and partition.
+func mergeClientAggregates(a, b ClientAggregate) ClientAggregate {
+	return ClientAggregate{Sum: a.Sum + b.Sum, Count: a.Count + b.Count}
+}
+
+// pairClientAggregate contains an encoded partition key and a client aggregate.
+type pairClientAggregate struct {
+	K []byte
+	M ClientAggregate
+}
+
+// rekeyClientAggregate transforms a PCollection<kv.Pair<codedK,codedV>,ClientAggregate> into a
+// PCollection<codedK,pairClientAggregate<codedV,ClientAggregate>>.
+func rekeyClientAggregate(kv kv.Pair, m ClientAggregate) ([]byte, pairClientAggregate) {
+	return kv.K, pairClientAggregate{kv.V, m}
+}
+
+// decodePairClientAggregateFn transforms a PCollection<pairClientAggregate<codedK,ClientAggregate>> into a
+// PCollection<K,ClientAggregate>.
+type decodePairClientAggregateFn struct {
+	KType beam.EncodedType
+	kDec  beam.ElementDecoder
+}
+
+func newDecodePairClientAggregateFn(t reflect.Type) *decodePairClientAggregateFn {
+	return &decodePairClientAggregateFn{KType: beam.EncodedType{t}}
+}
+
+func (fn *decodePairClientAggregateFn) Setup() {
+	fn.kDec = beam.NewElementDecoder(fn.KType.T)
+}
+
+func (fn *decodePairClientAggregateFn) ProcessElement(pair pairClientAggregate) (beam.W, ClientAggregate, error) {
+	k, err := fn.kDec.Decode(bytes.NewBuffer(pair.K))
+	if err != nil {
+		return nil, ClientAggregate{}, fmt.Errorf("pbeam.decodePairClientAggregateFn.ProcessElement: couldn't decode pair %v: %w", pair, err)
+	}
+	return k, pair.M, nil
+}
+
+// clientAggregateMeanFn is a differentially private combineFn for obtaining
+// the mean of client aggregates. It only differs from boundedMeanFn in how
+// inputs are added. Do not initialize it yourself, use
+// newClientAggregateMeanFn to create a clientAggregateMeanFn instance.
+type clientAggregateMeanFn struct {
+	MeanFn *boundedMeanFn
+}
+
+// newClientAggregateMeanFn returns a clientAggregateMeanFn with the given budget and parameters.
+func newClientAggregateMeanFn(spec PrivacySpec, params MeanParams, noiseKind noise.Kind, publicPartitions bool) (*clientAggregateMeanFn, error) {
+	meanFn, err := newBoundedMeanFn(spec, params, noiseKind, publicPartitions, false)
+	if err != nil {
+		return nil, err
+	}
+	if spec.testMode == TestModeWithoutContributionBounding {
+		// Counts of client aggregates are capped to MaxContributionsPerPartition
+		// by the underlying BoundedMean, which we disable in this test mode.
+		meanFn.MaxContributionsPerPartition = math.MaxInt64
+	}
+	return &clientAggregateMeanFn{MeanFn: meanFn}, nil
+}
+
+func (fn *clientAggregateMeanFn) Setup() {
+	fn.MeanFn.Setup()
+}
+
+func (fn *clientAggregateMeanFn) CreateAccumulator() (boundedMeanAccum, error) {
+	return fn.MeanFn.CreateAccumulator()
+}
+
+func (fn *clientAggregateMeanFn) AddInput(a boundedMeanAccum, agg ClientAggregate) (boundedMeanAccum, error) {
+	// Each input is the merged aggregate of a single privacy identifier, so we
+	// add a single input for it to SelectPartition.
+	err := a.BM.AddPreAggregated(agg.Sum, agg.Count)
+	if err != nil {
+		return a, err
+	}
+	if !fn.MeanFn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *clientAggregateMeanFn) MergeAccumulators(a, b boundedMeanAccum) (boundedMeanAccum, error) {
+	return fn.MeanFn.MergeAccumulators(a, b)
+}
+
+func (fn *clientAggregateMeanFn) ExtractOutput(a boundedMeanAccum) (*float64, error) {
+	return fn.MeanFn.ExtractOutput(a)
+}
+
+func (fn *clientAggregateMeanFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
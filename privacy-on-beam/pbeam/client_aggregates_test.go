@@ -0,0 +1,151 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[clientReport, int, clientReport](extractIDFromClientReport)
+	register.Function1x2[clientReport, int, ClientAggregate](clientReportToKV)
+}
+
+// clientReport is a ClientAggregate sent by a client for a given partition.
+type clientReport struct {
+	ID        int
+	Partition int
+	Agg       ClientAggregate
+}
+
+func extractIDFromClientReport(r clientReport) (int, clientReport) {
+	return r.ID, r
+}
+
+func clientReportToKV(r clientReport) (int, ClientAggregate) {
+	return r.Partition, r.Agg
+}
+
+func TestEncodeDecodeClientAggregate(t *testing.T) {
+	want := ClientAggregate{Sum: -12.5, Count: 7}
+	got, err := DecodeClientAggregate(EncodeClientAggregate(want))
+	if err != nil {
+		t.Fatalf("DecodeClientAggregate: %v", err)
+	}
+	if got != want {
+		t.Errorf("DecodeClientAggregate(EncodeClientAggregate(%v)) = %v, want %v", want, got, want)
+	}
+}
+
+func TestDecodeClientAggregateErrors(t *testing.T) {
+	wrongVersion := EncodeClientAggregate(ClientAggregate{Sum: 1, Count: 1})
+	wrongVersion[0] = 42
+	for _, tc := range []struct {
+		desc    string
+		encoded []byte
+	}{
+		{"empty input", nil},
+		{"truncated input", EncodeClientAggregate(ClientAggregate{Sum: 1, Count: 1})[:9]},
+		{"unsupported version", wrongVersion},
+		{"NaN sum", EncodeClientAggregate(ClientAggregate{Sum: math.NaN(), Count: 1})},
+		{"infinite sum", EncodeClientAggregate(ClientAggregate{Sum: math.Inf(1), Count: 1})},
+		{"negative count", EncodeClientAggregate(ClientAggregate{Sum: 1, Count: -1})},
+	} {
+		if _, err := DecodeClientAggregate(tc.encoded); err == nil {
+			t.Errorf("With %s, DecodeClientAggregate returned no error", tc.desc)
+		}
+	}
+}
+
+func TestMeanPerKeyFromClientAggregates(t *testing.T) {
+	for _, tc := range []struct {
+		desc             string
+		publicPartitions any
+		want             []testutils.PairIF64
+	}{
+		{
+			desc: "partition selection",
+			want: []testutils.PairIF64{{Key: 0, Value: 25.0 / 3}},
+		},
+		{
+			desc:             "public partitions",
+			publicPartitions: []int{0, 1},
+			// The mean of the empty partition 1 is the midpoint of [MinValue, MaxValue].
+			want: []testutils.PairIF64{{Key: 0, Value: 25.0 / 3}, {Key: 1, Value: 10}},
+		},
+	} {
+		reports := []clientReport{
+			// Privacy unit 0 sends two aggregates for partition 0, which are merged into
+			// {Sum: 10, Count: 4}, then capped to {Sum: 5, Count: 2}.
+			{ID: 0, Partition: 0, Agg: ClientAggregate{Sum: 6, Count: 2}},
+			{ID: 0, Partition: 0, Agg: ClientAggregate{Sum: 4, Count: 2}},
+			// The sum of privacy unit 1 is clamped to Count*MaxValue = 20.
+			{ID: 1, Partition: 0, Agg: ClientAggregate{Sum: 30, Count: 1}},
+		}
+		p, s, col, want := ptest.CreateList2(reports, tc.want)
+		col = beam.ParDo(s, extractIDFromClientReport, col)
+
+		pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+		pcol = ParDo(s, clientReportToKV, pcol)
+		params := MeanParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 2,
+			MinValue:                     0,
+			MaxValue:                     20,
+			PublicPartitions:             tc.publicPartitions,
+		}
+		got := MeanPerKeyFromClientAggregates(s, pcol, params)
+
+		want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+		testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-10)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("MeanPerKeyFromClientAggregates with %s: %v", tc.desc, err)
+		}
+	}
+}
+
+func TestMeanPerKeyFromClientAggregatesDeferValidationErrors(t *testing.T) {
+	p, s, col := ptest.CreateList([]clientReport{{ID: 0, Partition: 0, Agg: ClientAggregate{Sum: 1, Count: 1}}})
+	col = beam.ParDo(s, extractIDFromClientReport, col)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+	pcol := ParDo(s, clientReportToKV, MakePrivate(s, col, spec))
+	// MinValue must not be larger than MaxValue.
+	MeanPerKeyFromClientAggregates(s, pcol, MeanParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     20,
+		MaxValue:                     0,
+		PublicPartitions:             []int{0},
+	})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "MeanPerKeyFromClientAggregates" {
+		t.Errorf("ValidationErrors() = %v, want a single error for MeanPerKeyFromClientAggregates", errs)
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestMeanPerKeyFromClientAggregatesDeferValidationErrors: pipeline with an invalid MeanPerKeyFromClientAggregates succeeded, expected an error")
+	}
+}
@@ -18,7 +18,11 @@ package pbeam
 
 import (
 	"bytes"
+	"compress/flate"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
+	"math"
 	"reflect"
 
 	"github.com/apache/beam/sdks/v2/go/pkg/beam"
@@ -28,13 +32,29 @@ import (
 
 func init() {
 	beam.RegisterCoder(reflect.TypeOf(countAccum{}), encodeCountAccum, decodeCountAccum)
+	beam.RegisterCoder(reflect.TypeOf(aggregateAccum{}), encodeAggregateAccum, decodeAggregateAccum)
 	beam.RegisterCoder(reflect.TypeOf(boundedSumAccumInt64{}), encodeBoundedSumAccumInt64, decodeBoundedSumAccumInt64)
 	beam.RegisterCoder(reflect.TypeOf(boundedSumAccumFloat64{}), encodeBoundedSumAccumFloat64, decodeBoundedSumAccumFloat64)
 	beam.RegisterCoder(reflect.TypeOf(boundedMeanAccum{}), encodeBoundedMeanAccum, decodeBoundedMeanAccum)
+	beam.RegisterCoder(reflect.TypeOf(weightedMeanAccum{}), encodeWeightedMeanAccum, decodeWeightedMeanAccum)
+	beam.RegisterCoder(reflect.TypeOf(ratioOfSumsAccum{}), encodeRatioOfSumsAccum, decodeRatioOfSumsAccum)
 	beam.RegisterCoder(reflect.TypeOf(boundedQuantilesAccum{}), encodeBoundedQuantilesAccum, decodeBoundedQuantilesAccum)
+	beam.RegisterCoder(reflect.TypeOf(boundedStandardDeviationAccum{}), encodeBoundedStandardDeviationAccum, decodeBoundedStandardDeviationAccum)
+	beam.RegisterCoder(reflect.TypeOf(boundedMomentAccum{}), encodeBoundedMomentAccum, decodeBoundedMomentAccum)
+	beam.RegisterCoder(reflect.TypeOf(histogramAccum{}), encodeHistogramAccum, decodeHistogramAccum)
+	beam.RegisterCoder(reflect.TypeOf(modeAccum{}), encodeModeAccum, decodeModeAccum)
+	beam.RegisterCoder(reflect.TypeOf(argMaxAccum{}), encodeArgMaxAccum, decodeArgMaxAccum)
+	beam.RegisterCoder(reflect.TypeOf(profileRowsAccum{}), encodeProfileRowsAccum, decodeProfileRowsAccum)
+	beam.RegisterCoder(reflect.TypeOf(profileAccum{}), encodeProfileAccum, decodeProfileAccum)
 	beam.RegisterCoder(reflect.TypeOf(expandValuesAccum{}), encodeExpandValuesAccum, decodeExpandValuesAccum)
 	beam.RegisterCoder(reflect.TypeOf(expandFloat64ValuesAccum{}), encodeExpandFloat64ValuesAccum, decodeExpandFloat64ValuesAccum)
+	beam.RegisterCoder(reflect.TypeOf(expandWeightedValuesAccum{}), encodeExpandWeightedValuesAccum, decodeExpandWeightedValuesAccum)
 	beam.RegisterCoder(reflect.TypeOf(partitionSelectionAccum{}), encodePartitionSelectionAccum, decodePartitionSelectionAccum)
+	beam.RegisterCoder(reflect.TypeOf(countMinSketchAccum{}), encodeCountMinSketchAccum, decodeCountMinSketchAccum)
+
+	beam.RegisterCoder(reflect.TypeOf(pairInt64{}), encodePairInt64, decodePairInt64)
+	beam.RegisterCoder(reflect.TypeOf(pairFloat64{}), encodePairFloat64, decodePairFloat64)
+	beam.RegisterCoder(reflect.TypeOf(pairArrayFloat64{}), encodePairArrayFloat64, decodePairArrayFloat64)
 }
 
 func encodeCountAccum(ca countAccum) ([]byte, error) {
@@ -47,6 +67,16 @@ func decodeCountAccum(data []byte) (countAccum, error) {
 	return ret, err
 }
 
+func encodeAggregateAccum(v aggregateAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeAggregateAccum(data []byte) (aggregateAccum, error) {
+	var ret aggregateAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
 func encodeBoundedSumAccumInt64(v boundedSumAccumInt64) ([]byte, error) {
 	return encode(v)
 }
@@ -77,6 +107,96 @@ func decodeBoundedMeanAccum(data []byte) (boundedMeanAccum, error) {
 	return ret, err
 }
 
+func encodeWeightedMeanAccum(v weightedMeanAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeWeightedMeanAccum(data []byte) (weightedMeanAccum, error) {
+	var ret weightedMeanAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeRatioOfSumsAccum(v ratioOfSumsAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeRatioOfSumsAccum(data []byte) (ratioOfSumsAccum, error) {
+	var ret ratioOfSumsAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeBoundedStandardDeviationAccum(v boundedStandardDeviationAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeBoundedStandardDeviationAccum(data []byte) (boundedStandardDeviationAccum, error) {
+	var ret boundedStandardDeviationAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeBoundedMomentAccum(v boundedMomentAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeBoundedMomentAccum(data []byte) (boundedMomentAccum, error) {
+	var ret boundedMomentAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeHistogramAccum(v histogramAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeHistogramAccum(data []byte) (histogramAccum, error) {
+	var ret histogramAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeModeAccum(v modeAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeModeAccum(data []byte) (modeAccum, error) {
+	var ret modeAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeArgMaxAccum(v argMaxAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeArgMaxAccum(data []byte) (argMaxAccum, error) {
+	var ret argMaxAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeProfileRowsAccum(v profileRowsAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeProfileRowsAccum(data []byte) (profileRowsAccum, error) {
+	var ret profileRowsAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodeProfileAccum(v profileAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeProfileAccum(data []byte) (profileAccum, error) {
+	var ret profileAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
 func encodeBoundedQuantilesAccum(v boundedQuantilesAccum) ([]byte, error) {
 	return encode(v)
 }
@@ -87,14 +207,52 @@ func decodeBoundedQuantilesAccum(data []byte) (boundedQuantilesAccum, error) {
 	return ret, err
 }
 
+// Formats of encoded expandValuesAccums, written in their first byte.
+const (
+	gobFormat        byte = iota // Encoded with gob.
+	deflateGobFormat             // Encoded with gob, and compressed with DEFLATE.
+)
+
+// encodeExpandValuesAccum compresses v if v.Compress is set. Accumulators hold
+// all the encoded values of a privacy unit in a partition, so they can be large.
 func encodeExpandValuesAccum(v expandValuesAccum) ([]byte, error) {
-	return encode(v)
+	var buf bytes.Buffer
+	if !v.Compress {
+		buf.WriteByte(gobFormat)
+		err := gob.NewEncoder(&buf).Encode(v)
+		return buf.Bytes(), err
+	}
+	buf.WriteByte(deflateGobFormat)
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewEncoder(w).Encode(v); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func decodeExpandValuesAccum(data []byte) (expandValuesAccum, error) {
 	var ret expandValuesAccum
-	err := decode(&ret, data)
-	return ret, err
+	if len(data) == 0 {
+		return ret, fmt.Errorf("couldn't decode expandValuesAccum: no data")
+	}
+	switch data[0] {
+	case gobFormat:
+		err := decode(&ret, data[1:])
+		return ret, err
+	case deflateGobFormat:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+		err := gob.NewDecoder(r).Decode(&ret)
+		return ret, err
+	default:
+		return ret, fmt.Errorf("couldn't decode expandValuesAccum: unknown format %d", data[0])
+	}
 }
 
 func encodeExpandFloat64ValuesAccum(v expandFloat64ValuesAccum) ([]byte, error) {
@@ -107,6 +265,16 @@ func decodeExpandFloat64ValuesAccum(data []byte) (expandFloat64ValuesAccum, erro
 	return ret, err
 }
 
+func encodeExpandWeightedValuesAccum(v expandWeightedValuesAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodeExpandWeightedValuesAccum(data []byte) (expandWeightedValuesAccum, error) {
+	var ret expandWeightedValuesAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
 func encodePartitionSelectionAccum(v partitionSelectionAccum) ([]byte, error) {
 	return encode(v)
 }
@@ -117,6 +285,106 @@ func decodePartitionSelectionAccum(data []byte) (partitionSelectionAccum, error)
 	return ret, err
 }
 
+func encodeCountMinSketchAccum(a countMinSketchAccum) ([]byte, error) {
+	return encode(a)
+}
+
+func decodeCountMinSketchAccum(data []byte) (countMinSketchAccum, error) {
+	var ret countMinSketchAccum
+	err := decode(&ret, data)
+	return ret, err
+}
+
+// Coders for the pairs of encoded partition keys and metrics. These dominate
+// the data shuffled by aggregations, so they are encoded compactly instead of
+// with gob: K is prefixed by its length as a uvarint, int64 metrics are encoded
+// as varints, and float64 metrics as 8 little-endian bytes.
+
+func encodePairInt64(p pairInt64) ([]byte, error) {
+	b := appendLengthPrefixed(make([]byte, 0, 2*binary.MaxVarintLen64+len(p.K)), p.K)
+	return binary.AppendVarint(b, p.M), nil
+}
+
+func decodePairInt64(data []byte) (pairInt64, error) {
+	k, data, err := readLengthPrefixed(data)
+	if err != nil {
+		return pairInt64{}, fmt.Errorf("couldn't decode pairInt64: %v", err)
+	}
+	m, n := binary.Varint(data)
+	if n <= 0 || n != len(data) {
+		return pairInt64{}, fmt.Errorf("couldn't decode pairInt64: invalid metric")
+	}
+	return pairInt64{K: k, M: m}, nil
+}
+
+func encodePairFloat64(p pairFloat64) ([]byte, error) {
+	b := appendLengthPrefixed(make([]byte, 0, binary.MaxVarintLen64+len(p.K)+8), p.K)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(p.M)), nil
+}
+
+func decodePairFloat64(data []byte) (pairFloat64, error) {
+	k, data, err := readLengthPrefixed(data)
+	if err != nil {
+		return pairFloat64{}, fmt.Errorf("couldn't decode pairFloat64: %v", err)
+	}
+	if len(data) != 8 {
+		return pairFloat64{}, fmt.Errorf("couldn't decode pairFloat64: got %d bytes for the metric, want 8", len(data))
+	}
+	return pairFloat64{K: k, M: math.Float64frombits(binary.LittleEndian.Uint64(data))}, nil
+}
+
+func encodePairArrayFloat64(p pairArrayFloat64) ([]byte, error) {
+	b := appendLengthPrefixed(make([]byte, 0, 2*binary.MaxVarintLen64+len(p.K)+8*len(p.M)), p.K)
+	b = binary.AppendUvarint(b, uint64(len(p.M)))
+	for _, m := range p.M {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(m))
+	}
+	return b, nil
+}
+
+func decodePairArrayFloat64(data []byte) (pairArrayFloat64, error) {
+	k, data, err := readLengthPrefixed(data)
+	if err != nil {
+		return pairArrayFloat64{}, fmt.Errorf("couldn't decode pairArrayFloat64: %v", err)
+	}
+	l, n := binary.Uvarint(data)
+	if n <= 0 || l != uint64(len(data)-n)/8 || (len(data)-n)%8 != 0 {
+		return pairArrayFloat64{}, fmt.Errorf("couldn't decode pairArrayFloat64: invalid metrics")
+	}
+	data = data[n:]
+	p := pairArrayFloat64{K: k}
+	if l > 0 {
+		p.M = make([]float64, l)
+		for i := range p.M {
+			p.M[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+	}
+	return p, nil
+}
+
+// appendLengthPrefixed appends the length of v as a uvarint to b, followed by v.
+func appendLengthPrefixed(b, v []byte) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(v))), v...)
+}
+
+// readLengthPrefixed reads a byte slice encoded by appendLengthPrefixed from
+// data, and returns it with the rest of data. The returned slice is nil if it is
+// empty.
+func readLengthPrefixed(data []byte) (v, rest []byte, err error) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("invalid length prefix")
+	}
+	data = data[n:]
+	if l > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("length prefix is %d, but only %d bytes are left", l, len(data))
+	}
+	if l > 0 {
+		v = data[:l]
+	}
+	return v, data[l:], nil
+}
+
 func encode(v any) ([]byte, error) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -0,0 +1,116 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPairCoders(t *testing.T) {
+	for _, p := range []pairInt64{
+		{K: []byte{1, 2}, M: 42},
+		{K: []byte{1}, M: math.MinInt64},
+		{M: math.MaxInt64},
+	} {
+		data, err := encodePairInt64(p)
+		if err != nil {
+			t.Fatalf("encodePairInt64(%v): got error %v", p, err)
+		}
+		got, err := decodePairInt64(data)
+		if err != nil {
+			t.Fatalf("decodePairInt64(encodePairInt64(%v)): got error %v", p, err)
+		}
+		if diff := cmp.Diff(p, got); diff != "" {
+			t.Errorf("decodePairInt64(encodePairInt64(%v)): got diff (-want +got):\n%s", p, diff)
+		}
+		if _, err := decodePairInt64(data[:len(data)-1]); err == nil {
+			t.Errorf("decodePairInt64 with truncated encoding of %v: got no error", p)
+		}
+	}
+
+	for _, p := range []pairFloat64{
+		{K: []byte{1, 2}, M: 4.2},
+		{K: []byte{1}, M: math.Inf(-1)},
+		{M: -0.5},
+	} {
+		data, err := encodePairFloat64(p)
+		if err != nil {
+			t.Fatalf("encodePairFloat64(%v): got error %v", p, err)
+		}
+		got, err := decodePairFloat64(data)
+		if err != nil {
+			t.Fatalf("decodePairFloat64(encodePairFloat64(%v)): got error %v", p, err)
+		}
+		if diff := cmp.Diff(p, got); diff != "" {
+			t.Errorf("decodePairFloat64(encodePairFloat64(%v)): got diff (-want +got):\n%s", p, diff)
+		}
+		if _, err := decodePairFloat64(data[:len(data)-1]); err == nil {
+			t.Errorf("decodePairFloat64 with truncated encoding of %v: got no error", p)
+		}
+	}
+
+	for _, p := range []pairArrayFloat64{
+		{K: []byte{1, 2}, M: []float64{1, -2.5, 3}},
+		{K: []byte{1}},
+		{M: []float64{0}},
+	} {
+		data, err := encodePairArrayFloat64(p)
+		if err != nil {
+			t.Fatalf("encodePairArrayFloat64(%v): got error %v", p, err)
+		}
+		got, err := decodePairArrayFloat64(data)
+		if err != nil {
+			t.Fatalf("decodePairArrayFloat64(encodePairArrayFloat64(%v)): got error %v", p, err)
+		}
+		if diff := cmp.Diff(p, got); diff != "" {
+			t.Errorf("decodePairArrayFloat64(encodePairArrayFloat64(%v)): got diff (-want +got):\n%s", p, diff)
+		}
+		if _, err := decodePairArrayFloat64(data[:len(data)-1]); err == nil {
+			t.Errorf("decodePairArrayFloat64 with truncated encoding of %v: got no error", p)
+		}
+	}
+}
+
+func TestExpandValuesAccumCoder(t *testing.T) {
+	values := make([][]byte, 100)
+	for i := range values {
+		values[i] = bytes.Repeat([]byte{byte(i % 3)}, 50)
+	}
+	var sizes []int
+	for _, compress := range []bool{false, true} {
+		a := expandValuesAccum{Values: values, Compress: compress}
+		data, err := encodeExpandValuesAccum(a)
+		if err != nil {
+			t.Fatalf("encodeExpandValuesAccum with compress=%t: got error %v", compress, err)
+		}
+		got, err := decodeExpandValuesAccum(data)
+		if err != nil {
+			t.Fatalf("decodeExpandValuesAccum with compress=%t: got error %v", compress, err)
+		}
+		if diff := cmp.Diff(a, got); diff != "" {
+			t.Errorf("decodeExpandValuesAccum(encodeExpandValuesAccum(a)) with compress=%t: got diff (-want +got):\n%s", compress, diff)
+		}
+		sizes = append(sizes, len(data))
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("Compressed accumulator has %d bytes, want less than the %d bytes of the uncompressed one", sizes[1], sizes[0])
+	}
+}
@@ -104,6 +104,36 @@ type CountParams struct {
 	//
 	// Optional.
 	AllowNegativeOutputs bool
+	// Aggregates the counts of all the partitions that fail partition
+	// selection into a single "other" partition, instead of dropping them.
+	// See LongTailParams for details.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// Optional.
+	LongTail LongTailParams
+	// Also emits the total of the counts of all partitions as a separate
+	// partition. See TotalParams for details.
+	//
+	// Optional.
+	Total TotalParams
+	// Post-processing steps applied, in order, to the noisy outputs. They are
+	// applied after negative outputs are clamped to zero, if they are. See
+	// PostProcessor for details.
+	//
+	// Optional.
+	PostProcessing []PostProcessor
+	// Minimum number of privacy units that each released count must be based
+	// on, for rules requiring both differential privacy and a minimum
+	// aggregate size (in the style of k-anonymity). Partition selection keeps
+	// a partition only if at least MinAggregateSize privacy units contribute to
+	// it, as with PrivacySpecParams.PreThreshold, and noisy counts smaller than
+	// MinAggregateSize are dropped, before PostProcessing.
+	//
+	// If set, PublicPartitions and LongTail need to be left unset.
+	//
+	// Optional.
+	MinAggregateSize int64
 }
 
 // Count counts the number of times a value appears in a PrivatePCollection,
@@ -120,65 +150,77 @@ type CountParams struct {
 //
 // Count transforms a PrivatePCollection<V> into a PCollection<V, int64>.
 func Count(s beam.Scope, pcol PrivatePCollection, params CountParams) beam.PCollection {
+	return countWithDerivation(s, pcol, params, nil, nil)
+}
+
+// countWithDerivation is Count, reporting the derivation of its
+// AggregationEpsilon from an accuracy target, if any, when the aggregation is
+// registered. If budget isn't nil, it is the budget of params, reserved and
+// committed by an aggregation built on top of Count, e.g. Rate, and Count
+// doesn't consume it again.
+func countWithDerivation(s beam.Scope, pcol PrivatePCollection, params CountParams, derivation *AccuracyDerivation, budget *reservedBudget) beam.PCollection {
 	s = s.Scope("pbeam.Count")
+	pcol = extractTaggedStructFields(s, pcol, false)
 	// Obtain type information from the underlying PCollection<K,V>.
-	idT, partitionT := beam.ValidateKVType(pcol.col)
+	_, partitionT := beam.ValidateKVType(pcol.col)
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "Count", err, partitionT.Type(), reflect.TypeOf(int64(0)))
+	}
 
 	// Get privacy parameters.
 	spec := pcol.privacySpec
-	var err error
-	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
+	err := consumeLongTailBudget(spec, &params.LongTail)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume LongTail aggregation budget for Count: %v", err))
+	}
+	err = consumeTotalBudget(spec, &params.Total)
 	if err != nil {
-		log.Fatalf("Couldn't consume aggregation budget for Count: %v", err)
+		return invalid(fmt.Errorf("Couldn't consume Total aggregation budget for Count: %v", err))
 	}
-	if params.PublicPartitions == nil {
-		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.consume(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+	if budget == nil {
+		params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
 		if err != nil {
-			log.Fatalf("Couldn't consume partition selection budget for Count: %v", err)
+			return invalid(fmt.Errorf("Couldn't consume aggregation budget for Count: %v", err))
+		}
+		if params.PublicPartitions == nil {
+			params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.consume(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+			if err != nil {
+				return invalid(fmt.Errorf("Couldn't consume partition selection budget for Count: %v", err))
+			}
 		}
 	}
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
-	}
-
-	err = checkCountParams(params, noiseKind, partitionT.Type())
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
 	if err != nil {
-		log.Fatalf("pbeam.Count: %v", err)
+		return invalid(fmt.Errorf("pbeam.Count: %v", err))
+	}
+	if params.LongTail.Partition != nil || params.Total.Partition != nil {
+		err = spec.checkNoNoiseSeedKey("Count with LongTail or Total")
+		if err != nil {
+			return invalid(fmt.Errorf("pbeam.Count: %v", err))
+		}
 	}
 
-	// Drop non-public partitions, if public partitions are specified.
-	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, partitionT.Type())
+	err = checkCountParams(params, noiseKind, partitionT.Type())
 	if err != nil {
-		log.Fatalf("Couldn't drop non-public partitions for Count: %v", err)
+		return invalid(fmt.Errorf("pbeam.Count: %v", err))
 	}
+	spec.aggregationRegisteredWithAccuracy("Count", derivation, params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+	return count(s, pcol, params, noiseKind)
+}
 
-	// First, encode KV pairs, count how many times each one appears,
-	// and re-key by the original privacy key.
-	coded := beam.ParDo(s, kv.NewEncodeFn(idT, partitionT), pcol.col)
-	kvCounts := stats.Count(s, coded)
-	counts64 := beam.ParDo(s, convertToInt64Fn, kvCounts)
-	rekeyed := beam.ParDo(s, rekeyInt64, counts64)
-	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
-	if spec.testMode != TestModeWithoutContributionBounding {
-		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
-	}
-	// Third, now that contribution bounding is done, remove the privacy keys,
-	// decode the value, and sum all the counts bounded by MaxValue.
-	countPairs := beam.DropKey(s, rekeyed)
-	countsKV := beam.ParDo(s,
-		newDecodePairInt64Fn(partitionT.Type()),
-		countPairs,
-		beam.TypeDefinition{Var: beam.WType, T: partitionT.Type()})
+// count computes Count on pcol, whose budget must already be consumed and
+// params checked.
+func count(s beam.Scope, pcol PrivatePCollection, params CountParams, noiseKind noise.Kind) beam.PCollection {
+	_, partitionT := beam.ValidateKVType(pcol.col)
+	spec := withMinAggregateSize(pcol.privacySpec, params.MinAggregateSize)
+	countsKV := boundedCountsKV(s, spec, pcol, params)
 
 	var result beam.PCollection
 	// Add public partitions and compute the aggregation output, if public partitions are specified.
 	if params.PublicPartitions != nil {
 		result = addPublicPartitionsForCount(s, *spec, params, noiseKind, countsKV)
+		result = addSeededNoise(s, *spec, noiseKind, params.AggregationEpsilon, params.AggregationDelta, params.MaxPartitionsContributed, 0, float64(params.MaxValue), reflect.Int64, partitionT.Type(), result)
 	} else {
 		boundedSumFn, err := newBoundedSumInt64Fn(*spec, countToSumParams(params), noiseKind, false)
 		if err != nil {
@@ -187,16 +229,55 @@ func Count(s beam.Scope, pcol PrivatePCollection, params CountParams) beam.PColl
 		sums := beam.CombinePerKey(s,
 			boundedSumFn,
 			countsKV)
+		sums = traceStage(s, *spec, "Count.aggregate", sums)
+		reportNoiseDraws(s, sums)
 		// Drop thresholded partitions.
 		result = beam.ParDo(s, dropThresholdedPartitionsInt64, sums)
+		result = addSeededNoise(s, *spec, noiseKind, params.AggregationEpsilon, params.AggregationDelta, params.MaxPartitionsContributed, 0, float64(params.MaxValue), reflect.Int64, partitionT.Type(), result)
+		if params.LongTail.Partition != nil {
+			result = addLongTailPartition(s, *spec, params.LongTail, noiseKind, params.MaxPartitionsContributed, 0, float64(params.MaxValue), reflect.Int64, countsKV, sums, result)
+		}
 	}
 
-	if !params.AllowNegativeOutputs {
-		// Clamp negative counts to zero.
-		result = beam.ParDo(s, clampNegativePartitionsInt64, result)
+	if params.Total.Partition != nil {
+		result = addTotalPartition(s, *spec, params.Total, noiseKind, params.MaxPartitionsContributed, 0, float64(params.MaxValue), reflect.Int64, countsKV, result)
 	}
 
-	return result
+	return postProcessOutputs(s, result, !params.AllowNegativeOutputs, minAggregateSizeSteps(params.MinAggregateSize, params.PostProcessing))
+}
+
+// boundedCountsKV returns a PCollection<K,int64> with the number of
+// contributions of each privacy identifier to each partition of pcol, after
+// contribution bounding.
+func boundedCountsKV(s beam.Scope, spec *PrivacySpec, pcol PrivatePCollection, params CountParams) beam.PCollection {
+	idT, partitionT := beam.ValidateKVType(pcol.col)
+
+	// Drop non-public partitions, if public partitions are specified.
+	var err error
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, partitionT.Type())
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for Count: %v", err)
+	}
+
+	// First, encode KV pairs, count how many times each one appears,
+	// and re-key by the original privacy key.
+	coded := beam.ParDo(s, kv.NewEncodeFn(idT, partitionT), pcol.col)
+	coded = saltPrivacyIDs(s, spec, coded)
+	kvCounts := stats.Count(s, coded)
+	counts64 := convertValues(s, spec, reflect.Int64, kvCounts)
+	rekeyed := beam.ParDo(s, rekeyInt64, counts64)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "Count.boundContributions", rekeyed)
+	}
+	// Third, now that contribution bounding is done, remove the privacy keys
+	// and decode the value.
+	countPairs := beam.DropKey(s, rekeyed)
+	return beam.ParDo(s,
+		newDecodePairInt64Fn(partitionT.Type()),
+		countPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT.Type()})
 }
 
 func checkCountParams(params CountParams, noiseKind noise.Kind, partitionType reflect.Type) error {
@@ -227,6 +308,18 @@ func checkCountParams(params CountParams, noiseKind noise.Kind, partitionType re
 	if params.MaxValue <= 0 {
 		return fmt.Errorf("MaxValue should be strictly positive, got %d", params.MaxValue)
 	}
+	err = checkLongTailParams(params.LongTail, params.PublicPartitions, noiseKind, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkTotalParams(params.Total, params.LongTail, noiseKind, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkMinAggregateSize(params.MinAggregateSize, params.PublicPartitions, params.LongTail)
+	if err != nil {
+		return err
+	}
 	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
 }
 
@@ -246,6 +339,8 @@ func addPublicPartitionsForCount(s beam.Scope, spec PrivacySpec, params CountPar
 		log.Fatalf("Couldn't get boundedSumInt64Fn for Count: %v", err)
 	}
 	sums := beam.CombinePerKey(s, boundedSumFn, allPartitions)
+	sums = traceStage(s, spec, "Count.aggregate", sums)
+	reportNoiseDraws(s, sums)
 	return beam.ParDo(s, dereferenceValueInt64, sums)
 }
 
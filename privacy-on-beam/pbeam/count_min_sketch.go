@@ -0,0 +1,248 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(dpagg.NoisyCountMinSketch{}))
+	register.Combiner3[countMinSketchAccum, pairInt64, dpagg.NoisyCountMinSketch](&countMinSketchFn{})
+	register.DoFn2x3[beam.T, dpagg.NoisyCountMinSketch, beam.T, int64, error](&estimateFrequencyFn{})
+}
+
+// CountMinSketchParams specifies the parameters associated with a
+// CountMinSketch aggregation.
+type CountMinSketchParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget reserved for aggregation in the PrivacySpec is
+	// consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// The maximum number of distinct keys that a given privacy identifier can
+	// contribute to. If a privacy identifier is associated with more keys,
+	// random keys will be dropped. Each key of a privacy identifier changes
+	// Depth cells of the sketch, so the noise added to each cell is scaled
+	// according to MaxPartitionsContributed*Depth.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of times that a given privacy identifier can
+	// contribute to a single key. Additional contributions are dropped.
+	//
+	// Defaults to 1.
+	MaxContributionsPerPartition int64
+	// Number of cells of each row of the sketch. The larger it is, the less
+	// estimates overcount keys due to collisions with other keys.
+	//
+	// Required.
+	Width int64
+	// Number of rows of the sketch, i.e. of hash functions.
+	//
+	// Required.
+	Depth int64
+}
+
+// CountMinSketch computes a differentially private count-min sketch of the
+// values in a PrivatePCollection, to estimate the frequency of values over
+// domains that are too large for a Count of each value, or whose values
+// aren't known in advance. Unlike Count, it doesn't need partition selection:
+// noise is added to every cell of the sketch, and the sketch can be queried
+// for any value with EstimateFrequencies.
+//
+// See dpagg.CountMinSketch for details about the accuracy of the sketch.
+//
+// CountMinSketch transforms a PrivatePCollection<V> into a
+// PCollection<dpagg.NoisyCountMinSketch> with a single element.
+func CountMinSketch(s beam.Scope, pcol PrivatePCollection, params CountMinSketchParams) beam.PCollection {
+	s = s.Scope("pbeam.CountMinSketch")
+	pcol = extractTaggedStructFields(s, pcol, false)
+	idT, valueT := beam.ValidateKVType(pcol.col)
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "CountMinSketch", err, reflect.TypeOf(dpagg.NoisyCountMinSketch{}))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	var err error
+	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume aggregation budget for CountMinSketch: %v", err))
+	}
+	noiseKind, err := spec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.CountMinSketch: %v", err))
+	}
+	err = spec.checkNoNoiseSeedKey("CountMinSketch")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.CountMinSketch: %v", err))
+	}
+	if params.MaxContributionsPerPartition == 0 {
+		params.MaxContributionsPerPartition = 1
+	}
+	fn := newCountMinSketchFn(params, noiseKind, spec.testMode)
+	// Creating an accumulator checks the parameters.
+	fn.Setup()
+	if _, err := fn.CreateAccumulator(); err != nil {
+		return invalid(fmt.Errorf("pbeam.CountMinSketch: %v", err))
+	}
+	spec.aggregationRegistered("CountMinSketch", params.AggregationEpsilon, params.AggregationDelta, 0, 0)
+
+	// Count the contributions of each privacy identifier to each value, and
+	// bound the number of values each privacy identifier contributes to.
+	coded := beam.ParDo(s, kv.NewEncodeFn(idT, valueT), pcol.col)
+	kvCounts := stats.Count(s, coded)
+	counts64 := convertValues(s, spec, reflect.Int64, kvCounts)
+	rekeyed := beam.ParDo(s, rekeyInt64, counts64)
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "CountMinSketch.boundContributions", rekeyed)
+	}
+	// Add an empty contribution, so that the sketch is output even if there are
+	// no contributions.
+	contributions := beam.Flatten(s, beam.DropKey(s, rekeyed), beam.Create(s, pairInt64{}))
+	return beam.Combine(s, fn, contributions)
+}
+
+// countMinSketchFn is the combineFn used for computing a CountMinSketch.
+type countMinSketchFn struct {
+	Epsilon                      float64
+	Delta                        float64
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	Width                        int64
+	Depth                        int64
+	NoiseKind                    noise.Kind
+	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
+	TestMode                     TestMode
+}
+
+func newCountMinSketchFn(params CountMinSketchParams, noiseKind noise.Kind, testMode TestMode) *countMinSketchFn {
+	return &countMinSketchFn{
+		Epsilon:                      params.AggregationEpsilon,
+		Delta:                        params.AggregationDelta,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		Width:                        params.Width,
+		Depth:                        params.Depth,
+		NoiseKind:                    noiseKind,
+		TestMode:                     testMode,
+	}
+}
+
+func (fn *countMinSketchFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+type countMinSketchAccum struct {
+	S *dpagg.CountMinSketch
+}
+
+func (fn *countMinSketchFn) CreateAccumulator() (countMinSketchAccum, error) {
+	sketch, err := dpagg.NewCountMinSketch(&dpagg.CountMinSketchOptions{
+		Epsilon:                      fn.Epsilon,
+		Delta:                        fn.Delta,
+		MaxPartitionsContributed:     fn.MaxPartitionsContributed,
+		MaxContributionsPerPartition: fn.MaxContributionsPerPartition,
+		Noise:                        fn.noise,
+		Width:                        fn.Width,
+		Depth:                        fn.Depth,
+	})
+	return countMinSketchAccum{S: sketch}, err
+}
+
+// AddInput adds the contributions of a privacy identifier to a value, capped
+// at MaxContributionsPerPartition. Does nothing for empty contributions.
+func (fn *countMinSketchFn) AddInput(a countMinSketchAccum, p pairInt64) (countMinSketchAccum, error) {
+	if p.M == 0 {
+		return a, nil
+	}
+	return a, a.S.IncrementBy(p.K, min(p.M, fn.MaxContributionsPerPartition))
+}
+
+func (fn *countMinSketchFn) MergeAccumulators(a, b countMinSketchAccum) (countMinSketchAccum, error) {
+	err := a.S.Merge(b.S)
+	return a, err
+}
+
+func (fn *countMinSketchFn) ExtractOutput(a countMinSketchAccum) (dpagg.NoisyCountMinSketch, error) {
+	if fn.TestMode.isEnabled() {
+		a.S.Noise = noNoise{}
+	}
+	a.S.Noise = auditNoise(a.S.Noise, "CountMinSketch")
+	result, err := a.S.Result()
+	if err != nil {
+		return dpagg.NoisyCountMinSketch{}, err
+	}
+	return *result, nil
+}
+
+func (fn *countMinSketchFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+// EstimateFrequencies estimates the frequency of each key in keys with sketch,
+// the output of CountMinSketch on a PrivatePCollection<K>. It only uses the
+// noisy sketch, so it doesn't consume any privacy budget, and keys can be
+// public or private data.
+//
+// EstimateFrequencies transforms a PCollection<K> into a PCollection<K,int64>.
+func EstimateFrequencies(s beam.Scope, sketch, keys beam.PCollection) beam.PCollection {
+	s = s.Scope("pbeam.EstimateFrequencies")
+	if sketch.Type().Type() != reflect.TypeOf(dpagg.NoisyCountMinSketch{}) {
+		log.Fatalf("pbeam.EstimateFrequencies: sketch must be the output of CountMinSketch, got a PCollection<%v>", sketch.Type())
+	}
+	fn := &estimateFrequencyFn{KeyType: beam.EncodedType{T: keys.Type().Type()}}
+	return beam.ParDo(s, fn, keys, beam.SideInput{Input: sketch}, beam.TypeDefinition{Var: beam.TType, T: keys.Type().Type()})
+}
+
+// estimateFrequencyFn encodes keys as CountMinSketch does, and estimates their
+// frequency with the sketch.
+type estimateFrequencyFn struct {
+	KeyType beam.EncodedType
+	keyEnc  beam.ElementEncoder
+}
+
+func (fn *estimateFrequencyFn) Setup() {
+	fn.keyEnc = beam.NewElementEncoder(fn.KeyType.T)
+}
+
+func (fn *estimateFrequencyFn) ProcessElement(k beam.T, sketch dpagg.NoisyCountMinSketch) (beam.T, int64, error) {
+	var buf bytes.Buffer
+	if err := fn.keyEnc.Encode(k, &buf); err != nil {
+		return k, 0, fmt.Errorf("pbeam.EstimateFrequencies: couldn't encode key %v: %v", k, err)
+	}
+	return k, sketch.Estimate(buf.Bytes()), nil
+}
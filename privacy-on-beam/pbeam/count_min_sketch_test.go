@@ -0,0 +1,109 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func TestCountMinSketchNoNoise(t *testing.T) {
+	// Value 0 is associated with 7 privacy units, value 1 with 3 privacy units
+	// (one of them contributing 3 times, capped to 2), and value 2 with none.
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 7, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(7, 3, 1),
+		testutils.MakePairsWithFixedVStartingFromKey(7, 1, 1),
+		testutils.MakePairsWithFixedVStartingFromKey(7, 1, 1),
+	)
+	result := []testutils.PairII64{{0, 7}, {1, 4}, {2, 0}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	// With a Width of 10000 and a Depth of 3, the probability that two of the
+	// values collide in every row is negligible.
+	sketch := CountMinSketch(s, pcol, CountMinSketchParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 2,
+		Width:                        10000,
+		Depth:                        3,
+	})
+	got := EstimateFrequencies(s, sketch, beam.CreateList(s, []int{0, 1, 2}))
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountMinSketchNoNoise: EstimateFrequencies(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestCountMinSketchEmptyInput(t *testing.T) {
+	// The sketch of an empty collection is output, and estimates zero for all
+	// values.
+	result := []testutils.PairII64{{0, 0}, {1, 0}}
+	p, s, col, want := ptest.CreateList2([]testutils.PairII{}, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	sketch := CountMinSketch(s, pcol, CountMinSketchParams{MaxPartitionsContributed: 1, Width: 100, Depth: 3})
+	got := EstimateFrequencies(s, sketch, beam.CreateList(s, []int{0, 1}))
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountMinSketchEmptyInput: EstimateFrequencies(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestCountMinSketchCrossPartitionContributionBounding(t *testing.T) {
+	// pairs contains {0,0}, {1,0}, …, {49,0}, {0,1}, …, {49,1}, {0,2}, …, {49,9}.
+	var pairs []testutils.PairII
+	for i := 0; i < 10; i++ {
+		pairs = append(pairs, testutils.MakePairsWithFixedV(50, i)...)
+	}
+	result := []testutils.PairII64{{0, 150}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	sketch := CountMinSketch(s, pcol, CountMinSketchParams{MaxPartitionsContributed: 3, Width: 10000, Depth: 3})
+	got := EstimateFrequencies(s, sketch, beam.CreateList(s, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}))
+	// With a max contribution of 3, 70% of the data should be dropped. The sum
+	// of all estimates must then be 150.
+	sumOverValues := stats.Sum(s, beam.DropKey(s, got))
+	got = beam.AddFixedKey(s, sumOverValues) // Adds a fixed key of 0.
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountMinSketchCrossPartitionContributionBounding: EstimateFrequencies(%v) = %v, expected elements to sum to 150: %v", col, got, err)
+	}
+}
@@ -664,6 +664,45 @@ func TestCheckCountParams(t *testing.T) {
 			partitionType: nil,
 			wantErr:       true,
 		},
+		{
+			desc: "MinAggregateSize set",
+			params: CountParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+				MaxValue:                 1,
+				MinAggregateSize:         10,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: nil,
+			wantErr:       false,
+		},
+		{
+			desc: "negative MinAggregateSize",
+			params: CountParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+				MaxValue:                 1,
+				MinAggregateSize:         -1,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: nil,
+			wantErr:       true,
+		},
+		{
+			desc: "MinAggregateSize w/ public partitions",
+			params: CountParams{
+				AggregationEpsilon:       1.0,
+				MaxPartitionsContributed: 1,
+				MaxValue:                 1,
+				PublicPartitions:         []int{0},
+				MinAggregateSize:         10,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: reflect.TypeOf(0),
+			wantErr:       true,
+		},
 	} {
 		if err := checkCountParams(tc.params, tc.noiseKind, tc.partitionType); (err != nil) != tc.wantErr {
 			t.Errorf("With %s, got=%v error, wantErr=%t", tc.desc, err, tc.wantErr)
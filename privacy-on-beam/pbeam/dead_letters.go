@@ -0,0 +1,157 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(DeadLetter{}))
+	register.Emitter1[DeadLetter]()
+	register.DoFn5x1[context.Context, kv.Pair, beam.V, func(kv.Pair, int64), func(DeadLetter), error](&convertToInt64WithDeadLettersFn{})
+	register.Emitter2[kv.Pair, int64]()
+	register.DoFn5x1[context.Context, kv.Pair, beam.V, func(kv.Pair, float64), func(DeadLetter), error](&convertToFloat64WithDeadLettersFn{})
+	register.Emitter2[kv.Pair, float64]()
+}
+
+// malformedRecords counts the records skipped by aggregations because they
+// couldn't be decoded or converted, when PrivacySpecParams.SkipMalformedRecords
+// is set.
+var malformedRecords = beam.NewCounter("pbeam", "malformed_records")
+
+// DeadLetter describes a record that an aggregation skipped because it
+// couldn't be decoded or converted. See PrivacySpecParams.SkipMalformedRecords.
+type DeadLetter struct {
+	// Stage is the name of the DoFn that failed to process the record, e.g.
+	// "encodeIDKFn" or "convertToFloat64Fn".
+	Stage string
+	// Error is the error returned when processing the record.
+	Error string
+}
+
+// deadLetterSink collects the dead letter outputs of the aggregations of a
+// PrivacySpec during pipeline construction.
+type deadLetterSink struct {
+	mux  sync.Mutex
+	cols []beam.PCollection // PCollection<DeadLetter>s
+}
+
+func (sink *deadLetterSink) add(col beam.PCollection) {
+	sink.mux.Lock()
+	defer sink.mux.Unlock()
+	sink.cols = append(sink.cols, col)
+}
+
+func (sink *deadLetterSink) all() []beam.PCollection {
+	sink.mux.Lock()
+	defer sink.mux.Unlock()
+	return append([]beam.PCollection(nil), sink.cols...)
+}
+
+// DeadLetters returns a PCollection<DeadLetter> holding the records skipped by
+// the aggregations constructed so far on PrivatePCollections using this
+// PrivacySpec, so call it after constructing all aggregations. It is empty
+// unless PrivacySpecParams.SkipMalformedRecords is set.
+//
+// Dead letters are not differentially private: their error messages may contain
+// privacy identifiers and values of the skipped records, so they must only be
+// written to sinks that can hold the raw input data.
+func (ps *PrivacySpec) DeadLetters(s beam.Scope) beam.PCollection {
+	s = s.Scope("pbeam.DeadLetters")
+	cols := ps.deadLetters.all()
+	if len(cols) == 0 {
+		return beam.CreateList(s, []DeadLetter{})
+	}
+	return beam.Flatten(s, cols...)
+}
+
+// handleMalformedRecord returns err if skip is false. Otherwise, it counts the
+// record as malformed, emits a DeadLetter for it and returns nil, so that the
+// bundle doesn't fail.
+func handleMalformedRecord(ctx context.Context, skip bool, stage string, err error, emitDeadLetter func(DeadLetter)) error {
+	if !skip {
+		return err
+	}
+	malformedRecords.Inc(ctx, 1)
+	emitDeadLetter(DeadLetter{Stage: stage, Error: err.Error()})
+	return nil
+}
+
+// parDoWithDeadLetters applies fn, a DoFn with a main output and a
+// PCollection<DeadLetter> output, to col. It adds the dead letters to the
+// PrivacySpec and returns the main output.
+func parDoWithDeadLetters(s beam.Scope, spec *PrivacySpec, fn any, col beam.PCollection, opts ...beam.Option) beam.PCollection {
+	output, deadLetters := beam.ParDo2(s, fn, col, opts...)
+	if spec.skipMalformedRecords {
+		spec.deadLetters.add(deadLetters)
+	}
+	return output
+}
+
+// convertValues converts the values of col, a PCollection<K,V>, to vKind,
+// which must be reflect.Int64 or reflect.Float64, using convertToInt64Fn or
+// convertToFloat64Fn.
+func convertValues(s beam.Scope, spec *PrivacySpec, vKind reflect.Kind, col beam.PCollection) beam.PCollection {
+	var fn any
+	switch vKind {
+	case reflect.Int64:
+		fn = &convertToInt64WithDeadLettersFn{SkipMalformed: spec.skipMalformedRecords}
+	case reflect.Float64:
+		fn = &convertToFloat64WithDeadLettersFn{SkipMalformed: spec.skipMalformedRecords}
+	default:
+		log.Fatalf("convertValues: vKind(%v) should be int64 or float64", vKind)
+	}
+	return parDoWithDeadLetters(s, spec, fn, col)
+}
+
+// convertToInt64WithDeadLettersFn applies convertToInt64Fn, emitting the
+// records it fails to convert as dead letters if SkipMalformed is set.
+type convertToInt64WithDeadLettersFn struct {
+	SkipMalformed bool
+}
+
+func (fn *convertToInt64WithDeadLettersFn) ProcessElement(ctx context.Context, k kv.Pair, v beam.V, emit func(kv.Pair, int64), emitDeadLetter func(DeadLetter)) error {
+	k, converted, err := convertToInt64Fn(k, v)
+	if err != nil {
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "convertToInt64Fn", err, emitDeadLetter)
+	}
+	emit(k, converted)
+	return nil
+}
+
+// convertToFloat64WithDeadLettersFn applies convertToFloat64Fn, emitting the
+// records it fails to convert as dead letters if SkipMalformed is set.
+type convertToFloat64WithDeadLettersFn struct {
+	SkipMalformed bool
+}
+
+func (fn *convertToFloat64WithDeadLettersFn) ProcessElement(ctx context.Context, k kv.Pair, v beam.V, emit func(kv.Pair, float64), emitDeadLetter func(DeadLetter)) error {
+	k, converted, err := convertToFloat64Fn(k, v)
+	if err != nil {
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "convertToFloat64Fn", err, emitDeadLetter)
+	}
+	emit(k, converted)
+	return nil
+}
@@ -0,0 +1,104 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[kv.Pair, int, kv.Pair](addPrivacyIDToPairFn)
+}
+
+func addPrivacyIDToPairFn(p kv.Pair) (int, kv.Pair) {
+	return 1, p
+}
+
+// Checks that SumPerKey skips a record whose value can't be decoded and outputs
+// it in DeadLetters if SkipMalformedRecords is set, and fails otherwise.
+func TestSumPerKeySkipMalformedRecords(t *testing.T) {
+	codec := kv.NewCodec(reflect.TypeOf(0), reflect.TypeOf(0))
+	if err := codec.Setup(); err != nil {
+		t.Fatalf("Couldn't set up codec: %v", err)
+	}
+	valid, err := codec.Encode(0, 2)
+	if err != nil {
+		t.Fatalf("Couldn't encode pair: %v", err)
+	}
+	// An empty value can't be decoded as an int.
+	malformed := kv.Pair{K: valid.K}
+
+	for _, tc := range []struct {
+		desc                 string
+		skipMalformedRecords bool
+		wantErr              bool
+	}{
+		{"skip malformed records", true, false},
+		{"fail on malformed records", false, true},
+	} {
+		p, s := beam.NewPipelineWithRoot()
+		col := beam.ParDo(s, addPrivacyIDToPairFn, beam.CreateList(s, []kv.Pair{valid, malformed}))
+		spec := privacySpec(t, PrivacySpecParams{
+			AggregationEpsilon:   1,
+			TestMode:             TestModeWithContributionBounding,
+			SkipMalformedRecords: tc.skipMalformedRecords,
+		})
+		pcol := PrivatePCollection{col: col, codec: codec, privacySpec: spec}
+		got := SumPerKey(s, pcol, SumParams{
+			MaxPartitionsContributed: 1,
+			MinValue:                 0,
+			MaxValue:                 3,
+			PublicPartitions:         []int{0},
+		})
+		want := beam.ParDo(s, testutils.PairII64ToKV, beam.CreateList(s, []testutils.PairII64{{0, 2}}))
+		testutils.ApproxEqualsKVInt64(t, s, got, want, 0)
+		if tc.skipMalformedRecords {
+			passert.Count(s, spec.DeadLetters(s), "dead letters", 1)
+		}
+		if err := ptest.Run(p); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that DeadLetters is empty when SkipMalformedRecords isn't set.
+func TestDeadLettersEmptyByDefault(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, beam.CreateList(s, testutils.MakeSampleTripleWithFloatValue(10, 0)))
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, TestMode: TestModeWithContributionBounding})
+	pcol := MakePrivate(s, col, spec)
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	MeanPerKey(s, pcol, MeanParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     1,
+		PublicPartitions:             []int{0},
+	})
+	passert.Empty(s, spec.DeadLetters(s))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestDeadLettersEmptyByDefault: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build pbeamdebug
+
+// This file is only compiled with the pbeamdebug build tag, e.g.
+// "go test -tags=pbeamdebug". It must never be included in production builds:
+// DebugCompare outputs raw, non-anonymized aggregates.
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	register.Function2x3[beam.W, beam.V, beam.W, float64, error](convertDebugValueToFloat64)
+	register.Function3x2[beam.W, func(*float64) bool, func(*float64) bool, beam.W, DebugComparison](joinDebugComparison)
+	register.Iter1[float64]()
+	beam.RegisterType(reflect.TypeOf(DebugComparison{}))
+}
+
+// DebugAggregation is the aggregation whose raw value DebugCompare computes.
+type DebugAggregation int
+
+const (
+	// DebugCount compares the output of Count with the raw number of values
+	// in each partition. The input must be a PrivatePCollection<V>.
+	DebugCount DebugAggregation = iota
+	// DebugSum compares the output of SumPerKey with the raw sum of values in
+	// each partition. The input must be a PrivatePCollection<K,V>.
+	DebugSum
+	// DebugMean compares the output of MeanPerKey with the raw mean of values
+	// in each partition. The input must be a PrivatePCollection<K,V>.
+	DebugMean
+)
+
+// DebugComparison holds the raw and the differentially private value of a
+// partition.
+type DebugComparison struct {
+	// Raw aggregate, computed without contribution bounding nor noise. Only
+	// set if InRaw is true.
+	Raw float64
+	// Differentially private aggregate. Only set if Released is true.
+	DP float64
+	// InRaw is false for partitions that only appear in the differentially
+	// private output, e.g. empty public partitions.
+	InRaw bool
+	// Released is false for partitions that were dropped by partition
+	// selection.
+	Released bool
+}
+
+// DebugCompareParams specifies the parameters of DebugCompare.
+type DebugCompareParams struct {
+	// Aggregation that produced the differentially private output.
+	//
+	// Defaults to DebugCount.
+	Aggregation DebugAggregation
+	// Sink receives a PCollection<K,DebugComparison> with one element per
+	// partition. It should write to a location that only the data owners can
+	// access, since the raw values are not anonymized.
+	//
+	// Required.
+	Sink func(s beam.Scope, comparisons beam.PCollection)
+}
+
+// DebugCompare computes the raw (i.e. non-private) aggregate of each partition
+// of pcol and passes it, along with the value of the same partition in
+// dpOutput, to params.Sink. It lets data owners validate the utility of a
+// differentially private aggregation during development.
+//
+// dpOutput must be the PCollection<K,int64> or PCollection<K,float64>
+// returned by the aggregation applied on pcol. DebugCompare doesn't consume
+// any privacy budget, and its output is NOT differentially private.
+//
+// DebugCompare is only available with the pbeamdebug build tag.
+func DebugCompare(s beam.Scope, pcol PrivatePCollection, dpOutput beam.PCollection, params DebugCompareParams) {
+	s = s.Scope("pbeam.DebugCompare")
+	if params.Sink == nil {
+		log.Fatalf("pbeam.DebugCompare: Sink must be set")
+	}
+	var raw beam.PCollection // PCollection<K,V>
+	switch params.Aggregation {
+	case DebugCount:
+		if pcol.codec != nil {
+			log.Fatalf("pbeam.DebugCompare: DebugCount requires a PrivatePCollection<V>, got a PrivatePCollection<K,V>")
+		}
+		raw = stats.Count(s, beam.DropKey(s, pcol.col))
+	case DebugSum, DebugMean:
+		if pcol.codec == nil {
+			log.Fatalf("pbeam.DebugCompare: DebugSum and DebugMean require a PrivatePCollection<K,V>, got a PrivatePCollection<V>")
+		}
+		decoded := beam.ParDo(s,
+			&kv.DecodeFn{KType: pcol.codec.KType, VType: pcol.codec.VType},
+			beam.DropKey(s, pcol.col),
+			beam.TypeDefinition{Var: beam.TType, T: pcol.codec.KType.T},
+			beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+		if params.Aggregation == DebugSum {
+			raw = stats.Sum(s, decoded)
+		} else {
+			raw = stats.Mean(s, decoded)
+		}
+	default:
+		log.Fatalf("pbeam.DebugCompare: unknown Aggregation %d", params.Aggregation)
+	}
+	rawFloat := beam.ParDo(s, convertDebugValueToFloat64, raw)
+	dpFloat := beam.ParDo(s, convertDebugValueToFloat64, dpOutput)
+	joined := beam.CoGroupByKey(s, rawFloat, dpFloat)
+	params.Sink(s, beam.ParDo(s, joinDebugComparison, joined))
+}
+
+func convertDebugValueToFloat64(k beam.W, i beam.V) (beam.W, float64, error) {
+	v := reflect.ValueOf(i)
+	if !v.Type().ConvertibleTo(reflect.TypeOf(float64(0))) {
+		return nil, 0, fmt.Errorf("unexpected value type of %v", v.Type())
+	}
+	return k, v.Convert(reflect.TypeOf(float64(0))).Float(), nil
+}
+
+func joinDebugComparison(k beam.W, rawIter, dpIter func(*float64) bool) (beam.W, DebugComparison) {
+	var c DebugComparison
+	c.InRaw = rawIter(&c.Raw)
+	c.Released = dpIter(&c.DP)
+	return k, c
+}
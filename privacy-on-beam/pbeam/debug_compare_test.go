@@ -0,0 +1,100 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build pbeamdebug
+
+package pbeam
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, DebugComparison, string](formatDebugComparison)
+}
+
+func formatDebugComparison(k int, c DebugComparison) string {
+	return fmt.Sprintf("%d: %+v", k, c)
+}
+
+func TestDebugCompareCount(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedV(3, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(3, 2, 1))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithoutContributionBounding,
+	}))
+	got := Count(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1, 2},
+	})
+	DebugCompare(s, pcol, got, DebugCompareParams{
+		Aggregation: DebugCount,
+		Sink: func(s beam.Scope, comparisons beam.PCollection) {
+			passert.Equals(s, beam.ParDo(s, formatDebugComparison, comparisons),
+				formatDebugComparison(0, DebugComparison{Raw: 3, DP: 3, InRaw: true, Released: true}),
+				formatDebugComparison(1, DebugComparison{Raw: 2, DP: 2, InRaw: true, Released: true}),
+				// Partition 2 is an empty public partition.
+				formatDebugComparison(2, DebugComparison{Raw: 0, DP: 0, InRaw: false, Released: true}))
+		},
+	})
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("DebugCompare: %v", err)
+	}
+}
+
+func TestDebugCompareSum(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		testutils.MakeSampleTripleWithIntValue(4, 0),
+		testutils.MakeTripleWithIntValueStartingFromKey(4, 2, 1, 1))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithoutContributionBounding,
+	}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	got := SumPerKey(s, pcol, SumParams{
+		MaxPartitionsContributed: 1,
+		MinValue:                 0,
+		MaxValue:                 1,
+		PublicPartitions:         []int{0, 1},
+	})
+	DebugCompare(s, pcol, got, DebugCompareParams{
+		Aggregation: DebugSum,
+		Sink: func(s beam.Scope, comparisons beam.PCollection) {
+			passert.Equals(s, beam.ParDo(s, formatDebugComparison, comparisons),
+				formatDebugComparison(0, DebugComparison{Raw: 4, DP: 4, InRaw: true, Released: true}),
+				formatDebugComparison(1, DebugComparison{Raw: 2, DP: 2, InRaw: true, Released: true}))
+		},
+	})
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("DebugCompare: %v", err)
+	}
+}
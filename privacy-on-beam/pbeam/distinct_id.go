@@ -94,6 +94,22 @@ type DistinctPrivacyIDParams struct {
 	//
 	// Required.
 	MaxPartitionsContributed int64
+	// Post-processing steps applied, in order, to the noisy counts, after
+	// negative counts are clamped to zero. See PostProcessor for details.
+	//
+	// Optional.
+	PostProcessing []PostProcessor
+	// Minimum number of privacy units that each released count must be based
+	// on, for rules requiring both differential privacy and a minimum
+	// aggregate size (in the style of k-anonymity). Partition selection keeps
+	// a partition only if at least MinAggregateSize privacy units contribute to
+	// it, as with PrivacySpecParams.PreThreshold, and noisy counts smaller than
+	// MinAggregateSize are dropped, before PostProcessing.
+	//
+	// If set, PublicPartitions needs to be left unset.
+	//
+	// Optional.
+	MinAggregateSize int64
 }
 
 // DistinctPrivacyID counts the number of distinct privacy identifiers
@@ -113,36 +129,50 @@ type DistinctPrivacyIDParams struct {
 // This aggregation is not hardened for such applications yet.
 func DistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params DistinctPrivacyIDParams) beam.PCollection {
 	s = s.Scope("pbeam.DistinctPrivacyID")
+	pcol = extractTaggedStructFields(s, pcol, false)
 	// Obtain type information from the underlying PCollection<K,V>.
-	idT, partitionT := beam.ValidateKVType(pcol.col)
+	_, partitionT := beam.ValidateKVType(pcol.col)
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "DistinctPrivacyID", err, partitionT.Type(), reflect.TypeOf(int64(0)))
+	}
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.DistinctPrivacyID: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("DistinctPrivacyID")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.DistinctPrivacyID: %v", err))
 	}
 	// Get privacy parameters.
 	spec := pcol.privacySpec
-	var err error
 	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
 	if err != nil {
-		log.Fatalf("Couldn't consume aggregation budget for DistinctPrivacyID: %v", err)
+		return invalid(fmt.Errorf("Couldn't consume aggregation budget for DistinctPrivacyID: %v", err))
 	}
 	if params.PublicPartitions == nil {
 		_, params.PartitionSelectionDelta, err = spec.partitionSelectionBudget.consume(0, params.PartitionSelectionDelta)
 		if err != nil {
-			log.Fatalf("Couldn't consume partition selection budget for DistinctPrivacyID: %v", err)
+			return invalid(fmt.Errorf("Couldn't consume partition selection budget for DistinctPrivacyID: %v", err))
 		}
 	}
 
 	err = checkDistinctPrivacyIDParams(params, noiseKind, partitionT.Type())
 	if err != nil {
-		log.Fatalf("pbeam.DistinctPrivacyID: %v", err)
+		return invalid(fmt.Errorf("pbeam.DistinctPrivacyID: %v", err))
 	}
+	spec.aggregationRegistered("DistinctPrivacyID", params.AggregationEpsilon, params.AggregationDelta, 0, params.PartitionSelectionDelta)
+	return distinctPrivacyID(s, pcol, params, noiseKind)
+}
+
+// distinctPrivacyID performs the aggregation of DistinctPrivacyID, assuming
+// that the budget was already consumed and params were checked.
+func distinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params DistinctPrivacyIDParams, noiseKind noise.Kind) beam.PCollection {
+	idT, partitionT := beam.ValidateKVType(pcol.col)
+	spec := withMinAggregateSize(pcol.privacySpec, params.MinAggregateSize)
 
 	// Drop non-public partitions, if public partitions are specified.
+	var err error
 	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, partitionT.Type())
 	if err != nil {
 		log.Fatalf("Couldn't drop non-public partitions for DistinctPrivacyID: %v", err)
@@ -159,6 +189,7 @@ func DistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params DistinctPri
 	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
 	if spec.testMode != TestModeWithoutContributionBounding {
 		decoded = boundContributions(s, decoded, params.MaxPartitionsContributed)
+		decoded = traceStage(s, *spec, "DistinctPrivacyID.boundContributions", decoded)
 	}
 	// Third, now that KV pairs are deduplicated and contribution bounding is
 	// done, remove the keys and count how many times each value appears.
@@ -175,14 +206,14 @@ func DistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params DistinctPri
 			log.Fatalf("pbeam.DistinctPrivacyID: %v", err)
 		}
 		noisedCounts := beam.CombinePerKey(s, countFn, emptyCounts)
+		noisedCounts = traceStage(s, *spec, "DistinctPrivacyID.aggregate", noisedCounts)
+		reportNoiseDraws(s, noisedCounts)
 		// Drop thresholded partitions.
 		result = beam.ParDo(s, dropThresholdedPartitionsInt64, noisedCounts)
 	}
 
 	// Clamp negative counts to zero and return.
-	result = beam.ParDo(s, clampNegativePartitionsInt64, result)
-
-	return result
+	return postProcessOutputs(s, result, true, minAggregateSizeSteps(params.MinAggregateSize, params.PostProcessing))
 }
 
 func addPublicPartitionsForDistinctID(s beam.Scope, spec PrivacySpec, params DistinctPrivacyIDParams, noiseKind noise.Kind, countsKV beam.PCollection) beam.PCollection {
@@ -198,9 +229,9 @@ func addPublicPartitionsForDistinctID(s beam.Scope, spec PrivacySpec, params Dis
 		log.Fatalf("pbeam.DistinctPrivacyID: %v", err)
 	}
 	noisedCounts := beam.CombinePerKey(s, countFn, allAddPartitions)
-	finalPartitions := beam.ParDo(s, dereferenceValueInt64, noisedCounts)
-	// Clamp negative counts to zero and return.
-	return beam.ParDo(s, clampNegativePartitionsInt64, finalPartitions)
+	noisedCounts = traceStage(s, spec, "DistinctPrivacyID.aggregate", noisedCounts)
+	reportNoiseDraws(s, noisedCounts)
+	return beam.ParDo(s, dereferenceValueInt64, noisedCounts)
 }
 
 func checkDistinctPrivacyIDParams(params DistinctPrivacyIDParams, noiseKind noise.Kind, partitionType reflect.Type) error {
@@ -220,6 +251,10 @@ func checkDistinctPrivacyIDParams(params DistinctPrivacyIDParams, noiseKind nois
 	if err != nil {
 		return err
 	}
+	err = checkMinAggregateSize(params.MinAggregateSize, params.PublicPartitions, LongTailParams{})
+	if err != nil {
+		return err
+	}
 	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
 }
 
@@ -243,7 +278,7 @@ type countFn struct {
 
 // newCountFn returns a newCountFn with the given budget and parameters.
 func newCountFn(spec PrivacySpec, params DistinctPrivacyIDParams, noiseKind noise.Kind, publicPartitions bool) (*countFn, error) {
-	if noiseKind != noise.GaussianNoise && noiseKind != noise.LaplaceNoise {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
 		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
 	}
 	return &countFn{
@@ -299,6 +334,7 @@ func (fn *countFn) ExtractOutput(a countAccum) (*int64, error) {
 	if fn.TestMode.isEnabled() {
 		a.C.Noise = noNoise{}
 	}
+	a.C.Noise = auditNoise(a.C.Noise, "DistinctPrivacyID")
 	if a.PublicPartitions {
 		result, err := a.C.Result()
 		return &result, err
@@ -964,6 +964,30 @@ func TestCheckDistinctPrivacyIDParams(t *testing.T) {
 			partitionType: reflect.TypeOf(""),
 			wantErr:       true,
 		},
+		{
+			desc: "MinAggregateSize set",
+			params: DistinctPrivacyIDParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionDelta:  1e-5,
+				MaxPartitionsContributed: 1,
+				MinAggregateSize:         10,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: nil,
+			wantErr:       false,
+		},
+		{
+			desc: "MinAggregateSize w/ public partitions",
+			params: DistinctPrivacyIDParams{
+				AggregationEpsilon:       1.0,
+				MaxPartitionsContributed: 1,
+				PublicPartitions:         []int{0},
+				MinAggregateSize:         10,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: reflect.TypeOf(0),
+			wantErr:       true,
+		},
 	} {
 		if err := checkDistinctPrivacyIDParams(tc.params, tc.noiseKind, tc.partitionType); (err != nil) != tc.wantErr {
 			t.Errorf("With %s, got=%v error, wantErr=%t", tc.desc, err, tc.wantErr)
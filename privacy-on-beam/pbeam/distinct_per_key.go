@@ -17,6 +17,7 @@
 package pbeam
 
 import (
+	"fmt"
 	"reflect"
 
 	log "github.com/golang/glog"
@@ -104,10 +105,20 @@ type DistinctPerKeyParams struct {
 // present in the output, in which case the partition selection/thresholding
 // step is skipped.
 //
+// DistinctPerKey has two differentially private stages: partition selection,
+// which uses the PartitionSelectionParams budget, and a Count of the distinct
+// values in each selected partition, which uses the AggregationEpsilon and
+// AggregationDelta budget. The budget used by each stage is logged. With
+// high-cardinality value domains, counts are large compared to the noise, so
+// allocating a larger part of the budget to partition selection, e.g. with
+// SplitBudgetWithParams, usually releases more partitions without hurting
+// the accuracy of the counts much.
+//
 // DistinctPerKey transforms a PrivatePCollection<K,V> into a
 // PCollection<K,int64>.
 func DistinctPerKey(s beam.Scope, pcol PrivatePCollection, params DistinctPerKeyParams) beam.PCollection {
 	s = s.Scope("pbeam.DistinctPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
 	// Obtain type information from the underlying PCollection<K,V>.
 	idT, kvT := beam.ValidateKVType(pcol.col)
 	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
@@ -116,34 +127,43 @@ func DistinctPerKey(s beam.Scope, pcol PrivatePCollection, params DistinctPerKey
 	if pcol.codec == nil {
 		log.Fatalf("DistinctPerKey: no codec found for the input PrivatePCollection.")
 	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "DistinctPerKey", err, pcol.codec.KType.T, reflect.TypeOf(int64(0)))
+	}
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.DistinctPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("DistinctPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.DistinctPerKey: %v", err))
 	}
 
-	// We get the total budget for DistinctPerKey with getBudget, split it and
-	// consume it separately in partition selection and Count with consumeBudget.
+	// We reserve the total budget for DistinctPerKey, and commit it once its
+	// parameters are validated. Partition selection and Count use the committed
+	// budget without consuming it again.
 	// In the new privacy budget API, budgets are already split.
 	spec := pcol.privacySpec
-	var err error
-	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.get(params.AggregationEpsilon, params.AggregationDelta)
+	budget, err := spec.reserveBudget("DistinctPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
 	if err != nil {
-		log.Fatalf("Couldn't get aggregation budget for DistinctPerKey: %v", err)
-	}
-	if params.PublicPartitions == nil {
-		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.get(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
-		if err != nil {
-			log.Fatalf("Couldn't get partition selection budget for DistinctPerKey: %v", err)
-		}
+		return invalid(err)
 	}
 	err = checkDistinctPerKeyParams(params, noiseKind, pcol.codec.KType.T)
 	if err != nil {
-		log.Fatalf("pbeam.DistinctPerKey: %v", err)
+		return invalid(fmt.Errorf("pbeam.DistinctPerKey: %v", err))
 	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	split := BudgetSplit{
+		NoiseEpsilon:              params.AggregationEpsilon,
+		NoiseDelta:                params.AggregationDelta,
+		PartitionSelectionEpsilon: params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:   params.PartitionSelectionParams.Delta,
+	}
+	logBudgetSplit("pbeam.DistinctPerKey", split)
 
 	// Drop non-public partitions, if public partitions are specified.
 	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
@@ -156,19 +176,18 @@ func DistinctPerKey(s beam.Scope, pcol PrivatePCollection, params DistinctPerKey
 	// mean that we keep duplicates instead of distinct values. However, this is necessary
 	// for the current algorithm to be DP.
 	if spec.testMode != TestModeWithoutContributionBounding {
-		// First, rekey by kv.Pair{ID,K} and do per-partition contribution bounding.
-		rekeyed := beam.ParDo(
-			s,
-			newEncodeIDKFn(idT, pcol.codec),
+		// First, rekey by kv.Pair{ID,K}.
+		rekeyed := parDoWithDeadLetters(
+			s, spec,
+			newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
 			pcol.col,
 			beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T}) // PCollection<kv.Pair{ID,K}, V>.
-		// Keep only maxContributionsPerPartition values per (privacyKey, partitionKey) pair.
-		sampled := boundContributions(s, rekeyed, params.MaxContributionsPerPartition)
 
-		// Collect all values per kv.Pair{ID,K} in a slice.
+		// Collect the values per kv.Pair{ID,K} in a slice, keeping only
+		// MaxContributionsPerPartition values per (privacyKey, partitionKey) pair.
 		combined := beam.CombinePerKey(s,
-			newExpandValuesCombineFn(pcol.codec.VType),
-			sampled) // PCollection<kv.Pair{ID,K}, []codedV}>, where codedV=[]byte
+			newExpandValuesCombineFn(pcol.codec.VType, spec.compressValues, params.MaxContributionsPerPartition),
+			rekeyed) // PCollection<kv.Pair{ID,K}, []codedV}>, where codedV=[]byte
 
 		_, codedVSliceType := beam.ValidateKVType(combined)
 
@@ -181,9 +200,9 @@ func DistinctPerKey(s beam.Scope, pcol PrivatePCollection, params DistinctPerKey
 		// Second, do cross-partition contribution bounding.
 		decoded = boundContributions(s, decoded, params.MaxPartitionsContributed)
 
-		rekeyed = beam.ParDo(
-			s,
-			newEncodeIDKFn(idT, kv.NewCodec(pcol.codec.KType.T, codedVSliceType.Type())),
+		rekeyed = parDoWithDeadLetters(
+			s, spec,
+			newEncodeIDKFn(idT, kv.NewCodec(pcol.codec.KType.T, codedVSliceType.Type()), spec.skipMalformedRecords),
 			decoded,
 			beam.TypeDefinition{Var: beam.VType, T: codedVSliceType.Type()}) // PCollection<kv.Pair{ID,K}, []codedV>, where codedV=[]byte
 
@@ -201,11 +220,11 @@ func DistinctPerKey(s beam.Scope, pcol PrivatePCollection, params DistinctPerKey
 	// we want to keep the same contributions across partitions for partition selection
 	// and Count.
 	if params.PublicPartitions == nil {
-		params.PublicPartitions = SelectPartitions(s, pcol, SelectPartitionsParams{
+		params.PublicPartitions = selectPartitionsWithBudget(s, pcol, SelectPartitionsParams{
 			Epsilon:                  params.PartitionSelectionParams.Epsilon,
 			Delta:                    params.PartitionSelectionParams.Delta,
 			MaxPartitionsContributed: params.MaxPartitionsContributed,
-		})
+		}, budget)
 	}
 
 	// Keep only one privacyKey per (partitionKey, value) pair
@@ -220,31 +239,14 @@ func DistinctPerKey(s beam.Scope, pcol PrivatePCollection, params DistinctPerKey
 	// Perform DP count.
 	pcol.col = idK
 	pcol.codec = nil
-	return Count(s, pcol, CountParams{
+	return countWithDerivation(s, pcol, CountParams{
 		NoiseKind:                params.NoiseKind,
 		AggregationEpsilon:       params.AggregationEpsilon,
 		AggregationDelta:         params.AggregationDelta,
 		MaxPartitionsContributed: params.MaxPartitionsContributed,
 		MaxValue:                 params.MaxContributionsPerPartition,
 		PublicPartitions:         params.PublicPartitions,
-	})
-}
-
-// splitBudget splits the privacy budget between adding noise and partition selection for DistinctPerKey.
-func splitBudget(epsilon, delta float64, noiseKind noise.Kind) (noiseEpsilon float64, noiseDelta float64, partitionSelectionEpsilon float64, partitionSelectionDelta float64) {
-	noiseEpsilon = epsilon / 2
-	partitionSelectionEpsilon = epsilon - noiseEpsilon
-	switch noiseKind {
-	case noise.GaussianNoise:
-		noiseDelta = delta / 2
-		partitionSelectionDelta = delta - noiseDelta
-	case noise.LaplaceNoise:
-		noiseDelta = 0
-		partitionSelectionDelta = delta
-	default:
-		log.Fatalf("splitBudget: unknown noise.Kind (%v) is specified. Please specify a valid noise.", noiseKind)
-	}
-	return noiseEpsilon, noiseDelta, partitionSelectionEpsilon, partitionSelectionDelta
+	}, nil, budget)
 }
 
 func checkDistinctPerKeyParams(params DistinctPerKeyParams, noiseKind noise.Kind, partitionType reflect.Type) error {
@@ -81,6 +81,39 @@ func TestDistinctPerKeyNoNoise(t *testing.T) {
 	}
 }
 
+// Checks that DistinctPerKey keeps at most MaxContributionsPerPartition values
+// of a privacy identifier contributing many values to a partition.
+func TestDistinctPerKeyCapsValuesPerPartition(t *testing.T) {
+	var triples []testutils.TripleWithIntValue
+	for i := 0; i < 1000; i++ { // Privacy ID 0 contributes 1000 distinct values to Partition 0.
+		triples = append(triples, testutils.TripleWithIntValue{ID: 0, Partition: 0, Value: i})
+	}
+	for i := 1; i < 10; i++ { // Privacy IDs 1 to 9 contribute a single value each.
+		triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 0, Value: 1000 + i})
+	}
+	// Only 3 of the values of privacy ID 0 are kept.
+	result := []testutils.PairII64{{0, 12}}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	got := DistinctPerKey(s, pcol, DistinctPerKeyParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 3,
+		PublicPartitions:             []int{0},
+	})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestDistinctPerKeyCapsValuesPerPartition: DistinctPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
 // Checks that DistinctPerKey adds noise to its output. The logic mirrors TestDistinctPrivacyIDAddsNoise.
 func TestDistinctPerKeyAddsNoise(t *testing.T) {
 	for _, tc := range []struct {
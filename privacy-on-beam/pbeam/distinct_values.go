@@ -0,0 +1,354 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn5x1[context.Context, beam.W, kv.Pair, func(kv.Pair, []byte), func(DeadLetter), error](&encodeIDKWithCodedValueFn{})
+	register.Emitter2[kv.Pair, []byte]()
+	beam.RegisterType(reflect.TypeOf(distinctValuesAccum{}))
+	register.Combiner3[distinctValuesAccum, []byte, [][]byte](&distinctValuesCombineFn{})
+	beam.RegisterType(reflect.TypeOf(partitionValues{}))
+	register.Function2x2[kv.Pair, [][]byte, []byte, partitionValues](rekeyPartitionValues)
+	register.Function3x0[[]byte, partitionValues, func(kv.Pair, []byte)](emitPartitionValues)
+	register.Function2x1[[]byte, []byte, []byte](smallestBytes)
+	register.DoFn2x3[[]byte, partitionValues, beam.U, beam.W, error](&decodeIDPartitionValuesFn{})
+	register.DoFn2x3[kv.Pair, []byte, beam.U, beam.W, error](&decodeRepresentativeIDFn{})
+}
+
+// DistinctValuesPerKey estimates the number of distinct values appearing in
+// each partition of a PrivatePCollection<K,V>, adding differentially private
+// noise to the estimates and doing pre-aggregation thresholding to remove
+// estimates with a low number of distinct privacy identifiers. Like
+// DistinctPerKey, it counts values rather than privacy identifiers, which
+// DistinctPrivacyID counts; it takes the same parameters and provides the same
+// privacy guarantees.
+//
+// DistinctValuesPerKey differs from DistinctPerKey in how it bounds
+// contributions and processes values:
+//   - Duplicate values of a privacy identifier in a partition are removed
+//     before per-partition contribution bounding, so that
+//     params.MaxContributionsPerPartition applies to distinct values and
+//     duplicates don't take the place of distinct values.
+//   - Values are never decoded: they are compared by their encoding, so V can
+//     be any type that Beam can encode deterministically.
+//   - The distinct values of each privacy identifier and partition are
+//     sampled with a combiner keeping at most
+//     params.MaxContributionsPerPartition of them, so that no privacy
+//     identifier or partition needs to fit all its values in memory.
+//
+// DistinctValuesPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,int64>.
+func DistinctValuesPerKey(s beam.Scope, pcol PrivatePCollection, params DistinctPerKeyParams) beam.PCollection {
+	s = s.Scope("pbeam.DistinctValuesPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("DistinctValuesPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("DistinctValuesPerKey: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "DistinctValuesPerKey", err, pcol.codec.KType.T, reflect.TypeOf(int64(0)))
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.DistinctValuesPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("DistinctValuesPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.DistinctValuesPerKey: %v", err))
+	}
+
+	// Like in DistinctPerKey, the budget is committed once the parameters are
+	// validated, and used by SelectPartitions and Count.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("DistinctValuesPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+	err = checkDistinctPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.DistinctValuesPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for DistinctValuesPerKey: %v", err)
+	}
+
+	// First, rekey by kv.Pair{ID,K}, collect the distinct values of each key
+	// and do per-partition contribution bounding.
+	rekeyed := parDoWithDeadLetters(s, spec, newEncodeIDKWithCodedValueFn(idT, spec.skipMalformedRecords), pcol.col) // PCollection<kv.Pair{ID,K}, codedV>.
+	distinct := beam.CombinePerKey(s,
+		newDistinctValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)),
+		rekeyed) // PCollection<kv.Pair{ID,K}, []codedV>.
+	perID := beam.ParDo(s, rekeyPartitionValues, distinct) // PCollection<codedID, partitionValues>.
+	// Second, do cross-partition contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		perID = boundContributions(s, perID, params.MaxPartitionsContributed)
+	}
+
+	// Perform partition selection on all bounded contributions.
+	partitionT := pcol.codec.KType.T
+	if params.PublicPartitions == nil {
+		idK := beam.ParDo(s, newDecodeIDPartitionValuesFn(idT, partitionT), perID,
+			beam.TypeDefinition{Var: beam.UType, T: idT.Type()},
+			beam.TypeDefinition{Var: beam.WType, T: partitionT}) // PCollection<ID, K>.
+		params.PublicPartitions = selectPartitionsWithBudget(s, PrivatePCollection{col: idK, privacySpec: spec}, SelectPartitionsParams{
+			Epsilon:                  params.PartitionSelectionParams.Epsilon,
+			Delta:                    params.PartitionSelectionParams.Delta,
+			MaxPartitionsContributed: params.MaxPartitionsContributed,
+		}, budget)
+	}
+
+	// Keep a single privacy identifier per (partition, value) pair, so that
+	// each distinct value is counted once. Each privacy identifier then
+	// represents at most MaxContributionsPerPartition values in at most
+	// MaxPartitionsContributed partitions, so Count drops no contributions.
+	perValue := beam.ParDo(s, emitPartitionValues, perID)             // PCollection<kv.Pair{K,V}, codedID>.
+	representatives := beam.CombinePerKey(s, smallestBytes, perValue) // PCollection<kv.Pair{K,V}, codedID>.
+	idK := beam.ParDo(s, newDecodeRepresentativeIDFn(idT, partitionT), representatives,
+		beam.TypeDefinition{Var: beam.UType, T: idT.Type()},
+		beam.TypeDefinition{Var: beam.WType, T: partitionT}) // PCollection<ID, K>.
+
+	// Perform DP count.
+	return countWithDerivation(s, PrivatePCollection{col: idK, privacySpec: spec}, CountParams{
+		NoiseKind:                params.NoiseKind,
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+		MaxValue:                 params.MaxContributionsPerPartition,
+		PublicPartitions:         params.PublicPartitions,
+	}, nil, budget)
+}
+
+// encodeIDKWithCodedValueFn takes a PCollection<ID,kv.Pair{K,V}> as input, and
+// returns a PCollection<kv.Pair{ID,K},codedV>; where ID and K have been coded,
+// and V is left coded. Records whose ID can't be encoded are emitted as dead
+// letters if SkipMalformed is set.
+type encodeIDKWithCodedValueFn struct {
+	IDType        beam.EncodedType
+	idEnc         beam.ElementEncoder
+	SkipMalformed bool
+}
+
+func newEncodeIDKWithCodedValueFn(idType typex.FullType, skipMalformed bool) *encodeIDKWithCodedValueFn {
+	return &encodeIDKWithCodedValueFn{IDType: beam.EncodedType{idType.Type()}, SkipMalformed: skipMalformed}
+}
+
+func (fn *encodeIDKWithCodedValueFn) Setup() {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+}
+
+func (fn *encodeIDKWithCodedValueFn) ProcessElement(ctx context.Context, id beam.W, pair kv.Pair, emit func(kv.Pair, []byte), emitDeadLetter func(DeadLetter)) error {
+	var idBuf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "encodeIDKWithCodedValueFn", fmt.Errorf("pbeam.encodeIDKWithCodedValueFn.ProcessElement: couldn't encode ID %v: %w", id, err), emitDeadLetter)
+	}
+	emit(kv.Pair{idBuf.Bytes(), pair.K}, pair.V)
+	return nil
+}
+
+// distinctValuesAccum holds the distinct values added to a
+// distinctValuesCombineFn with the smallest hashes, sorted by hash and value.
+type distinctValuesAccum struct {
+	Hashes []uint64
+	Values [][]byte
+}
+
+// distinctValuesCombineFn collects the distinct coded values of each key. If
+// MaxValues is positive, it only keeps the MaxValues distinct values with the
+// smallest salted hashes, which is a random sample of the distinct values that
+// only needs memory for MaxValues of them.
+type distinctValuesCombineFn struct {
+	MaxValues int64  // Maximum number of distinct values kept per key, unbounded if 0.
+	Salt      uint64 // Salt of the hashes, chosen randomly at construction.
+}
+
+func newDistinctValuesCombineFn(maxValues int64) *distinctValuesCombineFn {
+	return &distinctValuesCombineFn{MaxValues: maxValues, Salt: rand.Uint64()}
+}
+
+func (fn *distinctValuesCombineFn) hash(v []byte) uint64 {
+	h := fnv.New64a()
+	var salt [8]byte
+	binary.LittleEndian.PutUint64(salt[:], fn.Salt)
+	h.Write(salt[:])
+	h.Write(v)
+	return h.Sum64()
+}
+
+func (fn *distinctValuesCombineFn) CreateAccumulator() distinctValuesAccum {
+	return distinctValuesAccum{}
+}
+
+func (fn *distinctValuesCombineFn) AddInput(a distinctValuesAccum, v []byte) distinctValuesAccum {
+	return fn.MergeAccumulators(a, distinctValuesAccum{Hashes: []uint64{fn.hash(v)}, Values: [][]byte{v}})
+}
+
+func (fn *distinctValuesCombineFn) MergeAccumulators(a, b distinctValuesAccum) distinctValuesAccum {
+	var merged distinctValuesAccum
+	i, j := 0, 0
+	for i < len(a.Values) || j < len(b.Values) {
+		if fn.MaxValues > 0 && int64(len(merged.Values)) == fn.MaxValues {
+			break
+		}
+		var c int
+		switch {
+		case i == len(a.Values):
+			c = 1
+		case j == len(b.Values):
+			c = -1
+		default:
+			c = compareHashedValues(a.Hashes[i], a.Values[i], b.Hashes[j], b.Values[j])
+		}
+		if c <= 0 {
+			merged.Hashes = append(merged.Hashes, a.Hashes[i])
+			merged.Values = append(merged.Values, a.Values[i])
+			i++
+			if c == 0 {
+				j++ // The value is in both accumulators.
+			}
+		} else {
+			merged.Hashes = append(merged.Hashes, b.Hashes[j])
+			merged.Values = append(merged.Values, b.Values[j])
+			j++
+		}
+	}
+	return merged
+}
+
+// compareHashedValues orders values by hash, and then by value.
+func compareHashedValues(h1 uint64, v1 []byte, h2 uint64, v2 []byte) int {
+	switch {
+	case h1 < h2:
+		return -1
+	case h1 > h2:
+		return 1
+	}
+	return bytes.Compare(v1, v2)
+}
+
+func (fn *distinctValuesCombineFn) ExtractOutput(a distinctValuesAccum) [][]byte {
+	return a.Values
+}
+
+// partitionValues contains a coded partition key and coded distinct values of
+// this partition.
+type partitionValues struct {
+	K      []byte
+	Values [][]byte
+}
+
+// rekeyPartitionValues transforms a PCollection<kv.Pair{codedID,codedK},[]codedV>
+// into a PCollection<codedID,partitionValues{codedK,[]codedV}>.
+func rekeyPartitionValues(pair kv.Pair, values [][]byte) ([]byte, partitionValues) {
+	return pair.K, partitionValues{K: pair.V, Values: values}
+}
+
+// emitPartitionValues transforms a PCollection<codedID,partitionValues{codedK,[]codedV}>
+// into a PCollection<kv.Pair{codedK,codedV},codedID>.
+func emitPartitionValues(id []byte, pv partitionValues, emit func(kv.Pair, []byte)) {
+	for _, v := range pv.Values {
+		emit(kv.Pair{pv.K, v}, id)
+	}
+}
+
+// smallestBytes returns the smallest of two byte slices, so that combining
+// with it keeps an arbitrary but deterministic one.
+func smallestBytes(a, b []byte) []byte {
+	if bytes.Compare(a, b) <= 0 {
+		return a
+	}
+	return b
+}
+
+// decodeIDPartitionValuesFn transforms a PCollection<codedID,partitionValues>
+// into a PCollection<ID,K>, dropping the values.
+type decodeIDPartitionValuesFn struct {
+	IDType, KType beam.EncodedType
+	idDec, kDec   beam.ElementDecoder
+}
+
+func newDecodeIDPartitionValuesFn(idType typex.FullType, kType reflect.Type) *decodeIDPartitionValuesFn {
+	return &decodeIDPartitionValuesFn{IDType: beam.EncodedType{idType.Type()}, KType: beam.EncodedType{kType}}
+}
+
+func (fn *decodeIDPartitionValuesFn) Setup() {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+	fn.kDec = beam.NewElementDecoder(fn.KType.T)
+}
+
+func (fn *decodeIDPartitionValuesFn) ProcessElement(codedID []byte, pv partitionValues) (beam.U, beam.W, error) {
+	return decodeIDAndPartition(fn.idDec, fn.kDec, codedID, pv.K)
+}
+
+// decodeRepresentativeIDFn transforms a PCollection<kv.Pair{codedK,codedV},codedID>
+// into a PCollection<ID,K>, dropping the values.
+type decodeRepresentativeIDFn struct {
+	IDType, KType beam.EncodedType
+	idDec, kDec   beam.ElementDecoder
+}
+
+func newDecodeRepresentativeIDFn(idType typex.FullType, kType reflect.Type) *decodeRepresentativeIDFn {
+	return &decodeRepresentativeIDFn{IDType: beam.EncodedType{idType.Type()}, KType: beam.EncodedType{kType}}
+}
+
+func (fn *decodeRepresentativeIDFn) Setup() {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+	fn.kDec = beam.NewElementDecoder(fn.KType.T)
+}
+
+func (fn *decodeRepresentativeIDFn) ProcessElement(pair kv.Pair, codedID []byte) (beam.U, beam.W, error) {
+	return decodeIDAndPartition(fn.idDec, fn.kDec, codedID, pair.K)
+}
+
+func decodeIDAndPartition(idDec, kDec beam.ElementDecoder, codedID, codedK []byte) (beam.U, beam.W, error) {
+	id, err := idDec.Decode(bytes.NewBuffer(codedID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.decodeIDAndPartition: couldn't decode privacy ID: %w", err)
+	}
+	k, err := kDec.Decode(bytes.NewBuffer(codedK))
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.decodeIDAndPartition: couldn't decode partition: %w", err)
+	}
+	return id, k, nil
+}
@@ -0,0 +1,115 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Checks that DistinctValuesPerKey returns a correct answer, in particular
+// that values are correctly counted (without duplicates).
+func TestDistinctValuesPerKeyNoNoise(t *testing.T) {
+	var triples []testutils.TripleWithIntValue
+	for i := 0; i < 100; i++ { // Add 200 distinct values to Partition 0.
+		triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 0, Value: i})
+		triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 0, Value: 100 + i})
+	}
+	for i := 100; i < 200; i++ { // Add 200 additional values, all of which are duplicates of the existing distinct values, to Partition 0.
+		triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 0, Value: i - 100})
+		triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 0, Value: i})
+	}
+	for i := 0; i < 50; i++ { // Add 100 distinct values to Partition 1, each contributed 3 times by the same user.
+		for j := 0; j < 3; j++ {
+			// Duplicates of a user are removed before per-partition contribution bounding, so none of the distinct values is dropped.
+			triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 1, Value: i})
+			triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 1, Value: 50 + i})
+		}
+	}
+	for i := 0; i < 7; i++ { // Add 7 distinct values to Partition 2. Should be thresholded.
+		triples = append(triples, testutils.TripleWithIntValue{ID: i, Partition: 2, Value: i})
+	}
+	result := []testutils.PairII64{
+		{0, 200},
+		{1, 100},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	// ε=50, δ=10⁻¹⁰⁰ and l0Sensitivity=3 gives a threshold of ≈17.
+	// We have 3 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 1-10⁻²⁴ probability (k=24).
+	epsilon, delta, k, l1Sensitivity := 50.0, 1e-100, 24.0, 6.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        epsilon,
+			PartitionSelectionEpsilon: epsilon,
+			PartitionSelectionDelta:   delta,
+		}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	got := DistinctValuesPerKey(s, pcol, DistinctPerKeyParams{MaxPartitionsContributed: 3, NoiseKind: LaplaceNoise{}, MaxContributionsPerPartition: 2})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.ApproxEqualsKVInt64(t, s, got, want, testutils.RoundedLaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestDistinctValuesPerKeyNoNoise: DistinctValuesPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that distinctValuesCombineFn keeps the same distinct values
+// regardless of the order in which values are added and merged.
+func TestDistinctValuesCombineFn(t *testing.T) {
+	for _, maxValues := range []int64{0, 3} {
+		fn := newDistinctValuesCombineFn(maxValues)
+		all, even, odd := fn.CreateAccumulator(), fn.CreateAccumulator(), fn.CreateAccumulator()
+		for i := 0; i < 50; i++ {
+			v := []byte(fmt.Sprint(i % 10))
+			all = fn.AddInput(all, v)
+			if i%2 == 0 {
+				even = fn.AddInput(even, v)
+			} else {
+				odd = fn.AddInput(odd, v)
+			}
+		}
+		got := valuesAsSortedStrings(fn.ExtractOutput(fn.MergeAccumulators(odd, even)))
+		want := valuesAsSortedStrings(fn.ExtractOutput(all))
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("distinctValuesCombineFn with MaxValues=%d: merged accumulators differ from a single one (-want +got):\n%s", maxValues, diff)
+		}
+		wantLen := 10
+		if maxValues > 0 {
+			wantLen = int(maxValues)
+		}
+		if len(got) != wantLen {
+			t.Errorf("distinctValuesCombineFn with MaxValues=%d: got %d distinct values %v, want %d", maxValues, len(got), got, wantLen)
+		}
+	}
+}
+
+func valuesAsSortedStrings(values [][]byte) []string {
+	var s []string
+	for _, v := range values {
+		s = append(s, string(v))
+	}
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,216 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn2x2[beam.W, beam.V, []byte, error](&encryptContributionFn{})
+	register.DoFn1x3[[]byte, beam.W, beam.V, error](&decryptContributionFn{})
+}
+
+// AEAD is an authenticated encryption primitive used to encrypt
+// contributions. It is satisfied by the AEAD primitive of Tink
+// (github.com/tink-crypto/tink-go), e.g. obtained with aead.New from a keyset
+// handle, which can itself be encrypted with a KMS key.
+type AEAD interface {
+	Encrypt(plaintext, associatedData []byte) ([]byte, error)
+	Decrypt(ciphertext, associatedData []byte) ([]byte, error)
+}
+
+var (
+	aeadsMu sync.Mutex
+	aeads   = make(map[string]func() (AEAD, error))
+)
+
+// RegisterAEAD registers a function creating the AEAD primitive with the given
+// name, for use in EncryptionParams.
+//
+// AEAD primitives can't be serialized to Beam workers, so they are created on
+// each worker by calling newAEAD. Like Beam functions, RegisterAEAD must be
+// called in an init() function, so that the registration also happens on
+// workers. newAEAD should fetch the keyset from a location that workers can
+// access, e.g. by decrypting it with a KMS key.
+func RegisterAEAD(name string, newAEAD func() (AEAD, error)) {
+	aeadsMu.Lock()
+	defer aeadsMu.Unlock()
+	if _, ok := aeads[name]; ok {
+		log.Fatalf("pbeam.RegisterAEAD: an AEAD named %q is already registered", name)
+	}
+	aeads[name] = newAEAD
+}
+
+func newRegisteredAEAD(name string) (AEAD, error) {
+	aeadsMu.Lock()
+	newAEAD, ok := aeads[name]
+	aeadsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no AEAD named %q is registered, did you call RegisterAEAD in an init() function?", name)
+	}
+	return newAEAD()
+}
+
+// EncryptionParams specifies how contributions are encrypted by
+// EncryptedReshuffle.
+type EncryptionParams struct {
+	// Name of the AEAD primitive, as registered with RegisterAEAD.
+	//
+	// Required.
+	AEADName string
+	// Associated data authenticated with each encrypted contribution, e.g. the
+	// name of the pipeline. Contributions can only be decrypted with the same
+	// associated data.
+	//
+	// Optional.
+	AssociatedData []byte
+}
+
+// EncryptedReshuffle reshuffles the contributions of a PrivatePCollection,
+// encrypting each contribution (i.e. its privacy identifier and its value)
+// while it is shuffled, so that the intermediate data persisted by the runner
+// during the shuffle can't be read without the AEAD keyset. Contributions are
+// decrypted after the shuffle.
+//
+// EncryptedReshuffle can be used to add a checkpoint to a pipeline without
+// materializing plaintext contributions, e.g. before an expensive aggregation.
+// It doesn't consume any privacy budget.
+//
+// Only the shuffle of EncryptedReshuffle itself is encrypted. The shuffles
+// that aggregations do internally, e.g. to group the contributions of each
+// privacy identifier before bounding them, are not: the runner may still
+// persist plaintext contributions during the aggregations that use the output
+// of EncryptedReshuffle.
+//
+// EncryptedReshuffle transforms a PrivatePCollection<V> into a
+// PrivatePCollection<V> with the same contributions.
+func EncryptedReshuffle(s beam.Scope, pcol PrivatePCollection, params EncryptionParams) PrivatePCollection {
+	s = s.Scope("pbeam.EncryptedReshuffle")
+	if params.AEADName == "" {
+		log.Fatalf("pbeam.EncryptedReshuffle: AEADName must be set")
+	}
+	// Fail early if the AEAD isn't registered in the launching binary.
+	if _, err := newRegisteredAEAD(params.AEADName); err != nil {
+		log.Fatalf("pbeam.EncryptedReshuffle: %v", err)
+	}
+	idT, vT := beam.ValidateKVType(pcol.col)
+	fn := &encryptContributionFn{
+		IDType:         beam.EncodedType{idT.Type()},
+		VType:          beam.EncodedType{vT.Type()},
+		AEADName:       params.AEADName,
+		AssociatedData: params.AssociatedData,
+	}
+	encrypted := beam.ParDo(s, fn, pcol.col) // PCollection<[]byte>
+	shuffled := beam.Reshuffle(s, encrypted)
+	decrypted := beam.ParDo(s,
+		&decryptContributionFn{
+			IDType:         fn.IDType,
+			VType:          fn.VType,
+			AEADName:       params.AEADName,
+			AssociatedData: params.AssociatedData,
+		},
+		shuffled,
+		beam.TypeDefinition{Var: beam.WType, T: idT.Type()},
+		beam.TypeDefinition{Var: beam.VType, T: vT.Type()})
+	return PrivatePCollection{
+		col:            decrypted,
+		codec:          pcol.codec,
+		privacySpec:    pcol.privacySpec,
+		doFns:          pcol.doFns,
+		exclusionLists: pcol.exclusionLists,
+	}
+}
+
+// encryptContributionFn encodes each <ID,V> contribution into bytes and
+// encrypts it.
+type encryptContributionFn struct {
+	IDType         beam.EncodedType
+	VType          beam.EncodedType
+	AEADName       string
+	AssociatedData []byte
+
+	idEnc beam.ElementEncoder
+	vEnc  beam.ElementEncoder
+	aead  AEAD
+}
+
+func (fn *encryptContributionFn) Setup() error {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+	fn.vEnc = beam.NewElementEncoder(fn.VType.T)
+	var err error
+	fn.aead, err = newRegisteredAEAD(fn.AEADName)
+	return err
+}
+
+func (fn *encryptContributionFn) ProcessElement(id beam.W, v beam.V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &buf); err != nil {
+		return nil, fmt.Errorf("pbeam.encryptContributionFn.ProcessElement: couldn't encode ID: %w", err)
+	}
+	if err := fn.vEnc.Encode(v, &buf); err != nil {
+		return nil, fmt.Errorf("pbeam.encryptContributionFn.ProcessElement: couldn't encode value: %w", err)
+	}
+	ciphertext, err := fn.aead.Encrypt(buf.Bytes(), fn.AssociatedData)
+	if err != nil {
+		return nil, fmt.Errorf("pbeam.encryptContributionFn.ProcessElement: couldn't encrypt contribution: %w", err)
+	}
+	return ciphertext, nil
+}
+
+// decryptContributionFn is the reverse operation of encryptContributionFn.
+type decryptContributionFn struct {
+	IDType         beam.EncodedType
+	VType          beam.EncodedType
+	AEADName       string
+	AssociatedData []byte
+
+	idDec beam.ElementDecoder
+	vDec  beam.ElementDecoder
+	aead  AEAD
+}
+
+func (fn *decryptContributionFn) Setup() error {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+	fn.vDec = beam.NewElementDecoder(fn.VType.T)
+	var err error
+	fn.aead, err = newRegisteredAEAD(fn.AEADName)
+	return err
+}
+
+func (fn *decryptContributionFn) ProcessElement(ciphertext []byte) (beam.W, beam.V, error) {
+	plaintext, err := fn.aead.Decrypt(ciphertext, fn.AssociatedData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.decryptContributionFn.ProcessElement: couldn't decrypt contribution: %w", err)
+	}
+	buf := bytes.NewBuffer(plaintext)
+	id, err := fn.idDec.Decode(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.decryptContributionFn.ProcessElement: couldn't decode ID: %w", err)
+	}
+	v, err := fn.vDec.Decode(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.decryptContributionFn.ProcessElement: couldn't decode value: %w", err)
+	}
+	return id, v, nil
+}
@@ -0,0 +1,113 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+const testAEADName = "pbeam.testAEAD"
+
+// testAEADKey is the AES-128 key of the test AEAD. Real deployments fetch keys
+// from a KMS instead.
+var testAEADKey = []byte("0123456789abcdef")
+
+func init() {
+	RegisterAEAD(testAEADName, newTestAEAD)
+}
+
+// testAEAD is an AES-GCM AEAD prefixing ciphertexts with their nonce.
+type testAEAD struct {
+	gcm cipher.AEAD
+}
+
+func newTestAEAD() (AEAD, error) {
+	block, err := aes.NewCipher(testAEADKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return testAEAD{gcm: gcm}, nil
+}
+
+func (a testAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, a.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return a.gcm.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func (a testAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if len(ciphertext) < a.gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:a.gcm.NonceSize()], ciphertext[a.gcm.NonceSize():]
+	return a.gcm.Open(nil, nonce, sealed, associatedData)
+}
+
+func TestEncryptedReshuffle(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedV(10, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(10, 5, 1))
+	p, s, col, want := ptest.CreateList2(pairs, pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	want = beam.ParDo(s, testutils.PairToKV, want)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1}))
+	got := EncryptedReshuffle(s, pcol, EncryptionParams{
+		AEADName:       testAEADName,
+		AssociatedData: []byte("TestEncryptedReshuffle"),
+	})
+
+	testutils.EqualsKVInt(t, s, got.col, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("EncryptedReshuffle: %v", err)
+	}
+}
+
+func TestDecryptContributionFnRejectsWrongAssociatedData(t *testing.T) {
+	aead, err := newRegisteredAEAD(testAEADName)
+	if err != nil {
+		t.Fatalf("newRegisteredAEAD: %v", err)
+	}
+	ciphertext, err := aead.Encrypt([]byte("contribution"), []byte("a"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	fn := &decryptContributionFn{AEADName: testAEADName, AssociatedData: []byte("b"), aead: aead}
+	if _, _, err := fn.ProcessElement(ciphertext); err == nil {
+		t.Errorf("decryptContributionFn.ProcessElement with wrong associated data returned no error")
+	}
+}
+
+func TestNewRegisteredAEADUnknownName(t *testing.T) {
+	if _, err := newRegisteredAEAD("unknown"); err == nil {
+		t.Errorf("newRegisteredAEAD with unknown name returned no error")
+	}
+}
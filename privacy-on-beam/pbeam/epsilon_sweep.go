@@ -0,0 +1,174 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+)
+
+// EpsilonSweepParams specifies the parameters associated with SweepEpsilon.
+type EpsilonSweepParams struct {
+	// Noise that the aggregation would add to its outputs. NoiseParams.Epsilon
+	// is ignored: the accuracy is evaluated for each value of Epsilons instead.
+	//
+	// Required.
+	NoiseParams OutputNoiseParams
+	// Values of ε to evaluate. They must be strictly positive and finite.
+	//
+	// Required.
+	Epsilons []float64
+	// Confidence level used for the confidence intervals of the outputs is
+	// 1-ConfidenceIntervalAlpha.
+	//
+	// Defaults to 0.05.
+	ConfidenceIntervalAlpha float64
+	// Expected values of the outputs of the aggregation, e.g. from a previous
+	// differentially private release or from public data, used to compute
+	// relative errors. Don't use raw values computed from private data: the
+	// sweep would then leak information about them.
+	//
+	// Optional.
+	ExpectedValues []float64
+	// Outputs whose noise standard deviation is at most MaxRelativeError times
+	// their expected value are counted as useful.
+	//
+	// Optional. Ignored if 0 or if ExpectedValues is empty.
+	MaxRelativeError float64
+}
+
+// EpsilonFrontier is the expected accuracy of an aggregation for a range of
+// values of ε, computed by SweepEpsilon.
+type EpsilonFrontier struct {
+	// Points of the frontier, in increasing order of ε.
+	Points []EpsilonFrontierPoint
+}
+
+// EpsilonFrontierPoint is the expected accuracy of an aggregation for a given
+// value of ε.
+type EpsilonFrontierPoint struct {
+	// Differential privacy budget of the aggregation.
+	Epsilon, Delta float64
+	// Standard deviation of the noise added to each output.
+	NoiseStandardDeviation float64
+	// Width of the 1-ConfidenceIntervalAlpha confidence interval of each
+	// output.
+	ConfidenceIntervalWidth float64
+	// Median over ExpectedValues of the noise standard deviation divided by the
+	// absolute expected value. +∞ for outputs with an expected value of 0, and
+	// NaN if ExpectedValues is empty.
+	MedianRelativeError float64
+	// Fraction of ExpectedValues whose relative error is at most
+	// MaxRelativeError. NaN if ExpectedValues is empty or MaxRelativeError is
+	// 0.
+	UsefulFraction float64
+}
+
+// String formats the frontier as a table, e.g. to include it in a design
+// document.
+func (f EpsilonFrontier) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-10s %-10s %-12s %-12s %-12s %s\n", "epsilon", "delta", "noise_stddev", "ci_width", "median_rel", "useful")
+	for _, p := range f.Points {
+		fmt.Fprintf(&b, "%-10g %-10g %-12.4g %-12.4g %-12.4g %.4g\n", p.Epsilon, p.Delta, p.NoiseStandardDeviation, p.ConfidenceIntervalWidth, p.MedianRelativeError, p.UsefulFraction)
+	}
+	return b.String()
+}
+
+// SweepEpsilon evaluates the expected accuracy of an aggregation for each
+// value of params.Epsilons, so that decision makers can choose ε knowing the
+// utility it buys. The accuracy of each point is estimated as in
+// ScoreUtility and SuppressOutputs, from the noise parameters and, if given,
+// from params.ExpectedValues.
+//
+// SweepEpsilon doesn't read any data and doesn't consume any privacy budget.
+// Note that it only accounts for the noise: the error introduced by
+// contribution bounding and partition selection isn't part of the estimate.
+func SweepEpsilon(params EpsilonSweepParams) (EpsilonFrontier, error) {
+	if params.ConfidenceIntervalAlpha == 0 {
+		params.ConfidenceIntervalAlpha = defaultConfidenceIntervalAlpha
+	}
+	if err := checkEpsilonSweepParams(params); err != nil {
+		return EpsilonFrontier{}, fmt.Errorf("pbeam.SweepEpsilon: %v", err)
+	}
+	epsilons := append([]float64(nil), params.Epsilons...)
+	sort.Float64s(epsilons)
+	frontier := EpsilonFrontier{Points: make([]EpsilonFrontierPoint, 0, len(epsilons))}
+	for _, eps := range epsilons {
+		noiseParams := params.NoiseParams
+		noiseParams.Epsilon = eps
+		stdDev, err := noiseParams.StandardDeviation()
+		if err != nil {
+			return EpsilonFrontier{}, fmt.Errorf("pbeam.SweepEpsilon: with epsilon=%g: %v", eps, err)
+		}
+		width, err := noiseParams.confidenceIntervalWidth(params.ConfidenceIntervalAlpha)
+		if err != nil {
+			return EpsilonFrontier{}, fmt.Errorf("pbeam.SweepEpsilon: with epsilon=%g: couldn't compute confidence interval width: %v", eps, err)
+		}
+		p := EpsilonFrontierPoint{
+			Epsilon:                 eps,
+			Delta:                   noiseParams.Delta,
+			NoiseStandardDeviation:  stdDev,
+			ConfidenceIntervalWidth: width,
+			MedianRelativeError:     math.NaN(),
+			UsefulFraction:          math.NaN(),
+		}
+		if len(params.ExpectedValues) > 0 {
+			relErrors := make([]float64, len(params.ExpectedValues))
+			useful := 0
+			for i, v := range params.ExpectedValues {
+				relErrors[i] = stdDev / math.Abs(v)
+				if relErrors[i] <= params.MaxRelativeError {
+					useful++
+				}
+			}
+			p.MedianRelativeError = median(relErrors)
+			if params.MaxRelativeError > 0 {
+				p.UsefulFraction = float64(useful) / float64(len(params.ExpectedValues))
+			}
+		}
+		frontier.Points = append(frontier.Points, p)
+	}
+	return frontier, nil
+}
+
+func checkEpsilonSweepParams(params EpsilonSweepParams) error {
+	if len(params.Epsilons) == 0 {
+		return fmt.Errorf("Epsilons must be set")
+	}
+	for _, eps := range params.Epsilons {
+		if err := checks.CheckEpsilonStrict(eps, "Epsilons"); err != nil {
+			return err
+		}
+	}
+	if err := checks.CheckAlpha(params.ConfidenceIntervalAlpha); err != nil {
+		return err
+	}
+	for _, v := range params.ExpectedValues {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("ExpectedValues must be finite, got %f", v)
+		}
+	}
+	if params.MaxRelativeError < 0 || math.IsNaN(params.MaxRelativeError) {
+		return fmt.Errorf("MaxRelativeError must be non-negative, was %f instead", params.MaxRelativeError)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestSweepEpsilon(t *testing.T) {
+	params := EpsilonSweepParams{
+		NoiseParams: OutputNoiseParams{
+			NoiseKind:                LaplaceNoise{},
+			MaxPartitionsContributed: 1,
+			MaxContribution:          1,
+		},
+		Epsilons:         []float64{2, 1},
+		ExpectedValues:   []float64{1, 10, 100},
+		MaxRelativeError: 0.5,
+	}
+	got, err := SweepEpsilon(params)
+	if err != nil {
+		t.Fatalf("SweepEpsilon: got error %v", err)
+	}
+	// With Laplace noise, the standard deviation is √2·l0·lInf/ε.
+	want := EpsilonFrontier{Points: []EpsilonFrontierPoint{
+		{
+			Epsilon:                 1,
+			NoiseStandardDeviation:  math.Sqrt2,
+			ConfidenceIntervalWidth: 2 * math.Log(20),
+			MedianRelativeError:     math.Sqrt2 / 10,
+			UsefulFraction:          2.0 / 3.0,
+		},
+		{
+			Epsilon:                 2,
+			NoiseStandardDeviation:  math.Sqrt2 / 2,
+			ConfidenceIntervalWidth: math.Log(20),
+			MedianRelativeError:     math.Sqrt2 / 20,
+			UsefulFraction:          2.0 / 3.0,
+		},
+	}}
+	if diff := cmp.Diff(want, got, cmpopts.EquateApprox(1e-9, 0)); diff != "" {
+		t.Errorf("SweepEpsilon: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSweepEpsilonWithoutExpectedValues(t *testing.T) {
+	got, err := SweepEpsilon(EpsilonSweepParams{
+		NoiseParams: OutputNoiseParams{
+			NoiseKind:                GaussianNoise{},
+			Delta:                    1e-5,
+			MaxPartitionsContributed: 1,
+			MaxContribution:          1,
+		},
+		Epsilons: []float64{0.5, 1, 2},
+	})
+	if err != nil {
+		t.Fatalf("SweepEpsilon: got error %v", err)
+	}
+	for i, p := range got.Points {
+		if !math.IsNaN(p.MedianRelativeError) || !math.IsNaN(p.UsefulFraction) {
+			t.Errorf("SweepEpsilon: got MedianRelativeError=%f and UsefulFraction=%f without ExpectedValues, want NaN", p.MedianRelativeError, p.UsefulFraction)
+		}
+		if i > 0 && p.NoiseStandardDeviation >= got.Points[i-1].NoiseStandardDeviation {
+			t.Errorf("SweepEpsilon: got noise standard deviation %f for epsilon=%f, want less than %f for epsilon=%f",
+				p.NoiseStandardDeviation, p.Epsilon, got.Points[i-1].NoiseStandardDeviation, got.Points[i-1].Epsilon)
+		}
+	}
+}
+
+func TestSweepEpsilonInvalidParams(t *testing.T) {
+	noiseParams := OutputNoiseParams{NoiseKind: LaplaceNoise{}, MaxPartitionsContributed: 1, MaxContribution: 1}
+	for _, tc := range []struct {
+		desc   string
+		params EpsilonSweepParams
+	}{
+		{"no epsilons", EpsilonSweepParams{NoiseParams: noiseParams}},
+		{"zero epsilon", EpsilonSweepParams{NoiseParams: noiseParams, Epsilons: []float64{0, 1}}},
+		{"infinite expected value", EpsilonSweepParams{NoiseParams: noiseParams, Epsilons: []float64{1}, ExpectedValues: []float64{math.Inf(1)}}},
+		{"negative MaxRelativeError", EpsilonSweepParams{NoiseParams: noiseParams, Epsilons: []float64{1}, MaxRelativeError: -1}},
+		{"no noise kind", EpsilonSweepParams{NoiseParams: OutputNoiseParams{MaxPartitionsContributed: 1, MaxContribution: 1}, Epsilons: []float64{1}}},
+	} {
+		if _, err := SweepEpsilon(tc.params); err == nil {
+			t.Errorf("SweepEpsilon with %s: got no error, want error", tc.desc)
+		}
+	}
+}
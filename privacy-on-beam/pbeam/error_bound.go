@@ -0,0 +1,218 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+)
+
+// minSolvedEpsilon is the smallest ε considered by SolveEpsilonForErrorBound,
+// which is the smallest ε accepted by the noise package.
+const minSolvedEpsilon = 1.0 / (1 << 50)
+
+// ErrorBound is an accuracy requirement on the noisy outputs of an aggregation,
+// e.g. "counts within 5% at 95% confidence". It is either an
+// AbsoluteErrorBound or a RelativeErrorBound.
+type ErrorBound interface {
+	// maxError returns the largest allowed distance between a noisy output and
+	// the corresponding raw output, and the probability that this distance may
+	// be exceeded.
+	maxError() (maxError, alpha float64)
+	check() error
+}
+
+// AbsoluteErrorBound requires the noisy outputs of an aggregation to be within
+// MaxError of the raw outputs with probability 1-ConfidenceIntervalAlpha.
+type AbsoluteErrorBound struct {
+	// Largest allowed distance between a noisy output and the raw output.
+	//
+	// Required.
+	MaxError float64
+	// Confidence level of the bound is 1-ConfidenceIntervalAlpha.
+	//
+	// Defaults to 0.05.
+	ConfidenceIntervalAlpha float64
+}
+
+func (b AbsoluteErrorBound) maxError() (float64, float64) {
+	return b.MaxError, alphaOrDefault(b.ConfidenceIntervalAlpha)
+}
+
+func (b AbsoluteErrorBound) check() error {
+	if b.MaxError <= 0 || math.IsNaN(b.MaxError) || math.IsInf(b.MaxError, 0) {
+		return fmt.Errorf("MaxError must be finite and strictly positive, was %f instead", b.MaxError)
+	}
+	return checks.CheckAlpha(alphaOrDefault(b.ConfidenceIntervalAlpha))
+}
+
+// RelativeErrorBound requires the noisy outputs of an aggregation to be within
+// MaxRelativeError times ExpectedValue of the raw outputs with probability
+// 1-ConfidenceIntervalAlpha.
+//
+// The bound holds for outputs whose raw value is at least ExpectedValue in
+// absolute value: set ExpectedValue to the smallest output that needs to be
+// accurate, e.g. from a previous differentially private release or from public
+// data. Don't derive it non-privately from the data being aggregated, since
+// the chosen ε would then leak information about it.
+type RelativeErrorBound struct {
+	// Largest allowed distance between a noisy output and the raw output,
+	// relative to ExpectedValue. For example, 0.05 requires outputs within 5%.
+	//
+	// Required.
+	MaxRelativeError float64
+	// Value relative to which the error is bounded.
+	//
+	// Required.
+	ExpectedValue float64
+	// Confidence level of the bound is 1-ConfidenceIntervalAlpha.
+	//
+	// Defaults to 0.05.
+	ConfidenceIntervalAlpha float64
+}
+
+func (b RelativeErrorBound) maxError() (float64, float64) {
+	return b.MaxRelativeError * math.Abs(b.ExpectedValue), alphaOrDefault(b.ConfidenceIntervalAlpha)
+}
+
+func (b RelativeErrorBound) check() error {
+	if b.MaxRelativeError <= 0 || math.IsNaN(b.MaxRelativeError) || math.IsInf(b.MaxRelativeError, 0) {
+		return fmt.Errorf("MaxRelativeError must be finite and strictly positive, was %f instead", b.MaxRelativeError)
+	}
+	if b.ExpectedValue == 0 || math.IsNaN(b.ExpectedValue) || math.IsInf(b.ExpectedValue, 0) {
+		return fmt.Errorf("ExpectedValue must be finite and non-zero, was %f instead", b.ExpectedValue)
+	}
+	return checks.CheckAlpha(alphaOrDefault(b.ConfidenceIntervalAlpha))
+}
+
+func alphaOrDefault(alpha float64) float64 {
+	if alpha == 0 {
+		return defaultConfidenceIntervalAlpha
+	}
+	return alpha
+}
+
+// ErrorBoundParams specifies the parameters associated with
+// SolveEpsilonForErrorBound.
+type ErrorBoundParams struct {
+	// Noise that the aggregation would add to its outputs. NoiseParams.Epsilon
+	// is ignored: it is the value being solved for.
+	//
+	// Required.
+	NoiseParams OutputNoiseParams
+	// Accuracy requirement on the outputs of the aggregation.
+	//
+	// Required.
+	Bound ErrorBound
+	// Largest ε that can be spent on the aggregation.
+	//
+	// Required.
+	MaxEpsilon float64
+}
+
+// ErrorBoundSolution is the result of SolveEpsilonForErrorBound.
+type ErrorBoundSolution struct {
+	// Whether the error bound can be met with at most MaxEpsilon.
+	Feasible bool
+	// Minimal ε meeting the error bound if Feasible, MaxEpsilon otherwise.
+	Epsilon float64
+	// δ of the aggregation, as in NoiseParams.Delta.
+	Delta float64
+	// Largest distance between a noisy output and the raw output with ε,
+	// at the confidence level of the bound. At most the bound's maximum error
+	// if Feasible.
+	MaxError float64
+}
+
+// SolveEpsilonForErrorBound returns the minimal ε with which an aggregation
+// adding the noise described by params.NoiseParams meets params.Bound, or
+// reports that the bound can't be met within params.MaxEpsilon. Aggregations
+// can then be run with the returned ε as their AggregationEpsilon.
+//
+// SolveEpsilonForErrorBound doesn't read any data and doesn't consume any
+// privacy budget. Note that, like SweepEpsilon, it only accounts for the noise:
+// the error introduced by contribution bounding and partition selection isn't
+// part of the bound.
+func SolveEpsilonForErrorBound(params ErrorBoundParams) (ErrorBoundSolution, error) {
+	if err := checkErrorBoundParams(params); err != nil {
+		return ErrorBoundSolution{}, fmt.Errorf("pbeam.SolveEpsilonForErrorBound: %v", err)
+	}
+	maxError, alpha := params.Bound.maxError()
+	errorWithEpsilon := func(eps float64) (float64, error) {
+		noiseParams := params.NoiseParams
+		noiseParams.Epsilon = eps
+		width, err := noiseParams.confidenceIntervalWidth(alpha)
+		if err != nil {
+			return 0, fmt.Errorf("pbeam.SolveEpsilonForErrorBound: with epsilon=%g: couldn't compute confidence interval width: %v", eps, err)
+		}
+		return width / 2, nil
+	}
+
+	solution := ErrorBoundSolution{Epsilon: params.MaxEpsilon, Delta: params.NoiseParams.Delta}
+	var err error
+	solution.MaxError, err = errorWithEpsilon(params.MaxEpsilon)
+	if err != nil {
+		return ErrorBoundSolution{}, err
+	}
+	if solution.MaxError > maxError {
+		return solution, nil
+	}
+	solution.Feasible = true
+	// The error decreases when ε increases, so the minimal ε is found by
+	// bisection between minSolvedEpsilon and MaxEpsilon; hi always meets the
+	// bound.
+	lo, hi := minSolvedEpsilon, params.MaxEpsilon
+	for i := 0; i < 200 && hi-lo > 1e-12*hi; i++ {
+		mid := math.Sqrt(lo * hi) // Bisect on a logarithmic scale, since ε spans many orders of magnitude.
+		midError, err := errorWithEpsilon(mid)
+		if err != nil {
+			return ErrorBoundSolution{}, err
+		}
+		if midError <= maxError {
+			hi, solution.MaxError = mid, midError
+		} else {
+			lo = mid
+		}
+	}
+	solution.Epsilon = hi
+	return solution, nil
+}
+
+func checkErrorBoundParams(params ErrorBoundParams) error {
+	// The noise parameters are checked with a placeholder ε, since Epsilon is
+	// solved for.
+	noiseParams := params.NoiseParams
+	noiseParams.Epsilon = 1
+	if err := noiseParams.check(); err != nil {
+		return fmt.Errorf("NoiseParams: %w", err)
+	}
+	if params.Bound == nil {
+		return fmt.Errorf("Bound must be set")
+	}
+	if err := params.Bound.check(); err != nil {
+		return fmt.Errorf("Bound: %w", err)
+	}
+	if err := checks.CheckEpsilonStrict(params.MaxEpsilon, "MaxEpsilon"); err != nil {
+		return err
+	}
+	if params.MaxEpsilon < minSolvedEpsilon {
+		return fmt.Errorf("MaxEpsilon must be at least %g, was %g instead", minSolvedEpsilon, params.MaxEpsilon)
+	}
+	return nil
+}
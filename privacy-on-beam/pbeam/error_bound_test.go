@@ -0,0 +1,140 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestSolveEpsilonForErrorBound(t *testing.T) {
+	laplace := OutputNoiseParams{
+		NoiseKind:                LaplaceNoise{},
+		MaxPartitionsContributed: 2,
+		MaxContribution:          1,
+	}
+	// With Laplace noise, the half-width of the 1-α confidence interval is
+	// l0·lInf·ln(1/α)/ε.
+	for _, tc := range []struct {
+		desc   string
+		params ErrorBoundParams
+		want   ErrorBoundSolution
+	}{
+		{
+			desc: "absolute error bound",
+			params: ErrorBoundParams{
+				NoiseParams: laplace,
+				Bound:       AbsoluteErrorBound{MaxError: 10},
+				MaxEpsilon:  1,
+			},
+			want: ErrorBoundSolution{Feasible: true, Epsilon: 2 * math.Log(20) / 10, MaxError: 10},
+		},
+		{
+			desc: "absolute error bound with 99% confidence",
+			params: ErrorBoundParams{
+				NoiseParams: laplace,
+				Bound:       AbsoluteErrorBound{MaxError: 10, ConfidenceIntervalAlpha: 0.01},
+				MaxEpsilon:  1,
+			},
+			want: ErrorBoundSolution{Feasible: true, Epsilon: 2 * math.Log(100) / 10, MaxError: 10},
+		},
+		{
+			desc: "relative error bound",
+			params: ErrorBoundParams{
+				NoiseParams: laplace,
+				Bound:       RelativeErrorBound{MaxRelativeError: 0.05, ExpectedValue: -1000},
+				MaxEpsilon:  1,
+			},
+			want: ErrorBoundSolution{Feasible: true, Epsilon: 2 * math.Log(20) / 50, MaxError: 50},
+		},
+		{
+			desc: "infeasible error bound",
+			params: ErrorBoundParams{
+				NoiseParams: laplace,
+				Bound:       AbsoluteErrorBound{MaxError: 1},
+				MaxEpsilon:  1,
+			},
+			want: ErrorBoundSolution{Feasible: false, Epsilon: 1, MaxError: 2 * math.Log(20)},
+		},
+	} {
+		got, err := SolveEpsilonForErrorBound(tc.params)
+		if err != nil {
+			t.Fatalf("SolveEpsilonForErrorBound with %s: got error %v", tc.desc, err)
+		}
+		if diff := cmp.Diff(tc.want, got, cmpopts.EquateApprox(1e-9, 0)); diff != "" {
+			t.Errorf("SolveEpsilonForErrorBound with %s: got diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestSolveEpsilonForErrorBoundGaussian(t *testing.T) {
+	noiseParams := OutputNoiseParams{
+		NoiseKind:                GaussianNoise{},
+		Delta:                    1e-5,
+		MaxPartitionsContributed: 1,
+		MaxContribution:          1,
+	}
+	got, err := SolveEpsilonForErrorBound(ErrorBoundParams{
+		NoiseParams: noiseParams,
+		Bound:       AbsoluteErrorBound{MaxError: 5},
+		MaxEpsilon:  10,
+	})
+	if err != nil {
+		t.Fatalf("SolveEpsilonForErrorBound: got error %v", err)
+	}
+	if !got.Feasible || got.Delta != 1e-5 || got.MaxError > 5 || got.MaxError < 5*(1-1e-6) {
+		t.Errorf("SolveEpsilonForErrorBound: got %+v, want a feasible solution with delta=1e-5 and MaxError just below 5", got)
+	}
+	// A slightly smaller ε doesn't meet the bound.
+	noiseParams.Epsilon = got.Epsilon * (1 - 1e-6)
+	width, err := noiseParams.confidenceIntervalWidth(defaultConfidenceIntervalAlpha)
+	if err != nil {
+		t.Fatalf("confidenceIntervalWidth: got error %v", err)
+	}
+	if width/2 <= 5 {
+		t.Errorf("SolveEpsilonForErrorBound: got epsilon=%g, but epsilon=%g also meets the bound", got.Epsilon, noiseParams.Epsilon)
+	}
+}
+
+func TestCheckErrorBoundParams(t *testing.T) {
+	noiseParams := OutputNoiseParams{
+		NoiseKind:                LaplaceNoise{},
+		MaxPartitionsContributed: 1,
+		MaxContribution:          1,
+	}
+	for _, tc := range []struct {
+		desc    string
+		params  ErrorBoundParams
+		wantErr bool
+	}{
+		{"valid parameters", ErrorBoundParams{NoiseParams: noiseParams, Bound: AbsoluteErrorBound{MaxError: 1}, MaxEpsilon: 1}, false},
+		{"no bound", ErrorBoundParams{NoiseParams: noiseParams, MaxEpsilon: 1}, true},
+		{"no MaxEpsilon", ErrorBoundParams{NoiseParams: noiseParams, Bound: AbsoluteErrorBound{MaxError: 1}}, true},
+		{"no NoiseKind", ErrorBoundParams{NoiseParams: OutputNoiseParams{MaxPartitionsContributed: 1, MaxContribution: 1}, Bound: AbsoluteErrorBound{MaxError: 1}, MaxEpsilon: 1}, true},
+		{"zero MaxError", ErrorBoundParams{NoiseParams: noiseParams, Bound: AbsoluteErrorBound{}, MaxEpsilon: 1}, true},
+		{"invalid alpha", ErrorBoundParams{NoiseParams: noiseParams, Bound: AbsoluteErrorBound{MaxError: 1, ConfidenceIntervalAlpha: 1.5}, MaxEpsilon: 1}, true},
+		{"zero MaxRelativeError", ErrorBoundParams{NoiseParams: noiseParams, Bound: RelativeErrorBound{ExpectedValue: 1}, MaxEpsilon: 1}, true},
+		{"zero ExpectedValue", ErrorBoundParams{NoiseParams: noiseParams, Bound: RelativeErrorBound{MaxRelativeError: 0.1}, MaxEpsilon: 1}, true},
+	} {
+		if err := checkErrorBoundParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"slices"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Function4x0[beam.W, func(*int64) bool, func(*beam.V) bool, func(beam.W, beam.V)](dropExcludedPrivacyUnits)
+	register.Iter1[int64]()
+	register.Iter1[beam.V]()
+	register.Emitter2[beam.W, beam.V]()
+}
+
+// ExcludePrivacyUnits drops all the records of pcol whose privacy identifier
+// is in excluded, a PCollection<ID> holding e.g. the users who opted out of
+// the analysis. name identifies the exclusion list, and is added to
+// ExclusionLists of the returned PrivatePCollection.
+//
+// Records are dropped before any aggregation, and therefore before
+// contribution bounding: excluded privacy units don't use up the contribution
+// bounds or affect the sampling of contributions of other privacy units.
+// excluded must not depend on the contributions of other privacy units, since
+// the privacy guarantees of aggregations only cover what happens after
+// exclusion.
+//
+// ExcludePrivacyUnits transforms a PrivatePCollection<V> (or <K,V>) into a
+// PrivatePCollection of the same type.
+func ExcludePrivacyUnits(s beam.Scope, pcol PrivatePCollection, excluded beam.PCollection, name string) PrivatePCollection {
+	s = s.Scope("pbeam.ExcludePrivacyUnits")
+	if name == "" {
+		log.Fatalf("pbeam.ExcludePrivacyUnits: name must be set")
+	}
+	idT, _ := beam.ValidateKVType(pcol.col)
+	if excluded.Type().Type() != idT.Type() {
+		log.Fatalf("pbeam.ExcludePrivacyUnits: excluded must be a PCollection of privacy identifiers of type %v, got %v", idT.Type(), excluded.Type())
+	}
+	grouped := beam.CoGroupByKey(s, beam.ParDo(s, addZeroValuesToPublicPartitionsInt64, excluded), pcol.col)
+	pcol.col = beam.ParDo(s, dropExcludedPrivacyUnits, grouped)
+	pcol.exclusionLists = append(slices.Clip(pcol.exclusionLists), name)
+	return pcol
+}
+
+// ExclusionLists returns the names of the exclusion lists applied to pcol with
+// ExcludePrivacyUnits, in the order they were applied. They are provenance
+// metadata: pipelines can check or record them before aggregating pcol.
+func (pcol PrivatePCollection) ExclusionLists() []string {
+	return slices.Clone(pcol.exclusionLists)
+}
+
+// dropExcludedPrivacyUnits outputs the records of a privacy unit after a
+// CoGroupByKey of the exclusion list and of the records, unless the privacy
+// unit is in the exclusion list.
+func dropExcludedPrivacyUnits(id beam.W, isExcluded func(*int64) bool, values func(*beam.V) bool, emit func(beam.W, beam.V)) {
+	var ignoredZero int64
+	if isExcluded(&ignoredZero) {
+		return
+	}
+	var v beam.V
+	for values(&v) {
+		emit(id, v)
+	}
+}
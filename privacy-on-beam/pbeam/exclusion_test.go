@@ -0,0 +1,107 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Checks that aggregations don't count the records of excluded privacy units.
+func TestExcludePrivacyUnits(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 5, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(5, 20, 1),
+	)
+	result := []testutils.PairII64{{0, 3}, {1, 19}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	// 42 isn't a privacy identifier of the input.
+	excluded := beam.CreateList(s, []int{0, 1, 5, 42})
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	pcol = ExcludePrivacyUnits(s, pcol, excluded, "opt-outs")
+	got := Count(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestExcludePrivacyUnits: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that ExcludePrivacyUnits works on PrivatePCollection<K,V>.
+func TestExcludePrivacyUnitsKV(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(10, 0, 1),
+		testutils.MakeTripleWithFloatValueStartingFromKey(10, 10, 1, 2))
+	result := []testutils.PairIF64{{0, 8}, {1, 20}}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	excluded := beam.CreateList(s, []int{0, 1})
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	pcol = ExcludePrivacyUnits(s, pcol, excluded, "opt-outs")
+	got := SumPerKey(s, pcol, SumParams{
+		MinValue:                 0,
+		MaxValue:                 2,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+
+	testutils.EqualsKVFloat64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestExcludePrivacyUnitsKV: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that the exclusion lists are recorded, and kept by ParDo.
+func TestExclusionLists(t *testing.T) {
+	_, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	excluded := beam.CreateList(s, []int{0})
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1}))
+	if got := pcol.ExclusionLists(); len(got) != 0 {
+		t.Errorf("ExclusionLists() = %v before ExcludePrivacyUnits, want none", got)
+	}
+	pcol = ExcludePrivacyUnits(s, pcol, excluded, "opt-outs")
+	pcol = ParDo(s, func(v int) int { return v + 1 }, pcol)
+	pcol = ExcludePrivacyUnits(s, pcol, excluded, "deletions")
+	want := []string{"opt-outs", "deletions"}
+	if diff := cmp.Diff(want, pcol.ExclusionLists()); diff != "" {
+		t.Errorf("ExclusionLists() returned diff (-want +got):\n%s", diff)
+	}
+}
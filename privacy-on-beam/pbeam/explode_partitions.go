@@ -0,0 +1,164 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn3x1[beam.W, beam.V, func(beam.W, beam.X), error](&explodePartitionsFn{})
+	register.Emitter2[beam.W, beam.X]()
+	register.DoFn3x1[beam.W, kv.Pair, func(beam.W, kv.Pair), error](&explodeKeyedPartitionsFn{})
+}
+
+// ExplodePartitions turns records carrying several partitions, e.g. articles
+// with a list of tags, into one record per distinct partition of the record.
+// It transforms a PrivatePCollection<[]K> into a PrivatePCollection<K>, and a
+// PrivatePCollection<[]K,V> into a PrivatePCollection<K,V> where the value of
+// the record is repeated for each of its partitions. Arrays can be used
+// instead of slices.
+//
+// The exploded records keep the privacy identifier of the original record, so
+// the partitions of multi-partition records count towards the
+// MaxPartitionsContributed of the aggregations applied to the output, like
+// any other partition contributed by this privacy identifier. Partitions
+// repeated within a record are only emitted once, so that a record tagged
+// twice with the same tag contributes to this partition a single time.
+//
+// Records with no partitions are dropped.
+func ExplodePartitions(s beam.Scope, pcol PrivatePCollection) PrivatePCollection {
+	s = s.Scope("pbeam.ExplodePartitions")
+	_, vT := beam.ValidateKVType(pcol.col)
+	if pcol.codec == nil {
+		partitionT, err := partitionsElemType(vT.Type())
+		if err != nil {
+			log.Fatalf("ExplodePartitions: %v", err)
+		}
+		return PrivatePCollection{
+			col: beam.ParDo(s,
+				&explodePartitionsFn{PartitionType: beam.EncodedType{T: partitionT}},
+				pcol.col,
+				beam.TypeDefinition{Var: beam.XType, T: partitionT}),
+			privacySpec:    pcol.privacySpec,
+			exclusionLists: pcol.exclusionLists,
+		}
+	}
+	partitionT, err := partitionsElemType(pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("ExplodePartitions: %v", err)
+	}
+	outputCodec := kv.NewCodec(partitionT, pcol.codec.VType.T)
+	return PrivatePCollection{
+		col:            beam.ParDo(s, &explodeKeyedPartitionsFn{InputPairCodec: pcol.codec, OutputPairCodec: outputCodec}, pcol.col),
+		codec:          outputCodec,
+		privacySpec:    pcol.privacySpec,
+		exclusionLists: pcol.exclusionLists,
+	}
+}
+
+// partitionsElemType returns the type of the partitions in a slice or array
+// of partitions of type t.
+func partitionsElemType(t reflect.Type) (reflect.Type, error) {
+	if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+		return nil, fmt.Errorf("partitions must be a slice or an array, got %v instead", t)
+	}
+	return t.Elem(), nil
+}
+
+// distinctPartitions returns the distinct partitions of partitions, a slice
+// or an array, in order. Partitions are compared by their encoding.
+func distinctPartitions(partitions any, enc beam.ElementEncoder) ([]any, error) {
+	v := reflect.ValueOf(partitions)
+	seen := make(map[string]bool, v.Len())
+	var distinct []any
+	for i := 0; i < v.Len(); i++ {
+		partition := v.Index(i).Interface()
+		var buf bytes.Buffer
+		if err := enc.Encode(partition, &buf); err != nil {
+			return nil, fmt.Errorf("couldn't encode partition %v: %v", partition, err)
+		}
+		if !seen[buf.String()] {
+			seen[buf.String()] = true
+			distinct = append(distinct, partition)
+		}
+	}
+	return distinct, nil
+}
+
+// explodePartitionsFn transforms a PCollection<ID,[]K> into a PCollection<ID,K>.
+type explodePartitionsFn struct {
+	PartitionType beam.EncodedType
+	partitionEnc  beam.ElementEncoder
+}
+
+func (fn *explodePartitionsFn) Setup() {
+	fn.partitionEnc = beam.NewElementEncoder(fn.PartitionType.T)
+}
+
+func (fn *explodePartitionsFn) ProcessElement(id beam.W, partitions beam.V, emit func(beam.W, beam.X)) error {
+	distinct, err := distinctPartitions(partitions, fn.partitionEnc)
+	if err != nil {
+		return fmt.Errorf("pbeam.explodePartitionsFn.ProcessElement: %w", err)
+	}
+	for _, partition := range distinct {
+		emit(id, partition)
+	}
+	return nil
+}
+
+// explodeKeyedPartitionsFn transforms a PCollection<ID,kv.Pair{[]K,V}> into a
+// PCollection<ID,kv.Pair{K,V}>.
+type explodeKeyedPartitionsFn struct {
+	InputPairCodec  *kv.Codec
+	OutputPairCodec *kv.Codec
+	partitionEnc    beam.ElementEncoder
+}
+
+func (fn *explodeKeyedPartitionsFn) Setup() error {
+	fn.partitionEnc = beam.NewElementEncoder(fn.OutputPairCodec.KType.T)
+	if err := fn.InputPairCodec.Setup(); err != nil {
+		return err
+	}
+	return fn.OutputPairCodec.Setup()
+}
+
+func (fn *explodeKeyedPartitionsFn) ProcessElement(id beam.W, pair kv.Pair, emit func(beam.W, kv.Pair)) error {
+	partitions, v, err := fn.InputPairCodec.Decode(pair)
+	if err != nil {
+		return fmt.Errorf("pbeam.explodeKeyedPartitionsFn.ProcessElement: %w", err)
+	}
+	distinct, err := distinctPartitions(partitions, fn.partitionEnc)
+	if err != nil {
+		return fmt.Errorf("pbeam.explodeKeyedPartitionsFn.ProcessElement: %w", err)
+	}
+	for _, partition := range distinct {
+		out, err := fn.OutputPairCodec.Encode(partition, v)
+		if err != nil {
+			return fmt.Errorf("pbeam.explodeKeyedPartitionsFn.ProcessElement: %w", err)
+		}
+		emit(id, out)
+	}
+	return nil
+}
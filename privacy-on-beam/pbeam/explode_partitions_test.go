@@ -0,0 +1,129 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	register.Function1x2[article, int, article](extractIDFromArticleFn)
+	register.Function1x1[article, []string](articleToTagsFn)
+	register.Function1x2[article, []string, int](articleToTagsAndViewsFn)
+	register.Function2x1[string, int64, string](formatTagCountFn)
+}
+
+// article is an article viewed by a privacy unit, with a list of tags.
+type article struct {
+	ID    int
+	Tags  []string
+	Views int
+}
+
+func extractIDFromArticleFn(a article) (int, article) {
+	return a.ID, a
+}
+
+func articleToTagsFn(a article) []string {
+	return a.Tags
+}
+
+func articleToTagsAndViewsFn(a article) ([]string, int) {
+	return a.Tags, a.Views
+}
+
+func formatTagCountFn(tag string, count int64) string {
+	return fmt.Sprintf("%s: %d", tag, count)
+}
+
+// makeArticles returns n articles with the given tags and 2 views, viewed by
+// privacy units 0 to n-1.
+func makeArticles(n int, tags ...string) []article {
+	articles := make([]article, n)
+	for i := range articles {
+		articles[i] = article{ID: i, Tags: tags, Views: 2}
+	}
+	return articles
+}
+
+func TestExplodePartitions(t *testing.T) {
+	// Repeated tags are only counted once, and articles without tags are dropped.
+	articles := makeArticles(10, "go", "privacy", "go")
+	articles = append(articles, article{ID: 10})
+	p, s, col := ptest.CreateList(articles)
+	col = beam.ParDo(s, extractIDFromArticleFn, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithoutContributionBounding,
+		}))
+	pcol = ParDo(s, articleToTagsFn, pcol)
+	pcol = ExplodePartitions(s, pcol)
+	got := Count(s, pcol, CountParams{
+		MaxPartitionsContributed: 1,
+		MaxValue:                 1,
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatTagCountFn, got), "go: 10", "privacy: 10")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestExplodePartitions: Count(ExplodePartitions(%v)) = %v, error %v", col, got, err)
+	}
+}
+
+func TestExplodePartitionsKeyed(t *testing.T) {
+	for _, tc := range []struct {
+		testMode TestMode
+		want     int64
+	}{
+		// Each privacy unit contributes its 2 views to only 2 of its 3 tags.
+		{TestModeWithContributionBounding, 400},
+		{TestModeWithoutContributionBounding, 600},
+	} {
+		p, s, col := ptest.CreateList(makeArticles(100, "go", "privacy", "beam"))
+		col = beam.ParDo(s, extractIDFromArticleFn, col)
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           tc.testMode,
+			}))
+		pcol = ParDo(s, articleToTagsAndViewsFn, pcol)
+		pcol = ExplodePartitions(s, pcol)
+		got := SumPerKey(s, pcol, SumParams{
+			MaxPartitionsContributed: 2,
+			MinValue:                 0,
+			MaxValue:                 2,
+			PublicPartitions:         []string{"go", "privacy", "beam"},
+		})
+
+		total := stats.Sum(s, beam.DropKey(s, got))
+		passert.Equals(s, total, tc.want)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestExplodePartitionsKeyed in test mode %v: SumPerKey(ExplodePartitions(%v)) = %v, error %v", tc.testMode, col, got, err)
+		}
+	}
+}
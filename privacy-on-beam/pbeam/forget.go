@@ -0,0 +1,211 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(DeletionReport{}))
+	register.Function4x0[beam.W, func(*int64) bool, func(*beam.V) bool, func(deletionCounts)](countDeletedRecords)
+	register.Emitter1[deletionCounts]()
+	register.Combiner3[deletionCounts, deletionCounts, DeletionReport](&deletionReportFn{})
+}
+
+// Aggregation is an aggregation of a PrivatePCollection, e.g.
+//
+//	func(s beam.Scope, pcol pbeam.PrivatePCollection) beam.PCollection {
+//		return pbeam.Count(s, pcol, countParams)
+//	}
+type Aggregation func(s beam.Scope, pcol PrivatePCollection) beam.PCollection
+
+// ForgetParams specifies the parameters associated with ForgetPrivacyUnits.
+type ForgetParams struct {
+	// Name of the deletion list, added to the ExclusionLists of the
+	// PrivatePCollection passed to the aggregations and to the report.
+	//
+	// Required.
+	Name string
+	// Aggregations to run again without the deleted privacy units, by name.
+	// They are run in the order of their names.
+	//
+	// Required.
+	Aggregations map[string]Aggregation
+}
+
+// DeletionReport records how a deletion list was applied by ForgetPrivacyUnits,
+// e.g. to keep track of the compliance of re-released outputs with deletion
+// requests.
+type DeletionReport struct {
+	// Name of the deletion list, as in ForgetParams.Name.
+	Name string
+	// Names of the aggregations that were run again, in the order they were run.
+	Aggregations []string
+	// Number of distinct privacy identifiers in the deletion list.
+	RequestedPrivacyUnits int64
+	// Number of privacy identifiers of the deletion list which had records in
+	// the input, and the number of these records. These records were all
+	// dropped before running the aggregations.
+	MatchedPrivacyUnits, DroppedRecords int64
+	// Budget consumed by running the aggregations again: the sum of the
+	// aggregation and partition selection budgets they consume from the
+	// PrivacySpec.
+	ConsumedEpsilon, ConsumedDelta float64
+}
+
+// ForgetPrivacyUnits runs aggregations again without the records of the
+// privacy units in deleted, a PCollection<ID> holding e.g. the users who asked
+// for their data to be deleted, and reports how the deletion was applied.
+// This makes re-releasing the outputs of a pipeline after deletion requests
+// systematic: pipelines pass the deletion list they received and the same
+// aggregations as the original release, and get corrected outputs along with
+// a record of what was deleted.
+//
+// Records of deleted privacy units are dropped with ExcludePrivacyUnits, so
+// before contribution bounding. Running the aggregations again is a new
+// release, so it consumes budget from the PrivacySpec of pcol like the
+// original release did; the consumed budget is recorded in the report.
+//
+// The report is computed from the deletion list and the raw input, so it is
+// not differentially private: it is meant for compliance records, and must
+// not be released with the outputs.
+//
+// ForgetPrivacyUnits returns the outputs of the aggregations by name, and a
+// PCollection<DeletionReport> with a single element.
+func ForgetPrivacyUnits(s beam.Scope, pcol PrivatePCollection, deleted beam.PCollection, params ForgetParams) (outputs map[string]beam.PCollection, report beam.PCollection) {
+	s = s.Scope("pbeam.ForgetPrivacyUnits")
+	if err := checkForgetParams(params); err != nil {
+		log.Fatalf("pbeam.ForgetPrivacyUnits: %v", err)
+	}
+	names := make([]string, 0, len(params.Aggregations))
+	for name := range params.Aggregations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	remaining := ExcludePrivacyUnits(s, pcol, deleted, params.Name)
+	outputs = make(map[string]beam.PCollection, len(names))
+	consumedEpsilon, consumedDelta := recordConsumedBudget(pcol.privacySpec, func() {
+		for _, name := range names {
+			outputs[name] = params.Aggregations[name](s.Scope(name), remaining)
+		}
+	})
+
+	grouped := beam.CoGroupByKey(s, beam.ParDo(s, addZeroValuesToPublicPartitionsInt64, deleted), pcol.col)
+	counts := beam.ParDo(s, countDeletedRecords, grouped)
+	report = beam.Combine(s, &deletionReportFn{
+		Name:            params.Name,
+		Aggregations:    names,
+		ConsumedEpsilon: consumedEpsilon,
+		ConsumedDelta:   consumedDelta,
+	}, counts)
+	return outputs, report
+}
+
+func checkForgetParams(params ForgetParams) error {
+	if params.Name == "" {
+		return fmt.Errorf("Name must be set")
+	}
+	if len(params.Aggregations) == 0 {
+		return fmt.Errorf("Aggregations must not be empty")
+	}
+	for name, aggregation := range params.Aggregations {
+		if aggregation == nil {
+			return fmt.Errorf("aggregation %q is nil", name)
+		}
+	}
+	return nil
+}
+
+// recordConsumedBudget calls addAggregations, and returns the budget they
+// consume from spec, summed over the aggregation and partition selection
+// budgets. Like budgets consumed from spec, it includes the inflation of
+// PrivacySpecParams.MaxReleasesPerPartition.
+func recordConsumedBudget(spec *PrivacySpec, addAggregations func()) (epsilon, delta float64) {
+	stopAggregation := spec.aggregationBudget.startRecording()
+	stopPartitionSelection := spec.partitionSelectionBudget.startRecording()
+	addAggregations()
+	aggregationEpsilon, aggregationDelta := stopAggregation()
+	partitionSelectionEpsilon, partitionSelectionDelta := stopPartitionSelection()
+	return aggregationEpsilon + partitionSelectionEpsilon, aggregationDelta + partitionSelectionDelta
+}
+
+// deletionCounts are the counts of a DeletionReport, for a single or several
+// deleted privacy units.
+type deletionCounts struct {
+	Requested, Matched, Records int64
+}
+
+// countDeletedRecords outputs the deletionCounts of a privacy unit after a
+// CoGroupByKey of the deletion list and of the records, if the privacy unit is
+// in the deletion list.
+func countDeletedRecords(id beam.W, isDeleted func(*int64) bool, values func(*beam.V) bool, emit func(deletionCounts)) {
+	var ignoredZero int64
+	if !isDeleted(&ignoredZero) {
+		return
+	}
+	counts := deletionCounts{Requested: 1}
+	var v beam.V
+	for values(&v) {
+		counts.Records++
+	}
+	if counts.Records > 0 {
+		counts.Matched = 1
+	}
+	emit(counts)
+}
+
+// deletionReportFn sums deletionCounts into a DeletionReport.
+type deletionReportFn struct {
+	Name                           string
+	Aggregations                   []string
+	ConsumedEpsilon, ConsumedDelta float64
+}
+
+func (fn *deletionReportFn) CreateAccumulator() deletionCounts {
+	return deletionCounts{}
+}
+
+func (fn *deletionReportFn) AddInput(a, counts deletionCounts) deletionCounts {
+	return fn.MergeAccumulators(a, counts)
+}
+
+func (fn *deletionReportFn) MergeAccumulators(a, b deletionCounts) deletionCounts {
+	a.Requested += b.Requested
+	a.Matched += b.Matched
+	a.Records += b.Records
+	return a
+}
+
+func (fn *deletionReportFn) ExtractOutput(a deletionCounts) DeletionReport {
+	return DeletionReport{
+		Name:                  fn.Name,
+		Aggregations:          fn.Aggregations,
+		RequestedPrivacyUnits: a.Requested,
+		MatchedPrivacyUnits:   a.Matched,
+		DroppedRecords:        a.Records,
+		ConsumedEpsilon:       fn.ConsumedEpsilon,
+		ConsumedDelta:         fn.ConsumedDelta,
+	}
+}
@@ -0,0 +1,164 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x1[DeletionReport, string](formatDeletionReportFn)
+}
+
+func formatDeletionReportFn(r DeletionReport) string {
+	return fmt.Sprintf("%s: aggregations=%v, requested=%d, matched=%d, dropped=%d, epsilon=%.2f, delta=%.2f",
+		r.Name, r.Aggregations, r.RequestedPrivacyUnits, r.MatchedPrivacyUnits, r.DroppedRecords, r.ConsumedEpsilon, r.ConsumedDelta)
+}
+
+// Checks that ForgetPrivacyUnits runs the aggregations without the deleted
+// privacy units, and reports the deletion.
+func TestForgetPrivacyUnits(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 5, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(5, 20, 1),
+		[]testutils.PairII{{0, 1}},
+	)
+	// Each remaining privacy unit has a single record, so both aggregations
+	// have the same result.
+	result := []testutils.PairII64{{0, 3}, {1, 19}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	// 42 isn't a privacy identifier of the input, and 0 is listed twice.
+	deleted := beam.CreateList(s, []int{0, 1, 5, 42, 0})
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	outputs, report := ForgetPrivacyUnits(s, pcol, deleted, ForgetParams{
+		Name: "deletions-2024-06",
+		Aggregations: map[string]Aggregation{
+			"count": func(s beam.Scope, pcol PrivatePCollection) beam.PCollection {
+				return Count(s, pcol, CountParams{
+					AggregationEpsilon:       0.5,
+					MaxValue:                 1,
+					MaxPartitionsContributed: 1,
+					PublicPartitions:         []int{0, 1},
+				})
+			},
+			"distinct": func(s beam.Scope, pcol PrivatePCollection) beam.PCollection {
+				return DistinctPrivacyID(s, pcol, DistinctPrivacyIDParams{
+					AggregationEpsilon:       0.5,
+					MaxPartitionsContributed: 1,
+					PublicPartitions:         []int{0, 1},
+				})
+			},
+		},
+	})
+
+	testutils.EqualsKVInt64(t, s, outputs["count"], want)
+	testutils.EqualsKVInt64(t, s, outputs["distinct"], want)
+	passert.Equals(s, beam.ParDo(s, formatDeletionReportFn, report),
+		"deletions-2024-06: aggregations=[count distinct], requested=4, matched=3, dropped=4, epsilon=1.00, delta=0.00")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestForgetPrivacyUnits: ForgetPrivacyUnits(%v) = %v, %v, error %v", col, outputs, report, err)
+	}
+}
+
+// Checks that the report of ForgetPrivacyUnits records the budget of all
+// aggregations, including those which get their budget before validating their
+// parameters.
+func TestForgetPrivacyUnitsConsumedBudget(t *testing.T) {
+	triples := testutils.MakeTripleWithIntValue(10, 0, 1)
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	deleted := beam.CreateList(s, []int{0})
+
+	var events []AggregationRegisteredEvent
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-10,
+			TestMode:                  TestModeWithContributionBounding,
+			OnAggregationRegistered:   func(e AggregationRegisteredEvent) { events = append(events, e) },
+		}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	_, report := ForgetPrivacyUnits(s, pcol, deleted, ForgetParams{
+		Name: "deletions-2024-06",
+		Aggregations: map[string]Aggregation{
+			"mean": func(s beam.Scope, pcol PrivatePCollection) beam.PCollection {
+				return MeanPerKey(s, pcol, MeanParams{
+					AggregationEpsilon:           0.6,
+					MaxPartitionsContributed:     1,
+					MaxContributionsPerPartition: 1,
+					MinValue:                     0,
+					MaxValue:                     1,
+					PublicPartitions:             []int{0},
+				})
+			},
+			"sum": func(s beam.Scope, pcol PrivatePCollection) beam.PCollection {
+				return SumPerKey(s, pcol, SumParams{
+					AggregationEpsilon:       0.4,
+					PartitionSelectionParams: PartitionSelectionParams{Epsilon: 0.5, Delta: 1e-10},
+					MaxPartitionsContributed: 1,
+					MinValue:                 0,
+					MaxValue:                 1,
+				})
+			},
+		},
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatDeletionReportFn, report),
+		"deletions-2024-06: aggregations=[mean sum], requested=1, matched=1, dropped=1, epsilon=1.50, delta=0.00")
+	// The hook of the PrivacySpec still sees the aggregations.
+	if len(events) != 2 {
+		t.Errorf("OnAggregationRegistered: got %d events, want 2", len(events))
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestForgetPrivacyUnitsConsumedBudget: ForgetPrivacyUnits(%v) = %v, error %v", col, report, err)
+	}
+}
+
+func TestCheckForgetParams(t *testing.T) {
+	count := func(s beam.Scope, pcol PrivatePCollection) beam.PCollection {
+		return Count(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1})
+	}
+	for _, tc := range []struct {
+		desc    string
+		params  ForgetParams
+		wantErr bool
+	}{
+		{"valid parameters", ForgetParams{Name: "deletions", Aggregations: map[string]Aggregation{"count": count}}, false},
+		{"no name", ForgetParams{Aggregations: map[string]Aggregation{"count": count}}, true},
+		{"no aggregations", ForgetParams{Name: "deletions"}, true},
+		{"nil aggregation", ForgetParams{Name: "deletions", Aggregations: map[string]Aggregation{"count": nil}}, true},
+	} {
+		if err := checkForgetParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// FunnelParams specifies the parameters associated with a Funnel aggregation.
+type FunnelParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation, as in
+	// DistinctPrivacyIDParams. It is shared between the counts of all stages.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation, as in DistinctPrivacyIDParams. Partitions are selected based
+	// on the count of their first stage only.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// Optional.
+	PartitionSelectionDelta float64
+	// List of partitions present in the output, as in DistinctPrivacyIDParams.
+	//
+	// If PartitionSelectionDelta is specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// Values identifying the stages of the funnel, in order, e.g. the index of
+	// the "view", "add to cart" and "purchase" events.
+	//
+	// Required; there must be between 2 and 63 distinct stages.
+	Stages []int64
+	// The maximum number of distinct partitions that a given privacy identifier
+	// can influence. A privacy identifier contributes to the count of each stage
+	// it reaches in each of these partitions. If a privacy identifier is
+	// associated with more partitions, random partitions are dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+}
+
+// Funnel counts the number of distinct privacy identifiers reaching each stage
+// of a funnel in each partition, e.g. the number of users viewing, adding to
+// their cart and purchasing each product. A privacy identifier reaches stage i
+// of a partition if it contributes each of Stages[0], …, Stages[i] to this
+// partition; the order in which it contributes them doesn't matter. Funnel
+// adds differentially private noise to the counts and does post-aggregation
+// thresholding on the counts of the first stage to remove partitions with low
+// counts.
+//
+// Contributions are bounded in a single pass per privacy identifier across all
+// stages: a privacy identifier contributes to the counts of the stages it
+// reaches in at most MaxPartitionsContributed partitions, and to at most one
+// count per stage of each of them. Each count is noised with the same scale.
+//
+// Funnel transforms a PrivatePCollection<K,int64>, where the values are
+// stages, into a PCollection<K,[]int64> with the count of each stage, in the
+// order of Stages. Contributions of values that aren't in Stages are ignored.
+//
+// Note: Do not use when your results may cause overflows for int64 values.
+// This aggregation is not hardened for such applications yet.
+func Funnel(s beam.Scope, pcol PrivatePCollection, params FunnelParams) beam.PCollection {
+	s = s.Scope("pbeam.Funnel")
+	if pcol.codec == nil {
+		log.Fatalf("pbeam.Funnel: input must be a PrivatePCollection<K,int64>")
+	}
+	if vT := pcol.codec.VType.T; vT != reflect.TypeOf(int64(0)) {
+		log.Fatalf("pbeam.Funnel: stages must be of type int64, got %v", vT)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "Funnel", err, pcol.codec.KType.T, reflect.TypeOf([]int64(nil)))
+	}
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Funnel: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("Funnel")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Funnel: %v", err))
+	}
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	// Only the δ of the partition selection budget is used, for thresholding.
+	var partitionSelection *PartitionSelectionParams
+	if params.PublicPartitions == nil {
+		partitionSelection = &PartitionSelectionParams{Delta: params.PartitionSelectionDelta}
+	}
+	budget, err := spec.reserveBudget("Funnel", &params.AggregationEpsilon, &params.AggregationDelta, partitionSelection)
+	if err != nil {
+		return invalid(err)
+	}
+	if partitionSelection != nil {
+		params.PartitionSelectionDelta = partitionSelection.Delta
+	}
+	err = checkFunnelParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Funnel: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("Funnel", params.AggregationEpsilon, params.AggregationDelta, 0, params.PartitionSelectionDelta)
+
+	return countStages(s, pcol, stageParams{
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionDelta:  params.PartitionSelectionDelta,
+		PublicPartitions:         params.PublicPartitions,
+		Stages:                   params.Stages,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	}, noiseKind)
+}
+
+func checkFunnelParams(params FunnelParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkDistinctPrivacyIDParams(DistinctPrivacyIDParams{
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionDelta:  params.PartitionSelectionDelta,
+		PublicPartitions:         params.PublicPartitions,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	}, noiseKind, partitionType)
+	if err != nil {
+		return err
+	}
+	return checkStages(params.Stages, params.MaxPartitionsContributed)
+}
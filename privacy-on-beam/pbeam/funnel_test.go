@@ -0,0 +1,123 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, []int64, string](formatFunnelCountsFn)
+}
+
+func formatFunnelCountsFn(k int, counts []int64) string {
+	return fmt.Sprintf("%d:%v", k, counts)
+}
+
+// Checks that Funnel only counts privacy identifiers in a stage if they reached
+// all the previous stages.
+func TestFunnel(t *testing.T) {
+	// Stages are identified by 10, 20 and 30.
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		// Privacy IDs 0-9 reach the first stage of partition 0.
+		testutils.MakeTripleWithIntValue(10, 0, 10),
+		// Privacy IDs 0-5 reach the second stage.
+		testutils.MakeTripleWithIntValue(6, 0, 20),
+		// Privacy IDs 0-2 reach the third stage.
+		testutils.MakeTripleWithIntValue(3, 0, 30),
+		// Privacy IDs 10-14 contribute the third stage of partition 0 without the
+		// previous ones, so they are not counted.
+		testutils.MakeTripleWithIntValueStartingFromKey(10, 5, 0, 30),
+		// Privacy IDs 0-9 contribute a value that isn't a stage, which is
+		// ignored.
+		testutils.MakeTripleWithIntValue(10, 0, 40))
+	want := []string{"0:[10 6 3]", "1:[0 0 0]"}
+
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, tripleToPartitionPeriodFn, pcol)
+	got := Funnel(s, pcol, FunnelParams{
+		Stages:                   []int64{10, 20, 30},
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+	passert.EqualsList(s, beam.ParDo(s, formatFunnelCountsFn, got), want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestFunnel: Funnel(%v) = %v, want %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that invalid parameters of Funnel fail the pipeline when validation
+// errors are deferred.
+func TestFunnelDeferValidationErrors(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, testutils.MakeTripleWithIntValue(10, 0, 10))
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+	pcol := ParDo(s, tripleToPartitionPeriodFn, MakePrivate(s, col, spec))
+	// There must be at least two stages.
+	Funnel(s, pcol, FunnelParams{
+		Stages:                   []int64{10},
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0},
+	})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "Funnel" {
+		t.Errorf("ValidationErrors() = %v, want a single error for Funnel", errs)
+	}
+	// The invalid Funnel doesn't consume any budget.
+	for _, usage := range spec.BudgetUsage() {
+		if usage.ConsumedEpsilon != 0 || usage.ConsumedDelta != 0 {
+			t.Errorf("BudgetUsage() after an invalid Funnel: got %+v, want no consumed budget", usage)
+		}
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestFunnelDeferValidationErrors: pipeline with an invalid Funnel succeeded, expected an error")
+	}
+}
+
+func TestCheckFunnelParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  FunnelParams
+		wantErr bool
+	}{
+		{"valid params", FunnelParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, Stages: []int64{0, 1, 2}, MaxPartitionsContributed: 1}, false},
+		{"single stage", FunnelParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, Stages: []int64{0}, MaxPartitionsContributed: 1}, true},
+		{"too many stages", FunnelParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, Stages: make([]int64, 64), MaxPartitionsContributed: 1}, true},
+		{"duplicate stages", FunnelParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, Stages: []int64{0, 1, 0}, MaxPartitionsContributed: 1}, true},
+		{"no MaxPartitionsContributed", FunnelParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, Stages: []int64{0, 1}}, true},
+		{"no partition selection delta", FunnelParams{AggregationEpsilon: 1, Stages: []int64{0, 1}, MaxPartitionsContributed: 1}, true},
+	} {
+		if err := checkFunnelParams(tc.params, noise.LaplaceNoise, reflect.TypeOf(0)); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn2x3[beam.W, string, beam.W, string, error](&truncatePathFn{})
+	register.DoFn1x2[string, string, string](&keyByParentFn{})
+	register.Function1x2[string, string, bool](markSelected)
+	register.Function4x0[string, func(*bool) bool, func(*string) bool, func(string)](keepChildrenOfSelectedParents)
+	register.Iter1[bool]()
+	register.Iter1[string]()
+	register.Emitter1[string]()
+}
+
+// defaultHierarchySeparator is the default separator between the levels of a
+// hierarchical partition key.
+const defaultHierarchySeparator = "/"
+
+// HierarchicalSelectPartitionsParams specifies the parameters associated with
+// a HierarchicalSelectPartitions aggregation.
+type HierarchicalSelectPartitionsParams struct {
+	// Differential privacy budget consumed by this aggregation, shared evenly
+	// between the levels of the hierarchy. If there is only one aggregation,
+	// both Epsilon and Delta can be left 0; in that case the entire budget
+	// reserved for partition selection in the PrivacySpec is consumed.
+	Epsilon, Delta float64
+	// The maximum number of distinct leaf partitions that a given privacy
+	// identifier can contribute to. Since a privacy identifier can't
+	// contribute to more partitions at a higher level than at the leaf level,
+	// this also bounds contributions at every other level.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// Number of levels in the hierarchy, e.g. 3 for country/region/city. Every
+	// partition key must have exactly NumLevels levels.
+	//
+	// Required.
+	NumLevels int
+	// Separator between the levels of a partition key.
+	//
+	// Defaults to "/".
+	Separator string
+}
+
+// HierarchicalSelectPartitions performs differentially private partition
+// selection at every level of a hierarchy of partition keys, e.g. to select
+// countries, regions and cities in a single aggregation.
+//
+// Partition keys are strings whose levels are joined by params.Separator, e.g.
+// "US/California/San Francisco". The partitions of level i are the prefixes of
+// the partition keys with i+1 levels, e.g. "US" for level 0 and
+// "US/California" for level 1.
+//
+// The budget is split evenly between the levels. After selection, partitions
+// whose parent was not selected are dropped, so that a selected partition
+// always implies that all of its ancestors were selected. This only depends
+// on the output of the partition selection and doesn't consume any
+// additional budget.
+//
+// HierarchicalSelectPartitions transforms a PrivatePCollection<string> into a
+// slice of params.NumLevels PCollection<string>, the i-th of which contains
+// the selected partitions of level i.
+func HierarchicalSelectPartitions(s beam.Scope, pcol PrivatePCollection, params HierarchicalSelectPartitionsParams) []beam.PCollection {
+	s = s.Scope("pbeam.HierarchicalSelectPartitions")
+	_, pT := beam.ValidateKVType(pcol.col)
+	if pT.Type() != reflect.TypeOf("") {
+		log.Fatalf("pbeam.HierarchicalSelectPartitions: input must be a PrivatePCollection<string>, got partition type %v", pT.Type())
+	}
+	if params.Separator == "" {
+		params.Separator = defaultHierarchySeparator
+	}
+	spec := pcol.privacySpec
+	invalid := func(err error) []beam.PCollection {
+		// All levels fail the pipeline, since there may not be a valid number of levels.
+		col := spec.invalidAggregation(s, "HierarchicalSelectPartitions", err, pT.Type())
+		levels := make([]beam.PCollection, max(params.NumLevels, 1))
+		for i := range levels {
+			levels[i] = col
+		}
+		return levels
+	}
+	var err error
+	params.Epsilon, params.Delta, err = spec.partitionSelectionBudget.consume(params.Epsilon, params.Delta)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume budget for HierarchicalSelectPartitions: %v", err))
+	}
+	err = checkHierarchicalSelectPartitionsParams(params)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.HierarchicalSelectPartitions: %v", err))
+	}
+	spec.aggregationRegistered("HierarchicalSelectPartitions", 0, 0, params.Epsilon, params.Delta)
+
+	levelParams := SelectPartitionsParams{
+		Epsilon:                  params.Epsilon / float64(params.NumLevels),
+		Delta:                    params.Delta / float64(params.NumLevels),
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	}
+	selected := make([]beam.PCollection, params.NumLevels)
+	for level := 0; level < params.NumLevels; level++ {
+		levelScope := s.Scope(fmt.Sprintf("Level%d", level))
+		prefixes := PrivatePCollection{
+			col: beam.ParDo(levelScope, &truncatePathFn{
+				NumLevels: params.NumLevels,
+				Level:     level,
+				Separator: params.Separator,
+			}, pcol.col),
+			privacySpec: spec,
+		}
+		selected[level] = selectPartitions(levelScope, prefixes, levelParams)
+		if level > 0 {
+			selected[level] = rollUp(levelScope, selected[level-1], selected[level], params.Separator)
+		}
+	}
+	return selected
+}
+
+func checkHierarchicalSelectPartitionsParams(params HierarchicalSelectPartitionsParams) error {
+	if params.NumLevels <= 0 {
+		return fmt.Errorf("NumLevels must be positive, was %d instead", params.NumLevels)
+	}
+	return checkSelectPartitionsParams(SelectPartitionsParams{
+		Epsilon:                  params.Epsilon,
+		Delta:                    params.Delta,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	})
+}
+
+// rollUp drops the partitions in children whose parent is not in parents.
+func rollUp(s beam.Scope, parents, children beam.PCollection, separator string) beam.PCollection {
+	s = s.Scope("RollUp")
+	keyedParents := beam.ParDo(s, markSelected, parents)                           // PCollection<string, bool>
+	keyedChildren := beam.ParDo(s, &keyByParentFn{Separator: separator}, children) // PCollection<string, string>
+	grouped := beam.CoGroupByKey(s, keyedParents, keyedChildren)
+	return beam.ParDo(s, keepChildrenOfSelectedParents, grouped)
+}
+
+// truncatePathFn replaces each partition key with its prefix at a given level
+// of the hierarchy.
+type truncatePathFn struct {
+	NumLevels int
+	Level     int
+	Separator string
+}
+
+func (fn *truncatePathFn) ProcessElement(id beam.W, path string) (beam.W, string, error) {
+	levels := strings.Split(path, fn.Separator)
+	if len(levels) != fn.NumLevels {
+		return id, "", fmt.Errorf("partition key %q has %d levels, expected %d", path, len(levels), fn.NumLevels)
+	}
+	return id, strings.Join(levels[:fn.Level+1], fn.Separator), nil
+}
+
+// keyByParentFn keys each partition by its parent partition.
+type keyByParentFn struct {
+	Separator string
+}
+
+func (fn *keyByParentFn) ProcessElement(child string) (string, string) {
+	return child[:strings.LastIndex(child, fn.Separator)], child
+}
+
+func markSelected(partition string) (string, bool) {
+	return partition, true
+}
+
+func keepChildrenOfSelectedParents(_ string, parentIter func(*bool) bool, childIter func(*string) bool, emit func(string)) {
+	var selected bool
+	if !parentIter(&selected) {
+		return
+	}
+	var child string
+	for childIter(&child) {
+		emit(child)
+	}
+}
@@ -0,0 +1,161 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[int, int, string](pathForIDFn)
+}
+
+// pathForIDFn assigns the path "a/b/c" to the first 1000 privacy identifiers,
+// and "d/e/f" to the others.
+func pathForIDFn(id int) (int, string) {
+	if id < 1000 {
+		return id, "a/b/c"
+	}
+	return id, "d/e/f"
+}
+
+func TestHierarchicalSelectPartitions(t *testing.T) {
+	ids := make([]int, 1001)
+	for i := range ids {
+		ids[i] = i
+	}
+	p, s, col := ptest.CreateList(ids)
+	col = beam.ParDo(s, pathForIDFn, col)
+
+	// "a/b/c" and its ancestors have 1000 privacy units and are kept, while
+	// "d/e/f" and its ancestors have a single privacy unit and are dropped.
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		PartitionSelectionEpsilon: 30,
+		PartitionSelectionDelta:   1e-10,
+	}))
+	got := HierarchicalSelectPartitions(s, pcol, HierarchicalSelectPartitionsParams{
+		MaxPartitionsContributed: 1,
+		NumLevels:                3,
+	})
+
+	if len(got) != 3 {
+		t.Fatalf("HierarchicalSelectPartitions returned %d levels, want 3", len(got))
+	}
+	passert.Equals(s, got[0], "a")
+	passert.Equals(s, got[1], "a/b")
+	passert.Equals(s, got[2], "a/b/c")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("HierarchicalSelectPartitions: %v", err)
+	}
+}
+
+func TestHierarchicalSelectPartitionsCustomSeparator(t *testing.T) {
+	p, s, col := ptest.CreateList([]string{"a|b", "a|c"})
+	col = beam.AddFixedKey(s, col) // PCollection<int, string>
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		TestMode:                  TestModeWithoutContributionBounding,
+	}))
+	got := HierarchicalSelectPartitions(s, pcol, HierarchicalSelectPartitionsParams{
+		MaxPartitionsContributed: 2,
+		NumLevels:                2,
+		Separator:                "|",
+	})
+
+	passert.Equals(s, got[0], "a")
+	passert.Equals(s, got[1], "a|b", "a|c")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("HierarchicalSelectPartitions: %v", err)
+	}
+}
+
+func TestRollUp(t *testing.T) {
+	parents := []string{"a", "b"}
+	children := []string{"a/x", "a/y", "c/z"}
+	p, s, parentCol, childCol := ptest.CreateList2(parents, children)
+
+	got := rollUp(s, parentCol, childCol, "/")
+
+	passert.Equals(s, got, "a/x", "a/y")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("rollUp: %v", err)
+	}
+}
+
+func TestCheckHierarchicalSelectPartitionsParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  HierarchicalSelectPartitionsParams
+		wantErr bool
+	}{
+		{
+			desc:    "valid parameters",
+			params:  HierarchicalSelectPartitionsParams{Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 1, NumLevels: 3},
+			wantErr: false,
+		},
+		{
+			desc:    "zero NumLevels",
+			params:  HierarchicalSelectPartitionsParams{Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 1},
+			wantErr: true,
+		},
+		{
+			desc:    "zero delta",
+			params:  HierarchicalSelectPartitionsParams{Epsilon: 1, MaxPartitionsContributed: 1, NumLevels: 3},
+			wantErr: true,
+		},
+		{
+			desc:    "zero MaxPartitionsContributed",
+			params:  HierarchicalSelectPartitionsParams{Epsilon: 1, Delta: 1e-5, NumLevels: 3},
+			wantErr: true,
+		},
+	} {
+		if err := checkHierarchicalSelectPartitionsParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestHierarchicalSelectPartitionsDeferValidationErrors(t *testing.T) {
+	p, s, col := ptest.CreateList([]int{0, 1})
+	col = beam.ParDo(s, pathForIDFn, col)
+	spec := privacySpec(t, PrivacySpecParams{
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		DeferValidationErrors:     true,
+	})
+	// NumLevels must be positive.
+	got := HierarchicalSelectPartitions(s, MakePrivate(s, col, spec), HierarchicalSelectPartitionsParams{
+		MaxPartitionsContributed: 1,
+		NumLevels:                0,
+	})
+	if len(got) != 1 {
+		t.Errorf("HierarchicalSelectPartitions returned %d levels, want a single invalid level", len(got))
+	}
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "HierarchicalSelectPartitions" {
+		t.Errorf("ValidationErrors() = %v, want a single error for HierarchicalSelectPartitions", errs)
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestHierarchicalSelectPartitionsDeferValidationErrors: pipeline with an invalid HierarchicalSelectPartitions succeeded, expected an error")
+	}
+}
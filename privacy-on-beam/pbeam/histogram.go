@@ -0,0 +1,259 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(HistogramBucket{}))
+	register.Function2x3[beam.W, beam.V, beam.W, float64, error](toHistogramValueFn)
+	register.DoFn2x3[beam.W, float64, beam.W, kv.Pair, error](&keyHistogramValueFn{})
+	register.DoFn3x2[beam.W, float64, []float64, beam.W, int64](&assignHistogramBucketFn{})
+	register.DoFn3x1[int64, int64, []float64, HistogramBucket](&makeHistogramBucketFn{})
+}
+
+// DefaultBoundariesBudgetFraction is the fraction of the budget of a Histogram
+// spent on choosing the bucket boundaries when no other fraction is specified.
+const DefaultBoundariesBudgetFraction = 0.5
+
+// HistogramParams specifies the parameters associated with a Histogram
+// aggregation.
+type HistogramParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Fraction of AggregationEpsilon and AggregationDelta spent on choosing the
+	// bucket boundaries. The rest is spent on the counts of the buckets.
+	//
+	// Defaults to DefaultBoundariesBudgetFraction. Must be in (0, 1).
+	BoundariesBudgetFraction float64
+	// Number of buckets of the histogram. The boundaries between buckets are
+	// differentially private estimates of the quantiles of ranks
+	// 1/NumBuckets, …, (NumBuckets-1)/NumBuckets, so that each bucket contains
+	// about the same number of values.
+	//
+	// Required; must be at least 2.
+	NumBuckets int64
+	// The maximum number of values that a given privacy identifier can
+	// contribute to the histogram. If a privacy identifier is associated with
+	// more values, random values are dropped.
+	//
+	// Required.
+	MaxContributions int64
+	// Values are clamped to [MinValue, MaxValue] when choosing bucket
+	// boundaries. They are also the lower bound of the first bucket and the
+	// upper bound of the last bucket.
+	//
+	// Required.
+	MinValue, MaxValue float64
+}
+
+// HistogramBucket is a bucket of a histogram output by Histogram.
+type HistogramBucket struct {
+	// Bounds of the bucket. Values in (Lower, Upper] are counted in this
+	// bucket, except for the first bucket which also counts values smaller than
+	// or equal to its Lower bound, and the last bucket which also counts values
+	// larger than its Upper bound.
+	Lower, Upper float64
+	// Noisy number of values in the bucket.
+	Count int64
+}
+
+// Histogram computes a histogram of the values of a PrivatePCollection<V>,
+// where V is a numeric type, choosing the bucket boundaries with
+// differentially private quantiles so that the histogram is readable even if
+// the distribution of the values isn't known in advance. It spends
+// params.BoundariesBudgetFraction of the budget on the boundaries and the rest
+// on the counts of each bucket.
+//
+// Histogram transforms a PrivatePCollection<V> into a
+// PCollection<HistogramBucket> with params.NumBuckets elements. Buckets are
+// always all present in the output, so no partition selection budget is
+// consumed.
+//
+// Note that, like for QuantilesPerKey, the boundaries are slightly noisy even
+// when using pbeamtest.
+func Histogram(s beam.Scope, pcol PrivatePCollection, params HistogramParams) beam.PCollection {
+	s = s.Scope("pbeam.Histogram")
+	if pcol.codec != nil {
+		log.Fatalf("pbeam.Histogram: input must be a PrivatePCollection<V>, got a PrivatePCollection<K,V>")
+	}
+	_, valueT := beam.ValidateKVType(pcol.col)
+	if err := checkNumericType(valueT); err != nil {
+		log.Fatalf("pbeam.Histogram: %v", err)
+	}
+	if params.BoundariesBudgetFraction == 0 {
+		params.BoundariesBudgetFraction = DefaultBoundariesBudgetFraction
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "Histogram", err, reflect.TypeOf(HistogramBucket{}))
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Histogram: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("Histogram")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Histogram: %v", err))
+	}
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("Histogram", &params.AggregationEpsilon, &params.AggregationDelta, nil)
+	if err != nil {
+		return invalid(err)
+	}
+	quantilesParams, countParams, err := histogramPhaseParams(params, noiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Histogram: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("Histogram", params.AggregationEpsilon, params.AggregationDelta, 0, 0)
+
+	values := beam.ParDo(s, toHistogramValueFn, pcol.col) // PCollection<ID, float64>.
+	// First, choose the boundaries of the buckets with quantiles of the values,
+	// all in a single partition.
+	codec := kv.NewCodec(reflect.TypeOf(int64(0)), reflect.TypeOf(float64(0)))
+	keyed := PrivatePCollection{
+		col:         beam.ParDo(s, &keyHistogramValueFn{Codec: codec}, values),
+		codec:       codec,
+		privacySpec: spec,
+	}
+	boundaries := beam.DropKey(s, quantilesPerKey(s, keyed, quantilesParams, noiseKind)) // PCollection<[]float64> with a single element.
+
+	// Second, count the values in each bucket.
+	buckets := beam.ParDo(s, &assignHistogramBucketFn{}, values, beam.SideInput{Input: boundaries})
+	counts := count(s, PrivatePCollection{col: buckets, privacySpec: spec}, countParams, noiseKind)
+	return beam.ParDo(s, &makeHistogramBucketFn{MinValue: params.MinValue, MaxValue: params.MaxValue}, counts, beam.SideInput{Input: boundaries})
+}
+
+// histogramPhaseParams checks params, and returns the params of the quantiles
+// choosing the bucket boundaries and of the count of each bucket.
+func histogramPhaseParams(params HistogramParams, noiseKind noise.Kind) (QuantilesParams, CountParams, error) {
+	if f := params.BoundariesBudgetFraction; !(f > 0 && f < 1) {
+		return QuantilesParams{}, CountParams{}, fmt.Errorf("BoundariesBudgetFraction must be in (0, 1), got %f", f)
+	}
+	if params.NumBuckets < 2 {
+		return QuantilesParams{}, CountParams{}, fmt.Errorf("NumBuckets must be at least 2, got %d", params.NumBuckets)
+	}
+	ranks := make([]float64, params.NumBuckets-1)
+	for i := range ranks {
+		ranks[i] = float64(i+1) / float64(params.NumBuckets)
+	}
+	f := params.BoundariesBudgetFraction
+	quantilesParams := QuantilesParams{
+		NoiseKind:                    params.NoiseKind,
+		AggregationEpsilon:           params.AggregationEpsilon * f,
+		AggregationDelta:             params.AggregationDelta * f,
+		PublicPartitions:             []int64{0},
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: params.MaxContributions,
+		MinValue:                     params.MinValue,
+		MaxValue:                     params.MaxValue,
+		Ranks:                        ranks,
+	}
+	if err := checkQuantilesPerKeyParams(quantilesParams, noiseKind, reflect.TypeOf(int64(0))); err != nil {
+		return QuantilesParams{}, CountParams{}, err
+	}
+	buckets := make([]int64, params.NumBuckets)
+	for i := range buckets {
+		buckets[i] = int64(i)
+	}
+	countParams := CountParams{
+		NoiseKind:          params.NoiseKind,
+		AggregationEpsilon: params.AggregationEpsilon * (1 - f),
+		AggregationDelta:   params.AggregationDelta * (1 - f),
+		PublicPartitions:   buckets,
+		// A privacy identifier contributing MaxContributions values can
+		// contribute all of them to a single bucket, or one to each of
+		// MaxContributions buckets.
+		MaxPartitionsContributed: min(params.MaxContributions, params.NumBuckets),
+		MaxValue:                 params.MaxContributions,
+	}
+	if err := checkCountParams(countParams, noiseKind, reflect.TypeOf(int64(0))); err != nil {
+		return QuantilesParams{}, CountParams{}, err
+	}
+	return quantilesParams, countParams, nil
+}
+
+func toHistogramValueFn(id beam.W, v beam.V) (beam.W, float64, error) {
+	value := reflect.ValueOf(v)
+	if !value.Type().ConvertibleTo(reflect.TypeOf(float64(0))) {
+		return nil, 0, fmt.Errorf("unexpected value type of %v", value.Type())
+	}
+	return id, value.Convert(reflect.TypeOf(float64(0))).Float(), nil
+}
+
+// keyHistogramValueFn associates every value with the same partition, so that
+// the boundaries of the buckets can be computed with quantilesPerKey.
+type keyHistogramValueFn struct {
+	Codec *kv.Codec
+}
+
+func (fn *keyHistogramValueFn) Setup() error {
+	return fn.Codec.Setup()
+}
+
+func (fn *keyHistogramValueFn) ProcessElement(id beam.W, v float64) (beam.W, kv.Pair, error) {
+	pair, err := fn.Codec.Encode(int64(0), v)
+	if err != nil {
+		return nil, kv.Pair{}, fmt.Errorf("pbeam.keyHistogramValueFn.ProcessElement: couldn't encode value %f: %v", v, err)
+	}
+	return id, pair, nil
+}
+
+// assignHistogramBucketFn replaces each value by the index of its bucket.
+type assignHistogramBucketFn struct{}
+
+func (fn *assignHistogramBucketFn) ProcessElement(id beam.W, v float64, boundaries []float64) (beam.W, int64) {
+	// Boundaries are sorted, since quantiles are monotonic in their rank.
+	return id, int64(sort.SearchFloat64s(boundaries, v))
+}
+
+// makeHistogramBucketFn adds the bounds of each bucket to its count.
+type makeHistogramBucketFn struct {
+	MinValue, MaxValue float64
+}
+
+func (fn *makeHistogramBucketFn) ProcessElement(bucket, count int64, boundaries []float64) HistogramBucket {
+	b := HistogramBucket{Lower: fn.MinValue, Upper: fn.MaxValue, Count: count}
+	if bucket > 0 {
+		b.Lower = boundaries[bucket-1]
+	}
+	if bucket < int64(len(boundaries)) {
+		b.Upper = boundaries[bucket]
+	}
+	return b
+}
@@ -0,0 +1,469 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Combiner3[histogramAccum, []float64, []HistogramBucket](&histogramFn{})
+	register.Function3x0[beam.V, []HistogramBucket, func(beam.V, []HistogramBucket)](dropThresholdedPartitionsHistogram)
+	register.Emitter2[beam.V, []HistogramBucket]()
+}
+
+// HistogramPerKeyParams specifies the parameters associated with a
+// HistogramPerKey aggregation.
+type HistogramPerKeyParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	//
+	// The budget is not split between buckets: the counts of all buckets of a
+	// key are noised jointly.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. See MeanParams.PublicPartitions for details.
+	//
+	// PublicPartitions needs to be a beam.PCollection, slice, or array. The
+	// underlying type needs to match the partition type of the PrivatePCollection.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct keys that a given privacy identifier
+	// can influence. If a privacy identifier is associated to more keys,
+	// random keys will be dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of values that a given privacy identifier can
+	// contribute to the histogram of a key, across all of its buckets. If a
+	// privacy identifier is associated to more values for a key, random values
+	// will be dropped.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Boundaries between the buckets, in strictly increasing order. With n
+	// boundaries b₀ < … < bₙ₋₁, the histogram has n+1 buckets (-∞, b₀],
+	// (b₀, b₁], …, (bₙ₋₁, +∞).
+	//
+	// Boundaries must not be derived from private data. If they aren't known
+	// in advance, use Histogram, which chooses them with differentially private
+	// quantiles.
+	//
+	// Required.
+	Boundaries []float64
+}
+
+// HistogramPerKey computes a histogram of the values associated with each key
+// in a PrivatePCollection<K,V>, where V is a numeric type, with the buckets
+// given by params.Boundaries. It adds differentially private noise to the
+// count of each bucket and does pre-aggregation thresholding to remove
+// partitions with a low number of distinct privacy identifiers.
+//
+// Compared to calling Count once per bucket, HistogramPerKey bounds the
+// contributions of each privacy identifier across all buckets of a key at
+// once, so that the budget is consumed once for the whole histogram and the
+// buckets of a key are either all output or all dropped.
+//
+// It is also possible to manually specify the list of partitions
+// present in the output, in which case the partition selection/thresholding
+// step is skipped.
+//
+// HistogramPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,[]HistogramBucket>, with len(params.Boundaries)+1 buckets per
+// key, in increasing order.
+func HistogramPerKey(s beam.Scope, pcol PrivatePCollection, params HistogramPerKeyParams) beam.PCollection {
+	s = s.Scope("pbeam.HistogramPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("HistogramPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("HistogramPerKey: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "HistogramPerKey", err, pcol.codec.KType.T, reflect.TypeOf([]HistogramBucket(nil)))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("HistogramPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.HistogramPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("HistogramPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.HistogramPerKey: %v", err))
+	}
+
+	err = checkHistogramPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.HistogramPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("HistogramPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for HistogramPerKey: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},V>
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+
+	// Convert value to float64.
+	// Result is PCollection<kv.Pair{ID,K},float64>.
+	_, valueT := beam.ValidateKVType(decoded)
+	if err := checkNumericType(valueT); err != nil {
+		log.Fatalf("HistogramPerKey: %v", err)
+	}
+	converted := convertValues(s, spec, reflect.Float64, decoded)
+
+	// Combine all values for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition values across all buckets unless in test
+	// mode without contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>.
+	combined := beam.CombinePerKey(s, newExpandFloat64ValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)), converted)
+	combined = traceStage(s, *spec, "HistogramPerKey.boundContributionsPerPartition", combined)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "HistogramPerKey.boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		return addPublicPartitionsForHistogram(s, *spec, params, noiseKind, partialKV)
+	}
+	// Compute the histogram of each partition. Result is PCollection<partition, []HistogramBucket>.
+	fn, err := newHistogramFn(*spec, params, noiseKind, false)
+	if err != nil {
+		log.Fatalf("Couldn't get histogramFn for HistogramPerKey: %v", err)
+	}
+	histograms := beam.CombinePerKey(s, fn, partialKV)
+	histograms = traceStage(s, *spec, "HistogramPerKey.histogram", histograms)
+	reportNoiseDraws(s, histograms)
+	// Finally, drop thresholded partitions.
+	return beam.ParDo(s, dropThresholdedPartitionsHistogram, histograms)
+}
+
+func addPublicPartitionsForHistogram(s beam.Scope, spec PrivacySpec, params HistogramPerKeyParams, noiseKind noise.Kind, partialKV beam.PCollection) beam.PCollection {
+	// Compute histograms with empty public partitions added. Result is PCollection<partition, []HistogramBucket>.
+	// First, add empty slice to all public partitions.
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	// Second, add noise to all public partitions (all of which are empty-valued).
+	fn, err := newHistogramFn(spec, params, noiseKind, true)
+	if err != nil {
+		log.Fatalf("Couldn't get histogramFn for HistogramPerKey: %v", err)
+	}
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	// Third, compute noisy histograms for partitions in the actual data.
+	histograms := beam.CombinePerKey(s, fn, partialKV)
+	histograms = traceStage(s, spec, "HistogramPerKey.histogram", histograms)
+	reportNoiseDraws(s, histograms)
+	// Finally, co-group the noisy histograms with the noisy empty public
+	// partitions, and emit the noisy empty histogram for public partitions not
+	// found in the data.
+	return beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, histograms, noisyEmptyPublicPartitions))
+}
+
+func checkHistogramPerKeyParams(params HistogramPerKeyParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	if len(params.Boundaries) == 0 {
+		return fmt.Errorf("Boundaries must be set")
+	}
+	for i, b := range params.Boundaries {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("Boundaries[%d]=%f must be finite", i, b)
+		}
+		if i > 0 && b <= params.Boundaries[i-1] {
+			return fmt.Errorf("Boundaries must be strictly increasing, got Boundaries[%d]=%f after Boundaries[%d]=%f", i, b, i-1, params.Boundaries[i-1])
+		}
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+// dropThresholdedPartitionsHistogram drops thresholded histograms, i.e. those
+// that are nil, by emitting only non-thresholded partitions.
+func dropThresholdedPartitionsHistogram(v beam.V, buckets []HistogramBucket, emit func(beam.V, []HistogramBucket)) {
+	if buckets != nil {
+		emit(v, buckets)
+	}
+}
+
+type histogramAccum struct {
+	Counts           []*dpagg.Count // Count of each bucket.
+	SP               *dpagg.PreAggSelectPartition
+	PublicPartitions bool
+}
+
+// histogramFn is a differentially private combineFn for computing a histogram
+// of values. Do not initialize it yourself, use newHistogramFn to create a
+// histogramFn instance.
+type histogramFn struct {
+	// Privacy spec parameters (set during initial construction).
+	NoiseEpsilon                 float64
+	PartitionSelectionEpsilon    float64
+	NoiseDelta                   float64
+	PartitionSelectionDelta      float64
+	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	Boundaries                   []float64
+	NoiseKind                    noise.Kind
+	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
+	PublicPartitions             bool        // Set to true if public partitions are used.
+	TestMode                     TestMode
+}
+
+// newHistogramFn returns a histogramFn with the given budget and parameters.
+func newHistogramFn(spec PrivacySpec, params HistogramPerKeyParams, noiseKind noise.Kind, publicPartitions bool) (*histogramFn, error) {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
+		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	return &histogramFn{
+		NoiseEpsilon:                 params.AggregationEpsilon,
+		NoiseDelta:                   params.AggregationDelta,
+		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
+		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		Boundaries:                   params.Boundaries,
+		NoiseKind:                    noiseKind,
+		PublicPartitions:             publicPartitions,
+		TestMode:                     spec.testMode,
+	}, nil
+}
+
+func (fn *histogramFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+func (fn *histogramFn) CreateAccumulator() (histogramAccum, error) {
+	// A privacy identifier contributes at most MaxContributionsPerPartition
+	// values to all buckets of a key together, so the L1 and L2 sensitivities
+	// of the vector of counts of a key are at most
+	// MaxContributionsPerPartition. Each count can thus be noised with the
+	// full budget and the sensitivity of a single count incremented by at most
+	// MaxContributionsPerPartition.
+	maxIncrement := fn.MaxContributionsPerPartition
+	if fn.TestMode == TestModeWithoutContributionBounding {
+		maxIncrement = 0
+	}
+	accum := histogramAccum{Counts: make([]*dpagg.Count, len(fn.Boundaries)+1), PublicPartitions: fn.PublicPartitions}
+	var err error
+	for i := range accum.Counts {
+		accum.Counts[i], err = dpagg.NewCount(&dpagg.CountOptions{
+			Epsilon:                  fn.NoiseEpsilon,
+			Delta:                    fn.NoiseDelta,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+			Noise:                    fn.noise,
+			MaxIncrement:             maxIncrement,
+		})
+		if err != nil {
+			return histogramAccum{}, err
+		}
+	}
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *histogramFn) AddInput(a histogramAccum, values []float64) (histogramAccum, error) {
+	// The values of a privacy identifier are counted with a single call to
+	// IncrementBy per bucket, and the privacy identifier is counted once for
+	// partition selection.
+	perBucket := make([]int64, len(a.Counts))
+	for _, v := range values {
+		perBucket[sort.SearchFloat64s(fn.Boundaries, v)]++
+	}
+	for i, c := range perBucket {
+		if c == 0 {
+			continue
+		}
+		if err := a.Counts[i].IncrementBy(c); err != nil {
+			return a, err
+		}
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *histogramFn) MergeAccumulators(a, b histogramAccum) (histogramAccum, error) {
+	for i := range a.Counts {
+		if err := a.Counts[i].Merge(b.Counts[i]); err != nil {
+			return a, err
+		}
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+func (fn *histogramFn) ExtractOutput(a histogramAccum) ([]HistogramBucket, error) {
+	for _, c := range a.Counts {
+		if fn.TestMode.isEnabled() {
+			c.Noise = noNoise{}
+		}
+		c.Noise = auditNoise(c.Noise, "HistogramPerKey")
+	}
+	if !fn.TestMode.isEnabled() && !a.PublicPartitions {
+		keep, err := fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !keep {
+			return nil, err
+		}
+	}
+	buckets := make([]HistogramBucket, len(a.Counts))
+	for i, c := range a.Counts {
+		count, err := c.Result()
+		if err != nil {
+			return nil, err
+		}
+		buckets[i] = HistogramBucket{Lower: math.Inf(-1), Upper: math.Inf(1), Count: count}
+		if i > 0 {
+			buckets[i].Lower = fn.Boundaries[i-1]
+		}
+		if i < len(fn.Boundaries) {
+			buckets[i].Upper = fn.Boundaries[i]
+		}
+	}
+	return buckets, nil
+}
+
+func (fn *histogramFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *histogramFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
@@ -0,0 +1,202 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, []HistogramBucket, string](formatHistogramFn)
+	register.Function2x1[int, []HistogramBucket, string](histogramTotalCountFn)
+}
+
+func formatHistogramFn(partition int, buckets []HistogramBucket) string {
+	s := fmt.Sprintf("%d:", partition)
+	for _, b := range buckets {
+		s += fmt.Sprintf(" (%v,%v]=%d", b.Lower, b.Upper, b.Count)
+	}
+	return s
+}
+
+func TestHistogramPerKeyNoNoise(t *testing.T) {
+	// Partition 0 has 100 values equal to 1, 50 values equal to 5 and 20
+	// values equal to 10; partition 1 has 30 values equal to 2.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, 1),
+		testutils.MakeTripleWithFloatValueStartingFromKey(100, 50, 0, 5),
+		testutils.MakeTripleWithFloatValueStartingFromKey(150, 20, 0, 10),
+		testutils.MakeTripleWithFloatValueStartingFromKey(200, 30, 1, 2))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := HistogramPerKey(s, pcol, HistogramPerKeyParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		Boundaries:                   []float64{1, 5},
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatHistogramFn, got),
+		"0: (-Inf,1]=100 (1,5]=50 (5,+Inf]=20",
+		"1: (-Inf,1]=0 (1,5]=30 (5,+Inf]=0")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestHistogramPerKeyNoNoise: HistogramPerKey(%v) = %v, error %v", col, got, err)
+	}
+}
+
+// Checks that contributions are bounded across all buckets of a key.
+func TestHistogramPerKeyBoundsContributionsAcrossBuckets(t *testing.T) {
+	// Each privacy ID contributes one value to each of the 3 buckets.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, 0),
+		testutils.MakeTripleWithFloatValue(100, 0, 2),
+		testutils.MakeTripleWithFloatValue(100, 0, 4))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := HistogramPerKey(s, pcol, HistogramPerKeyParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 2,
+		Boundaries:                   []float64{1, 3},
+		PublicPartitions:             []int{0, 1},
+	})
+
+	// Each privacy ID keeps 2 of its 3 values, so the buckets of partition 0
+	// contain 200 values in total. Public partition 1 is empty.
+	totals := beam.ParDo(s, histogramTotalCountFn, got)
+	passert.Equals(s, totals, "0: 200", "1: 0")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestHistogramPerKeyBoundsContributionsAcrossBuckets: HistogramPerKey(%v) = %v, error %v", col, got, err)
+	}
+}
+
+func histogramTotalCountFn(partition int, buckets []HistogramBucket) string {
+	var total int64
+	for _, b := range buckets {
+		total += b.Count
+	}
+	return fmt.Sprintf("%d: %d", partition, total)
+}
+
+func TestCheckHistogramPerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		params        HistogramPerKeyParams
+		noiseKind     noise.Kind
+		partitionType reflect.Type
+		wantErr       bool
+	}{
+		{
+			desc: "valid parameters",
+			params: HistogramPerKeyParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				Boundaries:                   []float64{0, 1},
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc: "valid parameters with public partitions",
+			params: HistogramPerKeyParams{
+				AggregationEpsilon:           1.0,
+				PublicPartitions:             []int{0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				Boundaries:                   []float64{0},
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: reflect.TypeOf(0),
+			wantErr:       false,
+		},
+		{
+			desc: "no boundaries",
+			params: HistogramPerKeyParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unsorted boundaries",
+			params: HistogramPerKeyParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				Boundaries:                   []float64{1, 0},
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "duplicate boundaries",
+			params: HistogramPerKeyParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				Boundaries:                   []float64{1, 1},
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxContributionsPerPartition",
+			params: HistogramPerKeyParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+				Boundaries:               []float64{0},
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkHistogramPerKeyParams(tc.params, tc.noiseKind, tc.partitionType); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
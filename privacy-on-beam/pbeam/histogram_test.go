@@ -0,0 +1,155 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func init() {
+	register.Function1x1[HistogramBucket, int64](histogramBucketCountFn)
+}
+
+func histogramBucketCountFn(b HistogramBucket) int64 {
+	return b.Count
+}
+
+// Checks that Histogram outputs NumBuckets buckets containing all values.
+func TestHistogram(t *testing.T) {
+	// Privacy IDs 0-99 contribute values 0-99.
+	var pairs []testutils.PairII
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, testutils.PairII{i, i})
+	}
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	got := Histogram(s, pcol, HistogramParams{
+		NumBuckets:       4,
+		MaxContributions: 1,
+		MinValue:         0,
+		MaxValue:         100,
+	})
+	counts := beam.ParDo(s, histogramBucketCountFn, got)
+	passert.Count(s, counts, "buckets", 4)
+	passert.Equals(s, stats.Sum(s, counts), int64(100))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestHistogram: Histogram(%v) = %v, want 4 buckets with a total count of 100: %v", col, got, err)
+	}
+}
+
+// Checks that invalid parameters of Histogram fail the pipeline when
+// validation errors are deferred.
+func TestHistogramDeferValidationErrors(t *testing.T) {
+	p, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+	// There must be at least two buckets.
+	Histogram(s, MakePrivate(s, col, spec), HistogramParams{
+		NumBuckets:       1,
+		MaxContributions: 1,
+		MinValue:         0,
+		MaxValue:         100,
+	})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "Histogram" {
+		t.Errorf("ValidationErrors() = %v, want a single error for Histogram", errs)
+	}
+	// The invalid Histogram doesn't consume any budget.
+	for _, usage := range spec.BudgetUsage() {
+		if usage.ConsumedEpsilon != 0 || usage.ConsumedDelta != 0 {
+			t.Errorf("BudgetUsage() after an invalid Histogram: got %+v, want no consumed budget", usage)
+		}
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestHistogramDeferValidationErrors: pipeline with an invalid Histogram succeeded, expected an error")
+	}
+}
+
+func TestHistogramPhaseParams(t *testing.T) {
+	quantilesParams, countParams, err := histogramPhaseParams(HistogramParams{
+		AggregationEpsilon:       1,
+		BoundariesBudgetFraction: 0.25,
+		NumBuckets:               4,
+		MaxContributions:         2,
+		MinValue:                 0,
+		MaxValue:                 100,
+	}, noise.LaplaceNoise)
+	if err != nil {
+		t.Fatalf("histogramPhaseParams: got error %v", err)
+	}
+	if diff := cmp.Diff([]float64{0.25, 0.5, 0.75}, quantilesParams.Ranks, cmpopts.EquateApprox(1e-9, 0)); diff != "" {
+		t.Errorf("histogramPhaseParams: got ranks diff (-want +got):\n%s", diff)
+	}
+	if quantilesParams.AggregationEpsilon != 0.25 || countParams.AggregationEpsilon != 0.75 {
+		t.Errorf("histogramPhaseParams: got epsilons %f for boundaries and %f for counts, want 0.25 and 0.75", quantilesParams.AggregationEpsilon, countParams.AggregationEpsilon)
+	}
+	if countParams.MaxPartitionsContributed != 2 || countParams.MaxValue != 2 {
+		t.Errorf("histogramPhaseParams: got MaxPartitionsContributed=%d and MaxValue=%d for counts, want 2 and 2", countParams.MaxPartitionsContributed, countParams.MaxValue)
+	}
+}
+
+func TestHistogramPhaseParamsInvalid(t *testing.T) {
+	valid := HistogramParams{AggregationEpsilon: 1, BoundariesBudgetFraction: 0.5, NumBuckets: 4, MaxContributions: 1, MinValue: 0, MaxValue: 100}
+	for _, tc := range []struct {
+		desc   string
+		modify func(*HistogramParams)
+	}{
+		{"BoundariesBudgetFraction of 1", func(p *HistogramParams) { p.BoundariesBudgetFraction = 1 }},
+		{"single bucket", func(p *HistogramParams) { p.NumBuckets = 1 }},
+		{"no MaxContributions", func(p *HistogramParams) { p.MaxContributions = 0 }},
+		{"MinValue larger than MaxValue", func(p *HistogramParams) { p.MinValue = 200 }},
+	} {
+		params := valid
+		tc.modify(&params)
+		if _, _, err := histogramPhaseParams(params, noise.LaplaceNoise); err == nil {
+			t.Errorf("histogramPhaseParams with %s: got no error, want error", tc.desc)
+		}
+	}
+}
+
+func TestMakeHistogramBucketFn(t *testing.T) {
+	fn := &makeHistogramBucketFn{MinValue: 0, MaxValue: 100}
+	boundaries := []float64{10, 50}
+	for _, tc := range []struct {
+		bucket int64
+		want   HistogramBucket
+	}{
+		{0, HistogramBucket{Lower: 0, Upper: 10, Count: 7}},
+		{1, HistogramBucket{Lower: 10, Upper: 50, Count: 7}},
+		{2, HistogramBucket{Lower: 50, Upper: 100, Count: 7}},
+	} {
+		if got := fn.ProcessElement(tc.bucket, 7, boundaries); got != tc.want {
+			t.Errorf("makeHistogramBucketFn(%d) = %+v, want %+v", tc.bucket, got, tc.want)
+		}
+		if _, got := (&assignHistogramBucketFn{}).ProcessElement(nil, tc.want.Upper, boundaries); got != tc.bucket {
+			t.Errorf("assignHistogramBucketFn(%f) = %d, want %d", tc.want.Upper, got, tc.bucket)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Function3x0[beam.W, *int64, func(beam.W, bool)](thresholdedPartitionsInt64)
+	register.Function3x0[beam.W, *float64, func(beam.W, bool)](thresholdedPartitionsFloat64)
+	register.Emitter2[beam.W, bool]()
+	register.DoFn4x0[beam.W, func(*bool) bool, func(*int64) bool, func(float64)](&longTailContributionsInt64Fn{})
+	register.DoFn4x0[beam.W, func(*bool) bool, func(*float64) bool, func(float64)](&longTailContributionsFloat64Fn{})
+	register.Emitter1[float64]()
+}
+
+// LongTailParams specifies the parameters of the "other" bucket of an
+// aggregation, which aggregates the contributions to all the partitions that
+// fail partition selection into a single output partition. Without it, these
+// contributions are silently dropped from the output.
+//
+// The "other" bucket is a separate aggregation: its noise is calibrated to
+// the total contribution of a privacy identifier to all its partitions (e.g.
+// MaxPartitionsContributed*MaxValue for Count), since all of them can end up in
+// the "other" bucket.
+type LongTailParams struct {
+	// The partition under which the "other" bucket is emitted. It must have
+	// the same type as the partitions of the aggregation, and shouldn't be a
+	// partition that can appear in the data: otherwise, the output would
+	// contain this partition twice.
+	//
+	// The "other" bucket is only emitted if Partition is set.
+	Partition any
+	// Differential privacy budget consumed by the "other" bucket, in addition
+	// to the budget consumed by the aggregation itself.
+	//
+	// Required if Partition is set: the entire budget reserved for aggregation
+	// in the PrivacySpec can't be consumed by both the aggregation and its
+	// "other" bucket, so the AggregationEpsilon (and AggregationDelta, if
+	// needed) of the aggregation must also be set.
+	AggregationEpsilon, AggregationDelta float64
+}
+
+// consumeLongTailBudget consumes the aggregation budget of the "other" bucket
+// specified by params, if any. It must be called before the aggregation gets
+// its own budget, so that the aggregation doesn't consume the entire budget
+// reserved for aggregation in the PrivacySpec.
+func consumeLongTailBudget(spec *PrivacySpec, params *LongTailParams) error {
+	if params.Partition == nil {
+		return nil
+	}
+	if params.AggregationEpsilon == 0 {
+		return fmt.Errorf("LongTail.AggregationEpsilon must be set when LongTail.Partition is set")
+	}
+	var err error
+	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
+	return err
+}
+
+// checkLongTailParams returns an error if the "other" bucket specified by
+// params can't be computed for an aggregation with the given public
+// partitions, noise and partition type.
+func checkLongTailParams(params LongTailParams, publicPartitions any, noiseKind noise.Kind, partitionType reflect.Type) error {
+	if params.Partition == nil {
+		if params.AggregationEpsilon != 0 || params.AggregationDelta != 0 {
+			return fmt.Errorf("LongTail.AggregationEpsilon and LongTail.AggregationDelta must be unset when LongTail.Partition is unset")
+		}
+		return nil
+	}
+	if publicPartitions != nil {
+		return fmt.Errorf("LongTail can't be used with public partitions: no partition fails partition selection")
+	}
+	if t := reflect.TypeOf(params.Partition); t != partitionType {
+		return fmt.Errorf("LongTail.Partition is of type %v, want the partition type %v", t, partitionType)
+	}
+	if err := checks.CheckEpsilonStrict(params.AggregationEpsilon, "LongTail.AggregationEpsilon"); err != nil {
+		return err
+	}
+	if noise.Consumption(noiseKind) == noise.EpsilonOnly {
+		return checks.CheckNoDelta(params.AggregationDelta, "LongTail.AggregationDelta")
+	}
+	return checks.CheckDeltaStrict(params.AggregationDelta, "LongTail.AggregationDelta")
+}
+
+// addLongTailPartition adds the "other" bucket specified by params to result.
+//
+// contributions is the PCollection<K,V> of the per-partition contributions of
+// each privacy identifier after contribution bounding, and sums the
+// PCollection<K,*V> of the aggregation of these contributions, where nil
+// values mark the partitions that failed partition selection. V is int64 or
+// float64, depending on vKind. Each contribution is clamped to [lower, upper].
+func addLongTailPartition(s beam.Scope, spec PrivacySpec, params LongTailParams, noiseKind noise.Kind, maxPartitionsContributed int64, lower, upper float64, vKind reflect.Kind, contributions, sums, result beam.PCollection) beam.PCollection {
+	s = s.Scope("addLongTailPartition")
+	var thresholdedFn, contributionsFn any
+	switch vKind {
+	case reflect.Int64:
+		thresholdedFn = thresholdedPartitionsInt64
+		contributionsFn = &longTailContributionsInt64Fn{Lower: lower, Upper: upper}
+	case reflect.Float64:
+		thresholdedFn = thresholdedPartitionsFloat64
+		contributionsFn = &longTailContributionsFloat64Fn{Lower: lower, Upper: upper}
+	default:
+		log.Fatalf("Couldn't add the LongTail partition: kind(%v) should be int64 or float64", vKind)
+	}
+	thresholded := beam.ParDo(s, thresholdedFn, sums)
+	grouped := beam.CoGroupByKey(s, thresholded, contributions)
+	longTailContributions := beam.ParDo(s, contributionsFn, grouped)
+	// Each privacy identifier contributes to at most maxPartitionsContributed
+	// partitions, all of which can fail partition selection.
+	total := noisyTotal(s, spec, params.AggregationEpsilon, params.AggregationDelta, noiseKind, maxPartitionsContributed, lower, upper, longTailContributions)
+	return beam.Flatten(s, result, keyTotal(s, params.Partition, vKind, total))
+}
+
+// thresholdedPartitionsInt64 emits the int partitions that failed partition
+// selection, i.e. those that have nil r.
+func thresholdedPartitionsInt64(k beam.W, r *int64, emit func(beam.W, bool)) {
+	if r == nil {
+		emit(k, true)
+	}
+}
+
+// thresholdedPartitionsFloat64 emits the float partitions that failed
+// partition selection, i.e. those that have nil r.
+func thresholdedPartitionsFloat64(k beam.W, r *float64, emit func(beam.W, bool)) {
+	if r == nil {
+		emit(k, true)
+	}
+}
+
+// longTailContributionsInt64Fn emits the clamped contributions to a partition
+// if it failed partition selection.
+type longTailContributionsInt64Fn struct {
+	Lower, Upper float64
+}
+
+func (fn *longTailContributionsInt64Fn) ProcessElement(_ beam.W, thresholdedIter func(*bool) bool, contributionsIter func(*int64) bool, emit func(float64)) {
+	var thresholded bool
+	if !thresholdedIter(&thresholded) {
+		return
+	}
+	var v int64
+	for contributionsIter(&v) {
+		emit(math.Min(math.Max(float64(v), fn.Lower), fn.Upper))
+	}
+}
+
+// longTailContributionsFloat64Fn emits the clamped contributions to a
+// partition if it failed partition selection.
+type longTailContributionsFloat64Fn struct {
+	Lower, Upper float64
+}
+
+func (fn *longTailContributionsFloat64Fn) ProcessElement(_ beam.W, thresholdedIter func(*bool) bool, contributionsIter func(*float64) bool, emit func(float64)) {
+	var thresholded bool
+	if !thresholdedIter(&thresholded) {
+		return
+	}
+	var v float64
+	for contributionsIter(&v) {
+		emit(math.Min(math.Max(v, fn.Lower), fn.Upper))
+	}
+}
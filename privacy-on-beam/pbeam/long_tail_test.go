@@ -0,0 +1,185 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// Checks that the counts of thresholded partitions are aggregated into the
+// LongTail partition.
+func TestCountLongTail(t *testing.T) {
+	// Values 0 and 1 are associated with 3 and 4 privacy units respectively,
+	// so they should be thresholded and counted in the LongTail partition -1;
+	// value 2 is associated with 50 privacy units.
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 3, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(3, 4, 1),
+		testutils.MakePairsWithFixedVStartingFromKey(7, 50, 2),
+	)
+	result := []testutils.PairII64{
+		{-1, 7},
+		{2, 50},
+	}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	// ε=25, δ=10⁻²⁰⁰ and l0Sensitivity=1 gives a threshold of ≈21.
+	// We have 3 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁴ probability (k=24).
+	// The LongTail partition has the same l1Sensitivity as the other
+	// partitions, since MaxPartitionsContributed is 1.
+	epsilon, delta, k, l1Sensitivity := 25.0, 1e-200, 24.0, 1.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        2 * epsilon,
+			PartitionSelectionEpsilon: epsilon,
+			PartitionSelectionDelta:   delta,
+		}))
+	got := Count(s, pcol, CountParams{
+		AggregationEpsilon:       epsilon,
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		NoiseKind:                LaplaceNoise{},
+		LongTail:                 LongTailParams{Partition: -1, AggregationEpsilon: epsilon},
+	})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.ApproxEqualsKVInt64(t, s, got, want, testutils.RoundedLaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountLongTail: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that the sums of thresholded partitions are aggregated into the
+// LongTail partition, with a noise scaled to MaxPartitionsContributed.
+func TestSumPerKeyLongTail(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeSampleTripleWithFloatValue(7, 0),
+		testutils.MakeSampleTripleWithFloatValue(99, 2))
+	result := []testutils.PairIF64{
+		// Only 7 privacy units are associated with value 0: should be
+		// thresholded and summed in the LongTail partition -1.
+		{-1, 7},
+		{2, 99},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	// ε=50, δ=10⁻²⁰⁰ and l0Sensitivity=3 gives a threshold of ≈31.
+	// We have 3 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁴ probability (k=24).
+	// The LongTail partition has a l0Sensitivity of 1 and a lInfSensitivity of
+	// MaxPartitionsContributed*MaxValue=3, so the same l1Sensitivity as the
+	// other partitions.
+	epsilon, delta, k, l1Sensitivity := 50.0, 1e-200, 24.0, 3.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        2 * epsilon,
+			PartitionSelectionEpsilon: epsilon,
+			PartitionSelectionDelta:   delta,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := SumPerKey(s, pcol, SumParams{
+		AggregationEpsilon:       epsilon,
+		MaxPartitionsContributed: 3,
+		MinValue:                 0.0,
+		MaxValue:                 1.0,
+		NoiseKind:                LaplaceNoise{},
+		LongTail:                 LongTailParams{Partition: -1, AggregationEpsilon: epsilon},
+	})
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, testutils.LaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSumPerKeyLongTail: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestCheckLongTailParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc             string
+		params           LongTailParams
+		publicPartitions any
+		noiseKind        noise.Kind
+		wantErr          bool
+	}{
+		{
+			desc:      "unset",
+			params:    LongTailParams{},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc:      "valid Laplace",
+			params:    LongTailParams{Partition: -1, AggregationEpsilon: 1},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc:      "valid Gaussian",
+			params:    LongTailParams{Partition: -1, AggregationEpsilon: 1, AggregationDelta: 1e-5},
+			noiseKind: noise.GaussianNoise,
+			wantErr:   false,
+		},
+		{
+			desc:      "budget without partition",
+			params:    LongTailParams{AggregationEpsilon: 1},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:             "public partitions",
+			params:           LongTailParams{Partition: -1, AggregationEpsilon: 1},
+			publicPartitions: []int{0},
+			noiseKind:        noise.LaplaceNoise,
+			wantErr:          true,
+		},
+		{
+			desc:      "wrong partition type",
+			params:    LongTailParams{Partition: "other", AggregationEpsilon: 1},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "zero epsilon",
+			params:    LongTailParams{Partition: -1},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "non-zero delta with Laplace",
+			params:    LongTailParams{Partition: -1, AggregationEpsilon: 1, AggregationDelta: 1e-5},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "zero delta with Gaussian",
+			params:    LongTailParams{Partition: -1, AggregationEpsilon: 1},
+			noiseKind: noise.GaussianNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkLongTailParams(tc.params, tc.publicPartitions, tc.noiseKind, reflect.TypeOf(0)); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v error, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
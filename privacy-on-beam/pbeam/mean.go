@@ -113,6 +113,19 @@ type MeanParams struct {
 	//
 	// Required.
 	MinValue, MaxValue float64
+	// If set, values are clamped to [MinValue, MaxValue] and transformed before
+	// being averaged, and the inverse of the transform is applied to the noisy
+	// means. For example, with LogTransform{}, MeanPerKey computes geometric
+	// means, and the noise is proportional to log(MaxValue)-log(MinValue)
+	// instead of MaxValue-MinValue.
+	//
+	// Optional.
+	Transform Transform
+	// Post-processing steps applied, in order, to the noisy means. See
+	// PostProcessor for details.
+	//
+	// Optional.
+	PostProcessing []PostProcessor
 }
 
 // MeanPerKey obtains the mean of the values associated with each key in a
@@ -130,6 +143,7 @@ type MeanParams struct {
 // This aggregation is not hardened for such applications yet.
 func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.PCollection {
 	s = s.Scope("pbeam.MeanPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
 	// Obtain & validate type information from the underlying PCollection<K,V>.
 	idT, kvT := beam.ValidateKVType(pcol.col)
 	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
@@ -138,33 +152,37 @@ func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.P
 	if pcol.codec == nil {
 		log.Fatalf("MeanPerKey: no codec found for the input PrivatePCollection.")
 	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "MeanPerKey", err, pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
 
 	// Get privacy parameters.
 	spec := pcol.privacySpec
-	var err error
-	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.get(params.AggregationEpsilon, params.AggregationDelta)
+	budget, err := spec.reserveBudget("MeanPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
 	if err != nil {
-		log.Fatalf("Couldn't consume aggregation budget for Mean: %v", err)
-	}
-	if params.PublicPartitions == nil {
-		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.get(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
-		if err != nil {
-			log.Fatalf("Couldn't consume partition selection budget for Mean: %v", err)
-		}
+		return invalid(err)
 	}
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.MeanPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("MeanPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.MeanPerKey: %v", err))
 	}
 
 	err = checkMeanPerKeyParams(params, noiseKind, pcol.codec.KType.T)
 	if err != nil {
-		log.Fatalf("pbeam.MeanPerKey: %v", err)
+		return invalid(fmt.Errorf("pbeam.MeanPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
 	}
+	spec.aggregationRegistered("MeanPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+	transform := params.Transform
+	pcol = applyTransform(s, "MeanPerKey", pcol, transform, &params.MinValue, &params.MaxValue)
 
 	// Drop non-public partitions, if public partitions are specified.
 	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
@@ -174,15 +192,11 @@ func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.P
 
 	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
 	// Result is PCollection<kv.Pair{ID,K},V>
-	decoded := beam.ParDo(s,
-		newEncodeIDKFn(idT, pcol.codec),
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
 		pcol.col,
 		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
-
-	// Don't do per-partition contribution bounding if in test mode without contribution bounding.
-	if spec.testMode != TestModeWithoutContributionBounding {
-		decoded = boundContributions(s, decoded, params.MaxContributionsPerPartition)
-	}
+	decoded = saltPrivacyIDs(s, spec, decoded)
 
 	// Convert value to float64.
 	// Result is PCollection<kv.Pair{ID,K},float64>.
@@ -190,17 +204,20 @@ func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.P
 	if err := checkNumericType(valueT); err != nil {
 		log.Fatalf("MeanPerKey: %v", err)
 	}
-	converted := beam.ParDo(s, convertToFloat64Fn, decoded)
+	converted := convertValues(s, spec, reflect.Float64, decoded)
 
-	// Combine all values for <id, partition> into a slice.
+	// Combine all values for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition values unless in test mode without contribution bounding.
 	// Result is PCollection<kv.Pair{ID,K},[]float64>.
-	combined := beam.CombinePerKey(s, &expandFloat64ValuesCombineFn{}, converted)
+	combined := beam.CombinePerKey(s, newExpandFloat64ValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)), converted)
+	combined = traceStage(s, *spec, "MeanPerKey.boundContributionsPerPartition", combined)
 
 	// Result is PCollection<ID, pairArrayFloat64>.
 	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
 	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
 	if spec.testMode != TestModeWithoutContributionBounding {
 		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "MeanPerKey.boundContributions", rekeyed)
 	}
 
 	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
@@ -225,11 +242,16 @@ func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.P
 		means := beam.CombinePerKey(s,
 			boundedMeanFn,
 			partialKV)
+		means = traceStage(s, *spec, "MeanPerKey.aggregate", means)
+		reportNoiseDraws(s, means)
 		// Finally, drop thresholded partitions.
 		result = beam.ParDo(s, dropThresholdedPartitionsFloat64, means)
 	}
 
-	return result
+	if transform != nil {
+		result = invertTransform(s, transform, result)
+	}
+	return PostProcess(s, result, params.PostProcessing...)
 }
 
 func addPublicPartitionsForMean(s beam.Scope, spec PrivacySpec, params MeanParams, noiseKind noise.Kind, partialKV beam.PCollection) beam.PCollection {
@@ -246,12 +268,21 @@ func addPublicPartitionsForMean(s beam.Scope, spec PrivacySpec, params MeanParam
 		log.Fatalf("Couldn't get boundedMeanFn for MeanPerKey: %v", err)
 	}
 	noisyEmptyPublicPartitions := beam.CombinePerKey(s, boundedMeanFn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
 	// Third, compute noisy means for partitions in the actual data.
 	boundedMeanFn, err = newBoundedMeanFn(spec, params, noiseKind, true, false)
 	if err != nil {
 		log.Fatalf("Couldn't get boundedMeanFn for MeanPerKey: %v", err)
 	}
 	means := beam.CombinePerKey(s, boundedMeanFn, partialKV)
+	means = traceStage(s, spec, "MeanPerKey.aggregate", means)
+	reportNoiseDraws(s, means)
+	return mergeMeansWithEmptyPublicPartitions(s, means, noisyEmptyPublicPartitions)
+}
+
+// mergeMeansWithEmptyPublicPartitions merges the noisy means of partitions found in the data
+// with the noisy means of empty public partitions, and dereferences the results.
+func mergeMeansWithEmptyPublicPartitions(s beam.Scope, means, noisyEmptyPublicPartitions beam.PCollection) beam.PCollection {
 	// Fourth, co-group by actual noisy means with noisy public partitions, emit noisy empty value for public partitions not found in data.
 	noisyMeansWithEmptyPublicPartitions := beam.CoGroupByKey(s, means, noisyEmptyPublicPartitions)
 	means = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, noisyMeansWithEmptyPublicPartitions)
@@ -314,6 +345,7 @@ type boundedMeanFn struct {
 	NoiseDelta                   float64
 	PartitionSelectionDelta      float64
 	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
 	MaxPartitionsContributed     int64
 	MaxContributionsPerPartition int64
 	Lower                        float64
@@ -327,7 +359,7 @@ type boundedMeanFn struct {
 
 // newBoundedMeanFn returns a boundedMeanFn with the given budget and parameters.
 func newBoundedMeanFn(spec PrivacySpec, params MeanParams, noiseKind noise.Kind, publicPartitions bool, emptyPartitions bool) (*boundedMeanFn, error) {
-	if noiseKind != noise.GaussianNoise && noiseKind != noise.LaplaceNoise {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
 		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
 	}
 	return &boundedMeanFn{
@@ -336,6 +368,7 @@ func newBoundedMeanFn(spec PrivacySpec, params MeanParams, noiseKind noise.Kind,
 		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
 		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
 		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
 		MaxPartitionsContributed:     params.MaxPartitionsContributed,
 		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
 		Lower:                        params.MinValue,
@@ -415,26 +448,39 @@ func (fn *boundedMeanFn) MergeAccumulators(a, b boundedMeanAccum) (boundedMeanAc
 }
 
 func (fn *boundedMeanFn) ExtractOutput(a boundedMeanAccum) (*float64, error) {
+	keep, err := fn.keepPartition(a)
+	if err != nil || !keep {
+		return nil, err
+	}
+	result, err := a.BM.Result()
+	return &result, err
+}
+
+// keepPartition sets up the noise of the accumulated BoundedMean and returns
+// whether its partition is kept in the output.
+func (fn *boundedMeanFn) keepPartition(a boundedMeanAccum) (bool, error) {
 	if fn.TestMode.isEnabled() {
 		a.BM.NormalizedSum.Noise = noNoise{}
 		a.BM.Count.Noise = noNoise{}
 	}
-	var err error
-	shouldKeepPartition := fn.TestMode.isEnabled() || a.PublicPartitions // If in test mode or public partitions are specified, we always keep the partition.
-	if !shouldKeepPartition {                                            // If not, we need to perform private partition selection.
-		shouldKeepPartition, err = a.SP.ShouldKeepPartition()
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	if shouldKeepPartition {
-		result, err := a.BM.Result()
-		return &result, err
+	a.BM.NormalizedSum.Noise = auditNoise(a.BM.NormalizedSum.Noise, "BoundedMean")
+	a.BM.Count.Noise = auditNoise(a.BM.Count.Noise, "BoundedMean")
+	if fn.TestMode.isEnabled() || a.PublicPartitions { // If in test mode or public partitions are specified, we always keep the partition.
+		return true, nil
 	}
-	return nil, nil
+	// If not, we need to perform private partition selection.
+	return fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
 }
 
 func (fn *boundedMeanFn) String() string {
 	return fmt.Sprintf("%#v", fn)
 }
+
+func (fn *boundedMeanFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
@@ -0,0 +1,264 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// Metric declares a metric of a MetricRegistry.
+type Metric struct {
+	// Name of the metric, unique within the registry. It is the key of the
+	// metric in the outputs of MetricRegistry.Build.
+	//
+	// Required.
+	Name string
+	// Name of the input that the metric is computed on, i.e. its key in the
+	// inputs given to MetricRegistry.Build. Several metrics can share an
+	// input.
+	//
+	// Required.
+	Input string
+	// Parameters of the aggregation computing the metric, which also determine
+	// the aggregation: CountParams for Count, SumParams for SumPerKey,
+	// MeanParams for MeanPerKey and DistinctPrivacyIDParams for
+	// DistinctPrivacyID.
+	//
+	// The budget of the aggregation must be set explicitly in Params, so that
+	// the registry can enforce its budget policy: AggregationEpsilon, and
+	// the partition selection budget unless public partitions are specified.
+	//
+	// Required.
+	Params any
+}
+
+// MetricRegistryParams specifies the budget policy of a MetricRegistry. Limits
+// that are left unset are not enforced.
+type MetricRegistryParams struct {
+	// Maximum total budget of the metrics built in a single run.
+	//
+	// Optional.
+	MaxEpsilonPerRun, MaxDeltaPerRun float64
+	// Maximum total budget of all runs in the history of the registry, under
+	// basic composition. Set it when the runs release statistics about the
+	// same privacy units, e.g. recurring reports on the same users.
+	//
+	// Optional.
+	MaxTotalEpsilon, MaxTotalDelta float64
+}
+
+// MetricRun records the metrics built in a run of a MetricRegistry and the
+// budget they consumed.
+type MetricRun struct {
+	// ID of the run, given to MetricRegistry.Build.
+	ID string
+	// Names of the metrics built in the run, in declaration order.
+	Metrics []string
+	// Budget consumed by the run, under basic composition.
+	Epsilon, Delta float64
+}
+
+// MetricRegistry holds metrics that are declared once and built in every run
+// of a recurring report, e.g. a daily dashboard. It enforces a budget policy
+// on each run and on the history of runs, and records the history.
+//
+// The registry doesn't persist its history: callers must store History() after
+// each run, e.g. as JSON, and give it to NewMetricRegistry in the next run, so
+// that the total budget policy covers all runs.
+type MetricRegistry struct {
+	params  MetricRegistryParams
+	metrics []Metric
+	names   map[string]bool
+	history []MetricRun
+}
+
+// NewMetricRegistry creates a MetricRegistry with the given budget policy and
+// the history of the previous runs.
+func NewMetricRegistry(params MetricRegistryParams, history []MetricRun) (*MetricRegistry, error) {
+	if err := checkMetricRegistryParams(params); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for _, run := range history {
+		if ids[run.ID] {
+			return nil, fmt.Errorf("history contains run %q several times", run.ID)
+		}
+		ids[run.ID] = true
+	}
+	return &MetricRegistry{
+		params:  params,
+		names:   make(map[string]bool),
+		history: append([]MetricRun(nil), history...),
+	}, nil
+}
+
+func checkMetricRegistryParams(params MetricRegistryParams) error {
+	for _, limit := range []struct {
+		name           string
+		epsilon, delta float64
+	}{
+		{"PerRun", params.MaxEpsilonPerRun, params.MaxDeltaPerRun},
+		{"Total", params.MaxTotalEpsilon, params.MaxTotalDelta},
+	} {
+		if err := checks.CheckEpsilon(limit.epsilon, "MaxEpsilon"+limit.name); err != nil {
+			return err
+		}
+		if err := checks.CheckDelta(limit.delta, "MaxDelta"+limit.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register declares a metric.
+func (r *MetricRegistry) Register(m Metric) error {
+	if m.Name == "" {
+		return fmt.Errorf("metric name must be set")
+	}
+	if r.names[m.Name] {
+		return fmt.Errorf("metric %q is already registered", m.Name)
+	}
+	if m.Input == "" {
+		return fmt.Errorf("metric %q: Input must be set", m.Name)
+	}
+	if _, _, err := metricBudget(m.Params); err != nil {
+		return fmt.Errorf("metric %q: %w", m.Name, err)
+	}
+	r.names[m.Name] = true
+	r.metrics = append(r.metrics, m)
+	return nil
+}
+
+// History returns the runs of the registry, including those given to
+// NewMetricRegistry, in the order they were built.
+func (r *MetricRegistry) History() []MetricRun {
+	return append([]MetricRun(nil), r.history...)
+}
+
+// Build adds the aggregations computing all registered metrics to the
+// pipeline, and records the run in the history with the given ID. It returns
+// the output of each metric, keyed by metric name.
+//
+// Build fails without adding anything to the pipeline if the run ID is already
+// in the history, if an input is missing, or if the run would exceed the
+// budget policy. The aggregations consume the budget of the PrivacySpec of
+// their inputs, which must be large enough for them.
+func (r *MetricRegistry) Build(s beam.Scope, runID string, inputs map[string]PrivatePCollection) (map[string]beam.PCollection, error) {
+	var epsilon, delta float64
+	names := make([]string, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		if _, ok := inputs[m.Input]; !ok {
+			return nil, fmt.Errorf("metric %q: no input named %q", m.Name, m.Input)
+		}
+		// Params were checked by Register.
+		e, d, _ := metricBudget(m.Params)
+		epsilon += e
+		delta += d
+		names = append(names, m.Name)
+	}
+	if err := r.checkRun(runID, epsilon, delta); err != nil {
+		return nil, err
+	}
+
+	s = s.Scope("pbeam.MetricRegistry")
+	outputs := make(map[string]beam.PCollection, len(r.metrics))
+	for _, m := range r.metrics {
+		ms := s.Scope(m.Name)
+		input := inputs[m.Input]
+		switch p := m.Params.(type) {
+		case CountParams:
+			outputs[m.Name] = Count(ms, input, p)
+		case SumParams:
+			outputs[m.Name] = SumPerKey(ms, input, p)
+		case MeanParams:
+			outputs[m.Name] = MeanPerKey(ms, input, p)
+		case DistinctPrivacyIDParams:
+			outputs[m.Name] = DistinctPrivacyID(ms, input, p)
+		}
+	}
+	r.history = append(r.history, MetricRun{ID: runID, Metrics: names, Epsilon: epsilon, Delta: delta})
+	return outputs, nil
+}
+
+// checkRun returns an error if a run with the given ID and budget can't be
+// added to the history.
+func (r *MetricRegistry) checkRun(runID string, epsilon, delta float64) error {
+	if runID == "" {
+		return fmt.Errorf("run ID must be set")
+	}
+	totalEpsilon, totalDelta := epsilon, delta
+	for _, run := range r.history {
+		if run.ID == runID {
+			return fmt.Errorf("run %q is already in the history", runID)
+		}
+		totalEpsilon += run.Epsilon
+		totalDelta += run.Delta
+	}
+	if exceedsBudgetLimit(epsilon, r.params.MaxEpsilonPerRun) || exceedsBudgetLimit(delta, r.params.MaxDeltaPerRun) {
+		return fmt.Errorf("run %q needs a budget of epsilon=%f and delta=%e, more than the per-run limit of epsilon=%f and delta=%e",
+			runID, epsilon, delta, r.params.MaxEpsilonPerRun, r.params.MaxDeltaPerRun)
+	}
+	if exceedsBudgetLimit(totalEpsilon, r.params.MaxTotalEpsilon) || exceedsBudgetLimit(totalDelta, r.params.MaxTotalDelta) {
+		return fmt.Errorf("run %q would bring the total budget of the history to epsilon=%f and delta=%e, more than the total limit of epsilon=%f and delta=%e",
+			runID, totalEpsilon, totalDelta, r.params.MaxTotalEpsilon, r.params.MaxTotalDelta)
+	}
+	return nil
+}
+
+// exceedsBudgetLimit returns whether v exceeds limit, with unset (zero) limits
+// never being exceeded. A relative tolerance avoids rejecting runs that use
+// exactly the limit because of floating-point errors in the sum of budgets.
+func exceedsBudgetLimit(v, limit float64) bool {
+	return limit != 0 && v > limit*(1+1e-9)
+}
+
+// metricBudget returns the budget consumed by the aggregation of a metric with
+// the given params.
+func metricBudget(params any) (epsilon, delta float64, err error) {
+	var aggEpsilon, aggDelta, psEpsilon, psDelta float64
+	var publicPartitions any
+	var psNeedsEpsilon bool
+	switch p := params.(type) {
+	case CountParams:
+		aggEpsilon, aggDelta, publicPartitions = p.AggregationEpsilon, p.AggregationDelta, p.PublicPartitions
+		psEpsilon, psDelta, psNeedsEpsilon = p.PartitionSelectionParams.Epsilon, p.PartitionSelectionParams.Delta, true
+	case SumParams:
+		aggEpsilon, aggDelta, publicPartitions = p.AggregationEpsilon, p.AggregationDelta, p.PublicPartitions
+		psEpsilon, psDelta, psNeedsEpsilon = p.PartitionSelectionParams.Epsilon, p.PartitionSelectionParams.Delta, true
+	case MeanParams:
+		aggEpsilon, aggDelta, publicPartitions = p.AggregationEpsilon, p.AggregationDelta, p.PublicPartitions
+		psEpsilon, psDelta, psNeedsEpsilon = p.PartitionSelectionParams.Epsilon, p.PartitionSelectionParams.Delta, true
+	case DistinctPrivacyIDParams:
+		// DistinctPrivacyID selects partitions by thresholding its noisy counts,
+		// so partition selection only needs a delta.
+		aggEpsilon, aggDelta, publicPartitions = p.AggregationEpsilon, p.AggregationDelta, p.PublicPartitions
+		psDelta = p.PartitionSelectionDelta
+	default:
+		return 0, 0, fmt.Errorf("Params must be CountParams, SumParams, MeanParams or DistinctPrivacyIDParams, got %T", params)
+	}
+	if aggEpsilon == 0 || math.IsNaN(aggEpsilon) {
+		return 0, 0, fmt.Errorf("AggregationEpsilon must be set explicitly")
+	}
+	if publicPartitions == nil && (psDelta == 0 || (psNeedsEpsilon && psEpsilon == 0)) {
+		return 0, 0, fmt.Errorf("the partition selection budget must be set explicitly when public partitions aren't specified")
+	}
+	return aggEpsilon + psEpsilon, aggDelta + psDelta, nil
+}
@@ -0,0 +1,164 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetricRegistryRegisterFails(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		metric Metric
+	}{
+		{"no name", Metric{Input: "in", Params: CountParams{AggregationEpsilon: 1, PublicPartitions: []int{0}}}},
+		{"no input", Metric{Name: "m", Params: CountParams{AggregationEpsilon: 1, PublicPartitions: []int{0}}}},
+		{"unsupported params", Metric{Name: "m", Input: "in", Params: QuantilesParams{}}},
+		{"no aggregation epsilon", Metric{Name: "m", Input: "in", Params: SumParams{PublicPartitions: []int{0}}}},
+		{"no partition selection budget", Metric{Name: "m", Input: "in", Params: MeanParams{AggregationEpsilon: 1}}},
+		{"no partition selection delta", Metric{Name: "m", Input: "in", Params: DistinctPrivacyIDParams{AggregationEpsilon: 1}}},
+	} {
+		r, err := NewMetricRegistry(MetricRegistryParams{}, nil)
+		if err != nil {
+			t.Fatalf("NewMetricRegistry: %v", err)
+		}
+		if err := r.Register(tc.metric); err == nil {
+			t.Errorf("With %s, Register(%+v) returned no error", tc.desc, tc.metric)
+		}
+	}
+}
+
+func TestMetricRegistryRegisterDuplicateNameFails(t *testing.T) {
+	r, err := NewMetricRegistry(MetricRegistryParams{}, nil)
+	if err != nil {
+		t.Fatalf("NewMetricRegistry: %v", err)
+	}
+	m := Metric{Name: "m", Input: "in", Params: CountParams{AggregationEpsilon: 1, PublicPartitions: []int{0}}}
+	if err := r.Register(m); err != nil {
+		t.Fatalf("Register(%+v): %v", m, err)
+	}
+	if err := r.Register(m); err == nil {
+		t.Errorf("Register(%+v) twice returned no error", m)
+	}
+}
+
+// Checks that Build computes the registered metrics and records the run.
+func TestMetricRegistryBuild(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 5, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(5, 20, 1),
+	)
+	result := []testutils.PairII64{{0, 5}, {1, 20}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        2,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+
+	previous := MetricRun{ID: "day1", Metrics: []string{"count", "users"}, Epsilon: 3, Delta: 1e-5}
+	r, err := NewMetricRegistry(MetricRegistryParams{MaxEpsilonPerRun: 3, MaxTotalEpsilon: 6}, []MetricRun{previous})
+	if err != nil {
+		t.Fatalf("NewMetricRegistry: %v", err)
+	}
+	for _, m := range []Metric{
+		{Name: "count", Input: "visits", Params: CountParams{AggregationEpsilon: 1, MaxValue: 1, MaxPartitionsContributed: 1, PublicPartitions: []int{0, 1}}},
+		{Name: "users", Input: "visits", Params: DistinctPrivacyIDParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, MaxPartitionsContributed: 1}},
+	} {
+		if err := r.Register(m); err != nil {
+			t.Fatalf("Register(%+v): %v", m, err)
+		}
+	}
+	outputs, err := r.Build(s, "day2", map[string]PrivatePCollection{"visits": pcol})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	testutils.EqualsKVInt64(t, s, outputs["count"], want)
+	testutils.EqualsKVInt64(t, s, outputs["users"], want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestMetricRegistryBuild: Build returned %v, expected %v for both metrics: %v", outputs, want, err)
+	}
+	wantHistory := []MetricRun{previous, {ID: "day2", Metrics: []string{"count", "users"}, Epsilon: 2, Delta: 1e-5}}
+	if diff := cmp.Diff(wantHistory, r.History()); diff != "" {
+		t.Errorf("History() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+// Checks that Build enforces the budget policy and doesn't record failed runs.
+func TestMetricRegistryBuildFails(t *testing.T) {
+	count := Metric{Name: "count", Input: "visits", Params: CountParams{AggregationEpsilon: 2, MaxValue: 1, MaxPartitionsContributed: 1, PublicPartitions: []int{0}}}
+	history := []MetricRun{{ID: "day1", Metrics: []string{"count"}, Epsilon: 2}}
+	for _, tc := range []struct {
+		desc   string
+		params MetricRegistryParams
+		runID  string
+		inputs []string
+	}{
+		{"per-run limit exceeded", MetricRegistryParams{MaxEpsilonPerRun: 1}, "day2", []string{"visits"}},
+		{"total limit exceeded", MetricRegistryParams{MaxTotalEpsilon: 3}, "day2", []string{"visits"}},
+		{"run ID already in history", MetricRegistryParams{}, "day1", []string{"visits"}},
+		{"empty run ID", MetricRegistryParams{}, "", []string{"visits"}},
+		{"missing input", MetricRegistryParams{}, "day2", []string{"clicks"}},
+	} {
+		_, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+		col = beam.ParDo(s, testutils.PairToKV, col)
+		pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 10, TestMode: TestModeWithContributionBounding}))
+		inputs := make(map[string]PrivatePCollection)
+		for _, name := range tc.inputs {
+			inputs[name] = pcol
+		}
+		r, err := NewMetricRegistry(tc.params, history)
+		if err != nil {
+			t.Fatalf("With %s, NewMetricRegistry: %v", tc.desc, err)
+		}
+		if err := r.Register(count); err != nil {
+			t.Fatalf("With %s, Register(%+v): %v", tc.desc, count, err)
+		}
+		if _, err := r.Build(s, tc.runID, inputs); err == nil {
+			t.Errorf("With %s, Build returned no error", tc.desc)
+		}
+		if diff := cmp.Diff(history, r.History()); diff != "" {
+			t.Errorf("With %s, History() returned diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestNewMetricRegistryFails(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  MetricRegistryParams
+		history []MetricRun
+	}{
+		{"negative epsilon limit", MetricRegistryParams{MaxEpsilonPerRun: -1}, nil},
+		{"delta limit larger than 1", MetricRegistryParams{MaxTotalDelta: 2}, nil},
+		{"duplicate run in history", MetricRegistryParams{}, []MetricRun{{ID: "day1"}, {ID: "day1"}}},
+	} {
+		if _, err := NewMetricRegistry(tc.params, tc.history); err == nil {
+			t.Errorf("With %s, NewMetricRegistry returned no error", tc.desc)
+		}
+	}
+}
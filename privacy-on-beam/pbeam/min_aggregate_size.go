@@ -0,0 +1,89 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn3x0[beam.W, int64, func(beam.W, int64)](&dropSmallCountsFn{})
+}
+
+// checkMinAggregateSize checks the MinAggregateSize of a count aggregation.
+// The minimum can only be enforced on partitions that go through private
+// partition selection, whose pre-threshold guarantees it.
+func checkMinAggregateSize(minAggregateSize int64, publicPartitions any, longTail LongTailParams) error {
+	if minAggregateSize < 0 {
+		return fmt.Errorf("MinAggregateSize must be non-negative, got %d", minAggregateSize)
+	}
+	if minAggregateSize == 0 {
+		return nil
+	}
+	if publicPartitions != nil {
+		return fmt.Errorf("MinAggregateSize can't be used with public partitions: public partitions are released regardless of how many privacy units contribute to them")
+	}
+	if longTail.Partition != nil {
+		return fmt.Errorf("MinAggregateSize can't be used with LongTail: the long tail partition aggregates partitions that fail the pre-threshold")
+	}
+	return nil
+}
+
+// withMinAggregateSize returns spec with a pre-threshold of at least
+// minAggregateSize, so that partition selection only keeps partitions with at
+// least minAggregateSize privacy units.
+func withMinAggregateSize(spec *PrivacySpec, minAggregateSize int64) *PrivacySpec {
+	if minAggregateSize <= spec.preThreshold {
+		return spec
+	}
+	thresholded := *spec
+	thresholded.preThreshold = minAggregateSize
+	return &thresholded
+}
+
+// minAggregateSizeSuppression is the post-processing step dropping the noisy
+// counts that are smaller than MinAggregateSize.
+type minAggregateSizeSuppression struct {
+	MinAggregateSize int64
+}
+
+func (m minAggregateSizeSuppression) PostProcess(s beam.Scope, col beam.PCollection) beam.PCollection {
+	return beam.ParDo(s.Scope("pbeam.MinAggregateSize"), &dropSmallCountsFn{MinCount: m.MinAggregateSize}, col)
+}
+
+// minAggregateSizeSteps returns the post-processing steps of a count
+// aggregation, with the suppression of small counts first if minAggregateSize
+// is set.
+func minAggregateSizeSteps(minAggregateSize int64, steps []PostProcessor) []PostProcessor {
+	if minAggregateSize == 0 {
+		return steps
+	}
+	return append([]PostProcessor{minAggregateSizeSuppression{MinAggregateSize: minAggregateSize}}, steps...)
+}
+
+type dropSmallCountsFn struct {
+	MinCount int64
+}
+
+func (fn *dropSmallCountsFn) ProcessElement(k beam.W, v int64, emit func(beam.W, int64)) {
+	if v >= fn.MinCount {
+		emit(k, v)
+	}
+}
@@ -0,0 +1,108 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func TestCountMinAggregateSize(t *testing.T) {
+	// In this test, we set MinAggregateSize to 10, and no pre-threshold in the
+	// PrivacySpec:
+	// - value 0 is associated with 9 privacy units, so it should be dropped;
+	// - value 1 is associated with 10 privacy units, so it should be kept.
+	// Each privacy unit contributes to at most 1 partition.
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 9, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(10, 10, 1),
+	)
+	result := []testutils.PairII64{{1, 10}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	// ε=10⁹, δ≈1 and l0Sensitivity=1 means partitions meeting MinAggregateSize should be kept.
+	// We have 1 partition. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 10⁻²³ probability (k=23).
+	epsilon, delta, k, l1Sensitivity := 1e9, dpagg.LargestRepresentableDelta, 23.0, 1.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        epsilon,
+			PartitionSelectionEpsilon: epsilon,
+			PartitionSelectionDelta:   delta,
+		}))
+	got := Count(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}, MinAggregateSize: 10})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.ApproxEqualsKVInt64(t, s, got, want, testutils.RoundedLaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountMinAggregateSize: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestDistinctPrivacyIDMinAggregateSize(t *testing.T) {
+	// In this test, we set MinAggregateSize to 10, and a smaller pre-threshold
+	// of 5 in the PrivacySpec:
+	// - value 0 is associated with 9 privacy units, so it should be dropped;
+	// - value 1 is associated with 11 privacy units, so it should be kept.
+	// Each privacy unit contributes to at most 1 partition.
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 9, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(10, 11, 1),
+	)
+	result := []testutils.PairII64{{1, 11}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	// ε=10⁹, δ≈1 and l0Sensitivity=1 means partitions meeting MinAggregateSize should be kept.
+	// We have 1 partition. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 10⁻²³ probability (k=23).
+	epsilon, delta, k, l1Sensitivity := 1e9, dpagg.LargestRepresentableDelta, 23.0, 1.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        epsilon,
+			PartitionSelectionEpsilon: epsilon,
+			PartitionSelectionDelta:   delta,
+			PreThreshold:              5,
+		}))
+	got := DistinctPrivacyID(s, pcol, DistinctPrivacyIDParams{MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}, MinAggregateSize: 10})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.ApproxEqualsKVInt64(t, s, got, want, testutils.RoundedLaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestDistinctPrivacyIDMinAggregateSize: DistinctPrivacyID(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that noisy counts smaller than MinAggregateSize are dropped, even if
+// partition selection kept their partition.
+func TestMinAggregateSizeSuppression(t *testing.T) {
+	outputs := []testutils.PairII64{{0, 9}, {1, 10}, {2, -3}, {3, 250}}
+	result := []testutils.PairII64{{1, 10}, {3, 250}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairII64ToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+
+	got := PostProcess(s, col, minAggregateSizeSteps(10, nil)...)
+
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestMinAggregateSizeSuppression: PostProcess(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
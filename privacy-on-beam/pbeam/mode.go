@@ -0,0 +1,418 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Combiner3[modeAccum, []float64, *float64](&modeFn{})
+	register.DoFn3x1[beam.W, float64, func(beam.W, beam.V), error](&indexToCategoryFn{})
+}
+
+// ModeParams specifies the parameters associated with a ModePerKey
+// aggregation.
+type ModeParams struct {
+	// Differential privacy budget consumed by this aggregation. The mode is
+	// selected with the exponential mechanism, which doesn't need a delta. If
+	// there is only one aggregation, AggregationEpsilon can be left 0; in that
+	// case, the entire budget reserved for aggregation in the PrivacySpec is
+	// consumed.
+	AggregationEpsilon float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. See MeanParams.PublicPartitions for details.
+	//
+	// PublicPartitions needs to be a beam.PCollection, slice, or array. The
+	// underlying type needs to match the partition type of the PrivatePCollection.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct keys that a given privacy identifier
+	// can influence. If a privacy identifier is associated to more keys,
+	// random keys will be dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of values that a given privacy identifier can
+	// contribute to a key, across all candidates. If a privacy identifier is
+	// associated to more values for a key, random values will be dropped.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Candidates is a slice or array of the values that can be selected as the
+	// mode of a key, e.g. []string{"chrome", "firefox", "safari"}. Its element
+	// type must be the value type of the PrivatePCollection, and candidates must
+	// be distinct. Values that don't match any candidate are dropped.
+	//
+	// Candidates must not be derived from private data.
+	//
+	// Required; must have at least 2 candidates.
+	Candidates any
+}
+
+// ModePerKey selects the most frequent value, i.e. the mode, among
+// params.Candidates for each key in a PrivatePCollection<K,V>, using the
+// exponential mechanism, and does pre-aggregation thresholding to remove
+// partitions with a low number of distinct privacy identifiers.
+//
+// The exponential mechanism selects each candidate with a probability
+// proportional to exp(ε·count/(2·MaxContributionsPerPartition)), where count
+// is the number of contributions to the candidate and ε is AggregationEpsilon
+// split between the MaxPartitionsContributed keys of each privacy identifier.
+// Compared to calling Count on each value and picking the largest noisy count,
+// the budget is consumed once for all candidates, so the selected mode is
+// accurate with many candidates. In test mode, the candidate with the largest
+// count is selected, and ties are broken in favor of the first candidate.
+//
+// It is also possible to manually specify the list of partitions
+// present in the output, in which case the partition selection/thresholding
+// step is skipped. The mode of public partitions without data is a uniformly
+// random candidate.
+//
+// ModePerKey transforms a PrivatePCollection<K,V> into a PCollection<K,V>.
+func ModePerKey(s beam.Scope, pcol PrivatePCollection, params ModeParams) beam.PCollection {
+	s = s.Scope("pbeam.ModePerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("ModePerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("ModePerKey: no codec found for the input PrivatePCollection.")
+	}
+	vType := pcol.codec.VType.T
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "ModePerKey", err, pcol.codec.KType.T, vType)
+	}
+	candidates, err := encodeCategories("Candidates", params.Candidates, vType)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ModePerKey: %v", err))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("ModePerKey", &params.AggregationEpsilon, nil, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+	// The randomness of the exponential mechanism isn't derived from a seed.
+	err = spec.checkNoNoiseSeedKey("ModePerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ModePerKey: %v", err))
+	}
+
+	err = checkModePerKeyParams(params, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ModePerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("ModePerKey", params.AggregationEpsilon, 0, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for ModePerKey: %v", err)
+	}
+
+	// Replace values by the index of their candidate, dropping values that
+	// aren't candidates. Result is PCollection<ID, kv.Pair{K,float64}>.
+	indexCodec := kv.NewCodec(pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	indices := parDoWithDeadLetters(s, spec, &categoryIndexFn{
+		InputCodec:    pcol.codec,
+		OutputCodec:   indexCodec,
+		Categories:    candidates,
+		SkipMalformed: spec.skipMalformedRecords,
+		DropUnknown:   true,
+	}, pcol.col)
+
+	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},float64>
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, indexCodec, spec.skipMalformedRecords),
+		indices,
+		beam.TypeDefinition{Var: beam.VType, T: reflect.TypeOf(float64(0))})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+
+	// Combine all candidate indices for <id, partition> into a slice, keeping at
+	// most MaxContributionsPerPartition values unless in test mode without
+	// contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>.
+	combined := beam.CombinePerKey(s, newExpandFloat64ValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)), decoded)
+	combined = traceStage(s, *spec, "ModePerKey.boundContributionsPerPartition", combined)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "ModePerKey.boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Select the mode of each partition. Result is PCollection<partition, float64>.
+	var modes beam.PCollection
+	if params.PublicPartitions != nil {
+		modes = addPublicPartitionsForMode(s, *spec, params, len(candidates), partialKV)
+	} else {
+		fn := newModeFn(*spec, params, len(candidates), false)
+		modes = beam.CombinePerKey(s, fn, partialKV)
+		modes = traceStage(s, *spec, "ModePerKey.aggregate", modes)
+		// Drop thresholded partitions.
+		modes = beam.ParDo(s, dropThresholdedPartitionsFloat64, modes)
+	}
+	// Finally, replace the indices by the candidates.
+	return beam.ParDo(s, &indexToCategoryFn{
+		Categories: candidates,
+		VType:      beam.EncodedType{T: vType},
+	}, modes, beam.TypeDefinition{Var: beam.VType, T: vType})
+}
+
+func addPublicPartitionsForMode(s beam.Scope, spec PrivacySpec, params ModeParams, numCandidates int, partialKV beam.PCollection) beam.PCollection {
+	// Select modes with empty public partitions added. Result is PCollection<partition, float64>.
+	// First, add empty slice to all public partitions.
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	// Second, select a mode for all public partitions (all of which are empty-valued).
+	fn := newModeFn(spec, params, numCandidates, true)
+	emptyModes := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	// Third, select modes for partitions in the actual data.
+	modes := beam.CombinePerKey(s, fn, partialKV)
+	modes = traceStage(s, spec, "ModePerKey.aggregate", modes)
+	// Fourth, co-group the modes with the modes of empty public partitions, and
+	// emit the latter for public partitions not found in the data.
+	modes = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, modes, emptyModes))
+	// Fifth, dereference *float64 results and return.
+	return beam.ParDo(s, dereferenceValueFloat64, modes)
+}
+
+func checkModePerKeyParams(params ModeParams, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+type modeAccum struct {
+	Counts           []int64 // Number of contributions to each candidate.
+	SP               *dpagg.PreAggSelectPartition
+	PublicPartitions bool
+}
+
+// modeFn is a differentially private combineFn for selecting the most
+// frequent candidate index. Do not initialize it yourself, use newModeFn to
+// create a modeFn instance.
+type modeFn struct {
+	// Privacy spec parameters (set during initial construction).
+	Epsilon                      float64
+	PartitionSelectionEpsilon    float64
+	PartitionSelectionDelta      float64
+	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	NumCandidates                int
+	PublicPartitions             bool // Set to true if public partitions are used.
+	TestMode                     TestMode
+}
+
+// newModeFn returns a modeFn with the given budget and parameters.
+func newModeFn(spec PrivacySpec, params ModeParams, numCandidates int, publicPartitions bool) *modeFn {
+	return &modeFn{
+		Epsilon:                      params.AggregationEpsilon,
+		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
+		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		NumCandidates:                numCandidates,
+		PublicPartitions:             publicPartitions,
+		TestMode:                     spec.testMode,
+	}
+}
+
+func (fn *modeFn) CreateAccumulator() (modeAccum, error) {
+	accum := modeAccum{Counts: make([]int64, fn.NumCandidates), PublicPartitions: fn.PublicPartitions}
+	var err error
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *modeFn) AddInput(a modeAccum, indices []float64) (modeAccum, error) {
+	// Each contribution is counted for its candidate, but each privacy
+	// identifier is counted once for partition selection.
+	for _, i := range indices {
+		a.Counts[int(i)]++
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *modeFn) MergeAccumulators(a, b modeAccum) (modeAccum, error) {
+	for i := range a.Counts {
+		a.Counts[i] += b.Counts[i]
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+func (fn *modeFn) ExtractOutput(a modeAccum) (*float64, error) {
+	if !fn.TestMode.isEnabled() && !a.PublicPartitions {
+		keep, err := fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !keep {
+			return nil, err
+		}
+	}
+	var mode int
+	if fn.TestMode.isEnabled() {
+		for i, c := range a.Counts {
+			if c > a.Counts[mode] {
+				mode = i
+			}
+		}
+	} else {
+		// Each privacy identifier changes the counts of a partition by at most
+		// MaxContributionsPerPartition, and contributes to at most
+		// MaxPartitionsContributed partitions.
+		scores := make([]float64, len(a.Counts))
+		for i, c := range a.Counts {
+			scores[i] = float64(c)
+		}
+		var err error
+		mode, err = reportNoisyMax(scores, fn.Epsilon/float64(fn.MaxPartitionsContributed), float64(fn.MaxContributionsPerPartition), GumbelNoisyMax)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := float64(mode)
+	return &result, nil
+}
+
+func (fn *modeFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *modeFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
+
+// indexToCategoryFn replaces the candidate index of each partition by the
+// candidate, as a V.
+type indexToCategoryFn struct {
+	Categories [][]byte
+	VType      beam.EncodedType
+	categories reflect.Value
+}
+
+func (fn *indexToCategoryFn) Setup() error {
+	var err error
+	fn.categories, err = decodeCategories(fn.Categories, fn.VType.T)
+	if err != nil {
+		return fmt.Errorf("pbeam.indexToCategoryFn.Setup: %v", err)
+	}
+	return nil
+}
+
+func (fn *indexToCategoryFn) ProcessElement(k beam.W, index float64, emit func(beam.W, beam.V)) error {
+	i := int(index)
+	if i < 0 || i >= fn.categories.Len() {
+		return fmt.Errorf("pbeam.indexToCategoryFn.ProcessElement: index %d out of range of %d categories", i, fn.categories.Len())
+	}
+	emit(k, fn.categories.Index(i).Interface())
+	return nil
+}
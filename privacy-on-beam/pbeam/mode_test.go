@@ -0,0 +1,205 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, string, string](formatModeFn)
+}
+
+type browserVisit struct {
+	ID      int    `pbeam:"privacy_id"`
+	Country int    `pbeam:"partition"`
+	Browser string `pbeam:"value"`
+}
+
+var browsers = []string{"chrome", "firefox", "safari"}
+
+// formatModeFn formats the mode of a partition as "partition:mode".
+func formatModeFn(country int, browser string) string {
+	return fmt.Sprintf("%d:%s", country, browser)
+}
+
+// makeBrowserVisits returns visits where "firefox" is the mode of country 0 and
+// "safari" is the mode of country 1. Most visits of country 1 are from
+// "opera", which isn't a candidate.
+func makeBrowserVisits() []browserVisit {
+	var visits []browserVisit
+	for i := 0; i < 100; i++ {
+		browser := "firefox"
+		if i < 30 {
+			browser = "chrome"
+		}
+		visits = append(visits, browserVisit{ID: i, Country: 0, Browser: browser})
+	}
+	for i := 100; i < 300; i++ {
+		browser := "opera"
+		if i < 150 {
+			browser = "safari"
+		} else if i < 170 {
+			browser = "chrome"
+		}
+		visits = append(visits, browserVisit{ID: i, Country: 1, Browser: browser})
+	}
+	return visits
+}
+
+// Checks that ModePerKey returns the most frequent candidate of each partition
+// in test mode, and ignores values that aren't candidates.
+func TestModePerKeyNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc             string
+		publicPartitions any
+		want             []string
+	}{
+		{"private partitions", nil, []string{"0:firefox", "1:safari"}},
+		// The mode of an empty public partition is the first candidate in test mode.
+		{"public partitions", []int{0, 1, 2}, []string{"0:firefox", "1:safari", "2:chrome"}},
+	} {
+		p, s, col := ptest.CreateList(makeBrowserVisits())
+		spec := PrivacySpecParams{AggregationEpsilon: 1, TestMode: TestModeWithoutContributionBounding}
+		if tc.publicPartitions == nil {
+			spec.PartitionSelectionEpsilon, spec.PartitionSelectionDelta = 1, 1e-5
+		}
+		pcol := MakePrivateFromStruct(s, col, privacySpec(t, spec), "")
+		got := ModePerKey(s, pcol, ModeParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			Candidates:                   browsers,
+			PublicPartitions:             tc.publicPartitions,
+		})
+
+		passert.Equals(s, beam.ParDo(s, formatModeFn, got), beam.CreateList(s, tc.want))
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("ModePerKey with %s did not return the expected modes: %v", tc.desc, err)
+		}
+	}
+}
+
+// Checks that ModePerKey selects the mode when the mode is much more frequent
+// than the other candidates.
+func TestModePerKeyAddsNoise(t *testing.T) {
+	p, s, col := ptest.CreateList(makeBrowserVisits())
+	// With ε=100, the probability of selecting another candidate than the mode
+	// is less than 3·exp(-100·30/2), which is negligible.
+	pcol := MakePrivateFromStruct(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 100}), "")
+	got := ModePerKey(s, pcol, ModeParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		Candidates:                   browsers,
+		PublicPartitions:             []int{0, 1},
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatModeFn, got), beam.CreateList(s, []string{"0:firefox", "1:safari"}))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("ModePerKey did not return the expected modes: %v", err)
+	}
+}
+
+func TestCheckModePerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		params        ModeParams
+		partitionType reflect.Type
+		wantErr       bool
+	}{
+		{
+			desc: "valid parameters",
+			params: ModeParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+			wantErr: false,
+		},
+		{
+			desc: "valid parameters with public partitions",
+			params: ModeParams{
+				AggregationEpsilon:           1.0,
+				PublicPartitions:             []int{0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+			partitionType: reflect.TypeOf(0),
+			wantErr:       false,
+		},
+		{
+			desc: "zero aggregation epsilon",
+			params: ModeParams{
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "zero partition selection delta",
+			params: ModeParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "partition selection parameters with public partitions",
+			params: ModeParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				PublicPartitions:             []int{0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+			partitionType: reflect.TypeOf(0),
+			wantErr:       true,
+		},
+		{
+			desc: "zero MaxPartitionsContributed",
+			params: ModeParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxContributionsPerPartition: 1,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "zero MaxContributionsPerPartition",
+			params: ModeParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+			},
+			wantErr: true,
+		},
+	} {
+		if err := checkModePerKeyParams(tc.params, tc.partitionType); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
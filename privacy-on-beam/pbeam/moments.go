@@ -0,0 +1,465 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Combiner3[boundedMomentAccum, []float64, *float64](&boundedMomentFn{})
+}
+
+// MomentParams specifies the parameters associated with a SkewnessPerKey or a
+// KurtosisPerKey aggregation.
+type MomentParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. See MeanParams.PublicPartitions for details.
+	//
+	// PublicPartitions needs to be a beam.PCollection, slice, or array. The
+	// underlying type needs to match the partition type of the PrivatePCollection.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct values that a given privacy identifier
+	// can influence. A larger MaxPartitionsContributed leads to less data loss
+	// due to contribution bounding, but to more noise in each moment.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of contributions from a given privacy identifier
+	// for each key. A larger MaxContributionsPerPartition leads to less data
+	// loss due to contribution bounding, but to more noise in each moment.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Contributions are clamped to [MinValue, MaxValue] before the moment is
+	// computed. The noise of the sum of the n-th powers of the values is scaled
+	// with ((MaxValue-MinValue)/2)ⁿ, so these bounds should be as tight as
+	// possible.
+	//
+	// Required.
+	MinValue, MaxValue float64
+}
+
+// SkewnessPerKey obtains the skewness, i.e. the third standardized moment, of
+// the values associated with each key in a PrivatePCollection<K,V>, adding
+// differentially private noise to the underlying sums and doing pre-aggregation
+// thresholding to remove partitions with a low number of distinct privacy
+// identifiers.
+//
+// The skewness is computed as the noisy third central moment divided by the
+// noisy variance to the power of 3/2. It is NaN for partitions whose noisy
+// variance is zero, e.g. for empty public partitions in test mode.
+//
+// It is also possible to manually specify the list of partitions
+// present in the output, in which case the partition selection/thresholding
+// step is skipped.
+//
+// SkewnessPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,float64>.
+//
+// Note: Do not use when your results may cause overflows for float64 values.
+// This aggregation is not hardened for such applications yet.
+func SkewnessPerKey(s beam.Scope, pcol PrivatePCollection, params MomentParams) beam.PCollection {
+	return standardizedMomentPerKey(s.Scope("pbeam.SkewnessPerKey"), pcol, params, 3, "SkewnessPerKey")
+}
+
+// KurtosisPerKey obtains the kurtosis, i.e. the fourth standardized moment, of
+// the values associated with each key in a PrivatePCollection<K,V>, adding
+// differentially private noise to the underlying sums and doing pre-aggregation
+// thresholding to remove partitions with a low number of distinct privacy
+// identifiers.
+//
+// The kurtosis is computed as the noisy fourth central moment divided by the
+// square of the noisy variance; it is not the excess kurtosis, so it is 3 for
+// normally distributed values. It is NaN for partitions whose noisy variance is
+// zero, e.g. for empty public partitions in test mode.
+//
+// It is also possible to manually specify the list of partitions
+// present in the output, in which case the partition selection/thresholding
+// step is skipped.
+//
+// KurtosisPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,float64>.
+//
+// Note: Do not use when your results may cause overflows for float64 values.
+// This aggregation is not hardened for such applications yet.
+func KurtosisPerKey(s beam.Scope, pcol PrivatePCollection, params MomentParams) beam.PCollection {
+	return standardizedMomentPerKey(s.Scope("pbeam.KurtosisPerKey"), pcol, params, 4, "KurtosisPerKey")
+}
+
+// standardizedMomentPerKey implements SkewnessPerKey and KurtosisPerKey for the
+// given order; name is the name of the calling aggregation.
+func standardizedMomentPerKey(s beam.Scope, pcol PrivatePCollection, params MomentParams, order int, name string) beam.PCollection {
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("%s must be used on a PrivatePCollection of type <K,V>, got type %v instead", name, kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("%s: no codec found for the input PrivatePCollection.", name)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, name, err, pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget(name, &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.%s: %v", name, err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey(name)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.%s: %v", name, err))
+	}
+
+	err = checkMomentPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.%s: %v", name, err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered(name, params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for %s: %v", name, err)
+	}
+
+	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},V>
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+
+	// Convert value to float64.
+	// Result is PCollection<kv.Pair{ID,K},float64>.
+	_, valueT := beam.ValidateKVType(decoded)
+	if err := checkNumericType(valueT); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	converted := convertValues(s, spec, reflect.Float64, decoded)
+
+	// Combine all values for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition values unless in test mode without contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>.
+	combined := beam.CombinePerKey(s, newExpandFloat64ValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)), converted)
+	combined = traceStage(s, *spec, name+".boundContributionsPerPartition", combined)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, name+".boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		return addPublicPartitionsForMoment(s, *spec, params, noiseKind, order, name, partialKV)
+	}
+	// Compute the moment for each partition. Result is PCollection<partition, float64>.
+	fn, err := newBoundedMomentFn(*spec, params, noiseKind, order, false, false)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedMomentFn for %s: %v", name, err)
+	}
+	moments := beam.CombinePerKey(s, fn, partialKV)
+	moments = traceStage(s, *spec, name+".aggregate", moments)
+	reportNoiseDraws(s, moments)
+	// Finally, drop thresholded partitions.
+	return beam.ParDo(s, dropThresholdedPartitionsFloat64, moments)
+}
+
+func addPublicPartitionsForMoment(s beam.Scope, spec PrivacySpec, params MomentParams, noiseKind noise.Kind, order int, name string, partialKV beam.PCollection) beam.PCollection {
+	// Calculate moments with empty public partitions added. Result is PCollection<partition, float64>.
+	// First, add empty slice to all public partitions.
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	// Second, add noise to all public partitions (all of which are empty-valued).
+	fn, err := newBoundedMomentFn(spec, params, noiseKind, order, true, true)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedMomentFn for %s: %v", name, err)
+	}
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	// Third, compute noisy moments for partitions in the actual data.
+	fn, err = newBoundedMomentFn(spec, params, noiseKind, order, true, false)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedMomentFn for %s: %v", name, err)
+	}
+	moments := beam.CombinePerKey(s, fn, partialKV)
+	moments = traceStage(s, spec, name+".aggregate", moments)
+	reportNoiseDraws(s, moments)
+	// Fourth, co-group the noisy moments with the noisy empty public partitions,
+	// and emit the noisy empty value for public partitions not found in the data.
+	moments = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, moments, noisyEmptyPublicPartitions))
+	// Fifth, dereference *float64 results and return.
+	return beam.ParDo(s, dereferenceValueFloat64, moments)
+}
+
+func checkMomentPerKeyParams(params MomentParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsFloat64(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsNotEqual(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+type boundedMomentAccum struct {
+	BNM              *dpagg.BoundedNthMoment
+	SP               *dpagg.PreAggSelectPartition
+	PublicPartitions bool
+}
+
+// boundedMomentFn is a differentially private combineFn for obtaining the
+// standardized moment of a given order of values. Do not initialize it
+// yourself, use newBoundedMomentFn to create a boundedMomentFn instance.
+type boundedMomentFn struct {
+	// Privacy spec parameters (set during initial construction).
+	NoiseEpsilon                 float64
+	PartitionSelectionEpsilon    float64
+	NoiseDelta                   float64
+	PartitionSelectionDelta      float64
+	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	Lower                        float64
+	Upper                        float64
+	Order                        int
+	NoiseKind                    noise.Kind
+	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
+	PublicPartitions             bool        // Set to true if public partitions are used.
+	TestMode                     TestMode
+	EmptyPartitions              bool // Set to true if this combineFn is for adding noise to empty public partitions.
+}
+
+// newBoundedMomentFn returns a boundedMomentFn with the given budget, order
+// and parameters.
+func newBoundedMomentFn(spec PrivacySpec, params MomentParams, noiseKind noise.Kind, order int, publicPartitions bool, emptyPartitions bool) (*boundedMomentFn, error) {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
+		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	return &boundedMomentFn{
+		NoiseEpsilon:                 params.AggregationEpsilon,
+		NoiseDelta:                   params.AggregationDelta,
+		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
+		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		Lower:                        params.MinValue,
+		Upper:                        params.MaxValue,
+		Order:                        order,
+		NoiseKind:                    noiseKind,
+		PublicPartitions:             publicPartitions,
+		TestMode:                     spec.testMode,
+		EmptyPartitions:              emptyPartitions,
+	}, nil
+}
+
+func (fn *boundedMomentFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+func (fn *boundedMomentFn) CreateAccumulator() (boundedMomentAccum, error) {
+	if fn.TestMode == TestModeWithoutContributionBounding && !fn.EmptyPartitions {
+		fn.Lower = math.Inf(-1)
+		fn.Upper = math.Inf(1)
+	}
+	bnm, err := dpagg.NewBoundedNthMoment(&dpagg.BoundedNthMomentOptions{
+		Epsilon:                      fn.NoiseEpsilon,
+		Delta:                        fn.NoiseDelta,
+		MaxPartitionsContributed:     fn.MaxPartitionsContributed,
+		MaxContributionsPerPartition: fn.MaxContributionsPerPartition,
+		Lower:                        fn.Lower,
+		Upper:                        fn.Upper,
+		Order:                        fn.Order,
+		Noise:                        fn.noise,
+	})
+	if err != nil {
+		return boundedMomentAccum{}, err
+	}
+	accum := boundedMomentAccum{BNM: bnm, PublicPartitions: fn.PublicPartitions}
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *boundedMomentFn) AddInput(a boundedMomentAccum, values []float64) (boundedMomentAccum, error) {
+	// Like in boundedMeanFn, each value is added to BoundedNthMoment, but each
+	// privacy identifier is counted once for partition selection.
+	for _, v := range values {
+		if err := a.BNM.Add(v); err != nil {
+			return a, err
+		}
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *boundedMomentFn) MergeAccumulators(a, b boundedMomentAccum) (boundedMomentAccum, error) {
+	err := a.BNM.Merge(b.BNM)
+	if err != nil {
+		return a, err
+	}
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+func (fn *boundedMomentFn) ExtractOutput(a boundedMomentAccum) (*float64, error) {
+	bnm := a.BNM
+	if fn.TestMode.isEnabled() {
+		bnm.Count.Noise = noNoise{}
+		for k := range bnm.NormalizedSums {
+			bnm.NormalizedSums[k].Noise = noNoise{}
+		}
+	}
+	bnm.Count.Noise = auditNoise(bnm.Count.Noise, "BoundedNthMoment")
+	for k := range bnm.NormalizedSums {
+		bnm.NormalizedSums[k].Noise = auditNoise(bnm.NormalizedSums[k].Noise, "BoundedNthMoment")
+	}
+	if !fn.TestMode.isEnabled() && !a.PublicPartitions {
+		keep, err := fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !keep {
+			return nil, err
+		}
+	}
+	result, err := bnm.StandardizedResult()
+	return &result, err
+}
+
+func (fn *boundedMomentFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *boundedMomentFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
@@ -0,0 +1,246 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// momentTriples returns triples where partition 0 has 300 values equal to 0
+// and 100 values equal to 10, so its skewness is 2/√3 and its kurtosis is 7/3,
+// and partition 1 has 50 values equal to 0 and 50 values equal to 10, so its
+// skewness is 0 and its kurtosis is 1.
+func momentTriples() []testutils.TripleWithFloatValue {
+	return testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(300, 0, 0),
+		testutils.MakeTripleWithFloatValueStartingFromKey(300, 100, 0, 10),
+		testutils.MakeTripleWithFloatValueStartingFromKey(400, 50, 1, 0),
+		testutils.MakeTripleWithFloatValueStartingFromKey(450, 50, 1, 10))
+}
+
+func TestSkewnessAndKurtosisPerKeyNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		aggregate func(beam.Scope, PrivatePCollection, MomentParams) beam.PCollection
+		want      []testutils.PairIF64
+	}{
+		{"skewness", SkewnessPerKey, []testutils.PairIF64{{Key: 0, Value: 2 / math.Sqrt(3)}, {Key: 1, Value: 0}}},
+		{"kurtosis", KurtosisPerKey, []testutils.PairIF64{{Key: 0, Value: 7.0 / 3}, {Key: 1, Value: 1}}},
+	} {
+		p, s, col, want := ptest.CreateList2(momentTriples(), tc.want)
+		col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon:        1,
+				PartitionSelectionEpsilon: 1,
+				PartitionSelectionDelta:   1e-5,
+				TestMode:                  TestModeWithContributionBounding,
+			}))
+		pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+		got := tc.aggregate(s, pcol, MomentParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinValue:                     0,
+			MaxValue:                     10,
+		})
+
+		want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+		testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-6)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestSkewnessAndKurtosisPerKeyNoNoise for %s: got %v, want %v, error %v", tc.desc, got, want, err)
+		}
+	}
+}
+
+func TestSkewnessPerKeyClampsValues(t *testing.T) {
+	// Values are clamped to 0 and 10, so partition 0 has the same skewness as in
+	// momentTriples.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(300, 0, -5),
+		testutils.MakeTripleWithFloatValueStartingFromKey(300, 100, 0, 100))
+	result := []testutils.PairIF64{
+		{Key: 0, Value: 2 / math.Sqrt(3)},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := SkewnessPerKey(s, pcol, MomentParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     10,
+	})
+
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-6)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSkewnessPerKeyClampsValues: SkewnessPerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+func TestKurtosisPerKeyWithPartitionsNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		inMemory bool
+	}{
+		{"public partitions as a PCollection", false},
+		{"in-memory public partitions", true},
+	} {
+		// Partition 1 is not public.
+		result := []testutils.PairIF64{
+			{Key: 0, Value: 7.0 / 3},
+		}
+		publicPartitionsSlice := []int{0}
+		p, s, col, want := ptest.CreateList2(momentTriples(), result)
+		col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+		var publicPartitions any
+		if tc.inMemory {
+			publicPartitions = publicPartitionsSlice
+		} else {
+			publicPartitions = beam.CreateList(s, publicPartitionsSlice)
+		}
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           TestModeWithContributionBounding,
+			}))
+		pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+		got := KurtosisPerKey(s, pcol, MomentParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinValue:                     0,
+			MaxValue:                     10,
+			PublicPartitions:             publicPartitions,
+		})
+
+		want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+		testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-6)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestKurtosisPerKeyWithPartitionsNoNoise with %s: KurtosisPerKey(%v) = %v, want %v, error %v", tc.desc, col, got, want, err)
+		}
+	}
+}
+
+func TestCheckMomentPerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		params        MomentParams
+		noiseKind     noise.Kind
+		partitionType reflect.Type
+		wantErr       bool
+	}{
+		{
+			desc: "valid parameters",
+			params: MomentParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc: "valid parameters with public partitions",
+			params: MomentParams{
+				AggregationEpsilon:           1.0,
+				PublicPartitions:             []int{0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: reflect.TypeOf(0),
+			wantErr:       false,
+		},
+		{
+			desc: "negative aggregationEpsilon",
+			params: MomentParams{
+				AggregationEpsilon:           -1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "MaxValue equal to MinValue",
+			params: MomentParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxContributionsPerPartition",
+			params: MomentParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+				MinValue:                 -5.0,
+				MaxValue:                 5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxPartitionsContributed",
+			params: MomentParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkMomentPerKeyParams(tc.params, tc.noiseKind, tc.partitionType); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn2x0[beam.W, beam.V](&reportNoiseDrawsFn{})
+}
+
+// NoiseDrawsNamespace is the namespace of the Beam counters reporting the
+// number of noise samples drawn by aggregations. Each counter is named
+// "<stage>.<mechanism>", e.g. "BoundedSumInt64.Laplace", where the stage is the
+// DoFn or CombineFn drawing the noise and the mechanism is Laplace, Gaussian,
+// or None if noise is disabled by a test mode or deferred to another stage.
+//
+// These counters allow checking that no stage of a production pipeline
+// bypassed noise addition. They aren't differentially private: they reveal
+// the number of partitions that each stage processed.
+const NoiseDrawsNamespace = "pbeam.NoiseDraws"
+
+// noiseDraws holds the number of noise samples drawn in this process that
+// haven't been reported in Beam metrics yet, as a map from counter names to
+// *atomic.Int64. Combiners can't report metrics themselves, so draws are
+// counted here and reported by the next DoFn of the fused stage, see
+// reportNoiseDraws.
+var noiseDraws sync.Map
+
+// auditedNoise counts the noise samples drawn with Noise in noiseDraws.
+type auditedNoise struct {
+	noise.Noise
+	draws *atomic.Int64
+}
+
+// auditNoise returns n wrapped so that its noise draws are counted for the
+// given stage. The result must not be used to build dpagg aggregations, since
+// they can only be serialized with noise.Laplace or noise.Gaussian: it must
+// only be set on them right before computing their results.
+func auditNoise(n noise.Noise, stage string) noise.Noise {
+	name := stage + "." + noiseMechanism(n)
+	draws, ok := noiseDraws.Load(name)
+	if !ok {
+		draws, _ = noiseDraws.LoadOrStore(name, new(atomic.Int64))
+	}
+	return auditedNoise{Noise: n, draws: draws.(*atomic.Int64)}
+}
+
+func noiseMechanism(n noise.Noise) string {
+	if _, ok := n.(noNoise); ok {
+		return "None"
+	}
+	switch k := noise.ToKind(n); k {
+	case noise.LaplaceNoise:
+		return "Laplace"
+	case noise.GaussianNoise:
+		return "Gaussian"
+	case noise.Unrecognised:
+		return "Unrecognised"
+	default:
+		m, _ := noise.RegisteredMechanism(k)
+		return m.Name
+	}
+}
+
+func (n auditedNoise) AddNoiseInt64(x, l0Sensitivity, lInfSensitivity int64, epsilon, delta float64) (int64, error) {
+	n.draws.Add(1)
+	return n.Noise.AddNoiseInt64(x, l0Sensitivity, lInfSensitivity, epsilon, delta)
+}
+
+func (n auditedNoise) AddNoiseFloat64(x float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	n.draws.Add(1)
+	return n.Noise.AddNoiseFloat64(x, l0Sensitivity, lInfSensitivity, epsilon, delta)
+}
+
+// flushNoiseDraws reports the noise draws counted in noiseDraws to Beam
+// metrics, and resets them.
+func flushNoiseDraws(ctx context.Context) {
+	noiseDraws.Range(func(name, draws any) bool {
+		if n := draws.(*atomic.Int64).Swap(0); n > 0 {
+			beam.NewCounter(NoiseDrawsNamespace, name.(string)).Inc(ctx, n)
+		}
+		return true
+	})
+}
+
+// reportNoiseDraws reports the noise draws of the CombineFn that output col, a
+// PCollection<K,V>, in Beam metrics. Since Beam fuses a CombineFn with the
+// DoFns consuming its output, reportNoiseDrawsFn processes each bundle after
+// the CombineFn drew its noise, and reports these draws when finishing it.
+func reportNoiseDraws(s beam.Scope, col beam.PCollection) {
+	beam.ParDo0(s.Scope("reportNoiseDraws"), &reportNoiseDrawsFn{}, col)
+}
+
+type reportNoiseDrawsFn struct{}
+
+func (fn *reportNoiseDrawsFn) ProcessElement(beam.W, beam.V) {}
+
+func (fn *reportNoiseDrawsFn) FinishBundle(ctx context.Context) {
+	flushNoiseDraws(ctx)
+}
@@ -0,0 +1,83 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func TestAuditNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		noise noise.Noise
+		want  string
+	}{
+		{"laplace", noise.Laplace(), "TestAuditNoise.Laplace"},
+		{"gaussian", noise.Gaussian(), "TestAuditNoise.Gaussian"},
+		{"no noise", noNoise{}, "TestAuditNoise.None"},
+	} {
+		noiseDraws.Delete(tc.want)
+		n := auditNoise(tc.noise, "TestAuditNoise")
+		if _, err := n.AddNoiseInt64(0, 1, 1, 1, 1e-5); err != nil {
+			t.Fatalf("With %s, AddNoiseInt64: %v", tc.desc, err)
+		}
+		if _, err := n.AddNoiseFloat64(0, 1, 1, 1, 1e-5); err != nil {
+			t.Fatalf("With %s, AddNoiseFloat64: %v", tc.desc, err)
+		}
+		draws, ok := noiseDraws.Load(tc.want)
+		if !ok {
+			t.Fatalf("With %s, got no noise draws for %s", tc.desc, tc.want)
+		}
+		if got := draws.(*atomic.Int64).Load(); got != 2 {
+			t.Errorf("With %s, got %d noise draws for %s, want 2", tc.desc, got, tc.want)
+		}
+	}
+}
+
+// Checks that Count reports one noise draw per partition in Beam metrics.
+func TestNoiseDrawsCounters(t *testing.T) {
+	p, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		TestMode:                  TestModeWithContributionBounding,
+	}))
+	Count(s, pcol, CountParams{MaxPartitionsContributed: 1, MaxValue: 1})
+	pr, err := ptest.RunWithMetrics(p)
+	if err != nil {
+		t.Fatalf("TestNoiseDrawsCounters: %v", err)
+	}
+
+	draws := make(map[string]int64)
+	for _, c := range pr.Metrics().AllMetrics().Counters() {
+		if c.Namespace() == NoiseDrawsNamespace {
+			draws[c.Name()] += c.Result()
+		}
+	}
+	// In test mode, noise draws are reported with the None mechanism.
+	if got := draws["BoundedSumInt64.None"]; got != 1 {
+		t.Errorf("TestNoiseDrawsCounters: got %d noise draws for BoundedSumInt64.None, want 1 (all counters: %v)", got, draws)
+	}
+}
@@ -0,0 +1,260 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn5x1[context.Context, beam.W, kv.Pair, func(beam.W, kv.Pair), func(DeadLetter), error](&categoryIndexFn{})
+	register.Emitter2[beam.W, kv.Pair]()
+	register.DoFn3x1[beam.W, []float64, func(beam.W, beam.V), error](&indexToCategoriesFn{})
+	register.Emitter2[beam.W, beam.V]()
+}
+
+// OrdinalQuantilesParams specifies the parameters associated with an
+// OrdinalQuantilesPerKey aggregation.
+type OrdinalQuantilesParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation. See QuantilesParams.PartitionSelectionParams.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// The list of partitions present in the output, if known in advance. See
+	// QuantilesParams.PublicPartitions.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct partitions that a given privacy identifier
+	// can influence.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of contributions from a given privacy identifier for
+	// each key.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Categories is a slice or array of the values that can be associated with
+	// keys, in increasing order, e.g. []string{"disagree", "neutral", "agree"}
+	// for answers on a Likert scale. Its element type must be the value type of
+	// the PrivatePCollection, and categories must be distinct. Values are
+	// matched to categories by their encoding, and values that don't match any
+	// category are malformed records: they fail the pipeline, unless
+	// PrivacySpecParams.SkipMalformedRecords is set.
+	//
+	// Required; must have at least 2 categories.
+	Categories any
+	// Percentile ranks that the quantiles should be computed for. Each rank must
+	// be between zero and one. See QuantilesParams.Ranks.
+	Ranks []float64
+}
+
+// OrdinalQuantilesPerKey computes one or multiple quantiles of the values
+// associated with each key in a PrivatePCollection<K,V>, where the values are
+// ordered categories rather than numbers, e.g. survey answers on a Likert
+// scale or ordered buckets. Instead of numeric bounds, it takes the ordered
+// list of categories in params.Categories, and returns the categories at the
+// given ranks, with the same privacy guarantees as QuantilesPerKey.
+//
+// Categories are mapped to their index in params.Categories, whose quantiles
+// are computed with QuantilesPerKey and rounded to the nearest category.
+//
+// OrdinalQuantilesPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,[]V>.
+func OrdinalQuantilesPerKey(s beam.Scope, pcol PrivatePCollection, params OrdinalQuantilesParams) beam.PCollection {
+	s = s.Scope("pbeam.OrdinalQuantilesPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	_, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("OrdinalQuantilesPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("OrdinalQuantilesPerKey: no codec found for the input PrivatePCollection.")
+	}
+	vType := pcol.codec.VType.T
+	categories, err := encodeCategories("Categories", params.Categories, vType)
+	if err != nil {
+		return pcol.privacySpec.invalidAggregation(s, "OrdinalQuantilesPerKey",
+			fmt.Errorf("pbeam.OrdinalQuantilesPerKey: %v", err), pcol.codec.KType.T, reflect.SliceOf(vType))
+	}
+
+	outputCodec := kv.NewCodec(pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	indices := pcol
+	indices.col = parDoWithDeadLetters(s, pcol.privacySpec, &categoryIndexFn{
+		InputCodec:    pcol.codec,
+		OutputCodec:   outputCodec,
+		Categories:    categories,
+		SkipMalformed: pcol.privacySpec.skipMalformedRecords,
+	}, pcol.col)
+	indices.codec = outputCodec
+
+	quantiles := quantilesPerKeyWithBudget(s, indices, QuantilesParams{
+		NoiseKind:                    params.NoiseKind,
+		AggregationEpsilon:           params.AggregationEpsilon,
+		AggregationDelta:             params.AggregationDelta,
+		PartitionSelectionParams:     params.PartitionSelectionParams,
+		PublicPartitions:             params.PublicPartitions,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		MinValue:                     0,
+		MaxValue:                     float64(len(categories) - 1),
+		Ranks:                        params.Ranks,
+	})
+	return beam.ParDo(s, &indexToCategoriesFn{
+		Categories: categories,
+		VType:      beam.EncodedType{T: vType},
+	}, quantiles, beam.TypeDefinition{Var: beam.VType, T: reflect.SliceOf(vType)})
+}
+
+// encodeCategories checks that categories, the value of the parameter named
+// field, is a slice or array of at least 2 distinct values of type vType, and
+// returns their encodings.
+func encodeCategories(field string, categories any, vType reflect.Type) ([][]byte, error) {
+	if categories == nil {
+		return nil, fmt.Errorf("%s must be set", field)
+	}
+	v := reflect.ValueOf(categories)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%s must be a slice or an array, got %T", field, categories)
+	}
+	if v.Type().Elem() != vType {
+		return nil, fmt.Errorf("the element type of %s must be the value type %v of the PrivatePCollection, got %v", field, vType, v.Type().Elem())
+	}
+	if v.Len() < 2 {
+		return nil, fmt.Errorf("%s must have at least 2 elements, got %d", field, v.Len())
+	}
+	enc := beam.NewElementEncoder(vType)
+	encoded := make([][]byte, v.Len())
+	seen := make(map[string]int)
+	for i := range encoded {
+		var buf bytes.Buffer
+		if err := enc.Encode(v.Index(i).Interface(), &buf); err != nil {
+			return nil, fmt.Errorf("couldn't encode category %v: %v", v.Index(i), err)
+		}
+		if j, ok := seen[buf.String()]; ok {
+			return nil, fmt.Errorf("%s must be distinct, got %v at indices %d and %d", field, v.Index(i), j, i)
+		}
+		seen[buf.String()] = i
+		encoded[i] = buf.Bytes()
+	}
+	return encoded, nil
+}
+
+// categoryIndexFn replaces the value of each kv.Pair{K,V} by the index of its
+// category, as a float64. Values that don't match any category are malformed
+// records, unless DropUnknown is set, in which case they are dropped.
+type categoryIndexFn struct {
+	InputCodec, OutputCodec *kv.Codec
+	Categories              [][]byte
+	SkipMalformed           bool
+	DropUnknown             bool
+	indices                 map[string]float64
+}
+
+func (fn *categoryIndexFn) Setup() error {
+	fn.indices = make(map[string]float64, len(fn.Categories))
+	for i, c := range fn.Categories {
+		fn.indices[string(c)] = float64(i)
+	}
+	if err := fn.InputCodec.Setup(); err != nil {
+		return err
+	}
+	return fn.OutputCodec.Setup()
+}
+
+func (fn *categoryIndexFn) ProcessElement(ctx context.Context, id beam.W, pair kv.Pair, emit func(beam.W, kv.Pair), emitDeadLetter func(DeadLetter)) error {
+	k, v, err := fn.InputCodec.Decode(pair)
+	if err != nil {
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "categoryIndexFn", err, emitDeadLetter)
+	}
+	index, ok := fn.indices[string(pair.V)]
+	if !ok && fn.DropUnknown {
+		return nil
+	}
+	if !ok {
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "categoryIndexFn", fmt.Errorf("value %v is not one of the Categories", v), emitDeadLetter)
+	}
+	indexed, err := fn.OutputCodec.Encode(k, index)
+	if err != nil {
+		return fmt.Errorf("pbeam.categoryIndexFn.ProcessElement: couldn't encode pair: %v", err)
+	}
+	emit(id, indexed)
+	return nil
+}
+
+// indexToCategoriesFn rounds the quantiles of category indices to the nearest
+// category, and outputs them as a []V.
+type indexToCategoriesFn struct {
+	Categories [][]byte
+	VType      beam.EncodedType
+	categories reflect.Value
+}
+
+func (fn *indexToCategoriesFn) Setup() error {
+	var err error
+	fn.categories, err = decodeCategories(fn.Categories, fn.VType.T)
+	if err != nil {
+		return fmt.Errorf("pbeam.indexToCategoriesFn.Setup: %v", err)
+	}
+	return nil
+}
+
+func (fn *indexToCategoriesFn) ProcessElement(k beam.W, quantiles []float64, emit func(beam.W, beam.V)) error {
+	result := reflect.MakeSlice(fn.categories.Type(), len(quantiles), len(quantiles))
+	for i, q := range quantiles {
+		index := int(math.Round(q))
+		index = max(0, min(index, fn.categories.Len()-1))
+		result.Index(i).Set(fn.categories.Index(index))
+	}
+	emit(k, result.Interface())
+	return nil
+}
+
+// decodeCategories decodes the categories encoded by encodeCategories into a
+// []vType.
+func decodeCategories(encoded [][]byte, vType reflect.Type) (reflect.Value, error) {
+	dec := beam.NewElementDecoder(vType)
+	categories := reflect.MakeSlice(reflect.SliceOf(vType), len(encoded), len(encoded))
+	for i, c := range encoded {
+		v, err := dec.Decode(bytes.NewBuffer(c))
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("couldn't decode category %d: %v", i, err)
+		}
+		categories.Index(i).Set(reflect.ValueOf(v))
+	}
+	return categories, nil
+}
@@ -0,0 +1,107 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, []string, string](checkLikertQuantilesFn)
+}
+
+type likertAnswer struct {
+	ID       int    `pbeam:"privacy_id"`
+	Question int    `pbeam:"partition"`
+	Answer   string `pbeam:"value"`
+}
+
+var likertScale = []string{"disagree", "neutral", "agree"}
+
+// checkLikertQuantilesFn returns "ok" if the quantiles are the answers
+// expected by TestOrdinalQuantilesPerKeyNoNoise.
+func checkLikertQuantilesFn(question int, quantiles []string) string {
+	want := []string{"disagree", "neutral", "agree"}
+	if !reflect.DeepEqual(quantiles, want) {
+		return fmt.Sprintf("question %d: got quantiles %v, want %v", question, quantiles, want)
+	}
+	return "ok"
+}
+
+// Checks that OrdinalQuantilesPerKey returns the expected categories.
+func TestOrdinalQuantilesPerKeyNoNoise(t *testing.T) {
+	var answers []likertAnswer
+	for i := 0; i < 200; i++ {
+		answer := "neutral"
+		if i < 50 {
+			answer = "disagree"
+		} else if i >= 150 {
+			answer = "agree"
+		}
+		answers = append(answers, likertAnswer{ID: i, Question: 0, Answer: answer})
+	}
+	p, s, col := ptest.CreateList(answers)
+	pcol := MakePrivateFromStruct(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithoutContributionBounding,
+		}), "")
+	got := OrdinalQuantilesPerKey(s, pcol, OrdinalQuantilesParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		Categories:                   likertScale,
+		Ranks:                        []float64{0.1, 0.5, 0.9},
+		PublicPartitions:             []int{0},
+	})
+
+	passert.Equals(s, beam.ParDo(s, checkLikertQuantilesFn, got), "ok")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("OrdinalQuantilesPerKey did not return the expected categories: %v", err)
+	}
+}
+
+func TestEncodeCategories(t *testing.T) {
+	stringT := reflect.TypeOf("")
+	for _, tc := range []struct {
+		desc       string
+		categories any
+		wantErr    bool
+	}{
+		{"slice", likertScale, false},
+		{"array", [2]string{"low", "high"}, false},
+		{"nil", nil, true},
+		{"not a slice", "low", true},
+		{"wrong element type", []int{1, 2}, true},
+		{"single category", []string{"low"}, true},
+		{"duplicate categories", []string{"low", "high", "low"}, true},
+	} {
+		got, err := encodeCategories("Categories", tc.categories, stringT)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("encodeCategories with %s: got err=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if err == nil && len(got) != reflect.ValueOf(tc.categories).Len() {
+			t.Errorf("encodeCategories with %s: got %d encoded categories, want %d", tc.desc, len(got), reflect.ValueOf(tc.categories).Len())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(PairedValues{}))
+	register.DoFn2x3[beam.W, kv.Pair, beam.W, kv.Pair, error](&pairedDifferenceFn{})
+}
+
+// PairedValues are two values of a single contribution, e.g. a measurement
+// taken before and after an intervention.
+type PairedValues struct {
+	First, Second float64
+}
+
+// PairedDifferenceParams specifies the parameters associated with a paired
+// difference aggregation.
+type PairedDifferenceParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. See MeanParams.PublicPartitions for details.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct values that a given privacy identifier
+	// can influence. See MeanParams.MaxPartitionsContributed for details.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of contributions from a given privacy identifier
+	// for each key. See MeanParams.MaxContributionsPerPartition for details.
+	//
+	// Only used by MeanDifferencePerKey.
+	MaxContributionsPerPartition int64
+	// Bounds of the difference Second-First of a single contribution for
+	// MeanDifferencePerKey, or of the sum of the differences of a privacy
+	// identifier in a partition for SumDifferencePerKey; differences outside
+	// of these bounds are clamped.
+	//
+	// Since only the difference is bounded, the noise only depends on the
+	// range of the differences. When both values are strongly correlated, this
+	// range is usually much smaller than the range of the values themselves,
+	// and the difference of the outputs of two separate aggregations on First
+	// and Second would be much noisier.
+	//
+	// Required.
+	MinDifference, MaxDifference float64
+}
+
+// MeanDifferencePerKey obtains the mean of the differences Second-First of the
+// PairedValues associated with each key in a PrivatePCollection<K,PairedValues>,
+// adding differentially private noise to the means and doing pre-aggregation
+// thresholding to remove means with a low number of distinct privacy
+// identifiers.
+//
+// Differences are computed per contribution and clamped to
+// [MinDifference, MaxDifference] before being aggregated with MeanPerKey.
+//
+// MeanDifferencePerKey transforms a PrivatePCollection<K,PairedValues> into a
+// PCollection<K,float64>.
+func MeanDifferencePerKey(s beam.Scope, pcol PrivatePCollection, params PairedDifferenceParams) beam.PCollection {
+	s = s.Scope("pbeam.MeanDifferencePerKey")
+	differences := pairedDifferences(s, pcol)
+	if err := checkPairedDifferenceParams(params); err != nil {
+		return pcol.privacySpec.invalidAggregation(s, "MeanDifferencePerKey", fmt.Errorf("pbeam.MeanDifferencePerKey: %v", err), differences.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
+	return MeanPerKey(s, differences, MeanParams{
+		NoiseKind:                    params.NoiseKind,
+		AggregationEpsilon:           params.AggregationEpsilon,
+		AggregationDelta:             params.AggregationDelta,
+		PartitionSelectionParams:     params.PartitionSelectionParams,
+		PublicPartitions:             params.PublicPartitions,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		MinValue:                     params.MinDifference,
+		MaxValue:                     params.MaxDifference,
+	})
+}
+
+// SumDifferencePerKey sums the differences Second-First of the PairedValues
+// associated with each key in a PrivatePCollection<K,PairedValues>, adding
+// differentially private noise to the sums and doing pre-aggregation
+// thresholding to remove sums with a low number of distinct privacy
+// identifiers.
+//
+// The differences of each privacy identifier in a partition are summed and
+// clamped to [MinDifference, MaxDifference] before being aggregated with
+// SumPerKey.
+//
+// SumDifferencePerKey transforms a PrivatePCollection<K,PairedValues> into a
+// PCollection<K,float64>.
+func SumDifferencePerKey(s beam.Scope, pcol PrivatePCollection, params PairedDifferenceParams) beam.PCollection {
+	s = s.Scope("pbeam.SumDifferencePerKey")
+	differences := pairedDifferences(s, pcol)
+	if err := checkPairedDifferenceParams(params); err != nil {
+		return pcol.privacySpec.invalidAggregation(s, "SumDifferencePerKey", fmt.Errorf("pbeam.SumDifferencePerKey: %v", err), differences.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
+	return SumPerKey(s, differences, SumParams{
+		NoiseKind:                params.NoiseKind,
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionParams: params.PartitionSelectionParams,
+		PublicPartitions:         params.PublicPartitions,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+		MinValue:                 params.MinDifference,
+		MaxValue:                 params.MaxDifference,
+	})
+}
+
+// pairedDifferences transforms a PrivatePCollection<K,PairedValues> into a
+// PrivatePCollection<K,float64> with the difference Second-First of each
+// contribution.
+func pairedDifferences(s beam.Scope, pcol PrivatePCollection) PrivatePCollection {
+	_, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("Paired difference aggregations must be used on a PrivatePCollection of type <K,PairedValues>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("Paired difference aggregations: no codec found for the input PrivatePCollection.")
+	}
+	if pcol.codec.VType.T != reflect.TypeOf(PairedValues{}) {
+		log.Fatalf("Paired difference aggregations must be used on a PrivatePCollection of type <K,PairedValues>, got value type %v instead", pcol.codec.VType.T)
+	}
+	outputCodec := kv.NewCodec(pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	return PrivatePCollection{
+		col:            beam.ParDo(s, &pairedDifferenceFn{InputPairCodec: pcol.codec, OutputPairCodec: outputCodec}, pcol.col),
+		codec:          outputCodec,
+		privacySpec:    pcol.privacySpec,
+		exclusionLists: pcol.exclusionLists,
+	}
+}
+
+func checkPairedDifferenceParams(params PairedDifferenceParams) error {
+	if math.IsNaN(params.MinDifference) || math.IsInf(params.MinDifference, 0) || math.IsNaN(params.MaxDifference) || math.IsInf(params.MaxDifference, 0) {
+		return fmt.Errorf("MinDifference and MaxDifference must be finite, got (%f, %f)", params.MinDifference, params.MaxDifference)
+	}
+	if params.MinDifference > params.MaxDifference {
+		return fmt.Errorf("MinDifference must not exceed MaxDifference, got (%f, %f)", params.MinDifference, params.MaxDifference)
+	}
+	return nil
+}
+
+// pairedDifferenceFn replaces the PairedValues of each element of a
+// PCollection<ID, kv.Pair{K,PairedValues}> by the difference Second-First.
+type pairedDifferenceFn struct {
+	InputPairCodec  *kv.Codec
+	OutputPairCodec *kv.Codec
+}
+
+func (fn *pairedDifferenceFn) Setup() error {
+	if err := fn.InputPairCodec.Setup(); err != nil {
+		return err
+	}
+	return fn.OutputPairCodec.Setup()
+}
+
+func (fn *pairedDifferenceFn) ProcessElement(id beam.W, pair kv.Pair) (beam.W, kv.Pair, error) {
+	k, v, err := fn.InputPairCodec.Decode(pair)
+	if err != nil {
+		return id, kv.Pair{}, fmt.Errorf("pbeam.pairedDifferenceFn.ProcessElement: %w", err)
+	}
+	values := v.(PairedValues)
+	out, err := fn.OutputPairCodec.Encode(k, values.Second-values.First)
+	if err != nil {
+		return id, kv.Pair{}, fmt.Errorf("pbeam.pairedDifferenceFn.ProcessElement: %w", err)
+	}
+	return id, out, nil
+}
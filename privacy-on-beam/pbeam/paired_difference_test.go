@@ -0,0 +1,156 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[testutils.TripleWithFloatValue, int, PairedValues](tripleWithFloatValueToPairedValues)
+}
+
+// tripleWithFloatValueToPairedValues uses the value of the triple as the
+// difference between two values that are far outside of the difference bounds.
+func tripleWithFloatValueToPairedValues(t testutils.TripleWithFloatValue) (int, PairedValues) {
+	first := float64(1000 * t.ID)
+	return t.Partition, PairedValues{First: first, Second: first + float64(t.Value)}
+}
+
+func TestMeanDifferencePerKey(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(10, 0, 2),
+		testutils.MakeTripleWithFloatValueStartingFromKey(10, 5, 1, -1))
+	result := []testutils.PairIF64{{Key: 0, Value: 2}, {Key: 1, Value: -1}}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithoutContributionBounding,
+	}))
+	pcol = ParDo(s, tripleWithFloatValueToPairedValues, pcol)
+	got := MeanDifferencePerKey(s, pcol, PairedDifferenceParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinDifference:                -5,
+		MaxDifference:                5,
+		PublicPartitions:             []int{0, 1},
+	})
+
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-10)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("MeanDifferencePerKey: %v", err)
+	}
+}
+
+func TestSumDifferencePerKeyClampsDifferences(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(10, 0, 2),
+		testutils.MakeTripleWithFloatValueStartingFromKey(10, 5, 1, -1))
+	// Differences of partition 0 are clamped to MaxDifference.
+	result := []testutils.PairIF64{{Key: 0, Value: 15}, {Key: 1, Value: -5}}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithoutContributionBounding,
+	}))
+	pcol = ParDo(s, tripleWithFloatValueToPairedValues, pcol)
+	got := SumDifferencePerKey(s, pcol, PairedDifferenceParams{
+		MaxPartitionsContributed: 1,
+		MinDifference:            -5,
+		MaxDifference:            1.5,
+		PublicPartitions:         []int{0, 1},
+	})
+
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-10)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("SumDifferencePerKey: %v", err)
+	}
+}
+
+func TestCheckPairedDifferenceParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  PairedDifferenceParams
+		wantErr bool
+	}{
+		{
+			desc:    "valid parameters",
+			params:  PairedDifferenceParams{MinDifference: -1, MaxDifference: 1},
+			wantErr: false,
+		},
+		{
+			desc:    "MinDifference > MaxDifference",
+			params:  PairedDifferenceParams{MinDifference: 1, MaxDifference: -1},
+			wantErr: true,
+		},
+		{
+			desc:    "infinite MaxDifference",
+			params:  PairedDifferenceParams{MinDifference: -1, MaxDifference: math.Inf(1)},
+			wantErr: true,
+		},
+		{
+			desc:    "NaN MinDifference",
+			params:  PairedDifferenceParams{MinDifference: math.NaN(), MaxDifference: 1},
+			wantErr: true,
+		},
+	} {
+		if err := checkPairedDifferenceParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPairedDifferenceDeferValidationErrors(t *testing.T) {
+	for _, tc := range []struct {
+		aggregation string
+		difference  func(beam.Scope, PrivatePCollection, PairedDifferenceParams) beam.PCollection
+	}{
+		{aggregation: "MeanDifferencePerKey", difference: MeanDifferencePerKey},
+		{aggregation: "SumDifferencePerKey", difference: SumDifferencePerKey},
+	} {
+		p, s, col := ptest.CreateList(testutils.MakeTripleWithFloatValue(10, 0, 2))
+		col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+		spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+		pcol := ParDo(s, tripleWithFloatValueToPairedValues, MakePrivate(s, col, spec))
+		// MinDifference must not be larger than MaxDifference.
+		tc.difference(s, pcol, PairedDifferenceParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinDifference:                5,
+			MaxDifference:                -5,
+			PublicPartitions:             []int{0},
+		})
+		if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != tc.aggregation {
+			t.Errorf("ValidationErrors() = %v, want a single error for %s", errs, tc.aggregation)
+		}
+		if err := ptest.Run(p); err == nil {
+			t.Errorf("TestPairedDifferenceDeferValidationErrors: pipeline with an invalid %s succeeded, expected an error", tc.aggregation)
+		}
+	}
+}
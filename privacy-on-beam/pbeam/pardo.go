@@ -19,6 +19,7 @@ package pbeam
 import (
 	"fmt"
 	"reflect"
+	"slices"
 
 	log "github.com/golang/glog"
 	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/generated"
@@ -84,15 +85,19 @@ func ParDo(s beam.Scope, doFn any, pcol PrivatePCollection) PrivatePCollection {
 	emptyDef := beam.TypeDefinition{}
 	if anonDoFn.typeDef != emptyDef {
 		return PrivatePCollection{
-			col:         beam.ParDo(s, anonDoFn.fn, pcol.col, anonDoFn.typeDef),
-			codec:       anonDoFn.codec,
-			privacySpec: pcol.privacySpec,
+			col:            beam.ParDo(s, anonDoFn.fn, pcol.col, anonDoFn.typeDef),
+			codec:          anonDoFn.codec,
+			privacySpec:    pcol.privacySpec,
+			doFns:          append(slices.Clip(pcol.doFns), doFn),
+			exclusionLists: pcol.exclusionLists,
 		}
 	}
 	return PrivatePCollection{
-		col:         beam.ParDo(s, anonDoFn.fn, pcol.col),
-		codec:       anonDoFn.codec,
-		privacySpec: pcol.privacySpec,
+		col:            beam.ParDo(s, anonDoFn.fn, pcol.col),
+		codec:          anonDoFn.codec,
+		privacySpec:    pcol.privacySpec,
+		doFns:          append(slices.Clip(pcol.doFns), doFn),
+		exclusionLists: pcol.exclusionLists,
 	}
 }
 
@@ -0,0 +1,84 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"context"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/filter"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	register.DoFn2x2[context.Context, int, int64, error](&noisyPartitionCountFn{})
+}
+
+// estimatedPartitions is set to the noisy number of candidate partitions of the
+// SelectPartitions aggregations with a PartitionCountEpsilon.
+var estimatedPartitions = beam.NewGauge("pbeam.SelectPartitions", "estimated_partitions")
+
+// estimatePartitionCount returns a PCollection<int64> holding the number of
+// distinct partitions of idPartitions, a PCollection<ID,K> where each privacy
+// ID contributes to at most maxPartitionsContributed partitions, with Laplace
+// noise making it ε-differentially private. The estimate is also reported in
+// the estimatedPartitions gauge, so that operators can size the pipeline's
+// workers and the sharding of its outputs without looking at the data.
+func estimatePartitionCount(s beam.Scope, spec PrivacySpec, epsilon float64, maxPartitionsContributed int64, idPartitions beam.PCollection) beam.PCollection {
+	s = s.Scope("estimatePartitionCount")
+	partitions := filter.Distinct(s, beam.DropKey(s, idPartitions))
+	return beam.ParDo(s, &noisyPartitionCountFn{
+		Epsilon:                  epsilon,
+		MaxPartitionsContributed: maxPartitionsContributed,
+		TestMode:                 spec.testMode,
+	}, stats.CountElms(s, partitions))
+}
+
+// noisyPartitionCountFn adds Laplace noise to a number of partitions. Adding
+// or removing a privacy ID changes it by at most MaxPartitionsContributed.
+type noisyPartitionCountFn struct {
+	Epsilon                  float64
+	MaxPartitionsContributed int64
+	TestMode                 TestMode
+}
+
+func (fn *noisyPartitionCountFn) ProcessElement(ctx context.Context, count int) (int64, error) {
+	n := noise.Laplace()
+	if fn.TestMode.isEnabled() {
+		n = noNoise{}
+	}
+	noisy, err := n.AddNoiseInt64(int64(count), fn.MaxPartitionsContributed, 1, fn.Epsilon, 0)
+	if err != nil {
+		return 0, err
+	}
+	if noisy < 0 {
+		noisy = 0
+	}
+	log.Infof("Estimated number of candidate partitions: %d", noisy)
+	dpagg.Log(dpagg.LogEntry{
+		Level:   dpagg.LogInfo,
+		Source:  "pbeam.SelectPartitions",
+		Message: "estimated number of candidate partitions",
+		Params:  map[string]float64{"NoisyPartitionCount": float64(noisy)},
+	})
+	estimatedPartitions.Set(ctx, noisy)
+	return noisy, nil
+}
@@ -0,0 +1,156 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/filter"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(PartitionDecision{}))
+	register.Function1x2[beam.W, beam.W, PartitionDecision](keptInTestMode)
+	register.Function4x0[beam.W, func(*int64) bool, func(*int64) bool, func(beam.W, PartitionDecision)](mergePartitionDecisions)
+	register.Iter1[int64]()
+	register.Emitter2[beam.W, PartitionDecision]()
+}
+
+// PartitionDecisionReason is the reason why a partition is kept in, or
+// dropped from, the output of aggregations.
+type PartitionDecisionReason int
+
+const (
+	// PublicPartitionWithContributions is a public partition that has
+	// contributions in the input.
+	PublicPartitionWithContributions PartitionDecisionReason = iota
+	// PublicPartitionWithoutContributions is a public partition that has no
+	// contributions in the input. Aggregations still output it, but its
+	// results only consist of noise.
+	PublicPartitionWithoutContributions
+	// NonPublicPartition is a partition that has contributions in the input, but
+	// isn't a public partition, so aggregations drop it.
+	NonPublicPartition
+	// KeptInTestMode is a partition that has contributions in the input, and is
+	// kept because test mode disables partition selection.
+	KeptInTestMode
+)
+
+func (r PartitionDecisionReason) String() string {
+	switch r {
+	case PublicPartitionWithContributions:
+		return "public partition with contributions"
+	case PublicPartitionWithoutContributions:
+		return "public partition without contributions"
+	case NonPublicPartition:
+		return "non-public partition"
+	case KeptInTestMode:
+		return "kept in test mode"
+	default:
+		return fmt.Sprintf("PartitionDecisionReason(%d)", int(r))
+	}
+}
+
+// PartitionDecision says whether a partition is kept in the output of
+// aggregations, and why.
+type PartitionDecision struct {
+	Kept   bool
+	Reason PartitionDecisionReason
+}
+
+// PartitionDecisions returns, for each partition of pcol and each public
+// partition, whether aggregations on pcol with the given public partitions
+// keep it in their output, and why. It lets pipelines with public partitions
+// log which of the expected partitions had no contributions, and test
+// pipelines log which partitions they output.
+//
+// Decisions are only available when the outcome of partition selection
+// doesn't depend on noise, i.e. with public partitions (a PCollection, slice or
+// array), or in test mode. Otherwise, PartitionDecisions fails as an
+// aggregation with invalid parameters would.
+//
+// Decisions are computed on the input, before contribution bounding, and are
+// not differentially private: whether a partition has contributions depends on
+// the input data. So they must only be written to sinks that can hold the raw
+// input data. They don't consume any privacy budget.
+//
+// This is also why aggregations can't mark public partitions without
+// contributions in their own output: the noisy result they output for such a
+// partition must be indistinguishable from the one of a partition with few
+// contributions.
+//
+// In a PrivatePCollection<K,V>, K is the partition key and in a
+// PrivatePCollection<V>, V is the partition key. PartitionDecisions
+// transforms a PrivatePCollection<K,V> or a PrivatePCollection<V> into a
+// PCollection<partition, PartitionDecision>.
+func PartitionDecisions(s beam.Scope, pcol PrivatePCollection, publicPartitions any) beam.PCollection {
+	s = s.Scope("pbeam.PartitionDecisions")
+	pcol = extractTaggedStructFields(s, pcol, false)
+	spec := pcol.privacySpec
+	partitionT := partitionType(pcol)
+	invalid := func(err error) beam.PCollection {
+		return spec.invalidAggregation(s, "PartitionDecisions", err, partitionT, reflect.TypeOf(PartitionDecision{}))
+	}
+	if publicPartitions == nil && !spec.testMode.isEnabled() {
+		return invalid(fmt.Errorf("pbeam.PartitionDecisions: partition decisions are only available with public partitions or in test mode"))
+	}
+	if err := checkPublicPartitions(publicPartitions, partitionT); err != nil {
+		return invalid(fmt.Errorf("pbeam.PartitionDecisions: %v", err))
+	}
+
+	// Keep the distinct partitions of the input.
+	partitions := pcol.col
+	if _, pT := beam.ValidateKVType(pcol.col); pT.Type() == reflect.TypeOf(kv.Pair{}) {
+		partitions = beam.ParDo(s, &dropValuesFn{pcol.codec}, pcol.col, beam.TypeDefinition{Var: beam.WType, T: partitionT})
+	}
+	partitions = filter.Distinct(s, beam.DropKey(s, partitions))
+
+	if publicPartitions == nil {
+		return beam.ParDo(s, keptInTestMode, partitions)
+	}
+	publicPartitionsCol, isPCollection := publicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitionsCol = beam.Reshuffle(s, beam.CreateList(s, publicPartitions))
+	}
+	grouped := beam.CoGroupByKey(s,
+		beam.ParDo(s, addZeroValuesToPublicPartitionsInt64, publicPartitionsCol),
+		beam.ParDo(s, addZeroValuesToPublicPartitionsInt64, partitions))
+	return beam.ParDo(s, mergePartitionDecisions, grouped)
+}
+
+func keptInTestMode(partition beam.W) (beam.W, PartitionDecision) {
+	return partition, PartitionDecision{Kept: true, Reason: KeptInTestMode}
+}
+
+// mergePartitionDecisions outputs the decision for a partition after a
+// CoGroupByKey of the public partitions and of the partitions of the input.
+func mergePartitionDecisions(partition beam.W, isPublic func(*int64) bool, hasContributions func(*int64) bool, emit func(beam.W, PartitionDecision)) {
+	var ignoredZero int64
+	public, contributed := isPublic(&ignoredZero), hasContributions(&ignoredZero)
+	switch {
+	case public && contributed:
+		emit(partition, PartitionDecision{Kept: true, Reason: PublicPartitionWithContributions})
+	case public:
+		emit(partition, PartitionDecision{Kept: true, Reason: PublicPartitionWithoutContributions})
+	case contributed:
+		emit(partition, PartitionDecision{Kept: false, Reason: NonPublicPartition})
+	}
+}
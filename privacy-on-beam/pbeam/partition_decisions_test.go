@@ -0,0 +1,110 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, PartitionDecision, string](formatPartitionDecisionFn)
+}
+
+func formatPartitionDecisionFn(partition int, d PartitionDecision) string {
+	return fmt.Sprintf("%d: kept=%t, %v", partition, d.Kept, d.Reason)
+}
+
+// Checks that PartitionDecisions reports public partitions with and without
+// contributions, and non-public partitions, for in-memory and PCollection
+// public partitions.
+func TestPartitionDecisionsPublicPartitions(t *testing.T) {
+	for _, tc := range []struct {
+		desc                    string
+		publicPartitionsAsPColl bool
+	}{
+		{"in-memory public partitions", false},
+		{"PCollection public partitions", true},
+	} {
+		// Partitions 0 and 1 have contributions, partition 1 multiple ones.
+		pairs := []testutils.PairII{{1, 0}, {2, 1}, {3, 1}, {3, 1}}
+		p, s, col := ptest.CreateList(pairs)
+		col = beam.ParDo(s, testutils.PairToKV, col)
+		pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+		}))
+		var publicPartitions any = []int{1, 2}
+		if tc.publicPartitionsAsPColl {
+			publicPartitions = beam.CreateList(s, []int{1, 2})
+		}
+		got := PartitionDecisions(s, pcol, publicPartitions)
+		passert.Equals(s, beam.ParDo(s, formatPartitionDecisionFn, got),
+			"0: kept=false, non-public partition",
+			"1: kept=true, public partition with contributions",
+			"2: kept=true, public partition without contributions")
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestPartitionDecisionsPublicPartitions with %s: %v", tc.desc, err)
+		}
+	}
+}
+
+// Checks that PartitionDecisions keeps all partitions with contributions in
+// test mode.
+func TestPartitionDecisionsTestMode(t *testing.T) {
+	pairs := []testutils.PairII{{1, 0}, {2, 1}, {3, 1}}
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		TestMode:                  TestModeWithContributionBounding,
+	}))
+	got := PartitionDecisions(s, pcol, nil)
+	passert.Equals(s, beam.ParDo(s, formatPartitionDecisionFn, got),
+		"0: kept=true, kept in test mode",
+		"1: kept=true, kept in test mode")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestPartitionDecisionsTestMode: %v", err)
+	}
+}
+
+// Checks that PartitionDecisions is unavailable without public partitions
+// outside of test mode.
+func TestPartitionDecisionsRequiresPublicPartitionsOrTestMode(t *testing.T) {
+	pairs := []testutils.PairII{{1, 0}}
+	_, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		DeferValidationErrors:     true,
+	})
+	PartitionDecisions(s, MakePrivate(s, col, spec), nil)
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "PartitionDecisions" {
+		t.Errorf("ValidationErrors() = %v, want a single error for PartitionDecisions", errs)
+	}
+}
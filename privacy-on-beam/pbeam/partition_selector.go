@@ -0,0 +1,130 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(PreAggPartitionSelector{}))
+}
+
+// PartitionSelector is a private partition selection mechanism, deciding
+// whether to keep a partition given the number of privacy units contributing to
+// it. It lets researchers experiment with alternative mechanisms in all
+// aggregations doing private partition selection, by setting
+// PrivacySpecParams.PartitionSelector.
+//
+// Implementations must be differentially private with the budget of
+// PartitionSelectorParams. They are serialized in the pipeline with
+// encoding/json, so their type must be registered with beam.RegisterType and
+// their parameters must be exported fields.
+type PartitionSelector interface {
+	ShouldKeepPartition(privacyUnits int64, params PartitionSelectorParams) (bool, error)
+}
+
+// PartitionSelectorParams are the parameters of the partition selection of an
+// aggregation.
+type PartitionSelectorParams struct {
+	// Budget of the partition selection.
+	Epsilon, Delta float64
+	// Maximum number of partitions a privacy unit contributes to.
+	MaxPartitionsContributed int64
+	// Minimum number of privacy units of the partitions to keep, see
+	// PrivacySpecParams.PreThreshold. 0 if unset.
+	PreThreshold int64
+}
+
+// PreAggPartitionSelector is the default PartitionSelector, which uses
+// dpagg.PreAggSelectPartition.
+type PreAggPartitionSelector struct{}
+
+// ShouldKeepPartition implements PartitionSelector.
+func (PreAggPartitionSelector) ShouldKeepPartition(privacyUnits int64, params PartitionSelectorParams) (bool, error) {
+	sp, err := dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+		Epsilon:                  params.Epsilon,
+		Delta:                    params.Delta,
+		PreThreshold:             params.PreThreshold,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := sp.IncrementBy(privacyUnits); err != nil {
+		return false, err
+	}
+	return sp.ShouldKeepPartition()
+}
+
+// encodedPartitionSelector serializes a PartitionSelector in the CombineFns
+// doing partition selection. They hold a nil *encodedPartitionSelector if the
+// PrivacySpec has no PartitionSelector.
+type encodedPartitionSelector struct {
+	Type     beam.EncodedType
+	Selector []byte // JSON encoding of the PartitionSelector.
+	selector PartitionSelector
+}
+
+// newEncodedPartitionSelector returns nil if selector is nil.
+func newEncodedPartitionSelector(selector PartitionSelector) (*encodedPartitionSelector, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(selector)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode PartitionSelector %v: %v", selector, err)
+	}
+	// The selector is kept as is when the pipeline isn't serialized.
+	return &encodedPartitionSelector{Type: beam.EncodedType{T: reflect.TypeOf(selector)}, Selector: b, selector: selector}, nil
+}
+
+func (e *encodedPartitionSelector) decode() (PartitionSelector, error) {
+	if e.selector != nil {
+		return e.selector, nil
+	}
+	// If the type is a pointer, json.Unmarshal allocates the value it points to.
+	v := reflect.New(e.Type.T)
+	if err := json.Unmarshal(e.Selector, v.Interface()); err != nil {
+		return nil, fmt.Errorf("couldn't decode PartitionSelector of type %v: %v", e.Type.T, err)
+	}
+	selector, ok := v.Elem().Interface().(PartitionSelector)
+	if !ok {
+		return nil, fmt.Errorf("type %v doesn't implement PartitionSelector", e.Type.T)
+	}
+	e.selector = selector
+	return selector, nil
+}
+
+// shouldKeepPartition returns whether to keep the partition whose privacy units
+// were counted by sp, using the PartitionSelector if e isn't nil, and sp
+// otherwise.
+func (e *encodedPartitionSelector) shouldKeepPartition(sp *dpagg.PreAggSelectPartition, params PartitionSelectorParams) (bool, error) {
+	if e == nil {
+		return sp.ShouldKeepPartition()
+	}
+	selector, err := e.decode()
+	if err != nil {
+		return false, err
+	}
+	return selector.ShouldKeepPartition(sp.IDCount(), params)
+}
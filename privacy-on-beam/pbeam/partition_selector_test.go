@@ -0,0 +1,104 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(thresholdPartitionSelector{}))
+}
+
+// thresholdPartitionSelector keeps the partitions with at least Threshold
+// privacy units. It is not differentially private.
+type thresholdPartitionSelector struct {
+	Threshold int64
+}
+
+func (s thresholdPartitionSelector) ShouldKeepPartition(privacyUnits int64, _ PartitionSelectorParams) (bool, error) {
+	return privacyUnits >= s.Threshold, nil
+}
+
+// Checks that a PartitionSelector survives its serialization in CombineFns.
+func TestEncodedPartitionSelector(t *testing.T) {
+	for _, selector := range []PartitionSelector{thresholdPartitionSelector{Threshold: 3}, &thresholdPartitionSelector{Threshold: 3}} {
+		encoded, err := newEncodedPartitionSelector(selector)
+		if err != nil {
+			t.Fatalf("newEncodedPartitionSelector(%v): got error %v", selector, err)
+		}
+		// Drop the selector kept when the pipeline isn't serialized.
+		encoded = &encodedPartitionSelector{Type: encoded.Type, Selector: encoded.Selector}
+		sp, err := dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 1})
+		if err != nil {
+			t.Fatalf("NewPreAggSelectPartition: got error %v", err)
+		}
+		sp.IncrementBy(2)
+		keep, err := encoded.shouldKeepPartition(sp, PartitionSelectorParams{})
+		if err != nil {
+			t.Fatalf("With %#v, shouldKeepPartition: got error %v", selector, err)
+		}
+		if keep {
+			t.Errorf("With %#v, shouldKeepPartition kept a partition with 2 privacy units", selector)
+		}
+	}
+}
+
+// Checks that SelectPartitions uses the PartitionSelector of the PrivacySpec.
+func TestSelectPartitionsWithPartitionSelector(t *testing.T) {
+	// Partition 0 has 3 privacy units, and partition 1 has 2.
+	pairs := []testutils.PairII{{0, 0}, {1, 0}, {2, 0}, {3, 1}, {4, 1}}
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		PartitionSelector:         thresholdPartitionSelector{Threshold: 3},
+	}))
+	got := SelectPartitions(s, pcol, PartitionSelectionParams{MaxPartitionsContributed: 1})
+	passert.Equals(s, got, 0)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSelectPartitionsWithPartitionSelector: SelectPartitions(%v) = %v, want [0]: %v", col, got, err)
+	}
+}
+
+func TestPreAggPartitionSelector(t *testing.T) {
+	params := PartitionSelectorParams{Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 1, PreThreshold: 10}
+	// Partitions with less privacy units than PreThreshold are always dropped.
+	keep, err := PreAggPartitionSelector{}.ShouldKeepPartition(9, params)
+	if err != nil {
+		t.Fatalf("ShouldKeepPartition: got error %v", err)
+	}
+	if keep {
+		t.Errorf("ShouldKeepPartition kept a partition with less privacy units than PreThreshold")
+	}
+	// Partitions with many more privacy units are kept with probability 1.
+	keep, err = PreAggPartitionSelector{}.ShouldKeepPartition(1000, params)
+	if err != nil {
+		t.Fatalf("ShouldKeepPartition: got error %v", err)
+	}
+	if !keep {
+		t.Errorf("ShouldKeepPartition dropped a partition with 1000 privacy units")
+	}
+}
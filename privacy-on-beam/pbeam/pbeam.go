@@ -121,6 +121,7 @@ import (
 
 	log "github.com/golang/glog"
 	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
 	"github.com/google/differential-privacy/go/v3/noise"
 	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam"
@@ -135,6 +136,8 @@ func init() {
 	register.DoFn2x3[beam.U, kv.Pair, beam.U, beam.W, error](&dropValueFn{})
 	register.DoFn1x3[beam.V, string, beam.V, error](&extractStructFieldFn{})
 	register.DoFn1x3[beam.V, string, beam.V, error](&extractProtoFieldFn{})
+	register.DoFn2x3[beam.U, beam.V, beam.U, beam.W, error](&extractStructKeyFn{})
+	register.DoFn2x3[beam.U, beam.V, beam.U, kv.Pair, error](&extractStructKVFn{})
 }
 
 // PrivacySpec contains information about the privacy parameters used in
@@ -144,10 +147,22 @@ func init() {
 // different privacy budgets, call NewPrivacySpec multiple times and give a
 // different PrivacySpec to each PrivatePCollection.
 type PrivacySpec struct {
-	aggregationBudget        *privacyBudget // Epsilon/Delta (ε,δ) budget available for aggregations performed on this PrivatePCollection.
-	partitionSelectionBudget *privacyBudget // Epsilon/Delta (ε,δ) budget available for partition selections performed on this PrivatePCollection.
-	preThreshold             int64          // Pre-threshold K applied on top of DP partition selection.
-	testMode TestMode // Used for test pipelines, disabled by default.
+	aggregationBudget        *privacyBudget       // Epsilon/Delta (ε,δ) budget available for aggregations performed on this PrivatePCollection.
+	partitionSelectionBudget *privacyBudget       // Epsilon/Delta (ε,δ) budget available for partition selections performed on this PrivatePCollection.
+	preThreshold             int64                // Pre-threshold K applied on top of DP partition selection.
+	testMode                 TestMode             // Used for test pipelines, disabled by default.
+	noiseKind                NoiseKind            // Noise used by aggregations that don't specify one. Laplace if nil.
+	forbidNoiseKindOverride  bool                 // Whether aggregations may specify a different noise than noiseKind.
+	traceStages              bool                 // Whether contribution bounding and DP combiners create OpenTelemetry spans.
+	skipMalformedRecords     bool                 // Whether aggregations output malformed records as dead letters instead of failing.
+	compressValues           bool                 // Whether values collected per privacy unit and partition are compressed when shuffled.
+	deferValidationErrors    bool                 // Whether aggregations with invalid parameters fail at execution instead of construction.
+	validationErrors         *validationErrorSink // Validation errors of aggregations, if deferValidationErrors is set.
+	deadLetters              *deadLetterSink      // Dead letter outputs of aggregations, if skipMalformedRecords is set.
+	noiseSeed                *noiseSeed           // Derives the noise of Count and SumPerKey from a key, if set.
+	privacyIDSalt            []byte               // Key with which encoded privacy IDs are salted before shuffling, if set.
+	onAggregationRegistered  func(AggregationRegisteredEvent)
+	partitionSelector        *encodedPartitionSelector // Private partition selection mechanism, if not the default one.
 }
 
 // PartitionSelectionParams holds the ε & δ budget to be used for private partition selection of
@@ -172,6 +187,16 @@ type PartitionSelectionParams struct {
 	//
 	// Required.
 	MaxPartitionsContributed int64
+	// Warning: This parameter can currently only be set for SelectPartitions aggregation.
+	//
+	// If PartitionCountEpsilon is set, this part of Epsilon is used to estimate the number of
+	// candidate partitions before partition selection, and the rest to select partitions. The
+	// estimate is ε-differentially private, and is reported in the "estimated_partitions" gauge
+	// of the "pbeam.SelectPartitions" namespace, to size the workers and output sharding of
+	// pipelines with very many partitions. It must be smaller than Epsilon.
+	//
+	// Optional.
+	PartitionCountEpsilon float64
 }
 
 // PrivacySpecParams contains parameters to construct a PrivacySpec.
@@ -202,47 +227,413 @@ type PrivacySpecParams struct {
 	// Test mode for test pipelines, disabled by default. Set it to TestModeWithContributionBounding or
 	// TestModeWithoutContributionBounding if you want to enable test mode.
 	TestMode TestMode
+	// NoiseKind is the noise used by aggregations on PrivatePCollections using this PrivacySpec
+	// that don't specify a NoiseKind. Defaults to LaplaceNoise{}. Optional.
+	NoiseKind NoiseKind
+	// If ForbidNoiseKindOverride is set, aggregations on PrivatePCollections using this PrivacySpec
+	// must either leave their NoiseKind unset, or set it to NoiseKind. This lets organizations
+	// standardize on a noise kind without relying on every aggregation to specify it. NoiseKind
+	// must be set when ForbidNoiseKindOverride is set. Optional.
+	ForbidNoiseKindOverride bool
+	// BudgetAlarms are invoked during pipeline construction when the fraction of the aggregation or
+	// partition selection budget consumed by aggregations crosses their threshold. This can be used
+	// e.g. by platform tooling to log or alert on budget consumption in large pipelines. Optional.
+	BudgetAlarms []BudgetAlarm
+	// If TraceStages is set, the contribution bounding and DP aggregation stages of aggregations on
+	// PrivatePCollections using this PrivacySpec create OpenTelemetry spans while the pipeline runs,
+	// using the global tracer provider of the workers. There is one span per stage and bundle, with
+	// the number of elements output by the stage in the bundle as attribute; spans don't contain
+	// any data. This can be used to debug slow stages on portable runners. Optional.
+	TraceStages bool
+	// If SkipMalformedRecords is set, aggregations on PrivatePCollections using this PrivacySpec
+	// skip the records they fail to decode or convert instead of failing the bundle (and, after
+	// retries, the pipeline). Skipped records are counted in the "pbeam/malformed_records" metric
+	// and output in PrivacySpec.DeadLetters. Skipping records doesn't affect the privacy guarantees
+	// of the aggregations, but it does affect their accuracy, so monitor the metric. Optional.
+	SkipMalformedRecords bool
+	// If CompressValues is set, the encoded values that DistinctPerKey collects for each privacy unit
+	// and partition are compressed with DEFLATE when they are shuffled. This trades CPU for fewer
+	// shuffled bytes, which is worth it in pipelines with large value types. Optional.
+	CompressValues bool
+	// If DeferValidationErrors is set, aggregations on PrivatePCollections using this PrivacySpec
+	// whose parameters are invalid, or whose budget can't be consumed, don't stop the program during
+	// pipeline construction. Instead, they return a PCollection that fails the pipeline when it is
+	// executed, with the validation error. This is useful for pipelines launched from templates,
+	// whose parameters are only known at execution. The deferred errors are also returned by
+	// PrivacySpec.ValidationErrors. Optional.
+	DeferValidationErrors bool
+	// If NoiseSeedKey is set, Count and SumPerKey derive the noise of each partition
+	// deterministically from NoiseSeedKey and the partition key (using HMAC-SHA256), instead of
+	// drawing it from a cryptographically secure random number generator. Runners that re-execute
+	// bundles, e.g. after a worker failure, then output the same noisy value for a partition, so
+	// at-least-once sinks can't publish two different noisy values for it. This matters because
+	// two independently noised values of the same partition leak more than the privacy budget.
+	//
+	// This comes with trade-offs:
+	//   - NoiseSeedKey must be at least 32 uniformly random bytes, generated for each pipeline run
+	//     and kept secret: anyone who knows it can remove the noise. It is serialized in the DoFns of
+	//     the pipeline, so anyone with access to the pipeline graph can read it.
+	//   - NoiseSeedKey must never be reused across runs: noise derived from the same key for the same
+	//     partition cancels out when comparing the outputs of both runs.
+	//   - Noise is added in a separate DoFn after combining, which is slightly slower.
+	//   - Private partition selection remains randomized: a re-executed bundle may keep a partition
+	//     that the first execution dropped or vice versa, but it never outputs a different value.
+	//   - Other aggregations adding noise, and the LongTail and Total options of Count and
+	//     SumPerKey, don't support NoiseSeedKey and fail at pipeline construction if it is set.
+	//
+	// Optional.
+	NoiseSeedKey []byte
+	// If PrivacyIDSalt is set, aggregations replace the encoded privacy identifiers by their
+	// HMAC-SHA256 keyed with PrivacyIDSalt before shuffling them, so that the intermediate data
+	// persisted by the runner during contribution bounding can't be joined with the shuffled data
+	// of other runs (or with other datasets) on privacy identifiers. Outputs are unaffected.
+	//
+	// PrivacyIDSalt must be at least 32 uniformly random bytes, generated for each pipeline run and
+	// kept secret. Like NoiseSeedKey, it is serialized in the DoFns of the pipeline. Salting applies
+	// to Count, SumPerKey, MeanPerKey, QuantilesPerKey, StandardDeviationPerKey, SkewnessPerKey,
+	// KurtosisPerKey, ModePerKey, AggregatePerKey, ProportionPerKey and
+	// MeanPerKeyFromClientAggregates;
+	// aggregations that decode privacy identifiers after shuffling them, such as DistinctPerKey,
+	// don't salt them. Optional.
+	PrivacyIDSalt []byte
+	// MaxReleasesPerPartition is the maximum number of times a noisy value of the same partition
+	// may be released by an aggregation, e.g. because a runner with speculative execution or
+	// at-least-once sinks publishes the outputs of several executions of the same bundle, each
+	// with independently drawn noise. Releasing r independently noised values with budget (ε,δ)
+	// is (rε,rδ)-DP, so if MaxReleasesPerPartition is set to r > 1, aggregations and partition
+	// selection use r times less budget than they consume from the PrivacySpec: the consumed budget
+	// covers the worst case where every partition is released r times.
+	//
+	// The inflation is reported in BudgetUsage and logged whenever budget is consumed. Use this on
+	// runners where exactly-once extraction can't be guaranteed and NoiseSeedKey can't be used.
+	// Defaults to 1, i.e. no inflation. Optional.
+	MaxReleasesPerPartition int
+	// Policy holds limits on the privacy parameters set by the application, e.g. to warn if ε > 2
+	// or fail if δ > 1e-5. NewPrivacySpec checks the total budget of the PrivacySpec against the
+	// limits on checks.EpsilonParameter and checks.DeltaParameter, and the budgets of its fields
+	// against the limits on "AggregationEpsilon", "AggregationDelta", "PartitionSelectionEpsilon"
+	// and "PartitionSelectionDelta". Violations of limits with checks.SeverityError make
+	// NewPrivacySpec return an error. Optional.
+	Policy *checks.Policy
+	// OnAggregationRegistered is invoked during pipeline construction whenever an aggregation on
+	// a PrivatePCollection using this PrivacySpec is added to the pipeline, with the budget it uses.
+	// Together with OnBudgetConsumed, this lets frameworks embedding pbeam mirror the budget state
+	// of the PrivacySpec in their own control planes. Aggregations built on top of other
+	// aggregations, e.g. MeanDifferencePerKey, are reported as the aggregations they use. Optional.
+	OnAggregationRegistered func(AggregationRegisteredEvent)
+	// OnBudgetConsumed is invoked during pipeline construction whenever budget is consumed from the
+	// aggregation or partition selection budget of this PrivacySpec, after BudgetAlarms crossed by
+	// this consumption. Optional.
+	OnBudgetConsumed func(BudgetConsumedEvent)
+	// BudgetState is a token returned by PrivacySpec.ExportBudgetState in a previous program
+	// sharing the budget of this PrivacySpec. The aggregation and partition selection budgets must
+	// be the same as those of the PrivacySpec that exported it; only the budget remaining in the
+	// token is then available to aggregations. BudgetStateKey must be the key that signed the
+	// token. Optional.
+	BudgetState    []byte
+	BudgetStateKey []byte
+	// PartitionSelector is the private partition selection mechanism used by aggregations on
+	// PrivatePCollections using this PrivacySpec, e.g. to experiment with alternative mechanisms.
+	// Defaults to PreAggPartitionSelector{}. Optional.
+	PartitionSelector PartitionSelector
+	// BudgetMiddleware intercepts the requests of aggregations to get or consume the aggregation or
+	// partition selection budget of this PrivacySpec, e.g. to log them, to give aggregations less
+	// budget than they request, or to also consume the budget from a remote accountant. The first
+	// middleware is the outermost one, i.e. it sees requests first. Optional.
+	BudgetMiddleware []BudgetMiddleware
+}
+
+// BudgetType identifies one of the two privacy budgets of a PrivacySpec.
+type BudgetType int
+
+const (
+	// AggregationBudget is the budget reserved for aggregations.
+	AggregationBudget BudgetType = iota
+	// PartitionSelectionBudget is the budget reserved for partition selection.
+	PartitionSelectionBudget
+)
+
+func (bt BudgetType) String() string {
+	switch bt {
+	case AggregationBudget:
+		return "aggregation budget"
+	case PartitionSelectionBudget:
+		return "partition selection budget"
+	default:
+		return fmt.Sprintf("unknown budget type %d", int(bt))
+	}
 }
+
+// BudgetAlarm specifies a callback that is invoked when the fraction of a privacy budget consumed
+// crosses a threshold.
+type BudgetAlarm struct {
+	// Fraction of the budget, in (0, 1]. The consumed fraction of a budget is the largest of the
+	// consumed fractions of its ε and δ.
+	Threshold float64
+	// Callback is invoked at most once per budget, right after the consumption that made the consumed
+	// fraction reach or exceed Threshold. It is called during pipeline construction, not while the
+	// pipeline is running.
+	Callback func(BudgetAlarmEvent)
+}
+
+// BudgetAlarmEvent describes the state of a privacy budget when a BudgetAlarm is invoked.
+type BudgetAlarmEvent struct {
+	Budget    BudgetType
+	Threshold float64
+	// Budget consumed so far and total budget.
+	ConsumedEpsilon, ConsumedDelta float64
+	TotalEpsilon, TotalDelta       float64
+}
+
+// AggregationRegisteredEvent describes an aggregation added to a pipeline.
+type AggregationRegisteredEvent struct {
+	// Name of the aggregation, e.g. "Count" or "SumPerKey".
+	Aggregation string
+	// Budget used by the aggregation. The partition selection budget is 0 if the aggregation uses
+	// public partitions.
+	AggregationEpsilon, AggregationDelta               float64
+	PartitionSelectionEpsilon, PartitionSelectionDelta float64
+	// Derivation of AggregationEpsilon from an accuracy target, for aggregations whose budget is
+	// chosen automatically, e.g. CountPerKeyWithAccuracy. Nil for other aggregations.
+	Accuracy *AccuracyDerivation
+}
+
+// BudgetConsumedEvent describes a consumption of a privacy budget of a PrivacySpec.
+type BudgetConsumedEvent struct {
+	// Budget used by the aggregation consuming it. The budget charged to the PrivacySpec is larger
+	// if Usage.Inflation > 1.
+	Epsilon, Delta float64
+	// Usage of the budget after this consumption.
+	Usage BudgetUsage
+}
+
+// BudgetUsage describes how much of a privacy budget of a PrivacySpec has been consumed.
+type BudgetUsage struct {
+	Budget BudgetType
+	// Budget consumed so far and total budget.
+	ConsumedEpsilon, ConsumedDelta float64
+	TotalEpsilon, TotalDelta       float64
+	// Factor by which the budget used by aggregations is inflated when consumed, see
+	// PrivacySpecParams.MaxReleasesPerPartition.
+	Inflation float64
+}
+
+// BudgetUsage returns the usage of the aggregation and partition selection budgets of the
+// PrivacySpec, in this order. Budgets are consumed during pipeline construction: once the pipeline
+// is constructed, this is the budget consumed by each run of the pipeline. This can be used e.g. to
+// export budget consumption to monitoring systems.
+func (ps *PrivacySpec) BudgetUsage() []BudgetUsage {
+	return []BudgetUsage{ps.aggregationBudget.usage(), ps.partitionSelectionBudget.usage()}
+}
+
 type privacyBudget struct {
 	// Epsilon/Delta (ε,δ) budget available.
 	epsilon, delta    float64
 	partiallyConsumed bool       // Whether some budget has already been consumed from this privacy budget.
 	mux               sync.Mutex // To avoid race conditions on epsilon & delta.
+
+	// Number of times a partition may be released, by which consumed budgets are multiplied.
+	maxReleasesPerPartition int
+
+	// Fields used for budget alarms.
+	budgetType               BudgetType
+	totalEpsilon, totalDelta float64
+	alarms                   []BudgetAlarm
+	firedAlarms              []bool
+	onConsumed               func(BudgetConsumedEvent)
+
+	// Middleware intercepting the budget requests, outermost first.
+	middleware []BudgetMiddleware
+
+	// Recorders of the budget charged to this privacy budget, see startRecording.
+	recorders []*budgetRecorder
+}
+
+// budgetRecorder sums the budget charged to a privacyBudget while it is recording.
+type budgetRecorder struct {
+	epsilon, delta float64
+}
+
+func newPrivacyBudget(budgetType BudgetType, epsilon, delta float64, maxReleasesPerPartition int, alarms []BudgetAlarm, onConsumed func(BudgetConsumedEvent), middleware []BudgetMiddleware) *privacyBudget {
+	return &privacyBudget{
+		epsilon:                 epsilon,
+		delta:                   delta,
+		maxReleasesPerPartition: maxReleasesPerPartition,
+		budgetType:              budgetType,
+		totalEpsilon:            epsilon,
+		totalDelta:              delta,
+		alarms:                  alarms,
+		firedAlarms:             make([]bool, len(alarms)),
+		onConsumed:              onConsumed,
+		middleware:              middleware,
+	}
 }
 
 // consumes a differential privacy budget (ε,δ) from a PrivacySpec. If epsilon and delta are 0,
 // it consumes the entire budget, which is only possible if this is the first time its budget is consumed.
+// The request goes through the BudgetMiddleware of the PrivacySpec, if any.
 //
 // Returns the budget consumed.
 func (budget *privacyBudget) consume(epsilon, delta float64) (eps, del float64, err error) {
+	return budget.request(BudgetRequest{Budget: budget.budgetType, Epsilon: epsilon, Delta: delta})
+}
+
+// consumeDirect is like consume, but bypasses the BudgetMiddleware of the PrivacySpec.
+func (budget *privacyBudget) consumeDirect(epsilon, delta float64) (eps, del float64, err error) {
 	budget.mux.Lock()
-	defer budget.mux.Unlock()
-	eps, del, err = budget.getThreadUnsafe(epsilon, delta)
-	budget.epsilon = budget.epsilon - eps
-	budget.delta = budget.delta - del
+	eps, del, chargedEps, chargedDel, err := budget.getThreadUnsafe(epsilon, delta)
+	budget.epsilon = budget.epsilon - chargedEps
+	budget.delta = budget.delta - chargedDel
 	budget.partiallyConsumed = true
+	if err == nil {
+		for _, r := range budget.recorders {
+			r.epsilon += chargedEps
+			r.delta += chargedDel
+		}
+	}
+	if err == nil && budget.inflation() > 1 {
+		log.Infof("consumed epsilon=%f and delta=%e from the %v, i.e. %v times the budget used (epsilon=%f and delta=%e), to account for up to %d releases per partition",
+			chargedEps, chargedDel, budget.budgetType, budget.inflation(), eps, del, budget.maxReleasesPerPartition)
+		dpagg.Log(dpagg.LogEntry{
+			Level:   dpagg.LogInfo,
+			Source:  "pbeam.PrivacySpec",
+			Message: fmt.Sprintf("consumed an inflated %v to account for repeated releases per partition", budget.budgetType),
+			Params: map[string]float64{
+				"ChargedEpsilon":          chargedEps,
+				"ChargedDelta":            chargedDel,
+				"Epsilon":                 eps,
+				"Delta":                   del,
+				"MaxReleasesPerPartition": float64(budget.maxReleasesPerPartition),
+			},
+		})
+	}
+	events := budget.triggeredAlarmsThreadUnsafe()
+	budget.mux.Unlock()
+	// Callbacks are invoked without holding the lock.
+	for i, event := range events {
+		if event != nil {
+			budget.alarms[i].Callback(*event)
+		}
+	}
+	if err == nil && budget.onConsumed != nil {
+		budget.onConsumed(BudgetConsumedEvent{Epsilon: eps, Delta: del, Usage: budget.usage()})
+	}
 	return eps, del, err
 }
 
+// startRecording records the budget charged to this privacy budget, including its inflation,
+// until the returned function is called, which returns the recorded budget. Recordings may be
+// nested.
+func (budget *privacyBudget) startRecording() (stop func() (epsilon, delta float64)) {
+	r := &budgetRecorder{}
+	budget.mux.Lock()
+	budget.recorders = append(budget.recorders, r)
+	budget.mux.Unlock()
+	return func() (epsilon, delta float64) {
+		budget.mux.Lock()
+		defer budget.mux.Unlock()
+		for i, other := range budget.recorders {
+			if other == r {
+				budget.recorders = append(budget.recorders[:i], budget.recorders[i+1:]...)
+				break
+			}
+		}
+		return r.epsilon, r.delta
+	}
+}
+
+// usage returns the budget consumed so far and the total budget.
+func (budget *privacyBudget) usage() BudgetUsage {
+	budget.mux.Lock()
+	defer budget.mux.Unlock()
+	return BudgetUsage{
+		Budget:          budget.budgetType,
+		ConsumedEpsilon: budget.totalEpsilon - budget.epsilon,
+		ConsumedDelta:   budget.totalDelta - budget.delta,
+		TotalEpsilon:    budget.totalEpsilon,
+		TotalDelta:      budget.totalDelta,
+		Inflation:       budget.inflation(),
+	}
+}
+
+// triggeredAlarmsThreadUnsafe marks the alarms whose threshold has been crossed as fired, and
+// returns the corresponding events, indexed like budget.alarms (nil for alarms that aren't
+// triggered).
+func (budget *privacyBudget) triggeredAlarmsThreadUnsafe() []*BudgetAlarmEvent {
+	if len(budget.alarms) == 0 {
+		return nil
+	}
+	consumedEpsilon := budget.totalEpsilon - budget.epsilon
+	consumedDelta := budget.totalDelta - budget.delta
+	var fraction float64
+	if budget.totalEpsilon > 0 {
+		fraction = consumedEpsilon / budget.totalEpsilon
+	}
+	if budget.totalDelta > 0 {
+		fraction = math.Max(fraction, consumedDelta/budget.totalDelta)
+	}
+	events := make([]*BudgetAlarmEvent, len(budget.alarms))
+	for i, alarm := range budget.alarms {
+		// Budgets consumed up to a rounding error are considered fully consumed.
+		if budget.firedAlarms[i] || fraction < alarm.Threshold-1/eqBudgetRelTol {
+			continue
+		}
+		budget.firedAlarms[i] = true
+		events[i] = &BudgetAlarmEvent{
+			Budget:          budget.budgetType,
+			Threshold:       alarm.Threshold,
+			ConsumedEpsilon: consumedEpsilon,
+			ConsumedDelta:   consumedDelta,
+			TotalEpsilon:    budget.totalEpsilon,
+			TotalDelta:      budget.totalDelta,
+		}
+	}
+	return events
+}
+
 // get computes the differential privacy budget (ε,δ) to consume from a PrivacySpec.If epsilon and
 // delta are 0, it gets the entire available budget, which is only possible if this is the first
 // time its budget is to be consumed.
 //
 // Returns the budget to consume.
 //
-// Warning: use consumeBudget to actually consume the budget.
+// Warning: use consume to actually consume the budget.
 func (budget *privacyBudget) get(epsilon, delta float64) (eps, del float64, err error) {
+	return budget.request(BudgetRequest{Budget: budget.budgetType, Epsilon: epsilon, Delta: delta, DryRun: true})
+}
+
+// getDirect is like get, but bypasses the BudgetMiddleware of the PrivacySpec.
+func (budget *privacyBudget) getDirect(epsilon, delta float64) (eps, del float64, err error) {
 	budget.mux.Lock()
 	defer budget.mux.Unlock()
-	return budget.getThreadUnsafe(epsilon, delta)
+	eps, del, _, _, err = budget.getThreadUnsafe(epsilon, delta)
+	return eps, del, err
 }
 
 // getThreadUnsafe is not thread-safe and should not be used directly. Instead, use get or consume.
-func (budget *privacyBudget) getThreadUnsafe(epsilon, delta float64) (eps, del float64, err error) {
+//
+// Returns the budget to use and the budget to charge for it, which is larger than the budget to use
+// if the budget is inflated to account for retried bundles.
+func (budget *privacyBudget) getThreadUnsafe(epsilon, delta float64) (eps, del, chargedEps, chargedDel float64, err error) {
+	inflation := budget.inflation()
 	if epsilon == 0 && delta == 0 {
-		return budget.getEntireBudget()
+		chargedEps, chargedDel, err = budget.getEntireBudget()
+	} else {
+		chargedEps, chargedDel, err = budget.getPartialBudget(epsilon*inflation, delta*inflation)
 	}
-	return budget.getPartialBudget(epsilon, delta)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return chargedEps / inflation, chargedDel / inflation, chargedEps, chargedDel, nil
+}
+
+// inflation returns the factor by which the budget used by aggregations is multiplied when charged
+// to this privacy budget. See PrivacySpecParams.MaxReleasesPerPartition.
+func (budget *privacyBudget) inflation() float64 {
+	if budget.maxReleasesPerPartition > 1 {
+		return float64(budget.maxReleasesPerPartition)
+	}
+	return 1
 }
 
 func (budget *privacyBudget) getEntireBudget() (eps, del float64, err error) {
@@ -255,10 +646,22 @@ func (budget *privacyBudget) getEntireBudget() (eps, del float64, err error) {
 func (budget *privacyBudget) getPartialBudget(epsilon, delta float64) (eps, del float64, err error) {
 	if budgetSlightlyTooLarge(budget.epsilon, epsilon) {
 		log.Infof("corrected rounding error for epsilon budget allocation (requested: %f, available: %f, difference: %e)", epsilon, budget.epsilon, epsilon-budget.epsilon)
+		dpagg.Log(dpagg.LogEntry{
+			Level:   dpagg.LogInfo,
+			Source:  "pbeam.PrivacySpec",
+			Message: "corrected rounding error for epsilon budget allocation",
+			Params:  map[string]float64{"RequestedEpsilon": epsilon, "AvailableEpsilon": budget.epsilon},
+		})
 		epsilon = budget.epsilon
 	}
 	if budgetSlightlyTooLarge(budget.delta, delta) {
 		log.Infof("corrected rounding error for delta budget allocation (requested: %e, available: %e, difference: %e)", delta, budget.delta, delta-budget.delta)
+		dpagg.Log(dpagg.LogEntry{
+			Level:   dpagg.LogInfo,
+			Source:  "pbeam.PrivacySpec",
+			Message: "corrected rounding error for delta budget allocation",
+			Params:  map[string]float64{"RequestedDelta": delta, "AvailableDelta": budget.delta},
+		})
 		delta = budget.delta
 	}
 	if budget.epsilon < epsilon || budget.delta < delta {
@@ -301,6 +704,22 @@ func (ln LaplaceNoise) toNoiseKind() noise.Kind {
 	return noise.LaplaceNoise
 }
 
+// CustomNoise is an aggregations param that makes them use a custom noise
+// mechanism, registered with noise.Register. The registration declares whether
+// the mechanism consumes δ, which determines whether the AggregationDelta of the
+// aggregations using it must be 0 like with LaplaceNoise, or positive like with
+// GaussianNoise.
+//
+// Since noise is added on Beam workers, the mechanism must also be registered
+// with the same noise.Kind in the worker binaries, e.g. in an init function.
+type CustomNoise struct {
+	Kind noise.Kind
+}
+
+func (cn CustomNoise) toNoiseKind() noise.Kind {
+	return cn.Kind
+}
+
 // NewPrivacySpec creates a new PrivacySpec with the specified privacy budget
 // and parameters.
 //
@@ -340,12 +759,133 @@ func NewPrivacySpec(params PrivacySpecParams) (*PrivacySpec, error) {
 		return nil, fmt.Errorf("PartitionSelectionDelta must be set to a positive value whenever PartitionSelectionEpsilon is set. "+
 			"PartitionSelectionEpsilon is currently set to (%f)", params.PartitionSelectionEpsilon)
 	}
-	return &PrivacySpec{
-		aggregationBudget:        &privacyBudget{epsilon: params.AggregationEpsilon, delta: params.AggregationDelta},
-		partitionSelectionBudget: &privacyBudget{epsilon: params.PartitionSelectionEpsilon, delta: params.PartitionSelectionDelta},
+	if params.ForbidNoiseKindOverride && params.NoiseKind == nil {
+		return nil, fmt.Errorf("NoiseKind must be set when ForbidNoiseKindOverride is set")
+	}
+	if params.NoiseSeedKey != nil && len(params.NoiseSeedKey) < minNoiseSeedKeyLength {
+		return nil, fmt.Errorf("NoiseSeedKey must be at least %d bytes long, got %d bytes", minNoiseSeedKeyLength, len(params.NoiseSeedKey))
+	}
+	if params.PrivacyIDSalt != nil && len(params.PrivacyIDSalt) < minPrivacyIDSaltLength {
+		return nil, fmt.Errorf("PrivacyIDSalt must be at least %d bytes long, got %d bytes", minPrivacyIDSaltLength, len(params.PrivacyIDSalt))
+	}
+	if params.MaxReleasesPerPartition < 0 {
+		return nil, fmt.Errorf("MaxReleasesPerPartition must be non-negative, got %d", params.MaxReleasesPerPartition)
+	}
+	if err := checkPolicy(params); err != nil {
+		return nil, err
+	}
+	for i, alarm := range params.BudgetAlarms {
+		if !(alarm.Threshold > 0 && alarm.Threshold <= 1) {
+			return nil, fmt.Errorf("BudgetAlarms[%d]: Threshold must be in (0, 1], got %f", i, alarm.Threshold)
+		}
+		if alarm.Callback == nil {
+			return nil, fmt.Errorf("BudgetAlarms[%d]: Callback must be set", i)
+		}
+	}
+	for i, middleware := range params.BudgetMiddleware {
+		if middleware == nil {
+			return nil, fmt.Errorf("BudgetMiddleware[%d] must not be nil", i)
+		}
+	}
+	partitionSelector, err := newEncodedPartitionSelector(params.PartitionSelector)
+	if err != nil {
+		return nil, fmt.Errorf("PartitionSelector: %v", err)
+	}
+	var seed *noiseSeed
+	if params.NoiseSeedKey != nil {
+		seed = &noiseSeed{key: append([]byte(nil), params.NoiseSeedKey...)}
+	}
+	spec := &PrivacySpec{
+		aggregationBudget:        newPrivacyBudget(AggregationBudget, params.AggregationEpsilon, params.AggregationDelta, params.MaxReleasesPerPartition, params.BudgetAlarms, params.OnBudgetConsumed, params.BudgetMiddleware),
+		partitionSelectionBudget: newPrivacyBudget(PartitionSelectionBudget, params.PartitionSelectionEpsilon, params.PartitionSelectionDelta, params.MaxReleasesPerPartition, params.BudgetAlarms, params.OnBudgetConsumed, params.BudgetMiddleware),
 		preThreshold:             params.PreThreshold,
 		testMode:                 params.TestMode,
-	}, nil
+		noiseKind:                params.NoiseKind,
+		forbidNoiseKindOverride:  params.ForbidNoiseKindOverride,
+		traceStages:              params.TraceStages,
+		skipMalformedRecords:     params.SkipMalformedRecords,
+		compressValues:           params.CompressValues,
+		deferValidationErrors:    params.DeferValidationErrors,
+		validationErrors:         &validationErrorSink{},
+		deadLetters:              &deadLetterSink{},
+		noiseSeed:                seed,
+		privacyIDSalt:            append([]byte(nil), params.PrivacyIDSalt...),
+		onAggregationRegistered:  params.OnAggregationRegistered,
+		partitionSelector:        partitionSelector,
+	}
+	if params.BudgetState != nil {
+		if err := restoreBudgetState(spec, params.BudgetState, params.BudgetStateKey); err != nil {
+			return nil, fmt.Errorf("BudgetState: %v", err)
+		}
+	}
+	return spec, nil
+}
+
+// checkPolicy checks the budgets of params against params.Policy.
+func checkPolicy(params PrivacySpecParams) error {
+	if err := params.Policy.Validate(); err != nil {
+		return fmt.Errorf("Policy: %v", err)
+	}
+	for _, p := range []struct {
+		name  string
+		value float64
+	}{
+		{checks.EpsilonParameter, params.AggregationEpsilon + params.PartitionSelectionEpsilon},
+		{checks.DeltaParameter, params.AggregationDelta + params.PartitionSelectionDelta},
+		{"AggregationEpsilon", params.AggregationEpsilon},
+		{"AggregationDelta", params.AggregationDelta},
+		{"PartitionSelectionEpsilon", params.PartitionSelectionEpsilon},
+		{"PartitionSelectionDelta", params.PartitionSelectionDelta},
+	} {
+		if err := params.Policy.Check(p.name, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNoiseKind returns the noise to use for an aggregation with the given
+// NoiseKind parameter (which may be nil), according to the PrivacySpec.
+func (ps *PrivacySpec) getNoiseKind(requested NoiseKind) (noise.Kind, error) {
+	if requested == nil {
+		if ps.noiseKind == nil {
+			log.Infof("No NoiseKind specified, using Laplace Noise by default.")
+			dpagg.Log(dpagg.LogEntry{Level: dpagg.LogInfo, Source: "pbeam.PrivacySpec", Message: "no NoiseKind specified, using Laplace noise by default"})
+			return noise.LaplaceNoise, nil
+		}
+		requested = ps.noiseKind
+	} else if ps.forbidNoiseKindOverride && requested.toNoiseKind() != ps.noiseKind.toNoiseKind() {
+		return noise.Unrecognised, fmt.Errorf("NoiseKind is %v, but the PrivacySpec forbids using a NoiseKind other than %v", requested.toNoiseKind(), ps.noiseKind.toNoiseKind())
+	}
+	k := requested.toNoiseKind()
+	if noise.Consumption(k) == noise.UnspecifiedConsumption {
+		return noise.Unrecognised, fmt.Errorf("NoiseKind %v is neither GaussianNoise, LaplaceNoise, nor a CustomNoise registered with noise.Register", requested)
+	}
+	return k, nil
+}
+
+// aggregationRegistered invokes the OnAggregationRegistered hook of the
+// PrivacySpec, if any. Aggregations call it once their budget is known and their
+// parameters are checked.
+func (ps *PrivacySpec) aggregationRegistered(aggregation string, aggregationEpsilon, aggregationDelta, partitionSelectionEpsilon, partitionSelectionDelta float64) {
+	ps.aggregationRegisteredWithAccuracy(aggregation, nil, aggregationEpsilon, aggregationDelta, partitionSelectionEpsilon, partitionSelectionDelta)
+}
+
+// aggregationRegisteredWithAccuracy is like aggregationRegistered, for
+// aggregations whose aggregation budget was derived from an accuracy target as
+// described by derivation, if it isn't nil.
+func (ps *PrivacySpec) aggregationRegisteredWithAccuracy(aggregation string, derivation *AccuracyDerivation, aggregationEpsilon, aggregationDelta, partitionSelectionEpsilon, partitionSelectionDelta float64) {
+	if ps.onAggregationRegistered == nil {
+		return
+	}
+	ps.onAggregationRegistered(AggregationRegisteredEvent{
+		Aggregation:               aggregation,
+		AggregationEpsilon:        aggregationEpsilon,
+		AggregationDelta:          aggregationDelta,
+		PartitionSelectionEpsilon: partitionSelectionEpsilon,
+		PartitionSelectionDelta:   partitionSelectionDelta,
+		Accuracy:                  derivation,
+	})
 }
 
 // A PrivatePCollection embeds a PCollection, associating each element to a
@@ -373,6 +913,11 @@ type PrivatePCollection struct {
 	codec *kv.Codec
 	// Privacy budget and parameters attached to this PrivatePCollection
 	privacySpec *PrivacySpec
+	// Functions passed to ParDo to obtain this PrivatePCollection, checked by
+	// CheckRegistrations.
+	doFns []any
+	// Names of the exclusion lists applied with ExcludePrivacyUnits.
+	exclusionLists []string
 }
 
 // MakePrivate transforms a PCollection<K,V> into a PrivatePCollection<V>,
@@ -404,6 +949,25 @@ func MakePrivate(_ beam.Scope, col beam.PCollection, spec *PrivacySpec) PrivateP
 // If col is a PCollection of exampleStruct1, you could use "IntField" or
 // "StructField.StringField" as idFieldPath.
 //
+// # Struct tags
+//
+// If idFieldPath is empty, the privacy key is the top-level field with the
+// `pbeam:"privacy_id"` tag. Fields can also be tagged with `pbeam:"partition"`
+// and `pbeam:"value"`: aggregations on a PrivatePCollection of such structs
+// then use these fields as the partition key and the value, as if the
+// PrivatePCollection had been transformed with ExtractStructFields first.
+// For example:
+//
+//	type visit struct {
+//	  VisitorID string  `pbeam:"privacy_id"`
+//	  Day       int     `pbeam:"partition"`
+//	  Duration  float64 `pbeam:"value"`
+//	}
+//
+//	pcol := pbeam.MakePrivateFromStruct(s, visits, spec, "")
+//	means := pbeam.MeanPerKey(s, pcol, meanParams) // Mean Duration per Day.
+//	counts := pbeam.Count(s, pcol, countParams)    // Number of visits per Day.
+//
 // # Caution
 //
 // The privacy key field must be a simple type (e.g. int, string, etc.), or
@@ -425,6 +989,16 @@ func MakePrivateFromStruct(s beam.Scope, col beam.PCollection, spec *PrivacySpec
 	if msgType.Kind() != reflect.Struct {
 		log.Fatalf("MakePrivateFromStruct: PCollection col=%v must be composed of structs", col)
 	}
+	if idFieldPath == "" {
+		var err error
+		idFieldPath, err = taggedStructField(msgType, privacyIDTag)
+		if err != nil {
+			log.Fatalf("MakePrivateFromStruct: %v", err)
+		}
+		if idFieldPath == "" {
+			log.Fatalf("MakePrivateFromStruct: idFieldPath is empty and %v has no field tagged `%s:%q`", msgType, structTagKey, privacyIDTag)
+		}
+	}
 	extractFn := &extractStructFieldFn{IDFieldPath: idFieldPath}
 	return PrivatePCollection{
 		col:         beam.ParDo(s, extractFn, col),
@@ -448,11 +1022,17 @@ func (ext *extractStructFieldFn) ProcessElement(v beam.V) (string, beam.V, error
 // getIDField retrieves the ID field (specified by the IDFieldPath) from
 // struct or pointer to a struct s.
 func (ext *extractStructFieldFn) getIDField(s any) (any, error) {
-	subFieldNames := strings.Split(ext.IDFieldPath, ".")
+	return getStructField(s, ext.IDFieldPath)
+}
+
+// getStructField retrieves the field specified by fieldPath from struct or
+// pointer to a struct s.
+func getStructField(s any, fieldPath string) (any, error) {
+	subFieldNames := strings.Split(fieldPath, ".")
 	subField := reflect.ValueOf(s)
 	var subFieldPath bytes.Buffer
 	for _, subFieldName := range subFieldNames {
-		subField = ext.getPointedValue(subField) // Retrieve the pointed value if subField is a pointer, no-op otherwise.
+		subField = getPointedValue(subField) // Retrieve the pointed value if subField is a pointer, no-op otherwise.
 		if subField.Kind() != reflect.Struct {
 			return nil, fmt.Errorf("%s (%v) should be a struct or a pointer to a struct", subFieldPath.String(), subField.Kind())
 		}
@@ -462,8 +1042,8 @@ func (ext *extractStructFieldFn) getIDField(s any) (any, error) {
 			return nil, fmt.Errorf("no such field %s (%v) in s", subFieldPath.String(), subField.Kind())
 		}
 	}
-	subField = ext.getPointedValue(subField) // Retrieve the  pointed value if subField is a pointer, no-op otherwise.
-	if err := ext.checkSimpleType(subField); err != nil {
+	subField = getPointedValue(subField) // Retrieve the  pointed value if subField is a pointer, no-op otherwise.
+	if err := checkSimpleType(subField); err != nil {
 		return nil, err
 	}
 	// TODO Set the ID field to default value.
@@ -473,7 +1053,7 @@ func (ext *extractStructFieldFn) getIDField(s any) (any, error) {
 // getPointedValue returns the value pointed by v if v is a pointer. If v is nil,
 // it returns the default value for the type pointed by v. If v is not a pointer,
 // it returns v.
-func (ext *extractStructFieldFn) getPointedValue(v reflect.Value) reflect.Value {
+func getPointedValue(v reflect.Value) reflect.Value {
 	zeroVal := reflect.Value{}
 	if reflect.Indirect(v) != zeroVal {
 		return reflect.Indirect(v)
@@ -481,7 +1061,7 @@ func (ext *extractStructFieldFn) getPointedValue(v reflect.Value) reflect.Value
 	return reflect.Zero(v.Type().Elem())
 }
 
-func (ext *extractStructFieldFn) checkSimpleType(v reflect.Value) error {
+func checkSimpleType(v reflect.Value) error {
 	switch v.Kind() {
 	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint,
 		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64,
@@ -613,3 +1193,151 @@ func (fn *dropValueFn) ProcessElement(id beam.U, kv kv.Pair) (beam.U, beam.W, er
 	k, _, err := fn.Codec.Decode(kv)
 	return id, k, err
 }
+
+// ExtractStructFields transforms a PrivatePCollection<T>, where T is a struct
+// or a pointer to a struct, into a PrivatePCollection<K,V>, where K and V are
+// the fields of T specified by keyFieldPath and valueFieldPath. If
+// valueFieldPath is empty, it returns a PrivatePCollection<K> instead.
+//
+// Field paths have the same format as the idFieldPath of
+// MakePrivateFromStruct, and the same caveats apply: fields must be simple
+// types (e.g. int, string, etc.), or pointers to simple types, and unset
+// fields are replaced by their default value.
+func ExtractStructFields(s beam.Scope, pcol PrivatePCollection, keyFieldPath, valueFieldPath string) PrivatePCollection {
+	s = s.Scope("pbeam.ExtractStructFields")
+	_, structT := beam.ValidateKVType(pcol.col)
+	keyT, err := structFieldType(structT.Type(), keyFieldPath)
+	if err != nil {
+		log.Fatalf("ExtractStructFields: invalid key field: %v", err)
+	}
+	if valueFieldPath == "" {
+		pcol.col = beam.ParDo(s, &extractStructKeyFn{KeyFieldPath: keyFieldPath}, pcol.col, beam.TypeDefinition{Var: beam.WType, T: keyT})
+		pcol.codec = nil
+		return pcol
+	}
+	valueT, err := structFieldType(structT.Type(), valueFieldPath)
+	if err != nil {
+		log.Fatalf("ExtractStructFields: invalid value field: %v", err)
+	}
+	pcol.codec = kv.NewCodec(keyT, valueT)
+	pcol.col = beam.ParDo(s, &extractStructKVFn{KeyFieldPath: keyFieldPath, ValueFieldPath: valueFieldPath, Codec: pcol.codec}, pcol.col)
+	return pcol
+}
+
+// Struct tags understood by MakePrivateFromStruct and aggregations.
+const (
+	structTagKey = "pbeam"
+	privacyIDTag = "privacy_id"
+	partitionTag = "partition"
+	valueTag     = "value"
+)
+
+// taggedStructField returns the name of the top-level field of struct type t
+// (or of the struct pointed by t) with the `pbeam:"<tag>"` tag, or an empty
+// string if there is no such field.
+func taggedStructField(t reflect.Type, tag string) (string, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return "", nil
+	}
+	name := ""
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get(structTagKey) != tag {
+			continue
+		}
+		if name != "" {
+			return "", fmt.Errorf("fields %s and %s of %v are both tagged `%s:%q`", name, f.Name, t, structTagKey, tag)
+		}
+		name = f.Name
+	}
+	return name, nil
+}
+
+// extractTaggedStructFields transforms a PrivatePCollection<T>, where T is a
+// struct with a field tagged `pbeam:"partition"`, into a
+// PrivatePCollection<K,V> with ExtractStructFields, where V is the field
+// tagged `pbeam:"value"`; or into a PrivatePCollection<K> if withValue is
+// false. Other PrivatePCollections are returned as is.
+func extractTaggedStructFields(s beam.Scope, pcol PrivatePCollection, withValue bool) PrivatePCollection {
+	if pcol.codec != nil {
+		return pcol
+	}
+	_, structT := beam.ValidateKVType(pcol.col)
+	partitionField, err := taggedStructField(structT.Type(), partitionTag)
+	if err != nil {
+		log.Fatalf("Couldn't get partition field: %v", err)
+	}
+	if partitionField == "" {
+		return pcol
+	}
+	valueField := ""
+	if withValue {
+		valueField, err = taggedStructField(structT.Type(), valueTag)
+		if err != nil {
+			log.Fatalf("Couldn't get value field: %v", err)
+		}
+		if valueField == "" {
+			log.Fatalf("%v has a field tagged `%s:%q` but no field tagged `%s:%q`", structT, structTagKey, partitionTag, structTagKey, valueTag)
+		}
+	}
+	return ExtractStructFields(s, pcol, partitionField, valueField)
+}
+
+// structFieldType returns the type of the field specified by fieldPath in
+// struct type t, dereferencing pointers like getStructField does.
+func structFieldType(t reflect.Type, fieldPath string) (reflect.Type, error) {
+	for _, fieldName := range strings.Split(fieldPath, ".") {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("parent of %s should be a struct or a pointer to a struct, got %v", fieldName, t)
+		}
+		f, ok := t.FieldByName(fieldName)
+		if !ok {
+			return nil, fmt.Errorf("no such field %s in %v", fieldPath, t)
+		}
+		t = f.Type
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t, nil
+}
+
+type extractStructKeyFn struct {
+	KeyFieldPath string
+}
+
+func (fn *extractStructKeyFn) ProcessElement(id beam.U, v beam.V) (beam.U, beam.W, error) {
+	k, err := getStructField(v, fn.KeyFieldPath)
+	if err != nil {
+		return id, nil, fmt.Errorf("couldn't retrieve key field %s: %v", fn.KeyFieldPath, err)
+	}
+	return id, k, nil
+}
+
+type extractStructKVFn struct {
+	KeyFieldPath, ValueFieldPath string
+	Codec                        *kv.Codec
+}
+
+func (fn *extractStructKVFn) Setup() error {
+	return fn.Codec.Setup()
+}
+
+func (fn *extractStructKVFn) ProcessElement(id beam.U, v beam.V) (beam.U, kv.Pair, error) {
+	k, err := getStructField(v, fn.KeyFieldPath)
+	if err != nil {
+		return id, kv.Pair{}, fmt.Errorf("couldn't retrieve key field %s: %v", fn.KeyFieldPath, err)
+	}
+	value, err := getStructField(v, fn.ValueFieldPath)
+	if err != nil {
+		return id, kv.Pair{}, fmt.Errorf("couldn't retrieve value field %s: %v", fn.ValueFieldPath, err)
+	}
+	pair, err := fn.Codec.Encode(k, value)
+	return id, pair, err
+}
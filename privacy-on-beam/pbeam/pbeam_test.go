@@ -19,6 +19,8 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
 	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
 	testpb "github.com/google/differential-privacy/privacy-on-beam/v3/testdata"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam"
@@ -26,6 +28,7 @@ import (
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -37,6 +40,31 @@ func init() {
 	register.Function2x1[string, ComplexStruct, structPair](kvToStructPair)
 	register.Function1x2[int, int, int](addZeroIntKeyFn)
 	register.Function1x2[int, int, int](addZeroIntValueFn)
+
+	if err := noise.Register(zeroNoiseKind, noise.Mechanism{
+		Name:        "Zero",
+		New:         func() noise.Noise { return zeroNoise{noise.Laplace()} },
+		Consumption: noise.EpsilonOnly,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// zeroNoiseKind is the noise.Kind of zeroNoise.
+const zeroNoiseKind noise.Kind = 100
+
+// zeroNoise is a custom noise mechanism that doesn't add any noise. It is not
+// differentially private.
+type zeroNoise struct {
+	noise.Noise
+}
+
+func (zeroNoise) AddNoiseInt64(x, _, _ int64, _, _ float64) (int64, error) {
+	return x, nil
+}
+
+func (zeroNoise) AddNoiseFloat64(x float64, _ int64, _, _, _ float64) (float64, error) {
+	return x, nil
 }
 
 func TestNewPrivacySpec(t *testing.T) {
@@ -71,6 +99,94 @@ func TestNewPrivacySpec(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"NoiseSeedKey shorter than 32 bytes",
+			PrivacySpecParams{
+				AggregationEpsilon: 1.0,
+				NoiseSeedKey:       []byte("too short"),
+			},
+			true,
+		},
+		{
+			"PrivacyIDSalt shorter than 32 bytes",
+			PrivacySpecParams{
+				AggregationEpsilon: 1.0,
+				PrivacyIDSalt:      []byte("too short"),
+			},
+			true,
+		},
+		{
+			"negative MaxReleasesPerPartition",
+			PrivacySpecParams{
+				AggregationEpsilon:      1.0,
+				MaxReleasesPerPartition: -1,
+			},
+			true,
+		},
+		{
+			"total budget within Policy",
+			PrivacySpecParams{
+				AggregationEpsilon:        1.0,
+				PartitionSelectionEpsilon: 1.0,
+				PartitionSelectionDelta:   1e-6,
+				Policy: &checks.Policy{Limits: []checks.Limit{
+					{Parameter: checks.EpsilonParameter, Max: 2, Severity: checks.SeverityError},
+					{Parameter: checks.DeltaParameter, Max: 1e-5, Severity: checks.SeverityError},
+				}},
+			},
+			false,
+		},
+		{
+			"total budget violating Policy",
+			PrivacySpecParams{
+				AggregationEpsilon:        1.5,
+				PartitionSelectionEpsilon: 1.0,
+				PartitionSelectionDelta:   1e-6,
+				Policy: &checks.Policy{Limits: []checks.Limit{
+					{Parameter: checks.EpsilonParameter, Max: 2, Severity: checks.SeverityError},
+				}},
+			},
+			true,
+		},
+		{
+			"budget of a field violating Policy",
+			PrivacySpecParams{
+				AggregationEpsilon:        1.0,
+				PartitionSelectionEpsilon: 1.0,
+				PartitionSelectionDelta:   1e-4,
+				Policy: &checks.Policy{Limits: []checks.Limit{
+					{Parameter: "PartitionSelectionDelta", Max: 1e-5, Severity: checks.SeverityError},
+				}},
+			},
+			true,
+		},
+		{
+			"budget violating Policy with warning severity",
+			PrivacySpecParams{
+				AggregationEpsilon: 5.0,
+				Policy: &checks.Policy{
+					Limits:    []checks.Limit{{Parameter: checks.EpsilonParameter, Max: 2, Severity: checks.SeverityWarning}},
+					OnWarning: func(checks.Violation) {},
+				},
+			},
+			false,
+		},
+		{
+			"invalid Policy",
+			PrivacySpecParams{
+				AggregationEpsilon: 1.0,
+				Policy:             &checks.Policy{Limits: []checks.Limit{{Max: 1}}},
+			},
+			true,
+		},
+		{
+			"ForbidNoiseKindOverride without NoiseKind",
+			PrivacySpecParams{
+				AggregationEpsilon:      1.0,
+				ForbidNoiseKindOverride: true,
+			},
+			true,
+		},
 		{
 			"no budget is set",
 			PrivacySpecParams{},
@@ -265,6 +381,111 @@ func TestMakePrivateFromStruct(t *testing.T) {
 	}
 }
 
+func TestExtractStructFields(t *testing.T) {
+	values := []ComplexStruct{
+		{String: "0", Int: 3, SubStruct: &SimpleStruct{Int: 1}},
+		{String: "1", Int: 4, SubStruct: &SimpleStruct{Int: 1}},
+		{String: "2", Int: 5, SubStruct: &SimpleStruct{Int: 2}},
+	}
+	counts := []testutils.PairII64{{1, 2}, {2, 1}}
+	sums := []testutils.PairII64{{1, 7}, {2, 5}}
+	p, s, col, wantCounts := ptest.CreateList2(values, counts)
+	wantSums := beam.CreateList(s, sums)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1e10})
+	pcol := MakePrivateFromStruct(s, col, spec, "String")
+
+	keys := ExtractStructFields(s, pcol, "SubStruct.Int", "")
+	gotCounts := Count(s, keys, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, AggregationEpsilon: 5e9, NoiseKind: LaplaceNoise{}, PublicPartitions: []int{1, 2}})
+	kvs := ExtractStructFields(s, pcol, "SubStruct.Int", "Int")
+	gotSums := SumPerKey(s, kvs, SumParams{MinValue: 0, MaxValue: 10, MaxPartitionsContributed: 1, AggregationEpsilon: 5e9, NoiseKind: LaplaceNoise{}, PublicPartitions: []int{1, 2}})
+
+	testutils.EqualsKVInt64(t, s, gotCounts, beam.ParDo(s, testutils.PairII64ToKV, wantCounts))
+	testutils.EqualsKVInt64(t, s, gotSums, beam.ParDo(s, testutils.PairII64ToKV, wantSums))
+	if err := ptest.Run(p); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStructFieldType(t *testing.T) {
+	for _, tc := range []struct {
+		fieldPath string
+		want      reflect.Type
+		wantErr   bool
+	}{
+		{"Int", reflect.TypeOf(0), false},
+		{"StringPointer", reflect.TypeOf(""), false},
+		{"SubStruct.String", reflect.TypeOf(""), false},
+		{"Missing", nil, true},
+		{"Int.String", nil, true},
+	} {
+		got, err := structFieldType(reflect.TypeOf(ComplexStruct{}), tc.fieldPath)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("structFieldType(%s): got err=%v, wantErr=%t", tc.fieldPath, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("structFieldType(%s): got %v, want %v", tc.fieldPath, got, tc.want)
+		}
+	}
+}
+
+type taggedStruct struct {
+	ID        string `pbeam:"privacy_id"`
+	Partition int    `pbeam:"partition"`
+	Value     int64  `pbeam:"value"`
+	Other     string
+}
+
+func TestStructTags(t *testing.T) {
+	values := []taggedStruct{
+		{ID: "0", Partition: 1, Value: 3},
+		{ID: "1", Partition: 1, Value: 4},
+		{ID: "2", Partition: 2, Value: 5},
+	}
+	counts := []testutils.PairII64{{1, 2}, {2, 1}}
+	sums := []testutils.PairII64{{1, 7}, {2, 5}}
+	p, s, col, wantCounts := ptest.CreateList2(values, counts)
+	wantSums := beam.CreateList(s, sums)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1e10})
+	pcol := MakePrivateFromStruct(s, col, spec, "")
+
+	gotCounts := Count(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, AggregationEpsilon: 5e9, NoiseKind: LaplaceNoise{}, PublicPartitions: []int{1, 2}})
+	gotSums := SumPerKey(s, pcol, SumParams{MinValue: 0, MaxValue: 10, MaxPartitionsContributed: 1, AggregationEpsilon: 5e9, NoiseKind: LaplaceNoise{}, PublicPartitions: []int{1, 2}})
+
+	testutils.EqualsKVInt64(t, s, gotCounts, beam.ParDo(s, testutils.PairII64ToKV, wantCounts))
+	testutils.EqualsKVInt64(t, s, gotSums, beam.ParDo(s, testutils.PairII64ToKV, wantSums))
+	if err := ptest.Run(p); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTaggedStructField(t *testing.T) {
+	type duplicateTags struct {
+		A int `pbeam:"partition"`
+		B int `pbeam:"partition"`
+	}
+	for _, tc := range []struct {
+		desc    string
+		t       reflect.Type
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"privacy ID", reflect.TypeOf(taggedStruct{}), privacyIDTag, "ID", false},
+		{"pointer to struct", reflect.TypeOf(&taggedStruct{}), valueTag, "Value", false},
+		{"no tagged field", reflect.TypeOf(ComplexStruct{}), partitionTag, "", false},
+		{"not a struct", reflect.TypeOf(0), partitionTag, "", false},
+		{"duplicate tags", reflect.TypeOf(duplicateTags{}), partitionTag, "", true},
+	} {
+		got, err := taggedStructField(tc.t, tc.tag)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("taggedStructField with %s: got err=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("taggedStructField with %s: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
 // Tests the GetIDField method in extractStructFieldFn.
 func TestGetIDField(t *testing.T) {
 	eight := "8"
@@ -560,6 +781,356 @@ func TestBudgetRounding(t *testing.T) {
 	}
 }
 
+func TestGetNoiseKind(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		params    PrivacySpecParams
+		requested NoiseKind
+		want      noise.Kind
+		wantErr   bool
+	}{
+		{"no default, unset", PrivacySpecParams{AggregationEpsilon: 1}, nil, noise.LaplaceNoise, false},
+		{"no default, set", PrivacySpecParams{AggregationEpsilon: 1}, GaussianNoise{}, noise.GaussianNoise, false},
+		{"default, unset", PrivacySpecParams{AggregationEpsilon: 1, NoiseKind: GaussianNoise{}}, nil, noise.GaussianNoise, false},
+		{"default, overridden", PrivacySpecParams{AggregationEpsilon: 1, NoiseKind: GaussianNoise{}}, LaplaceNoise{}, noise.LaplaceNoise, false},
+		{"forbidden override, unset", PrivacySpecParams{AggregationEpsilon: 1, NoiseKind: GaussianNoise{}, ForbidNoiseKindOverride: true}, nil, noise.GaussianNoise, false},
+		{"forbidden override, same noise", PrivacySpecParams{AggregationEpsilon: 1, NoiseKind: GaussianNoise{}, ForbidNoiseKindOverride: true}, GaussianNoise{}, noise.GaussianNoise, false},
+		{"forbidden override, overridden", PrivacySpecParams{AggregationEpsilon: 1, NoiseKind: GaussianNoise{}, ForbidNoiseKindOverride: true}, LaplaceNoise{}, noise.Unrecognised, true},
+		{"registered custom noise", PrivacySpecParams{AggregationEpsilon: 1}, CustomNoise{zeroNoiseKind}, zeroNoiseKind, false},
+		{"registered custom noise by default", PrivacySpecParams{AggregationEpsilon: 1, NoiseKind: CustomNoise{zeroNoiseKind}}, nil, zeroNoiseKind, false},
+		{"unregistered custom noise", PrivacySpecParams{AggregationEpsilon: 1}, CustomNoise{zeroNoiseKind + 1}, noise.Unrecognised, true},
+	} {
+		spec := privacySpec(t, tc.params)
+		got, err := spec.getNoiseKind(tc.requested)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("getNoiseKind: with %s got err=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("getNoiseKind: with %s got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+// Checks that aggregations use the custom noise mechanisms registered with
+// noise.Register.
+func TestCustomNoise(t *testing.T) {
+	pairs := []testutils.PairII{{0, 0}, {1, 0}, {2, 1}}
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1}))
+	got := Count(s, pcol, CountParams{
+		MaxPartitionsContributed: 1,
+		MaxValue:                 1,
+		NoiseKind:                CustomNoise{zeroNoiseKind},
+		PublicPartitions:         []int{0, 1, 2},
+	})
+	want := beam.ParDo(s, testutils.PairII64ToKV, beam.CreateList(s, []testutils.PairII64{{0, 2}, {1, 1}, {2, 0}}))
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCustomNoise: Count(%v) = %v, want %v: %v", col, got, want, err)
+	}
+
+	// The declared consumption of the mechanism determines the valid deltas.
+	if err := checkAggregationDelta(0, zeroNoiseKind); err != nil {
+		t.Errorf("checkAggregationDelta(0, zeroNoiseKind): got error %v", err)
+	}
+	if err := checkAggregationDelta(1e-5, zeroNoiseKind); err == nil {
+		t.Errorf("checkAggregationDelta(1e-5, zeroNoiseKind): got no error for a mechanism not consuming delta")
+	}
+}
+
+// Tests that budget alarms are invoked once, when their threshold is crossed.
+func TestBudgetAlarms(t *testing.T) {
+	var events []BudgetAlarmEvent
+	record := func(e BudgetAlarmEvent) { events = append(events, e) }
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+		BudgetAlarms: []BudgetAlarm{
+			{Threshold: 0.5, Callback: record},
+			{Threshold: 1, Callback: record},
+		},
+	})
+
+	if _, _, err := spec.aggregationBudget.consume(0.3, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("after consuming 30%% of the aggregation budget, got events %+v, want none", events)
+	}
+	if _, _, err := spec.aggregationBudget.consume(0.3, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	want := []BudgetAlarmEvent{{Budget: AggregationBudget, Threshold: 0.5, ConsumedEpsilon: 0.6, TotalEpsilon: 1}}
+	if diff := cmp.Diff(want, events, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("after consuming 60%% of the aggregation budget, got diff (-want +got):\n%s", diff)
+	}
+	// The consumed fraction of the partition selection budget is the largest of
+	// the consumed fractions of its ε and δ.
+	events = nil
+	if _, _, err := spec.partitionSelectionBudget.consume(0.1, 1e-10); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	want = []BudgetAlarmEvent{
+		{Budget: PartitionSelectionBudget, Threshold: 0.5, ConsumedEpsilon: 0.1, ConsumedDelta: 1e-10, TotalEpsilon: 1, TotalDelta: 1e-10},
+		{Budget: PartitionSelectionBudget, Threshold: 1, ConsumedEpsilon: 0.1, ConsumedDelta: 1e-10, TotalEpsilon: 1, TotalDelta: 1e-10},
+	}
+	if diff := cmp.Diff(want, events, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("after consuming all of the partition selection δ, got diff (-want +got):\n%s", diff)
+	}
+	// Alarms that already fired are not invoked again.
+	events = nil
+	if _, _, err := spec.aggregationBudget.consume(0.4, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	want = []BudgetAlarmEvent{{Budget: AggregationBudget, Threshold: 1, ConsumedEpsilon: 1, TotalEpsilon: 1}}
+	if diff := cmp.Diff(want, events, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("after consuming all of the aggregation budget, got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestBudgetUsage(t *testing.T) {
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+	})
+	if _, _, err := spec.aggregationBudget.consume(0.3, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if _, _, err := spec.partitionSelectionBudget.consume(0.5, 1e-11); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	want := []BudgetUsage{
+		{Budget: AggregationBudget, ConsumedEpsilon: 0.3, TotalEpsilon: 1, Inflation: 1},
+		{Budget: PartitionSelectionBudget, ConsumedEpsilon: 0.5, ConsumedDelta: 1e-11, TotalEpsilon: 1, TotalDelta: 1e-10, Inflation: 1},
+	}
+	if diff := cmp.Diff(want, spec.BudgetUsage(), cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("BudgetUsage: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestBudgetRecording(t *testing.T) {
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, AggregationDelta: 1e-10, MaxReleasesPerPartition: 2})
+	budget := spec.aggregationBudget
+	if _, _, err := budget.consume(0.1, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	stopOuter := budget.startRecording()
+	if _, _, err := budget.consume(0.1, 1e-11); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	stopInner := budget.startRecording()
+	if _, _, err := budget.get(0.1, 0); err != nil {
+		t.Fatalf("get: got error %v", err)
+	}
+	if _, _, err := budget.consume(0.05, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	// Refused requests are not recorded.
+	if _, _, err := budget.consume(1, 0); err == nil {
+		t.Errorf("consume: with a too large budget got no error")
+	}
+	// Recorded budgets include the inflation of MaxReleasesPerPartition.
+	innerEps, innerDel := stopInner()
+	outerEps, outerDel := stopOuter()
+	approx := cmpopts.EquateApprox(0, 1e-12)
+	if !cmp.Equal(innerEps, 0.1, approx) || innerDel != 0 {
+		t.Errorf("inner recording: got epsilon=%f and delta=%e, want 0.1 and 0", innerEps, innerDel)
+	}
+	if !cmp.Equal(outerEps, 0.3, approx) || !cmp.Equal(outerDel, 2e-11, approx) {
+		t.Errorf("outer recording: got epsilon=%f and delta=%e, want 0.3 and 2e-11", outerEps, outerDel)
+	}
+}
+
+// Checks that MeanPerKey, SumPerKey and QuantilesPerKey consume their budget
+// when they are added to the pipeline, and only if their parameters are valid.
+func TestAggregationsConsumeBudgetOnceValidated(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		aggregate func(s beam.Scope, pcol PrivatePCollection, maxValue float64)
+	}{
+		{"MeanPerKey", func(s beam.Scope, pcol PrivatePCollection, maxValue float64) {
+			MeanPerKey(s, pcol, MeanParams{
+				AggregationEpsilon:           0.4,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 0.5, Delta: 1e-11},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     0,
+				MaxValue:                     maxValue,
+			})
+		}},
+		{"SumPerKey", func(s beam.Scope, pcol PrivatePCollection, maxValue float64) {
+			SumPerKey(s, pcol, SumParams{
+				AggregationEpsilon:       0.4,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 0.5, Delta: 1e-11},
+				MaxPartitionsContributed: 1,
+				MinValue:                 0,
+				MaxValue:                 maxValue,
+			})
+		}},
+		{"QuantilesPerKey", func(s beam.Scope, pcol PrivatePCollection, maxValue float64) {
+			QuantilesPerKey(s, pcol, QuantilesParams{
+				AggregationEpsilon:           0.4,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 0.5, Delta: 1e-11},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     0,
+				MaxValue:                     maxValue,
+				Ranks:                        []float64{0.5},
+			})
+		}},
+	} {
+		for _, valid := range []bool{true, false} {
+			spec := privacySpec(t, PrivacySpecParams{
+				AggregationEpsilon:        1,
+				PartitionSelectionEpsilon: 1,
+				PartitionSelectionDelta:   1e-10,
+				DeferValidationErrors:     true,
+			})
+			_, s, col := ptest.CreateList(testutils.MakeTripleWithFloatValue(10, 0, 1))
+			col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+			pcol := ParDo(s, testutils.TripleWithFloatValueToKV, MakePrivate(s, col, spec))
+			// MaxValue must not be smaller than MinValue.
+			maxValue := -1.0
+			if valid {
+				maxValue = 1
+			}
+			tc.aggregate(s, pcol, maxValue)
+
+			want := []BudgetUsage{
+				{Budget: AggregationBudget, TotalEpsilon: 1, Inflation: 1},
+				{Budget: PartitionSelectionBudget, TotalEpsilon: 1, TotalDelta: 1e-10, Inflation: 1},
+			}
+			if valid {
+				want[0].ConsumedEpsilon = 0.4
+				want[1].ConsumedEpsilon, want[1].ConsumedDelta = 0.5, 1e-11
+			}
+			if diff := cmp.Diff(want, spec.BudgetUsage(), cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+				t.Errorf("%s with valid=%t: got BudgetUsage diff (-want +got):\n%s", tc.desc, valid, diff)
+			}
+		}
+	}
+}
+
+func TestOnBudgetConsumed(t *testing.T) {
+	var events []BudgetConsumedEvent
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+		MaxReleasesPerPartition:   2,
+		OnBudgetConsumed:          func(e BudgetConsumedEvent) { events = append(events, e) },
+	})
+	if _, _, err := spec.aggregationBudget.consume(0.2, 0); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if _, _, err := spec.partitionSelectionBudget.consume(0.1, 1e-11); err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	// Failed consumptions are not reported.
+	if _, _, err := spec.aggregationBudget.consume(1, 0); err == nil {
+		t.Fatalf("consume: got no error when consuming more than the remaining budget")
+	}
+	want := []BudgetConsumedEvent{
+		{Epsilon: 0.2, Usage: BudgetUsage{Budget: AggregationBudget, ConsumedEpsilon: 0.4, TotalEpsilon: 1, Inflation: 2}},
+		{Epsilon: 0.1, Delta: 1e-11, Usage: BudgetUsage{Budget: PartitionSelectionBudget, ConsumedEpsilon: 0.2, ConsumedDelta: 2e-11, TotalEpsilon: 1, TotalDelta: 1e-10, Inflation: 2}},
+	}
+	if diff := cmp.Diff(want, events, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("OnBudgetConsumed: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestOnAggregationRegistered(t *testing.T) {
+	var events []AggregationRegisteredEvent
+	_, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+		OnAggregationRegistered:   func(e AggregationRegisteredEvent) { events = append(events, e) },
+	}))
+	Count(s, pcol, CountParams{
+		AggregationEpsilon:       1,
+		PartitionSelectionParams: PartitionSelectionParams{Epsilon: 0.5, Delta: 5e-11},
+		MaxPartitionsContributed: 1,
+		MaxValue:                 1,
+	})
+	SelectPartitions(s, pcol, SelectPartitionsParams{Epsilon: 0.5, Delta: 5e-11, MaxPartitionsContributed: 1})
+
+	want := []AggregationRegisteredEvent{
+		{Aggregation: "Count", AggregationEpsilon: 1, PartitionSelectionEpsilon: 0.5, PartitionSelectionDelta: 5e-11},
+		{Aggregation: "SelectPartitions", PartitionSelectionEpsilon: 0.5, PartitionSelectionDelta: 5e-11},
+	}
+	if diff := cmp.Diff(want, events, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("OnAggregationRegistered: got diff (-want +got):\n%s", diff)
+	}
+}
+
+// Tests that with MaxReleasesPerPartition, consuming budget charges MaxReleasesPerPartition times
+// the budget returned to the aggregation.
+func TestMaxReleasesPerPartition(t *testing.T) {
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+		MaxReleasesPerPartition:   4,
+	})
+	approx := cmpopts.EquateApprox(1e-12, 0)
+	eps, del, err := spec.aggregationBudget.consume(0.2, 0)
+	if err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if !cmp.Equal([]float64{eps, del}, []float64{0.2, 0}, approx) {
+		t.Errorf("consume(0.2, 0): got (epsilon,delta)=(%f,%e), expected=(%f,%e)", eps, del, 0.2, 0.0)
+	}
+	// The remaining aggregation budget, i.e. ε=0.2, is divided by 4.
+	eps, del, err = spec.aggregationBudget.consume(0, 0)
+	if err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if !cmp.Equal([]float64{eps, del}, []float64{0.05, 0}, approx) {
+		t.Errorf("consume(0, 0): got (epsilon,delta)=(%f,%e), expected=(%f,%e)", eps, del, 0.05, 0.0)
+	}
+	eps, del, err = spec.partitionSelectionBudget.consume(0.25, 2.5e-11)
+	if err != nil {
+		t.Fatalf("consume: got error %v", err)
+	}
+	if !cmp.Equal([]float64{eps, del}, []float64{0.25, 2.5e-11}, approx) {
+		t.Errorf("consume(0.25, 2.5e-11): got (epsilon,delta)=(%f,%e), expected=(%f,%e)", eps, del, 0.25, 2.5e-11)
+	}
+	// The partition selection budget is now entirely consumed.
+	if _, _, err := spec.partitionSelectionBudget.consume(0.01, 0); err == nil {
+		t.Errorf("consume(0.01, 0): got no error, expected an error since the budget is exhausted")
+	}
+	want := []BudgetUsage{
+		{Budget: AggregationBudget, ConsumedEpsilon: 1, TotalEpsilon: 1, Inflation: 4},
+		{Budget: PartitionSelectionBudget, ConsumedEpsilon: 1, ConsumedDelta: 1e-10, TotalEpsilon: 1, TotalDelta: 1e-10, Inflation: 4},
+	}
+	if diff := cmp.Diff(want, spec.BudgetUsage(), cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("BudgetUsage: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewPrivacySpecInvalidBudgetAlarms(t *testing.T) {
+	callback := func(BudgetAlarmEvent) {}
+	for _, tc := range []struct {
+		desc   string
+		alarms []BudgetAlarm
+	}{
+		{"zero threshold", []BudgetAlarm{{Threshold: 0, Callback: callback}}},
+		{"threshold larger than 1", []BudgetAlarm{{Threshold: 1.5, Callback: callback}}},
+		{"no callback", []BudgetAlarm{{Threshold: 0.5}}},
+	} {
+		_, err := NewPrivacySpec(PrivacySpecParams{AggregationEpsilon: 1, BudgetAlarms: tc.alarms})
+		if err == nil {
+			t.Errorf("NewPrivacySpec with %s: got no error, want error", tc.desc)
+		}
+	}
+}
+
 func TestDropKey(t *testing.T) {
 	// Input is two contributions: (privacy_id, value) = {(1, 100), (2, 100)}.
 	// We add a test key of 0 and remove it with DropKey(), which should be a no-op.
@@ -17,6 +17,7 @@
 package pbeamtest
 
 import (
+	"math"
 	"testing"
 
 	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
@@ -1475,6 +1476,42 @@ func TestSelectPartitionsTestModeCrossPartitionContributionBoundingKV(t *testing
 	}
 }
 
+// Tests that SelectPartitionsKeepProbabilities returns the exact probability of
+// keeping each partition in test mode.
+func TestSelectPartitionsKeepProbabilities(t *testing.T) {
+	for _, testMode := range []pbeam.TestMode{pbeam.TestModeWithContributionBounding, pbeam.TestModeWithoutContributionBounding} {
+		// Partition k has k privacy IDs, for k from 1 to 5.
+		var pairs []testutils.PairII
+		for k, id := 1, 0; k <= 5; k++ {
+			pairs = append(pairs, testutils.MakePairsWithFixedVStartingFromKey(id, k, k)...)
+			id += k
+		}
+		// With ε=ln(2), δ=0.1 and a single partition contributed, magic partition
+		// selection keeps a partition with 1, 2, 3, 4 and 5 privacy IDs with
+		// probability 0.1, 0.3, 0.7, 0.9 and 1.
+		result := []testutils.PairIF64{{1, 0.1}, {2, 0.3}, {3, 0.7}, {4, 0.9}, {5, 1}}
+		p, s, col, want := ptest.CreateList2(pairs, result)
+		col = beam.ParDo(s, testutils.PairToKV, col)
+
+		spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+			PartitionSelectionEpsilon: math.Log(2),
+			PartitionSelectionDelta:   0.1,
+			TestMode:                  testMode,
+		})
+		if err != nil {
+			t.Fatalf("Couldn't create PrivacySpec: %v", err)
+		}
+		pcol := pbeam.MakePrivate(s, col, spec)
+		got := pbeam.SelectPartitionsKeepProbabilities(s, pcol, pbeam.PartitionSelectionParams{MaxPartitionsContributed: 1})
+
+		want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+		testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-9)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("SelectPartitionsKeepProbabilities in test mode %v did not return the expected probabilities: %v", testMode, err)
+		}
+	}
+}
+
 // Tests that DistinctPerKey bounds cross-partition contributions correctly, adds no
 // noise and keeps all partitions in test mode.
 func TestDistinctPerKeyTestModeCrossPartitionContributionBounding(t *testing.T) {
@@ -0,0 +1,179 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn2x2[beam.W, int64, beam.W, int64](&clampInt64Fn{})
+	register.DoFn2x2[beam.W, float64, beam.W, float64](&clampFloat64Fn{})
+	register.DoFn2x2[beam.W, int64, beam.W, int64](&rescaleInt64Fn{})
+	register.DoFn2x2[beam.W, float64, beam.W, float64](&rescaleFloat64Fn{})
+}
+
+// PostProcessor is a step that transforms the outputs of an aggregation after
+// noise was added to them. Since it only sees noisy outputs, it doesn't
+// consume any privacy budget.
+//
+// Steps are chained with PostProcess, or with the PostProcessing field of the
+// parameters of aggregations. ClampOutputs, RescaleOutputs, RoundingParams and
+// SuppressionParams are post-processing steps; other steps can be added by
+// implementing this interface.
+type PostProcessor interface {
+	// PostProcess transforms a PCollection<K, int64> or PCollection<K, float64>
+	// into a PCollection of the same type.
+	PostProcess(s beam.Scope, col beam.PCollection) beam.PCollection
+}
+
+// PostProcess applies steps, in order, to the outputs of an aggregation.
+//
+// PostProcess transforms a PCollection<K, int64> or PCollection<K, float64>
+// into a PCollection of the same type.
+func PostProcess(s beam.Scope, col beam.PCollection, steps ...PostProcessor) beam.PCollection {
+	if len(steps) == 0 {
+		return col
+	}
+	s = s.Scope("pbeam.PostProcess")
+	for _, step := range steps {
+		col = step.PostProcess(s, col)
+	}
+	return col
+}
+
+// postProcessOutputs applies the post-processing steps of an aggregation to
+// its outputs, after clamping negative outputs to zero if clampNegative is
+// set.
+func postProcessOutputs(s beam.Scope, col beam.PCollection, clampNegative bool, steps []PostProcessor) beam.PCollection {
+	if clampNegative {
+		steps = append([]PostProcessor{ClampOutputs{Min: 0, Max: math.Inf(1)}}, steps...)
+	}
+	return PostProcess(s, col, steps...)
+}
+
+// PostProcess rounds the outputs of an aggregation with RoundToNoisePrecision.
+func (p RoundingParams) PostProcess(s beam.Scope, col beam.PCollection) beam.PCollection {
+	return RoundToNoisePrecision(s, col, p)
+}
+
+// PostProcess suppresses the outputs of an aggregation with SuppressOutputs.
+func (p SuppressionParams) PostProcess(s beam.Scope, col beam.PCollection) beam.PCollection {
+	return SuppressOutputs(s, col, p)
+}
+
+// ClampOutputs is a post-processing step that clamps outputs to [Min, Max],
+// e.g. to remove negative outputs that are only due to noise. Int64 outputs
+// are clamped to the integers in [Min, Max].
+//
+// Use math.Inf(-1) or math.Inf(1) to leave a bound unset.
+type ClampOutputs struct {
+	Min, Max float64
+}
+
+// PostProcess clamps the outputs of an aggregation.
+func (c ClampOutputs) PostProcess(s beam.Scope, col beam.PCollection) beam.PCollection {
+	s = s.Scope("pbeam.ClampOutputs")
+	if math.IsNaN(c.Min) || math.IsNaN(c.Max) || c.Min > c.Max {
+		log.Fatalf("pbeam.ClampOutputs: Min (%f) must be smaller than or equal to Max (%f)", c.Min, c.Max)
+	}
+	_, valueT := beam.ValidateKVType(col)
+	switch valueT.Type() {
+	case reflect.TypeOf(int64(0)):
+		min, max := math.Ceil(c.Min), math.Floor(c.Max)
+		if min > max {
+			log.Fatalf("pbeam.ClampOutputs: there is no integer between Min (%f) and Max (%f)", c.Min, c.Max)
+		}
+		return beam.ParDo(s, &clampInt64Fn{Min: min, Max: max}, col)
+	case reflect.TypeOf(float64(0)):
+		return beam.ParDo(s, &clampFloat64Fn{Min: c.Min, Max: c.Max}, col)
+	default:
+		log.Fatalf("pbeam.ClampOutputs: value type must be int64 or float64, got %v", valueT.Type())
+	}
+	return beam.PCollection{}
+}
+
+// clampInt64Fn compares outputs to its bounds as float64, so that infinite
+// bounds can be used.
+type clampInt64Fn struct {
+	Min, Max float64
+}
+
+func (fn *clampInt64Fn) ProcessElement(k beam.W, v int64) (beam.W, int64) {
+	switch {
+	case float64(v) < fn.Min:
+		return k, int64(fn.Min)
+	case float64(v) > fn.Max:
+		return k, int64(fn.Max)
+	}
+	return k, v
+}
+
+type clampFloat64Fn struct {
+	Min, Max float64
+}
+
+func (fn *clampFloat64Fn) ProcessElement(k beam.W, v float64) (beam.W, float64) {
+	return k, math.Min(math.Max(v, fn.Min), fn.Max)
+}
+
+// RescaleOutputs is a post-processing step that multiplies outputs by Factor,
+// e.g. to convert a count of sampled records to an estimate for the whole
+// population, or to change units. Int64 outputs are rounded to the nearest
+// integer.
+type RescaleOutputs struct {
+	Factor float64
+}
+
+// PostProcess rescales the outputs of an aggregation.
+func (r RescaleOutputs) PostProcess(s beam.Scope, col beam.PCollection) beam.PCollection {
+	s = s.Scope("pbeam.RescaleOutputs")
+	if math.IsNaN(r.Factor) || math.IsInf(r.Factor, 0) {
+		log.Fatalf("pbeam.RescaleOutputs: Factor must be finite, got %f", r.Factor)
+	}
+	_, valueT := beam.ValidateKVType(col)
+	switch valueT.Type() {
+	case reflect.TypeOf(int64(0)):
+		return beam.ParDo(s, &rescaleInt64Fn{Factor: r.Factor}, col)
+	case reflect.TypeOf(float64(0)):
+		return beam.ParDo(s, &rescaleFloat64Fn{Factor: r.Factor}, col)
+	default:
+		log.Fatalf("pbeam.RescaleOutputs: value type must be int64 or float64, got %v", valueT.Type())
+	}
+	return beam.PCollection{}
+}
+
+type rescaleInt64Fn struct {
+	Factor float64
+}
+
+func (fn *rescaleInt64Fn) ProcessElement(k beam.W, v int64) (beam.W, int64) {
+	return k, int64(math.Round(float64(v) * fn.Factor))
+}
+
+type rescaleFloat64Fn struct {
+	Factor float64
+}
+
+func (fn *rescaleFloat64Fn) ProcessElement(k beam.W, v float64) (beam.W, float64) {
+	return k, v * fn.Factor
+}
@@ -0,0 +1,110 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// Checks that PostProcess applies the steps in order.
+func TestPostProcessInt64(t *testing.T) {
+	outputs := []testutils.PairII64{{0, 1234}, {1, -56}, {2, 4}, {3, 5000}}
+	result := []testutils.PairII64{{0, 2470}, {1, 0}, {2, 10}, {3, 4000}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairII64ToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+
+	// Standard deviation is ≈ 14.1, so outputs are rounded to multiples of 10
+	// after being clamped to [0, 2000] and doubled.
+	got := PostProcess(s, col,
+		ClampOutputs{Min: 0, Max: 2000},
+		RescaleOutputs{Factor: 2},
+		RoundingParams{
+			NoiseParams: OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 10},
+		})
+
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestPostProcessInt64: PostProcess(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestClampOutputsFloat64(t *testing.T) {
+	outputs := []testutils.PairIF64{{0, -1.5}, {1, 0.25}, {2, 7}}
+	result := []testutils.PairIF64{{0, -0.5}, {1, 0.25}, {2, 7}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairIF64ToKV, col)
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+
+	got := PostProcess(s, col, ClampOutputs{Min: -0.5, Max: math.Inf(1)})
+
+	testutils.EqualsKVFloat64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestClampOutputsFloat64: PostProcess(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that ClampOutputs clamps int64 outputs to the integers within the
+// bounds.
+func TestClampOutputsInt64NonIntegerBounds(t *testing.T) {
+	outputs := []testutils.PairII64{{0, -3}, {1, 1}, {2, 9}}
+	result := []testutils.PairII64{{0, -2}, {1, 1}, {2, 4}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairII64ToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+
+	got := PostProcess(s, col, ClampOutputs{Min: -2.5, Max: 4.5})
+
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestClampOutputsInt64NonIntegerBounds: PostProcess(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that aggregations apply their PostProcessing steps to their outputs.
+func TestCountPostProcessing(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 5, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(5, 20, 1),
+	)
+	result := []testutils.PairII64{{0, 50}, {1, 150}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	got := Count(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+		PostProcessing:           []PostProcessor{RescaleOutputs{Factor: 10}, ClampOutputs{Min: 0, Max: 150}},
+	})
+
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountPostProcessing: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
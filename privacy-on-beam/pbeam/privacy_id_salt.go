@@ -0,0 +1,80 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn2x2[kv.Pair, beam.V, kv.Pair, beam.V](&saltIDKFn{})
+	register.DoFn1x1[kv.Pair, kv.Pair](&saltIDKPairFn{})
+}
+
+// minPrivacyIDSaltLength is the minimum length of
+// PrivacySpecParams.PrivacyIDSalt, in bytes.
+const minPrivacyIDSaltLength = 32
+
+// saltPrivacyID replaces a coded privacy ID by its HMAC-SHA256 keyed with
+// salt. Distinct privacy IDs get distinct salted IDs (except with negligible
+// probability), so grouping by salted IDs is the same as grouping by privacy
+// IDs.
+func saltPrivacyID(salt, codedID []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(codedID)
+	return mac.Sum(nil)
+}
+
+// saltPrivacyIDs salts the coded privacy IDs of a PCollection<kv.Pair{ID,K},V>
+// or of a PCollection<kv.Pair{ID,K}> with the PrivacyIDSalt of the
+// PrivacySpec, if set. Otherwise, it returns col unchanged.
+//
+// Salted IDs can't be decoded, so this must only be used by aggregations that
+// drop privacy IDs after contribution bounding.
+func saltPrivacyIDs(s beam.Scope, spec *PrivacySpec, col beam.PCollection) beam.PCollection {
+	if spec.privacyIDSalt == nil {
+		return col
+	}
+	if typex.IsKV(col.Type()) {
+		return beam.ParDo(s, &saltIDKFn{Salt: spec.privacyIDSalt}, col)
+	}
+	return beam.ParDo(s, &saltIDKPairFn{Salt: spec.privacyIDSalt}, col)
+}
+
+// saltIDKFn salts the coded privacy IDs of a PCollection<kv.Pair{ID,K},V>.
+type saltIDKFn struct {
+	Salt []byte
+}
+
+func (fn *saltIDKFn) ProcessElement(idk kv.Pair, v beam.V) (kv.Pair, beam.V) {
+	return kv.Pair{saltPrivacyID(fn.Salt, idk.K), idk.V}, v
+}
+
+// saltIDKPairFn salts the coded privacy IDs of a PCollection<kv.Pair{ID,K}>.
+type saltIDKPairFn struct {
+	Salt []byte
+}
+
+func (fn *saltIDKPairFn) ProcessElement(idk kv.Pair) kv.Pair {
+	return kv.Pair{saltPrivacyID(fn.Salt, idk.K), idk.V}
+}
@@ -0,0 +1,83 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// Checks that salting privacy IDs doesn't change the results of Count and
+// SumPerKey, in particular that contributions of the same privacy ID are still
+// bounded together.
+func TestPrivacyIDSaltNoNoise(t *testing.T) {
+	// Each privacy ID contributes 3 times to partition 0, and is only counted
+	// once because of contribution bounding.
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		testutils.MakeTripleWithIntValue(100, 0, 1),
+		testutils.MakeTripleWithIntValue(100, 0, 1),
+		testutils.MakeTripleWithIntValue(100, 0, 1))
+	result := []testutils.PairII64{
+		{0, 100},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		PrivacyIDSalt:      bytes.Repeat([]byte{1}, 32),
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	counts := Count(s, pcol, CountParams{
+		AggregationEpsilon:       0.5,
+		MaxPartitionsContributed: 1,
+		MaxValue:                 1,
+		PublicPartitions:         []int{0},
+	})
+	sums := SumPerKey(s, pcol, SumParams{
+		AggregationEpsilon:       0.5,
+		MaxPartitionsContributed: 1,
+		MinValue:                 0,
+		MaxValue:                 1,
+		PublicPartitions:         []int{0},
+	})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.EqualsKVInt64(t, s, counts, want)
+	testutils.EqualsKVInt64(t, s, sums, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestPrivacyIDSaltNoNoise: Count(%v) = %v, SumPerKey = %v, expected %v: %v", col, counts, sums, want, err)
+	}
+}
+
+func TestSaltPrivacyID(t *testing.T) {
+	salt1, salt2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	id1, id2 := []byte("id1"), []byte("id2")
+	if !bytes.Equal(saltPrivacyID(salt1, id1), saltPrivacyID(salt1, id1)) {
+		t.Errorf("saltPrivacyID: salting the same ID twice with the same salt gave different results")
+	}
+	if bytes.Equal(saltPrivacyID(salt1, id1), saltPrivacyID(salt1, id2)) {
+		t.Errorf("saltPrivacyID: salting different IDs with the same salt gave the same result")
+	}
+	if bytes.Equal(saltPrivacyID(salt1, id1), saltPrivacyID(salt2, id1)) {
+		t.Errorf("saltPrivacyID: salting the same ID with different salts gave the same result")
+	}
+}
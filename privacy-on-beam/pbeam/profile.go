@@ -0,0 +1,504 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(DataProfile{}))
+	beam.RegisterType(reflect.TypeOf(ColumnProfile{}))
+	register.DoFn2x3[beam.W, beam.V, kv.Pair, []float64, error](&extractProfileRowFn{})
+	register.Combiner3[profileRowsAccum, []float64, profileRowsAccum](&profileRowsFn{})
+	register.Combiner3[profileAccum, profileRowsAccum, DataProfile](&profileFn{})
+}
+
+// Default ranks of the quantiles computed by Profile.
+var (
+	// DefaultContributionRanks are the default ranks of the quantiles of the
+	// number of records per privacy unit.
+	DefaultContributionRanks = []float64{0.5, 0.9, 0.99}
+	// DefaultColumnRanks are the default ranks of the quantiles of each
+	// column. The first and last quantiles estimate the range of the column.
+	DefaultColumnRanks = []float64{0.01, 0.5, 0.99}
+)
+
+// ProfileParams specifies the parameters of Profile.
+type ProfileParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by the profile, split evenly between
+	// the row count, the quantiles of the number of records per privacy unit,
+	// and the quantiles of each column. If there is only one aggregation, both
+	// epsilon and delta can be left 0; in that case the entire budget reserved
+	// for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// The maximum number of records that a given privacy identifier can
+	// contribute to the row count and to the quantiles of each column. If a
+	// privacy identifier is associated with more records, random records are
+	// dropped.
+	//
+	// Required.
+	MaxContributions int64
+	// Upper bound of the domain in which the quantiles of the number of records
+	// per privacy unit are searched. Numbers of records are counted before
+	// contribution bounding, and clamped to [0, MaxContributionsUpperBound].
+	//
+	// Required.
+	MaxContributionsUpperBound int64
+	// Ranks of the quantiles of the number of records per privacy unit.
+	//
+	// Defaults to DefaultContributionRanks.
+	ContributionRanks []float64
+	// Numeric columns to profile. Optional.
+	Columns []ProfileColumnParams
+}
+
+// ProfileColumnParams specifies a column profiled by Profile.
+type ProfileColumnParams struct {
+	// Path of the column in the records of the PrivatePCollection, in the
+	// format of ExtractStructFields, e.g. "Purchase.Amount". The column must
+	// have a numeric type.
+	//
+	// Required.
+	Field string
+	// Values are clamped to [MinValue, MaxValue], the domain in which the
+	// quantiles of the column are searched.
+	//
+	// Required.
+	MinValue, MaxValue float64
+	// Ranks of the quantiles of the column.
+	//
+	// Defaults to DefaultColumnRanks.
+	Ranks []float64
+}
+
+// DataProfile is a differentially private profile of a PrivatePCollection,
+// output by Profile.
+type DataProfile struct {
+	// Noisy number of records, after contribution bounding.
+	RowCount int64
+	// Ranks and noisy quantiles of the number of records per privacy unit,
+	// before contribution bounding.
+	ContributionRanks     []float64
+	ContributionQuantiles []float64
+	// Profiles of the columns, in the order of ProfileParams.Columns.
+	Columns []ColumnProfile
+}
+
+// ColumnProfile is the differentially private profile of a column.
+type ColumnProfile struct {
+	Field string
+	// Ranks and noisy quantiles of the values of the column.
+	Ranks     []float64
+	Quantiles []float64
+}
+
+// Profile computes a differentially private profile of a PrivatePCollection<V>
+// in a single pass: its number of records, quantiles of the number of records
+// per privacy unit, and quantiles of the numeric columns of V. The profile is
+// meant to help choose the parameters of other aggregations, e.g. contribution
+// bounds from the contribution quantiles, and MinValue and MaxValue from the
+// column quantiles.
+//
+// Profile transforms a PrivatePCollection<V> into a PCollection<DataProfile>
+// with a single element. No partition selection budget is consumed.
+//
+// Note that, like for QuantilesPerKey, the quantiles are slightly noisy even
+// when using pbeamtest.
+func Profile(s beam.Scope, pcol PrivatePCollection, params ProfileParams) beam.PCollection {
+	s = s.Scope("pbeam.Profile")
+	if pcol.codec != nil {
+		log.Fatalf("pbeam.Profile: input must be a PrivatePCollection<V>, got a PrivatePCollection<K,V>")
+	}
+	idT, valueT := beam.ValidateKVType(pcol.col)
+	if params.ContributionRanks == nil {
+		params.ContributionRanks = DefaultContributionRanks
+	}
+	for i := range params.Columns {
+		if params.Columns[i].Ranks == nil {
+			params.Columns[i].Ranks = DefaultColumnRanks
+		}
+	}
+
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "Profile", err, reflect.TypeOf(DataProfile{}))
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Profile: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("Profile")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Profile: %v", err))
+	}
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("Profile", &params.AggregationEpsilon, &params.AggregationDelta, nil)
+	if err != nil {
+		return invalid(err)
+	}
+	err = checkProfileParams(params, noiseKind, valueT.Type())
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Profile: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("Profile", params.AggregationEpsilon, params.AggregationDelta, 0, 0)
+
+	fields := make([]string, len(params.Columns))
+	for i, c := range params.Columns {
+		fields[i] = c.Field
+	}
+	rows := beam.ParDo(s, &extractProfileRowFn{IDType: beam.EncodedType{idT.Type()}, Fields: fields}, pcol.col) // PCollection<kv.Pair{ID,nil}, []float64>.
+	rows = saltPrivacyIDs(s, spec, rows)
+	// Count the records of each privacy unit, and keep at most MaxContributions of them.
+	perID := beam.CombinePerKey(s, &profileRowsFn{MaxRows: maxContributionsPerPartition(*spec, params.MaxContributions)}, rows)
+	perID = traceStage(s, *spec, "Profile.boundContributions", perID)
+	fn, err := newProfileFn(*spec, params, noiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Profile: %v", err))
+	}
+	profile := beam.Combine(s, fn, beam.DropKey(s, perID))
+	return traceStage(s, *spec, "Profile.aggregate", profile)
+}
+
+func checkProfileParams(params ProfileParams, noiseKind noise.Kind, valueType reflect.Type) error {
+	err := checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	if params.MaxContributions <= 0 {
+		return fmt.Errorf("MaxContributions must be set to a positive value, was %d instead", params.MaxContributions)
+	}
+	if params.MaxContributionsUpperBound <= 0 {
+		return fmt.Errorf("MaxContributionsUpperBound must be set to a positive value, was %d instead", params.MaxContributionsUpperBound)
+	}
+	if err := checkProfileRanks("ContributionRanks", params.ContributionRanks); err != nil {
+		return err
+	}
+	for i, c := range params.Columns {
+		t, err := structFieldType(valueType, c.Field)
+		if err != nil {
+			return fmt.Errorf("Columns[%d]: %v", i, err)
+		}
+		if !t.ConvertibleTo(reflect.TypeOf(float64(0))) {
+			return fmt.Errorf("Columns[%d]: field %s must have a numeric type, got %v", i, c.Field, t)
+		}
+		err = checks.CheckBoundsFloat64(c.MinValue, c.MaxValue)
+		if err != nil {
+			return fmt.Errorf("Columns[%d]: %v", i, err)
+		}
+		err = checks.CheckBoundsNotEqual(c.MinValue, c.MaxValue)
+		if err != nil {
+			return fmt.Errorf("Columns[%d]: %v", i, err)
+		}
+		if err := checkProfileRanks(fmt.Sprintf("Columns[%d].Ranks", i), c.Ranks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkProfileRanks(name string, ranks []float64) error {
+	if len(ranks) == 0 {
+		return fmt.Errorf("%s must contain at least one rank", name)
+	}
+	for i, rank := range ranks {
+		if rank < 0.0 || rank > 1.0 {
+			return fmt.Errorf("%s[%d]=%f must be >= 0 and <= 1", name, i, rank)
+		}
+	}
+	return nil
+}
+
+// extractProfileRowFn encodes the privacy ID of each record, and extracts the
+// values of its profiled columns.
+type extractProfileRowFn struct {
+	IDType beam.EncodedType
+	idEnc  beam.ElementEncoder
+	Fields []string
+}
+
+func (fn *extractProfileRowFn) Setup() {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+}
+
+func (fn *extractProfileRowFn) ProcessElement(id beam.W, v beam.V) (kv.Pair, []float64, error) {
+	var idBuf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
+		return kv.Pair{}, nil, fmt.Errorf("pbeam.extractProfileRowFn.ProcessElement: couldn't encode ID %v: %w", id, err)
+	}
+	row := make([]float64, len(fn.Fields))
+	for i, field := range fn.Fields {
+		f, err := getStructField(v, field)
+		if err != nil {
+			return kv.Pair{}, nil, fmt.Errorf("pbeam.extractProfileRowFn.ProcessElement: couldn't get field %s: %v", field, err)
+		}
+		row[i] = reflect.ValueOf(f).Convert(reflect.TypeOf(float64(0))).Float()
+	}
+	return kv.Pair{idBuf.Bytes(), nil}, row, nil
+}
+
+// profileRowsAccum holds the records of a privacy unit.
+type profileRowsAccum struct {
+	// Number of records of the privacy unit.
+	Count int64
+	// Values of the columns of the records of the privacy unit. If Count is
+	// larger than the MaxRows of the CombineFn, Rows is a uniformly random
+	// sample of them.
+	Rows [][]float64
+}
+
+// profileRowsFn collects the records of each privacy unit, keeping at most
+// MaxRows of them with reservoir sampling, or all of them if MaxRows is 0.
+type profileRowsFn struct {
+	MaxRows int64
+}
+
+func (fn *profileRowsFn) CreateAccumulator() profileRowsAccum {
+	return profileRowsAccum{}
+}
+
+func (fn *profileRowsFn) AddInput(a profileRowsAccum, row []float64) profileRowsAccum {
+	a.Count++
+	i := int64(len(a.Rows))
+	if fn.MaxRows > 0 && i >= fn.MaxRows {
+		if i = rand.Int63n(a.Count); i >= fn.MaxRows {
+			return a
+		}
+		a.Rows[i] = row
+		return a
+	}
+	a.Rows = append(a.Rows, row)
+	return a
+}
+
+func (fn *profileRowsFn) MergeAccumulators(a, b profileRowsAccum) profileRowsAccum {
+	if fn.MaxRows > 0 && int64(len(a.Rows)+len(b.Rows)) > fn.MaxRows {
+		a.Rows = mergeSamples(a.Rows, b.Rows, a.Count, b.Count, fn.MaxRows)
+	} else {
+		a.Rows = append(a.Rows, b.Rows...)
+	}
+	a.Count += b.Count
+	return a
+}
+
+func (fn *profileRowsFn) ExtractOutput(a profileRowsAccum) profileRowsAccum {
+	return a
+}
+
+type profileAccum struct {
+	RowCount      *dpagg.Count
+	Contributions *dpagg.BoundedQuantiles
+	Columns       []*dpagg.BoundedQuantiles
+}
+
+// profileFn is a differentially private combineFn computing a DataProfile from
+// the records of each privacy unit. Do not initialize it yourself, use
+// newProfileFn to create a profileFn instance.
+type profileFn struct {
+	// Budget of each statistic of the profile.
+	NoiseEpsilon               float64
+	NoiseDelta                 float64
+	MaxContributions           int64
+	MaxContributionsUpperBound int64
+	ContributionRanks          []float64
+	Columns                    []ProfileColumnParams
+	NoiseKind                  noise.Kind
+	noise                      noise.Noise // Set during Setup phase according to NoiseKind.
+	TestMode                   TestMode
+}
+
+// newProfileFn returns a profileFn splitting the budget of params evenly
+// between the statistics of the profile.
+func newProfileFn(spec PrivacySpec, params ProfileParams, noiseKind noise.Kind) (*profileFn, error) {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
+		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	numStatistics := float64(2 + len(params.Columns))
+	return &profileFn{
+		NoiseEpsilon:               params.AggregationEpsilon / numStatistics,
+		NoiseDelta:                 params.AggregationDelta / numStatistics,
+		MaxContributions:           params.MaxContributions,
+		MaxContributionsUpperBound: params.MaxContributionsUpperBound,
+		ContributionRanks:          params.ContributionRanks,
+		Columns:                    params.Columns,
+		NoiseKind:                  noiseKind,
+		TestMode:                   spec.testMode,
+	}, nil
+}
+
+func (fn *profileFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+func (fn *profileFn) CreateAccumulator() (profileAccum, error) {
+	var maxIncrement int64
+	if fn.TestMode != TestModeWithoutContributionBounding {
+		maxIncrement = fn.MaxContributions
+	}
+	rowCount, err := dpagg.NewCount(&dpagg.CountOptions{
+		Epsilon:                  fn.NoiseEpsilon,
+		Delta:                    fn.NoiseDelta,
+		MaxPartitionsContributed: 1,
+		MaxIncrement:             maxIncrement,
+		Noise:                    fn.noise,
+	})
+	if err != nil {
+		return profileAccum{}, err
+	}
+	contributions, err := dpagg.NewBoundedQuantiles(&dpagg.BoundedQuantilesOptions{
+		Epsilon:                      fn.NoiseEpsilon,
+		Delta:                        fn.NoiseDelta,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		Lower:                        0,
+		Upper:                        float64(fn.MaxContributionsUpperBound),
+		Noise:                        fn.noise,
+	})
+	if err != nil {
+		return profileAccum{}, err
+	}
+	accum := profileAccum{RowCount: rowCount, Contributions: contributions, Columns: make([]*dpagg.BoundedQuantiles, len(fn.Columns))}
+	for i, c := range fn.Columns {
+		accum.Columns[i], err = dpagg.NewBoundedQuantiles(&dpagg.BoundedQuantilesOptions{
+			Epsilon:                      fn.NoiseEpsilon,
+			Delta:                        fn.NoiseDelta,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: fn.MaxContributions,
+			Lower:                        c.MinValue,
+			Upper:                        c.MaxValue,
+			Noise:                        fn.noise,
+		})
+		if err != nil {
+			return profileAccum{}, err
+		}
+	}
+	return accum, nil
+}
+
+func (fn *profileFn) AddInput(a profileAccum, rows profileRowsAccum) (profileAccum, error) {
+	err := a.RowCount.IncrementBy(int64(len(rows.Rows)))
+	if err != nil {
+		return a, err
+	}
+	err = a.Contributions.Add(float64(rows.Count))
+	if err != nil {
+		return a, err
+	}
+	for _, row := range rows.Rows {
+		for i, v := range row {
+			err = a.Columns[i].Add(v)
+			if err != nil {
+				return a, err
+			}
+		}
+	}
+	return a, nil
+}
+
+func (fn *profileFn) MergeAccumulators(a, b profileAccum) (profileAccum, error) {
+	err := a.RowCount.Merge(b.RowCount)
+	if err != nil {
+		return a, err
+	}
+	err = a.Contributions.Merge(b.Contributions)
+	if err != nil {
+		return a, err
+	}
+	for i := range a.Columns {
+		err = a.Columns[i].Merge(b.Columns[i])
+		if err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+func (fn *profileFn) ExtractOutput(a profileAccum) (DataProfile, error) {
+	if fn.TestMode.isEnabled() {
+		a.RowCount.Noise = noNoise{}
+		a.Contributions.Noise = noNoise{}
+		for _, c := range a.Columns {
+			c.Noise = noNoise{}
+		}
+	}
+	a.RowCount.Noise = auditNoise(a.RowCount.Noise, "Count")
+	a.Contributions.Noise = auditNoise(a.Contributions.Noise, "BoundedQuantiles")
+	for _, c := range a.Columns {
+		c.Noise = auditNoise(c.Noise, "BoundedQuantiles")
+	}
+
+	var profile DataProfile
+	var err error
+	profile.RowCount, err = a.RowCount.Result()
+	if err != nil {
+		return DataProfile{}, err
+	}
+	profile.ContributionRanks = fn.ContributionRanks
+	profile.ContributionQuantiles, err = quantileResults(a.Contributions, fn.ContributionRanks)
+	if err != nil {
+		return DataProfile{}, err
+	}
+	profile.Columns = make([]ColumnProfile, len(fn.Columns))
+	for i, c := range fn.Columns {
+		quantiles, err := quantileResults(a.Columns[i], c.Ranks)
+		if err != nil {
+			return DataProfile{}, err
+		}
+		profile.Columns[i] = ColumnProfile{Field: c.Field, Ranks: c.Ranks, Quantiles: quantiles}
+	}
+	return profile, nil
+}
+
+// quantileResults returns the quantiles of bq at each of ranks.
+func quantileResults(bq *dpagg.BoundedQuantiles, ranks []float64) ([]float64, error) {
+	result := make([]float64, len(ranks))
+	for i, rank := range ranks {
+		var err error
+		result[i], err = bq.Result(rank)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,161 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x1[DataProfile, string](formatDataProfileFn)
+}
+
+type purchase struct {
+	ID     int `pbeam:"privacy_id"`
+	Amount float64
+	Items  int64
+	Store  string
+}
+
+// formatDataProfileFn formats a DataProfile, rounding the quantiles which are
+// slightly noisy even without noise.
+func formatDataProfileFn(p DataProfile) string {
+	s := fmt.Sprintf("rows=%d, contributions=%s", p.RowCount, formatRoundedQuantiles(p.ContributionQuantiles))
+	for _, c := range p.Columns {
+		s += fmt.Sprintf(", %s=%s", c.Field, formatRoundedQuantiles(c.Quantiles))
+	}
+	return s
+}
+
+func formatRoundedQuantiles(quantiles []float64) string {
+	rounded := make([]string, len(quantiles))
+	for i, q := range quantiles {
+		rounded[i] = fmt.Sprintf("%.0f", q)
+	}
+	return fmt.Sprint(rounded)
+}
+
+func TestProfileNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		testMode TestMode
+		want     string
+	}{
+		// Each privacy unit contributes 2 of its 3 purchases.
+		{TestModeWithContributionBounding, "rows=200, contributions=[3], Amount=[10 20], Items=[1 1]"},
+		{TestModeWithoutContributionBounding, "rows=300, contributions=[3], Amount=[10 20], Items=[1 1]"},
+	} {
+		// Privacy units 0 to 49 have 3 purchases of 10, and privacy units 50
+		// to 99 have 3 purchases of 20.
+		var purchases []purchase
+		for i := 0; i < 100; i++ {
+			amount := 10.0
+			if i >= 50 {
+				amount = 20
+			}
+			for j := 0; j < 3; j++ {
+				purchases = append(purchases, purchase{ID: i, Amount: amount, Items: 1})
+			}
+		}
+		p, s, col := ptest.CreateList(purchases)
+		pcol := MakePrivateFromStruct(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           tc.testMode,
+			}), "")
+		got := Profile(s, pcol, ProfileParams{
+			MaxContributions:           2,
+			MaxContributionsUpperBound: 10,
+			ContributionRanks:          []float64{0.5},
+			Columns: []ProfileColumnParams{
+				{Field: "Amount", MinValue: 0, MaxValue: 100, Ranks: []float64{0.25, 0.75}},
+				{Field: "Items", MinValue: 0, MaxValue: 10, Ranks: []float64{0.25, 0.75}},
+			},
+		})
+
+		passert.Equals(s, beam.ParDo(s, formatDataProfileFn, got), tc.want)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestProfileNoNoise in test mode %v: Profile(%v) = %v, error %v", tc.testMode, col, got, err)
+		}
+	}
+}
+
+func TestProfileDeferValidationErrors(t *testing.T) {
+	p, s, col := ptest.CreateList([]purchase{{ID: 0, Amount: 10, Items: 1}})
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+	// MaxContributions must be positive.
+	Profile(s, MakePrivateFromStruct(s, col, spec, ""), ProfileParams{
+		MaxContributions:           0,
+		MaxContributionsUpperBound: 10,
+		Columns:                    []ProfileColumnParams{{Field: "Amount", MinValue: 0, MaxValue: 100}},
+	})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "Profile" {
+		t.Errorf("ValidationErrors() = %v, want a single error for Profile", errs)
+	}
+	// The invalid Profile doesn't consume any budget.
+	for _, usage := range spec.BudgetUsage() {
+		if usage.ConsumedEpsilon != 0 || usage.ConsumedDelta != 0 {
+			t.Errorf("BudgetUsage() after an invalid Profile: got %+v, want no consumed budget", usage)
+		}
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestProfileDeferValidationErrors: pipeline with an invalid Profile succeeded, expected an error")
+	}
+}
+
+func TestCheckProfileParams(t *testing.T) {
+	purchaseT := reflect.TypeOf(purchase{})
+	valid := func() ProfileParams {
+		return ProfileParams{
+			AggregationEpsilon:         1.0,
+			MaxContributions:           1,
+			MaxContributionsUpperBound: 10,
+			ContributionRanks:          []float64{0.5},
+			Columns:                    []ProfileColumnParams{{Field: "Amount", MinValue: 0, MaxValue: 100, Ranks: []float64{0.5}}},
+		}
+	}
+	for _, tc := range []struct {
+		desc    string
+		modify  func(*ProfileParams)
+		wantErr bool
+	}{
+		{"valid parameters", func(*ProfileParams) {}, false},
+		{"no columns", func(p *ProfileParams) { p.Columns = nil }, false},
+		{"zero aggregationEpsilon", func(p *ProfileParams) { p.AggregationEpsilon = 0 }, true},
+		{"unset MaxContributions", func(p *ProfileParams) { p.MaxContributions = 0 }, true},
+		{"unset MaxContributionsUpperBound", func(p *ProfileParams) { p.MaxContributionsUpperBound = 0 }, true},
+		{"no contribution ranks", func(p *ProfileParams) { p.ContributionRanks = nil }, true},
+		{"contribution rank out of bounds", func(p *ProfileParams) { p.ContributionRanks = []float64{1.5} }, true},
+		{"unknown column", func(p *ProfileParams) { p.Columns[0].Field = "Price" }, true},
+		{"non-numeric column", func(p *ProfileParams) { p.Columns[0].Field = "Store" }, true},
+		{"MaxValue equal to MinValue", func(p *ProfileParams) { p.Columns[0].MaxValue = 0 }, true},
+		{"column rank out of bounds", func(p *ProfileParams) { p.Columns[0].Ranks = []float64{-0.5} }, true},
+	} {
+		params := valid()
+		tc.modify(&params)
+		if err := checkProfileParams(params, noise.LaplaceNoise, purchaseT); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(ProportionResult{}))
+	register.Function2x2[kv.Pair, bool, kv.Pair, ClientAggregate](toProportionAggregate)
+	register.Function2x1[ClientAggregate, ClientAggregate, ClientAggregate](mergeProportionAggregatesPerPrivacyUnit)
+	register.Function1x2[beam.W, beam.W, ClientAggregate](addEmptyAggregateToPublicPartitions)
+	register.Combiner3[boundedMeanAccum, ClientAggregate, *ProportionResult](&proportionFn{})
+	register.Function3x0[beam.V, *ProportionResult, func(beam.V, ProportionResult)](dropThresholdedPartitionsProportion)
+	register.Emitter2[beam.V, ProportionResult]()
+	register.Function2x2[beam.W, *ProportionResult, beam.W, ProportionResult](dereferenceProportionResult)
+}
+
+// ProportionParams specifies the parameters associated with a Proportion
+// aggregation.
+type ProportionParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. See CountParams.PublicPartitions for details.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct values that a given privacy identifier
+	// can influence. See CountParams.MaxPartitionsContributed for details.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of records of a given privacy identifier counted in
+	// the proportion of each partition. If a privacy identifier has more
+	// records in a partition, the number of its records satisfying the
+	// predicate is scaled down accordingly, so that its own proportion is
+	// preserved.
+	//
+	// Required, unless PerPrivacyUnit is set.
+	MaxContributionsPerPartition int64
+	// If true, ProportionPerKey computes the proportion of privacy identifiers
+	// with at least one record satisfying the predicate in each partition,
+	// rather than the proportion of records. MaxContributionsPerPartition must
+	// then be left unset.
+	//
+	// Optional.
+	PerPrivacyUnit bool
+	// Confidence intervals in the output contain the raw proportion with
+	// probability at least 1-ConfidenceIntervalAlpha.
+	//
+	// Defaults to 0.05.
+	ConfidenceIntervalAlpha float64
+}
+
+// ProportionResult is the output of a Proportion aggregation for a single
+// partition.
+type ProportionResult struct {
+	// Proportion is the differentially private fraction of records, or of
+	// privacy identifiers, satisfying the predicate. It is in [0, 1].
+	Proportion float64
+	// LowerBound and UpperBound are the bounds of the confidence interval of
+	// the proportion.
+	LowerBound, UpperBound float64
+}
+
+// ProportionPerKey computes the fraction of the records associated with each
+// key in a PrivatePCollection<K,bool> whose value is true, e.g. the records
+// satisfying a predicate that was applied with ParDo. If params.PerPrivacyUnit
+// is set, it computes the fraction of privacy identifiers with at least one
+// such record instead.
+//
+// Rather than dividing two noisy counts, the numerator and denominator are
+// noised jointly like in MeanPerKey, taking the mean of the values as 0 or 1:
+// the proportion is always in [0, 1], and its confidence interval accounts for
+// the noise of both. The confidence intervals don't consume additional
+// privacy budget.
+//
+// Like Count, ProportionPerKey does pre-aggregation thresholding to remove
+// partitions with a low number of distinct privacy identifiers unless public
+// partitions are specified.
+//
+// ProportionPerKey transforms a PrivatePCollection<K,bool> into a
+// PCollection<K,ProportionResult>.
+func ProportionPerKey(s beam.Scope, pcol PrivatePCollection, params ProportionParams) beam.PCollection {
+	s = s.Scope("pbeam.ProportionPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("ProportionPerKey must be used on a PrivatePCollection of type <K,bool>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("ProportionPerKey: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "ProportionPerKey", err, pcol.codec.KType.T, reflect.TypeOf(ProportionResult{}))
+	}
+	if pcol.codec.VType.T != reflect.TypeOf(false) {
+		return invalid(fmt.Errorf("ProportionPerKey must be used on a PrivatePCollection of type <K,bool>, got value type %v instead", pcol.codec.VType.T))
+	}
+	if params.ConfidenceIntervalAlpha == 0 {
+		params.ConfidenceIntervalAlpha = defaultConfidenceIntervalAlpha
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	var err error
+	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume aggregation budget for ProportionPerKey: %v", err))
+	}
+	if params.PublicPartitions == nil {
+		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.consume(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+		if err != nil {
+			return invalid(fmt.Errorf("Couldn't consume partition selection budget for ProportionPerKey: %v", err))
+		}
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ProportionPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("ProportionPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ProportionPerKey: %v", err))
+	}
+	meanParams, err := proportionMeanParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.ProportionPerKey: %v", err))
+	}
+	spec.aggregationRegistered("ProportionPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for ProportionPerKey: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID, and aggregate
+	// the values of each <id, partition> into the number of records and of
+	// records satisfying the predicate. Per-partition contribution bounding is
+	// done when adding the aggregates to the mean.
+	// Result is PCollection<kv.Pair{ID,K},ClientAggregate>.
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+	aggregates := beam.ParDo(s, toProportionAggregate, decoded)
+	if params.PerPrivacyUnit {
+		aggregates = beam.CombinePerKey(s, mergeProportionAggregatesPerPrivacyUnit, aggregates)
+	} else {
+		aggregates = beam.CombinePerKey(s, mergeClientAggregates, aggregates)
+	}
+
+	// Result is PCollection<ID, pairClientAggregate>.
+	rekeyed := beam.ParDo(s, rekeyClientAggregate, aggregates)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, ClientAggregate>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairClientAggregateFn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Compute the proportion for each partition. Result is PCollection<partition, *ProportionResult>.
+	proportionFn, err := newProportionFn(*spec, meanParams, noiseKind, params.PublicPartitions != nil, params.ConfidenceIntervalAlpha)
+	if err != nil {
+		log.Fatalf("Couldn't get proportionFn for ProportionPerKey: %v", err)
+	}
+	proportions := beam.CombinePerKey(s, proportionFn, partialKV)
+	reportNoiseDraws(s, proportions)
+	if params.PublicPartitions == nil {
+		// Drop thresholded partitions.
+		return beam.ParDo(s, dropThresholdedPartitionsProportion, proportions)
+	}
+	// Add noisy proportions for empty public partitions.
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptyAggregateToPublicPartitions, publicPartitions)
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, proportionFn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	proportions = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, proportions, noisyEmptyPublicPartitions))
+	return beam.ParDo(s, dereferenceProportionResult, proportions)
+}
+
+// proportionMeanParams checks params, and returns the params of the mean of
+// the values as 0 or 1 computing the proportion.
+func proportionMeanParams(params ProportionParams, noiseKind noise.Kind, partitionType reflect.Type) (MeanParams, error) {
+	maxContributionsPerPartition := params.MaxContributionsPerPartition
+	if params.PerPrivacyUnit {
+		if maxContributionsPerPartition != 0 {
+			return MeanParams{}, fmt.Errorf("MaxContributionsPerPartition must be unset when PerPrivacyUnit is set, got %d", maxContributionsPerPartition)
+		}
+		maxContributionsPerPartition = 1
+	}
+	if err := checks.CheckAlpha(params.ConfidenceIntervalAlpha); err != nil {
+		return MeanParams{}, err
+	}
+	meanParams := MeanParams{
+		NoiseKind:                    params.NoiseKind,
+		AggregationEpsilon:           params.AggregationEpsilon,
+		AggregationDelta:             params.AggregationDelta,
+		PartitionSelectionParams:     params.PartitionSelectionParams,
+		PublicPartitions:             params.PublicPartitions,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: maxContributionsPerPartition,
+		MinValue:                     0,
+		MaxValue:                     1,
+	}
+	if err := checkMeanPerKeyParams(meanParams, noiseKind, partitionType); err != nil {
+		return MeanParams{}, err
+	}
+	return meanParams, nil
+}
+
+// toProportionAggregate turns a value into the ClientAggregate of a single
+// record, whose sum is 1 if the record satisfies the predicate and 0 otherwise.
+func toProportionAggregate(k kv.Pair, v bool) (kv.Pair, ClientAggregate) {
+	if v {
+		return k, ClientAggregate{Sum: 1, Count: 1}
+	}
+	return k, ClientAggregate{Sum: 0, Count: 1}
+}
+
+// mergeProportionAggregatesPerPrivacyUnit merges the records of a privacy
+// identifier in a partition into a single one, which satisfies the predicate
+// if any of them does.
+func mergeProportionAggregatesPerPrivacyUnit(a, b ClientAggregate) ClientAggregate {
+	return ClientAggregate{Sum: max(a.Sum, b.Sum), Count: 1}
+}
+
+func addEmptyAggregateToPublicPartitions(partition beam.W) (beam.W, ClientAggregate) {
+	return partition, ClientAggregate{}
+}
+
+// proportionFn is a differentially private combineFn for obtaining the
+// proportion of records satisfying a predicate, with its confidence interval.
+// It is a clientAggregateMeanFn on values in [0, 1]. Do not initialize it
+// yourself, use newProportionFn to create a proportionFn instance.
+type proportionFn struct {
+	MeanFn *clientAggregateMeanFn
+	Alpha  float64
+}
+
+// newProportionFn returns a proportionFn with the given budget and parameters.
+func newProportionFn(spec PrivacySpec, params MeanParams, noiseKind noise.Kind, publicPartitions bool, alpha float64) (*proportionFn, error) {
+	meanFn, err := newClientAggregateMeanFn(spec, params, noiseKind, publicPartitions)
+	if err != nil {
+		return nil, err
+	}
+	return &proportionFn{MeanFn: meanFn, Alpha: alpha}, nil
+}
+
+func (fn *proportionFn) Setup() {
+	fn.MeanFn.Setup()
+}
+
+func (fn *proportionFn) CreateAccumulator() (boundedMeanAccum, error) {
+	return fn.MeanFn.CreateAccumulator()
+}
+
+func (fn *proportionFn) AddInput(a boundedMeanAccum, agg ClientAggregate) (boundedMeanAccum, error) {
+	return fn.MeanFn.AddInput(a, agg)
+}
+
+func (fn *proportionFn) MergeAccumulators(a, b boundedMeanAccum) (boundedMeanAccum, error) {
+	return fn.MeanFn.MergeAccumulators(a, b)
+}
+
+func (fn *proportionFn) ExtractOutput(a boundedMeanAccum) (*ProportionResult, error) {
+	keep, err := fn.MeanFn.MeanFn.keepPartition(a)
+	if err != nil || !keep {
+		return nil, err
+	}
+	proportion, err := a.BM.Result()
+	if err != nil {
+		return nil, err
+	}
+	confInt, err := a.BM.ComputeConfidenceInterval(fn.Alpha)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compute confidence interval: %w", err)
+	}
+	return &ProportionResult{
+		Proportion: proportion,
+		LowerBound: confInt.LowerBound,
+		UpperBound: confInt.UpperBound,
+	}, nil
+}
+
+func (fn *proportionFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+// dropThresholdedPartitionsProportion drops thresholded partitions, i.e. those
+// that have nil r, by emitting only non-thresholded partitions.
+func dropThresholdedPartitionsProportion(v beam.V, r *ProportionResult, emit func(beam.V, ProportionResult)) {
+	if r != nil {
+		emit(v, *r)
+	}
+}
+
+func dereferenceProportionResult(key beam.W, value *ProportionResult) (k beam.W, v ProportionResult) {
+	return key, *value
+}
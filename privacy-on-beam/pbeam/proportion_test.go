@@ -0,0 +1,135 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, ProportionResult, string](checkProportionQuarterFn)
+}
+
+type proportionRecord struct {
+	ID        int  `pbeam:"privacy_id"`
+	Partition int  `pbeam:"partition"`
+	Satisfied bool `pbeam:"value"`
+}
+
+// checkProportionQuarterFn returns "ok" if the proportion and its confidence
+// interval are 0.25, as expected without noise.
+func checkProportionQuarterFn(partition int, r ProportionResult) string {
+	for _, v := range []float64{r.Proportion, r.LowerBound, r.UpperBound} {
+		if math.Abs(v-0.25) > 1e-9 {
+			return fmt.Sprintf("partition %d: got %+v, want a proportion of 0.25", partition, r)
+		}
+	}
+	return "ok"
+}
+
+// Checks that ProportionPerKey computes the proportion of records or privacy
+// units satisfying the predicate.
+func TestProportionPerKeyNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc           string
+		perPrivacyUnit bool
+		records        func(id int) []bool
+	}{
+		{"records", false, func(id int) []bool {
+			// 3 records per privacy unit, and one in four records satisfies the predicate.
+			if id%4 == 0 {
+				return []bool{true, true, true}
+			}
+			return []bool{false, false, false}
+		}},
+		{"privacy units", true, func(id int) []bool {
+			// One in four privacy units has a record satisfying the predicate.
+			if id%4 == 0 {
+				return []bool{false, true}
+			}
+			return []bool{false, false}
+		}},
+	} {
+		var records []proportionRecord
+		for id := 0; id < 400; id++ {
+			for _, satisfied := range tc.records(id) {
+				records = append(records, proportionRecord{ID: id, Partition: 0, Satisfied: satisfied})
+			}
+		}
+		p, s, col := ptest.CreateList(records)
+		pcol := MakePrivateFromStruct(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           TestModeWithoutContributionBounding,
+			}), "")
+		params := ProportionParams{
+			MaxPartitionsContributed: 1,
+			PerPrivacyUnit:           tc.perPrivacyUnit,
+			PublicPartitions:         []int{0},
+		}
+		if !tc.perPrivacyUnit {
+			params.MaxContributionsPerPartition = 3
+		}
+		got := ProportionPerKey(s, pcol, params)
+
+		passert.Equals(s, beam.ParDo(s, checkProportionQuarterFn, got), "ok")
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("ProportionPerKey with %s did not return the expected proportion: %v", tc.desc, err)
+		}
+	}
+}
+
+func TestProportionMeanParams(t *testing.T) {
+	valid := ProportionParams{
+		AggregationEpsilon:           1,
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 2,
+		PublicPartitions:             []int{0},
+		ConfidenceIntervalAlpha:      0.05,
+	}
+	for _, tc := range []struct {
+		desc    string
+		update  func(*ProportionParams)
+		wantErr bool
+	}{
+		{"valid", func(*ProportionParams) {}, false},
+		{"per privacy unit", func(p *ProportionParams) { p.PerPrivacyUnit, p.MaxContributionsPerPartition = true, 0 }, false},
+		{"per privacy unit with MaxContributionsPerPartition", func(p *ProportionParams) { p.PerPrivacyUnit = true }, true},
+		{"no MaxContributionsPerPartition", func(p *ProportionParams) { p.MaxContributionsPerPartition = 0 }, true},
+		{"invalid alpha", func(p *ProportionParams) { p.ConfidenceIntervalAlpha = 1 }, true},
+		{"no MaxPartitionsContributed", func(p *ProportionParams) { p.MaxPartitionsContributed = 0 }, true},
+	} {
+		params := valid
+		tc.update(&params)
+		meanParams, err := proportionMeanParams(params, noise.LaplaceNoise, reflect.TypeOf(0))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("proportionMeanParams with %s: got err=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if err == nil && (meanParams.MinValue != 0 || meanParams.MaxValue != 1) {
+			t.Errorf("proportionMeanParams with %s: got bounds [%f, %f], want [0, 1]", tc.desc, meanParams.MinValue, meanParams.MaxValue)
+		}
+	}
+}
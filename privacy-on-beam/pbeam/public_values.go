@@ -0,0 +1,126 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(ValueWithPublic{}))
+	register.Function2x2[beam.W, int64, beam.W, float64](int64ValueToFloat64)
+	register.Function4x1[beam.W, func(*float64) bool, func(*float64) bool, func(beam.W, ValueWithPublic), error](attachPublicValue)
+	register.Iter1[float64]()
+	register.Emitter2[beam.W, ValueWithPublic]()
+}
+
+// PublicPCollection is a PCollection<K,float64> of values that are publicly
+// known for each partition K, e.g. the total population that a partition
+// corresponds to. It can only be created with MakePublic, which declares that
+// its values are public.
+type PublicPCollection struct {
+	col beam.PCollection
+}
+
+// MakePublic declares that col, a PCollection<K,float64>, holds publicly known
+// values, which can then be attached to the outputs of aggregations with
+// WithPublicValues without consuming privacy budget.
+//
+// The values must not be derived from private data: they are released as is.
+// In particular, they must not come from the input of a PrivatePCollection.
+func MakePublic(s beam.Scope, col beam.PCollection) PublicPCollection {
+	if !col.IsValid() {
+		log.Fatalf("pbeam.MakePublic: col must be a valid PCollection")
+	}
+	if !typex.IsKV(col.Type()) {
+		log.Fatalf("pbeam.MakePublic: col must be a PCollection<K,float64>, got %v", col.Type())
+	}
+	if _, vT := beam.ValidateKVType(col); vT.Type() != reflect.TypeOf(float64(0)) {
+		log.Fatalf("pbeam.MakePublic: col must be a PCollection<K,float64>, got value type %v", vT.Type())
+	}
+	return PublicPCollection{col: col}
+}
+
+// ValueWithPublic is the output of WithPublicValues for a single partition.
+type ValueWithPublic struct {
+	// Value is the differentially private output of the aggregation.
+	Value float64
+	// Public is the public value of the partition.
+	Public float64
+}
+
+// WithPublicValues attaches the public value of each partition in public to
+// the output of an aggregation, so that they can be used together downstream,
+// e.g. to compute rates. It doesn't consume privacy budget: the outputs of
+// aggregations are differentially private, and the values of public were
+// declared public with MakePublic.
+//
+// Every partition of col must have exactly one public value, otherwise the
+// pipeline fails. Public values of partitions that are not in col are dropped,
+// so that the output only has the partitions of the aggregation.
+//
+// WithPublicValues transforms col, a PCollection<K,int64> or a
+// PCollection<K,float64> output by an aggregation, into a
+// PCollection<K,ValueWithPublic>.
+func WithPublicValues(s beam.Scope, col beam.PCollection, public PublicPCollection) beam.PCollection {
+	s = s.Scope("pbeam.WithPublicValues")
+	if !public.col.IsValid() {
+		log.Fatalf("pbeam.WithPublicValues: public values must be created with MakePublic")
+	}
+	kT, vT := beam.ValidateKVType(col)
+	if publicKT, _ := beam.ValidateKVType(public.col); publicKT.Type() != kT.Type() {
+		log.Fatalf("pbeam.WithPublicValues: public values have key type %v, must match the key type %v of col", publicKT.Type(), kT.Type())
+	}
+	switch vT.Type() {
+	case reflect.TypeOf(int64(0)):
+		col = beam.ParDo(s, int64ValueToFloat64, col)
+	case reflect.TypeOf(float64(0)):
+	default:
+		log.Fatalf("pbeam.WithPublicValues: col must have int64 or float64 values, got %v", vT.Type())
+	}
+	grouped := beam.CoGroupByKey(s, col, public.col)
+	return beam.ParDo(s, attachPublicValue, grouped)
+}
+
+func int64ValueToFloat64(k beam.W, v int64) (beam.W, float64) {
+	return k, float64(v)
+}
+
+// attachPublicValue outputs the value of a partition with its public value,
+// after a CoGroupByKey of the output of an aggregation and of public values.
+func attachPublicValue(k beam.W, valueIter func(*float64) bool, publicIter func(*float64) bool, emit func(beam.W, ValueWithPublic)) error {
+	var value float64
+	if !valueIter(&value) {
+		// The partition is not in the output of the aggregation.
+		return nil
+	}
+	var public, other float64
+	if !publicIter(&public) {
+		return fmt.Errorf("no public value for partition %v", k)
+	}
+	if publicIter(&other) {
+		return fmt.Errorf("more than one public value for partition %v", k)
+	}
+	emit(k, ValueWithPublic{Value: value, Public: public})
+	return nil
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x2[int, ValueWithPublic, int, float64](valueWithPublicValueFn)
+	register.Function2x2[int, ValueWithPublic, int, float64](valueWithPublicPublicFn)
+}
+
+func valueWithPublicValueFn(k int, v ValueWithPublic) (int, float64)  { return k, v.Value }
+func valueWithPublicPublicFn(k int, v ValueWithPublic) (int, float64) { return k, v.Public }
+
+// Checks that WithPublicValues attaches public values to the partitions of
+// the output of an aggregation, and drops the other public values.
+func TestWithPublicValues(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 5, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(5, 20, 1),
+	)
+	publicValues := []testutils.PairIF64{{0, 10}, {1, 40}, {2, 100}}
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	public := MakePublic(s, beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, publicValues)))
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	counts := Count(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+	got := WithPublicValues(s, counts, public)
+
+	wantValues := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{0, 5}, {1, 20}}))
+	wantPublic := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{0, 10}, {1, 40}}))
+	testutils.EqualsKVFloat64(t, s, beam.ParDo(s, valueWithPublicValueFn, got), wantValues)
+	testutils.EqualsKVFloat64(t, s, beam.ParDo(s, valueWithPublicPublicFn, got), wantPublic)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestWithPublicValues: WithPublicValues(%v) = %v: %v", counts, got, err)
+	}
+}
+
+// Checks that WithPublicValues fails when an output partition has no public
+// value.
+func TestWithPublicValuesMissingPublicValueFails(t *testing.T) {
+	pairs := testutils.MakePairsWithFixedV(10, 0)
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	public := MakePublic(s, beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{1, 10}})))
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	counts := Count(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0},
+	})
+	WithPublicValues(s, counts, public)
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestWithPublicValuesMissingPublicValueFails: got no error, want error")
+	}
+}
@@ -17,6 +17,7 @@
 package pbeam
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 
@@ -31,6 +32,13 @@ import (
 
 func init() {
 	register.Combiner2[boundedQuantilesAccum, []float64](&boundedQuantilesFn{})
+	beam.RegisterType(reflect.TypeOf(QuantileResult{}))
+	register.DoFn2x2[beam.W, []float64, beam.W, []QuantileResult](&toQuantileResultsFn{})
+	beam.RegisterType(reflect.TypeOf(DistributionPoint{}))
+	register.DoFn2x2[beam.W, []float64, beam.W, []DistributionPoint](&toDistributionPointsFn{})
+	beam.RegisterType(reflect.TypeOf(quantilesStateSize{}))
+	register.Combiner3[boundedQuantilesAccum, []float64, quantilesStateSize](&quantilesStateSizeFn{})
+	register.DoFn3x0[context.Context, beam.W, quantilesStateSize](&recordQuantilesStateSizeFn{})
 }
 
 // QuantilesParams specifies the parameters associated with a Quantiles aggregation.
@@ -121,6 +129,54 @@ type QuantilesParams struct {
 	// i.e. computing multiple quantiles does not make each quantile less accurate
 	// for a fixed privacy budget.
 	Ranks []float64
+	// If true, the sizes of the per-partition quantile trees are reported in
+	// the Beam distribution metrics "serialized_state_bytes" and
+	// "memory_footprint_bytes" of the "pbeam.QuantilesPerKey" namespace. They
+	// can be used to predict the shuffle volume and memory usage of larger
+	// jobs.
+	//
+	// These metrics aren't differentially private, and computing them requires
+	// an additional combine over the data.
+	//
+	// Optional.
+	ReportStateSizes bool
+	// If set, values are clamped to [MinValue, MaxValue] and transformed before
+	// computing the quantiles, e.g. with LogTransform{} so that the bounds can
+	// span several orders of magnitude. The quantiles are computed on the
+	// transformed values and mapped back to the original units with the inverse
+	// of the transform, which is exact since quantiles commute with increasing
+	// transforms.
+	//
+	// Optional.
+	Transform Transform
+	// Confidence intervals output by QuantilesWithConfidenceIntervalsPerKey
+	// contain the raw quantiles with probability at least
+	// 1-ConfidenceIntervalAlpha. Ignored by QuantilesPerKey.
+	//
+	// Defaults to 0.05.
+	ConfidenceIntervalAlpha float64
+	// Number of points of the approximate CDF output by DistributionPerKey.
+	// Ignored by QuantilesPerKey.
+	//
+	// Defaults to DefaultDistributionPoints.
+	NumDistributionPoints int64
+}
+
+// DefaultDistributionPoints is the number of points of the approximate CDF
+// output by DistributionPerKey when QuantilesParams.NumDistributionPoints
+// isn't set.
+const DefaultDistributionPoints = 100
+
+// QuantileResult is a quantile output by QuantilesWithConfidenceIntervalsPerKey.
+type QuantileResult struct {
+	// Rank of the quantile, as specified in QuantilesParams.Ranks.
+	Rank float64
+	// Quantile is the differentially private quantile, as output by
+	// QuantilesPerKey.
+	Quantile float64
+	// LowerBound and UpperBound are the bounds of the confidence interval of
+	// the quantile.
+	LowerBound, UpperBound float64
 }
 
 // QuantilesPerKey computes one or multiple quantiles of the values associated with each
@@ -145,44 +201,149 @@ type QuantilesParams struct {
 //     bounding will be disabled.
 func QuantilesPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesParams) beam.PCollection {
 	s = s.Scope("pbeam.QuantilesPerKey")
+	params.ConfidenceIntervalAlpha = 0
+	return quantilesPerKeyWithBudget(s, pcol, params)
+}
+
+// QuantilesWithConfidenceIntervalsPerKey computes the same quantiles as
+// QuantilesPerKey, along with confidence intervals that contain the raw
+// quantiles of the clamped values with probability at least
+// 1-params.ConfidenceIntervalAlpha. The confidence intervals propagate the
+// noise of the quantile tree, so they don't consume additional privacy budget;
+// they are conservative, and don't account for contribution bounding.
+//
+// QuantilesWithConfidenceIntervalsPerKey transforms a PrivatePCollection<K,V>
+// into a PCollection<K,[]QuantileResult>, with one QuantileResult per rank.
+func QuantilesWithConfidenceIntervalsPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesParams) beam.PCollection {
+	s = s.Scope("pbeam.QuantilesWithConfidenceIntervalsPerKey")
+	if params.ConfidenceIntervalAlpha == 0 {
+		params.ConfidenceIntervalAlpha = defaultConfidenceIntervalAlpha
+	}
+	quantiles := quantilesPerKeyWithBudget(s, pcol, params)
+	return beam.ParDo(s, &toQuantileResultsFn{Ranks: params.Ranks}, quantiles)
+}
+
+// DistributionPoint is a point of the approximate CDF output by
+// DistributionPerKey: about a fraction CumulativeFraction of the values of the
+// partition are smaller than or equal to Value.
+type DistributionPoint struct {
+	Value              float64
+	CumulativeFraction float64
+}
+
+// DistributionPerKey computes an approximate cumulative distribution function
+// (CDF) of the values associated with each key in a PrivatePCollection<K,V>.
+// The CDF is made of params.NumDistributionPoints quantiles of evenly spaced
+// ranks 1/n, 2/n, …, 1, read from a single quantile tree per partition: like
+// computing multiple quantiles with QuantilesPerKey, this doesn't consume
+// more budget than computing a single quantile.
+//
+// params.Ranks must be left unset. All other parameters have the same meaning
+// as for QuantilesPerKey, and the same caveats apply when using pbeamtest.
+//
+// DistributionPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,[]DistributionPoint>, with points in increasing order.
+func DistributionPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesParams) beam.PCollection {
+	s = s.Scope("pbeam.DistributionPerKey")
+	if params.Ranks != nil {
+		log.Fatalf("pbeam.DistributionPerKey: Ranks must be unset, use NumDistributionPoints instead")
+	}
+	if params.NumDistributionPoints == 0 {
+		params.NumDistributionPoints = DefaultDistributionPoints
+	}
+	if params.NumDistributionPoints < 0 {
+		log.Fatalf("pbeam.DistributionPerKey: NumDistributionPoints must be positive, got %d", params.NumDistributionPoints)
+	}
+	params.Ranks = distributionRanks(params.NumDistributionPoints)
+	params.ConfidenceIntervalAlpha = 0
+	quantiles := quantilesPerKeyWithBudget(s, pcol, params)
+	return beam.ParDo(s, &toDistributionPointsFn{Ranks: params.Ranks}, quantiles)
+}
+
+// distributionRanks returns the n evenly spaced ranks 1/n, 2/n, …, 1.
+func distributionRanks(n int64) []float64 {
+	ranks := make([]float64, n)
+	for i := range ranks {
+		ranks[i] = float64(i+1) / float64(n)
+	}
+	return ranks
+}
+
+// toDistributionPointsFn pairs the quantiles output by boundedQuantilesFn with
+// their ranks.
+type toDistributionPointsFn struct {
+	Ranks []float64
+}
+
+func (fn *toDistributionPointsFn) ProcessElement(k beam.W, v []float64) (beam.W, []DistributionPoint) {
+	points := make([]DistributionPoint, len(fn.Ranks))
+	for i, rank := range fn.Ranks {
+		points[i] = DistributionPoint{Value: v[i], CumulativeFraction: rank}
+	}
+	return k, points
+}
+
+// quantilesPerKeyWithBudget gets the budget of QuantilesPerKey, checks params
+// and computes the quantiles. If params.ConfidenceIntervalAlpha is set, the
+// output values are flattened quantiles and confidence intervals, as output by
+// boundedQuantilesFn.
+func quantilesPerKeyWithBudget(s beam.Scope, pcol PrivatePCollection, params QuantilesParams) beam.PCollection {
+	pcol = extractTaggedStructFields(s, pcol, true)
 	// Obtain & validate type information from the underlying PCollection<K,V>.
-	idT, kvT := beam.ValidateKVType(pcol.col)
+	_, kvT := beam.ValidateKVType(pcol.col)
 	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
 		log.Fatalf("QuantilesPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
 	}
 	if pcol.codec == nil {
 		log.Fatalf("QuantilesPerKey: no codec found for the input PrivatePCollection.")
 	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "QuantilesPerKey", err, pcol.codec.KType.T, reflect.TypeOf([]float64(nil)))
+	}
 
 	// Get privacy parameters.
 	spec := pcol.privacySpec
 	var err error
 
-	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.get(params.AggregationEpsilon, params.AggregationDelta)
+	budget, err := spec.reserveBudget("QuantilesPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
 	if err != nil {
-		log.Fatalf("Couldn't consume aggregation budget for Quantiles: %v", err)
-	}
-	if params.PublicPartitions == nil {
-		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.get(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
-		if err != nil {
-			log.Fatalf("Couldn't consume partition selection budget for Quantiles: %v", err)
-		}
+		return invalid(err)
 	}
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.QuantilesPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("QuantilesPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.QuantilesPerKey: %v", err))
 	}
 
 	err = checkQuantilesPerKeyParams(params, noiseKind, pcol.codec.KType.T)
 	if err != nil {
-		log.Fatalf("pbeam.QuantilesPerKey: %v", err)
+		return invalid(fmt.Errorf("pbeam.QuantilesPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("QuantilesPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+	pcol = applyTransform(s, "QuantilesPerKey", pcol, params.Transform, &params.MinValue, &params.MaxValue)
+	result := quantilesPerKey(s, pcol, params, noiseKind)
+	if params.Transform != nil {
+		result = invertTransformSlice(s, params.Transform, result)
 	}
+	return result
+}
+
+// quantilesPerKey computes QuantilesPerKey on pcol, whose budget must already
+// be accounted for and params checked.
+func quantilesPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesParams, noiseKind noise.Kind) beam.PCollection {
+	idT, _ := beam.ValidateKVType(pcol.col)
+	spec := pcol.privacySpec
 
 	// Drop non-public partitions, if public partitions are specified.
+	var err error
 	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
 	if err != nil {
 		log.Fatalf("Couldn't drop non-public partitions for Quantiles: %v", err)
@@ -190,15 +351,11 @@ func QuantilesPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesPara
 
 	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
 	// Result is PCollection<kv.Pair{ID,K},V>
-	decoded := beam.ParDo(s,
-		newEncodeIDKFn(idT, pcol.codec),
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
 		pcol.col,
 		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
-
-	// Don't do per-partition contribution bounding if in test mode without contribution bounding.
-	if spec.testMode != TestModeWithoutContributionBounding {
-		decoded = boundContributions(s, decoded, params.MaxContributionsPerPartition)
-	}
+	decoded = saltPrivacyIDs(s, spec, decoded)
 
 	// Convert value to float64.
 	// Result is PCollection<kv.Pair{ID,K},float64>.
@@ -206,19 +363,22 @@ func QuantilesPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesPara
 	if err := checkNumericType(valueT); err != nil {
 		log.Fatalf("QuantilesPerKey: %v", err)
 	}
-	converted := beam.ParDo(s, convertToFloat64Fn, decoded)
+	converted := convertValues(s, spec, reflect.Float64, decoded)
 
-	// Combine all values for <id, partition> into a slice.
+	// Combine all values for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition values unless in test mode without contribution bounding.
 	// Result is PCollection<kv.Pair{ID,K},[]float64>.
 	combined := beam.CombinePerKey(s,
-		&expandFloat64ValuesCombineFn{},
+		newExpandFloat64ValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)),
 		converted)
+	combined = traceStage(s, *spec, "QuantilesPerKey.boundContributionsPerPartition", combined)
 
 	// Result is PCollection<ID, pairArrayFloat64>.
 	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
 	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
 	if spec.testMode != TestModeWithoutContributionBounding {
 		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "QuantilesPerKey.boundContributions", rekeyed)
 	}
 
 	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
@@ -230,6 +390,10 @@ func QuantilesPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesPara
 		partialPairs,
 		beam.TypeDefinition{Var: beam.WType, T: partitionT})
 
+	if params.ReportStateSizes {
+		reportQuantilesStateSizes(s, *spec, params, noiseKind, partialKV)
+	}
+
 	var result beam.PCollection
 	// Add public partitions and return the aggregation output, if public partitions are specified.
 	if params.PublicPartitions != nil {
@@ -243,6 +407,8 @@ func QuantilesPerKey(s beam.Scope, pcol PrivatePCollection, params QuantilesPara
 		quantiles := beam.CombinePerKey(s,
 			boundedQuantilesFn,
 			partialKV)
+		quantiles = traceStage(s, *spec, "QuantilesPerKey.aggregate", quantiles)
+		reportNoiseDraws(s, quantiles)
 		// Finally, drop thresholded partitions.
 		result = beam.ParDo(s, dropThresholdedPartitionsFloat64Slice, quantiles)
 	}
@@ -264,13 +430,28 @@ func addPublicPartitionsForQuantiles(s beam.Scope, spec PrivacySpec, params Quan
 		log.Fatalf("Couldn't get boundedMeanFn for MeanPerKey: %v", err)
 	}
 	noisyEmptyPublicPartitions := beam.CombinePerKey(s, boundedQuantilesFn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
 	// Third, compute noisy quantiles for partitions in the actual data.
 	quantiles := beam.CombinePerKey(s, boundedQuantilesFn, partialKV)
+	quantiles = traceStage(s, spec, "QuantilesPerKey.aggregate", quantiles)
+	reportNoiseDraws(s, quantiles)
 	// Fourth, co-group by actual noisy means with noisy public partitions, emit noisy empty value for public partitions not found in data and return.
 	noisyQuantilesWithEmptyPublicPartitions := beam.CoGroupByKey(s, quantiles, noisyEmptyPublicPartitions)
 	return beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, noisyQuantilesWithEmptyPublicPartitions)
 }
 
+// reportQuantilesStateSizes records the sizes of the quantile trees that
+// boundedQuantilesFn computes for each partition of partialKV in Beam metrics.
+func reportQuantilesStateSizes(s beam.Scope, spec PrivacySpec, params QuantilesParams, noiseKind noise.Kind, partialKV beam.PCollection) {
+	s = s.Scope("ReportStateSizes")
+	boundedQuantilesFn, err := newBoundedQuantilesFn(spec, params, noiseKind, true)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedQuantilesFn for QuantilesPerKey: %v", err)
+	}
+	sizes := beam.CombinePerKey(s, &quantilesStateSizeFn{BQFn: boundedQuantilesFn}, partialKV)
+	beam.ParDo0(s, &recordQuantilesStateSizeFn{}, sizes)
+}
+
 func checkQuantilesPerKeyParams(params QuantilesParams, noiseKind noise.Kind, partitionType reflect.Type) error {
 	err := checkPublicPartitions(params.PublicPartitions, partitionType)
 	if err != nil {
@@ -307,6 +488,11 @@ func checkQuantilesPerKeyParams(params QuantilesParams, noiseKind noise.Kind, pa
 	if len(params.Ranks) == 0 {
 		return fmt.Errorf("there should at least be one rank to compute")
 	}
+	if params.ConfidenceIntervalAlpha != 0 {
+		if err := checks.CheckAlpha(params.ConfidenceIntervalAlpha); err != nil {
+			return err
+		}
+	}
 	for i, rank := range params.Ranks {
 		if rank < 0.0 || rank > 1.0 {
 			return fmt.Errorf("Ranks[%d]=%f must be >= 0 and <= 1", i, rank)
@@ -334,6 +520,7 @@ type boundedQuantilesFn struct {
 	PartitionSelectionEpsilon    float64
 	PartitionSelectionDelta      float64
 	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
 	MaxPartitionsContributed     int64
 	MaxContributionsPerPartition int64
 	Lower                        float64
@@ -341,13 +528,14 @@ type boundedQuantilesFn struct {
 	NoiseKind                    noise.Kind
 	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
 	Ranks                        []float64
-	PublicPartitions             bool // Set to true if public partitions are used.
+	ConfidenceIntervalAlpha      float64 // If set, each quantile is followed by the bounds of its confidence interval in the output.
+	PublicPartitions             bool    // Set to true if public partitions are used.
 	TestMode                     TestMode
 }
 
 // newBoundedQuantilesFn returns a boundedQuantilesFn with the given budget and parameters.
 func newBoundedQuantilesFn(spec PrivacySpec, params QuantilesParams, noiseKind noise.Kind, publicPartitions bool) (*boundedQuantilesFn, error) {
-	if noiseKind != noise.GaussianNoise && noiseKind != noise.LaplaceNoise {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
 		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
 	}
 	return &boundedQuantilesFn{
@@ -356,11 +544,13 @@ func newBoundedQuantilesFn(spec PrivacySpec, params QuantilesParams, noiseKind n
 		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
 		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
 		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
 		MaxPartitionsContributed:     params.MaxPartitionsContributed,
 		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
 		Lower:                        params.MinValue,
 		Upper:                        params.MaxValue,
 		Ranks:                        params.Ranks,
+		ConfidenceIntervalAlpha:      params.ConfidenceIntervalAlpha,
 		NoiseKind:                    noiseKind,
 		PublicPartitions:             publicPartitions,
 		TestMode:                     spec.testMode,
@@ -434,10 +624,11 @@ func (fn *boundedQuantilesFn) ExtractOutput(a boundedQuantilesAccum) ([]float64,
 	if fn.TestMode.isEnabled() {
 		a.BQ.Noise = noNoise{}
 	}
+	a.BQ.Noise = auditNoise(a.BQ.Noise, "BoundedQuantiles")
 	var err error
 	shouldKeepPartition := fn.TestMode.isEnabled() || a.PublicPartitions // If in test mode or public partitions are specified, we always keep the partition.
 	if !shouldKeepPartition {                                            // If not, we need to perform private partition selection.
-		shouldKeepPartition, err = a.SP.ShouldKeepPartition()
+		shouldKeepPartition, err = fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
 		if err != nil {
 			return nil, err
 		}
@@ -451,11 +642,97 @@ func (fn *boundedQuantilesFn) ExtractOutput(a boundedQuantilesAccum) ([]float64,
 				return nil, err
 			}
 		}
-		return result, nil
+		if fn.ConfidenceIntervalAlpha == 0 {
+			return result, nil
+		}
+		withConfInts := make([]float64, 0, 3*len(fn.Ranks))
+		for i, rank := range fn.Ranks {
+			confInt, err := a.BQ.ComputeConfidenceInterval(rank, fn.ConfidenceIntervalAlpha)
+			if err != nil {
+				return nil, err
+			}
+			withConfInts = append(withConfInts, result[i], confInt.LowerBound, confInt.UpperBound)
+		}
+		return withConfInts, nil
 	}
 	return nil, nil
 }
 
+// toQuantileResultsFn converts the flattened quantiles and confidence
+// intervals output by boundedQuantilesFn into QuantileResults.
+type toQuantileResultsFn struct {
+	Ranks []float64
+}
+
+func (fn *toQuantileResultsFn) ProcessElement(k beam.W, v []float64) (beam.W, []QuantileResult) {
+	results := make([]QuantileResult, len(fn.Ranks))
+	for i, rank := range fn.Ranks {
+		results[i] = QuantileResult{Rank: rank, Quantile: v[3*i], LowerBound: v[3*i+1], UpperBound: v[3*i+2]}
+	}
+	return k, results
+}
+
 func (fn *boundedQuantilesFn) String() string {
 	return fmt.Sprintf("%#v", fn)
 }
+
+func (fn *boundedQuantilesFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
+
+// quantilesStateSize contains the sizes of a BoundedQuantiles, in bytes.
+type quantilesStateSize struct {
+	SerializedBytes int64
+	MemoryBytes     int64
+}
+
+// quantilesStateSizeFn builds the same BoundedQuantiles as BQFn, but outputs
+// its sizes instead of quantiles.
+type quantilesStateSizeFn struct {
+	BQFn *boundedQuantilesFn
+}
+
+func (fn *quantilesStateSizeFn) Setup() {
+	fn.BQFn.Setup()
+}
+
+func (fn *quantilesStateSizeFn) CreateAccumulator() (boundedQuantilesAccum, error) {
+	return fn.BQFn.CreateAccumulator()
+}
+
+func (fn *quantilesStateSizeFn) AddInput(a boundedQuantilesAccum, values []float64) (boundedQuantilesAccum, error) {
+	return fn.BQFn.AddInput(a, values)
+}
+
+func (fn *quantilesStateSizeFn) MergeAccumulators(a, b boundedQuantilesAccum) (boundedQuantilesAccum, error) {
+	return fn.BQFn.MergeAccumulators(a, b)
+}
+
+func (fn *quantilesStateSizeFn) ExtractOutput(a boundedQuantilesAccum) (quantilesStateSize, error) {
+	serialized, err := a.BQ.SerializedSize()
+	if err != nil {
+		return quantilesStateSize{}, err
+	}
+	return quantilesStateSize{SerializedBytes: int64(serialized), MemoryBytes: int64(a.BQ.MemoryFootprint())}, nil
+}
+
+// recordQuantilesStateSizeFn records quantilesStateSize values in Beam metrics.
+type recordQuantilesStateSizeFn struct {
+	serializedBytes beam.Distribution
+	memoryBytes     beam.Distribution
+}
+
+func (fn *recordQuantilesStateSizeFn) Setup() {
+	fn.serializedBytes = beam.NewDistribution("pbeam.QuantilesPerKey", "serialized_state_bytes")
+	fn.memoryBytes = beam.NewDistribution("pbeam.QuantilesPerKey", "memory_footprint_bytes")
+}
+
+func (fn *recordQuantilesStateSizeFn) ProcessElement(ctx context.Context, _ beam.W, size quantilesStateSize) {
+	fn.serializedBytes.Update(ctx, size.SerializedBytes)
+	fn.memoryBytes.Update(ctx, size.MemoryBytes)
+}
@@ -17,6 +17,7 @@
 package pbeam
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -24,12 +25,48 @@ import (
 	"github.com/google/differential-privacy/go/v3/noise"
 	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
+func init() {
+	register.Function2x1[int, []QuantileResult, string](checkQuantileResultsFn)
+	register.Function2x2[int, []QuantileResult, int, []float64](quantileResultsToQuantilesFn)
+	register.Function2x2[int, []DistributionPoint, int, []float64](distributionPointsToValuesFn)
+}
+
+func distributionPointsToValuesFn(k int, points []DistributionPoint) (int, []float64) {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Value
+	}
+	return k, values
+}
+
+func quantileResultsToQuantilesFn(k int, results []QuantileResult) (int, []float64) {
+	quantiles := make([]float64, len(results))
+	for i, r := range results {
+		quantiles[i] = r.Quantile
+	}
+	return k, quantiles
+}
+
+// checkQuantileResultsFn returns "ok" if the confidence interval of each
+// quantile result contains its quantile, and a description of the results
+// otherwise.
+func checkQuantileResultsFn(k int, results []QuantileResult) string {
+	for _, r := range results {
+		if r.LowerBound > r.Quantile+1e-6 || r.UpperBound < r.Quantile-1e-6 {
+			return fmt.Sprintf("partition %d: %+v", k, results)
+		}
+	}
+	return "ok"
+}
+
 func TestNewBoundedQuantilesFn(t *testing.T) {
 	opts := []cmp.Option{
 		cmpopts.EquateApprox(0, 1e-10),
@@ -348,6 +385,54 @@ func TestBoundedQuantilesFnWithPartitionsExtractOutputDoesNotReturnNilForSmallPa
 }
 
 // Checks that QuantilesPerKey adds noise to its output.
+func TestQuantilesStateSizeFn(t *testing.T) {
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1})
+	bqFn, err := newBoundedQuantilesFn(
+		*spec,
+		QuantilesParams{
+			AggregationEpsilon:           1,
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinValue:                     0,
+			MaxValue:                     5,
+			Ranks:                        []float64{0.5},
+		},
+		noise.LaplaceNoise,
+		true)
+	if err != nil {
+		t.Fatalf("Couldn't get newBoundedQuantilesFn: %v", err)
+	}
+	fn := &quantilesStateSizeFn{BQFn: bqFn}
+	fn.Setup()
+
+	empty, err := fn.CreateAccumulator()
+	if err != nil {
+		t.Fatalf("Couldn't create accum: %v", err)
+	}
+	emptySize, err := fn.ExtractOutput(empty)
+	if err != nil {
+		t.Fatalf("Couldn't extract output: %v", err)
+	}
+	accum, err := fn.CreateAccumulator()
+	if err != nil {
+		t.Fatalf("Couldn't create accum: %v", err)
+	}
+	accum, err = fn.AddInput(accum, []float64{1.0, 4.0})
+	if err != nil {
+		t.Fatalf("Couldn't add input: %v", err)
+	}
+	got, err := fn.ExtractOutput(accum)
+	if err != nil {
+		t.Fatalf("Couldn't extract output: %v", err)
+	}
+	if got.SerializedBytes <= emptySize.SerializedBytes {
+		t.Errorf("ExtractOutput: got SerializedBytes=%d, want more than %d for an empty accumulator", got.SerializedBytes, emptySize.SerializedBytes)
+	}
+	if got.MemoryBytes <= emptySize.MemoryBytes {
+		t.Errorf("ExtractOutput: got MemoryBytes=%d, want more than %d for an empty accumulator", got.MemoryBytes, emptySize.MemoryBytes)
+	}
+}
+
 func TestQuantilesPerKeyAddsNoise(t *testing.T) {
 	for _, tc := range []struct {
 		name      string
@@ -548,6 +633,42 @@ func TestQuantilesPerKeyNoNoise(t *testing.T) {
 	}
 }
 
+// Checks that reporting state sizes doesn't change the output of QuantilesPerKey.
+func TestQuantilesPerKeyReportStateSizes(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, 1.0),
+		testutils.MakeTripleWithFloatValue(100, 0, 4.0))
+
+	wantMetric := []testutils.PairIF64Slice{
+		{0, []float64{1.0, 4.0}},
+	}
+	p, s, col, want := ptest.CreateList2(triples, wantMetric)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	lower, upper := 0.0, 5.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithoutContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := QuantilesPerKey(s, pcol, QuantilesParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 2,
+		MinValue:                     lower,
+		MaxValue:                     upper,
+		Ranks:                        []float64{0.25, 0.75},
+		PublicPartitions:             []int{0},
+		ReportStateSizes:             true,
+	})
+
+	want = beam.ParDo(s, testutils.PairIF64SliceToKV, want)
+	testutils.ApproxEqualsKVFloat64Slice(t, s, got, want, testutils.QuantilesTolerance(lower, upper))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("QuantilesPerKey with ReportStateSizes did not return approximate quantile: %v", err)
+	}
+}
+
 // Checks that QuantilesPerKey with partitions returns a correct answer.
 func TestQuantilesPerKeyWithPartitionsNoNoise(t *testing.T) {
 	// We have two test cases, one for public partitions as a PCollection and one for public partitions as a slice (i.e., in-memory).
@@ -1385,3 +1506,120 @@ func TestQuantilesPerKeyPreThresholding(t *testing.T) {
 		t.Errorf("TestQuantilesPerKeyPreThresholding: %v", err)
 	}
 }
+
+// Checks that QuantilesWithConfidenceIntervalsPerKey outputs the quantiles of
+// QuantilesPerKey with confidence intervals containing them.
+func TestQuantilesWithConfidenceIntervalsPerKey(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, 1.0),
+		testutils.MakeTripleWithFloatValue(100, 0, 4.0))
+	wantMetric := []testutils.PairIF64Slice{
+		{0, []float64{1.0, 4.0}},
+	}
+	p, s, col, want := ptest.CreateList2(triples, wantMetric)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	lower, upper := 0.0, 5.0
+	ranks := []float64{0.25, 0.75}
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	params := QuantilesParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 2,
+		MinValue:                     lower,
+		MaxValue:                     upper,
+		Ranks:                        ranks,
+		PublicPartitions:             []int{0},
+	}
+	got := QuantilesWithConfidenceIntervalsPerKey(s, pcol, params)
+
+	passert.Equals(s, beam.ParDo(s, checkQuantileResultsFn, got), "ok")
+	quantiles := beam.ParDo(s, quantileResultsToQuantilesFn, got)
+	want = beam.ParDo(s, testutils.PairIF64SliceToKV, want)
+	testutils.ApproxEqualsKVFloat64Slice(t, s, quantiles, want, testutils.QuantilesTolerance(lower, upper))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestQuantilesWithConfidenceIntervalsPerKey: QuantilesWithConfidenceIntervalsPerKey(%v) = %v, want quantiles %v with confidence intervals containing them: %v", col, got, want, err)
+	}
+}
+
+// Checks that DistributionPerKey outputs the quantiles of evenly spaced ranks.
+func TestDistributionPerKey(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(300, 0, 1.0),
+		testutils.MakeTripleWithFloatValueStartingFromKey(300, 200, 0, 2.0),
+		testutils.MakeTripleWithFloatValueStartingFromKey(500, 200, 0, 3.0),
+		testutils.MakeTripleWithFloatValueStartingFromKey(700, 100, 0, 4.0))
+	// Ranks 0.25, 0.5, 0.75 and 1 fall in the values 1, 2, 3 and 4 respectively.
+	wantMetric := []testutils.PairIF64Slice{
+		{0, []float64{1.0, 2.0, 3.0, 4.0}},
+	}
+	p, s, col, want := ptest.CreateList2(triples, wantMetric)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	lower, upper := 0.0, 5.0
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := DistributionPerKey(s, pcol, QuantilesParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     lower,
+		MaxValue:                     upper,
+		PublicPartitions:             []int{0},
+		NumDistributionPoints:        4,
+	})
+
+	values := beam.ParDo(s, distributionPointsToValuesFn, got)
+	want = beam.ParDo(s, testutils.PairIF64SliceToKV, want)
+	testutils.ApproxEqualsKVFloat64Slice(t, s, values, want, testutils.QuantilesTolerance(lower, upper))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestDistributionPerKey: DistributionPerKey(%v) = %v, want values %v: %v", col, got, want, err)
+	}
+}
+
+func TestToDistributionPointsFn(t *testing.T) {
+	fn := &toDistributionPointsFn{Ranks: distributionRanks(4)}
+	_, got := fn.ProcessElement(0, []float64{1, 2, 3, 4})
+	want := []DistributionPoint{
+		{Value: 1, CumulativeFraction: 0.25},
+		{Value: 2, CumulativeFraction: 0.5},
+		{Value: 3, CumulativeFraction: 0.75},
+		{Value: 4, CumulativeFraction: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("toDistributionPointsFn: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestToQuantileResultsFn(t *testing.T) {
+	fn := &toQuantileResultsFn{Ranks: []float64{0.1, 0.9}}
+	_, got := fn.ProcessElement(0, []float64{1, 0.5, 1.5, 9, 8, 10})
+	want := []QuantileResult{
+		{Rank: 0.1, Quantile: 1, LowerBound: 0.5, UpperBound: 1.5},
+		{Rank: 0.9, Quantile: 9, LowerBound: 8, UpperBound: 10},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("toQuantileResultsFn: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckQuantilesPerKeyParamsConfidenceIntervalAlpha(t *testing.T) {
+	params := QuantilesParams{
+		AggregationEpsilon:           1,
+		PublicPartitions:             []int{0},
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     1,
+		Ranks:                        []float64{0.5},
+		ConfidenceIntervalAlpha:      1.5,
+	}
+	if err := checkQuantilesPerKeyParams(params, noise.LaplaceNoise, reflect.TypeOf(0)); err == nil {
+		t.Errorf("checkQuantilesPerKeyParams with ConfidenceIntervalAlpha=1.5: got no error, want error")
+	}
+}
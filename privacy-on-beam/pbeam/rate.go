@@ -0,0 +1,248 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(RateResult{}))
+	register.DoFn4x1[beam.W, func(*int64) bool, func(*float64) bool, func(beam.W, RateResult), error](&rateFn{})
+	register.Iter1[float64]()
+	register.Emitter2[beam.W, RateResult]()
+}
+
+// defaultConfidenceIntervalAlpha is the default alpha for confidence intervals
+// computed on the outputs of aggregations.
+const defaultConfidenceIntervalAlpha = 0.05
+
+// RateParams specifies the parameters associated with a Rate aggregation.
+type RateParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. See CountParams.PublicPartitions for details.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct values that a given privacy identifier
+	// can influence. See CountParams.MaxPartitionsContributed for details.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of times that a privacy identifier can contribute to
+	// a single count. See CountParams.MaxValue for details.
+	//
+	// Required.
+	MaxValue int64
+	// Publicly known denominator for each partition, as a PCollection<K, float64>
+	// where K is the partition type of the PrivatePCollection. Denominators must
+	// be strictly positive, and every partition present in the output must have
+	// exactly one denominator. Denominators of partitions that are not in the
+	// output are ignored.
+	//
+	// Denominators must not be derived from private data: no privacy budget is
+	// spent on them, and they are used as is.
+	//
+	// Required.
+	Denominators beam.PCollection
+	// Confidence intervals in the output contain the raw rate with probability
+	// at least 1-ConfidenceIntervalAlpha.
+	//
+	// Defaults to 0.05.
+	ConfidenceIntervalAlpha float64
+	// Allow negative rates and confidence interval bounds in the output. See
+	// CountParams.AllowNegativeOutputs for details.
+	//
+	// Optional.
+	AllowNegativeOutputs bool
+}
+
+// RateResult is the output of a Rate aggregation for a single partition.
+type RateResult struct {
+	// Rate is the differentially private count divided by the denominator.
+	Rate float64
+	// LowerBound and UpperBound are the bounds of the confidence interval of
+	// the rate.
+	LowerBound, UpperBound float64
+}
+
+// Rate counts the number of times a value appears in a PrivatePCollection and
+// divides it by a publicly known denominator, e.g. the size of the population
+// that a partition corresponds to. Noise is only added to the count: since the
+// denominators are public, the noise of the rate and its confidence interval
+// are those of the count, scaled by the denominator.
+//
+// Like Count, Rate does pre-aggregation thresholding to remove partitions
+// with a low number of distinct privacy identifiers unless public partitions
+// are specified.
+//
+// Rate transforms a PrivatePCollection<V> into a PCollection<V, RateResult>.
+func Rate(s beam.Scope, pcol PrivatePCollection, params RateParams) beam.PCollection {
+	s = s.Scope("pbeam.Rate")
+	_, partitionT := beam.ValidateKVType(pcol.col)
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "Rate", err, partitionT.Type(), reflect.TypeOf(RateResult{}))
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Rate: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("Rate")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Rate: %v", err))
+	}
+	if params.ConfidenceIntervalAlpha == 0 {
+		params.ConfidenceIntervalAlpha = defaultConfidenceIntervalAlpha
+	}
+
+	// We reserve the budget for Rate and commit it once its parameters are
+	// validated, since the confidence intervals need the actual budget. Count
+	// uses the committed budget without consuming it again.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("Rate", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+	err = checkRateParams(params, partitionT.Type())
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Rate: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+
+	counts := countWithDerivation(s, pcol, CountParams{
+		NoiseKind:                params.NoiseKind,
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionParams: params.PartitionSelectionParams,
+		PublicPartitions:         params.PublicPartitions,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+		MaxValue:                 params.MaxValue,
+		// Negative counts are clamped after computing confidence intervals.
+		AllowNegativeOutputs: true,
+	}, nil, budget) // PCollection<V, int64>
+	grouped := beam.CoGroupByKey(s, counts, params.Denominators)
+	return beam.ParDo(s, &rateFn{
+		NoiseKind:                noiseKind,
+		Epsilon:                  params.AggregationEpsilon,
+		Delta:                    params.AggregationDelta,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+		MaxValue:                 params.MaxValue,
+		Alpha:                    params.ConfidenceIntervalAlpha,
+		AllowNegativeOutputs:     params.AllowNegativeOutputs,
+		TestMode:                 spec.testMode,
+	}, grouped) // PCollection<V, RateResult>
+}
+
+func checkRateParams(params RateParams, partitionType reflect.Type) error {
+	if !params.Denominators.IsValid() {
+		return fmt.Errorf("Denominators must be set")
+	}
+	keyT, valueT := beam.ValidateKVType(params.Denominators)
+	if keyT.Type() != partitionType {
+		return fmt.Errorf("Denominators have key type %v, must match the partition type %v", keyT.Type(), partitionType)
+	}
+	if valueT.Type() != reflect.TypeOf(float64(0)) {
+		return fmt.Errorf("Denominators have value type %v, must be float64", valueT.Type())
+	}
+	return checks.CheckAlpha(params.ConfidenceIntervalAlpha)
+}
+
+// rateFn divides the noisy count of each partition by its denominator and
+// computes the corresponding confidence interval.
+type rateFn struct {
+	NoiseKind                          noise.Kind
+	Epsilon, Delta                     float64
+	MaxPartitionsContributed, MaxValue int64
+	Alpha                              float64
+	AllowNegativeOutputs               bool
+	TestMode                           TestMode
+	noise                              noise.Noise
+}
+
+func (fn *rateFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+func (fn *rateFn) ProcessElement(k beam.W, countIter func(*int64) bool, denominatorIter func(*float64) bool, emit func(beam.W, RateResult)) error {
+	var count int64
+	if !countIter(&count) {
+		// The partition was not selected, or is not public.
+		return nil
+	}
+	var denominator float64
+	if !denominatorIter(&denominator) {
+		return fmt.Errorf("no denominator for partition %v", k)
+	}
+	var other float64
+	if denominatorIter(&other) {
+		return fmt.Errorf("more than one denominator for partition %v", k)
+	}
+	if math.IsNaN(denominator) || math.IsInf(denominator, 0) || denominator <= 0 {
+		return fmt.Errorf("denominator for partition %v is %f, must be finite and strictly positive", k, denominator)
+	}
+	confInt, err := fn.noise.ComputeConfidenceIntervalInt64(count, fn.MaxPartitionsContributed, fn.MaxValue, fn.Epsilon, fn.Delta, fn.Alpha)
+	if err != nil {
+		return fmt.Errorf("couldn't compute confidence interval for partition %v: %w", k, err)
+	}
+	result := RateResult{
+		Rate:       float64(count) / denominator,
+		LowerBound: confInt.LowerBound / denominator,
+		UpperBound: confInt.UpperBound / denominator,
+	}
+	if !fn.AllowNegativeOutputs {
+		result.Rate = math.Max(result.Rate, 0)
+		result.LowerBound = math.Max(result.LowerBound, 0)
+		result.UpperBound = math.Max(result.UpperBound, 0)
+	}
+	emit(k, result)
+	return nil
+}
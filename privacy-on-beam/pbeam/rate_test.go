@@ -0,0 +1,221 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x2[int, RateResult, int, float64](rateValueFn)
+	register.Function2x2[int, RateResult, int, float64](rateLowerBoundFn)
+	register.Function2x2[int, RateResult, int, float64](rateUpperBoundFn)
+	register.Function2x1[int, RateResult, error](checkRateContainsHalfFn)
+}
+
+func rateValueFn(k int, r RateResult) (int, float64)      { return k, r.Rate }
+func rateLowerBoundFn(k int, r RateResult) (int, float64) { return k, r.LowerBound }
+func rateUpperBoundFn(k int, r RateResult) (int, float64) { return k, r.UpperBound }
+
+func checkRateContainsHalfFn(k int, r RateResult) error {
+	if r.LowerBound > r.Rate || r.Rate > r.UpperBound {
+		return fmt.Errorf("rate %f for partition %d is not within its confidence interval [%f, %f]", r.Rate, k, r.LowerBound, r.UpperBound)
+	}
+	if r.LowerBound > 0.5 || 0.5 > r.UpperBound {
+		return fmt.Errorf("confidence interval [%f, %f] for partition %d does not contain the raw rate 0.5", r.LowerBound, r.UpperBound, k)
+	}
+	return nil
+}
+
+// rateTestInput returns 5 privacy units contributing to partition 0 and 20
+// privacy units contributing to partition 1, along with denominators of 10 and
+// 40 respectively, so that the raw rate of each partition is 0.5.
+func rateTestInput() ([]testutils.PairII, []testutils.PairIF64) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 5, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(5, 20, 1),
+	)
+	denominators := []testutils.PairIF64{{0, 10}, {1, 40}}
+	return pairs, denominators
+}
+
+// Checks that Rate divides counts by the denominators.
+func TestRateNoNoise(t *testing.T) {
+	pairs, denominators := rateTestInput()
+	result := []testutils.PairIF64{{0, 0.5}, {1, 0.5}}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	denominatorsCol := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, denominators))
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	got := Rate(s, pcol, RateParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+		Denominators:             denominatorsCol,
+	})
+
+	testutils.EqualsKVFloat64(t, s, beam.ParDo(s, rateValueFn, got), want)
+	testutils.EqualsKVFloat64(t, s, beam.ParDo(s, rateLowerBoundFn, got), want)
+	testutils.EqualsKVFloat64(t, s, beam.ParDo(s, rateUpperBoundFn, got), want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestRateNoNoise: Rate(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that the confidence intervals returned by Rate contain the noisy and
+// the raw rates.
+func TestRateConfidenceIntervalContainsRawRate(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		noiseKind NoiseKind
+		delta     float64
+	}{
+		{"Laplace noise", LaplaceNoise{}, 0},
+		{"Gaussian noise", GaussianNoise{}, 1e-5},
+	} {
+		pairs, denominators := rateTestInput()
+		p, s, col := ptest.CreateList(pairs)
+		col = beam.ParDo(s, testutils.PairToKV, col)
+		denominatorsCol := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, denominators))
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				AggregationDelta:   tc.delta,
+			}))
+		// With α=10⁻¹⁰, the raw rate is outside the confidence interval with
+		// probability at most 10⁻¹⁰ per partition.
+		got := Rate(s, pcol, RateParams{
+			NoiseKind:                tc.noiseKind,
+			MaxValue:                 1,
+			MaxPartitionsContributed: 1,
+			PublicPartitions:         []int{0, 1},
+			Denominators:             denominatorsCol,
+			ConfidenceIntervalAlpha:  1e-10,
+			AllowNegativeOutputs:     true,
+		})
+
+		beam.ParDo0(s, checkRateContainsHalfFn, got)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestRateConfidenceIntervalContainsRawRate: with %s, got error: %v", tc.desc, err)
+		}
+	}
+}
+
+// Checks that Rate fails when an output partition has no denominator.
+func TestRateMissingDenominatorFails(t *testing.T) {
+	pairs, _ := rateTestInput()
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	denominatorsCol := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{0, 10}}))
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+	Rate(s, pcol, RateParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+		Denominators:             denominatorsCol,
+	})
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestRateMissingDenominatorFails: got no error, want error")
+	}
+}
+
+// Checks that invalid parameters of Rate fail the pipeline when validation
+// errors are deferred.
+func TestRateDeferValidationErrors(t *testing.T) {
+	pairs, _ := rateTestInput()
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+	// Denominators are required.
+	Rate(s, MakePrivate(s, col, spec), RateParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "Rate" {
+		t.Errorf("ValidationErrors() = %v, want a single error for Rate", errs)
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestRateDeferValidationErrors: pipeline with an invalid Rate succeeded, expected an error")
+	}
+}
+
+func TestCheckRateParams(t *testing.T) {
+	_, s := beam.NewPipelineWithRoot()
+	validDenominators := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{0, 10}}))
+	intDenominators := beam.ParDo(s, testutils.PairToKV, beam.CreateList(s, []testutils.PairII{{0, 10}}))
+	for _, tc := range []struct {
+		desc          string
+		params        RateParams
+		partitionType reflect.Type
+		wantErr       bool
+	}{
+		{
+			desc:          "valid parameters",
+			params:        RateParams{Denominators: validDenominators, ConfidenceIntervalAlpha: 0.05},
+			partitionType: reflect.TypeOf(0),
+			wantErr:       false,
+		},
+		{
+			desc:          "no denominators",
+			params:        RateParams{ConfidenceIntervalAlpha: 0.05},
+			partitionType: reflect.TypeOf(0),
+			wantErr:       true,
+		},
+		{
+			desc:          "denominators with non-float64 values",
+			params:        RateParams{Denominators: intDenominators, ConfidenceIntervalAlpha: 0.05},
+			partitionType: reflect.TypeOf(0),
+			wantErr:       true,
+		},
+		{
+			desc:          "denominators with wrong partition type",
+			params:        RateParams{Denominators: validDenominators, ConfidenceIntervalAlpha: 0.05},
+			partitionType: reflect.TypeOf(""),
+			wantErr:       true,
+		},
+		{
+			desc:          "alpha is 1",
+			params:        RateParams{Denominators: validDenominators, ConfidenceIntervalAlpha: 1},
+			partitionType: reflect.TypeOf(0),
+			wantErr:       true,
+		},
+	} {
+		if err := checkRateParams(tc.params, tc.partitionType); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
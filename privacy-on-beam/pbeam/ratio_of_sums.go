@@ -0,0 +1,471 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(RatioValues{}))
+	register.Combiner3[RatioValues, RatioValues, []float64](&sumRatioValuesFn{})
+	register.Combiner3[ratioOfSumsAccum, []float64, *float64](&ratioOfSumsFn{})
+}
+
+// RatioValues are the numerator and denominator of a single record, as
+// aggregated by RatioOfSumsPerKey. For example, for a click-through rate, the
+// numerator is 1 if an impression was clicked and 0 otherwise, and the
+// denominator is 1.
+type RatioValues struct {
+	Numerator, Denominator float64
+}
+
+// RatioOfSumsParams specifies the parameters associated with a RatioOfSums
+// aggregation.
+type RatioOfSumsParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation, split evenly
+	// between the sum of the numerators and the sum of the denominators. If
+	// there is only one aggregation, both epsilon and delta can be left 0; in
+	// that case the entire budget reserved for aggregation in the PrivacySpec
+	// is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation. Partition selection is done once for both sums.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// See SumParams.PublicPartitions for details.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct keys that a given privacy identifier
+	// can influence.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The sum of the numerators of a given privacy identifier in a partition
+	// is clamped to [MinNumerator, MaxNumerator], like the values of
+	// SumPerKey.
+	//
+	// Required.
+	MinNumerator, MaxNumerator float64
+	// The sum of the denominators of a given privacy identifier in a partition
+	// is clamped to [MinDenominator, MaxDenominator], like the values of
+	// SumPerKey.
+	//
+	// Required.
+	MinDenominator, MaxDenominator float64
+}
+
+// RatioOfSumsPerKey obtains the ratio of the sum of the numerators to the sum
+// of the denominators associated with each key in a
+// PrivatePCollection<K,RatioValues>, adding differentially private noise to
+// both sums and doing pre-aggregation thresholding to remove partitions with a
+// low number of distinct privacy identifiers.
+//
+// Unlike dividing the outputs of two SumPerKey aggregations, both sums are
+// computed over the same records: contributions are bounded once, keeping or
+// dropping the numerator and denominator of a record together, and a single
+// partition selection decides which partitions are kept. This makes it suited
+// to rates such as conversion rates or click-through rates.
+//
+// If the noisy sum of the denominators of a partition isn't positive, its
+// ratio is NaN.
+//
+// It is also possible to manually specify the list of partitions present in
+// the output, in which case the partition selection/thresholding step is
+// skipped.
+//
+// RatioOfSumsPerKey transforms a PrivatePCollection<K,RatioValues> into a
+// PCollection<K,float64>.
+func RatioOfSumsPerKey(s beam.Scope, pcol PrivatePCollection, params RatioOfSumsParams) beam.PCollection {
+	s = s.Scope("pbeam.RatioOfSumsPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("RatioOfSumsPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("RatioOfSumsPerKey: no codec found for the input PrivatePCollection.")
+	}
+	if pcol.codec.VType.T != reflect.TypeOf(RatioValues{}) {
+		log.Fatalf("RatioOfSumsPerKey: values must be of type RatioValues, got %v instead", pcol.codec.VType.T)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "RatioOfSumsPerKey", err, pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("RatioOfSumsPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.RatioOfSumsPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("RatioOfSumsPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.RatioOfSumsPerKey: %v", err))
+	}
+
+	err = checkRatioOfSumsPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.RatioOfSumsPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("RatioOfSumsPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for RatioOfSumsPerKey: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID, and sum the
+	// numerators and the denominators per-privacy unit and per-partition.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>, with a numerator and a denominator.
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+	summed := beam.CombinePerKey(s, &sumRatioValuesFn{}, decoded)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, summed)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	// Numerators and denominators are kept or dropped together.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "RatioOfSumsPerKey.boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		return addPublicPartitionsForRatioOfSums(s, *spec, params, noiseKind, partialKV)
+	}
+	// Compute the ratio of sums for each partition. Result is PCollection<partition, float64>.
+	fn, err := newRatioOfSumsFn(*spec, params, noiseKind, false)
+	if err != nil {
+		log.Fatalf("Couldn't get ratioOfSumsFn for RatioOfSumsPerKey: %v", err)
+	}
+	ratios := beam.CombinePerKey(s, fn, partialKV)
+	ratios = traceStage(s, *spec, "RatioOfSumsPerKey.aggregate", ratios)
+	reportNoiseDraws(s, ratios)
+	// Finally, drop thresholded partitions.
+	return beam.ParDo(s, dropThresholdedPartitionsFloat64, ratios)
+}
+
+func addPublicPartitionsForRatioOfSums(s beam.Scope, spec PrivacySpec, params RatioOfSumsParams, noiseKind noise.Kind, partialKV beam.PCollection) beam.PCollection {
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	fn, err := newRatioOfSumsFn(spec, params, noiseKind, true)
+	if err != nil {
+		log.Fatalf("Couldn't get ratioOfSumsFn for RatioOfSumsPerKey: %v", err)
+	}
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	ratios := beam.CombinePerKey(s, fn, partialKV)
+	ratios = traceStage(s, spec, "RatioOfSumsPerKey.aggregate", ratios)
+	reportNoiseDraws(s, ratios)
+	return mergeMeansWithEmptyPublicPartitions(s, ratios, noisyEmptyPublicPartitions)
+}
+
+func checkRatioOfSumsPerKeyParams(params RatioOfSumsParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsFloat64(params.MinNumerator, params.MaxNumerator)
+	if err != nil {
+		return fmt.Errorf("numerator: %v", err)
+	}
+	err = checks.CheckBoundsFloat64(params.MinDenominator, params.MaxDenominator)
+	if err != nil {
+		return fmt.Errorf("denominator: %v", err)
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+// sumRatioValuesFn sums the numerators and the denominators of a
+// PCollection<K,RatioValues> per key, and outputs them as a PCollection<K,[]float64>
+// of [numerator, denominator] slices, which can go through the contribution
+// bounding and public partition steps of other float64 aggregations.
+//
+// Records with a NaN numerator or denominator are ignored, so that both sums
+// are computed over the same records.
+type sumRatioValuesFn struct{}
+
+func (fn *sumRatioValuesFn) CreateAccumulator() RatioValues {
+	return RatioValues{}
+}
+
+func (fn *sumRatioValuesFn) AddInput(a, v RatioValues) RatioValues {
+	if math.IsNaN(v.Numerator) || math.IsNaN(v.Denominator) {
+		return a
+	}
+	a.Numerator += v.Numerator
+	a.Denominator += v.Denominator
+	return a
+}
+
+func (fn *sumRatioValuesFn) MergeAccumulators(a, b RatioValues) RatioValues {
+	a.Numerator += b.Numerator
+	a.Denominator += b.Denominator
+	return a
+}
+
+func (fn *sumRatioValuesFn) ExtractOutput(a RatioValues) []float64 {
+	return []float64{a.Numerator, a.Denominator}
+}
+
+type ratioOfSumsAccum struct {
+	Numerator, Denominator *dpagg.BoundedSumFloat64
+	SP                     *dpagg.PreAggSelectPartition
+}
+
+// ratioOfSumsFn is a differentially private combineFn for obtaining the ratio
+// of the sum of the numerators to the sum of the denominators, whose input are
+// the [numerator, denominator] slices output by sumRatioValuesFn. Do not
+// initialize it yourself, use newRatioOfSumsFn to create a ratioOfSumsFn
+// instance.
+type ratioOfSumsFn struct {
+	// Privacy spec parameters (set during initial construction).
+	NoiseEpsilon              float64
+	PartitionSelectionEpsilon float64
+	NoiseDelta                float64
+	PartitionSelectionDelta   float64
+	PreThreshold              int64
+	PartitionSelector         *encodedPartitionSelector
+	MaxPartitionsContributed  int64
+	MinNumerator              float64
+	MaxNumerator              float64
+	MinDenominator            float64
+	MaxDenominator            float64
+	NoiseKind                 noise.Kind
+	noise                     noise.Noise // Set during Setup phase according to NoiseKind.
+	PublicPartitions          bool        // Set to true if public partitions are used.
+	TestMode                  TestMode
+}
+
+// newRatioOfSumsFn returns a ratioOfSumsFn with the given budget and parameters.
+func newRatioOfSumsFn(spec PrivacySpec, params RatioOfSumsParams, noiseKind noise.Kind, publicPartitions bool) (*ratioOfSumsFn, error) {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
+		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	return &ratioOfSumsFn{
+		NoiseEpsilon:              params.AggregationEpsilon,
+		NoiseDelta:                params.AggregationDelta,
+		PartitionSelectionEpsilon: params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:   params.PartitionSelectionParams.Delta,
+		PreThreshold:              spec.preThreshold,
+		PartitionSelector:         spec.partitionSelector,
+		MaxPartitionsContributed:  params.MaxPartitionsContributed,
+		MinNumerator:              params.MinNumerator,
+		MaxNumerator:              params.MaxNumerator,
+		MinDenominator:            params.MinDenominator,
+		MaxDenominator:            params.MaxDenominator,
+		NoiseKind:                 noiseKind,
+		PublicPartitions:          publicPartitions,
+		TestMode:                  spec.testMode,
+	}, nil
+}
+
+func (fn *ratioOfSumsFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+func (fn *ratioOfSumsFn) newBoundedSum(lower, upper float64) (*dpagg.BoundedSumFloat64, error) {
+	if fn.TestMode == TestModeWithoutContributionBounding {
+		lower, upper = math.Inf(-1), math.Inf(1)
+	}
+	return dpagg.NewBoundedSumFloat64(&dpagg.BoundedSumFloat64Options{
+		Epsilon:                  fn.NoiseEpsilon / 2,
+		Delta:                    fn.NoiseDelta / 2,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		Lower:                    lower,
+		Upper:                    upper,
+		Noise:                    fn.noise,
+	})
+}
+
+func (fn *ratioOfSumsFn) CreateAccumulator() (ratioOfSumsAccum, error) {
+	numerator, err := fn.newBoundedSum(fn.MinNumerator, fn.MaxNumerator)
+	if err != nil {
+		return ratioOfSumsAccum{}, err
+	}
+	denominator, err := fn.newBoundedSum(fn.MinDenominator, fn.MaxDenominator)
+	if err != nil {
+		return ratioOfSumsAccum{}, err
+	}
+	accum := ratioOfSumsAccum{Numerator: numerator, Denominator: denominator}
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *ratioOfSumsFn) AddInput(a ratioOfSumsAccum, values []float64) (ratioOfSumsAccum, error) {
+	var err error
+	// Empty public partitions have no values.
+	if len(values) == 2 {
+		err = a.Numerator.Add(values[0])
+		if err != nil {
+			return a, err
+		}
+		err = a.Denominator.Add(values[1])
+		if err != nil {
+			return a, err
+		}
+	}
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *ratioOfSumsFn) MergeAccumulators(a, b ratioOfSumsAccum) (ratioOfSumsAccum, error) {
+	err := a.Numerator.Merge(b.Numerator)
+	if err != nil {
+		return a, err
+	}
+	err = a.Denominator.Merge(b.Denominator)
+	if err != nil {
+		return a, err
+	}
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+// ExtractOutput returns the ratio of the noisy sums, or NaN if the noisy sum of
+// the denominators isn't positive.
+func (fn *ratioOfSumsFn) ExtractOutput(a ratioOfSumsAccum) (*float64, error) {
+	if fn.TestMode.isEnabled() {
+		a.Numerator.Noise = noNoise{}
+		a.Denominator.Noise = noNoise{}
+	}
+	a.Numerator.Noise = auditNoise(a.Numerator.Noise, "RatioOfSums")
+	a.Denominator.Noise = auditNoise(a.Denominator.Noise, "RatioOfSums")
+	shouldKeepPartition := fn.TestMode.isEnabled() || fn.PublicPartitions // If in test mode or public partitions are specified, we always keep the partition.
+	if !shouldKeepPartition {                                             // If not, we need to perform private partition selection.
+		var err error
+		shouldKeepPartition, err = fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !shouldKeepPartition {
+			return nil, err
+		}
+	}
+	noisedNumerator, err := a.Numerator.Result()
+	if err != nil {
+		return nil, err
+	}
+	noisedDenominator, err := a.Denominator.Result()
+	if err != nil {
+		return nil, err
+	}
+	result := math.NaN()
+	if noisedDenominator > 0 {
+		result = noisedNumerator / noisedDenominator
+	}
+	return &result, nil
+}
+
+func (fn *ratioOfSumsFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *ratioOfSumsFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
@@ -0,0 +1,192 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[impression, int, impression](extractIDFromImpressionFn)
+	register.Function1x2[impression, int, RatioValues](impressionToKVFn)
+	register.Function2x1[int, float64, string](formatRatioFn)
+}
+
+// impression is an ad impression, which may have been clicked.
+type impression struct {
+	ID, Campaign int
+	Clicked      bool
+}
+
+func extractIDFromImpressionFn(i impression) (int, impression) {
+	return i.ID, i
+}
+
+func impressionToKVFn(i impression) (int, RatioValues) {
+	if i.Clicked {
+		return i.Campaign, RatioValues{Numerator: 1, Denominator: 1}
+	}
+	return i.Campaign, RatioValues{Numerator: 0, Denominator: 1}
+}
+
+func formatRatioFn(partition int, ratio float64) string {
+	return fmt.Sprintf("%d: %.2f", partition, ratio)
+}
+
+// makeImpressions returns n impressions with consecutive IDs starting from
+// firstID, of which the first clicked impressions are clicked.
+func makeImpressions(firstID, n, clicked, campaign int) []impression {
+	impressions := make([]impression, n)
+	for i := range impressions {
+		impressions[i] = impression{ID: firstID + i, Campaign: campaign, Clicked: i < clicked}
+	}
+	return impressions
+}
+
+func TestRatioOfSumsPerKeyNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		testMode TestMode
+		want     []string
+	}{
+		// Each privacy unit contributes at most 1 impression and 1 click.
+		{TestModeWithContributionBounding, []string{"0: 0.25", "1: 0.50"}},
+		{TestModeWithoutContributionBounding, []string{"0: 0.06", "1: 0.50"}},
+	} {
+		// Privacy units 0 to 99 have 4 impressions of campaign 0 each, and
+		// privacy units 0 to 24 clicked one of them. Privacy units 100 to 149
+		// have a single impression of campaign 1, and 25 of them are clicked.
+		var impressions []impression
+		impressions = append(impressions, makeImpressions(0, 100, 25, 0)...)
+		for i := 0; i < 3; i++ {
+			impressions = append(impressions, makeImpressions(0, 100, 0, 0)...)
+		}
+		impressions = append(impressions, makeImpressions(100, 50, 25, 1)...)
+		p, s, col := ptest.CreateList(impressions)
+		col = beam.ParDo(s, extractIDFromImpressionFn, col)
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon:        1,
+				PartitionSelectionEpsilon: 1,
+				PartitionSelectionDelta:   1e-5,
+				TestMode:                  tc.testMode,
+			}))
+		pcol = ParDo(s, impressionToKVFn, pcol)
+		got := RatioOfSumsPerKey(s, pcol, RatioOfSumsParams{
+			MaxPartitionsContributed: 1,
+			MinNumerator:             0,
+			MaxNumerator:             1,
+			MinDenominator:           0,
+			MaxDenominator:           1,
+		})
+
+		want := make([]any, len(tc.want))
+		for i, w := range tc.want {
+			want[i] = w
+		}
+		passert.Equals(s, beam.ParDo(s, formatRatioFn, got), want...)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestRatioOfSumsPerKeyNoNoise in test mode %v: RatioOfSumsPerKey(%v) = %v, error %v", tc.testMode, col, got, err)
+		}
+	}
+}
+
+func TestRatioOfSumsPerKeyWithPartitionsNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		inMemory bool
+	}{
+		{"public partitions as a PCollection", false},
+		{"in-memory public partitions", true},
+	} {
+		// Campaign 1 is not public, and public campaign 2 is empty: its ratio is
+		// undefined.
+		var impressions []impression
+		impressions = append(impressions, makeImpressions(0, 100, 10, 0)...)
+		impressions = append(impressions, makeImpressions(100, 50, 25, 1)...)
+		publicPartitionsSlice := []int{0, 2}
+		p, s, col := ptest.CreateList(impressions)
+		col = beam.ParDo(s, extractIDFromImpressionFn, col)
+
+		var publicPartitions any
+		if tc.inMemory {
+			publicPartitions = publicPartitionsSlice
+		} else {
+			publicPartitions = beam.CreateList(s, publicPartitionsSlice)
+		}
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           TestModeWithContributionBounding,
+			}))
+		pcol = ParDo(s, impressionToKVFn, pcol)
+		got := RatioOfSumsPerKey(s, pcol, RatioOfSumsParams{
+			MaxPartitionsContributed: 1,
+			MinNumerator:             0,
+			MaxNumerator:             1,
+			MinDenominator:           0,
+			MaxDenominator:           1,
+			PublicPartitions:         publicPartitions,
+		})
+
+		passert.Equals(s, beam.ParDo(s, formatRatioFn, got), "0: 0.10", "2: NaN")
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestRatioOfSumsPerKeyWithPartitionsNoNoise with %s: RatioOfSumsPerKey(%v) = %v, error %v", tc.desc, col, got, err)
+		}
+	}
+}
+
+func TestCheckRatioOfSumsPerKeyParams(t *testing.T) {
+	valid := func() RatioOfSumsParams {
+		return RatioOfSumsParams{
+			AggregationEpsilon:       1.0,
+			PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+			MaxPartitionsContributed: 1,
+			MinNumerator:             0,
+			MaxNumerator:             1,
+			MinDenominator:           0,
+			MaxDenominator:           1,
+		}
+	}
+	for _, tc := range []struct {
+		desc    string
+		modify  func(*RatioOfSumsParams)
+		wantErr bool
+	}{
+		{"valid parameters", func(*RatioOfSumsParams) {}, false},
+		{"negative aggregationEpsilon", func(p *RatioOfSumsParams) { p.AggregationEpsilon = -1 }, true},
+		{"unset partition selection delta", func(p *RatioOfSumsParams) { p.PartitionSelectionParams.Delta = 0 }, true},
+		{"MaxNumerator smaller than MinNumerator", func(p *RatioOfSumsParams) { p.MinNumerator = 2 }, true},
+		{"MaxDenominator smaller than MinDenominator", func(p *RatioOfSumsParams) { p.MinDenominator = 2 }, true},
+		{"unset MaxPartitionsContributed", func(p *RatioOfSumsParams) { p.MaxPartitionsContributed = 0 }, true},
+	} {
+		params := valid()
+		tc.modify(&params)
+		if err := checkRatioOfSumsPerKeyParams(params, noise.LaplaceNoise, reflect.TypeOf(0)); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/runtime"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/util/reflectx"
+)
+
+// CheckRegistrations verifies at pipeline construction time that pcol can be
+// processed on portable runners (e.g. Dataflow or Flink), and returns an error
+// listing all the problems it finds otherwise. It checks that:
+//   - the partition and value types of pcol (or its element type, if it isn't
+//     a PrivatePCollection<K,V>) have a deterministic coder: DP aggregations
+//     group elements by partition, and contribution bounding groups them by
+//     privacy identifier, so they must encode equal elements to equal bytes;
+//   - named struct types among them are registered with beam.RegisterType;
+//   - the functions passed to ParDo to obtain pcol are registered with
+//     register.Function*.
+//
+// Test pipelines, e.g. pipelines using a PrivacySpec with a TestMode, usually
+// run on the direct runner, which doesn't need these registrations: unregistered
+// types and functions only make pipelines fail at runtime on portable runners.
+// Calling CheckRegistrations in unit tests catches these failures early.
+func CheckRegistrations(pcol PrivatePCollection) error {
+	var errs []error
+	if pcol.codec != nil {
+		errs = append(errs, checkTypeRegistration("partition", pcol.codec.KType.T))
+		errs = append(errs, checkTypeRegistration("value", pcol.codec.VType.T))
+	} else {
+		_, elemT := beam.ValidateKVType(pcol.col)
+		errs = append(errs, checkTypeRegistration("element", elemT.Type()))
+	}
+	for _, fn := range pcol.doFns {
+		errs = append(errs, checkFunctionRegistration(fn))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("pbeam.CheckRegistrations: %w", err)
+	}
+	return nil
+}
+
+// checkTypeRegistration checks that t has a deterministic coder and, if t is a
+// named struct type, that it is registered with beam.RegisterType.
+func checkTypeRegistration(role string, t reflect.Type) error {
+	if err := checkDeterministicType(t); err != nil {
+		return fmt.Errorf("%s type %v doesn't have a deterministic coder: %w", role, t, err)
+	}
+	if err := checkEncodable(t); err != nil {
+		return fmt.Errorf("%s type %v can't be encoded: %w", role, t, err)
+	}
+	st := reflectx.SkipPtr(t)
+	if st.Kind() == reflect.Struct {
+		if key, ok := runtime.TypeKey(st); ok {
+			if _, registered := runtime.LookupType(key); !registered {
+				return fmt.Errorf("%s type %v isn't registered: call beam.RegisterType(reflect.TypeOf((*%v)(nil)).Elem()) in an init() function", role, t, st)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDeterministicType returns an error if t contains types whose encoding
+// isn't deterministic, like maps, or that can't be encoded, like functions.
+func checkDeterministicType(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Map:
+		return fmt.Errorf("map %v is encoded in a non-deterministic order", t)
+	case reflect.Interface:
+		return fmt.Errorf("interface %v can hold values of any type", t)
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return fmt.Errorf("%v can't be encoded", t)
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return checkDeterministicType(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := checkDeterministicType(t.Field(i).Type); err != nil {
+				return fmt.Errorf("field %s: %w", t.Field(i).Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkEncodable checks that Beam can infer a coder for t.
+func checkEncodable(t reflect.Type) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	beam.NewElementEncoder(t)
+	return nil
+}
+
+// checkFunctionRegistration checks that fn is registered with
+// register.Function*. Beam falls back on calling unregistered functions with
+// reflection, which isn't available on all runners.
+func checkFunctionRegistration(fn any) error {
+	if reflect.TypeOf(fn).Kind() != reflect.Func {
+		return nil
+	}
+	name := reflectx.FunctionName(fn)
+	if reflect.TypeOf(reflectx.MakeFunc(fn)) == reflectFuncType {
+		return fmt.Errorf("function %s passed to ParDo isn't registered: call register.Function%dx%d[...](%s) in an init() function",
+			name, reflect.TypeOf(fn).NumIn(), reflect.TypeOf(fn).NumOut(), name)
+	}
+	return nil
+}
+
+// reflectFuncType is the type of the reflectx.Func that Beam uses for
+// functions without a registered caller. It is obtained with a function type
+// that is never registered.
+var reflectFuncType = reflect.TypeOf(reflectx.MakeFunc(func(unregisteredFuncArg) {}))
+
+type unregisteredFuncArg struct{}
@@ -0,0 +1,87 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Function1x2[int, int, int64](registeredRegistrationsTestFn)
+	beam.RegisterType(reflect.TypeOf(registeredRegistrationsTestStruct{}))
+}
+
+type registeredRegistrationsTestStruct struct{ Value int }
+
+type unregisteredRegistrationsTestStruct struct{ Value int }
+
+type mapRegistrationsTestStruct struct{ Values map[string]int }
+
+func registeredRegistrationsTestFn(v int) (int, int64) { return v, 1 }
+
+func unregisteredRegistrationsTestFn(v int) (int, unregisteredRegistrationsTestStruct) {
+	return v, unregisteredRegistrationsTestStruct{Value: v}
+}
+
+func TestCheckRegistrations(t *testing.T) {
+	_, s := beam.NewPipelineWithRoot()
+	col := beam.ParDo(s, testutils.PairToKV, beam.CreateList(s, testutils.MakePairsWithFixedV(10, 0)))
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1}))
+
+	if err := CheckRegistrations(pcol); err != nil {
+		t.Errorf("CheckRegistrations on a PrivatePCollection<int>: got error %v", err)
+	}
+	if err := CheckRegistrations(ParDo(s, registeredRegistrationsTestFn, pcol)); err != nil {
+		t.Errorf("CheckRegistrations with a registered function: got error %v", err)
+	}
+	err := CheckRegistrations(ParDo(s, unregisteredRegistrationsTestFn, pcol))
+	if err == nil {
+		t.Fatalf("CheckRegistrations with an unregistered function and value type: got no error")
+	}
+	for _, want := range []string{"unregisteredRegistrationsTestFn", "unregisteredRegistrationsTestStruct"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("CheckRegistrations with an unregistered function and value type: got error %q, want it to mention %s", err, want)
+		}
+	}
+}
+
+func TestCheckTypeRegistration(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		t       reflect.Type
+		wantErr bool
+	}{
+		{"int", reflect.TypeOf(0), false},
+		{"string", reflect.TypeOf(""), false},
+		{"slice of float64", reflect.TypeOf([]float64{}), false},
+		{"registered struct", reflect.TypeOf(registeredRegistrationsTestStruct{}), false},
+		{"unregistered struct", reflect.TypeOf(unregisteredRegistrationsTestStruct{}), true},
+		{"map", reflect.TypeOf(map[string]int{}), true},
+		{"struct with a map", reflect.TypeOf(mapRegistrationsTestStruct{}), true},
+		{"interface", reflect.TypeOf((*any)(nil)).Elem(), true},
+	} {
+		if err := checkTypeRegistration("value", tc.t); (err != nil) != tc.wantErr {
+			t.Errorf("checkTypeRegistration with %s: got err=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+)
+
+// DrillDownPlanParams specifies the parameters associated with
+// PlanDrillDownRelease.
+type DrillDownPlanParams struct {
+	// Differential privacy budget available for the release, split between
+	// the released levels of the hierarchy.
+	//
+	// Required.
+	Epsilon, Delta float64
+	// Differential privacy budget that was consumed to compute the volume
+	// estimates given to PlanDrillDownRelease. It is only used to compute the
+	// total privacy loss of the plan.
+	EstimationEpsilon, EstimationDelta float64
+	// Noise type that the release will use (which is either LaplaceNoise{} or
+	// GaussianNoise{}).
+	//
+	// Required.
+	NoiseKind NoiseKind
+	// MaxPartitionsContributed of the aggregations that the release will use.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// Maximum absolute value that a single privacy unit can contribute to the
+	// output of a single cell, as in OutputNoiseParams.
+	//
+	// Required.
+	MaxContribution float64
+	// Cells whose noise standard deviation would be larger than
+	// MaxRelativeError times their estimated volume are not released. For
+	// example, with MaxRelativeError=0.1, a cell with an estimated volume of
+	// 1000 is only released if the standard deviation of its noise is at
+	// most 100.
+	//
+	// Required.
+	MaxRelativeError float64
+	// Separator between the levels of a cell key.
+	//
+	// Defaults to "/".
+	Separator string
+}
+
+// DrillDownPlan is a release plan for a hierarchy of cells, computed by
+// PlanDrillDownRelease.
+type DrillDownPlan struct {
+	// Released levels, from the top of the hierarchy down. Levels that don't
+	// appear in the plan must not be released.
+	Levels []DrillDownLevelPlan
+	// Total privacy loss of the volume estimation and of the release of all
+	// levels, under basic composition.
+	TotalEpsilon, TotalDelta float64
+}
+
+// DrillDownLevelPlan describes the release of a single level of a hierarchy.
+type DrillDownLevelPlan struct {
+	// Index of the level in the hierarchy, 0 being the top level.
+	Level int
+	// Differential privacy budget allocated to the level. This is the budget
+	// of the aggregation (e.g. AggregationEpsilon and AggregationDelta of a
+	// Count) releasing the level.
+	Epsilon, Delta float64
+	// Cells of the level to release, in lexicographic order. Since they are
+	// derived from differentially private volume estimates, they can be used
+	// as public partitions for the release.
+	Cells []string
+}
+
+// String documents the plan and its total privacy loss.
+func (p DrillDownPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Drill-down release plan with total privacy loss (ε=%g, δ=%g):\n", p.TotalEpsilon, p.TotalDelta)
+	for _, l := range p.Levels {
+		fmt.Fprintf(&b, "  level %d: %d cells with (ε=%g, δ=%g)\n", l.Level, len(l.Cells), l.Epsilon, l.Delta)
+	}
+	return b.String()
+}
+
+// PlanDrillDownRelease plans which levels and cells of a hierarchy to release
+// with a given privacy budget.
+//
+// estimates[i] maps the cells of level i of the hierarchy to differentially
+// private estimates of their volume, e.g. the output of a Count on the
+// partitions selected by HierarchicalSelectPartitions. Cell keys follow the
+// format of HierarchicalSelectPartitions, e.g. "US", "US/California" and
+// "US/California/San Francisco".
+//
+// The budget is allocated adaptively, from the top of the hierarchy down.
+// Each level needs enough budget for the cell with the median estimated
+// volume among the candidate cells of the level to meet
+// params.MaxRelativeError; candidate cells are the children of the cells
+// released at the previous level. Levels are added to the plan as long as
+// their needs fit in params.Epsilon, and the budget is then split between
+// them proportionally to their needs. Only cells meeting
+// params.MaxRelativeError with the allocated budget and whose parent is
+// released are part of the plan, so that the release can be drilled down
+// safely.
+//
+// Planning only depends on differentially private estimates, so it doesn't
+// consume any additional privacy budget; the total loss of the plan is the
+// estimation budget plus the budget allocated to the released levels.
+func PlanDrillDownRelease(estimates []map[string]float64, params DrillDownPlanParams) (DrillDownPlan, error) {
+	if params.Separator == "" {
+		params.Separator = defaultHierarchySeparator
+	}
+	if err := checkDrillDownPlanParams(params); err != nil {
+		return DrillDownPlan{}, err
+	}
+	if len(estimates) == 0 {
+		return DrillDownPlan{}, fmt.Errorf("estimates must contain at least one level")
+	}
+
+	// Delta is split evenly between the released levels. When computing the
+	// needs, we conservatively assume that all levels are released.
+	needDelta := params.Delta / float64(len(estimates))
+	var needs []float64
+	var totalNeed float64
+	var released map[string]bool
+	for level, volumes := range estimates {
+		candidates, err := candidateVolumes(level, volumes, released, params.Separator)
+		if err != nil {
+			return DrillDownPlan{}, err
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		need, err := epsilonForRelativeError(median(candidates), needDelta, params)
+		if err != nil {
+			return DrillDownPlan{}, fmt.Errorf("level %d: %w", level, err)
+		}
+		if totalNeed+need > params.Epsilon {
+			break
+		}
+		needs = append(needs, need)
+		totalNeed += need
+		released, err = releasableCells(level, volumes, released, need, needDelta, params)
+		if err != nil {
+			return DrillDownPlan{}, fmt.Errorf("level %d: %w", level, err)
+		}
+	}
+
+	plan := DrillDownPlan{
+		TotalEpsilon: params.EstimationEpsilon,
+		TotalDelta:   params.EstimationDelta,
+	}
+	released = nil
+	for level, need := range needs {
+		epsilon := params.Epsilon * need / totalNeed
+		delta := params.Delta / float64(len(needs))
+		var err error
+		released, err = releasableCells(level, estimates[level], released, epsilon, delta, params)
+		if err != nil {
+			return DrillDownPlan{}, fmt.Errorf("level %d: %w", level, err)
+		}
+		if len(released) == 0 {
+			break
+		}
+		cells := make([]string, 0, len(released))
+		for cell := range released {
+			cells = append(cells, cell)
+		}
+		sort.Strings(cells)
+		plan.Levels = append(plan.Levels, DrillDownLevelPlan{Level: level, Epsilon: epsilon, Delta: delta, Cells: cells})
+		plan.TotalEpsilon += epsilon
+		plan.TotalDelta += delta
+	}
+	return plan, nil
+}
+
+func checkDrillDownPlanParams(params DrillDownPlanParams) error {
+	if err := checks.CheckEpsilon(params.EstimationEpsilon, "EstimationEpsilon"); err != nil {
+		return err
+	}
+	if err := checks.CheckDelta(params.EstimationDelta, "EstimationDelta"); err != nil {
+		return err
+	}
+	if math.IsNaN(params.MaxRelativeError) || math.IsInf(params.MaxRelativeError, 0) || params.MaxRelativeError <= 0 {
+		return fmt.Errorf("MaxRelativeError must be finite and strictly positive, was %f instead", params.MaxRelativeError)
+	}
+	// Epsilon, Delta and the noise parameters are checked as the noise of a
+	// level using the entire budget.
+	return outputNoiseParams(params.Epsilon, params.Delta, params).check()
+}
+
+// outputNoiseParams returns the noise parameters of a level released with the
+// given budget.
+func outputNoiseParams(epsilon, delta float64, params DrillDownPlanParams) OutputNoiseParams {
+	return OutputNoiseParams{
+		NoiseKind:                params.NoiseKind,
+		Epsilon:                  epsilon,
+		Delta:                    delta,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+		MaxContribution:          params.MaxContribution,
+	}
+}
+
+// candidateVolumes returns the estimated volumes of the cells of a level whose
+// parent is in parents. All cells of the top level are candidates.
+func candidateVolumes(level int, volumes map[string]float64, parents map[string]bool, separator string) ([]float64, error) {
+	var candidates []float64
+	for cell, volume := range volumes {
+		ok, err := hasReleasedParent(level, cell, parents, separator)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			candidates = append(candidates, volume)
+		}
+	}
+	return candidates, nil
+}
+
+// releasableCells returns the cells of a level whose parent is in parents and
+// whose estimated volume meets MaxRelativeError when released with the given
+// budget.
+func releasableCells(level int, volumes map[string]float64, parents map[string]bool, epsilon, delta float64, params DrillDownPlanParams) (map[string]bool, error) {
+	stdDev, err := outputNoiseParams(epsilon, delta, params).StandardDeviation()
+	if err != nil {
+		return nil, err
+	}
+	minVolume := stdDev / params.MaxRelativeError
+	released := make(map[string]bool)
+	for cell, volume := range volumes {
+		ok, err := hasReleasedParent(level, cell, parents, params.Separator)
+		if err != nil {
+			return nil, err
+		}
+		if ok && volume >= minVolume {
+			released[cell] = true
+		}
+	}
+	return released, nil
+}
+
+func hasReleasedParent(level int, cell string, parents map[string]bool, separator string) (bool, error) {
+	if level == 0 {
+		return true, nil
+	}
+	i := strings.LastIndex(cell, separator)
+	if i < 0 {
+		return false, fmt.Errorf("cell %q of level %d has no parent", cell, level)
+	}
+	return parents[cell[:i]], nil
+}
+
+// epsilonForRelativeError returns the smallest epsilon (up to a relative
+// precision of 1e-6) for which a cell with the given volume meets
+// MaxRelativeError.
+func epsilonForRelativeError(volume, delta float64, params DrillDownPlanParams) (float64, error) {
+	if volume <= 0 {
+		return math.Inf(1), nil
+	}
+	maxStdDev := params.MaxRelativeError * volume
+	meets := func(epsilon float64) (bool, error) {
+		stdDev, err := outputNoiseParams(epsilon, delta, params).StandardDeviation()
+		return stdDev <= maxStdDev, err
+	}
+	// The standard deviation of the noise is decreasing in epsilon, so we
+	// find an epsilon that meets the error bound and binary search below it.
+	hi := params.Epsilon
+	for {
+		ok, err := meets(hi)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			break
+		}
+		if hi > params.Epsilon*1e6 {
+			return math.Inf(1), nil
+		}
+		hi *= 2
+	}
+	lo := 0.0
+	for hi-lo > hi*1e-6 {
+		mid := (lo + hi) / 2
+		ok, err := meets(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
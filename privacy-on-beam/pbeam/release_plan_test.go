@@ -0,0 +1,170 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestPlanDrillDownRelease(t *testing.T) {
+	estimates := []map[string]float64{
+		{"a": 1000, "b": 10},
+		{"a/x": 500, "a/y": 5, "b/z": 5},
+	}
+	// With Laplace noise and sensitivities of 1, a cell with volume v needs
+	// ε=√2/(0.1v) to meet MaxRelativeError=0.1. The medians of the candidates
+	// are 505 for the first level and 252.5 for the second, so the second
+	// level needs twice as much budget as the first.
+	params := DrillDownPlanParams{
+		NoiseKind:                LaplaceNoise{},
+		MaxPartitionsContributed: 1,
+		MaxContribution:          1,
+		MaxRelativeError:         0.1,
+		EstimationEpsilon:        0.5,
+	}
+	for _, tc := range []struct {
+		desc    string
+		epsilon float64
+		want    DrillDownPlan
+	}{
+		{
+			desc:    "budget for both levels",
+			epsilon: 1,
+			want: DrillDownPlan{
+				Levels: []DrillDownLevelPlan{
+					{Level: 0, Epsilon: 1.0 / 3, Cells: []string{"a"}},
+					{Level: 1, Epsilon: 2.0 / 3, Cells: []string{"a/x"}},
+				},
+				TotalEpsilon: 1.5,
+			},
+		},
+		{
+			desc:    "budget for the first level only",
+			epsilon: 0.05,
+			want: DrillDownPlan{
+				Levels:       []DrillDownLevelPlan{{Level: 0, Epsilon: 0.05, Cells: []string{"a"}}},
+				TotalEpsilon: 0.55,
+			},
+		},
+		{
+			desc:    "budget for no level",
+			epsilon: 0.01,
+			want:    DrillDownPlan{TotalEpsilon: 0.5},
+		},
+	} {
+		params.Epsilon = tc.epsilon
+		got, err := PlanDrillDownRelease(estimates, params)
+		if err != nil {
+			t.Fatalf("With %s, PlanDrillDownRelease: %v", tc.desc, err)
+		}
+		if diff := cmp.Diff(tc.want, got, cmpopts.EquateApprox(1e-4, 0)); diff != "" {
+			t.Errorf("With %s, PlanDrillDownRelease: diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestPlanDrillDownReleaseSplitsDeltaBetweenReleasedLevels(t *testing.T) {
+	estimates := []map[string]float64{
+		{"a": 1000},
+		{"a|x": 1000},
+	}
+	got, err := PlanDrillDownRelease(estimates, DrillDownPlanParams{
+		Epsilon:                  10,
+		Delta:                    1e-5,
+		NoiseKind:                GaussianNoise{},
+		MaxPartitionsContributed: 1,
+		MaxContribution:          1,
+		MaxRelativeError:         0.1,
+		Separator:                "|",
+	})
+	if err != nil {
+		t.Fatalf("PlanDrillDownRelease: %v", err)
+	}
+	if len(got.Levels) != 2 {
+		t.Fatalf("PlanDrillDownRelease returned %d levels, want 2", len(got.Levels))
+	}
+	for _, l := range got.Levels {
+		if l.Delta != 5e-6 {
+			t.Errorf("PlanDrillDownRelease: got delta %e for level %d, want 5e-6", l.Delta, l.Level)
+		}
+		if len(l.Cells) != 1 {
+			t.Errorf("PlanDrillDownRelease: got cells %v for level %d, want a single cell", l.Cells, l.Level)
+		}
+	}
+	if math.Abs(got.TotalEpsilon-10) > 1e-9 || math.Abs(got.TotalDelta-1e-5) > 1e-15 {
+		t.Errorf("PlanDrillDownRelease: got total loss (%f, %e), want (10, 1e-5)", got.TotalEpsilon, got.TotalDelta)
+	}
+}
+
+func TestPlanDrillDownReleaseErrors(t *testing.T) {
+	valid := DrillDownPlanParams{
+		Epsilon:                  1,
+		NoiseKind:                LaplaceNoise{},
+		MaxPartitionsContributed: 1,
+		MaxContribution:          1,
+		MaxRelativeError:         0.1,
+	}
+	for _, tc := range []struct {
+		desc      string
+		estimates []map[string]float64
+		params    func(DrillDownPlanParams) DrillDownPlanParams
+	}{
+		{
+			desc:      "no estimates",
+			estimates: nil,
+			params:    func(p DrillDownPlanParams) DrillDownPlanParams { return p },
+		},
+		{
+			desc:      "cell without parent",
+			estimates: []map[string]float64{{"a": 1000}, {"x": 1000}},
+			params:    func(p DrillDownPlanParams) DrillDownPlanParams { return p },
+		},
+		{
+			desc:      "zero epsilon",
+			estimates: []map[string]float64{{"a": 1000}},
+			params:    func(p DrillDownPlanParams) DrillDownPlanParams { p.Epsilon = 0; return p },
+		},
+		{
+			desc:      "delta with Laplace noise",
+			estimates: []map[string]float64{{"a": 1000}},
+			params:    func(p DrillDownPlanParams) DrillDownPlanParams { p.Delta = 1e-5; return p },
+		},
+		{
+			desc:      "negative estimation epsilon",
+			estimates: []map[string]float64{{"a": 1000}},
+			params:    func(p DrillDownPlanParams) DrillDownPlanParams { p.EstimationEpsilon = -1; return p },
+		},
+		{
+			desc:      "zero MaxRelativeError",
+			estimates: []map[string]float64{{"a": 1000}},
+			params:    func(p DrillDownPlanParams) DrillDownPlanParams { p.MaxRelativeError = 0; return p },
+		},
+		{
+			desc:      "no noise kind",
+			estimates: []map[string]float64{{"a": 1000}},
+			params:    func(p DrillDownPlanParams) DrillDownPlanParams { p.NoiseKind = nil; return p },
+		},
+	} {
+		if _, err := PlanDrillDownRelease(tc.estimates, tc.params(valid)); err == nil {
+			t.Errorf("With %s, PlanDrillDownRelease returned no error", tc.desc)
+		}
+	}
+}
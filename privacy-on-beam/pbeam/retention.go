@@ -0,0 +1,419 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(RetentionCount{}))
+	beam.RegisterType(reflect.TypeOf(stageCount{}))
+	register.DoFn3x1[beam.W, kv.Pair, func(kv.Pair, int64), error](&markStagesFn{})
+	register.Emitter2[kv.Pair, int64]()
+	register.Function2x1[int64, int64, int64](orStagesFn)
+	register.DoFn3x1[kv.Pair, int64, func(beam.W, partitionIndexKey), error](&reachedStagesFn{})
+	register.DoFn3x0[beam.W, partitionIndexKey, func(beam.W, partitionIndexKey)](&expandReachedStagesFn{})
+	register.DoFn2x0[partitionIndexKey, func(partitionIndexKey)](&expandReleasedStagesFn{})
+	register.Function2x2[partitionIndexKey, int64, []byte, stageCount](rekeyStageCountFn)
+	register.DoFn2x3[[]byte, func(*stageCount) bool, beam.W, []int64, error](&assembleStagesFn{})
+	register.Function2x2[beam.W, []int64, beam.W, RetentionCount](toRetentionCountFn)
+}
+
+// RetentionParams specifies the parameters associated with a Retention
+// aggregation.
+type RetentionParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation, as in
+	// DistinctPrivacyIDParams. It is shared between the initial and the retained
+	// counts.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation, as in DistinctPrivacyIDParams. Partitions are selected based
+	// on their initial count only.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// Optional.
+	PartitionSelectionDelta float64
+	// List of partitions present in the output, as in DistinctPrivacyIDParams.
+	//
+	// If PartitionSelectionDelta is specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// Periods in which privacy identifiers are first observed and in which they
+	// are expected to return, e.g. the index of two consecutive weeks.
+	//
+	// Required; InitialPeriod and ReturnPeriod must be different.
+	InitialPeriod, ReturnPeriod int64
+	// The maximum number of distinct partitions that a given privacy identifier
+	// can influence. A privacy identifier contributes to both the initial and
+	// the retained count of each of these partitions. If a privacy identifier
+	// is associated with more partitions, random partitions are dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+}
+
+// RetentionCount is the number of distinct privacy identifiers in a partition
+// during the initial period, and the number of those that also appear during
+// the return period, output by Retention.
+//
+// Both counts are noised independently: Retained can be greater than Initial.
+type RetentionCount struct {
+	Initial  int64
+	Retained int64
+}
+
+// Retention counts the number of distinct privacy identifiers associated with
+// each partition during an initial period, and the number of them that are
+// also associated with this partition during a return period, e.g. the
+// number of weekly active users of each product that are still active the
+// following week. It adds differentially private noise to both counts and
+// does post-aggregation thresholding on the initial counts to remove
+// partitions with low counts.
+//
+// Contributions are bounded per privacy identifier across both periods:
+// unlike two separate DistinctPrivacyID aggregations, the same partitions are
+// kept for the initial and the retained counts of a privacy identifier, so
+// that the retained count only includes privacy identifiers that are part of
+// the initial count.
+//
+// Retention transforms a PrivatePCollection<K,int64>, where the values are
+// periods, into a PCollection<K,RetentionCount>. Contributions in other
+// periods than InitialPeriod and ReturnPeriod are ignored.
+//
+// Note: Do not use when your results may cause overflows for int64 values.
+// This aggregation is not hardened for such applications yet.
+func Retention(s beam.Scope, pcol PrivatePCollection, params RetentionParams) beam.PCollection {
+	s = s.Scope("pbeam.Retention")
+	if pcol.codec == nil {
+		log.Fatalf("pbeam.Retention: input must be a PrivatePCollection<K,int64>")
+	}
+	if vT := pcol.codec.VType.T; vT != reflect.TypeOf(int64(0)) {
+		log.Fatalf("pbeam.Retention: periods must be of type int64, got %v", vT)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "Retention", err, pcol.codec.KType.T, reflect.TypeOf(RetentionCount{}))
+	}
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Retention: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("Retention")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Retention: %v", err))
+	}
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	// Only the δ of the partition selection budget is used, for thresholding.
+	var partitionSelection *PartitionSelectionParams
+	if params.PublicPartitions == nil {
+		partitionSelection = &PartitionSelectionParams{Delta: params.PartitionSelectionDelta}
+	}
+	budget, err := spec.reserveBudget("Retention", &params.AggregationEpsilon, &params.AggregationDelta, partitionSelection)
+	if err != nil {
+		return invalid(err)
+	}
+	if partitionSelection != nil {
+		params.PartitionSelectionDelta = partitionSelection.Delta
+	}
+	err = checkRetentionParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.Retention: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("Retention", params.AggregationEpsilon, params.AggregationDelta, 0, params.PartitionSelectionDelta)
+
+	counts := countStages(s, pcol, stageParams{
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionDelta:  params.PartitionSelectionDelta,
+		PublicPartitions:         params.PublicPartitions,
+		Stages:                   []int64{params.InitialPeriod, params.ReturnPeriod},
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	}, noiseKind)
+	return beam.ParDo(s, toRetentionCountFn, counts)
+}
+
+func checkRetentionParams(params RetentionParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkDistinctPrivacyIDParams(DistinctPrivacyIDParams{
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionDelta:  params.PartitionSelectionDelta,
+		PublicPartitions:         params.PublicPartitions,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	}, noiseKind, partitionType)
+	if err != nil {
+		return err
+	}
+	if params.InitialPeriod == params.ReturnPeriod {
+		return fmt.Errorf("InitialPeriod and ReturnPeriod must be different, got %d for both", params.InitialPeriod)
+	}
+	return checkStages([]int64{params.InitialPeriod, params.ReturnPeriod}, params.MaxPartitionsContributed)
+}
+
+func toRetentionCountFn(k beam.W, counts []int64) (beam.W, RetentionCount) {
+	return k, RetentionCount{Initial: counts[0], Retained: counts[1]}
+}
+
+// stageParams specifies the parameters of countStages, with the budget already
+// consumed.
+type stageParams struct {
+	AggregationEpsilon, AggregationDelta float64
+	PartitionSelectionDelta              float64
+	PublicPartitions                     any
+	// Values identifying each stage, in order. A privacy identifier reaches
+	// stage i of a partition if it contributes each of Stages[0], …, Stages[i]
+	// to this partition.
+	Stages                   []int64
+	MaxPartitionsContributed int64
+}
+
+// maxStages is the maximum number of stages supported by countStages, which
+// tracks the stages contributed by a privacy identifier as a bitmask.
+const maxStages = 63
+
+// countStages counts the number of distinct privacy identifiers reaching each
+// stage of each partition of a PrivatePCollection<K,int64>, and returns a
+// PCollection<K,[]int64> with one count per stage.
+//
+// The partitions contributed by each privacy identifier are bounded once,
+// across all stages. Stage 0 is counted like DistinctPrivacyID, with 1/n of
+// the aggregation budget where n is the number of stages, and determines the
+// partitions present in the output. The other stages are counted as public
+// partitions with the rest of the budget: each privacy identifier contributes
+// to n-1 of them per partition, so all counts are noised with the same scale.
+func countStages(s beam.Scope, pcol PrivatePCollection, params stageParams, noiseKind noise.Kind) beam.PCollection {
+	idT, _ := beam.ValidateKVType(pcol.col)
+	spec := pcol.privacySpec
+	partitionT := pcol.codec.KType.T
+	numStages := int64(len(params.Stages))
+
+	// Compute the stages reached by each privacy identifier in each partition.
+	marked := beam.ParDo(s, &markStagesFn{
+		IDType:     beam.EncodedType{idT.Type()},
+		StageCodec: pcol.codec,
+		Stages:     params.Stages,
+	}, pcol.col)
+	masks := beam.CombinePerKey(s, orStagesFn, marked)
+	reached := beam.ParDo(s, &reachedStagesFn{IDType: beam.EncodedType{idT.Type()}}, masks,
+		beam.TypeDefinition{Var: beam.WType, T: idT.Type()})
+	// Do cross-partition contribution bounding once for all stages, if not in
+	// test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		reached = boundContributions(s, reached, params.MaxPartitionsContributed)
+		reached = traceStage(s, *spec, "countStages.boundContributions", reached)
+	}
+
+	// Count stage 0, with partition selection if there are no public partitions.
+	firstStage := beam.ParDo(s, &expandReachedStagesFn{First: 0, Last: 0}, reached)
+	var publicFirstStage any
+	if params.PublicPartitions != nil {
+		var err error
+		publicFirstStage, err = expandPublicPartitions(s, params.PublicPartitions, partitionT, 0, 0)
+		if err != nil {
+			log.Fatalf("pbeam.countStages: %v", err)
+		}
+	}
+	firstCounts := distinctPrivacyID(s, PrivatePCollection{col: firstStage, privacySpec: spec}, DistinctPrivacyIDParams{
+		AggregationEpsilon:       params.AggregationEpsilon / float64(numStages),
+		AggregationDelta:         params.AggregationDelta / float64(numStages),
+		PartitionSelectionDelta:  params.PartitionSelectionDelta,
+		PublicPartitions:         publicFirstStage,
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+	}, noiseKind)
+
+	// Count the next stages of the partitions released for stage 0.
+	laterStages := beam.ParDo(s, &expandReachedStagesFn{First: 1, Last: numStages - 1}, reached)
+	publicLaterStages := beam.ParDo(s, &expandReleasedStagesFn{NumStages: numStages}, beam.DropValue(s, firstCounts))
+	laterFraction := float64(numStages-1) / float64(numStages)
+	laterCounts := distinctPrivacyID(s, PrivatePCollection{col: laterStages, privacySpec: spec}, DistinctPrivacyIDParams{
+		AggregationEpsilon:       params.AggregationEpsilon * laterFraction,
+		AggregationDelta:         params.AggregationDelta * laterFraction,
+		PublicPartitions:         publicLaterStages,
+		MaxPartitionsContributed: params.MaxPartitionsContributed * (numStages - 1),
+	}, noiseKind)
+
+	// Assemble the counts of all stages of each partition.
+	counts := beam.Flatten(s, firstCounts, laterCounts)
+	grouped := beam.GroupByKey(s, beam.ParDo(s, rekeyStageCountFn, counts))
+	return beam.ParDo(s, &assembleStagesFn{PartitionType: beam.EncodedType{partitionT}, NumStages: numStages}, grouped,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+}
+
+func checkStages(stages []int64, maxPartitionsContributed int64) error {
+	if len(stages) < 2 || len(stages) > maxStages {
+		return fmt.Errorf("the number of stages must be between 2 and %d, got %d", maxStages, len(stages))
+	}
+	seen := make(map[int64]bool)
+	for _, stage := range stages {
+		if seen[stage] {
+			return fmt.Errorf("stages must be distinct, got %d twice", stage)
+		}
+		seen[stage] = true
+	}
+	if maxPartitionsContributed > math.MaxInt64/int64(len(stages)) {
+		return fmt.Errorf("MaxPartitionsContributed (%d) times the number of stages overflows", maxPartitionsContributed)
+	}
+	return nil
+}
+
+// markStagesFn takes a PCollection<ID,kv.Pair{K,V}> as input, and returns a
+// PCollection<kv.Pair{ID,K},int64> where the value is a bitmask with the bit of
+// the stage of V set. Values that aren't a stage are dropped.
+type markStagesFn struct {
+	IDType     beam.EncodedType
+	idEnc      beam.ElementEncoder
+	StageCodec *kv.Codec
+	Stages     []int64
+	stageBits  map[int64]int64
+}
+
+func (fn *markStagesFn) Setup() error {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+	fn.stageBits = make(map[int64]int64, len(fn.Stages))
+	for i, stage := range fn.Stages {
+		fn.stageBits[stage] = 1 << i
+	}
+	return fn.StageCodec.Setup()
+}
+
+func (fn *markStagesFn) ProcessElement(id beam.W, pair kv.Pair, emit func(kv.Pair, int64)) error {
+	_, v, err := fn.StageCodec.Decode(pair)
+	if err != nil {
+		return fmt.Errorf("pbeam.markStagesFn.ProcessElement: couldn't decode stage: %v", err)
+	}
+	bit, ok := fn.stageBits[v.(int64)]
+	if !ok {
+		return nil
+	}
+	var idBuf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
+		return fmt.Errorf("pbeam.markStagesFn.ProcessElement: couldn't encode ID %v: %v", id, err)
+	}
+	emit(kv.Pair{idBuf.Bytes(), pair.K}, bit)
+	return nil
+}
+
+func orStagesFn(a, b int64) int64 {
+	return a | b
+}
+
+// reachedStagesFn takes a PCollection<kv.Pair{ID,K},int64> of stage bitmasks
+// as input, and returns a PCollection<ID,partitionIndexKey> where the index is
+// the number of consecutive stages reached, starting from stage 0. Privacy
+// identifiers that didn't reach stage 0 are dropped.
+type reachedStagesFn struct {
+	IDType beam.EncodedType
+	idDec  beam.ElementDecoder
+}
+
+func (fn *reachedStagesFn) Setup() {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+}
+
+func (fn *reachedStagesFn) ProcessElement(idk kv.Pair, mask int64, emit func(beam.W, partitionIndexKey)) error {
+	var reached int64
+	for mask&(1<<reached) != 0 {
+		reached++
+	}
+	if reached == 0 {
+		return nil
+	}
+	id, err := fn.idDec.Decode(bytes.NewBuffer(idk.K))
+	if err != nil {
+		return fmt.Errorf("pbeam.reachedStagesFn.ProcessElement: couldn't decode ID: %v", err)
+	}
+	emit(id, partitionIndexKey{Partition: idk.V, Index: reached})
+	return nil
+}
+
+// expandReachedStagesFn emits a partitionIndexKey for each stage in
+// [First, Last] reached by a privacy identifier in a partition.
+type expandReachedStagesFn struct {
+	First, Last int64
+}
+
+func (fn *expandReachedStagesFn) ProcessElement(id beam.W, reached partitionIndexKey, emit func(beam.W, partitionIndexKey)) {
+	for stage := fn.First; stage <= fn.Last && stage < reached.Index; stage++ {
+		emit(id, partitionIndexKey{Partition: reached.Partition, Index: stage})
+	}
+}
+
+// expandReleasedStagesFn emits stages 1 to NumStages-1 of a partition released
+// for stage 0.
+type expandReleasedStagesFn struct {
+	NumStages int64
+}
+
+func (fn *expandReleasedStagesFn) ProcessElement(first partitionIndexKey, emit func(partitionIndexKey)) {
+	for stage := int64(1); stage < fn.NumStages; stage++ {
+		emit(partitionIndexKey{Partition: first.Partition, Index: stage})
+	}
+}
+
+// stageCount is the count of a stage of a partition.
+type stageCount struct {
+	Stage int64
+	Count int64
+}
+
+func rekeyStageCountFn(k partitionIndexKey, count int64) ([]byte, stageCount) {
+	return k.Partition, stageCount{Stage: k.Index, Count: count}
+}
+
+// assembleStagesFn decodes a partition and collects the counts of its stages
+// in a slice.
+type assembleStagesFn struct {
+	PartitionType beam.EncodedType
+	partitionDec  beam.ElementDecoder
+	NumStages     int64
+}
+
+func (fn *assembleStagesFn) Setup() {
+	fn.partitionDec = beam.NewElementDecoder(fn.PartitionType.T)
+}
+
+func (fn *assembleStagesFn) ProcessElement(partition []byte, stageCounts func(*stageCount) bool) (beam.W, []int64, error) {
+	k, err := fn.partitionDec.Decode(bytes.NewBuffer(partition))
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.assembleStagesFn.ProcessElement: couldn't decode partition: %v", err)
+	}
+	counts := make([]int64, fn.NumStages)
+	var c stageCount
+	for stageCounts(&c) {
+		counts[c.Stage] = c.Count
+	}
+	return k, counts, nil
+}
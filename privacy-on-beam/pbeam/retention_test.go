@@ -0,0 +1,168 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	register.Function2x1[int, RetentionCount, string](formatRetentionCountFn)
+	register.Function2x2[int, RetentionCount, int, int64](retentionInitialFn)
+	register.Function2x2[int, RetentionCount, int, int64](retentionChurnFn)
+}
+
+func formatRetentionCountFn(k int, c RetentionCount) string {
+	return fmt.Sprintf("%d:%d/%d", k, c.Initial, c.Retained)
+}
+
+func retentionInitialFn(k int, c RetentionCount) (int, int64) {
+	return k, c.Initial
+}
+
+func retentionChurnFn(k int, c RetentionCount) (int, int64) {
+	return k, c.Initial - c.Retained
+}
+
+// Checks that Retention only counts privacy identifiers present during the
+// initial period as retained.
+func TestRetention(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		// Privacy IDs 0-9 are active in partition 0 during the initial period.
+		testutils.MakeTripleWithIntValue(10, 0, 0),
+		// Privacy IDs 0-4 return in partition 0.
+		testutils.MakeTripleWithIntValue(5, 0, 1),
+		// Privacy IDs 10-14 are only active in partition 0 during the return
+		// period, so they are not counted.
+		testutils.MakeTripleWithIntValueStartingFromKey(10, 5, 0, 1),
+		// Privacy IDs 0-9 are active in partition 0 during another period, which
+		// is ignored.
+		testutils.MakeTripleWithIntValue(10, 0, 2))
+	want := []string{"0:10/5", "1:0/0"}
+
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, tripleToPartitionPeriodFn, pcol)
+	got := Retention(s, pcol, RetentionParams{
+		InitialPeriod:            0,
+		ReturnPeriod:             1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+	passert.EqualsList(s, beam.ParDo(s, formatRetentionCountFn, got), want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestRetention: Retention(%v) = %v, want %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that Retention keeps the same partitions for the initial and the
+// retained counts of a privacy identifier when bounding contributions.
+func TestRetentionJointContributionBounding(t *testing.T) {
+	// Privacy IDs 0-9 are active in partitions 0 and 1 during both periods.
+	var triples []testutils.TripleWithIntValue
+	for partition := 0; partition < 2; partition++ {
+		for period := 0; period < 2; period++ {
+			triples = append(triples, testutils.MakeTripleWithIntValue(10, partition, period)...)
+		}
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, tripleToPartitionPeriodFn, pcol)
+	got := Retention(s, pcol, RetentionParams{
+		InitialPeriod:            0,
+		ReturnPeriod:             1,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+	// Each privacy ID is kept in a single partition, and is retained in this
+	// partition.
+	initial := stats.Sum(s, beam.DropKey(s, beam.ParDo(s, retentionInitialFn, got)))
+	passert.Equals(s, initial, int64(10))
+	churn := beam.DropKey(s, beam.ParDo(s, retentionChurnFn, got))
+	passert.EqualsList(s, churn, []int64{0, 0})
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestRetentionJointContributionBounding: Retention(%v) = %v, want 10 privacy IDs retained in a single partition each: %v", col, got, err)
+	}
+}
+
+// Checks that invalid parameters of Retention fail the pipeline when
+// validation errors are deferred.
+func TestRetentionDeferValidationErrors(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, testutils.MakeTripleWithIntValue(10, 0, 0))
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+	pcol := ParDo(s, tripleToPartitionPeriodFn, MakePrivate(s, col, spec))
+	// InitialPeriod and ReturnPeriod must be different.
+	Retention(s, pcol, RetentionParams{
+		InitialPeriod:            0,
+		ReturnPeriod:             0,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0},
+	})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "Retention" {
+		t.Errorf("ValidationErrors() = %v, want a single error for Retention", errs)
+	}
+	// The invalid Retention doesn't consume any budget.
+	for _, usage := range spec.BudgetUsage() {
+		if usage.ConsumedEpsilon != 0 || usage.ConsumedDelta != 0 {
+			t.Errorf("BudgetUsage() after an invalid Retention: got %+v, want no consumed budget", usage)
+		}
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestRetentionDeferValidationErrors: pipeline with an invalid Retention succeeded, expected an error")
+	}
+}
+
+func TestCheckRetentionParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  RetentionParams
+		wantErr bool
+	}{
+		{"valid params", RetentionParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, InitialPeriod: 0, ReturnPeriod: 1, MaxPartitionsContributed: 1}, false},
+		{"same periods", RetentionParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, InitialPeriod: 1, ReturnPeriod: 1, MaxPartitionsContributed: 1}, true},
+		{"no MaxPartitionsContributed", RetentionParams{AggregationEpsilon: 1, PartitionSelectionDelta: 1e-5, InitialPeriod: 0, ReturnPeriod: 1}, true},
+		{"zero epsilon", RetentionParams{PartitionSelectionDelta: 1e-5, InitialPeriod: 0, ReturnPeriod: 1, MaxPartitionsContributed: 1}, true},
+		{"public partitions of the wrong type", RetentionParams{AggregationEpsilon: 1, InitialPeriod: 0, ReturnPeriod: 1, MaxPartitionsContributed: 1, PublicPartitions: []string{"a"}}, true},
+	} {
+		if err := checkRetentionParams(tc.params, noise.LaplaceNoise, reflect.TypeOf(0)); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
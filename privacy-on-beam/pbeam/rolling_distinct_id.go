@@ -0,0 +1,282 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(partitionIndexKey{}))
+	beam.RegisterType(reflect.TypeOf(RollingCount{}))
+	register.DoFn3x1[beam.W, kv.Pair, func(beam.W, partitionIndexKey), error](&expandRollingWindowsFn{})
+	register.Emitter2[beam.W, partitionIndexKey]()
+	register.DoFn2x1[beam.X, func(partitionIndexKey), error](&expandPublicPartitionFn{})
+	register.Emitter1[partitionIndexKey]()
+	register.DoFn2x3[partitionIndexKey, int64, beam.W, RollingCount, error](&decodeRollingWindowFn{})
+}
+
+// RollingDistinctPrivacyIDParams specifies the parameters associated with a
+// RollingDistinctPrivacyID aggregation.
+type RollingDistinctPrivacyIDParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation, as in
+	// DistinctPrivacyIDParams.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation, as in DistinctPrivacyIDParams. Each window of each partition
+	// is selected independently.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// Optional.
+	PartitionSelectionDelta float64
+	// List of partitions present in the output, as in DistinctPrivacyIDParams.
+	// Every window of each public partition is present in the output.
+	//
+	// If PartitionSelectionDelta is specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// Number of consecutive periods in each window, e.g. 7 to count 7-day
+	// actives when periods are days.
+	//
+	// Required.
+	WindowSize int64
+	// Periods at which the first and last windows end. One window is output for
+	// each period in [FirstWindowEnd, LastWindowEnd]. The window ending at
+	// period e contains periods [e-WindowSize+1, e].
+	//
+	// Required; FirstWindowEnd must be smaller than or equal to LastWindowEnd.
+	FirstWindowEnd, LastWindowEnd int64
+	// The maximum number of distinct partitions that a given privacy identifier
+	// can influence in each window. A privacy identifier appearing in the same
+	// partition in overlapping windows is counted in each of them, so the noise
+	// is scaled to MaxPartitionsContributed times the number of windows: prefer
+	// short ranges of windows. If a privacy identifier is associated with more
+	// (partition, window) pairs, random pairs are dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+}
+
+// RollingCount is the number of distinct privacy identifiers in a partition
+// during the window ending at period End, output by RollingDistinctPrivacyID.
+type RollingCount struct {
+	End   int64
+	Count int64
+}
+
+// RollingDistinctPrivacyID counts the number of distinct privacy identifiers
+// associated with each partition during each rolling window of periods, e.g.
+// the daily number of 7-day active users of each product, adding
+// differentially private noise to the counts and doing post-aggregation
+// thresholding to remove low counts.
+//
+// The period of each contribution is an int64, e.g. the number of days since
+// the Unix epoch. A privacy identifier active during several periods of a
+// window is counted once in this window; a privacy identifier active during a
+// period is counted in each of the WindowSize windows containing it.
+//
+// RollingDistinctPrivacyID transforms a PrivatePCollection<K,int64>, where the
+// values are periods, into a PCollection<K,RollingCount> with one element per
+// released window of each partition.
+//
+// Note: Do not use when your results may cause overflows for int64 values.
+// This aggregation is not hardened for such applications yet.
+func RollingDistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params RollingDistinctPrivacyIDParams) beam.PCollection {
+	s = s.Scope("pbeam.RollingDistinctPrivacyID")
+	if pcol.codec == nil {
+		log.Fatalf("pbeam.RollingDistinctPrivacyID: input must be a PrivatePCollection<K,int64>")
+	}
+	partitionT := pcol.codec.KType.T
+	if vT := pcol.codec.VType.T; vT != reflect.TypeOf(int64(0)) {
+		log.Fatalf("pbeam.RollingDistinctPrivacyID: periods must be of type int64, got %v", vT)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "RollingDistinctPrivacyID", err, partitionT, reflect.TypeOf(RollingCount{}))
+	}
+	numWindows, err := checkRollingDistinctPrivacyIDParams(params, partitionT)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.RollingDistinctPrivacyID: %v", err))
+	}
+
+	windows := beam.ParDo(s, &expandRollingWindowsFn{
+		PeriodCodec:    pcol.codec,
+		WindowSize:     params.WindowSize,
+		FirstWindowEnd: params.FirstWindowEnd,
+		LastWindowEnd:  params.LastWindowEnd,
+	}, pcol.col)
+	var publicWindows any
+	if params.PublicPartitions != nil {
+		publicWindows, err = expandPublicPartitions(s, params.PublicPartitions, partitionT, params.FirstWindowEnd, params.LastWindowEnd)
+		if err != nil {
+			return invalid(fmt.Errorf("pbeam.RollingDistinctPrivacyID: %v", err))
+		}
+	}
+	counts := DistinctPrivacyID(s, PrivatePCollection{col: windows, privacySpec: pcol.privacySpec}, DistinctPrivacyIDParams{
+		NoiseKind:                params.NoiseKind,
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionDelta:  params.PartitionSelectionDelta,
+		PublicPartitions:         publicWindows,
+		MaxPartitionsContributed: params.MaxPartitionsContributed * numWindows,
+	})
+	return beam.ParDo(s, &decodeRollingWindowFn{PartitionType: beam.EncodedType{partitionT}}, counts,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+}
+
+// checkRollingDistinctPrivacyIDParams checks params and returns the number of
+// windows per partition.
+func checkRollingDistinctPrivacyIDParams(params RollingDistinctPrivacyIDParams, partitionType reflect.Type) (int64, error) {
+	if err := checkPublicPartitions(params.PublicPartitions, partitionType); err != nil {
+		return 0, err
+	}
+	if params.WindowSize <= 0 {
+		return 0, fmt.Errorf("WindowSize must be strictly positive, got %d", params.WindowSize)
+	}
+	if params.FirstWindowEnd > params.LastWindowEnd {
+		return 0, fmt.Errorf("FirstWindowEnd (%d) must be smaller than or equal to LastWindowEnd (%d)", params.FirstWindowEnd, params.LastWindowEnd)
+	}
+	if err := checkMaxPartitionsContributed(params.MaxPartitionsContributed); err != nil {
+		return 0, err
+	}
+	numWindows := params.LastWindowEnd - params.FirstWindowEnd + 1
+	if numWindows <= 0 || numWindows > math.MaxInt64/params.MaxPartitionsContributed {
+		return 0, fmt.Errorf("MaxPartitionsContributed (%d) times the number of windows overflows", params.MaxPartitionsContributed)
+	}
+	return numWindows, nil
+}
+
+// partitionIndexKey identifies a sub-partition of a partition, e.g. a window
+// or a stage.
+type partitionIndexKey struct {
+	Partition []byte // Encoded partition key.
+	Index     int64
+}
+
+// expandRollingWindowsFn emits a partitionIndexKey for each output window
+// containing the period of a contribution.
+type expandRollingWindowsFn struct {
+	PeriodCodec                   *kv.Codec
+	WindowSize                    int64
+	FirstWindowEnd, LastWindowEnd int64
+}
+
+func (fn *expandRollingWindowsFn) Setup() error {
+	return fn.PeriodCodec.Setup()
+}
+
+func (fn *expandRollingWindowsFn) ProcessElement(id beam.W, pair kv.Pair, emit func(beam.W, partitionIndexKey)) error {
+	_, v, err := fn.PeriodCodec.Decode(pair)
+	if err != nil {
+		return fmt.Errorf("pbeam.expandRollingWindowsFn.ProcessElement: couldn't decode period: %v", err)
+	}
+	period := v.(int64)
+	// Windows ending in [period, period+WindowSize-1] contain period. Avoid
+	// overflows for periods close to the extremes of int64.
+	first := max(period, fn.FirstWindowEnd)
+	last := fn.LastWindowEnd
+	if period <= fn.LastWindowEnd-fn.WindowSize+1 {
+		last = period + fn.WindowSize - 1
+	}
+	for end := first; end <= last; end++ {
+		emit(id, partitionIndexKey{Partition: pair.K, Index: end})
+		if end == math.MaxInt64 {
+			break
+		}
+	}
+	return nil
+}
+
+// expandPublicPartitions returns every partitionIndexKey with an index in
+// [first, last] of the public partitions, as a slice if they are a slice or an
+// array and as a PCollection otherwise.
+func expandPublicPartitions(s beam.Scope, publicPartitions any, partitionType reflect.Type, first, last int64) (any, error) {
+	fn := &expandPublicPartitionFn{
+		PartitionType: beam.EncodedType{partitionType},
+		First:         first,
+		Last:          last,
+	}
+	if col, ok := publicPartitions.(beam.PCollection); ok {
+		return beam.ParDo(s, fn, col), nil
+	}
+	fn.Setup()
+	partitions := reflect.ValueOf(publicPartitions)
+	var keys []partitionIndexKey
+	for i := 0; i < partitions.Len(); i++ {
+		if err := fn.ProcessElement(partitions.Index(i).Interface(), func(k partitionIndexKey) { keys = append(keys, k) }); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// expandPublicPartitionFn emits a partitionIndexKey for each index in
+// [First, Last] of a public partition.
+type expandPublicPartitionFn struct {
+	PartitionType beam.EncodedType
+	partitionEnc  beam.ElementEncoder
+	First, Last   int64
+}
+
+func (fn *expandPublicPartitionFn) Setup() {
+	fn.partitionEnc = beam.NewElementEncoder(fn.PartitionType.T)
+}
+
+func (fn *expandPublicPartitionFn) ProcessElement(partition beam.X, emit func(partitionIndexKey)) error {
+	var buf bytes.Buffer
+	if err := fn.partitionEnc.Encode(partition, &buf); err != nil {
+		return fmt.Errorf("pbeam.expandPublicPartitionFn.ProcessElement: couldn't encode public partition %v: %v", partition, err)
+	}
+	for i := fn.First; i <= fn.Last; i++ {
+		emit(partitionIndexKey{Partition: buf.Bytes(), Index: i})
+		if i == math.MaxInt64 {
+			break
+		}
+	}
+	return nil
+}
+
+// decodeRollingWindowFn decodes the partition of the count of a window.
+type decodeRollingWindowFn struct {
+	PartitionType beam.EncodedType
+	partitionDec  beam.ElementDecoder
+}
+
+func (fn *decodeRollingWindowFn) Setup() {
+	fn.partitionDec = beam.NewElementDecoder(fn.PartitionType.T)
+}
+
+func (fn *decodeRollingWindowFn) ProcessElement(w partitionIndexKey, count int64) (beam.W, RollingCount, error) {
+	partition, err := fn.partitionDec.Decode(bytes.NewBuffer(w.Partition))
+	if err != nil {
+		return nil, RollingCount{}, fmt.Errorf("pbeam.decodeRollingWindowFn.ProcessElement: couldn't decode partition: %v", err)
+	}
+	return partition, RollingCount{End: w.Index, Count: count}, nil
+}
@@ -0,0 +1,124 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[testutils.TripleWithIntValue, int, int64](tripleToPartitionPeriodFn)
+	register.Function2x1[int, RollingCount, string](formatRollingCountFn)
+}
+
+func tripleToPartitionPeriodFn(t testutils.TripleWithIntValue) (int, int64) {
+	return t.Partition, int64(t.Value)
+}
+
+func formatRollingCountFn(k int, c RollingCount) string {
+	return fmt.Sprintf("%d/%d:%d", k, c.End, c.Count)
+}
+
+// Checks that RollingDistinctPrivacyID counts each privacy identifier once in
+// each window it is active in.
+func TestRollingDistinctPrivacyID(t *testing.T) {
+	// Windows of 3 periods ending at periods 2, 3 and 4.
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		// Privacy IDs 0-9 are active in partition 0 during period 0, which is in
+		// the window ending at 2.
+		testutils.MakeTripleWithIntValue(10, 0, 0),
+		// Privacy IDs 0-4 are also active in partition 0 during period 1, which
+		// is in the windows ending at 2 and 3.
+		testutils.MakeTripleWithIntValue(5, 0, 1),
+		// Privacy IDs 10-14 are active in partition 0 during period 4, which is
+		// in the window ending at 4.
+		testutils.MakeTripleWithIntValueStartingFromKey(10, 5, 0, 4))
+	want := []string{"0/2:10", "0/3:5", "0/4:5", "1/2:0", "1/3:0", "1/4:0"}
+
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, tripleToPartitionPeriodFn, pcol)
+	got := RollingDistinctPrivacyID(s, pcol, RollingDistinctPrivacyIDParams{
+		WindowSize:               3,
+		FirstWindowEnd:           2,
+		LastWindowEnd:            4,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0, 1},
+	})
+	passert.EqualsList(s, beam.ParDo(s, formatRollingCountFn, got), want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestRollingDistinctPrivacyID: RollingDistinctPrivacyID(%v) = %v, want %v: %v", col, got, want, err)
+	}
+}
+
+func TestCheckRollingDistinctPrivacyIDParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc           string
+		params         RollingDistinctPrivacyIDParams
+		wantNumWindows int64
+		wantErr        bool
+	}{
+		{"valid params", RollingDistinctPrivacyIDParams{WindowSize: 7, FirstWindowEnd: 10, LastWindowEnd: 16, MaxPartitionsContributed: 1}, 7, false},
+		{"zero WindowSize", RollingDistinctPrivacyIDParams{FirstWindowEnd: 10, LastWindowEnd: 16, MaxPartitionsContributed: 1}, 0, true},
+		{"FirstWindowEnd after LastWindowEnd", RollingDistinctPrivacyIDParams{WindowSize: 7, FirstWindowEnd: 16, LastWindowEnd: 10, MaxPartitionsContributed: 1}, 0, true},
+		{"no MaxPartitionsContributed", RollingDistinctPrivacyIDParams{WindowSize: 7, FirstWindowEnd: 10, LastWindowEnd: 16}, 0, true},
+		{"public partitions of the wrong type", RollingDistinctPrivacyIDParams{WindowSize: 7, FirstWindowEnd: 10, LastWindowEnd: 16, MaxPartitionsContributed: 1, PublicPartitions: []string{"a"}}, 0, true},
+	} {
+		numWindows, err := checkRollingDistinctPrivacyIDParams(tc.params, reflect.TypeOf(0))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if numWindows != tc.wantNumWindows {
+			t.Errorf("With %s, got %d windows, want %d", tc.desc, numWindows, tc.wantNumWindows)
+		}
+	}
+}
+
+func TestRollingDistinctPrivacyIDDeferValidationErrors(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, testutils.MakeTripleWithIntValue(10, 0, 0))
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+	spec := privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1, DeferValidationErrors: true})
+	pcol := ParDo(s, tripleToPartitionPeriodFn, MakePrivate(s, col, spec))
+	// WindowSize must be strictly positive.
+	RollingDistinctPrivacyID(s, pcol, RollingDistinctPrivacyIDParams{
+		WindowSize:               0,
+		FirstWindowEnd:           2,
+		LastWindowEnd:            4,
+		MaxPartitionsContributed: 1,
+		PublicPartitions:         []int{0},
+	})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "RollingDistinctPrivacyID" {
+		t.Errorf("ValidationErrors() = %v, want a single error for RollingDistinctPrivacyID", errs)
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestRollingDistinctPrivacyIDDeferValidationErrors: pipeline with an invalid RollingDistinctPrivacyID succeeded, expected an error")
+	}
+}
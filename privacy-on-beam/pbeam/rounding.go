@@ -0,0 +1,136 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn2x2[beam.W, int64, beam.W, int64](&roundInt64Fn{})
+	register.DoFn2x2[beam.W, float64, beam.W, float64](&roundFloat64Fn{})
+}
+
+// StandardDeviation returns the standard deviation of the noise described by p.
+func (p OutputNoiseParams) StandardDeviation() (float64, error) {
+	if err := p.check(); err != nil {
+		return 0, err
+	}
+	switch p.NoiseKind.toNoiseKind() {
+	case noise.LaplaceNoise:
+		return math.Sqrt2 * float64(p.MaxPartitionsContributed) * p.MaxContribution / p.Epsilon, nil
+	case noise.GaussianNoise:
+		return noise.SigmaForGaussian(p.MaxPartitionsContributed, p.MaxContribution, p.Epsilon, p.Delta), nil
+	default:
+		return 0, fmt.Errorf("unknown noise kind %v", p.NoiseKind)
+	}
+}
+
+// RoundingParams specifies how to round the outputs of an aggregation
+// according to their noise.
+type RoundingParams struct {
+	// Noise that was added to the outputs.
+	//
+	// Required.
+	NoiseParams OutputNoiseParams
+	// Number of significant digits of the noise standard deviation that are
+	// kept. For example, with a standard deviation of 37 and
+	// SignificantDigits=1, outputs are rounded to the nearest multiple of 10;
+	// with SignificantDigits=2, they are rounded to the nearest integer.
+	//
+	// Defaults to 1.
+	SignificantDigits int
+}
+
+// RoundToNoisePrecision rounds the outputs of an aggregation to a precision
+// consistent with the standard deviation of the noise that was added to them,
+// so that outputs don't convey a false sense of precision. Outputs are rounded
+// to the nearest multiple of a power of 10 determined by the standard
+// deviation and params.SignificantDigits.
+//
+// Rounding only depends on the noisy outputs and on public noise parameters,
+// so RoundToNoisePrecision is a post-processing step and doesn't consume any
+// privacy budget.
+//
+// RoundToNoisePrecision transforms a PCollection<K, int64> or
+// PCollection<K, float64> into a PCollection of the same type.
+func RoundToNoisePrecision(s beam.Scope, col beam.PCollection, params RoundingParams) beam.PCollection {
+	s = s.Scope("pbeam.RoundToNoisePrecision")
+	_, valueT := beam.ValidateKVType(col)
+	if params.SignificantDigits == 0 {
+		params.SignificantDigits = 1
+	}
+	granularity, err := roundingGranularity(params)
+	if err != nil {
+		log.Fatalf("pbeam.RoundToNoisePrecision: %v", err)
+	}
+	switch valueT.Type() {
+	case reflect.TypeOf(int64(0)):
+		return beam.ParDo(s, &roundInt64Fn{Granularity: granularity}, col)
+	case reflect.TypeOf(float64(0)):
+		return beam.ParDo(s, &roundFloat64Fn{Granularity: granularity}, col)
+	default:
+		log.Fatalf("pbeam.RoundToNoisePrecision: value type must be int64 or float64, got %v", valueT.Type())
+	}
+	return beam.PCollection{}
+}
+
+// roundingGranularity returns the power of 10 to whose multiples outputs are
+// rounded.
+func roundingGranularity(params RoundingParams) (float64, error) {
+	if params.SignificantDigits < 1 {
+		return 0, fmt.Errorf("SignificantDigits must be positive, was %d instead", params.SignificantDigits)
+	}
+	stdDev, err := params.NoiseParams.StandardDeviation()
+	if err != nil {
+		return 0, fmt.Errorf("NoiseParams: %w", err)
+	}
+	exponent := math.Floor(math.Log10(stdDev)) - float64(params.SignificantDigits-1)
+	return math.Pow(10, exponent), nil
+}
+
+type roundInt64Fn struct {
+	Granularity float64
+}
+
+func (fn *roundInt64Fn) ProcessElement(k beam.W, v int64) (beam.W, int64) {
+	if fn.Granularity <= 1 {
+		return k, v
+	}
+	return k, int64(math.Round(float64(v)/fn.Granularity) * fn.Granularity)
+}
+
+type roundFloat64Fn struct {
+	Granularity float64
+}
+
+func (fn *roundFloat64Fn) ProcessElement(k beam.W, v float64) (beam.W, float64) {
+	if fn.Granularity < 1 {
+		// Dividing by the inverse of the granularity avoids artifacts such as
+		// 0.30000000000000004.
+		inverse := math.Round(1 / fn.Granularity)
+		return k, math.Round(v*inverse) / inverse
+	}
+	return k, math.Round(v/fn.Granularity) * fn.Granularity
+}
@@ -0,0 +1,146 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func TestOutputNoiseParamsStandardDeviation(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  OutputNoiseParams
+		want    float64
+		wantErr bool
+	}{
+		{
+			desc:   "Laplace noise",
+			params: OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 2, MaxPartitionsContributed: 3, MaxContribution: 10},
+			want:   math.Sqrt2 * 3 * 10 / 2,
+		},
+		{
+			desc:   "Gaussian noise",
+			params: OutputNoiseParams{NoiseKind: GaussianNoise{}, Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 4, MaxContribution: 2},
+			want:   noise.SigmaForGaussian(4, 2, 1, 1e-5),
+		},
+		{
+			desc:    "invalid parameters",
+			params:  OutputNoiseParams{NoiseKind: GaussianNoise{}, Epsilon: 1, MaxPartitionsContributed: 4, MaxContribution: 2},
+			wantErr: true,
+		},
+	} {
+		got, err := tc.params.StandardDeviation()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("StandardDeviation: with %s got err=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if !testutils.ApproxEquals(got, tc.want) {
+			t.Errorf("StandardDeviation: with %s got %f, want %f", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestRoundingGranularity(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  RoundingParams
+		want    float64
+		wantErr bool
+	}{
+		{
+			desc: "standard deviation ≈ 14.1, 1 significant digit",
+			params: RoundingParams{
+				NoiseParams:       OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 10},
+				SignificantDigits: 1,
+			},
+			want: 10,
+		},
+		{
+			desc: "standard deviation ≈ 14.1, 2 significant digits",
+			params: RoundingParams{
+				NoiseParams:       OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 10},
+				SignificantDigits: 2,
+			},
+			want: 1,
+		},
+		{
+			desc: "standard deviation ≈ 0.141, 1 significant digit",
+			params: RoundingParams{
+				NoiseParams:       OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 0.1},
+				SignificantDigits: 1,
+			},
+			want: 0.1,
+		},
+		{
+			desc: "negative significant digits",
+			params: RoundingParams{
+				NoiseParams:       OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 10},
+				SignificantDigits: -1,
+			},
+			wantErr: true,
+		},
+	} {
+		got, err := roundingGranularity(tc.params)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("roundingGranularity: with %s got err=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if !testutils.ApproxEquals(got, tc.want) {
+			t.Errorf("roundingGranularity: with %s got %f, want %f", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestRoundToNoisePrecisionInt64(t *testing.T) {
+	outputs := []testutils.PairII64{{0, 1234}, {1, -56}, {2, 4}}
+	result := []testutils.PairII64{{0, 1230}, {1, -60}, {2, 0}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairII64ToKV, col)
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+
+	// Standard deviation is ≈ 14.1, so outputs are rounded to multiples of 10.
+	got := RoundToNoisePrecision(s, col, RoundingParams{
+		NoiseParams: OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 10},
+	})
+
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestRoundToNoisePrecisionInt64: RoundToNoisePrecision(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestRoundToNoisePrecisionFloat64(t *testing.T) {
+	outputs := []testutils.PairIF64{{0, 1.23456}, {1, -0.56789}, {2, 0.3}}
+	result := []testutils.PairIF64{{0, 1.2}, {1, -0.6}, {2, 0.3}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairIF64ToKV, col)
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+
+	// Standard deviation is ≈ 0.141, so outputs are rounded to multiples of 0.1.
+	got := RoundToNoisePrecision(s, col, RoundingParams{
+		NoiseParams: OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 0.1},
+	})
+
+	testutils.EqualsKVFloat64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestRoundToNoisePrecisionFloat64: RoundToNoisePrecision(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
@@ -0,0 +1,197 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/go/v3/rand"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn2x3[beam.W, int64, beam.W, int64, error](&addSeededNoiseInt64Fn{})
+	register.DoFn2x3[beam.W, float64, beam.W, float64, error](&addSeededNoiseFloat64Fn{})
+}
+
+// minNoiseSeedKeyLength is the minimum length of PrivacySpecParams.NoiseSeedKey,
+// in bytes.
+const minNoiseSeedKeyLength = 32
+
+// noiseSeed derives the keys used to seed the noise of aggregations from
+// PrivacySpecParams.NoiseSeedKey.
+type noiseSeed struct {
+	key          []byte
+	mux          sync.Mutex
+	aggregations uint64 // Number of aggregation keys derived so far.
+}
+
+// aggregationKey returns a new key to seed the noise of an aggregation. Each
+// aggregation gets a different key, so that aggregations on the same
+// partitions don't add correlated noise. Keys only depend on the order in which
+// aggregations are constructed, so they are the same when a bundle is
+// re-executed.
+func (ns *noiseSeed) aggregationKey() []byte {
+	ns.mux.Lock()
+	defer ns.mux.Unlock()
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], ns.aggregations)
+	ns.aggregations++
+	mac := hmac.New(sha256.New, ns.key)
+	mac.Write(index[:])
+	return mac.Sum(nil)
+}
+
+// seedsNoise returns whether Count and SumPerKey derive their noise from the
+// NoiseSeedKey of the PrivacySpec. Noise isn't seeded in test mode, since no
+// noise is added.
+func (ps *PrivacySpec) seedsNoise() bool {
+	return ps.noiseSeed != nil && !ps.testMode.isEnabled()
+}
+
+// checkNoNoiseSeedKey returns an error if the PrivacySpec has a NoiseSeedKey,
+// for the aggregations and options that don't support it.
+func (ps *PrivacySpec) checkNoNoiseSeedKey(feature string) error {
+	if ps.noiseSeed != nil {
+		return fmt.Errorf("%s doesn't support PrivacySpecParams.NoiseSeedKey", feature)
+	}
+	return nil
+}
+
+// addSeededNoise adds noise to the values of result, a PCollection<K,V> of
+// sums computed without noise where V is int64 or float64, if the PrivacySpec
+// seeds noise. The noise of each partition is derived from the key of the
+// partition; its sensitivity is that of a bounded sum with the given
+// parameters. Otherwise, it returns result unchanged.
+func addSeededNoise(s beam.Scope, spec PrivacySpec, noiseKind noise.Kind, epsilon, delta float64, maxPartitionsContributed int64, lower, upper float64, vKind reflect.Kind, partitionType reflect.Type, result beam.PCollection) beam.PCollection {
+	if !spec.seedsNoise() {
+		return result
+	}
+	s = s.Scope("addSeededNoise")
+	key := spec.noiseSeed.aggregationKey()
+	lInf := math.Max(math.Abs(lower), math.Abs(upper))
+	var fn any
+	switch vKind {
+	case reflect.Int64:
+		fn = &addSeededNoiseInt64Fn{
+			PartitionType:   beam.EncodedType{partitionType},
+			Key:             key,
+			NoiseKind:       noiseKind,
+			Epsilon:         epsilon,
+			Delta:           delta,
+			L0Sensitivity:   maxPartitionsContributed,
+			LInfSensitivity: int64(lInf),
+		}
+	case reflect.Float64:
+		fn = &addSeededNoiseFloat64Fn{
+			PartitionType:   beam.EncodedType{partitionType},
+			Key:             key,
+			NoiseKind:       noiseKind,
+			Epsilon:         epsilon,
+			Delta:           delta,
+			L0Sensitivity:   maxPartitionsContributed,
+			LInfSensitivity: lInf,
+		}
+	default:
+		log.Fatalf("addSeededNoise: vKind(%v) should be int64 or float64", vKind)
+	}
+	return beam.ParDo(s, fn, result)
+}
+
+// partitionNoise returns a Noise whose randomness is the AES-CTR keystream of
+// the HMAC-SHA256 of the encoded partition keyed with key.
+func partitionNoise(noiseKind noise.Kind, key []byte, partitionEnc beam.ElementEncoder, partition beam.W) (noise.Noise, error) {
+	var partitionBuf bytes.Buffer
+	if err := partitionEnc.Encode(partition, &partitionBuf); err != nil {
+		return nil, fmt.Errorf("couldn't encode partition %v: %w", partition, err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(partitionBuf.Bytes())
+	stream, err := rand.NewDeterministicStream(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return noise.ToNoiseWithStream(noiseKind, stream), nil
+}
+
+// addSeededNoiseInt64Fn adds noise derived from the partition key to int64 sums.
+type addSeededNoiseInt64Fn struct {
+	PartitionType   beam.EncodedType
+	partitionEnc    beam.ElementEncoder
+	Key             []byte
+	NoiseKind       noise.Kind
+	Epsilon, Delta  float64
+	L0Sensitivity   int64
+	LInfSensitivity int64
+}
+
+func (fn *addSeededNoiseInt64Fn) Setup() {
+	fn.partitionEnc = beam.NewElementEncoder(fn.PartitionType.T)
+}
+
+func (fn *addSeededNoiseInt64Fn) ProcessElement(k beam.W, v int64) (beam.W, int64, error) {
+	n, err := partitionNoise(fn.NoiseKind, fn.Key, fn.partitionEnc, k)
+	if err != nil {
+		return k, 0, fmt.Errorf("pbeam.addSeededNoiseInt64Fn.ProcessElement: %w", err)
+	}
+	noisy, err := auditNoise(n, "SeededNoiseInt64").AddNoiseInt64(v, fn.L0Sensitivity, fn.LInfSensitivity, fn.Epsilon, fn.Delta)
+	return k, noisy, err
+}
+
+func (fn *addSeededNoiseInt64Fn) FinishBundle(ctx context.Context) {
+	flushNoiseDraws(ctx)
+}
+
+// addSeededNoiseFloat64Fn adds noise derived from the partition key to float64
+// sums.
+type addSeededNoiseFloat64Fn struct {
+	PartitionType   beam.EncodedType
+	partitionEnc    beam.ElementEncoder
+	Key             []byte
+	NoiseKind       noise.Kind
+	Epsilon, Delta  float64
+	L0Sensitivity   int64
+	LInfSensitivity float64
+}
+
+func (fn *addSeededNoiseFloat64Fn) Setup() {
+	fn.partitionEnc = beam.NewElementEncoder(fn.PartitionType.T)
+}
+
+func (fn *addSeededNoiseFloat64Fn) ProcessElement(k beam.W, v float64) (beam.W, float64, error) {
+	n, err := partitionNoise(fn.NoiseKind, fn.Key, fn.partitionEnc, k)
+	if err != nil {
+		return k, 0, fmt.Errorf("pbeam.addSeededNoiseFloat64Fn.ProcessElement: %w", err)
+	}
+	noisy, err := auditNoise(n, "SeededNoiseFloat64").AddNoiseFloat64(v, fn.L0Sensitivity, fn.LInfSensitivity, fn.Epsilon, fn.Delta)
+	return k, noisy, err
+}
+
+func (fn *addSeededNoiseFloat64Fn) FinishBundle(ctx context.Context) {
+	flushNoiseDraws(ctx)
+}
@@ -0,0 +1,79 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// Checks that SumPerKey outputs the same noisy sums when run twice with the
+// same NoiseSeedKey, and that these sums are close to the raw sums.
+func TestSumPerKeyNoiseSeedKey(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeSampleTripleWithFloatValue(100, 0),
+		testutils.MakeSampleTripleWithFloatValue(50, 1))
+	result := []testutils.PairIF64{
+		{0, 100},
+		{1, 50},
+		{2, 0},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+	key := bytes.Repeat([]byte{1}, 32)
+
+	// We have 3 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁴ probability (k=24).
+	epsilon, k, l1Sensitivity := 10.0, 24.0, 1.0
+	sumPerKey := func() beam.PCollection {
+		pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+			AggregationEpsilon: epsilon,
+			NoiseSeedKey:       key,
+		}))
+		pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+		return SumPerKey(s, pcol, SumParams{
+			MaxPartitionsContributed: 1,
+			MinValue:                 0.0,
+			MaxValue:                 1.0,
+			NoiseKind:                LaplaceNoise{},
+			PublicPartitions:         []int{0, 1, 2},
+		})
+	}
+	got1, got2 := sumPerKey(), sumPerKey()
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.EqualsKVFloat64(t, s, got1, got2)
+	testutils.ApproxEqualsKVFloat64(t, s, got1, want, testutils.LaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSumPerKeyNoiseSeedKey: SumPerKey(%v) = %v, expected %v: %v", col, got1, want, err)
+	}
+}
+
+func TestNoiseSeedAggregationKey(t *testing.T) {
+	seed1 := &noiseSeed{key: bytes.Repeat([]byte{1}, 32)}
+	seed2 := &noiseSeed{key: bytes.Repeat([]byte{1}, 32)}
+	first, second := seed1.aggregationKey(), seed1.aggregationKey()
+	if bytes.Equal(first, second) {
+		t.Errorf("aggregationKey: got the same key %v for two aggregations", first)
+	}
+	if got := seed2.aggregationKey(); !bytes.Equal(got, first) {
+		t.Errorf("aggregationKey: got %v for the first aggregation of a noiseSeed with the same key, want %v", got, first)
+	}
+}
@@ -31,6 +31,7 @@ import (
 
 func init() {
 	register.Combiner3[partitionSelectionAccum, beam.W, bool](&partitionSelectionFn{})
+	register.Combiner3[partitionSelectionAccum, beam.W, float64](&keepProbabilityFn{})
 
 	register.Function3x0[beam.W, bool, func(beam.W)](dropThresholdedPartitionsBool)
 	register.Emitter1[beam.W]()
@@ -50,21 +51,107 @@ type SelectPartitionsParams = PartitionSelectionParams
 // V is the partition key. SelectPartitions transforms a PrivatePCollection<K,V> into a
 // PCollection<K> and a PrivatePCollection<V> into a PCollection<V>.
 func SelectPartitions(s beam.Scope, pcol PrivatePCollection, params SelectPartitionsParams) beam.PCollection {
+	return selectPartitionsWithBudget(s, pcol, params, nil)
+}
+
+// selectPartitionsWithBudget is SelectPartitions. If budget isn't nil, it is
+// the budget of params, reserved and committed by an aggregation built on top
+// of SelectPartitions, e.g. DistinctPerKey, and SelectPartitions doesn't
+// consume it again.
+func selectPartitionsWithBudget(s beam.Scope, pcol PrivatePCollection, params SelectPartitionsParams, budget *reservedBudget) beam.PCollection {
 	s = s.Scope("pbeam.SelectPartitions")
-	// Obtain type information from the underlying PCollection<K,V>.
-	_, pT := beam.ValidateKVType(pcol.col)
+	pcol = extractTaggedStructFields(s, pcol, false)
 	spec := pcol.privacySpec
 	var err error
-	params.Epsilon, params.Delta, err = spec.partitionSelectionBudget.consume(params.Epsilon, params.Delta)
+	if budget == nil {
+		params.Epsilon, params.Delta, err = spec.partitionSelectionBudget.consume(params.Epsilon, params.Delta)
+		if err != nil {
+			return spec.invalidAggregation(s, "SelectPartitions", fmt.Errorf("Couldn't consume budget for SelectPartitions: %v", err), partitionType(pcol))
+		}
+	}
+
+	err = checkSelectPartitionsParams(params)
 	if err != nil {
-		log.Fatalf("Couldn't consume budget for SelectPartitions: %v", err)
+		return spec.invalidAggregation(s, "SelectPartitions", fmt.Errorf("pbeam.SelectPartitions: %v", err), partitionType(pcol))
 	}
+	spec.aggregationRegistered("SelectPartitions", 0, 0, params.Epsilon, params.Delta)
+	return selectPartitions(s, pcol, params)
+}
 
+// SelectPartitionsKeepProbabilities is a variant of SelectPartitions for tests
+// covering partition selection, which can only be used in test mode. Instead of
+// sampling whether to keep each partition, it returns the probability with
+// which SelectPartitions would keep it outside of test mode, given the number
+// of privacy identifiers contributing to it after contribution bounding. This
+// makes the partition selection deterministic, so that tests don't need large
+// counts or retries to avoid flakiness. It consumes the same budget as
+// SelectPartitions.
+//
+// It doesn't support PrivacySpecParams.PartitionSelector, whose probabilities
+// aren't known.
+//
+// SelectPartitionsKeepProbabilities transforms a PrivatePCollection<K,V> into a
+// PCollection<K,float64> and a PrivatePCollection<V> into a
+// PCollection<V,float64>.
+func SelectPartitionsKeepProbabilities(s beam.Scope, pcol PrivatePCollection, params SelectPartitionsParams) beam.PCollection {
+	s = s.Scope("pbeam.SelectPartitionsKeepProbabilities")
+	pcol = extractTaggedStructFields(s, pcol, false)
+	spec := pcol.privacySpec
+	invalid := func(err error) beam.PCollection {
+		return spec.invalidAggregation(s, "SelectPartitionsKeepProbabilities", err, partitionType(pcol), reflect.TypeOf(float64(0)))
+	}
+	// Returning keep probabilities isn't differentially private.
+	if !spec.testMode.isEnabled() {
+		return invalid(fmt.Errorf("pbeam.SelectPartitionsKeepProbabilities can only be used in test mode"))
+	}
+	if spec.partitionSelector != nil {
+		return invalid(fmt.Errorf("pbeam.SelectPartitionsKeepProbabilities doesn't support custom PartitionSelectors"))
+	}
+	if params.PartitionCountEpsilon != 0 {
+		return invalid(fmt.Errorf("pbeam.SelectPartitionsKeepProbabilities doesn't support PartitionCountEpsilon"))
+	}
+	var err error
+	params.Epsilon, params.Delta, err = spec.partitionSelectionBudget.consume(params.Epsilon, params.Delta)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume budget for SelectPartitionsKeepProbabilities: %v", err))
+	}
 	err = checkSelectPartitionsParams(params)
 	if err != nil {
-		log.Fatalf("pbeam.SelectPartitions: %v", err)
+		return invalid(fmt.Errorf("pbeam.SelectPartitionsKeepProbabilities: %v", err))
+	}
+	spec.aggregationRegistered("SelectPartitionsKeepProbabilities", 0, 0, params.Epsilon, params.Delta)
+
+	partitions := beam.SwapKV(s, boundPartitionsContributed(s, pcol, params)) // PCollection<K, ID>
+	probabilities := beam.CombinePerKey(s, newKeepProbabilityFn(*spec, params), partitions)
+	return traceStage(s, *spec, "SelectPartitionsKeepProbabilities.aggregate", probabilities)
+}
+
+// selectPartitions performs the partition selection of SelectPartitions,
+// assuming that the budget was already consumed and params were checked.
+func selectPartitions(s beam.Scope, pcol PrivatePCollection, params SelectPartitionsParams) beam.PCollection {
+	spec := pcol.privacySpec
+	partitions := boundPartitionsContributed(s, pcol, params)
+	if params.PartitionCountEpsilon > 0 {
+		estimatePartitionCount(s, *spec, params.PartitionCountEpsilon, params.MaxPartitionsContributed, partitions)
+		params.Epsilon -= params.PartitionCountEpsilon
 	}
 
+	// Finally, we swap the privacy and partition key and perform partition selection.
+	partitions = beam.SwapKV(s, partitions) // PCollection<K, ID>
+	partitions = beam.CombinePerKey(s, newPartitionSelectionFn(*spec, params), partitions)
+	partitions = traceStage(s, *spec, "SelectPartitions.aggregate", partitions)
+	result := beam.ParDo(s, dropThresholdedPartitionsBool, partitions)
+	return result
+}
+
+// boundPartitionsContributed returns a PCollection<ID, K> with one element per
+// partition each privacy identifier contributes to, after cross-partition
+// contribution bounding.
+func boundPartitionsContributed(s beam.Scope, pcol PrivatePCollection, params SelectPartitionsParams) beam.PCollection {
+	// Obtain type information from the underlying PCollection<K,V>.
+	_, pT := beam.ValidateKVType(pcol.col)
+	spec := pcol.privacySpec
+
 	// First, we drop the values if we have (privacyKey, partitionKey, value) tuples.
 	// Afterwards, we will have (privacyKey, partitionKey) pairs.
 	// If we initially have (privacyKey, partitionKey) pairs already, we do nothing.
@@ -89,13 +176,20 @@ func SelectPartitions(s beam.Scope, pcol PrivatePCollection, params SelectPartit
 	// Third, do cross-partition contribution bounding if not in test mode without contribution bounding.
 	if spec.testMode != TestModeWithoutContributionBounding {
 		partitions = boundContributions(s, partitions, params.MaxPartitionsContributed)
+		partitions = traceStage(s, *spec, "SelectPartitions.boundContributions", partitions)
 	}
 
-	// Finally, we swap the privacy and partition key and perform partition selection.
-	partitions = beam.SwapKV(s, partitions) // PCollection<K, ID>
-	partitions = beam.CombinePerKey(s, newPartitionSelectionFn(*spec, params), partitions)
-	result := beam.ParDo(s, dropThresholdedPartitionsBool, partitions)
-	return result
+	return partitions
+}
+
+// partitionType returns the type of the partitions output by SelectPartitions
+// on pcol.
+func partitionType(pcol PrivatePCollection) reflect.Type {
+	_, pT := beam.ValidateKVType(pcol.col)
+	if pT.Type() == reflect.TypeOf(kv.Pair{}) && pcol.codec != nil {
+		return pcol.codec.KType.T
+	}
+	return pT.Type()
 }
 
 func checkSelectPartitionsParams(params SelectPartitionsParams) error {
@@ -107,6 +201,9 @@ func checkSelectPartitionsParams(params SelectPartitionsParams) error {
 	if err != nil {
 		return err
 	}
+	if params.PartitionCountEpsilon < 0 || params.PartitionCountEpsilon >= params.Epsilon {
+		return fmt.Errorf("PartitionCountEpsilon must be in [0, Epsilon), got %f with Epsilon=%f", params.PartitionCountEpsilon, params.Epsilon)
+	}
 	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
 }
 
@@ -118,12 +215,13 @@ type partitionSelectionFn struct {
 	Epsilon                  float64
 	Delta                    float64
 	PreThreshold             int64
+	PartitionSelector        *encodedPartitionSelector
 	MaxPartitionsContributed int64
 	TestMode                 TestMode
 }
 
 func newPartitionSelectionFn(spec PrivacySpec, params SelectPartitionsParams) *partitionSelectionFn {
-	return &partitionSelectionFn{Epsilon: params.Epsilon, Delta: params.Delta, PreThreshold: spec.preThreshold, MaxPartitionsContributed: params.MaxPartitionsContributed, TestMode: spec.testMode}
+	return &partitionSelectionFn{Epsilon: params.Epsilon, Delta: params.Delta, PreThreshold: spec.preThreshold, MaxPartitionsContributed: params.MaxPartitionsContributed, TestMode: spec.testMode, PartitionSelector: spec.partitionSelector}
 }
 
 func (fn *partitionSelectionFn) CreateAccumulator() (partitionSelectionAccum, error) {
@@ -149,13 +247,53 @@ func (fn *partitionSelectionFn) ExtractOutput(a partitionSelectionAccum) (bool,
 	if fn.TestMode.isEnabled() {
 		return true, nil
 	}
-	return a.SP.ShouldKeepPartition()
+	return fn.PartitionSelector.shouldKeepPartition(a.SP, PartitionSelectorParams{Epsilon: fn.Epsilon, Delta: fn.Delta, MaxPartitionsContributed: fn.MaxPartitionsContributed, PreThreshold: fn.PreThreshold})
 }
 
 func (fn *partitionSelectionFn) String() string {
 	return fmt.Sprintf("%#v", fn)
 }
 
+// keepProbabilityFn is like partitionSelectionFn, but returns the probability
+// of keeping each partition instead of sampling whether to keep it.
+type keepProbabilityFn struct {
+	Epsilon                  float64
+	Delta                    float64
+	PreThreshold             int64
+	MaxPartitionsContributed int64
+}
+
+func newKeepProbabilityFn(spec PrivacySpec, params SelectPartitionsParams) *keepProbabilityFn {
+	return &keepProbabilityFn{Epsilon: params.Epsilon, Delta: params.Delta, PreThreshold: spec.preThreshold, MaxPartitionsContributed: params.MaxPartitionsContributed}
+}
+
+func (fn *keepProbabilityFn) CreateAccumulator() (partitionSelectionAccum, error) {
+	sp, err := dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+		Epsilon:                  fn.Epsilon,
+		Delta:                    fn.Delta,
+		PreThreshold:             fn.PreThreshold,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed})
+	return partitionSelectionAccum{SP: sp}, err
+}
+
+func (fn *keepProbabilityFn) AddInput(a partitionSelectionAccum, _ beam.W) (partitionSelectionAccum, error) {
+	err := a.SP.Increment()
+	return a, err
+}
+
+func (fn *keepProbabilityFn) MergeAccumulators(a, b partitionSelectionAccum) (partitionSelectionAccum, error) {
+	err := a.SP.Merge(b.SP)
+	return a, err
+}
+
+func (fn *keepProbabilityFn) ExtractOutput(a partitionSelectionAccum) (float64, error) {
+	return a.SP.KeepPartitionProbability()
+}
+
+func (fn *keepProbabilityFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
 // dropThresholdedPartitionsBool drops thresholded bool partitions, i.e. those
 // that have false v, by emitting only non-thresholded partitions. Differently from
 // other dropThresholdedPartitionsFn's, since v only indicates whether or not a
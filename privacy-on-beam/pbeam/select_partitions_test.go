@@ -205,3 +205,70 @@ func TestSelectPartitionsPrethresholding(t *testing.T) {
 		t.Errorf("Expected only a single partition to be kept with pre-thresholding:  %v", err)
 	}
 }
+
+// Checks that SelectPartitions reports the number of candidate partitions if
+// PartitionCountEpsilon is set.
+func TestSelectPartitionsEstimatesPartitionCount(t *testing.T) {
+	// 3 partitions, the first one with 2 privacy IDs.
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedV(2, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(2, 1, 1),
+		testutils.MakePairsWithFixedVStartingFromKey(3, 1, 2))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		TestMode:                  TestModeWithContributionBounding,
+	}))
+	SelectPartitions(s, pcol, PartitionSelectionParams{MaxPartitionsContributed: 1, PartitionCountEpsilon: 0.1})
+	pr, err := ptest.RunWithMetrics(p)
+	if err != nil {
+		t.Fatalf("TestSelectPartitionsEstimatesPartitionCount: %v", err)
+	}
+	var found bool
+	for _, g := range pr.Metrics().AllMetrics().Gauges() {
+		if g.Namespace() == "pbeam.SelectPartitions" && g.Name() == "estimated_partitions" {
+			found = true
+			// There is no noise in test mode.
+			if got := g.Result().Value; got != 3 {
+				t.Errorf("TestSelectPartitionsEstimatesPartitionCount: got %d estimated partitions, want 3", got)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("TestSelectPartitionsEstimatesPartitionCount: no estimated_partitions gauge")
+	}
+}
+
+// Checks that SelectPartitionsKeepProbabilities is invalid outside of test mode.
+func TestSelectPartitionsKeepProbabilitiesRequiresTestMode(t *testing.T) {
+	_, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		DeferValidationErrors:     true,
+	})
+	SelectPartitionsKeepProbabilities(s, MakePrivate(s, col, spec), PartitionSelectionParams{MaxPartitionsContributed: 1})
+	if errs := spec.ValidationErrors(); len(errs) != 1 || errs[0].Aggregation != "SelectPartitionsKeepProbabilities" {
+		t.Errorf("ValidationErrors() = %v, want a single error for SelectPartitionsKeepProbabilities", errs)
+	}
+}
+
+func TestCheckSelectPartitionsParamsPartitionCountEpsilon(t *testing.T) {
+	for _, tc := range []struct {
+		partitionCountEpsilon float64
+		wantErr               bool
+	}{
+		{0, false},
+		{0.5, false},
+		{1, true},
+		{-0.5, true},
+	} {
+		params := PartitionSelectionParams{Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 1, PartitionCountEpsilon: tc.partitionCountEpsilon}
+		if err := checkSelectPartitionsParams(params); (err != nil) != tc.wantErr {
+			t.Errorf("checkSelectPartitionsParams with PartitionCountEpsilon=%f: got err=%v, wantErr=%t", tc.partitionCountEpsilon, err, tc.wantErr)
+		}
+	}
+}
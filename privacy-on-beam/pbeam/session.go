@@ -0,0 +1,234 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(Session{}))
+	beam.RegisterType(reflect.TypeOf(partitionSessions{}))
+	register.DoFn3x0[kv.Pair, func(*int64) bool, func(kv.Pair, Session)](&splitSessionsFn{})
+	register.Emitter2[kv.Pair, Session]()
+	register.DoFn2x3[kv.Pair, func(*Session) bool, beam.W, partitionSessions, error](&collectSessionsFn{})
+	register.DoFn3x1[beam.W, partitionSessions, func(beam.W, kv.Pair), error](&flattenSessionsFn{})
+	register.Emitter2[beam.W, kv.Pair]()
+}
+
+// SessionParams specifies the parameters associated with Sessionize.
+type SessionParams struct {
+	// Maximum gap between two consecutive events of the same session. Events of
+	// a privacy identifier in a partition that are more than Gap apart belong to
+	// different sessions.
+	//
+	// Required.
+	Gap int64
+	// The maximum number of sessions that a privacy identifier can have in a
+	// single partition. If a privacy identifier has more sessions in a
+	// partition, random sessions are dropped.
+	//
+	// Required.
+	MaxSessionsPerPartition int64
+	// The maximum number of distinct partitions in which a privacy identifier
+	// can have sessions. If a privacy identifier has sessions in more
+	// partitions, random partitions are dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+}
+
+// CountParams returns the contribution bounds of a Count of the sessions
+// output by Sessionize with these params. Other fields, e.g. the privacy
+// budget, must be set by the caller.
+func (params SessionParams) CountParams() CountParams {
+	return CountParams{
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+		MaxValue:                 params.MaxSessionsPerPartition,
+	}
+}
+
+// SumParams returns the contribution bounds of a Sum of values computed for
+// each session output by Sessionize with these params, where the value of
+// each session is in [minValue, maxValue]. Other fields, e.g. the privacy
+// budget, must be set by the caller.
+func (params SessionParams) SumParams(minValue, maxValue float64) SumParams {
+	n := float64(params.MaxSessionsPerPartition)
+	return SumParams{
+		MaxPartitionsContributed: params.MaxPartitionsContributed,
+		MinValue:                 min(minValue, minValue*n),
+		MaxValue:                 max(maxValue, maxValue*n),
+	}
+}
+
+// Session is a group of consecutive events of a privacy identifier in a
+// partition, output by Sessionize.
+type Session struct {
+	// Timestamps of the first and last events of the session.
+	Start, End int64
+	// Number of events in the session.
+	NumEvents int64
+}
+
+// Sessionize groups the events of each privacy identifier in each partition
+// into sessions, starting a new session whenever two consecutive events are
+// more than params.Gap apart, e.g. to count sessions instead of events.
+//
+// The number of sessions of each privacy identifier is bounded using
+// params.MaxSessionsPerPartition and params.MaxPartitionsContributed, so that
+// sessions can be used as the unit of contribution of downstream
+// aggregations: use params.CountParams or params.SumParams to get the
+// corresponding contribution bounds. The privacy unit of the output is still
+// the privacy identifier of the input.
+//
+// Sessionize transforms a PrivatePCollection<K,int64>, where the values are
+// timestamps, into a PrivatePCollection<K,Session>. It doesn't consume any
+// privacy budget.
+func Sessionize(s beam.Scope, pcol PrivatePCollection, params SessionParams) PrivatePCollection {
+	s = s.Scope("pbeam.Sessionize")
+	if pcol.codec == nil {
+		log.Fatalf("pbeam.Sessionize: input must be a PrivatePCollection<K,int64>")
+	}
+	if vT := pcol.codec.VType.T; vT != reflect.TypeOf(int64(0)) {
+		log.Fatalf("pbeam.Sessionize: timestamps must be of type int64, got %v", vT)
+	}
+	if err := checkSessionParams(params); err != nil {
+		log.Fatalf("pbeam.Sessionize: %v", err)
+	}
+	idT, _ := beam.ValidateKVType(pcol.col)
+	spec := pcol.privacySpec
+	partitionT := pcol.codec.KType.T
+
+	// Rekey by kv.Pair{ID,K} and split the events of each pair into sessions.
+	rekeyed := parDoWithDeadLetters(
+		s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: reflect.TypeOf(int64(0))}) // PCollection<kv.Pair{ID,K}, int64>.
+	sessions := beam.ParDo(s, &splitSessionsFn{Gap: params.Gap}, beam.GroupByKey(s, rekeyed))
+	// Do per-partition contribution bounding on sessions, then cross-partition
+	// contribution bounding, if not in test mode without contribution bounding.
+	bound := spec.testMode != TestModeWithoutContributionBounding
+	if bound {
+		sessions = boundContributions(s, sessions, params.MaxSessionsPerPartition)
+	}
+	partitions := beam.ParDo(s, &collectSessionsFn{IDType: beam.EncodedType{idT.Type()}}, beam.GroupByKey(s, sessions),
+		beam.TypeDefinition{Var: beam.WType, T: idT.Type()}) // PCollection<ID, partitionSessions>.
+	if bound {
+		partitions = boundContributions(s, partitions, params.MaxPartitionsContributed)
+		partitions = traceStage(s, *spec, "Sessionize.boundContributions", partitions)
+	}
+
+	pcol.col = beam.ParDo(s, &flattenSessionsFn{}, partitions) // PCollection<ID, kv.Pair{K,Session}>.
+	pcol.codec = kv.NewCodec(partitionT, reflect.TypeOf(Session{}))
+	return pcol
+}
+
+func checkSessionParams(params SessionParams) error {
+	if params.Gap < 0 {
+		return fmt.Errorf("Gap must be non-negative, got %d", params.Gap)
+	}
+	if params.MaxSessionsPerPartition <= 0 {
+		return fmt.Errorf("MaxSessionsPerPartition must be set to a positive value, was %d instead", params.MaxSessionsPerPartition)
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+// splitSessionsFn takes the timestamps of the events of a kv.Pair{ID,K} and
+// emits its sessions.
+type splitSessionsFn struct {
+	Gap int64
+}
+
+func (fn *splitSessionsFn) ProcessElement(idk kv.Pair, timestamps func(*int64) bool, emit func(kv.Pair, Session)) {
+	var ts []int64
+	var t int64
+	for timestamps(&t) {
+		ts = append(ts, t)
+	}
+	slices.Sort(ts)
+	session := Session{Start: ts[0], End: ts[0]}
+	for _, t := range ts {
+		// The difference of two int64 always fits in a uint64.
+		if t > session.End && uint64(t-session.End) > uint64(fn.Gap) {
+			emit(idk, session)
+			session = Session{Start: t, End: t}
+		}
+		session.End = t
+		session.NumEvents++
+	}
+	emit(idk, session)
+}
+
+// partitionSessions are the sessions of a privacy identifier in a partition.
+type partitionSessions struct {
+	Partition []byte // Encoded partition key.
+	Sessions  []Session
+}
+
+// collectSessionsFn takes the sessions of a kv.Pair{ID,K} and returns them as
+// a partitionSessions keyed by the decoded ID.
+type collectSessionsFn struct {
+	IDType beam.EncodedType
+	idDec  beam.ElementDecoder
+}
+
+func (fn *collectSessionsFn) Setup() {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+}
+
+func (fn *collectSessionsFn) ProcessElement(idk kv.Pair, sessions func(*Session) bool) (beam.W, partitionSessions, error) {
+	id, err := fn.idDec.Decode(bytes.NewBuffer(idk.K))
+	if err != nil {
+		return nil, partitionSessions{}, fmt.Errorf("pbeam.collectSessionsFn.ProcessElement: couldn't decode ID: %v", err)
+	}
+	ps := partitionSessions{Partition: idk.V}
+	var session Session
+	for sessions(&session) {
+		ps.Sessions = append(ps.Sessions, session)
+	}
+	return id, ps, nil
+}
+
+// flattenSessionsFn emits each session of a partitionSessions as a
+// kv.Pair{K,Session}.
+type flattenSessionsFn struct {
+	sessionEnc beam.ElementEncoder
+}
+
+func (fn *flattenSessionsFn) Setup() {
+	fn.sessionEnc = beam.NewElementEncoder(reflect.TypeOf(Session{}))
+}
+
+func (fn *flattenSessionsFn) ProcessElement(id beam.W, ps partitionSessions, emit func(beam.W, kv.Pair)) error {
+	for _, session := range ps.Sessions {
+		var buf bytes.Buffer
+		if err := fn.sessionEnc.Encode(session, &buf); err != nil {
+			return fmt.Errorf("pbeam.flattenSessionsFn.ProcessElement: couldn't encode session %v: %v", session, err)
+		}
+		emit(id, kv.Pair{K: ps.Partition, V: buf.Bytes()})
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func init() {
+	register.Function2x1[int, int64, string](formatSessionCountFn)
+}
+
+func formatSessionCountFn(k int, count int64) string {
+	return fmt.Sprintf("%d:%d", k, count)
+}
+
+// Checks that sessions output by Sessionize can be counted with the bounds of
+// SessionParams.CountParams, and that the number of sessions per privacy
+// identifier is capped.
+func TestSessionize(t *testing.T) {
+	// Privacy IDs 0-9 have events in partition 0 at timestamps 0, 5 and 100,
+	// which form 2 sessions with a gap of 10.
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		testutils.MakeTripleWithIntValue(10, 0, 0),
+		testutils.MakeTripleWithIntValue(10, 0, 5),
+		testutils.MakeTripleWithIntValue(10, 0, 100))
+	for _, tc := range []struct {
+		desc                    string
+		maxSessionsPerPartition int64
+		want                    []string
+	}{
+		{"sessions within cap", 3, []string{"0:20", "1:0"}},
+		{"sessions above cap", 1, []string{"0:10", "1:0"}},
+	} {
+		p, s := beam.NewPipelineWithRoot()
+		col := beam.CreateList(s, triples)
+		col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+		pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithContributionBounding,
+		}))
+		pcol = ParDo(s, tripleToPartitionPeriodFn, pcol)
+		sessionParams := SessionParams{Gap: 10, MaxSessionsPerPartition: tc.maxSessionsPerPartition, MaxPartitionsContributed: 1}
+		sessions := Sessionize(s, pcol, sessionParams)
+		countParams := sessionParams.CountParams()
+		countParams.PublicPartitions = []int{0, 1}
+		got := Count(s, DropValue(s, sessions), countParams)
+		passert.EqualsList(s, beam.ParDo(s, formatSessionCountFn, got), tc.want)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestSessionize with %s: got %v, want %v: %v", tc.desc, got, tc.want, err)
+		}
+	}
+}
+
+func TestSplitSessionsFn(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		gap        int64
+		timestamps []int64
+		want       []Session
+	}{
+		{"single event", 10, []int64{3}, []Session{{Start: 3, End: 3, NumEvents: 1}}},
+		{"unsorted events", 10, []int64{20, 0, 10, 35}, []Session{{Start: 0, End: 20, NumEvents: 3}, {Start: 35, End: 35, NumEvents: 1}}},
+		{"duplicate events with zero gap", 0, []int64{1, 1, 2}, []Session{{Start: 1, End: 1, NumEvents: 2}, {Start: 2, End: 2, NumEvents: 1}}},
+		{"extreme timestamps", math.MaxInt64, []int64{math.MinInt64, math.MaxInt64}, []Session{{Start: math.MinInt64, End: math.MinInt64, NumEvents: 1}, {Start: math.MaxInt64, End: math.MaxInt64, NumEvents: 1}}},
+	} {
+		i := 0
+		timestamps := func(t *int64) bool {
+			if i == len(tc.timestamps) {
+				return false
+			}
+			*t = tc.timestamps[i]
+			i++
+			return true
+		}
+		var got []Session
+		fn := &splitSessionsFn{Gap: tc.gap}
+		fn.ProcessElement(kv.Pair{}, timestamps, func(_ kv.Pair, s Session) { got = append(got, s) })
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("splitSessionsFn with %s: got diff (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestSessionParamsSumParams(t *testing.T) {
+	params := SessionParams{Gap: 10, MaxSessionsPerPartition: 3, MaxPartitionsContributed: 2}
+	for _, tc := range []struct {
+		desc                       string
+		minValue, maxValue         float64
+		wantMinValue, wantMaxValue float64
+	}{
+		{"non-negative values", 1, 5, 1, 15},
+		{"negative and positive values", -2, 5, -6, 15},
+	} {
+		got := params.SumParams(tc.minValue, tc.maxValue)
+		if got.MaxPartitionsContributed != 2 || got.MinValue != tc.wantMinValue || got.MaxValue != tc.wantMaxValue {
+			t.Errorf("SumParams with %s: got MaxPartitionsContributed=%d, MinValue=%f, MaxValue=%f, want 2, %f, %f",
+				tc.desc, got.MaxPartitionsContributed, got.MinValue, got.MaxValue, tc.wantMinValue, tc.wantMaxValue)
+		}
+	}
+}
+
+func TestCheckSessionParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  SessionParams
+		wantErr bool
+	}{
+		{"valid params", SessionParams{Gap: 10, MaxSessionsPerPartition: 1, MaxPartitionsContributed: 1}, false},
+		{"negative Gap", SessionParams{Gap: -1, MaxSessionsPerPartition: 1, MaxPartitionsContributed: 1}, true},
+		{"no MaxSessionsPerPartition", SessionParams{Gap: 10, MaxPartitionsContributed: 1}, true},
+		{"no MaxPartitionsContributed", SessionParams{Gap: 10, MaxSessionsPerPartition: 1}, true},
+	} {
+		if err := checkSessionParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
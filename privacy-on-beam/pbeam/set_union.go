@@ -0,0 +1,268 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/filter"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	register.DoFn3x0[beam.T, func(*beam.V) bool, func(beam.V, float64)](&weightSetUnionItemsFn{})
+	register.Iter1[beam.V]()
+	register.Emitter2[beam.V, float64]()
+	register.DoFn3x1[beam.V, float64, func(beam.V), error](&thresholdSetUnionItemsFn{})
+	register.Emitter1[beam.V]()
+}
+
+// SetUnionParams specifies the parameters associated with a SetUnion
+// aggregation.
+type SetUnionParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}). With
+	// Laplace noise, each of the n items of a privacy identifier has a weight
+	// of 1/n; with Gaussian noise, a weight of 1/√n.
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation, from the
+	// partition selection budget of the PrivacySpec, like SelectPartitions.
+	// With Gaussian noise, half of Delta is used for the noise and half for
+	// the threshold. If there is only one partition selection, both can be
+	// left 0; in that case, the entire budget reserved for partition selection
+	// in the PrivacySpec is consumed.
+	Epsilon, Delta float64
+	// The maximum number of distinct items that a given privacy identifier can
+	// contribute. If a privacy identifier is associated with more items,
+	// random items will be dropped. A larger MaxItemsContributed leads to less
+	// data loss, but to a larger threshold.
+	//
+	// Required.
+	MaxItemsContributed int64
+}
+
+// SetUnion returns a differentially private subset of the union of the items
+// contributed by all privacy identifiers, e.g. to discover the vocabulary of
+// a corpus of texts or the URLs visited by users. In a PrivatePCollection<V>,
+// V is the item and in a PrivatePCollection<K,V>, K is the item.
+//
+// It implements the weighted Laplace or Gaussian version of the DP Set Union
+// algorithm of Gopi et al. (https://arxiv.org/abs/2002.09745): each privacy
+// identifier distributes a total weight of 1 between its items (in L1 norm with
+// Laplace noise, in L2 norm with Gaussian noise), and the items whose total
+// weight, with noise, exceeds a threshold derived from the budget are kept.
+// Compared to SelectPartitions, items of privacy identifiers with few items get
+// a larger weight, so more items are typically released with the same budget.
+//
+// In test mode, all items are kept.
+//
+// SetUnion transforms a PrivatePCollection<K,V> into a PCollection<K> and a
+// PrivatePCollection<V> into a PCollection<V>.
+func SetUnion(s beam.Scope, pcol PrivatePCollection, params SetUnionParams) beam.PCollection {
+	s = s.Scope("pbeam.SetUnion")
+	pcol = extractTaggedStructFields(s, pcol, false)
+	spec := pcol.privacySpec
+	invalid := func(err error) beam.PCollection {
+		return spec.invalidAggregation(s, "SetUnion", err, partitionType(pcol))
+	}
+
+	// The noise of the weights isn't derived from a seed.
+	err := spec.checkNoNoiseSeedKey("SetUnion")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SetUnion: %v", err))
+	}
+	params.Epsilon, params.Delta, err = spec.partitionSelectionBudget.consume(params.Epsilon, params.Delta)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume budget for SetUnion: %v", err))
+	}
+	noiseKind, err := spec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SetUnion: %v", err))
+	}
+	err = checkSetUnionParams(params, noiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SetUnion: %v", err))
+	}
+	thresholdFn, err := newThresholdSetUnionItemsFn(*spec, params, noiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SetUnion: %v", err))
+	}
+	spec.aggregationRegistered("SetUnion", 0, 0, params.Epsilon, params.Delta)
+
+	// First, drop the values if we have (privacyKey, item, value) tuples, and
+	// keep one contribution per privacy identifier for each item.
+	items := pcol.col
+	_, itemT := beam.ValidateKVType(items)
+	if itemT.Type() == reflect.TypeOf(kv.Pair{}) {
+		if pcol.codec == nil {
+			log.Fatalf("SetUnion: no codec found for the input PrivatePCollection.")
+		}
+		items = beam.ParDo(s, &dropValuesFn{pcol.codec}, pcol.col, beam.TypeDefinition{Var: beam.WType, T: pcol.codec.KType.T})
+	}
+	idT, itemT := beam.ValidateKVType(items)
+	coded := beam.ParDo(s, kv.NewEncodeFn(idT, itemT), items)
+	coded = filter.Distinct(s, coded)
+	items = beam.ParDo(s,
+		kv.NewDecodeFn(idT, itemT),
+		coded,
+		beam.TypeDefinition{Var: beam.TType, T: idT.Type()},
+		beam.TypeDefinition{Var: beam.VType, T: itemT.Type()})
+
+	// Second, do contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		items = boundContributions(s, items, params.MaxItemsContributed)
+		items = traceStage(s, *spec, "SetUnion.boundContributions", items)
+	}
+
+	// Third, compute the weighted histogram of the items.
+	weights := beam.ParDo(s, &weightSetUnionItemsFn{NoiseKind: noiseKind}, beam.GroupByKey(s, items))
+	histogram := stats.SumPerKey(s, weights)
+	histogram = traceStage(s, *spec, "SetUnion.aggregate", histogram)
+
+	// Finally, keep the items whose noisy weight exceeds the threshold.
+	return beam.ParDo(s, thresholdFn, histogram)
+}
+
+func checkSetUnionParams(params SetUnionParams, noiseKind noise.Kind) error {
+	if noiseKind != noise.LaplaceNoise && noiseKind != noise.GaussianNoise {
+		return fmt.Errorf("NoiseKind must be LaplaceNoise or GaussianNoise, got %v", noiseKind)
+	}
+	err := checks.CheckEpsilonStrict(params.Epsilon)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckDeltaStrict(params.Delta)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxItemsContributed)
+}
+
+// weightSetUnionItemsFn distributes a total weight of 1 between the items of
+// each privacy identifier, in L1 norm with Laplace noise and in L2 norm with
+// Gaussian noise.
+type weightSetUnionItemsFn struct {
+	NoiseKind noise.Kind
+}
+
+func (fn *weightSetUnionItemsFn) ProcessElement(_ beam.T, itemsIter func(*beam.V) bool, emit func(beam.V, float64)) {
+	var items []beam.V
+	var item beam.V
+	for itemsIter(&item) {
+		items = append(items, item)
+	}
+	weight := 1 / float64(len(items))
+	if fn.NoiseKind == noise.GaussianNoise {
+		weight = math.Sqrt(weight)
+	}
+	for _, item := range items {
+		emit(item, weight)
+	}
+}
+
+// thresholdSetUnionItemsFn adds noise to the total weight of each item, and
+// emits the items whose noisy weight exceeds Threshold. Do not initialize it
+// yourself, use newThresholdSetUnionItemsFn to create a
+// thresholdSetUnionItemsFn instance.
+type thresholdSetUnionItemsFn struct {
+	Epsilon, NoiseDelta float64
+	Threshold           float64
+	NoiseKind           noise.Kind
+	TestMode            TestMode
+	noise               noise.Noise
+}
+
+func newThresholdSetUnionItemsFn(spec PrivacySpec, params SetUnionParams, noiseKind noise.Kind) (*thresholdSetUnionItemsFn, error) {
+	threshold, noiseDelta, err := setUnionThreshold(noiseKind, params.Epsilon, params.Delta, params.MaxItemsContributed)
+	if err != nil {
+		return nil, err
+	}
+	return &thresholdSetUnionItemsFn{
+		Epsilon:    params.Epsilon,
+		NoiseDelta: noiseDelta,
+		Threshold:  threshold,
+		NoiseKind:  noiseKind,
+		TestMode:   spec.testMode,
+	}, nil
+}
+
+func (fn *thresholdSetUnionItemsFn) Setup() {
+	fn.noise = auditNoise(noise.ToNoise(fn.NoiseKind), "SetUnion")
+}
+
+func (fn *thresholdSetUnionItemsFn) ProcessElement(item beam.V, weight float64, emit func(beam.V)) error {
+	if fn.TestMode.isEnabled() {
+		emit(item)
+		return nil
+	}
+	// The weights of the items of a privacy identifier have an L1 norm (with
+	// Laplace noise) or an L2 norm (with Gaussian noise) of at most 1.
+	noisyWeight, err := fn.noise.AddNoiseFloat64(weight, 1, 1, fn.Epsilon, fn.NoiseDelta)
+	if err != nil {
+		return fmt.Errorf("pbeam.thresholdSetUnionItemsFn: couldn't add noise: %v", err)
+	}
+	if noisyWeight > fn.Threshold {
+		emit(item)
+	}
+	return nil
+}
+
+// setUnionThreshold returns the threshold above which the noisy weight of an
+// item is released by SetUnion, and the delta used for the noise.
+//
+// The items only contributed by a single privacy identifier with t items have a
+// weight of 1/t (with Laplace noise) or 1/√t (with Gaussian noise). The
+// threshold is the smallest value such that, for all t ≤ maxItems, the
+// probability that any of these t items is released is at most the delta of
+// the threshold, i.e. each of them is released with probability at most
+// 1-(1-delta)^(1/t).
+func setUnionThreshold(noiseKind noise.Kind, epsilon, delta float64, maxItems int64) (threshold, noiseDelta float64, err error) {
+	thresholdDelta := delta
+	var sigma float64
+	if noiseKind == noise.GaussianNoise {
+		noiseDelta, thresholdDelta = delta/2, delta/2
+		sigma = noise.SigmaForGaussian(1, 1, epsilon, noiseDelta)
+	}
+	threshold = math.Inf(-1)
+	for t := int64(1); t <= maxItems; t++ {
+		// Largest probability with which each item may be released.
+		p := -math.Expm1(math.Log1p(-thresholdDelta) / float64(t))
+		var tThreshold float64
+		switch noiseKind {
+		case noise.LaplaceNoise:
+			// Laplace noise of scale 1/ε exceeds x with probability exp(-εx)/2.
+			tThreshold = 1/float64(t) + math.Log(1/(2*p))/epsilon
+		case noise.GaussianNoise:
+			// Gaussian noise of standard deviation σ exceeds x with probability
+			// erfc(x/(σ√2))/2.
+			tThreshold = 1/math.Sqrt(float64(t)) + sigma*math.Sqrt2*math.Erfcinv(2*p)
+		default:
+			return 0, 0, fmt.Errorf("unsupported noise kind %v", noiseKind)
+		}
+		threshold = math.Max(threshold, tThreshold)
+	}
+	return threshold, noiseDelta, nil
+}
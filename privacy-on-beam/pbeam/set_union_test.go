@@ -0,0 +1,138 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// Checks that SetUnion keeps all items in test mode.
+func TestSetUnionTestMode(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedV(10, 0),
+		testutils.MakePairsWithFixedV(10, 1),
+		testutils.MakePairsWithFixedVStartingFromKey(10, 1, 2))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		TestMode:                  TestModeWithContributionBounding,
+	}))
+	got := SetUnion(s, pcol, SetUnionParams{MaxItemsContributed: 2})
+
+	passert.Equals(s, got, 0, 1, 2)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("SetUnion in test mode did not keep all items: %v", err)
+	}
+}
+
+// Checks that SetUnion keeps the items contributed by many privacy identifiers
+// and drops the items contributed by a single privacy identifier.
+func TestSetUnionThresholdsItems(t *testing.T) {
+	for _, noiseKind := range []NoiseKind{LaplaceNoise{}, GaussianNoise{}} {
+		// Item 0 has a weight of about 1000, much larger than the threshold;
+		// item 1 is only contributed by privacy identifier 0, so it is released
+		// with probability less than δ.
+		pairs := testutils.ConcatenatePairs(
+			testutils.MakePairsWithFixedV(1000, 0),
+			testutils.MakePairsWithFixedVStartingFromKey(0, 1, 1))
+		p, s, col := ptest.CreateList(pairs)
+		col = beam.ParDo(s, testutils.PairToKV, col)
+		pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-10,
+		}))
+		got := SetUnion(s, pcol, SetUnionParams{NoiseKind: noiseKind, MaxItemsContributed: 2})
+
+		passert.Equals(s, got, 0)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("SetUnion with %v did not return the expected items: %v", noiseKind, err)
+		}
+	}
+}
+
+func TestSetUnionThreshold(t *testing.T) {
+	sigma := noise.SigmaForGaussian(1, 1, 1, 5e-6)
+	for _, tc := range []struct {
+		desc           string
+		noiseKind      noise.Kind
+		maxItems       int64
+		wantThreshold  float64
+		wantNoiseDelta float64
+	}{
+		{
+			desc:      "Laplace noise with a single item",
+			noiseKind: noise.LaplaceNoise,
+			maxItems:  1,
+			// Laplace noise of scale 1 exceeds x with probability exp(-x)/2.
+			wantThreshold: 1 + math.Log(1/2e-5),
+		},
+		{
+			desc:           "Gaussian noise with a single item",
+			noiseKind:      noise.GaussianNoise,
+			maxItems:       1,
+			wantThreshold:  1 + sigma*math.Sqrt2*math.Erfcinv(1e-5),
+			wantNoiseDelta: 5e-6,
+		},
+	} {
+		threshold, noiseDelta, err := setUnionThreshold(tc.noiseKind, 1, 1e-5, tc.maxItems)
+		if err != nil {
+			t.Fatalf("setUnionThreshold with %s: got error %v", tc.desc, err)
+		}
+		if math.Abs(threshold-tc.wantThreshold) > 1e-9 || noiseDelta != tc.wantNoiseDelta {
+			t.Errorf("setUnionThreshold with %s: got (threshold, noiseDelta)=(%f, %e), want (%f, %e)", tc.desc, threshold, noiseDelta, tc.wantThreshold, tc.wantNoiseDelta)
+		}
+	}
+
+	// Privacy identifiers with more items spread the delta over more items, so
+	// the threshold grows with maxItems.
+	for _, noiseKind := range []noise.Kind{noise.LaplaceNoise, noise.GaussianNoise} {
+		small, _, _ := setUnionThreshold(noiseKind, 1, 1e-5, 1)
+		large, _, _ := setUnionThreshold(noiseKind, 1, 1e-5, 100)
+		if large <= small {
+			t.Errorf("setUnionThreshold with %v: got threshold %f with 100 items, want more than %f with 1 item", noiseKind, large, small)
+		}
+	}
+}
+
+func TestCheckSetUnionParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		params    SetUnionParams
+		noiseKind noise.Kind
+		wantErr   bool
+	}{
+		{"valid parameters", SetUnionParams{Epsilon: 1, Delta: 1e-5, MaxItemsContributed: 1}, noise.LaplaceNoise, false},
+		{"valid parameters with Gaussian noise", SetUnionParams{Epsilon: 1, Delta: 1e-5, MaxItemsContributed: 1}, noise.GaussianNoise, false},
+		{"zero delta", SetUnionParams{Epsilon: 1, MaxItemsContributed: 1}, noise.LaplaceNoise, true},
+		{"zero epsilon", SetUnionParams{Delta: 1e-5, MaxItemsContributed: 1}, noise.LaplaceNoise, true},
+		{"zero MaxItemsContributed", SetUnionParams{Epsilon: 1, Delta: 1e-5}, noise.LaplaceNoise, true},
+		{"unsupported noise", SetUnionParams{Epsilon: 1, Delta: 1e-5, MaxItemsContributed: 1}, noise.Unrecognised, true},
+	} {
+		if err := checkSetUnionParams(tc.params, tc.noiseKind); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
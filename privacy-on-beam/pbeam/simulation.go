@@ -0,0 +1,363 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build pbeamdebug
+
+// This file is only compiled with the pbeamdebug build tag, e.g.
+// "go test -tags=pbeamdebug". It must never be included in production builds:
+// repeating the differentially private extraction N times on the same data
+// consumes N times the privacy budget of a single release.
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Combiner3[boundedSumAccumInt64, int64, SimulationResult](&simulateBoundedSumInt64Fn{})
+	register.Combiner3[boundedSumAccumFloat64, float64, SimulationResult](&simulateBoundedSumFloat64Fn{})
+	beam.RegisterType(reflect.TypeOf(SimulationResult{}))
+}
+
+// SimulationParams specifies the parameters of SimulateCount and
+// SimulateSumPerKey.
+type SimulationParams struct {
+	// Number of times the differentially private extraction is repeated for
+	// each partition.
+	//
+	// Required.
+	NumRuns int64
+}
+
+// SimulationResult holds the empirical output distribution of a partition
+// over all the runs of a simulation.
+type SimulationResult struct {
+	// Outputs of the runs in which the partition was released, in no
+	// particular order.
+	Outputs []float64
+	// Number of runs in which the partition was dropped by partition
+	// selection. NumDropped + len(Outputs) is always equal to NumRuns.
+	NumDropped int64
+}
+
+// SimulateCount computes the per-partition accumulators of Count on pcol once,
+// i.e. it does contribution bounding and counts the contributions, and then
+// repeats only the differentially private extraction (partition selection and
+// noise) simulation.NumRuns times on each accumulator. It returns a
+// PCollection<K,SimulationResult> with the empirical output distribution of
+// each partition, which lets data owners study the utility of Count for given
+// parameters without running the whole pipeline NumRuns times.
+//
+// The budget and params are the ones of a single Count. LongTail, Total,
+// PostProcessing and MinAggregateSize are not supported. Partitions that don't
+// appear in pcol are only part of the output if they are public partitions.
+// The output is NOT differentially private.
+//
+// SimulateCount is only available with the pbeamdebug build tag.
+func SimulateCount(s beam.Scope, pcol PrivatePCollection, params CountParams, simulation SimulationParams) beam.PCollection {
+	s = s.Scope("pbeam.SimulateCount")
+	pcol = extractTaggedStructFields(s, pcol, false)
+	// Obtain type information from the underlying PCollection<K,V>.
+	_, partitionT := beam.ValidateKVType(pcol.col)
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "SimulateCount", err, partitionT.Type(), reflect.TypeOf(SimulationResult{}))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	var err error
+	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume aggregation budget for SimulateCount: %v", err))
+	}
+	if params.PublicPartitions == nil {
+		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.consume(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+		if err != nil {
+			return invalid(fmt.Errorf("Couldn't consume partition selection budget for SimulateCount: %v", err))
+		}
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SimulateCount: %v", err))
+	}
+	// With seeded noise, all the runs would return the same output.
+	err = spec.checkNoNoiseSeedKey("SimulateCount")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SimulateCount: %v", err))
+	}
+
+	err = checkSimulateCountParams(params, simulation, noiseKind, partitionT.Type())
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SimulateCount: %v", err))
+	}
+	spec.aggregationRegistered("SimulateCount", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	countsKV := boundedCountsKV(s, spec, pcol, params)
+	boundedSumFn, err := newBoundedSumInt64Fn(*spec, countToSumParams(params), noiseKind, params.PublicPartitions != nil)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedSumInt64Fn for SimulateCount: %v", err)
+	}
+	simulateFn := &simulateBoundedSumInt64Fn{Fn: boundedSumFn, NumRuns: simulation.NumRuns, ClampNegativeOutputs: !params.AllowNegativeOutputs}
+	return simulatePerKey(s, simulateFn, reflect.Int64, params.PublicPartitions, countsKV)
+}
+
+// SimulateSumPerKey is like SimulateCount, but for SumPerKey: it computes the
+// per-partition accumulators of SumPerKey on pcol once, and repeats only the
+// differentially private extraction simulation.NumRuns times on each of them.
+// It returns a PCollection<K,SimulationResult>.
+//
+// The budget and params are the ones of a single SumPerKey. LongTail, Total
+// and PostProcessing are not supported. The output is NOT differentially
+// private.
+//
+// SimulateSumPerKey is only available with the pbeamdebug build tag.
+func SimulateSumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams, simulation SimulationParams) beam.PCollection {
+	s = s.Scope("pbeam.SimulateSumPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	_, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("SimulateSumPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("SimulateSumPerKey: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "SimulateSumPerKey", err, pcol.codec.KType.T, reflect.TypeOf(SimulationResult{}))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	var err error
+	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume aggregation budget for SimulateSumPerKey: %v", err))
+	}
+	if params.PublicPartitions == nil {
+		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.consume(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+		if err != nil {
+			return invalid(fmt.Errorf("Couldn't consume partition selection budget for SimulateSumPerKey: %v", err))
+		}
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SimulateSumPerKey: %v", err))
+	}
+	// With seeded noise, all the runs would return the same output.
+	err = spec.checkNoNoiseSeedKey("SimulateSumPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SimulateSumPerKey: %v", err))
+	}
+
+	err = checkSimulateSumPerKeyParams(params, simulation, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SimulateSumPerKey: %v", err))
+	}
+	spec.aggregationRegistered("SimulateSumPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+	pcol = applyTransform(s, "SimulateSumPerKey", pcol, params.Transform, &params.MinValue, &params.MaxValue)
+
+	partialSumKV, vKind := boundedPartialSumsKV(s, spec, pcol, params)
+	boundedSumFn, err := newBoundedSumFn(*spec, params, noiseKind, vKind, params.PublicPartitions != nil)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedSumFn for SimulateSumPerKey: %v", err)
+	}
+	// Negative sums are clamped to zero when MinValue is non-negative, like in
+	// SumPerKey.
+	var simulateFn any
+	switch fn := boundedSumFn.(type) {
+	case *boundedSumInt64Fn:
+		simulateFn = &simulateBoundedSumInt64Fn{Fn: fn, NumRuns: simulation.NumRuns, ClampNegativeOutputs: params.MinValue >= 0}
+	case *boundedSumFloat64Fn:
+		simulateFn = &simulateBoundedSumFloat64Fn{Fn: fn, NumRuns: simulation.NumRuns, ClampNegativeOutputs: params.MinValue >= 0}
+	}
+	return simulatePerKey(s, simulateFn, vKind, params.PublicPartitions, partialSumKV)
+}
+
+// simulatePerKey applies simulateFn to the PCollection<K,V> kvCol and, if
+// publicPartitions is set, to empty public partitions that don't appear in
+// kvCol. It returns a PCollection<K,SimulationResult>.
+func simulatePerKey(s beam.Scope, simulateFn any, vKind reflect.Kind, publicPartitions any, kvCol beam.PCollection) beam.PCollection {
+	results := beam.CombinePerKey(s, simulateFn, kvCol)
+	if publicPartitions == nil {
+		return results
+	}
+	// Simulate empty public partitions separately, like in addPublicPartitionsForSum,
+	// and only keep their results if they don't appear in kvCol.
+	addZeroValuesToPublicPartitions, err := newAddZeroValuesToPublicPartitionsFn(vKind)
+	if err != nil {
+		log.Fatalf("Couldn't get addZeroValuesToPublicPartitions for simulation: %v", err)
+	}
+	publicPartitionsCol, isPCollection := publicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitionsCol = beam.Reshuffle(s, beam.CreateList(s, publicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addZeroValuesToPublicPartitions, publicPartitionsCol)
+	emptyResults := beam.CombinePerKey(s, simulateFn, emptyPublicPartitions)
+	return beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, results, emptyResults))
+}
+
+// simulateBoundedSumInt64Fn is a combineFn that repeats the ExtractOutput of
+// a boundedSumInt64Fn NumRuns times on copies of the same accumulator.
+type simulateBoundedSumInt64Fn struct {
+	Fn                   *boundedSumInt64Fn
+	NumRuns              int64
+	ClampNegativeOutputs bool
+}
+
+func (fn *simulateBoundedSumInt64Fn) Setup() {
+	fn.Fn.Setup()
+}
+
+func (fn *simulateBoundedSumInt64Fn) CreateAccumulator() (boundedSumAccumInt64, error) {
+	return fn.Fn.CreateAccumulator()
+}
+
+func (fn *simulateBoundedSumInt64Fn) AddInput(a boundedSumAccumInt64, value int64) (boundedSumAccumInt64, error) {
+	return fn.Fn.AddInput(a, value)
+}
+
+func (fn *simulateBoundedSumInt64Fn) MergeAccumulators(a, b boundedSumAccumInt64) (boundedSumAccumInt64, error) {
+	return fn.Fn.MergeAccumulators(a, b)
+}
+
+func (fn *simulateBoundedSumInt64Fn) ExtractOutput(a boundedSumAccumInt64) (SimulationResult, error) {
+	// The result of a dpagg aggregation can only be computed once, so each run
+	// uses its own copy of the accumulator.
+	encoded, err := encodeBoundedSumAccumInt64(a)
+	if err != nil {
+		return SimulationResult{}, err
+	}
+	var result SimulationResult
+	for i := int64(0); i < fn.NumRuns; i++ {
+		run, err := decodeBoundedSumAccumInt64(encoded)
+		if err != nil {
+			return SimulationResult{}, err
+		}
+		output, err := fn.Fn.ExtractOutput(run)
+		if err != nil {
+			return SimulationResult{}, err
+		}
+		if output == nil {
+			result.NumDropped++
+			continue
+		}
+		if fn.ClampNegativeOutputs && *output < 0 {
+			*output = 0
+		}
+		result.Outputs = append(result.Outputs, float64(*output))
+	}
+	return result, nil
+}
+
+func (fn *simulateBoundedSumInt64Fn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+// simulateBoundedSumFloat64Fn is a combineFn that repeats the ExtractOutput of
+// a boundedSumFloat64Fn NumRuns times on copies of the same accumulator.
+type simulateBoundedSumFloat64Fn struct {
+	Fn                   *boundedSumFloat64Fn
+	NumRuns              int64
+	ClampNegativeOutputs bool
+}
+
+func (fn *simulateBoundedSumFloat64Fn) Setup() {
+	fn.Fn.Setup()
+}
+
+func (fn *simulateBoundedSumFloat64Fn) CreateAccumulator() (boundedSumAccumFloat64, error) {
+	return fn.Fn.CreateAccumulator()
+}
+
+func (fn *simulateBoundedSumFloat64Fn) AddInput(a boundedSumAccumFloat64, value float64) (boundedSumAccumFloat64, error) {
+	return fn.Fn.AddInput(a, value)
+}
+
+func (fn *simulateBoundedSumFloat64Fn) MergeAccumulators(a, b boundedSumAccumFloat64) (boundedSumAccumFloat64, error) {
+	return fn.Fn.MergeAccumulators(a, b)
+}
+
+func (fn *simulateBoundedSumFloat64Fn) ExtractOutput(a boundedSumAccumFloat64) (SimulationResult, error) {
+	// The result of a dpagg aggregation can only be computed once, so each run
+	// uses its own copy of the accumulator.
+	encoded, err := encodeBoundedSumAccumFloat64(a)
+	if err != nil {
+		return SimulationResult{}, err
+	}
+	var result SimulationResult
+	for i := int64(0); i < fn.NumRuns; i++ {
+		run, err := decodeBoundedSumAccumFloat64(encoded)
+		if err != nil {
+			return SimulationResult{}, err
+		}
+		output, err := fn.Fn.ExtractOutput(run)
+		if err != nil {
+			return SimulationResult{}, err
+		}
+		if output == nil {
+			result.NumDropped++
+			continue
+		}
+		if fn.ClampNegativeOutputs && *output < 0 {
+			*output = 0
+		}
+		result.Outputs = append(result.Outputs, *output)
+	}
+	return result, nil
+}
+
+func (fn *simulateBoundedSumFloat64Fn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func checkSimulationParams(simulation SimulationParams) error {
+	if simulation.NumRuns <= 0 {
+		return fmt.Errorf("NumRuns should be strictly positive, got %d", simulation.NumRuns)
+	}
+	return nil
+}
+
+func checkSimulateCountParams(params CountParams, simulation SimulationParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	if params.LongTail.Partition != nil || params.Total.Partition != nil || params.PostProcessing != nil || params.MinAggregateSize != 0 {
+		return fmt.Errorf("LongTail, Total, PostProcessing and MinAggregateSize are not supported in simulations")
+	}
+	err := checkSimulationParams(simulation)
+	if err != nil {
+		return err
+	}
+	return checkCountParams(params, noiseKind, partitionType)
+}
+
+func checkSimulateSumPerKeyParams(params SumParams, simulation SimulationParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	if params.LongTail.Partition != nil || params.Total.Partition != nil || params.PostProcessing != nil {
+		return fmt.Errorf("LongTail, Total and PostProcessing are not supported in simulations")
+	}
+	err := checkSimulationParams(simulation)
+	if err != nil {
+		return err
+	}
+	return checkSumPerKeyParams(params, noiseKind, partitionType)
+}
@@ -0,0 +1,165 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build pbeamdebug
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, SimulationResult, string](formatSimulationResult)
+}
+
+// formatSimulationResult summarizes a SimulationResult with the number of
+// runs, the number of runs in which the partition was released, the mean of
+// the outputs rounded to the nearest integer, and whether the outputs vary
+// between runs.
+func formatSimulationResult(k int, r SimulationResult) string {
+	var sum float64
+	distinct := make(map[float64]bool)
+	for _, o := range r.Outputs {
+		sum += o
+		distinct[o] = true
+	}
+	var mean int64
+	if len(r.Outputs) > 0 {
+		mean = int64(math.Round(sum / float64(len(r.Outputs))))
+	}
+	return fmt.Sprintf("%d: runs=%d released=%d mean=%d noisy=%t", k, r.NumDropped+int64(len(r.Outputs)), len(r.Outputs), mean, len(distinct) > 1)
+}
+
+// Checks that SimulateCount with public partitions returns noisy outputs
+// centered on the raw counts, including for empty public partitions.
+func TestSimulateCountPublicPartitions(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedV(100, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(100, 50, 1))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	// With ε=1 and 1000 runs, the standard deviation of the mean of the outputs
+	// is sqrt(2)/sqrt(1000) ≈ 0.045, so it rounds to the raw count.
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 1}))
+	got := SimulateCount(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		NoiseKind:                LaplaceNoise{},
+		PublicPartitions:         []int{0, 1, 2},
+		AllowNegativeOutputs:     true,
+	}, SimulationParams{NumRuns: 1000})
+
+	passert.Equals(s, beam.ParDo(s, formatSimulationResult, got),
+		"0: runs=1000 released=1000 mean=100 noisy=true",
+		"1: runs=1000 released=1000 mean=50 noisy=true",
+		// Partition 2 is an empty public partition.
+		"2: runs=1000 released=1000 mean=0 noisy=true")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("SimulateCount: %v", err)
+	}
+}
+
+// Checks that SimulateCount without public partitions repeats partition
+// selection in each run.
+func TestSimulateCountPartitionSelection(t *testing.T) {
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedV(1000, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(1000, 1, 1))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	// Partition 0 is always kept and partition 1, which has a single privacy
+	// unit, is kept with probability δ=1e-10.
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-10,
+	}))
+	got := SimulateCount(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		NoiseKind:                LaplaceNoise{},
+	}, SimulationParams{NumRuns: 1000})
+
+	passert.Equals(s, beam.ParDo(s, formatSimulationResult, got),
+		"0: runs=1000 released=1000 mean=1000 noisy=true",
+		"1: runs=1000 released=0 mean=0 noisy=false")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("SimulateCount: %v", err)
+	}
+}
+
+// Checks that SimulateSumPerKey returns noisy outputs centered on the raw sums
+// after contribution bounding.
+func TestSimulateSumPerKey(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithIntValue(
+		testutils.MakeTripleWithIntValue(100, 0, 3),
+		testutils.MakeTripleWithIntValueStartingFromKey(100, 10, 1, 10))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	// With ε=10 and 1000 runs, the standard deviation of the mean of the
+	// outputs is 5·sqrt(2)/10/sqrt(1000) ≈ 0.022.
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{AggregationEpsilon: 10}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	got := SimulateSumPerKey(s, pcol, SumParams{
+		MaxPartitionsContributed: 1,
+		MinValue:                 0,
+		MaxValue:                 5,
+		NoiseKind:                LaplaceNoise{},
+		PublicPartitions:         []int{0, 1},
+	}, SimulationParams{NumRuns: 1000})
+
+	passert.Equals(s, beam.ParDo(s, formatSimulationResult, got),
+		"0: runs=1000 released=1000 mean=300 noisy=true",
+		// Values are clamped to 5.
+		"1: runs=1000 released=1000 mean=50 noisy=true")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("SimulateSumPerKey: %v", err)
+	}
+}
+
+func TestSimulateCountInvalidNumRuns(t *testing.T) {
+	pairs := testutils.MakePairsWithFixedV(10, 0)
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		DeferValidationErrors:     true,
+	})
+	pcol := MakePrivate(s, col, spec)
+	SimulateCount(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}}, SimulationParams{})
+
+	errs := spec.ValidationErrors()
+	if len(errs) != 1 || errs[0].Aggregation != "SimulateCount" {
+		t.Fatalf("ValidationErrors() = %v, want a single error for SimulateCount", errs)
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestSimulateCountInvalidNumRuns: pipeline with an invalid SimulateCount succeeded, expected an error")
+	}
+}
@@ -0,0 +1,146 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+)
+
+// DefaultNoiseEpsilonFraction is the fraction of ε that SplitBudget and
+// SplitBudgetWithParams allocate to noise when no other fraction is specified.
+const DefaultNoiseEpsilonFraction = 0.5
+
+// DefaultNoiseDeltaFraction is the fraction of δ that SplitBudget allocates
+// to noise when GaussianNoise is used and no other fraction is specified.
+const DefaultNoiseDeltaFraction = 0.5
+
+// BudgetSplit describes how a total (ε, δ) privacy budget is divided between
+// adding noise and partition selection.
+type BudgetSplit struct {
+	NoiseEpsilon, NoiseDelta                           float64
+	PartitionSelectionEpsilon, PartitionSelectionDelta float64
+}
+
+// String returns a human-readable description of the split, suitable for
+// including in reports.
+func (b BudgetSplit) String() string {
+	return fmt.Sprintf("noise: (ε=%v, δ=%v), partition selection: (ε=%v, δ=%v)",
+		b.NoiseEpsilon, b.NoiseDelta, b.PartitionSelectionEpsilon, b.PartitionSelectionDelta)
+}
+
+// logBudgetSplit sends split to the dpagg.Logger.
+func logBudgetSplit(source string, split BudgetSplit) {
+	dpagg.Log(dpagg.LogEntry{
+		Level:   dpagg.LogInfo,
+		Source:  source,
+		Message: "split privacy budget between noise and partition selection",
+		Params: map[string]float64{
+			"NoiseEpsilon":              split.NoiseEpsilon,
+			"NoiseDelta":                split.NoiseDelta,
+			"PartitionSelectionEpsilon": split.PartitionSelectionEpsilon,
+			"PartitionSelectionDelta":   split.PartitionSelectionDelta,
+		},
+	})
+}
+
+// SplitBudget splits a total privacy budget between adding noise and partition
+// selection, the way aggregations using a single (ε, δ) budget used to do it.
+// It can be used to compute the AggregationEpsilon, AggregationDelta and
+// PartitionSelectionParams of an aggregation from such a budget.
+//
+// ε is always split evenly. With GaussianNoise, noiseDeltaFraction of δ is
+// allocated to noise and the rest to partition selection; it must be in (0, 1),
+// or 0 to use DefaultNoiseDeltaFraction. With LaplaceNoise, the entire δ is
+// allocated to partition selection and noiseDeltaFraction must be 0.
+func SplitBudget(epsilon, delta float64, noiseKind NoiseKind, noiseDeltaFraction float64) (BudgetSplit, error) {
+	return SplitBudgetWithParams(epsilon, delta, noiseKind, BudgetSplitParams{NoiseDeltaFraction: noiseDeltaFraction})
+}
+
+// BudgetSplitParams specifies how SplitBudgetWithParams splits a total
+// privacy budget.
+type BudgetSplitParams struct {
+	// Fraction of ε allocated to noise, the rest being allocated to partition
+	// selection. Must be in (0, 1).
+	//
+	// Defaults to DefaultNoiseEpsilonFraction.
+	NoiseEpsilonFraction float64
+	// Fraction of δ allocated to noise, the rest being allocated to partition
+	// selection. With GaussianNoise, must be in (0, 1). With LaplaceNoise,
+	// the entire δ is allocated to partition selection and this must be 0.
+	//
+	// Defaults to DefaultNoiseDeltaFraction with GaussianNoise.
+	NoiseDeltaFraction float64
+}
+
+// SplitBudgetWithParams is like SplitBudget, but lets the caller choose how ε
+// is split too. For example, aggregations like DistinctPerKey on
+// high-cardinality value domains often benefit from allocating most of ε to
+// partition selection.
+func SplitBudgetWithParams(epsilon, delta float64, noiseKind NoiseKind, params BudgetSplitParams) (BudgetSplit, error) {
+	if noiseKind == nil {
+		return BudgetSplit{}, fmt.Errorf("NoiseKind must be set")
+	}
+	if params.NoiseEpsilonFraction == 0 {
+		params.NoiseEpsilonFraction = DefaultNoiseEpsilonFraction
+	}
+	if params.NoiseDeltaFraction == 0 && noise.Consumption(noiseKind.toNoiseKind()) == noise.EpsilonDelta {
+		params.NoiseDeltaFraction = DefaultNoiseDeltaFraction
+	}
+	split, err := splitBudget(epsilon, delta, params.NoiseEpsilonFraction, params.NoiseDeltaFraction, noiseKind.toNoiseKind())
+	if err != nil {
+		return BudgetSplit{}, err
+	}
+	logBudgetSplit("pbeam.SplitBudget", split)
+	return split, nil
+}
+
+// splitBudget splits the privacy budget between adding noise and partition selection.
+func splitBudget(epsilon, delta, noiseEpsilonFraction, noiseDeltaFraction float64, noiseKind noise.Kind) (BudgetSplit, error) {
+	if err := checks.CheckEpsilonStrict(epsilon, "epsilon"); err != nil {
+		return BudgetSplit{}, err
+	}
+	if err := checks.CheckDeltaStrict(delta, "delta"); err != nil {
+		return BudgetSplit{}, err
+	}
+	if noiseEpsilonFraction <= 0 || noiseEpsilonFraction >= 1 {
+		return BudgetSplit{}, fmt.Errorf("noiseEpsilonFraction is %v, must be in (0, 1)", noiseEpsilonFraction)
+	}
+	var split BudgetSplit
+	split.NoiseEpsilon = epsilon * noiseEpsilonFraction
+	split.PartitionSelectionEpsilon = epsilon - split.NoiseEpsilon
+	switch noise.Consumption(noiseKind) {
+	case noise.EpsilonDelta:
+		if noiseDeltaFraction <= 0 || noiseDeltaFraction >= 1 {
+			return BudgetSplit{}, fmt.Errorf("noiseDeltaFraction is %v, must be in (0, 1) for GaussianNoise and other noise consuming delta", noiseDeltaFraction)
+		}
+		split.NoiseDelta = delta * noiseDeltaFraction
+		split.PartitionSelectionDelta = delta - split.NoiseDelta
+	case noise.EpsilonOnly:
+		if noiseDeltaFraction != 0 {
+			return BudgetSplit{}, fmt.Errorf("noiseDeltaFraction is %v, must be 0 for LaplaceNoise and other noise not consuming delta", noiseDeltaFraction)
+		}
+		split.NoiseDelta = 0
+		split.PartitionSelectionDelta = delta
+	default:
+		return BudgetSplit{}, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	return split, nil
+}
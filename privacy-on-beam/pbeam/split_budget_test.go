@@ -0,0 +1,136 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+)
+
+func TestSplitBudget(t *testing.T) {
+	for _, tc := range []struct {
+		desc               string
+		noiseKind          NoiseKind
+		noiseDeltaFraction float64
+		want               BudgetSplit
+		wantErr            bool
+	}{
+		{
+			desc:      "Gaussian noise with default split",
+			noiseKind: GaussianNoise{},
+			want:      BudgetSplit{NoiseEpsilon: 0.5, NoiseDelta: 5e-6, PartitionSelectionEpsilon: 0.5, PartitionSelectionDelta: 5e-6},
+		},
+		{
+			desc:               "Gaussian noise with 90/10 split",
+			noiseKind:          GaussianNoise{},
+			noiseDeltaFraction: 0.9,
+			want:               BudgetSplit{NoiseEpsilon: 0.5, NoiseDelta: 9e-6, PartitionSelectionEpsilon: 0.5, PartitionSelectionDelta: 1e-6},
+		},
+		{
+			desc:      "Laplace noise",
+			noiseKind: LaplaceNoise{},
+			want:      BudgetSplit{NoiseEpsilon: 0.5, NoiseDelta: 0, PartitionSelectionEpsilon: 0.5, PartitionSelectionDelta: 1e-5},
+		},
+		{
+			desc:               "Laplace noise with non-zero noiseDeltaFraction",
+			noiseKind:          LaplaceNoise{},
+			noiseDeltaFraction: 0.5,
+			wantErr:            true,
+		},
+		{
+			desc:               "noiseDeltaFraction of 1",
+			noiseKind:          GaussianNoise{},
+			noiseDeltaFraction: 1,
+			wantErr:            true,
+		},
+		{
+			desc:               "negative noiseDeltaFraction",
+			noiseKind:          GaussianNoise{},
+			noiseDeltaFraction: -0.1,
+			wantErr:            true,
+		},
+		{
+			desc:    "nil NoiseKind",
+			wantErr: true,
+		},
+	} {
+		got, err := SplitBudget(1, 1e-5, tc.noiseKind, tc.noiseDeltaFraction)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("SplitBudget: when %s for err got %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if !testutils.ApproxEquals(got.NoiseDelta, tc.want.NoiseDelta) || !testutils.ApproxEquals(got.PartitionSelectionDelta, tc.want.PartitionSelectionDelta) ||
+			got.NoiseEpsilon != tc.want.NoiseEpsilon || got.PartitionSelectionEpsilon != tc.want.PartitionSelectionEpsilon {
+			t.Errorf("SplitBudget: when %s got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestSplitBudgetWithParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		noiseKind NoiseKind
+		params    BudgetSplitParams
+		want      BudgetSplit
+		wantErr   bool
+	}{
+		{
+			desc:      "default split",
+			noiseKind: GaussianNoise{},
+			want:      BudgetSplit{NoiseEpsilon: 0.5, NoiseDelta: 5e-6, PartitionSelectionEpsilon: 0.5, PartitionSelectionDelta: 5e-6},
+		},
+		{
+			desc:      "Laplace noise with 20/80 ε split",
+			noiseKind: LaplaceNoise{},
+			params:    BudgetSplitParams{NoiseEpsilonFraction: 0.2},
+			want:      BudgetSplit{NoiseEpsilon: 0.2, NoiseDelta: 0, PartitionSelectionEpsilon: 0.8, PartitionSelectionDelta: 1e-5},
+		},
+		{
+			desc:      "Gaussian noise with 20/80 ε split and 90/10 δ split",
+			noiseKind: GaussianNoise{},
+			params:    BudgetSplitParams{NoiseEpsilonFraction: 0.2, NoiseDeltaFraction: 0.9},
+			want:      BudgetSplit{NoiseEpsilon: 0.2, NoiseDelta: 9e-6, PartitionSelectionEpsilon: 0.8, PartitionSelectionDelta: 1e-6},
+		},
+		{
+			desc:      "NoiseEpsilonFraction of 1",
+			noiseKind: LaplaceNoise{},
+			params:    BudgetSplitParams{NoiseEpsilonFraction: 1},
+			wantErr:   true,
+		},
+		{
+			desc:      "negative NoiseEpsilonFraction",
+			noiseKind: LaplaceNoise{},
+			params:    BudgetSplitParams{NoiseEpsilonFraction: -0.5},
+			wantErr:   true,
+		},
+	} {
+		got, err := SplitBudgetWithParams(1, 1e-5, tc.noiseKind, tc.params)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("SplitBudgetWithParams: when %s for err got %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if !testutils.ApproxEquals(got.NoiseEpsilon, tc.want.NoiseEpsilon) || !testutils.ApproxEquals(got.PartitionSelectionEpsilon, tc.want.PartitionSelectionEpsilon) ||
+			!testutils.ApproxEquals(got.NoiseDelta, tc.want.NoiseDelta) || !testutils.ApproxEquals(got.PartitionSelectionDelta, tc.want.PartitionSelectionDelta) {
+			t.Errorf("SplitBudgetWithParams: when %s got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Combiner3[boundedStandardDeviationAccum, []float64, *float64](&boundedStandardDeviationFn{})
+}
+
+// StandardDeviationParams specifies the parameters associated with a
+// StandardDeviation aggregation.
+type StandardDeviationParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. See MeanParams.PublicPartitions for details.
+	//
+	// PublicPartitions needs to be a beam.PCollection, slice, or array. The
+	// underlying type needs to match the partition type of the PrivatePCollection.
+	//
+	// If PartitionSelectionParams are specified, this needs to be left unset.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct values that a given privacy identifier
+	// can influence. A larger MaxPartitionsContributed leads to less data loss
+	// due to contribution bounding, but to more noise in each standard
+	// deviation.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of contributions from a given privacy identifier
+	// for each key. A larger MaxContributionsPerPartition leads to less data
+	// loss due to contribution bounding, but to more noise in each standard
+	// deviation.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Contributions are clamped to [MinValue, MaxValue] before the standard
+	// deviation is computed. The noise is scaled with MaxValue-MinValue, and the
+	// noisy standard deviations are within [0, (MaxValue-MinValue)/2].
+	//
+	// Required.
+	MinValue, MaxValue float64
+}
+
+// StandardDeviationPerKey obtains the standard deviation of the values
+// associated with each key in a PrivatePCollection<K,V>, adding differentially
+// private noise to the standard deviations and doing pre-aggregation
+// thresholding to remove standard deviations with a low number of distinct
+// privacy identifiers.
+//
+// It is also possible to manually specify the list of partitions
+// present in the output, in which case the partition selection/thresholding
+// step is skipped.
+//
+// StandardDeviationPerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,float64>.
+//
+// Note: Do not use when your results may cause overflows for float64 values.
+// This aggregation is not hardened for such applications yet.
+func StandardDeviationPerKey(s beam.Scope, pcol PrivatePCollection, params StandardDeviationParams) beam.PCollection {
+	s = s.Scope("pbeam.StandardDeviationPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("StandardDeviationPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("StandardDeviationPerKey: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "StandardDeviationPerKey", err, pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("StandardDeviationPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.StandardDeviationPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("StandardDeviationPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.StandardDeviationPerKey: %v", err))
+	}
+
+	err = checkStandardDeviationPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.StandardDeviationPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("StandardDeviationPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for StandardDeviationPerKey: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},V>
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+
+	// Convert value to float64.
+	// Result is PCollection<kv.Pair{ID,K},float64>.
+	_, valueT := beam.ValidateKVType(decoded)
+	if err := checkNumericType(valueT); err != nil {
+		log.Fatalf("StandardDeviationPerKey: %v", err)
+	}
+	converted := convertValues(s, spec, reflect.Float64, decoded)
+
+	// Combine all values for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition values unless in test mode without contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>.
+	combined := beam.CombinePerKey(s, newExpandFloat64ValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)), converted)
+	combined = traceStage(s, *spec, "StandardDeviationPerKey.boundContributionsPerPartition", combined)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "StandardDeviationPerKey.boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		return addPublicPartitionsForStandardDeviation(s, *spec, params, noiseKind, partialKV)
+	}
+	// Compute the standard deviation for each partition. Result is PCollection<partition, float64>.
+	fn, err := newBoundedStandardDeviationFn(*spec, params, noiseKind, false, false)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedStandardDeviationFn for StandardDeviationPerKey: %v", err)
+	}
+	stddevs := beam.CombinePerKey(s, fn, partialKV)
+	stddevs = traceStage(s, *spec, "StandardDeviationPerKey.aggregate", stddevs)
+	reportNoiseDraws(s, stddevs)
+	// Finally, drop thresholded partitions.
+	return beam.ParDo(s, dropThresholdedPartitionsFloat64, stddevs)
+}
+
+func addPublicPartitionsForStandardDeviation(s beam.Scope, spec PrivacySpec, params StandardDeviationParams, noiseKind noise.Kind, partialKV beam.PCollection) beam.PCollection {
+	// Calculate standard deviations with empty public partitions added. Result is PCollection<partition, float64>.
+	// First, add empty slice to all public partitions.
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	// Second, add noise to all public partitions (all of which are empty-valued).
+	fn, err := newBoundedStandardDeviationFn(spec, params, noiseKind, true, true)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedStandardDeviationFn for StandardDeviationPerKey: %v", err)
+	}
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	// Third, compute noisy standard deviations for partitions in the actual data.
+	fn, err = newBoundedStandardDeviationFn(spec, params, noiseKind, true, false)
+	if err != nil {
+		log.Fatalf("Couldn't get boundedStandardDeviationFn for StandardDeviationPerKey: %v", err)
+	}
+	stddevs := beam.CombinePerKey(s, fn, partialKV)
+	stddevs = traceStage(s, spec, "StandardDeviationPerKey.aggregate", stddevs)
+	reportNoiseDraws(s, stddevs)
+	// Fourth, co-group the noisy standard deviations with the noisy empty public
+	// partitions, and emit the noisy empty value for public partitions not found
+	// in the data.
+	stddevs = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, beam.CoGroupByKey(s, stddevs, noisyEmptyPublicPartitions))
+	// Fifth, dereference *float64 results and return.
+	return beam.ParDo(s, dereferenceValueFloat64, stddevs)
+}
+
+func checkStandardDeviationPerKeyParams(params StandardDeviationParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsFloat64(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsNotEqual(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+type boundedStandardDeviationAccum struct {
+	BSTDV            *dpagg.BoundedStandardDeviation
+	SP               *dpagg.PreAggSelectPartition
+	PublicPartitions bool
+}
+
+// boundedStandardDeviationFn is a differentially private combineFn for
+// obtaining the standard deviation of values. Do not initialize it yourself,
+// use newBoundedStandardDeviationFn to create a boundedStandardDeviationFn
+// instance.
+type boundedStandardDeviationFn struct {
+	// Privacy spec parameters (set during initial construction).
+	NoiseEpsilon                 float64
+	PartitionSelectionEpsilon    float64
+	NoiseDelta                   float64
+	PartitionSelectionDelta      float64
+	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	Lower                        float64
+	Upper                        float64
+	NoiseKind                    noise.Kind
+	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
+	PublicPartitions             bool        // Set to true if public partitions are used.
+	TestMode                     TestMode
+	EmptyPartitions              bool // Set to true if this combineFn is for adding noise to empty public partitions.
+}
+
+// newBoundedStandardDeviationFn returns a boundedStandardDeviationFn with the
+// given budget and parameters.
+func newBoundedStandardDeviationFn(spec PrivacySpec, params StandardDeviationParams, noiseKind noise.Kind, publicPartitions bool, emptyPartitions bool) (*boundedStandardDeviationFn, error) {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
+		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	return &boundedStandardDeviationFn{
+		NoiseEpsilon:                 params.AggregationEpsilon,
+		NoiseDelta:                   params.AggregationDelta,
+		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
+		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		Lower:                        params.MinValue,
+		Upper:                        params.MaxValue,
+		NoiseKind:                    noiseKind,
+		PublicPartitions:             publicPartitions,
+		TestMode:                     spec.testMode,
+		EmptyPartitions:              emptyPartitions,
+	}, nil
+}
+
+func (fn *boundedStandardDeviationFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+func (fn *boundedStandardDeviationFn) CreateAccumulator() (boundedStandardDeviationAccum, error) {
+	if fn.TestMode == TestModeWithoutContributionBounding && !fn.EmptyPartitions {
+		fn.Lower = math.Inf(-1)
+		fn.Upper = math.Inf(1)
+	}
+	bstdv, err := dpagg.NewBoundedStandardDeviation(&dpagg.BoundedStandardDeviationOptions{
+		Epsilon:                      fn.NoiseEpsilon,
+		Delta:                        fn.NoiseDelta,
+		MaxPartitionsContributed:     fn.MaxPartitionsContributed,
+		MaxContributionsPerPartition: fn.MaxContributionsPerPartition,
+		Lower:                        fn.Lower,
+		Upper:                        fn.Upper,
+		Noise:                        fn.noise,
+	})
+	if err != nil {
+		return boundedStandardDeviationAccum{}, err
+	}
+	accum := boundedStandardDeviationAccum{BSTDV: bstdv, PublicPartitions: fn.PublicPartitions}
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *boundedStandardDeviationFn) AddInput(a boundedStandardDeviationAccum, values []float64) (boundedStandardDeviationAccum, error) {
+	// Like in boundedMeanFn, each value is added to BoundedStandardDeviation,
+	// but each privacy identifier is counted once for partition selection.
+	for _, v := range values {
+		if err := a.BSTDV.Add(v); err != nil {
+			return a, err
+		}
+	}
+	var err error
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *boundedStandardDeviationFn) MergeAccumulators(a, b boundedStandardDeviationAccum) (boundedStandardDeviationAccum, error) {
+	err := a.BSTDV.Merge(b.BSTDV)
+	if err != nil {
+		return a, err
+	}
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+func (fn *boundedStandardDeviationFn) ExtractOutput(a boundedStandardDeviationAccum) (*float64, error) {
+	v := &a.BSTDV.Variance
+	if fn.TestMode.isEnabled() {
+		v.Count.Noise = noNoise{}
+		v.NormalizedSum.Noise = noNoise{}
+		v.NormalizedSumOfSquares.Noise = noNoise{}
+	}
+	v.Count.Noise = auditNoise(v.Count.Noise, "BoundedStandardDeviation")
+	v.NormalizedSum.Noise = auditNoise(v.NormalizedSum.Noise, "BoundedStandardDeviation")
+	v.NormalizedSumOfSquares.Noise = auditNoise(v.NormalizedSumOfSquares.Noise, "BoundedStandardDeviation")
+	if !fn.TestMode.isEnabled() && !a.PublicPartitions {
+		keep, err := fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !keep {
+			return nil, err
+		}
+	}
+	result, err := a.BSTDV.Result()
+	return &result, err
+}
+
+func (fn *boundedStandardDeviationFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *boundedStandardDeviationFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
@@ -0,0 +1,252 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func TestStandardDeviationPerKeyNoNoise(t *testing.T) {
+	// Partition 0 has 100 values equal to 1 and 100 values equal to 3, so its
+	// standard deviation is 1. Partition 1 only has values equal to 2.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, 1),
+		testutils.MakeTripleWithFloatValueStartingFromKey(100, 100, 0, 3),
+		testutils.MakeTripleWithFloatValueStartingFromKey(200, 50, 1, 2))
+	result := []testutils.PairIF64{
+		{Key: 0, Value: 1},
+		{Key: 1, Value: 0},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := StandardDeviationPerKey(s, pcol, StandardDeviationParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     4,
+	})
+
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-6)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestStandardDeviationPerKeyNoNoise: StandardDeviationPerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+func TestStandardDeviationPerKeyClampsValues(t *testing.T) {
+	// Values are clamped to 0 and 4, so the standard deviation is 2.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, -10),
+		testutils.MakeTripleWithFloatValueStartingFromKey(100, 100, 0, 10))
+	result := []testutils.PairIF64{
+		{Key: 0, Value: 2},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := StandardDeviationPerKey(s, pcol, StandardDeviationParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     4,
+	})
+
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-6)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestStandardDeviationPerKeyClampsValues: StandardDeviationPerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+func TestStandardDeviationPerKeyWithPartitionsNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		inMemory bool
+	}{
+		{"public partitions as a PCollection", false},
+		{"in-memory public partitions", true},
+	} {
+		// Partition 0 has a standard deviation of 1, partition 1 is not public,
+		// and public partition 2 is empty.
+		triples := testutils.ConcatenateTriplesWithFloatValue(
+			testutils.MakeTripleWithFloatValue(100, 0, 1),
+			testutils.MakeTripleWithFloatValueStartingFromKey(100, 100, 0, 3),
+			testutils.MakeTripleWithFloatValueStartingFromKey(200, 50, 1, 2))
+		result := []testutils.PairIF64{
+			{Key: 0, Value: 1},
+			{Key: 2, Value: 0},
+		}
+		publicPartitionsSlice := []int{0, 2}
+		p, s, col, want := ptest.CreateList2(triples, result)
+		col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+		var publicPartitions any
+		if tc.inMemory {
+			publicPartitions = publicPartitionsSlice
+		} else {
+			publicPartitions = beam.CreateList(s, publicPartitionsSlice)
+		}
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           TestModeWithContributionBounding,
+			}))
+		pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+		got := StandardDeviationPerKey(s, pcol, StandardDeviationParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinValue:                     0,
+			MaxValue:                     4,
+			PublicPartitions:             publicPartitions,
+		})
+
+		want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+		testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-6)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestStandardDeviationPerKeyWithPartitionsNoNoise with %s: StandardDeviationPerKey(%v) = %v, want %v, error %v", tc.desc, col, got, want, err)
+		}
+	}
+}
+
+func TestCheckStandardDeviationPerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc          string
+		params        StandardDeviationParams
+		noiseKind     noise.Kind
+		partitionType reflect.Type
+		wantErr       bool
+	}{
+		{
+			desc: "valid parameters",
+			params: StandardDeviationParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc: "valid parameters with public partitions",
+			params: StandardDeviationParams{
+				AggregationEpsilon:           1.0,
+				PublicPartitions:             []int{0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind:     noise.LaplaceNoise,
+			partitionType: reflect.TypeOf(0),
+			wantErr:       false,
+		},
+		{
+			desc: "negative aggregationEpsilon",
+			params: StandardDeviationParams{
+				AggregationEpsilon:           -1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "zero partitionSelectionDelta w/o public partitions",
+			params: StandardDeviationParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "MaxValue equal to MinValue",
+			params: StandardDeviationParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				MinValue:                     5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxContributionsPerPartition",
+			params: StandardDeviationParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+				MinValue:                 -5.0,
+				MaxValue:                 5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxPartitionsContributed",
+			params: StandardDeviationParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxContributionsPerPartition: 1,
+				MinValue:                     -5.0,
+				MaxValue:                     5.0,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkStandardDeviationPerKeyParams(tc.params, tc.noiseKind, tc.partitionType); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
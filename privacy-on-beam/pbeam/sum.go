@@ -18,6 +18,7 @@ package pbeam
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"reflect"
 
@@ -33,7 +34,7 @@ import (
 )
 
 func init() {
-	register.DoFn2x3[beam.W, kv.Pair, kv.Pair, beam.V, error](&prepareSumFn{})
+	register.DoFn5x1[context.Context, beam.W, kv.Pair, func(kv.Pair, beam.V), func(DeadLetter), error](&prepareSumFn{})
 	register.DoFn2x3[beam.X, int64, beam.X, int64, error](&addNoiseToEmptyPublicPartitionsInt64Fn{})
 	register.DoFn2x3[beam.X, float64, beam.X, float64, error](&addNoiseToEmptyPublicPartitionsFloat64Fn{})
 }
@@ -107,6 +108,56 @@ type SumParams struct {
 	//
 	// Required.
 	MinValue, MaxValue float64
+	// If NormalizeContributions is set, the contribution of a privacy
+	// identifier to a partition is the mean of its values in this partition
+	// instead of their sum, and this mean is clamped to [MinValue, MaxValue].
+	// For example, with the key-value pairs [("a", 1), ("a", 3), ("b", 7)],
+	// the contributions for "a" and "b" are 2 and 7.
+	//
+	// Each privacy identifier still contributes a single value in
+	// [MinValue, MaxValue] to each partition, so the noise doesn't change. This
+	// is useful when privacy identifiers have a variable number of values per
+	// partition, and each of them should have the same weight in the output
+	// regardless of its number of values: MinValue and MaxValue then only
+	// need to bound a single value instead of a sum of values.
+	//
+	// Outputs are float64 when NormalizeContributions is set, even if the
+	// input values are integers.
+	//
+	// Optional.
+	NormalizeContributions bool
+	// Aggregates the sums of all the partitions that fail partition selection
+	// into a single "other" partition, instead of dropping them. See
+	// LongTailParams for details.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// Optional.
+	LongTail LongTailParams
+	// Also emits the total of the sums of all partitions as a separate
+	// partition. See TotalParams for details.
+	//
+	// Optional.
+	Total TotalParams
+	// If set, each value is clamped to [MinValue, MaxValue] and transformed
+	// before being summed, e.g. with LogTransform{} to sum the logarithms of
+	// heavy-tailed values. The per-partition contributions of each privacy
+	// identifier are then sums of transformed values, clamped to the
+	// transformed bounds [Transform(MinValue), Transform(MaxValue)], and the
+	// output is in transformed units: it isn't mapped back, since the inverse
+	// of a sum of transformed values isn't meaningful in general.
+	//
+	// Outputs are float64 when Transform is set, even if the input values are
+	// integers.
+	//
+	// Optional.
+	Transform Transform
+	// Post-processing steps applied, in order, to the noisy outputs. When
+	// MinValue is non-negative, negative outputs are clamped to zero first.
+	// See PostProcessor for details.
+	//
+	// Optional.
+	PostProcessing []PostProcessor
 }
 
 // SumPerKey sums the values associated with each key in a
@@ -120,60 +171,135 @@ type SumParams struct {
 //
 // SumPerKey transforms a PrivatePCollection<K,V> either into a
 // PCollection<K,int64> or a PCollection<K,float64>, depending on whether its
-// input is an integer type or a float type.
+// input is an integer type or a float type. If NormalizeContributions is set,
+// the output is always a PCollection<K,float64>.
 //
 // Note: Do not use when your results may cause overflows for int64 and float64
 // values. This aggregation is not hardened for such applications yet.
 func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCollection {
+	return sumPerKeyWithDerivation(s, pcol, params, nil)
+}
+
+// sumPerKeyWithDerivation is SumPerKey, reporting the derivation of its
+// AggregationEpsilon from an accuracy target, if any, when the aggregation is
+// registered.
+func sumPerKeyWithDerivation(s beam.Scope, pcol PrivatePCollection, params SumParams, derivation *AccuracyDerivation) beam.PCollection {
 	s = s.Scope("pbeam.SumPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
 	// Obtain & validate type information from the underlying PCollection<K,V>.
-	idT, kvT := beam.ValidateKVType(pcol.col)
+	_, kvT := beam.ValidateKVType(pcol.col)
 	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
 		log.Fatalf("SumPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
 	}
 	if pcol.codec == nil {
 		log.Fatalf("SumPerKey: no codec found for the input PrivatePCollection.")
 	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "SumPerKey", err, pcol.codec.KType.T, sumOutputType(pcol.codec.VType.T, params.NormalizeContributions))
+	}
 
 	// Get privacy parameters.
 	spec := pcol.privacySpec
-	var err error
-	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.get(params.AggregationEpsilon, params.AggregationDelta)
+	err := consumeLongTailBudget(spec, &params.LongTail)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume LongTail aggregation budget for SumPerKey: %v", err))
+	}
+	err = consumeTotalBudget(spec, &params.Total)
+	if err != nil {
+		return invalid(fmt.Errorf("Couldn't consume Total aggregation budget for SumPerKey: %v", err))
+	}
+	budget, err := spec.reserveBudget("SumPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
 	if err != nil {
-		log.Fatalf("Couldn't consume aggregation budget for SumPerKey: %v", err)
+		return invalid(fmt.Errorf("pbeam.SumPerKey: %v", err))
 	}
-	if params.PublicPartitions == nil {
-		params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta, err = spec.partitionSelectionBudget.get(params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+	if params.LongTail.Partition != nil || params.Total.Partition != nil {
+		err = spec.checkNoNoiseSeedKey("SumPerKey with LongTail or Total")
 		if err != nil {
-			log.Fatalf("Couldn't consume partition selection budget for SumPerKey: %v", err)
+			return invalid(fmt.Errorf("pbeam.SumPerKey: %v", err))
 		}
 	}
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
+	err = checkSumPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.SumPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegisteredWithAccuracy("SumPerKey", derivation, params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+	pcol = applyTransform(s, "SumPerKey", pcol, params.Transform, &params.MinValue, &params.MaxValue)
+
+	partialSumKV, vKind := boundedPartialSumsKV(s, spec, pcol, params)
+	partitionT := pcol.codec.KType.T
+
+	var result beam.PCollection
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		result = addPublicPartitionsForSum(s, *spec, params, noiseKind, vKind, partialSumKV)
+		result = addSeededNoise(s, *spec, noiseKind, params.AggregationEpsilon, params.AggregationDelta, params.MaxPartitionsContributed, params.MinValue, params.MaxValue, vKind, partitionT, result)
 	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
+		boundedSumFn, err := newBoundedSumFn(*spec, params, noiseKind, vKind, false)
+		if err != nil {
+			log.Fatalf("Couldn't get boundedSumFn for SumPerKey: %v", err)
+		}
+		sums := beam.CombinePerKey(s,
+			boundedSumFn,
+			partialSumKV)
+		sums = traceStage(s, *spec, "SumPerKey.aggregate", sums)
+		reportNoiseDraws(s, sums)
+		// Drop thresholded partitions.
+		dropThresholdedPartitionsFn, err := findDropThresholdedPartitionsFn(vKind)
+		if err != nil {
+			log.Fatalf("Couldn't get dropThresholdedPartitionsFn for SumPerKey: %v", err)
+		}
+		result = beam.ParDo(s, dropThresholdedPartitionsFn, sums)
+		result = addSeededNoise(s, *spec, noiseKind, params.AggregationEpsilon, params.AggregationDelta, params.MaxPartitionsContributed, params.MinValue, params.MaxValue, vKind, partitionT, result)
+		if params.LongTail.Partition != nil {
+			result = addLongTailPartition(s, *spec, params.LongTail, noiseKind, params.MaxPartitionsContributed, params.MinValue, params.MaxValue, vKind, partialSumKV, sums, result)
+		}
 	}
 
-	err = checkSumPerKeyParams(params, noiseKind, pcol.codec.KType.T)
-	if err != nil {
-		log.Fatalf("pbeam.SumPerKey: %v", err)
+	if params.Total.Partition != nil {
+		result = addTotalPartition(s, *spec, params.Total, noiseKind, params.MaxPartitionsContributed, params.MinValue, params.MaxValue, vKind, partialSumKV, result)
 	}
 
+	// Clamp negative sums to zero when MinValue is non-negative.
+	return postProcessOutputs(s, result, params.MinValue >= 0, params.PostProcessing)
+}
+
+// boundedPartialSumsKV returns a PCollection<K,V> with the sum (or mean, if
+// contributions are normalized) of the values of each privacy identifier in
+// each partition of pcol, after contribution bounding, and the kind of V,
+// which is either int64 or float64.
+func boundedPartialSumsKV(s beam.Scope, spec *PrivacySpec, pcol PrivatePCollection, params SumParams) (beam.PCollection, reflect.Kind) {
+	idT, _ := beam.ValidateKVType(pcol.col)
+
 	// Drop non-public partitions, if public partitions are specified.
+	var err error
 	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
 	if err != nil {
 		log.Fatalf("Couldn't drop non-public partitions for SumPerKey: %v", err)
 	}
-	// First, group together the privacy ID and the partition ID, and sum the
-	// values per-privacy unit and per-partition.
-	decoded := beam.ParDo(s,
-		newPrepareSumFn(idT, pcol.codec),
+	// First, group together the privacy ID and the partition ID, and sum (or
+	// average, if contributions are normalized) the values per-privacy unit
+	// and per-partition.
+	decoded := parDoWithDeadLetters(s, spec,
+		newPrepareSumFn(idT, pcol.codec, spec.skipMalformedRecords),
 		pcol.col,
 		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
-	summed := stats.SumPerKey(s, decoded)
+	decoded = saltPrivacyIDs(s, spec, decoded)
+	var summed beam.PCollection
+	if params.NormalizeContributions {
+		summed = stats.MeanPerKey(s, decoded)
+	} else {
+		summed = stats.SumPerKey(s, decoded)
+	}
 	// Second, convert the sum to int64 or float64, and re-key.
 	_, sumT := beam.ValidateKVType(summed)
 	convertFn, err := findConvertFn(sumT)
@@ -184,7 +310,7 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 	if err != nil {
 		log.Fatalf("Couldn't get vKind for SumPerKey: %v", err)
 	}
-	converted := beam.ParDo(s, convertFn, summed)
+	converted := convertValues(s, spec, vKind, summed)
 	rekeyFn, err := findRekeyFn(vKind)
 	if err != nil {
 		log.Fatalf("Couldn't get rekeyFn for SumPerKey: %v", err)
@@ -193,9 +319,10 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
 	if spec.testMode != TestModeWithoutContributionBounding {
 		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "SumPerKey.boundContributions", rekeyed)
 	}
-	// Fourth, now that contribution bounding is done, remove the privacy keys,
-	// decode the value, and do a DP sum with all the partial sums.
+	// Third, now that contribution bounding is done, remove the privacy keys
+	// and decode the value.
 	partialSumPairs := beam.DropKey(s, rekeyed)
 	partitionT := pcol.codec.KType.T
 	decodePairFn, err := newDecodePairFn(partitionT, vKind)
@@ -206,37 +333,7 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 		decodePairFn,
 		partialSumPairs,
 		beam.TypeDefinition{Var: beam.WType, T: partitionT})
-
-	var result beam.PCollection
-	// Add public partitions and return the aggregation output, if public partitions are specified.
-	if params.PublicPartitions != nil {
-		result = addPublicPartitionsForSum(s, *spec, params, noiseKind, vKind, partialSumKV)
-	} else {
-		boundedSumFn, err := newBoundedSumFn(*spec, params, noiseKind, vKind, false)
-		if err != nil {
-			log.Fatalf("Couldn't get boundedSumFn for SumPerKey: %v", err)
-		}
-		sums := beam.CombinePerKey(s,
-			boundedSumFn,
-			partialSumKV)
-		// Drop thresholded partitions.
-		dropThresholdedPartitionsFn, err := findDropThresholdedPartitionsFn(vKind)
-		if err != nil {
-			log.Fatalf("Couldn't get dropThresholdedPartitionsFn for SumPerKey: %v", err)
-		}
-		result = beam.ParDo(s, dropThresholdedPartitionsFn, sums)
-	}
-
-	// Clamp negative counts to zero when MinValue is non-negative.
-	if params.MinValue >= 0 {
-		clampNegativePartitionsFn, err := findClampNegativePartitionsFn(vKind)
-		if err != nil {
-			log.Fatalf("Couldn't get clampNegativePartitionsFn for SumPerKey: %v", err)
-		}
-		result = beam.ParDo(s, clampNegativePartitionsFn, result)
-	}
-
-	return result
+	return partialSumKV, vKind
 }
 
 func addPublicPartitionsForSum(s beam.Scope, spec PrivacySpec, params SumParams, noiseKind noise.Kind, vKind reflect.Kind, partialSumKV beam.PCollection) beam.PCollection {
@@ -257,8 +354,11 @@ func addPublicPartitionsForSum(s beam.Scope, spec PrivacySpec, params SumParams,
 		log.Fatalf("Couldn't get boundedSumFn for SumPerKey: %v", err)
 	}
 	noisyEmptyPublicPartitions := beam.CombinePerKey(s, boundedSumFn, publicPartitionsWithZeroValues)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
 	// Third, compute noisy sums for partitions in the actual data.
 	sums := beam.CombinePerKey(s, boundedSumFn, partialSumKV)
+	sums = traceStage(s, spec, "SumPerKey.aggregate", sums)
+	reportNoiseDraws(s, sums)
 	// Fourth, co-group by actual noisy sums with noisy public partitions, emit noisy zero value for public partitions not found in data.
 	actualNoisySumsWithPublicPartitions := beam.CoGroupByKey(s, sums, noisyEmptyPublicPartitions)
 	sums = beam.ParDo(s, mergeResultWithEmptyPublicPartitionsFn, actualNoisySumsWithPublicPartitions)
@@ -270,6 +370,19 @@ func addPublicPartitionsForSum(s beam.Scope, spec PrivacySpec, params SumParams,
 	return beam.ParDo(s, dereferenceValueFn, sums)
 }
 
+// sumOutputType returns the type of the values output by SumPerKey for input
+// values of type vT.
+func sumOutputType(vT reflect.Type, normalizeContributions bool) reflect.Type {
+	if !normalizeContributions {
+		switch vT.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return reflect.TypeOf(int64(0))
+		}
+	}
+	return reflect.TypeOf(float64(0))
+}
+
 func checkSumPerKeyParams(params SumParams, noiseKind noise.Kind, partitionType reflect.Type) error {
 	err := checkPublicPartitions(params.PublicPartitions, partitionType)
 	if err != nil {
@@ -299,22 +412,33 @@ func checkSumPerKeyParams(params SumParams, noiseKind noise.Kind, partitionType
 	if err != nil {
 		return err
 	}
+	err = checkLongTailParams(params.LongTail, params.PublicPartitions, noiseKind, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkTotalParams(params.Total, params.LongTail, noiseKind, partitionType)
+	if err != nil {
+		return err
+	}
 	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
 }
 
 // prepareSumFn takes a PCollection<ID,kv.Pair{K,V}> as input, and returns a
 // PCollection<kv.Pair{ID,K},V>; where ID has been coded, and V has been
-// decoded.
+// decoded. Records that can't be encoded or decoded are emitted as dead letters
+// if SkipMalformed is set.
 type prepareSumFn struct {
 	IDType         beam.EncodedType
 	idEnc          beam.ElementEncoder
 	InputPairCodec *kv.Codec
+	SkipMalformed  bool
 }
 
-func newPrepareSumFn(idType typex.FullType, kvCodec *kv.Codec) *prepareSumFn {
+func newPrepareSumFn(idType typex.FullType, kvCodec *kv.Codec, skipMalformed bool) *prepareSumFn {
 	return &prepareSumFn{
 		IDType:         beam.EncodedType{idType.Type()},
 		InputPairCodec: kvCodec,
+		SkipMalformed:  skipMalformed,
 	}
 }
 
@@ -323,13 +447,17 @@ func (fn *prepareSumFn) Setup() error {
 	return fn.InputPairCodec.Setup()
 }
 
-func (fn *prepareSumFn) ProcessElement(id beam.W, pair kv.Pair) (kv.Pair, beam.V, error) {
+func (fn *prepareSumFn) ProcessElement(ctx context.Context, id beam.W, pair kv.Pair, emit func(kv.Pair, beam.V), emitDeadLetter func(DeadLetter)) error {
 	var idBuf bytes.Buffer
 	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
-		return kv.Pair{}, nil, fmt.Errorf("pbeam.prepareSumFn.ProcessElement: couldn't encode ID %v: %w", id, err)
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "prepareSumFn", fmt.Errorf("pbeam.prepareSumFn.ProcessElement: couldn't encode ID %v: %w", id, err), emitDeadLetter)
 	}
 	_, v, err := fn.InputPairCodec.Decode(pair)
-	return kv.Pair{idBuf.Bytes(), pair.K}, v, err
+	if err != nil {
+		return handleMalformedRecord(ctx, fn.SkipMalformed, "prepareSumFn", err, emitDeadLetter)
+	}
+	emit(kv.Pair{idBuf.Bytes(), pair.K}, v)
+	return nil
 }
 
 // findConvertFn gets the correct conversion to int64 or float64 function.
@@ -411,6 +539,10 @@ func (fn *addNoiseToEmptyPublicPartitionsInt64Fn) Setup() {
 	}
 }
 
+func (fn *addNoiseToEmptyPublicPartitionsInt64Fn) FinishBundle(ctx context.Context) {
+	flushNoiseDraws(ctx)
+}
+
 func (fn *addNoiseToEmptyPublicPartitionsInt64Fn) ProcessElement(partitionKey beam.X, _ int64) (beam.X, int64, error) {
 	bs, err := dpagg.NewBoundedSumInt64(&dpagg.BoundedSumInt64Options{
 		Epsilon:                  fn.NoiseEpsilon,
@@ -423,6 +555,7 @@ func (fn *addNoiseToEmptyPublicPartitionsInt64Fn) ProcessElement(partitionKey be
 	if err != nil {
 		return partitionKey, 0, err
 	}
+	bs.Noise = auditNoise(bs.Noise, "EmptyPublicPartitions")
 	noisedValue, err := bs.Result()
 	return partitionKey, noisedValue, err
 }
@@ -460,6 +593,10 @@ func (fn *addNoiseToEmptyPublicPartitionsFloat64Fn) Setup() {
 	}
 }
 
+func (fn *addNoiseToEmptyPublicPartitionsFloat64Fn) FinishBundle(ctx context.Context) {
+	flushNoiseDraws(ctx)
+}
+
 func (fn *addNoiseToEmptyPublicPartitionsFloat64Fn) ProcessElement(partitionKey beam.X, _ float64) (beam.X, float64, error) {
 	bs, err := dpagg.NewBoundedSumFloat64(&dpagg.BoundedSumFloat64Options{
 		Epsilon:                  fn.NoiseEpsilon,
@@ -472,6 +609,7 @@ func (fn *addNoiseToEmptyPublicPartitionsFloat64Fn) ProcessElement(partitionKey
 	if err != nil {
 		return partitionKey, 0, err
 	}
+	bs.Noise = auditNoise(bs.Noise, "EmptyPublicPartitions")
 	noisedValue, err := bs.Result()
 	return partitionKey, noisedValue, err
 }
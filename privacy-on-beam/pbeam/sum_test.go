@@ -70,6 +70,48 @@ func TestSumPerKeyNoNoiseInt(t *testing.T) {
 	}
 }
 
+// Checks that SumPerKey returns exact sums on realistic synthetic data in test
+// mode without contribution bounding.
+func TestSumPerKeySyntheticTriplesInt(t *testing.T) {
+	triples, err := testutils.MakeSyntheticTriplesWithIntValue(testutils.SyntheticTriplesParams{
+		NumPrivacyUnits:              1000,
+		NumPartitions:                20,
+		MaxPartitionsPerUnit:         3,
+		MaxContributionsPerPartition: 2,
+		PartitionSkew:                1,
+		MinValue:                     0,
+		MaxValue:                     10,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't generate synthetic triples: %v", err)
+	}
+	sums := make([]int64, 20)
+	for _, triple := range triples {
+		sums[triple.Partition] += int64(triple.Value)
+	}
+	publicPartitions := make([]int, len(sums))
+	var result []testutils.PairII64
+	for partition, sum := range sums {
+		publicPartitions[partition] = partition
+		result = append(result, testutils.PairII64{partition, sum})
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon: 1,
+			TestMode:           TestModeWithoutContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 1, MinValue: 0, MaxValue: 1, PublicPartitions: publicPartitions})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.EqualsKVInt64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSumPerKeySyntheticTriplesInt: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
 // Checks that SumPerKey with partitions returns a correct answer with int values.
 func TestSumPerKeyWithPartitionsNoNoiseInt(t *testing.T) {
 	for _, tc := range []struct {
@@ -932,6 +974,42 @@ func TestSumPerKeyPerPartitionContributionBoundingFloat(t *testing.T) {
 	}
 }
 
+// Checks that SumPerKey averages the values of each privacy identifier in each
+// partition when NormalizeContributions is set.
+func TestSumPerKeyNormalizeContributions(t *testing.T) {
+	var triples []testutils.TripleWithIntValue
+	for id := 1; id <= 50; id++ {
+		triples = append(triples, testutils.TripleWithIntValue{id, 0, 1})
+		triples = append(triples, testutils.TripleWithIntValue{id, 0, 3}) // the mean in partition 0 is 2
+		triples = append(triples, testutils.TripleWithIntValue{id, 1, 4})
+		triples = append(triples, testutils.TripleWithIntValue{id, 1, 42}) // the mean in partition 1 is 23, clamped to 10
+	}
+	result := []testutils.PairIF64{
+		{0, 100.0},
+		{1, 500.0},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	// ε=60, δ=0.01 and l0Sensitivity=2 gives a threshold of ≈2.
+	// We have 2 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁴ probability (k=24).
+	epsilon, delta, k, l1Sensitivity := 60.0, 0.01, 24.0, 20.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        epsilon,
+			PartitionSelectionEpsilon: epsilon,
+			PartitionSelectionDelta:   delta,
+		}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	got := SumPerKey(s, pcol, SumParams{MinValue: 0, MaxValue: 10, MaxPartitionsContributed: 2, NormalizeContributions: true, NoiseKind: LaplaceNoise{}})
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, testutils.LaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSumPerKeyNormalizeContributions: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
 var sumPartitionSelectionTestCases = []struct {
 	name                      string
 	noiseKind                 NoiseKind
@@ -0,0 +1,240 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.DoFn3x0[beam.W, int64, func(beam.W, int64)](&suppressInt64Fn{})
+	register.DoFn3x0[beam.W, float64, func(beam.W, float64)](&suppressFloat64Fn{})
+	register.Emitter2[beam.W, int64]()
+	register.Emitter2[beam.W, float64]()
+}
+
+// OutputNoiseParams describes the noise that was added to the output of an
+// aggregation. Post-processing transforms use it to reason about how noisy
+// each output is. These parameters are public, so using them does not
+// consume any privacy budget.
+type OutputNoiseParams struct {
+	// Noise type used by the aggregation (which is either LaplaceNoise{} or
+	// GaussianNoise{}).
+	//
+	// Required.
+	NoiseKind NoiseKind
+	// Differential privacy budget used for adding noise to the outputs, i.e.
+	// the AggregationEpsilon and AggregationDelta of the aggregation. If these
+	// were left unset in the aggregation, the values from the PrivacySpec must
+	// be used here.
+	//
+	// Required.
+	Epsilon, Delta float64
+	// MaxPartitionsContributed of the aggregation.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// Maximum absolute value that a single privacy unit can contribute to the
+	// output of a single partition: MaxValue for Count,
+	// max(|MinValue|, |MaxValue|) times MaxContributionsPerPartition for
+	// SumPerKey, etc.
+	//
+	// Required.
+	MaxContribution float64
+}
+
+func (p OutputNoiseParams) check() error {
+	if p.NoiseKind == nil {
+		return fmt.Errorf("NoiseKind must be set")
+	}
+	if err := checks.CheckEpsilonStrict(p.Epsilon, "Epsilon"); err != nil {
+		return err
+	}
+	var err error
+	if noise.Consumption(p.NoiseKind.toNoiseKind()) == noise.EpsilonOnly {
+		err = checks.CheckNoDelta(p.Delta, "Delta")
+	} else {
+		err = checks.CheckDeltaStrict(p.Delta, "Delta")
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkMaxPartitionsContributed(p.MaxPartitionsContributed); err != nil {
+		return err
+	}
+	if math.IsNaN(p.MaxContribution) || math.IsInf(p.MaxContribution, 0) || p.MaxContribution <= 0 {
+		return fmt.Errorf("MaxContribution must be finite and strictly positive, was %f instead", p.MaxContribution)
+	}
+	return nil
+}
+
+// confidenceIntervalWidth returns the width of the 1-alpha confidence interval
+// of an output with noise described by p.
+func (p OutputNoiseParams) confidenceIntervalWidth(alpha float64) (float64, error) {
+	confInt, err := noise.ToNoise(p.NoiseKind.toNoiseKind()).ComputeConfidenceIntervalFloat64(0, p.MaxPartitionsContributed, p.MaxContribution, p.Epsilon, p.Delta, alpha)
+	if err != nil {
+		return 0, err
+	}
+	return confInt.UpperBound - confInt.LowerBound, nil
+}
+
+// SuppressionParams specifies quality rules for the outputs of an
+// aggregation, and what to do with outputs that fail them.
+type SuppressionParams struct {
+	// Noise that was added to the outputs.
+	//
+	// Required.
+	NoiseParams OutputNoiseParams
+	// Confidence level used for the confidence intervals of the outputs is
+	// 1-ConfidenceIntervalAlpha.
+	//
+	// Defaults to 0.05.
+	ConfidenceIntervalAlpha float64
+	// Outputs whose confidence interval is wider than
+	// MaxRelativeConfidenceIntervalWidth times their absolute value fail the
+	// quality rules. For example, with MaxRelativeConfidenceIntervalWidth=0.5,
+	// an output of 100 fails if its confidence interval is wider than 50.
+	//
+	// Optional. Ignored if 0.
+	MaxRelativeConfidenceIntervalWidth float64
+	// Outputs whose absolute value is smaller than MinAbsoluteValue fail the
+	// quality rules.
+	//
+	// Optional. Ignored if 0.
+	MinAbsoluteValue float64
+	// If set, outputs that fail the quality rules are rounded to the nearest
+	// multiple of CoarseningGranularity instead of being dropped.
+	//
+	// Optional.
+	CoarseningGranularity float64
+}
+
+// SuppressOutputs drops or coarsens the outputs of an aggregation that fail
+// the quality rules specified in params, so that published tables don't
+// contain cells that are too noisy to be useful.
+//
+// The rules only depend on the noisy outputs and on public noise parameters,
+// so SuppressOutputs is a post-processing step and doesn't consume any
+// privacy budget.
+//
+// SuppressOutputs transforms a PCollection<K, int64> or PCollection<K, float64>
+// into a PCollection of the same type.
+func SuppressOutputs(s beam.Scope, col beam.PCollection, params SuppressionParams) beam.PCollection {
+	s = s.Scope("pbeam.SuppressOutputs")
+	_, valueT := beam.ValidateKVType(col)
+	if params.ConfidenceIntervalAlpha == 0 {
+		params.ConfidenceIntervalAlpha = defaultConfidenceIntervalAlpha
+	}
+	err := checkSuppressionParams(params)
+	if err != nil {
+		log.Fatalf("pbeam.SuppressOutputs: %v", err)
+	}
+	width, err := params.NoiseParams.confidenceIntervalWidth(params.ConfidenceIntervalAlpha)
+	if err != nil {
+		log.Fatalf("pbeam.SuppressOutputs: couldn't compute confidence interval width: %v", err)
+	}
+	rules := suppressionRules{
+		ConfidenceIntervalWidth:            width,
+		MaxRelativeConfidenceIntervalWidth: params.MaxRelativeConfidenceIntervalWidth,
+		MinAbsoluteValue:                   params.MinAbsoluteValue,
+		CoarseningGranularity:              params.CoarseningGranularity,
+	}
+	switch valueT.Type() {
+	case reflect.TypeOf(int64(0)):
+		return beam.ParDo(s, &suppressInt64Fn{Rules: rules}, col)
+	case reflect.TypeOf(float64(0)):
+		return beam.ParDo(s, &suppressFloat64Fn{Rules: rules}, col)
+	default:
+		log.Fatalf("pbeam.SuppressOutputs: value type must be int64 or float64, got %v", valueT.Type())
+	}
+	return beam.PCollection{}
+}
+
+func checkSuppressionParams(params SuppressionParams) error {
+	if err := params.NoiseParams.check(); err != nil {
+		return fmt.Errorf("NoiseParams: %w", err)
+	}
+	if err := checks.CheckAlpha(params.ConfidenceIntervalAlpha); err != nil {
+		return err
+	}
+	if params.MaxRelativeConfidenceIntervalWidth < 0 || math.IsNaN(params.MaxRelativeConfidenceIntervalWidth) {
+		return fmt.Errorf("MaxRelativeConfidenceIntervalWidth must be non-negative, was %f instead", params.MaxRelativeConfidenceIntervalWidth)
+	}
+	if params.MinAbsoluteValue < 0 || math.IsNaN(params.MinAbsoluteValue) {
+		return fmt.Errorf("MinAbsoluteValue must be non-negative, was %f instead", params.MinAbsoluteValue)
+	}
+	if params.CoarseningGranularity < 0 || math.IsNaN(params.CoarseningGranularity) || math.IsInf(params.CoarseningGranularity, 0) {
+		return fmt.Errorf("CoarseningGranularity must be finite and non-negative, was %f instead", params.CoarseningGranularity)
+	}
+	return nil
+}
+
+// suppressionRules contains the quality rules applied by suppressInt64Fn and
+// suppressFloat64Fn.
+type suppressionRules struct {
+	ConfidenceIntervalWidth            float64
+	MaxRelativeConfidenceIntervalWidth float64
+	MinAbsoluteValue                   float64
+	CoarseningGranularity              float64
+}
+
+// passes returns true if v passes the quality rules.
+func (r suppressionRules) passes(v float64) bool {
+	if r.MaxRelativeConfidenceIntervalWidth > 0 && r.ConfidenceIntervalWidth > r.MaxRelativeConfidenceIntervalWidth*math.Abs(v) {
+		return false
+	}
+	if r.MinAbsoluteValue > 0 && math.Abs(v) < r.MinAbsoluteValue {
+		return false
+	}
+	return true
+}
+
+func (r suppressionRules) coarsen(v float64) float64 {
+	return math.Round(v/r.CoarseningGranularity) * r.CoarseningGranularity
+}
+
+type suppressInt64Fn struct {
+	Rules suppressionRules
+}
+
+func (fn *suppressInt64Fn) ProcessElement(k beam.W, v int64, emit func(beam.W, int64)) {
+	if fn.Rules.passes(float64(v)) {
+		emit(k, v)
+	} else if fn.Rules.CoarseningGranularity > 0 {
+		emit(k, int64(fn.Rules.coarsen(float64(v))))
+	}
+}
+
+type suppressFloat64Fn struct {
+	Rules suppressionRules
+}
+
+func (fn *suppressFloat64Fn) ProcessElement(k beam.W, v float64, emit func(beam.W, float64)) {
+	if fn.Rules.passes(v) {
+		emit(k, v)
+	} else if fn.Rules.CoarseningGranularity > 0 {
+		emit(k, fn.Rules.coarsen(v))
+	}
+}
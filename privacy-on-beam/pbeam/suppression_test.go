@@ -0,0 +1,176 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// With Laplace noise, ε=1 and sensitivities of 1, the 95% confidence interval
+// of an output has a width of 2*ln(20) ≈ 5.99.
+var suppressionTestNoiseParams = OutputNoiseParams{
+	NoiseKind:                LaplaceNoise{},
+	Epsilon:                  1,
+	MaxPartitionsContributed: 1,
+	MaxContribution:          1,
+}
+
+func TestSuppressOutputsInt64(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		params SuppressionParams
+		want   []testutils.PairII64
+	}{
+		{
+			desc: "no rules",
+			params: SuppressionParams{
+				NoiseParams: suppressionTestNoiseParams,
+			},
+			want: []testutils.PairII64{{0, 100}, {1, 4}, {2, -50}, {3, 11}},
+		},
+		{
+			desc: "relative confidence interval width",
+			params: SuppressionParams{
+				NoiseParams:                        suppressionTestNoiseParams,
+				MaxRelativeConfidenceIntervalWidth: 0.5, // Outputs need an absolute value ≥ 11.98.
+			},
+			want: []testutils.PairII64{{0, 100}, {2, -50}},
+		},
+		{
+			desc: "minimum absolute value",
+			params: SuppressionParams{
+				NoiseParams:      suppressionTestNoiseParams,
+				MinAbsoluteValue: 10,
+			},
+			want: []testutils.PairII64{{0, 100}, {2, -50}, {3, 11}},
+		},
+		{
+			desc: "coarsening",
+			params: SuppressionParams{
+				NoiseParams:                        suppressionTestNoiseParams,
+				MaxRelativeConfidenceIntervalWidth: 0.5,
+				CoarseningGranularity:              10,
+			},
+			want: []testutils.PairII64{{0, 100}, {1, 0}, {2, -50}, {3, 10}},
+		},
+	} {
+		outputs := []testutils.PairII64{{0, 100}, {1, 4}, {2, -50}, {3, 11}}
+		p, s, col, want := ptest.CreateList2(outputs, tc.want)
+		col = beam.ParDo(s, testutils.PairII64ToKV, col)
+		want = beam.ParDo(s, testutils.PairII64ToKV, want)
+
+		got := SuppressOutputs(s, col, tc.params)
+
+		testutils.EqualsKVInt64(t, s, got, want)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("SuppressOutputs with %s: %v", tc.desc, err)
+		}
+	}
+}
+
+func TestSuppressOutputsFloat64(t *testing.T) {
+	outputs := []testutils.PairIF64{{0, 100}, {1, 4.5}, {2, -50}}
+	result := []testutils.PairIF64{{0, 100}, {1, 5}, {2, -50}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairIF64ToKV, col)
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+
+	got := SuppressOutputs(s, col, SuppressionParams{
+		NoiseParams:                        suppressionTestNoiseParams,
+		MaxRelativeConfidenceIntervalWidth: 0.5,
+		CoarseningGranularity:              2.5,
+	})
+
+	testutils.EqualsKVFloat64(t, s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSuppressOutputsFloat64: SuppressOutputs(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestCheckSuppressionParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  SuppressionParams
+		wantErr bool
+	}{
+		{
+			desc:    "valid parameters",
+			params:  SuppressionParams{NoiseParams: suppressionTestNoiseParams, ConfidenceIntervalAlpha: 0.05},
+			wantErr: false,
+		},
+		{
+			desc: "valid Gaussian noise parameters",
+			params: SuppressionParams{
+				NoiseParams:             OutputNoiseParams{NoiseKind: GaussianNoise{}, Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 1, MaxContribution: 1},
+				ConfidenceIntervalAlpha: 0.05,
+			},
+			wantErr: false,
+		},
+		{
+			desc: "no NoiseKind",
+			params: SuppressionParams{
+				NoiseParams:             OutputNoiseParams{Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 1},
+				ConfidenceIntervalAlpha: 0.05,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "non-zero delta with Laplace noise",
+			params: SuppressionParams{
+				NoiseParams:             OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, Delta: 1e-5, MaxPartitionsContributed: 1, MaxContribution: 1},
+				ConfidenceIntervalAlpha: 0.05,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "zero MaxContribution",
+			params: SuppressionParams{
+				NoiseParams:             OutputNoiseParams{NoiseKind: LaplaceNoise{}, Epsilon: 1, MaxPartitionsContributed: 1},
+				ConfidenceIntervalAlpha: 0.05,
+			},
+			wantErr: true,
+		},
+		{
+			desc:    "invalid alpha",
+			params:  SuppressionParams{NoiseParams: suppressionTestNoiseParams, ConfidenceIntervalAlpha: 1.5},
+			wantErr: true,
+		},
+		{
+			desc:    "negative MaxRelativeConfidenceIntervalWidth",
+			params:  SuppressionParams{NoiseParams: suppressionTestNoiseParams, ConfidenceIntervalAlpha: 0.05, MaxRelativeConfidenceIntervalWidth: -1},
+			wantErr: true,
+		},
+		{
+			desc:    "negative MinAbsoluteValue",
+			params:  SuppressionParams{NoiseParams: suppressionTestNoiseParams, ConfidenceIntervalAlpha: 0.05, MinAbsoluteValue: -1},
+			wantErr: true,
+		},
+		{
+			desc:    "negative CoarseningGranularity",
+			params:  SuppressionParams{NoiseParams: suppressionTestNoiseParams, ConfidenceIntervalAlpha: 0.05, CoarseningGranularity: -1},
+			wantErr: true,
+		},
+	} {
+		if err := checkSuppressionParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package testutils
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// ValueDistribution is the distribution of the values of synthetic triples.
+type ValueDistribution int
+
+const (
+	// UniformValues are uniformly distributed in [MinValue, MaxValue].
+	UniformValues ValueDistribution = iota
+	// NormalValues are normally distributed around the midpoint of
+	// [MinValue, MaxValue], with a standard deviation of a sixth of its width,
+	// so that about 0.3% of the values are outside of [MinValue, MaxValue].
+	NormalValues
+	// ExponentialValues are exponentially distributed above MinValue, with a
+	// mean of MinValue plus a quarter of the width of [MinValue, MaxValue],
+	// so that about 2% of the values are above MaxValue. This is typical of
+	// long-tailed data, e.g. amounts spent or durations.
+	ExponentialValues
+)
+
+// SyntheticTriplesParams specifies the shape of the data generated by
+// MakeSyntheticTriplesWithFloatValue and MakeSyntheticTriplesWithIntValue.
+type SyntheticTriplesParams struct {
+	// Number of privacy units, with IDs from 0 to NumPrivacyUnits-1. Required.
+	NumPrivacyUnits int
+	// Number of partitions, with IDs from 0 to NumPartitions-1. Required.
+	NumPartitions int
+	// Each privacy unit contributes to a number of distinct partitions drawn
+	// uniformly in [1, MaxPartitionsPerUnit]. Defaults to 1; values larger
+	// than NumPartitions are capped to NumPartitions.
+	MaxPartitionsPerUnit int
+	// Each privacy unit contributes a number of records drawn uniformly in
+	// [1, MaxContributionsPerPartition] to each of its partitions. Defaults to 1.
+	MaxContributionsPerPartition int
+	// Skew of the popularity of partitions: partition k is chosen with a
+	// probability proportional to 1/(k+1)^PartitionSkew, so 0 means that all
+	// partitions are equally popular and 1 gives a Zipf distribution, where a
+	// few partitions have most of the privacy units and there is a long tail
+	// of partitions with a few privacy units. Must be non-negative.
+	PartitionSkew float64
+	// Distribution of the values. Defaults to UniformValues.
+	Values ValueDistribution
+	// Range of the values, see ValueDistribution. Required; MinValue must be
+	// smaller than MaxValue.
+	MinValue, MaxValue float64
+	// Fraction of the records whose partition is replaced by a uniformly random
+	// partition after the records are generated, like mislabeled records in
+	// real data. A record with a noisy label may have the same partition as
+	// another record of its privacy unit. Must be in [0, 1].
+	LabelNoise float64
+	// Seed of the random number generator. The same parameters and seed always
+	// generate the same triples.
+	Seed int64
+}
+
+// MakeSyntheticTriplesWithFloatValue returns realistic synthetic triples with
+// the shape given by params, e.g. to test aggregations on representative but
+// fake data or to load-test pipelines. The triples are sorted by privacy ID.
+func MakeSyntheticTriplesWithFloatValue(params SyntheticTriplesParams) ([]TripleWithFloatValue, error) {
+	var triples []TripleWithFloatValue
+	err := makeSyntheticTriples(params, func(id, partition int, value float64) {
+		triples = append(triples, TripleWithFloatValue{ID: id, Partition: partition, Value: float32(value)})
+	})
+	return triples, err
+}
+
+// MakeSyntheticTriplesWithIntValue is like MakeSyntheticTriplesWithFloatValue,
+// with values rounded to the nearest integer.
+func MakeSyntheticTriplesWithIntValue(params SyntheticTriplesParams) ([]TripleWithIntValue, error) {
+	var triples []TripleWithIntValue
+	err := makeSyntheticTriples(params, func(id, partition int, value float64) {
+		triples = append(triples, TripleWithIntValue{ID: id, Partition: partition, Value: int(math.Round(value))})
+	})
+	return triples, err
+}
+
+// makeSyntheticTriples generates the triples with the shape given by params,
+// and passes them to emit.
+func makeSyntheticTriples(params SyntheticTriplesParams, emit func(id, partition int, value float64)) error {
+	if err := checkSyntheticTriplesParams(params); err != nil {
+		return fmt.Errorf("testutils.MakeSyntheticTriples: %v", err)
+	}
+	maxPartitions := max(params.MaxPartitionsPerUnit, 1)
+	maxPartitions = min(maxPartitions, params.NumPartitions)
+	maxContributions := max(params.MaxContributionsPerPartition, 1)
+
+	r := rand.New(rand.NewSource(params.Seed))
+	// cumulativeWeights[k] is the sum of the popularity of partitions 0 to k.
+	cumulativeWeights := make([]float64, params.NumPartitions)
+	total := 0.0
+	for k := range cumulativeWeights {
+		total += math.Pow(float64(k+1), -params.PartitionSkew)
+		cumulativeWeights[k] = total
+	}
+	drawPartition := func() int {
+		return sort.SearchFloat64s(cumulativeWeights, r.Float64()*total)
+	}
+	drawValue := func() float64 {
+		width := params.MaxValue - params.MinValue
+		switch params.Values {
+		case NormalValues:
+			return params.MinValue + width/2 + r.NormFloat64()*width/6
+		case ExponentialValues:
+			return params.MinValue + r.ExpFloat64()*width/4
+		default:
+			return params.MinValue + r.Float64()*width
+		}
+	}
+
+	for id := 0; id < params.NumPrivacyUnits; id++ {
+		numPartitions := 1 + r.Intn(maxPartitions)
+		partitions := make(map[int]bool, numPartitions)
+		for len(partitions) < numPartitions {
+			// With a large skew, drawing distinct unpopular partitions can take many
+			// draws, so fall back to a uniform draw after a few attempts.
+			p := drawPartition()
+			for i := 0; partitions[p] && i < 10; i++ {
+				p = drawPartition()
+			}
+			for partitions[p] {
+				p = r.Intn(params.NumPartitions)
+			}
+			partitions[p] = true
+		}
+		sortedPartitions := make([]int, 0, numPartitions)
+		for p := range partitions {
+			sortedPartitions = append(sortedPartitions, p)
+		}
+		sort.Ints(sortedPartitions)
+		for _, p := range sortedPartitions {
+			numContributions := 1 + r.Intn(maxContributions)
+			for i := 0; i < numContributions; i++ {
+				partition := p
+				if r.Float64() < params.LabelNoise {
+					partition = r.Intn(params.NumPartitions)
+				}
+				emit(id, partition, drawValue())
+			}
+		}
+	}
+	return nil
+}
+
+func checkSyntheticTriplesParams(params SyntheticTriplesParams) error {
+	if params.NumPrivacyUnits <= 0 {
+		return fmt.Errorf("NumPrivacyUnits must be positive, got %d", params.NumPrivacyUnits)
+	}
+	if params.NumPartitions <= 0 {
+		return fmt.Errorf("NumPartitions must be positive, got %d", params.NumPartitions)
+	}
+	if params.MaxPartitionsPerUnit < 0 {
+		return fmt.Errorf("MaxPartitionsPerUnit must be non-negative, got %d", params.MaxPartitionsPerUnit)
+	}
+	if params.MaxContributionsPerPartition < 0 {
+		return fmt.Errorf("MaxContributionsPerPartition must be non-negative, got %d", params.MaxContributionsPerPartition)
+	}
+	if params.PartitionSkew < 0 || math.IsNaN(params.PartitionSkew) || math.IsInf(params.PartitionSkew, 0) {
+		return fmt.Errorf("PartitionSkew must be non-negative and finite, got %f", params.PartitionSkew)
+	}
+	if params.Values < UniformValues || params.Values > ExponentialValues {
+		return fmt.Errorf("unknown Values distribution %d", params.Values)
+	}
+	if math.IsNaN(params.MinValue) || math.IsInf(params.MinValue, 0) || math.IsNaN(params.MaxValue) || math.IsInf(params.MaxValue, 0) {
+		return fmt.Errorf("MinValue and MaxValue must be finite, got %f and %f", params.MinValue, params.MaxValue)
+	}
+	if params.MinValue >= params.MaxValue {
+		return fmt.Errorf("MinValue must be smaller than MaxValue, got %f and %f", params.MinValue, params.MaxValue)
+	}
+	if !(params.LabelNoise >= 0 && params.LabelNoise <= 1) {
+		return fmt.Errorf("LabelNoise must be in [0, 1], got %f", params.LabelNoise)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package testutils
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMakeSyntheticTriplesWithFloatValueRespectsBounds(t *testing.T) {
+	params := SyntheticTriplesParams{
+		NumPrivacyUnits:              1000,
+		NumPartitions:                20,
+		MaxPartitionsPerUnit:         3,
+		MaxContributionsPerPartition: 2,
+		PartitionSkew:                1,
+		MinValue:                     -1,
+		MaxValue:                     5,
+		Seed:                         42,
+	}
+	triples, err := MakeSyntheticTriplesWithFloatValue(params)
+	if err != nil {
+		t.Fatalf("MakeSyntheticTriplesWithFloatValue: %v", err)
+	}
+	contributions := make(map[PairII]int)
+	partitionsPerUnit := make(map[int]map[int]bool)
+	for _, triple := range triples {
+		if triple.ID < 0 || triple.ID >= params.NumPrivacyUnits {
+			t.Errorf("MakeSyntheticTriplesWithFloatValue: got privacy ID %d, want in [0, %d)", triple.ID, params.NumPrivacyUnits)
+		}
+		if triple.Partition < 0 || triple.Partition >= params.NumPartitions {
+			t.Errorf("MakeSyntheticTriplesWithFloatValue: got partition %d, want in [0, %d)", triple.Partition, params.NumPartitions)
+		}
+		if triple.Value < -1 || triple.Value > 5 {
+			t.Errorf("MakeSyntheticTriplesWithFloatValue: got uniform value %f, want in [-1, 5]", triple.Value)
+		}
+		contributions[PairII{triple.ID, triple.Partition}]++
+		if partitionsPerUnit[triple.ID] == nil {
+			partitionsPerUnit[triple.ID] = make(map[int]bool)
+		}
+		partitionsPerUnit[triple.ID][triple.Partition] = true
+	}
+	if len(partitionsPerUnit) != params.NumPrivacyUnits {
+		t.Errorf("MakeSyntheticTriplesWithFloatValue: got %d privacy units, want %d", len(partitionsPerUnit), params.NumPrivacyUnits)
+	}
+	for id, partitions := range partitionsPerUnit {
+		if len(partitions) > 3 {
+			t.Errorf("MakeSyntheticTriplesWithFloatValue: privacy unit %d contributed to %d partitions, want at most 3", id, len(partitions))
+		}
+	}
+	for pair, n := range contributions {
+		if n > 2 {
+			t.Errorf("MakeSyntheticTriplesWithFloatValue: privacy unit %d contributed %d times to partition %d, want at most 2", pair.Key, n, pair.Value)
+		}
+	}
+}
+
+func TestMakeSyntheticTriplesPartitionSkew(t *testing.T) {
+	params := SyntheticTriplesParams{
+		NumPrivacyUnits: 10000,
+		NumPartitions:   100,
+		PartitionSkew:   1,
+		MinValue:        0,
+		MaxValue:        1,
+	}
+	triples, err := MakeSyntheticTriplesWithIntValue(params)
+	if err != nil {
+		t.Fatalf("MakeSyntheticTriplesWithIntValue: %v", err)
+	}
+	counts := make([]int, params.NumPartitions)
+	for _, triple := range triples {
+		counts[triple.Partition]++
+	}
+	// With a Zipf distribution over 100 partitions, the first partition has about
+	// 19% of the privacy units, and the last one about 0.2%.
+	if counts[0] < 1500 || counts[0] > 2300 {
+		t.Errorf("MakeSyntheticTriplesWithIntValue: got %d privacy units in the most popular partition, want about 1900", counts[0])
+	}
+	if counts[99] > 100 {
+		t.Errorf("MakeSyntheticTriplesWithIntValue: got %d privacy units in the least popular partition, want about 20", counts[99])
+	}
+}
+
+func TestMakeSyntheticTriplesLabelNoise(t *testing.T) {
+	params := SyntheticTriplesParams{
+		NumPrivacyUnits: 10000,
+		NumPartitions:   10,
+		PartitionSkew:   100, // Without label noise, all privacy units are in partition 0.
+		MinValue:        0,
+		MaxValue:        1,
+		LabelNoise:      0.5,
+	}
+	triples, err := MakeSyntheticTriplesWithFloatValue(params)
+	if err != nil {
+		t.Fatalf("MakeSyntheticTriplesWithFloatValue: %v", err)
+	}
+	relabeled := 0
+	for _, triple := range triples {
+		if triple.Partition != 0 {
+			relabeled++
+		}
+	}
+	// Half of the records get a random partition, which is not 0 with
+	// probability 0.9.
+	if relabeled < 4200 || relabeled > 4800 {
+		t.Errorf("MakeSyntheticTriplesWithFloatValue: got %d records with a partition other than 0, want about 4500", relabeled)
+	}
+}
+
+func TestMakeSyntheticTriplesIsDeterministic(t *testing.T) {
+	params := SyntheticTriplesParams{
+		NumPrivacyUnits:              100,
+		NumPartitions:                10,
+		MaxPartitionsPerUnit:         4,
+		MaxContributionsPerPartition: 3,
+		PartitionSkew:                0.5,
+		Values:                       ExponentialValues,
+		MinValue:                     0,
+		MaxValue:                     100,
+		LabelNoise:                   0.1,
+		Seed:                         7,
+	}
+	triples1, err := MakeSyntheticTriplesWithFloatValue(params)
+	if err != nil {
+		t.Fatalf("MakeSyntheticTriplesWithFloatValue: %v", err)
+	}
+	triples2, err := MakeSyntheticTriplesWithFloatValue(params)
+	if err != nil {
+		t.Fatalf("MakeSyntheticTriplesWithFloatValue: %v", err)
+	}
+	if diff := cmp.Diff(triples1, triples2); diff != "" {
+		t.Errorf("MakeSyntheticTriplesWithFloatValue: got different triples with the same seed (-first +second):\n%s", diff)
+	}
+}
+
+func TestCheckSyntheticTriplesParams(t *testing.T) {
+	valid := SyntheticTriplesParams{NumPrivacyUnits: 10, NumPartitions: 2, MinValue: 0, MaxValue: 1}
+	for _, tc := range []struct {
+		desc    string
+		modify  func(*SyntheticTriplesParams)
+		wantErr bool
+	}{
+		{"valid parameters", func(*SyntheticTriplesParams) {}, false},
+		{"no privacy units", func(p *SyntheticTriplesParams) { p.NumPrivacyUnits = 0 }, true},
+		{"no partitions", func(p *SyntheticTriplesParams) { p.NumPartitions = 0 }, true},
+		{"negative MaxPartitionsPerUnit", func(p *SyntheticTriplesParams) { p.MaxPartitionsPerUnit = -1 }, true},
+		{"negative MaxContributionsPerPartition", func(p *SyntheticTriplesParams) { p.MaxContributionsPerPartition = -1 }, true},
+		{"negative PartitionSkew", func(p *SyntheticTriplesParams) { p.PartitionSkew = -1 }, true},
+		{"unknown value distribution", func(p *SyntheticTriplesParams) { p.Values = ExponentialValues + 1 }, true},
+		{"MinValue equal to MaxValue", func(p *SyntheticTriplesParams) { p.MaxValue = 0 }, true},
+		{"LabelNoise larger than 1", func(p *SyntheticTriplesParams) { p.LabelNoise = 1.5 }, true},
+	} {
+		params := valid
+		tc.modify(&params)
+		if err := checkSyntheticTriplesParams(params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
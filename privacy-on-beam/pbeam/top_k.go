@@ -0,0 +1,284 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/top"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(topKCandidate{}))
+	register.DoFn3x1[[]byte, partitionValues, func(beam.U, kv.Pair), error](&emitIDPartitionValuePairsFn{})
+	register.Emitter2[beam.U, kv.Pair]()
+	register.Function2x2[kv.Pair, int64, []byte, topKCandidate](rekeyTopKCandidate)
+	register.Function2x1[topKCandidate, topKCandidate, bool](lessTopKCandidate)
+	register.DoFn2x3[[]byte, []topKCandidate, beam.W, []beam.V, error](&decodeTopKFn{})
+}
+
+// TopKParams specifies the parameters associated with a TopK aggregation.
+type TopKParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both epsilon and delta can be left 0; in that case
+	// the entire budget reserved for aggregation in the PrivacySpec is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by the selection of the values of
+	// each partition that can appear in the output.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// The maximum number of distinct keys that a given privacy identifier
+	// can influence. If a privacy identifier is associated to more keys,
+	// random keys will be dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of distinct values a given privacy identifier can
+	// contribute to for each key. If a privacy identifier is associated to
+	// more values for a key, random values will be dropped. The noise added to
+	// each count is scaled with MaxPartitionsContributed *
+	// MaxContributionsPerPartition.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Maximum number of values output for each key.
+	//
+	// Required.
+	K int64
+}
+
+// TopKPerKey finds the most frequent values associated with each key in a
+// PrivatePCollection<K,V>, where the frequency of a value is the number of
+// distinct privacy identifiers associated with it.
+//
+// TopKPerKey computes a differentially private count of the privacy
+// identifiers of each (key, value) pair, doing pre-aggregation thresholding
+// to remove pairs with a low number of distinct privacy identifiers, and
+// outputs the values of each key with the K largest noisy counts. Since the
+// ranking only depends on the noisy counts, it doesn't consume budget of its
+// own. Keys all of whose values are thresholded don't appear in the output.
+//
+// Since values, unlike keys, aren't known in advance, public partitions are
+// not supported.
+//
+// TopKPerKey transforms a PrivatePCollection<K,V> into a PCollection<K,[]V>,
+// where the values of each key are sorted by decreasing noisy count.
+func TopKPerKey(s beam.Scope, pcol PrivatePCollection, params TopKParams) beam.PCollection {
+	s = s.Scope("pbeam.TopKPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("TopKPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("TopKPerKey: no codec found for the input PrivatePCollection.")
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "TopKPerKey", err, pcol.codec.KType.T, reflect.SliceOf(pcol.codec.VType.T))
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.TopKPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("TopKPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.TopKPerKey: %v", err))
+	}
+
+	// Like in DistinctValuesPerKey, the budget is committed once the parameters
+	// are validated, and used by Count.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("TopKPerKey", &params.AggregationEpsilon, &params.AggregationDelta, &params.PartitionSelectionParams)
+	if err != nil {
+		return invalid(err)
+	}
+	err = checkTopKPerKeyParams(params, noiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.TopKPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+
+	// First, rekey by kv.Pair{ID,K}, collect the distinct values of each key
+	// and do per-partition contribution bounding.
+	rekeyed := parDoWithDeadLetters(s, spec, newEncodeIDKWithCodedValueFn(idT, spec.skipMalformedRecords), pcol.col) // PCollection<kv.Pair{ID,K}, codedV>.
+	distinct := beam.CombinePerKey(s,
+		newDistinctValuesCombineFn(maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)),
+		rekeyed) // PCollection<kv.Pair{ID,K}, []codedV>.
+	perID := beam.ParDo(s, rekeyPartitionValues, distinct) // PCollection<codedID, partitionValues>.
+	// Second, do cross-partition contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		perID = boundContributions(s, perID, params.MaxPartitionsContributed)
+	}
+
+	// Count the privacy identifiers of each (key, value) pair. Each privacy
+	// identifier is now associated with at most MaxPartitionsContributed *
+	// MaxContributionsPerPartition pairs, once each, so Count drops no
+	// contributions.
+	idPairs := beam.ParDo(s, newEmitIDPartitionValuePairsFn(idT), perID,
+		beam.TypeDefinition{Var: beam.UType, T: idT.Type()}) // PCollection<ID, kv.Pair{codedK,codedV}>.
+	counts := countWithDerivation(s, PrivatePCollection{col: idPairs, privacySpec: spec}, CountParams{
+		NoiseKind:                params.NoiseKind,
+		AggregationEpsilon:       params.AggregationEpsilon,
+		AggregationDelta:         params.AggregationDelta,
+		PartitionSelectionParams: PartitionSelectionParams{Epsilon: params.PartitionSelectionParams.Epsilon, Delta: params.PartitionSelectionParams.Delta},
+		MaxPartitionsContributed: params.MaxPartitionsContributed * params.MaxContributionsPerPartition,
+		MaxValue:                 1,
+	}, nil, budget) // PCollection<kv.Pair{codedK,codedV}, int64>.
+
+	// Finally, keep the K values with the largest noisy counts for each key.
+	candidates := beam.ParDo(s, rekeyTopKCandidate, counts)                    // PCollection<codedK, topKCandidate>.
+	topK := top.LargestPerKey(s, candidates, int(params.K), lessTopKCandidate) // PCollection<codedK, []topKCandidate>.
+	// Return PCollection<K, []V>.
+	return beam.ParDo(s, newDecodeTopKFn(pcol.codec.KType.T, pcol.codec.VType.T), topK,
+		beam.TypeDefinition{Var: beam.WType, T: pcol.codec.KType.T},
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+}
+
+func checkTopKPerKeyParams(params TopKParams, noiseKind noise.Kind) error {
+	err := checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, nil)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, nil)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	if params.K <= 0 {
+		return fmt.Errorf("K must be strictly positive, got %d", params.K)
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+// emitIDPartitionValuePairsFn transforms a PCollection<codedID,partitionValues>
+// into a PCollection<ID,kv.Pair{codedK,codedV}>, emitting each value of the
+// partition.
+type emitIDPartitionValuePairsFn struct {
+	IDType beam.EncodedType
+	idDec  beam.ElementDecoder
+}
+
+func newEmitIDPartitionValuePairsFn(idType typex.FullType) *emitIDPartitionValuePairsFn {
+	return &emitIDPartitionValuePairsFn{IDType: beam.EncodedType{idType.Type()}}
+}
+
+func (fn *emitIDPartitionValuePairsFn) Setup() {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+}
+
+func (fn *emitIDPartitionValuePairsFn) ProcessElement(codedID []byte, pv partitionValues, emit func(beam.U, kv.Pair)) error {
+	id, err := fn.idDec.Decode(bytes.NewBuffer(codedID))
+	if err != nil {
+		return fmt.Errorf("pbeam.emitIDPartitionValuePairsFn.ProcessElement: couldn't decode privacy ID: %w", err)
+	}
+	for _, v := range pv.Values {
+		emit(id, kv.Pair{pv.K, v})
+	}
+	return nil
+}
+
+// topKCandidate is a coded value of a key and its noisy count.
+type topKCandidate struct {
+	V     []byte
+	Count int64
+}
+
+// rekeyTopKCandidate transforms a PCollection<kv.Pair{codedK,codedV},int64>
+// into a PCollection<codedK,topKCandidate>.
+func rekeyTopKCandidate(pair kv.Pair, count int64) ([]byte, topKCandidate) {
+	return pair.K, topKCandidate{V: pair.V, Count: count}
+}
+
+// lessTopKCandidate orders candidates by noisy count, breaking ties by coded
+// value so that the output is deterministic.
+func lessTopKCandidate(a, b topKCandidate) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	return bytes.Compare(a.V, b.V) > 0
+}
+
+// decodeTopKFn transforms a PCollection<codedK,[]topKCandidate> into a
+// PCollection<K,[]V>, sorting the values by decreasing noisy count.
+type decodeTopKFn struct {
+	KType, VType beam.EncodedType
+	kDec, vDec   beam.ElementDecoder
+}
+
+func newDecodeTopKFn(kType, vType reflect.Type) *decodeTopKFn {
+	return &decodeTopKFn{KType: beam.EncodedType{kType}, VType: beam.EncodedType{vType}}
+}
+
+func (fn *decodeTopKFn) Setup() {
+	fn.kDec = beam.NewElementDecoder(fn.KType.T)
+	fn.vDec = beam.NewElementDecoder(fn.VType.T)
+}
+
+func (fn *decodeTopKFn) ProcessElement(codedK []byte, candidates []topKCandidate) (beam.W, []beam.V, error) {
+	k, err := fn.kDec.Decode(bytes.NewBuffer(codedK))
+	if err != nil {
+		return nil, nil, fmt.Errorf("pbeam.decodeTopKFn.ProcessElement: couldn't decode partition: %w", err)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return lessTopKCandidate(candidates[j], candidates[i]) })
+	values := make([]beam.V, len(candidates))
+	for i, c := range candidates {
+		values[i], err = fn.vDec.Decode(bytes.NewBuffer(c.V))
+		if err != nil {
+			return nil, nil, fmt.Errorf("pbeam.decodeTopKFn.ProcessElement: couldn't decode value: %w", err)
+		}
+	}
+	return k, values, nil
+}
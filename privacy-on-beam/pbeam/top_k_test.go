@@ -0,0 +1,144 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function2x1[int, []int, string](formatTopKFn)
+}
+
+func formatTopKFn(partition int, values []int) string {
+	return fmt.Sprintf("%d: %v", partition, values)
+}
+
+func TestTopKPerKeyNoNoise(t *testing.T) {
+	var triples []testutils.TripleWithIntValue
+	id := 0
+	// In partition 0, value 1 is contributed by 30 privacy IDs, value 2 by 20
+	// and value 3 by 10. In partition 1, value 4 is contributed by 5 privacy IDs.
+	for _, c := range []struct{ partition, value, count int }{{0, 1, 30}, {0, 2, 20}, {0, 3, 10}, {1, 4, 5}} {
+		for i := 0; i < c.count; i++ {
+			triples = append(triples, testutils.TripleWithIntValue{ID: id, Partition: c.partition, Value: c.value})
+			// Duplicates of a privacy ID are only counted once.
+			triples = append(triples, testutils.TripleWithIntValue{ID: id, Partition: c.partition, Value: c.value})
+			id++
+		}
+	}
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, testutils.TripleWithIntValueToKV, pcol)
+	got := TopKPerKey(s, pcol, TopKParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		K:                            2,
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatTopKFn, got), "0: [1 2]", "1: [4]")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestTopKPerKeyNoNoise: TopKPerKey(%v) = %v, error %v", col, got, err)
+	}
+}
+
+func TestCheckTopKPerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		params    TopKParams
+		noiseKind noise.Kind
+		wantErr   bool
+	}{
+		{
+			desc: "valid parameters",
+			params: TopKParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				K:                            3,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc: "zero partition selection delta",
+			params: TopKParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+				K:                            3,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "zero K",
+			params: TopKParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 1,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxContributionsPerPartition",
+			params: TopKParams{
+				AggregationEpsilon:       1.0,
+				PartitionSelectionParams: PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxPartitionsContributed: 1,
+				K:                        3,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc: "unset MaxPartitionsContributed",
+			params: TopKParams{
+				AggregationEpsilon:           1.0,
+				PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+				MaxContributionsPerPartition: 1,
+				K:                            3,
+			},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkTopKPerKeyParams(tc.params, tc.noiseKind); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
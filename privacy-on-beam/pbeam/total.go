@@ -0,0 +1,284 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	register.DoFn2x1[beam.W, int64, float64](&clampContributionInt64Fn{})
+	register.DoFn2x1[beam.W, float64, float64](&clampContributionFloat64Fn{})
+	register.DoFn1x2[float64, float64, error](&addNoiseToTotalFn{})
+	register.Function2x2[beam.W, float64, beam.W, float64](keyTotalFn)
+	register.Function2x2[beam.W, float64, beam.W, int64](roundTotalInt64)
+	register.Function2x1[beam.W, int64, float64](partitionValueInt64ToFloat64)
+	register.Function2x1[beam.W, float64, float64](partitionValueFloat64ToFloat64)
+	register.Function2x1[beam.W, beam.V, int64](countPartition)
+	register.Function5x2[beam.W, int64, float64, float64, int64, beam.W, int64](adjustToTotalInt64)
+	register.Function5x2[beam.W, float64, float64, float64, int64, beam.W, float64](adjustToTotalFloat64)
+}
+
+// TotalParams specifies the parameters of the total row of an aggregation,
+// which is a differentially private grand total of the contributions to all
+// partitions, emitted alongside the per-partition outputs.
+//
+// The total row is computed under the same contribution bounding as the
+// per-partition outputs, and includes the contributions to partitions that fail
+// partition selection. It is a separate aggregation: its noise is calibrated
+// to the total contribution of a privacy identifier to all its partitions
+// (e.g. MaxPartitionsContributed*MaxValue for Count).
+type TotalParams struct {
+	// The partition under which the total row is emitted. It must have the
+	// same type as the partitions of the aggregation, and shouldn't be a
+	// partition that can appear in the data: otherwise, the output would
+	// contain this partition twice.
+	//
+	// The total row is only emitted if Partition is set.
+	Partition any
+	// Differential privacy budget consumed by the total row, in addition to
+	// the budget consumed by the aggregation itself.
+	//
+	// Required if Partition is set: the entire budget reserved for aggregation
+	// in the PrivacySpec can't be consumed by both the aggregation and its
+	// total row, so the AggregationEpsilon (and AggregationDelta, if needed) of
+	// the aggregation must also be set.
+	AggregationEpsilon, AggregationDelta float64
+	// If Consistent is set, the per-partition outputs are adjusted so that
+	// they sum to the total: the difference between the total and the sum of
+	// the per-partition outputs is split evenly between the partitions. This
+	// is post-processing, so it doesn't consume any privacy budget.
+	//
+	// The contributions to partitions that fail partition selection are part
+	// of the total, so the adjustment spreads them over the output partitions
+	// unless a LongTail partition is also emitted. Integer outputs are only
+	// consistent up to rounding, and outputs clamped to be non-negative might
+	// no longer sum to the total.
+	//
+	// Optional.
+	Consistent bool
+}
+
+// consumeTotalBudget consumes the aggregation budget of the total row
+// specified by params, if any. It must be called before the aggregation gets
+// its own budget, so that the aggregation doesn't consume the entire budget
+// reserved for aggregation in the PrivacySpec.
+func consumeTotalBudget(spec *PrivacySpec, params *TotalParams) error {
+	if params.Partition == nil {
+		return nil
+	}
+	if params.AggregationEpsilon == 0 {
+		return fmt.Errorf("Total.AggregationEpsilon must be set when Total.Partition is set")
+	}
+	var err error
+	params.AggregationEpsilon, params.AggregationDelta, err = spec.aggregationBudget.consume(params.AggregationEpsilon, params.AggregationDelta)
+	return err
+}
+
+// checkTotalParams returns an error if the total row specified by params can't
+// be computed for an aggregation with the given LongTail partition, noise and
+// partition type.
+func checkTotalParams(params TotalParams, longTail LongTailParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	if params.Partition == nil {
+		if params.AggregationEpsilon != 0 || params.AggregationDelta != 0 || params.Consistent {
+			return fmt.Errorf("Total.AggregationEpsilon, Total.AggregationDelta and Total.Consistent must be unset when Total.Partition is unset")
+		}
+		return nil
+	}
+	if t := reflect.TypeOf(params.Partition); t != partitionType {
+		return fmt.Errorf("Total.Partition is of type %v, want the partition type %v", t, partitionType)
+	}
+	if reflect.DeepEqual(params.Partition, longTail.Partition) {
+		return fmt.Errorf("Total.Partition and LongTail.Partition must be different, got %v for both", params.Partition)
+	}
+	if err := checks.CheckEpsilonStrict(params.AggregationEpsilon, "Total.AggregationEpsilon"); err != nil {
+		return err
+	}
+	if noise.Consumption(noiseKind) == noise.EpsilonOnly {
+		return checks.CheckNoDelta(params.AggregationDelta, "Total.AggregationDelta")
+	}
+	return checks.CheckDeltaStrict(params.AggregationDelta, "Total.AggregationDelta")
+}
+
+// addTotalPartition adds the total row specified by params to result, and
+// adjusts the values of result so that they sum to the total if
+// params.Consistent is set.
+//
+// contributions is the PCollection<K,V> of the per-partition contributions of
+// each privacy identifier after contribution bounding, and result the
+// PCollection<K,V> of the per-partition outputs, where V is int64 or float64,
+// depending on vKind. Each contribution is clamped to [lower, upper].
+func addTotalPartition(s beam.Scope, spec PrivacySpec, params TotalParams, noiseKind noise.Kind, maxPartitionsContributed int64, lower, upper float64, vKind reflect.Kind, contributions, result beam.PCollection) beam.PCollection {
+	s = s.Scope("addTotalPartition")
+	var clampFn, toFloat64Fn, adjustFn any
+	switch vKind {
+	case reflect.Int64:
+		clampFn = &clampContributionInt64Fn{Lower: lower, Upper: upper, TestMode: spec.testMode}
+		toFloat64Fn = partitionValueInt64ToFloat64
+		adjustFn = adjustToTotalInt64
+	case reflect.Float64:
+		clampFn = &clampContributionFloat64Fn{Lower: lower, Upper: upper, TestMode: spec.testMode}
+		toFloat64Fn = partitionValueFloat64ToFloat64
+		adjustFn = adjustToTotalFloat64
+	default:
+		log.Fatalf("Couldn't add the Total partition: kind(%v) should be int64 or float64", vKind)
+	}
+	clamped := beam.ParDo(s, clampFn, contributions)
+	total := noisyTotal(s, spec, params.AggregationEpsilon, params.AggregationDelta, noiseKind, maxPartitionsContributed, lower, upper, clamped)
+	if params.Consistent {
+		partitionsSum := stats.Sum(s, beam.Flatten(s, beam.Create(s, 0.0), beam.ParDo(s, toFloat64Fn, result)))
+		partitionsCount := stats.Sum(s, beam.Flatten(s, beam.Create(s, int64(0)), beam.ParDo(s, countPartition, result)))
+		result = beam.ParDo(s, adjustFn, result,
+			beam.SideInput{Input: total},
+			beam.SideInput{Input: partitionsSum},
+			beam.SideInput{Input: partitionsCount})
+	}
+	return beam.Flatten(s, result, keyTotal(s, params.Partition, vKind, total))
+}
+
+// noisyTotal sums contributions, a PCollection<float64> of contributions
+// clamped to [lower, upper], and adds noise to the sum. It returns a
+// PCollection<float64> with a single element.
+//
+// Each privacy identifier is assumed to contribute to at most
+// maxPartitionsContributed partitions, all of which can be part of the sum, so
+// the sum has a l0 sensitivity of 1 and a lInf sensitivity of
+// maxPartitionsContributed*max(|lower|, |upper|).
+func noisyTotal(s beam.Scope, spec PrivacySpec, epsilon, delta float64, noiseKind noise.Kind, maxPartitionsContributed int64, lower, upper float64, contributions beam.PCollection) beam.PCollection {
+	// Make sure that the sum exists even if there are no contributions.
+	total := stats.Sum(s, beam.Flatten(s, beam.Create(s, 0.0), contributions))
+	return beam.ParDo(s, &addNoiseToTotalFn{
+		Epsilon:         epsilon,
+		Delta:           delta,
+		LInfSensitivity: float64(maxPartitionsContributed) * math.Max(math.Abs(lower), math.Abs(upper)),
+		NoiseKind:       noiseKind,
+		TestMode:        spec.testMode,
+	}, total)
+}
+
+// keyTotal keys total, a PCollection<float64> with a single element, by
+// partition. It returns a PCollection<K,V>, where V is int64 or float64
+// depending on vKind.
+func keyTotal(s beam.Scope, partition any, vKind reflect.Kind, total beam.PCollection) beam.PCollection {
+	keyed := beam.ParDo(s, keyTotalFn, beam.Create(s, partition), beam.SideInput{Input: total})
+	if vKind == reflect.Int64 {
+		keyed = beam.ParDo(s, roundTotalInt64, keyed)
+	}
+	return keyed
+}
+
+// clampContributionInt64Fn clamps the per-partition contributions of a
+// privacy identifier to [Lower, Upper], unless contribution bounding is
+// disabled in test mode.
+type clampContributionInt64Fn struct {
+	Lower, Upper float64
+	TestMode     TestMode
+}
+
+func (fn *clampContributionInt64Fn) ProcessElement(_ beam.W, v int64) float64 {
+	if fn.TestMode == TestModeWithoutContributionBounding {
+		return float64(v)
+	}
+	return math.Min(math.Max(float64(v), fn.Lower), fn.Upper)
+}
+
+// clampContributionFloat64Fn clamps the per-partition contributions of a
+// privacy identifier to [Lower, Upper], unless contribution bounding is
+// disabled in test mode.
+type clampContributionFloat64Fn struct {
+	Lower, Upper float64
+	TestMode     TestMode
+}
+
+func (fn *clampContributionFloat64Fn) ProcessElement(_ beam.W, v float64) float64 {
+	if fn.TestMode == TestModeWithoutContributionBounding {
+		return v
+	}
+	return math.Min(math.Max(v, fn.Lower), fn.Upper)
+}
+
+// addNoiseToTotalFn adds noise to a sum of contributions to several
+// partitions.
+type addNoiseToTotalFn struct {
+	Epsilon, Delta  float64
+	LInfSensitivity float64
+	NoiseKind       noise.Kind
+	TestMode        TestMode
+	noise           noise.Noise
+}
+
+func (fn *addNoiseToTotalFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+	fn.noise = auditNoise(fn.noise, "Total")
+}
+
+func (fn *addNoiseToTotalFn) FinishBundle(ctx context.Context) {
+	flushNoiseDraws(ctx)
+}
+
+func (fn *addNoiseToTotalFn) ProcessElement(total float64) (float64, error) {
+	noisyTotal, err := fn.noise.AddNoiseFloat64(total, 1, fn.LInfSensitivity, fn.Epsilon, fn.Delta)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't add noise to total: %w", err)
+	}
+	return noisyTotal, nil
+}
+
+func keyTotalFn(partition beam.W, total float64) (beam.W, float64) {
+	return partition, total
+}
+
+func roundTotalInt64(k beam.W, v float64) (beam.W, int64) {
+	return k, int64(math.Round(v))
+}
+
+func partitionValueInt64ToFloat64(_ beam.W, v int64) float64 {
+	return float64(v)
+}
+
+func partitionValueFloat64ToFloat64(_ beam.W, v float64) float64 {
+	return v
+}
+
+func countPartition(_ beam.W, _ beam.V) int64 {
+	return 1
+}
+
+// adjustToTotalInt64 adds to v its share of the difference between total and
+// the sum of the values of all partitions.
+func adjustToTotalInt64(k beam.W, v int64, total, partitionsSum float64, partitionsCount int64) (beam.W, int64) {
+	return k, v + int64(math.Round((total-partitionsSum)/float64(partitionsCount)))
+}
+
+// adjustToTotalFloat64 adds to v its share of the difference between total and
+// the sum of the values of all partitions.
+func adjustToTotalFloat64(k beam.W, v float64, total, partitionsSum float64, partitionsCount int64) (beam.W, float64) {
+	return k, v + (total-partitionsSum)/float64(partitionsCount)
+}
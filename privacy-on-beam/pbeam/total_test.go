@@ -0,0 +1,180 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// Checks that Count emits the total of the bounded contributions to all
+// partitions in the Total partition.
+func TestCountTotal(t *testing.T) {
+	// Value 0 is associated with 7 privacy units appearing twice each, and
+	// value 1 with 30 privacy units appearing 3 times each, but MaxValue is 2,
+	// so each of them should only be counted twice.
+	pairs := testutils.ConcatenatePairs(
+		testutils.MakePairsWithFixedVStartingFromKey(0, 7, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(0, 7, 0),
+		testutils.MakePairsWithFixedVStartingFromKey(7, 30, 1),
+		testutils.MakePairsWithFixedVStartingFromKey(7, 30, 1),
+		testutils.MakePairsWithFixedVStartingFromKey(7, 30, 1),
+	)
+	result := []testutils.PairII64{
+		{0, 14},
+		{1, 60},
+		{-1, 74},
+	}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        2,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		TestMode:                  TestModeWithContributionBounding,
+	}))
+	got := Count(s, pcol, CountParams{
+		AggregationEpsilon:       1,
+		MaxValue:                 2,
+		MaxPartitionsContributed: 1,
+		Total:                    TotalParams{Partition: -1, AggregationEpsilon: 1, Consistent: true},
+	})
+	want = beam.ParDo(s, testutils.PairII64ToKV, want)
+	testutils.ApproxEqualsKVInt64(t, s, got, want, 0)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountTotal: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that with Consistent set, the sum of a thresholded partition is
+// spread over the output partitions.
+func TestSumPerKeyTotalConsistent(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeSampleTripleWithFloatValue(7, 0),
+		testutils.MakeSampleTripleWithFloatValue(99, 1),
+		testutils.MakeSampleTripleWithFloatValue(99, 2))
+	result := []testutils.PairIF64{
+		// Only 7 privacy units are associated with value 0: it should be
+		// thresholded, and its sum split between values 1 and 2.
+		{1, 102.5},
+		{2, 102.5},
+		{-1, 205},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	// ε=50, δ=10⁻²⁰⁰ and l0Sensitivity=3 gives a threshold of ≈31.
+	// We have 3 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁴ probability (k=24).
+	// The Total partition has a l0Sensitivity of 1 and a lInfSensitivity of
+	// MaxPartitionsContributed*MaxValue=3, so the same l1Sensitivity as the
+	// other partitions. Each adjusted partition has half of the noise of
+	// the total and of both partitions, so its tolerance is at most 1.5 times
+	// the tolerance of a single partition.
+	epsilon, delta, k, l1Sensitivity := 50.0, 1e-200, 24.0, 3.0
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        2 * epsilon,
+			PartitionSelectionEpsilon: epsilon,
+			PartitionSelectionDelta:   delta,
+		}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := SumPerKey(s, pcol, SumParams{
+		AggregationEpsilon:       epsilon,
+		MaxPartitionsContributed: 3,
+		MinValue:                 0.0,
+		MaxValue:                 1.0,
+		NoiseKind:                LaplaceNoise{},
+		Total:                    TotalParams{Partition: -1, AggregationEpsilon: epsilon, Consistent: true},
+	})
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1.5*testutils.LaplaceTolerance(k, l1Sensitivity, epsilon))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSumPerKeyTotalConsistent: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestCheckTotalParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		params    TotalParams
+		longTail  LongTailParams
+		noiseKind noise.Kind
+		wantErr   bool
+	}{
+		{
+			desc:      "unset",
+			params:    TotalParams{},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc:      "valid Laplace",
+			params:    TotalParams{Partition: -1, AggregationEpsilon: 1, Consistent: true},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc:      "valid Gaussian with LongTail",
+			params:    TotalParams{Partition: -1, AggregationEpsilon: 1, AggregationDelta: 1e-5},
+			longTail:  LongTailParams{Partition: -2, AggregationEpsilon: 1, AggregationDelta: 1e-5},
+			noiseKind: noise.GaussianNoise,
+			wantErr:   false,
+		},
+		{
+			desc:      "Consistent without partition",
+			params:    TotalParams{Consistent: true},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "same partition as LongTail",
+			params:    TotalParams{Partition: -1, AggregationEpsilon: 1},
+			longTail:  LongTailParams{Partition: -1, AggregationEpsilon: 1},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "wrong partition type",
+			params:    TotalParams{Partition: "total", AggregationEpsilon: 1},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "zero epsilon",
+			params:    TotalParams{Partition: -1},
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "zero delta with Gaussian",
+			params:    TotalParams{Partition: -1, AggregationEpsilon: 1},
+			noiseKind: noise.GaussianNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkTotalParams(tc.params, tc.longTail, tc.noiseKind, reflect.TypeOf(0)); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v error, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
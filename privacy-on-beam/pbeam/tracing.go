@@ -0,0 +1,73 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"context"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func init() {
+	register.DoFn3x0[beam.W, beam.V, func(beam.W, beam.V)](&traceStageFn{})
+}
+
+// tracerName is the name of the OpenTelemetry tracer used for stage spans.
+const tracerName = "github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+
+// elementsAttribute is the attribute of stage spans holding the number of
+// elements output by the stage in the bundle.
+const elementsAttribute = attribute.Key("pbeam.elements")
+
+// traceStage returns col, a PCollection<K,V> output by the given stage of an
+// aggregation, unchanged. If the PrivacySpec enables stage tracing, it passes
+// col through a DoFn that creates a span per bundle: since Beam fuses
+// consecutive DoFns, the span lasts as long as the processing of the bundle by
+// the fused stage.
+func traceStage(s beam.Scope, spec PrivacySpec, stage string, col beam.PCollection) beam.PCollection {
+	if !spec.traceStages {
+		return col
+	}
+	return beam.ParDo(s.Scope("traceStage"), &traceStageFn{Stage: stage}, col)
+}
+
+// traceStageFn emits its input unchanged and creates a span per bundle named
+// after Stage, with the number of elements of the bundle as attribute.
+type traceStageFn struct {
+	Stage    string
+	span     trace.Span
+	elements int64
+}
+
+func (fn *traceStageFn) StartBundle(ctx context.Context) {
+	_, fn.span = otel.Tracer(tracerName).Start(ctx, "pbeam."+fn.Stage)
+	fn.elements = 0
+}
+
+func (fn *traceStageFn) ProcessElement(k beam.W, v beam.V, emit func(beam.W, beam.V)) {
+	fn.elements++
+	emit(k, v)
+}
+
+func (fn *traceStageFn) FinishBundle() {
+	fn.span.SetAttributes(elementsAttribute.Int64(fn.elements))
+	fn.span.End()
+}
@@ -0,0 +1,71 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Checks that with TraceStages, Count creates spans for its stages with the
+// number of elements they output.
+func TestTraceStages(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(previous)
+
+	p, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		TestMode:                  TestModeWithContributionBounding,
+		TraceStages:               true,
+	}))
+	got := Count(s, pcol, CountParams{MaxPartitionsContributed: 1, MaxValue: 1})
+	want := beam.ParDo(s, testutils.PairII64ToKV, beam.CreateList(s, []testutils.PairII64{{0, 10}}))
+	testutils.ApproxEqualsKVInt64(t, s, got, want, 0)
+	if err := ptest.Run(p); err != nil {
+		t.Fatalf("TestTraceStages: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+
+	elements := make(map[string]int64)
+	for _, span := range exporter.GetSpans() {
+		for _, a := range span.Attributes {
+			if a.Key == elementsAttribute {
+				elements[span.Name] += a.Value.AsInt64()
+			}
+		}
+	}
+	// Each of the 10 privacy units contributes once to partition 0.
+	wantElements := map[string]int64{
+		"pbeam.Count.boundContributions": 10,
+		"pbeam.Count.aggregate":          1,
+	}
+	if diff := cmp.Diff(wantElements, elements); diff != "" {
+		t.Errorf("TestTraceStages: got diff in elements per stage (-want +got):\n%s", diff)
+	}
+}
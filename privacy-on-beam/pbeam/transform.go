@@ -0,0 +1,238 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/util/reflectx"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	register.Function1x1[float64, float64](logTransformFn)
+	register.Function1x1[float64, float64](expTransformFn)
+	register.Function1x1[float64, float64](sqrtTransformFn)
+	register.Function1x1[float64, float64](squareTransformFn)
+	register.DoFn2x3[beam.W, kv.Pair, beam.W, kv.Pair, error](&transformValuesFn{})
+	register.DoFn2x2[beam.W, float64, beam.W, float64](&invertTransformFn{})
+	register.DoFn2x2[beam.W, []float64, beam.W, []float64](&invertTransformSliceFn{})
+}
+
+// Transform is a strictly increasing function applied to the values of an
+// aggregation before clamping them, e.g. to improve the utility of
+// aggregations on heavy-tailed metrics like latency or revenue: the bounds can
+// then span several orders of magnitude without scaling the noise
+// accordingly. Transform is either LogTransform{}, SqrtTransform{} or a
+// CustomTransform.
+type Transform interface {
+	// functions returns the transform and its inverse, both func(float64) float64.
+	functions() (forward, inverse any)
+}
+
+// LogTransform is the natural logarithm. MinValue must be strictly positive
+// when using it.
+type LogTransform struct{}
+
+func (LogTransform) functions() (forward, inverse any) {
+	return logTransformFn, expTransformFn
+}
+
+// SqrtTransform is the square root. MinValue must be non-negative when using
+// it.
+type SqrtTransform struct{}
+
+func (SqrtTransform) functions() (forward, inverse any) {
+	return sqrtTransformFn, squareTransformFn
+}
+
+// CustomTransform is a strictly increasing transform defined by the user.
+// Forward and Inverse must be registered with register.Function1x1 so that
+// they can be serialized.
+type CustomTransform struct {
+	// Transform applied to values, defined on [MinValue, MaxValue].
+	Forward func(float64) float64
+	// Inverse of Forward, applied to outputs when meaningful.
+	Inverse func(float64) float64
+}
+
+func (t CustomTransform) functions() (forward, inverse any) {
+	return t.Forward, t.Inverse
+}
+
+func logTransformFn(x float64) float64 {
+	return math.Log(x)
+}
+
+func expTransformFn(x float64) float64 {
+	return math.Exp(x)
+}
+
+func sqrtTransformFn(x float64) float64 {
+	return math.Sqrt(x)
+}
+
+// squareTransformFn is the inverse of sqrtTransformFn. Negative values, e.g.
+// noisy outputs, are mapped to 0.
+func squareTransformFn(x float64) float64 {
+	if x < 0 {
+		return 0
+	}
+	return x * x
+}
+
+// transformBounds returns the transformed [lower, upper] bounds, or an error
+// if the transform isn't strictly increasing and finite on them.
+func transformBounds(transform Transform, lower, upper float64) (float64, float64, error) {
+	forward, inverse := transform.functions()
+	f, ok := forward.(func(float64) float64)
+	if !ok || f == nil {
+		return 0, 0, fmt.Errorf("the forward function of Transform must be a non-nil func(float64) float64, got %T", forward)
+	}
+	if g, ok := inverse.(func(float64) float64); !ok || g == nil {
+		return 0, 0, fmt.Errorf("the inverse function of Transform must be a non-nil func(float64) float64, got %T", inverse)
+	}
+	tLower, tUpper := f(lower), f(upper)
+	if math.IsNaN(tLower) || math.IsInf(tLower, 0) || math.IsNaN(tUpper) || math.IsInf(tUpper, 0) {
+		return 0, 0, fmt.Errorf("Transform must be finite on MinValue (%f) and MaxValue (%f), got %f and %f", lower, upper, tLower, tUpper)
+	}
+	if tLower >= tUpper {
+		return 0, 0, fmt.Errorf("Transform must be strictly increasing, got %f for MinValue (%f) and %f for MaxValue (%f)", tLower, lower, tUpper, upper)
+	}
+	return tLower, tUpper, nil
+}
+
+// transformValues clamps the values of pcol, a PrivatePCollection<K,V>, to
+// [lower, upper] and transforms them. It returns a PrivatePCollection<K,float64>.
+//
+// Clamping before transforming is equivalent to clamping to the transformed
+// bounds after transforming, since the transform is increasing, and ensures that
+// the transform is only applied to values on which it is defined.
+func transformValues(s beam.Scope, pcol PrivatePCollection, transform Transform, lower, upper float64) PrivatePCollection {
+	forward, _ := transform.functions()
+	outputCodec := kv.NewCodec(pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	pcol.col = beam.ParDo(s, &transformValuesFn{
+		InputCodec:  pcol.codec,
+		OutputCodec: outputCodec,
+		Lower:       lower,
+		Upper:       upper,
+		Forward:     beam.EncodedFunc{Fn: reflectx.MakeFunc(forward)},
+	}, pcol.col)
+	pcol.codec = outputCodec
+	return pcol
+}
+
+// invertTransform applies the inverse of transform to the values of a
+// PCollection<K,float64>.
+func invertTransform(s beam.Scope, transform Transform, col beam.PCollection) beam.PCollection {
+	_, inverse := transform.functions()
+	return beam.ParDo(s, &invertTransformFn{Inverse: beam.EncodedFunc{Fn: reflectx.MakeFunc(inverse)}}, col)
+}
+
+// invertTransformSlice applies the inverse of transform to each element of the
+// values of a PCollection<K,[]float64>.
+func invertTransformSlice(s beam.Scope, transform Transform, col beam.PCollection) beam.PCollection {
+	_, inverse := transform.functions()
+	return beam.ParDo(s, &invertTransformSliceFn{Inverse: beam.EncodedFunc{Fn: reflectx.MakeFunc(inverse)}}, col)
+}
+
+// transformValuesFn clamps and transforms the value of each kv.Pair{K,V}.
+type transformValuesFn struct {
+	InputCodec, OutputCodec *kv.Codec
+	Lower, Upper            float64
+	Forward                 beam.EncodedFunc
+	forward                 reflectx.Func1x1
+}
+
+func (fn *transformValuesFn) Setup() error {
+	fn.forward = reflectx.ToFunc1x1(fn.Forward.Fn)
+	if err := fn.InputCodec.Setup(); err != nil {
+		return err
+	}
+	return fn.OutputCodec.Setup()
+}
+
+func (fn *transformValuesFn) ProcessElement(id beam.W, pair kv.Pair) (beam.W, kv.Pair, error) {
+	k, v, err := fn.InputCodec.Decode(pair)
+	if err != nil {
+		return nil, kv.Pair{}, fmt.Errorf("pbeam.transformValuesFn.ProcessElement: couldn't decode pair: %v", err)
+	}
+	value := reflect.ValueOf(v)
+	if !value.Type().ConvertibleTo(reflect.TypeOf(float64(0))) {
+		return nil, kv.Pair{}, fmt.Errorf("pbeam.transformValuesFn.ProcessElement: unexpected value type of %v", value.Type())
+	}
+	x := math.Min(math.Max(value.Convert(reflect.TypeOf(float64(0))).Float(), fn.Lower), fn.Upper)
+	transformed, err := fn.OutputCodec.Encode(k, fn.forward.Call1x1(x).(float64))
+	if err != nil {
+		return nil, kv.Pair{}, fmt.Errorf("pbeam.transformValuesFn.ProcessElement: couldn't encode pair: %v", err)
+	}
+	return id, transformed, nil
+}
+
+// invertTransformFn applies the inverse of a transform to each value.
+type invertTransformFn struct {
+	Inverse beam.EncodedFunc
+	inverse reflectx.Func1x1
+}
+
+func (fn *invertTransformFn) Setup() {
+	fn.inverse = reflectx.ToFunc1x1(fn.Inverse.Fn)
+}
+
+func (fn *invertTransformFn) ProcessElement(k beam.W, v float64) (beam.W, float64) {
+	return k, fn.inverse.Call1x1(v).(float64)
+}
+
+// invertTransformSliceFn applies the inverse of a transform to each element of
+// each value.
+type invertTransformSliceFn struct {
+	Inverse beam.EncodedFunc
+	inverse reflectx.Func1x1
+}
+
+func (fn *invertTransformSliceFn) Setup() {
+	fn.inverse = reflectx.ToFunc1x1(fn.Inverse.Fn)
+}
+
+func (fn *invertTransformSliceFn) ProcessElement(k beam.W, v []float64) (beam.W, []float64) {
+	inverted := make([]float64, len(v))
+	for i, x := range v {
+		inverted[i] = fn.inverse.Call1x1(x).(float64)
+	}
+	return k, inverted
+}
+
+// applyTransform transforms the values of pcol and the bounds [*lower, *upper]
+// in place if transform is set, failing the pipeline construction if the
+// transform isn't valid on these bounds.
+func applyTransform(s beam.Scope, aggregation string, pcol PrivatePCollection, transform Transform, lower, upper *float64) PrivatePCollection {
+	if transform == nil {
+		return pcol
+	}
+	tLower, tUpper, err := transformBounds(transform, *lower, *upper)
+	if err != nil {
+		log.Fatalf("pbeam.%s: %v", aggregation, err)
+	}
+	pcol = transformValues(s, pcol, transform, *lower, *upper)
+	*lower, *upper = tLower, tUpper
+	return pcol
+}
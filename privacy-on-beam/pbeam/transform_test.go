@@ -0,0 +1,187 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/util/reflectx"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func init() {
+	register.Function1x1[float64, float64](cubeTransformFn)
+	register.Function1x1[float64, float64](cubeRootTransformFn)
+}
+
+func cubeTransformFn(x float64) float64 {
+	return x * x * x
+}
+
+func cubeRootTransformFn(x float64) float64 {
+	return math.Cbrt(x)
+}
+
+// Checks that MeanPerKey with LogTransform{} computes geometric means.
+func TestMeanPerKeyLogTransform(t *testing.T) {
+	// Privacy IDs 0-49 contribute 1 and privacy IDs 50-99 contribute 100 to
+	// partition 0, whose geometric mean is 10.
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(50, 0, 1),
+		testutils.MakeTripleWithFloatValueStartingFromKey(50, 50, 0, 100))
+	result := []testutils.PairIF64{{Key: 0, Value: 10}}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := MeanPerKey(s, pcol, MeanParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0.001,
+		MaxValue:                     1000,
+		PublicPartitions:             []int{0},
+		Transform:                    LogTransform{},
+	})
+
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+	testutils.ApproxEqualsKVFloat64(t, s, got, want, 1e-6)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestMeanPerKeyLogTransform: MeanPerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+// Checks that QuantilesPerKey with LogTransform{} returns quantiles in the
+// original units of the values.
+func TestQuantilesPerKeyLogTransform(t *testing.T) {
+	triples := testutils.ConcatenateTriplesWithFloatValue(
+		testutils.MakeTripleWithFloatValue(100, 0, 1),
+		testutils.MakeTripleWithFloatValue(100, 0, 1000))
+	result := []testutils.PairIF64Slice{{0, []float64{1, 1000}}}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, testutils.ExtractIDFromTripleWithFloatValue, col)
+
+	lower, upper := 0.1, 10000.0
+	pcol := MakePrivate(s, col, privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon: 1,
+		TestMode:           TestModeWithContributionBounding,
+	}))
+	pcol = ParDo(s, testutils.TripleWithFloatValueToKV, pcol)
+	got := QuantilesPerKey(s, pcol, QuantilesParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 2,
+		MinValue:                     lower,
+		MaxValue:                     upper,
+		Ranks:                        []float64{0.25, 0.75},
+		PublicPartitions:             []int{0},
+		Transform:                    LogTransform{},
+	})
+
+	// The tolerance of quantiles applies to the transformed values, so it is
+	// relative to the value once mapped back; 1000 is the largest quantile.
+	tolerance := 1000 * (math.Exp(testutils.QuantilesTolerance(math.Log(lower), math.Log(upper))) - 1)
+	want = beam.ParDo(s, testutils.PairIF64SliceToKV, want)
+	testutils.ApproxEqualsKVFloat64Slice(t, s, got, want, tolerance)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestQuantilesPerKeyLogTransform: QuantilesPerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+func TestInvertTransformSliceFn(t *testing.T) {
+	fn := &invertTransformSliceFn{Inverse: beam.EncodedFunc{Fn: reflectx.MakeFunc(squareTransformFn)}}
+	fn.Setup()
+	_, got := fn.ProcessElement(0, []float64{-1, 0, 2, 3})
+	if diff := cmp.Diff([]float64{0, 0, 4, 9}, got); diff != "" {
+		t.Errorf("invertTransformSliceFn: got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTransformBounds(t *testing.T) {
+	negate := func(x float64) float64 { return -x }
+	for _, tc := range []struct {
+		desc                 string
+		transform            Transform
+		lower, upper         float64
+		wantLower, wantUpper float64
+		wantErr              bool
+	}{
+		{"log", LogTransform{}, 1, math.E, 0, 1, false},
+		{"sqrt", SqrtTransform{}, 0, 4, 0, 2, false},
+		{"custom", CustomTransform{Forward: cubeTransformFn, Inverse: cubeRootTransformFn}, -1, 2, -1, 8, false},
+		{"log with zero MinValue", LogTransform{}, 0, 10, 0, 0, true},
+		{"sqrt with negative MinValue", SqrtTransform{}, -1, 4, 0, 0, true},
+		{"custom without Inverse", CustomTransform{Forward: cubeTransformFn}, -1, 2, 0, 0, true},
+		{"decreasing custom", CustomTransform{Forward: negate, Inverse: negate}, 1, 2, 0, 0, true},
+	} {
+		gotLower, gotUpper, err := transformBounds(tc.transform, tc.lower, tc.upper)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("transformBounds with %s: got error %v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if !tc.wantErr && (!testutils.ApproxEquals(gotLower, tc.wantLower) || !testutils.ApproxEquals(gotUpper, tc.wantUpper)) {
+			t.Errorf("transformBounds with %s: got [%f, %f], want [%f, %f]", tc.desc, gotLower, gotUpper, tc.wantLower, tc.wantUpper)
+		}
+	}
+}
+
+func TestTransformValuesFn(t *testing.T) {
+	inputCodec := kv.NewCodec(reflect.TypeOf(0), reflect.TypeOf(int64(0)))
+	outputCodec := kv.NewCodec(reflect.TypeOf(0), reflect.TypeOf(float64(0)))
+	fn := &transformValuesFn{
+		InputCodec:  inputCodec,
+		OutputCodec: outputCodec,
+		Lower:       1,
+		Upper:       16,
+		Forward:     beam.EncodedFunc{Fn: reflectx.MakeFunc(sqrtTransformFn)},
+	}
+	if err := fn.Setup(); err != nil {
+		t.Fatalf("transformValuesFn.Setup: got error %v", err)
+	}
+	for _, tc := range []struct {
+		value int64
+		want  float64
+	}{
+		{-5, 1}, // Clamped to Lower before being transformed.
+		{9, 3},
+		{100, 4}, // Clamped to Upper before being transformed.
+	} {
+		pair, err := inputCodec.Encode(0, tc.value)
+		if err != nil {
+			t.Fatalf("Encode(%d): got error %v", tc.value, err)
+		}
+		_, got, err := fn.ProcessElement(nil, pair)
+		if err != nil {
+			t.Fatalf("transformValuesFn(%d): got error %v", tc.value, err)
+		}
+		_, v, err := outputCodec.Decode(got)
+		if err != nil {
+			t.Fatalf("Decode: got error %v", err)
+		}
+		if v.(float64) != tc.want {
+			t.Errorf("transformValuesFn(%d) = %f, want %f", tc.value, v, tc.want)
+		}
+	}
+}
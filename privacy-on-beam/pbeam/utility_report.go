@@ -0,0 +1,199 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(UtilityReport{}))
+	register.DoFn2x2[beam.W, int64, beam.W, float64](&scoreUtilityInt64Fn{})
+	register.DoFn2x2[beam.W, float64, beam.W, float64](&scoreUtilityFloat64Fn{})
+	register.Combiner3[utilityReportAccum, float64, UtilityReport](&utilityReportFn{})
+}
+
+// defaultUtilityScoreBucketBounds are the default bounds of the buckets of
+// the distribution of utility scores.
+var defaultUtilityScoreBucketBounds = []float64{1, 2, 5, 10}
+
+// UtilityReportParams specifies how to score the utility of the outputs of an
+// aggregation.
+type UtilityReportParams struct {
+	// Noise that was added to the outputs.
+	//
+	// Required.
+	NoiseParams OutputNoiseParams
+	// Bounds of the buckets of the distribution of utility scores, in strictly
+	// increasing order. With bounds b₀ < b₁ < … < bₙ₋₁, the buckets are
+	// [0, b₀), [b₀, b₁), …, [bₙ₋₁, +∞).
+	//
+	// Defaults to {1, 2, 5, 10}.
+	ScoreBucketBounds []float64
+}
+
+// UtilityReport summarizes the distribution of the utility scores of the
+// partitions released by an aggregation.
+type UtilityReport struct {
+	// Number of released partitions.
+	NumPartitions int64
+	// Standard deviation of the noise added to each output.
+	NoiseStandardDeviation float64
+	// Mean utility score of the released partitions.
+	MeanScore float64
+	// Bounds of the buckets of the score distribution, as in
+	// UtilityReportParams.ScoreBucketBounds.
+	ScoreBucketBounds []float64
+	// Number of released partitions whose score is in each bucket.
+	// BucketCounts[0] counts the scores smaller than ScoreBucketBounds[0], and
+	// BucketCounts[i] the scores in [ScoreBucketBounds[i-1], ScoreBucketBounds[i]).
+	// It has one more element than ScoreBucketBounds.
+	BucketCounts []int64
+}
+
+// ScoreUtility scores the utility of each partition released by an
+// aggregation with its expected signal-to-noise ratio, i.e. the absolute value
+// of its noisy output divided by the standard deviation of the noise, and
+// summarizes the distribution of the scores.
+//
+// A report where most partitions have a low score (e.g. smaller than 1, which
+// means that the noise is typically larger than the output) suggests raising
+// ε or pre-thresholding partitions more aggressively. Scores are
+// proportional to ε with Laplace noise.
+//
+// Scores only depend on the released outputs and on public noise parameters,
+// so ScoreUtility is a post-processing step and doesn't consume any privacy
+// budget. Note that scores are computed from noisy outputs, so they are noisy
+// too; in particular, partitions with a small true value can get a high score.
+//
+// ScoreUtility takes a PCollection<K, int64> or PCollection<K, float64> and
+// returns a PCollection<K, float64> with the score of each partition, and a
+// PCollection<UtilityReport> with a single element.
+func ScoreUtility(s beam.Scope, col beam.PCollection, params UtilityReportParams) (scores, report beam.PCollection) {
+	s = s.Scope("pbeam.ScoreUtility")
+	_, valueT := beam.ValidateKVType(col)
+	if params.ScoreBucketBounds == nil {
+		params.ScoreBucketBounds = defaultUtilityScoreBucketBounds
+	}
+	if err := checkUtilityReportParams(params); err != nil {
+		log.Fatalf("pbeam.ScoreUtility: %v", err)
+	}
+	stdDev, err := params.NoiseParams.StandardDeviation()
+	if err != nil {
+		log.Fatalf("pbeam.ScoreUtility: %v", err)
+	}
+	switch valueT.Type() {
+	case reflect.TypeOf(int64(0)):
+		scores = beam.ParDo(s, &scoreUtilityInt64Fn{StandardDeviation: stdDev}, col)
+	case reflect.TypeOf(float64(0)):
+		scores = beam.ParDo(s, &scoreUtilityFloat64Fn{StandardDeviation: stdDev}, col)
+	default:
+		log.Fatalf("pbeam.ScoreUtility: value type must be int64 or float64, got %v", valueT.Type())
+	}
+	report = beam.Combine(s,
+		&utilityReportFn{StandardDeviation: stdDev, ScoreBucketBounds: params.ScoreBucketBounds},
+		beam.DropKey(s, scores))
+	return scores, report
+}
+
+func checkUtilityReportParams(params UtilityReportParams) error {
+	if err := params.NoiseParams.check(); err != nil {
+		return fmt.Errorf("NoiseParams: %w", err)
+	}
+	for i, b := range params.ScoreBucketBounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) || b <= 0 {
+			return fmt.Errorf("ScoreBucketBounds must be finite and strictly positive, got %f", b)
+		}
+		if i > 0 && b <= params.ScoreBucketBounds[i-1] {
+			return fmt.Errorf("ScoreBucketBounds must be strictly increasing, got %v", params.ScoreBucketBounds)
+		}
+	}
+	return nil
+}
+
+type scoreUtilityInt64Fn struct {
+	StandardDeviation float64
+}
+
+func (fn *scoreUtilityInt64Fn) ProcessElement(k beam.W, v int64) (beam.W, float64) {
+	return k, math.Abs(float64(v)) / fn.StandardDeviation
+}
+
+type scoreUtilityFloat64Fn struct {
+	StandardDeviation float64
+}
+
+func (fn *scoreUtilityFloat64Fn) ProcessElement(k beam.W, v float64) (beam.W, float64) {
+	return k, math.Abs(v) / fn.StandardDeviation
+}
+
+type utilityReportAccum struct {
+	BucketCounts []int64
+	SumScores    float64
+}
+
+// utilityReportFn computes the UtilityReport of a PCollection<float64> of
+// utility scores.
+type utilityReportFn struct {
+	StandardDeviation float64
+	ScoreBucketBounds []float64
+}
+
+func (fn *utilityReportFn) CreateAccumulator() utilityReportAccum {
+	return utilityReportAccum{BucketCounts: make([]int64, len(fn.ScoreBucketBounds)+1)}
+}
+
+func (fn *utilityReportFn) AddInput(a utilityReportAccum, score float64) utilityReportAccum {
+	bucket := 0
+	for bucket < len(fn.ScoreBucketBounds) && score >= fn.ScoreBucketBounds[bucket] {
+		bucket++
+	}
+	a.BucketCounts[bucket]++
+	a.SumScores += score
+	return a
+}
+
+func (fn *utilityReportFn) MergeAccumulators(a, b utilityReportAccum) utilityReportAccum {
+	for i := range a.BucketCounts {
+		a.BucketCounts[i] += b.BucketCounts[i]
+	}
+	a.SumScores += b.SumScores
+	return a
+}
+
+func (fn *utilityReportFn) ExtractOutput(a utilityReportAccum) UtilityReport {
+	var n int64
+	for _, c := range a.BucketCounts {
+		n += c
+	}
+	r := UtilityReport{
+		NumPartitions:          n,
+		NoiseStandardDeviation: fn.StandardDeviation,
+		ScoreBucketBounds:      fn.ScoreBucketBounds,
+		BucketCounts:           a.BucketCounts,
+	}
+	if n > 0 {
+		r.MeanScore = a.SumScores / float64(n)
+	}
+	return r
+}
@@ -0,0 +1,121 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+// With Laplace noise, ε=1 and sensitivities of 1, the noise has a standard
+// deviation of √2.
+var utilityReportTestNoiseParams = OutputNoiseParams{
+	NoiseKind:                LaplaceNoise{},
+	Epsilon:                  1,
+	MaxPartitionsContributed: 1,
+	MaxContribution:          1,
+}
+
+func TestScoreUtility(t *testing.T) {
+	outputs := []testutils.PairII64{{0, 1}, {1, 2}, {2, -10}, {3, 100}}
+	result := []testutils.PairIF64{{0, 1 / math.Sqrt2}, {1, math.Sqrt2}, {2, 10 / math.Sqrt2}, {3, 100 / math.Sqrt2}}
+	p, s, col, want := ptest.CreateList2(outputs, result)
+	col = beam.ParDo(s, testutils.PairII64ToKV, col)
+	want = beam.ParDo(s, testutils.PairIF64ToKV, want)
+
+	scores, _ := ScoreUtility(s, col, UtilityReportParams{NoiseParams: utilityReportTestNoiseParams})
+
+	testutils.ApproxEqualsKVFloat64(t, s, scores, want, 1e-10)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestScoreUtility: ScoreUtility(%v) = %v, expected %v: %v", col, scores, want, err)
+	}
+}
+
+func TestUtilityReportFn(t *testing.T) {
+	fn := &utilityReportFn{StandardDeviation: 2, ScoreBucketBounds: []float64{1, 5}}
+	a := fn.CreateAccumulator()
+	for _, score := range []float64{0.5, 1, 3} {
+		a = fn.AddInput(a, score)
+	}
+	b := fn.CreateAccumulator()
+	b = fn.AddInput(b, 7.5)
+	got := fn.ExtractOutput(fn.MergeAccumulators(a, b))
+
+	want := UtilityReport{
+		NumPartitions:          4,
+		NoiseStandardDeviation: 2,
+		MeanScore:              3,
+		ScoreBucketBounds:      []float64{1, 5},
+		BucketCounts:           []int64{1, 2, 1},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.EquateApprox(0, 1e-10)); diff != "" {
+		t.Errorf("utilityReportFn output differs from expected (-want +got):\n%s", diff)
+	}
+}
+
+func TestUtilityReportFnNoPartitions(t *testing.T) {
+	fn := &utilityReportFn{StandardDeviation: 2, ScoreBucketBounds: []float64{1}}
+	got := fn.ExtractOutput(fn.CreateAccumulator())
+	want := UtilityReport{NoiseStandardDeviation: 2, ScoreBucketBounds: []float64{1}, BucketCounts: []int64{0, 0}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("utilityReportFn output differs from expected (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckUtilityReportParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  UtilityReportParams
+		wantErr bool
+	}{
+		{
+			desc:    "valid parameters",
+			params:  UtilityReportParams{NoiseParams: utilityReportTestNoiseParams, ScoreBucketBounds: []float64{1, 2}},
+			wantErr: false,
+		},
+		{
+			desc:    "invalid noise parameters",
+			params:  UtilityReportParams{NoiseParams: OutputNoiseParams{Epsilon: 1, MaxPartitionsContributed: 1, MaxContribution: 1}},
+			wantErr: true,
+		},
+		{
+			desc:    "non-positive bucket bound",
+			params:  UtilityReportParams{NoiseParams: utilityReportTestNoiseParams, ScoreBucketBounds: []float64{0, 2}},
+			wantErr: true,
+		},
+		{
+			desc:    "infinite bucket bound",
+			params:  UtilityReportParams{NoiseParams: utilityReportTestNoiseParams, ScoreBucketBounds: []float64{1, math.Inf(1)}},
+			wantErr: true,
+		},
+		{
+			desc:    "bucket bounds not increasing",
+			params:  UtilityReportParams{NoiseParams: utilityReportTestNoiseParams, ScoreBucketBounds: []float64{2, 2}},
+			wantErr: true,
+		},
+	} {
+		if err := checkUtilityReportParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(ValidationError{}))
+	register.DoFn2x1[[]byte, func(beam.T), error](&failValidationFn{})
+	register.Emitter1[beam.T]()
+	register.DoFn2x1[[]byte, func(beam.W, beam.V), error](&failValidationKVFn{})
+}
+
+// ValidationError describes invalid parameters of an aggregation, whose
+// failure was deferred to pipeline execution. See
+// PrivacySpecParams.DeferValidationErrors.
+type ValidationError struct {
+	// Aggregation is the name of the aggregation, e.g. "Count".
+	Aggregation string
+	// Error is the validation error, as it would have been logged at pipeline
+	// construction.
+	Error string
+}
+
+func (e ValidationError) String() string {
+	return fmt.Sprintf("pbeam: invalid parameters for %s: %s", e.Aggregation, e.Error)
+}
+
+// validationErrorSink collects the validation errors of the aggregations of a
+// PrivacySpec during pipeline construction.
+type validationErrorSink struct {
+	mux    sync.Mutex
+	errors []ValidationError
+}
+
+func (sink *validationErrorSink) add(e ValidationError) {
+	sink.mux.Lock()
+	defer sink.mux.Unlock()
+	sink.errors = append(sink.errors, e)
+}
+
+// ValidationErrors returns the validation errors of the aggregations
+// constructed so far on PrivatePCollections using this PrivacySpec. It is empty
+// unless PrivacySpecParams.DeferValidationErrors is set: otherwise, the first
+// validation error stops the program.
+func (ps *PrivacySpec) ValidationErrors() []ValidationError {
+	if ps.validationErrors == nil {
+		return nil
+	}
+	ps.validationErrors.mux.Lock()
+	defer ps.validationErrors.mux.Unlock()
+	return append([]ValidationError(nil), ps.validationErrors.errors...)
+}
+
+// invalidAggregation handles the validation error err of an aggregation. It
+// stops the program, unless validation errors are deferred: then, it returns a
+// PCollection that fails the pipeline when it is executed, whose elements have
+// the given types: a PCollection<K,V> if there are two, and a PCollection<T>
+// if there is one.
+func (ps *PrivacySpec) invalidAggregation(s beam.Scope, aggregation string, err error, outputTypes ...reflect.Type) beam.PCollection {
+	if !ps.deferValidationErrors {
+		log.Fatalf("%v", err)
+	}
+	e := ValidationError{Aggregation: aggregation, Error: err.Error()}
+	log.Warningf("%v, the pipeline will fail when it is executed", e)
+	// The validation error isn't logged to dpagg.Log, since it may contain
+	// arbitrary parameters, like the public partitions.
+	dpagg.Log(dpagg.LogEntry{Level: dpagg.LogWarning, Source: "pbeam." + aggregation, Message: "invalid aggregation, the pipeline will fail when it is executed"})
+	if ps.validationErrors != nil {
+		ps.validationErrors.add(e)
+	}
+	s = s.Scope("invalidAggregation")
+	impulse := beam.Impulse(s)
+	if len(outputTypes) == 2 {
+		return beam.ParDo(s, &failValidationKVFn{e}, impulse,
+			beam.TypeDefinition{Var: beam.WType, T: outputTypes[0]},
+			beam.TypeDefinition{Var: beam.VType, T: outputTypes[1]})
+	}
+	return beam.ParDo(s, &failValidationFn{e}, impulse, beam.TypeDefinition{Var: beam.TType, T: outputTypes[0]})
+}
+
+// failValidationFn fails with a validation error instead of outputting a
+// PCollection<T>.
+type failValidationFn struct {
+	Err ValidationError
+}
+
+func (fn *failValidationFn) ProcessElement(_ []byte, _ func(beam.T)) error {
+	return fmt.Errorf("%v", fn.Err)
+}
+
+// failValidationKVFn fails with a validation error instead of outputting a
+// PCollection<K,V>.
+type failValidationKVFn struct {
+	Err ValidationError
+}
+
+func (fn *failValidationKVFn) ProcessElement(_ []byte, _ func(beam.W, beam.V)) error {
+	return fmt.Errorf("%v", fn.Err)
+}
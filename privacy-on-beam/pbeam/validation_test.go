@@ -0,0 +1,118 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Checks that invalid parameters fail the pipeline instead of stopping the
+// program when validation errors are deferred.
+func TestDeferValidationErrors(t *testing.T) {
+	pairs := testutils.MakePairsWithFixedV(10, 0)
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		DeferValidationErrors:     true,
+	})
+	pcol := MakePrivate(s, col, spec)
+	// MaxPartitionsContributed is required.
+	Count(s, pcol, CountParams{MaxValue: 1, NoiseKind: LaplaceNoise{}})
+
+	errs := spec.ValidationErrors()
+	if len(errs) != 1 {
+		t.Fatalf("ValidationErrors() = %v, want a single error", errs)
+	}
+	if errs[0].Aggregation != "Count" {
+		t.Errorf("ValidationErrors()[0].Aggregation = %q, want \"Count\"", errs[0].Aggregation)
+	}
+	if err := ptest.Run(p); err == nil {
+		t.Errorf("TestDeferValidationErrors: pipeline with an invalid Count succeeded, expected an error")
+	}
+}
+
+// Checks that ValidationErrors is empty for valid aggregations.
+func TestNoValidationErrors(t *testing.T) {
+	pairs := testutils.MakePairsWithFixedV(10, 0)
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		DeferValidationErrors:     true,
+	})
+	pcol := MakePrivate(s, col, spec)
+	Count(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}})
+
+	if errs := spec.ValidationErrors(); len(errs) != 0 {
+		t.Errorf("ValidationErrors() = %v, want none", errs)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestNoValidationErrors: pipeline failed: %v", err)
+	}
+}
+
+type recordingLogger struct {
+	mux     sync.Mutex
+	entries []dpagg.LogEntry
+}
+
+func (l *recordingLogger) Log(entry dpagg.LogEntry) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+// Checks that deferred validation errors are sent to the dpagg.Logger, without
+// the error message.
+func TestDeferValidationErrorsAreLogged(t *testing.T) {
+	l := &recordingLogger{}
+	dpagg.SetLogger(l)
+	t.Cleanup(func() { dpagg.SetLogger(nil) })
+
+	_, s, col := ptest.CreateList(testutils.MakePairsWithFixedV(10, 0))
+	col = beam.ParDo(s, testutils.PairToKV, col)
+	spec := privacySpec(t, PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		DeferValidationErrors:     true,
+	})
+	pcol := MakePrivate(s, col, spec)
+	// MaxPartitionsContributed is required.
+	Count(s, pcol, CountParams{MaxValue: 1, NoiseKind: LaplaceNoise{}})
+
+	want := []dpagg.LogEntry{{
+		Level:   dpagg.LogWarning,
+		Source:  "pbeam.Count",
+		Message: "invalid aggregation, the pipeline will fail when it is executed",
+	}}
+	if diff := cmp.Diff(want, l.entries); diff != "" {
+		t.Errorf("Logged entries (-want +got):\n%s", diff)
+	}
+}
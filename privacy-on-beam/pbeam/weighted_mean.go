@@ -0,0 +1,552 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/v3/checks"
+	"github.com/google/differential-privacy/go/v3/dpagg"
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/internal/kv"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf(WeightedValue{}))
+	register.Combiner3[expandWeightedValuesAccum, WeightedValue, []float64](&expandWeightedValuesCombineFn{})
+	register.Combiner3[weightedMeanAccum, []float64, *float64](&weightedMeanFn{})
+}
+
+// WeightedValue is a value with a weight, as aggregated by WeightedMeanPerKey.
+type WeightedValue struct {
+	Value, Weight float64
+}
+
+// WeightedMeanParams specifies the parameters associated with a WeightedMean
+// aggregation.
+type WeightedMeanParams struct {
+	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation, split evenly
+	// between the weighted sum of the values and the sum of the weights. If
+	// there is only one aggregation, both epsilon and delta can be left 0; in
+	// that case the entire budget reserved for aggregation in the PrivacySpec
+	// is consumed.
+	AggregationEpsilon, AggregationDelta float64
+	// Differential privacy budget consumed by partition selection of this
+	// aggregation.
+	//
+	// If PublicPartitions are specified, this needs to be left unset.
+	//
+	// If there is only one aggregation, this can be left unset; in that case
+	// the entire budget reserved for partition selection in the PrivacySpec
+	// is consumed.
+	//
+	// Optional.
+	PartitionSelectionParams PartitionSelectionParams
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// See MeanParams.PublicPartitions for details.
+	//
+	// Optional.
+	PublicPartitions any
+	// The maximum number of distinct keys that a given privacy identifier
+	// can influence.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of weighted values that a given privacy identifier
+	// can contribute to each key. If a privacy identifier is associated with
+	// more weighted values for a key, random weighted values are dropped.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// Values are clamped to [MinValue, MaxValue].
+	//
+	// Required.
+	MinValue, MaxValue float64
+	// Weights are clamped to [MinWeight, MaxWeight]. The noise added to the
+	// weighted sum of the values is proportional to MaxWeight*(MaxValue-MinValue),
+	// and the noise added to the sum of the weights to MaxWeight.
+	//
+	// Required; must be such that 0 <= MinWeight < MaxWeight.
+	MinWeight, MaxWeight float64
+}
+
+// WeightedMeanPerKey obtains the weighted mean of the values associated with
+// each key in a PrivatePCollection<K,WeightedValue>, i.e. the sum of the
+// values multiplied by their weight divided by the sum of the weights, adding
+// differentially private noise to both sums and doing pre-aggregation
+// thresholding to remove partitions with a low number of distinct privacy
+// identifiers.
+//
+// Both sums are computed over the same contributions, bounded once, so the
+// budget only needs to be split by setting AggregationEpsilon and
+// AggregationDelta for the weighted mean as a whole.
+//
+// It is also possible to manually specify the list of partitions present in
+// the output, in which case the partition selection/thresholding step is
+// skipped.
+//
+// WeightedMeanPerKey transforms a PrivatePCollection<K,WeightedValue> into a
+// PCollection<K,float64>.
+func WeightedMeanPerKey(s beam.Scope, pcol PrivatePCollection, params WeightedMeanParams) beam.PCollection {
+	s = s.Scope("pbeam.WeightedMeanPerKey")
+	pcol = extractTaggedStructFields(s, pcol, true)
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Fatalf("WeightedMeanPerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Fatalf("WeightedMeanPerKey: no codec found for the input PrivatePCollection.")
+	}
+	if pcol.codec.VType.T != reflect.TypeOf(WeightedValue{}) {
+		log.Fatalf("WeightedMeanPerKey: values must be of type WeightedValue, got %v instead", pcol.codec.VType.T)
+	}
+	invalid := func(err error) beam.PCollection {
+		return pcol.privacySpec.invalidAggregation(s, "WeightedMeanPerKey", err, pcol.codec.KType.T, reflect.TypeOf(float64(0)))
+	}
+
+	// Get privacy parameters.
+	spec := pcol.privacySpec
+	budget, err := spec.reserveBudget("WeightedMeanPerKey", &params.AggregationEpsilon, &params.AggregationDelta, privatePartitionSelection(params.PublicPartitions, &params.PartitionSelectionParams))
+	if err != nil {
+		return invalid(err)
+	}
+
+	noiseKind, err := pcol.privacySpec.getNoiseKind(params.NoiseKind)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.WeightedMeanPerKey: %v", err))
+	}
+	err = pcol.privacySpec.checkNoNoiseSeedKey("WeightedMeanPerKey")
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.WeightedMeanPerKey: %v", err))
+	}
+
+	err = checkWeightedMeanPerKeyParams(params, noiseKind, pcol.codec.KType.T)
+	if err != nil {
+		return invalid(fmt.Errorf("pbeam.WeightedMeanPerKey: %v", err))
+	}
+	err = budget.commit()
+	if err != nil {
+		return invalid(err)
+	}
+	spec.aggregationRegistered("WeightedMeanPerKey", params.AggregationEpsilon, params.AggregationDelta, params.PartitionSelectionParams.Epsilon, params.PartitionSelectionParams.Delta)
+
+	// Drop non-public partitions, if public partitions are specified.
+	pcol.col, err = dropNonPublicPartitions(s, pcol, params.PublicPartitions, pcol.codec.KType.T)
+	if err != nil {
+		log.Fatalf("Couldn't drop non-public partitions for WeightedMeanPerKey: %v", err)
+	}
+
+	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},WeightedValue>
+	decoded := parDoWithDeadLetters(s, spec,
+		newEncodeIDKFn(idT, pcol.codec, spec.skipMalformedRecords),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = saltPrivacyIDs(s, spec, decoded)
+
+	// Combine all weighted values for <id, partition> into a slice, keeping at most
+	// MaxContributionsPerPartition of them unless in test mode without contribution bounding.
+	// Result is PCollection<kv.Pair{ID,K},[]float64>, with values and weights interleaved.
+	combined := beam.CombinePerKey(s, &expandWeightedValuesCombineFn{MaxValues: maxContributionsPerPartition(*spec, params.MaxContributionsPerPartition)}, decoded)
+	combined = traceStage(s, *spec, "WeightedMeanPerKey.boundContributionsPerPartition", combined)
+
+	// Result is PCollection<ID, pairArrayFloat64>.
+	rekeyed := beam.ParDo(s, rekeyArrayFloat64, combined)
+	// Second, do cross-partition contribution bounding if not in test mode without contribution bounding.
+	if spec.testMode != TestModeWithoutContributionBounding {
+		rekeyed = boundContributions(s, rekeyed, params.MaxPartitionsContributed)
+		rekeyed = traceStage(s, *spec, "WeightedMeanPerKey.boundContributions", rekeyed)
+	}
+
+	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
+	// Result is PCollection<partition, []float64>.
+	partialPairs := beam.DropKey(s, rekeyed)
+	partitionT := pcol.codec.KType.T
+	partialKV := beam.ParDo(s,
+		newDecodePairArrayFloat64Fn(partitionT),
+		partialPairs,
+		beam.TypeDefinition{Var: beam.WType, T: partitionT})
+
+	// Add public partitions and return the aggregation output, if public partitions are specified.
+	if params.PublicPartitions != nil {
+		return addPublicPartitionsForWeightedMean(s, *spec, params, noiseKind, partialKV)
+	}
+	// Compute the weighted mean for each partition. Result is PCollection<partition, float64>.
+	fn, err := newWeightedMeanFn(*spec, params, noiseKind, false)
+	if err != nil {
+		log.Fatalf("Couldn't get weightedMeanFn for WeightedMeanPerKey: %v", err)
+	}
+	means := beam.CombinePerKey(s, fn, partialKV)
+	means = traceStage(s, *spec, "WeightedMeanPerKey.aggregate", means)
+	reportNoiseDraws(s, means)
+	// Finally, drop thresholded partitions.
+	return beam.ParDo(s, dropThresholdedPartitionsFloat64, means)
+}
+
+func addPublicPartitionsForWeightedMean(s beam.Scope, spec PrivacySpec, params WeightedMeanParams, noiseKind noise.Kind, partialKV beam.PCollection) beam.PCollection {
+	publicPartitions, isPCollection := params.PublicPartitions.(beam.PCollection)
+	if !isPCollection {
+		publicPartitions = beam.Reshuffle(s, beam.CreateList(s, params.PublicPartitions))
+	}
+	emptyPublicPartitions := beam.ParDo(s, addEmptySliceToPublicPartitionsFloat64, publicPartitions)
+	fn, err := newWeightedMeanFn(spec, params, noiseKind, true)
+	if err != nil {
+		log.Fatalf("Couldn't get weightedMeanFn for WeightedMeanPerKey: %v", err)
+	}
+	noisyEmptyPublicPartitions := beam.CombinePerKey(s, fn, emptyPublicPartitions)
+	reportNoiseDraws(s, noisyEmptyPublicPartitions)
+	means := beam.CombinePerKey(s, fn, partialKV)
+	means = traceStage(s, spec, "WeightedMeanPerKey.aggregate", means)
+	reportNoiseDraws(s, means)
+	return mergeMeansWithEmptyPublicPartitions(s, means, noisyEmptyPublicPartitions)
+}
+
+func checkWeightedMeanPerKeyParams(params WeightedMeanParams, noiseKind noise.Kind, partitionType reflect.Type) error {
+	err := checkPublicPartitions(params.PublicPartitions, partitionType)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationEpsilon(params.AggregationEpsilon)
+	if err != nil {
+		return err
+	}
+	err = checkAggregationDelta(params.AggregationDelta, noiseKind)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionEpsilon(params.PartitionSelectionParams.Epsilon, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionDelta(params.PartitionSelectionParams.Delta, params.PublicPartitions)
+	if err != nil {
+		return err
+	}
+	err = checkMaxPartitionsContributedPartitionSelection(params.PartitionSelectionParams.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsFloat64(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsNotEqual(params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsFloat64(params.MinWeight, params.MaxWeight)
+	if err != nil {
+		return err
+	}
+	if params.MinWeight < 0 {
+		return fmt.Errorf("MinWeight must be non-negative, got %f", params.MinWeight)
+	}
+	if params.MaxWeight <= params.MinWeight {
+		return fmt.Errorf("MaxWeight must be larger than MinWeight, got MinWeight=%f and MaxWeight=%f", params.MinWeight, params.MaxWeight)
+	}
+	err = checks.CheckMaxContributionsPerPartition(params.MaxContributionsPerPartition)
+	if err != nil {
+		return err
+	}
+	return checkMaxPartitionsContributed(params.MaxPartitionsContributed)
+}
+
+type expandWeightedValuesAccum struct {
+	Values []WeightedValue
+	// Number of weighted values added to the accumulator. If it is larger than
+	// the MaxValues of the CombineFn, Values is a uniformly random sample of them.
+	Count int64
+}
+
+// expandWeightedValuesCombineFn converts a PCollection<K,WeightedValue> to a
+// PCollection<K,[]float64>, where the values and weights of each key are
+// interleaved in a single slice: [v₀, w₀, v₁, w₁, …]. This lets weighted values
+// go through the contribution bounding and public partition steps of other
+// float64 aggregations.
+//
+// If MaxValues is positive, at most MaxValues weighted values are kept per key,
+// sampled uniformly at random with reservoir sampling.
+type expandWeightedValuesCombineFn struct {
+	MaxValues int64
+}
+
+func (fn *expandWeightedValuesCombineFn) CreateAccumulator() expandWeightedValuesAccum {
+	return expandWeightedValuesAccum{}
+}
+
+func (fn *expandWeightedValuesCombineFn) AddInput(a expandWeightedValuesAccum, value WeightedValue) expandWeightedValuesAccum {
+	a.Count++
+	i := int64(len(a.Values))
+	if fn.MaxValues > 0 && i >= fn.MaxValues {
+		if i = rand.Int63n(a.Count); i >= fn.MaxValues {
+			return a
+		}
+		a.Values[i] = value
+		return a
+	}
+	a.Values = append(a.Values, value)
+	return a
+}
+
+func (fn *expandWeightedValuesCombineFn) MergeAccumulators(a, b expandWeightedValuesAccum) expandWeightedValuesAccum {
+	if fn.MaxValues > 0 && int64(len(a.Values)+len(b.Values)) > fn.MaxValues {
+		a.Values = mergeSamples(a.Values, b.Values, a.Count, b.Count, fn.MaxValues)
+	} else {
+		a.Values = append(a.Values, b.Values...)
+	}
+	a.Count += b.Count
+	return a
+}
+
+func (fn *expandWeightedValuesCombineFn) ExtractOutput(a expandWeightedValuesAccum) []float64 {
+	interleaved := make([]float64, 0, 2*len(a.Values))
+	for _, v := range a.Values {
+		interleaved = append(interleaved, v.Value, v.Weight)
+	}
+	return interleaved
+}
+
+type weightedMeanAccum struct {
+	// Sum of the weighted values, normalized around the midpoint of
+	// [MinValue, MaxValue] like in dpagg.BoundedMean.
+	NormalizedSum *dpagg.BoundedSumFloat64
+	Weight        *dpagg.BoundedSumFloat64
+	SP            *dpagg.PreAggSelectPartition
+}
+
+// weightedMeanFn is a differentially private combineFn for obtaining the
+// weighted mean of values, whose input are the interleaved values and weights
+// output by expandWeightedValuesCombineFn. Do not initialize it yourself, use
+// newWeightedMeanFn to create a weightedMeanFn instance.
+type weightedMeanFn struct {
+	// Privacy spec parameters (set during initial construction).
+	NoiseEpsilon                 float64
+	PartitionSelectionEpsilon    float64
+	NoiseDelta                   float64
+	PartitionSelectionDelta      float64
+	PreThreshold                 int64
+	PartitionSelector            *encodedPartitionSelector
+	MaxPartitionsContributed     int64
+	MaxContributionsPerPartition int64
+	Lower                        float64
+	Upper                        float64
+	MinWeight                    float64
+	MaxWeight                    float64
+	NoiseKind                    noise.Kind
+	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
+	PublicPartitions             bool        // Set to true if public partitions are used.
+	TestMode                     TestMode
+}
+
+// newWeightedMeanFn returns a weightedMeanFn with the given budget and parameters.
+func newWeightedMeanFn(spec PrivacySpec, params WeightedMeanParams, noiseKind noise.Kind, publicPartitions bool) (*weightedMeanFn, error) {
+	if noise.Consumption(noiseKind) == noise.UnspecifiedConsumption {
+		return nil, fmt.Errorf("unknown noise.Kind (%v) is specified. Please specify a valid noise", noiseKind)
+	}
+	return &weightedMeanFn{
+		NoiseEpsilon:                 params.AggregationEpsilon,
+		NoiseDelta:                   params.AggregationDelta,
+		PartitionSelectionEpsilon:    params.PartitionSelectionParams.Epsilon,
+		PartitionSelectionDelta:      params.PartitionSelectionParams.Delta,
+		PreThreshold:                 spec.preThreshold,
+		PartitionSelector:            spec.partitionSelector,
+		MaxPartitionsContributed:     params.MaxPartitionsContributed,
+		MaxContributionsPerPartition: params.MaxContributionsPerPartition,
+		Lower:                        params.MinValue,
+		Upper:                        params.MaxValue,
+		MinWeight:                    params.MinWeight,
+		MaxWeight:                    params.MaxWeight,
+		NoiseKind:                    noiseKind,
+		PublicPartitions:             publicPartitions,
+		TestMode:                     spec.testMode,
+	}, nil
+}
+
+func (fn *weightedMeanFn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+	if fn.TestMode.isEnabled() {
+		fn.noise = noNoise{}
+	}
+}
+
+func (fn *weightedMeanFn) midPoint() float64 {
+	return fn.Lower + (fn.Upper-fn.Lower)/2
+}
+
+// clamps returns whether values and weights are clamped, i.e. unless in test
+// mode without contribution bounding.
+func (fn *weightedMeanFn) clamps() bool {
+	return fn.TestMode != TestModeWithoutContributionBounding
+}
+
+func (fn *weightedMeanFn) CreateAccumulator() (weightedMeanAccum, error) {
+	// Each weighted value adds at most MaxWeight*(MaxValue-MinValue)/2 in
+	// absolute value to the normalized sum, and at most MaxWeight to the sum
+	// of the weights. The weighted values of a privacy identifier are summed
+	// before being added, so the sums are bounded for
+	// MaxContributionsPerPartition weighted values.
+	maxValues := float64(fn.MaxContributionsPerPartition)
+	maxNormalized := maxValues * fn.MaxWeight * (fn.Upper - fn.Lower) / 2
+	sumLower, sumUpper, weightLower, weightUpper := -maxNormalized, maxNormalized, 0.0, maxValues*fn.MaxWeight
+	if !fn.clamps() {
+		sumLower, sumUpper, weightLower, weightUpper = math.Inf(-1), math.Inf(1), math.Inf(-1), math.Inf(1)
+	}
+	sum, err := dpagg.NewBoundedSumFloat64(&dpagg.BoundedSumFloat64Options{
+		Epsilon:                  fn.NoiseEpsilon / 2,
+		Delta:                    fn.NoiseDelta / 2,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		Lower:                    sumLower,
+		Upper:                    sumUpper,
+		Noise:                    fn.noise,
+	})
+	if err != nil {
+		return weightedMeanAccum{}, err
+	}
+	weight, err := dpagg.NewBoundedSumFloat64(&dpagg.BoundedSumFloat64Options{
+		Epsilon:                  fn.NoiseEpsilon / 2,
+		Delta:                    fn.NoiseDelta / 2,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		Lower:                    weightLower,
+		Upper:                    weightUpper,
+		Noise:                    fn.noise,
+	})
+	if err != nil {
+		return weightedMeanAccum{}, err
+	}
+	accum := weightedMeanAccum{NormalizedSum: sum, Weight: weight}
+	if !fn.PublicPartitions {
+		accum.SP, err = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+			Epsilon:                  fn.PartitionSelectionEpsilon,
+			Delta:                    fn.PartitionSelectionDelta,
+			PreThreshold:             fn.PreThreshold,
+			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		})
+	}
+	return accum, err
+}
+
+func (fn *weightedMeanFn) AddInput(a weightedMeanAccum, interleaved []float64) (weightedMeanAccum, error) {
+	var err error
+	// We can have multiple weighted values for each (privacy_key, partition_key) pair.
+	// We add their sums to the sums but we need to add a single input for each
+	// privacy_key to SelectPartition.
+	var sum, weight float64
+	for i := 0; i+1 < len(interleaved); i += 2 {
+		v, w := interleaved[i], interleaved[i+1]
+		if math.IsNaN(v) || math.IsNaN(w) {
+			// Ignored like NaN values in dpagg.BoundedSumFloat64, for both sums.
+			continue
+		}
+		if fn.clamps() {
+			v = math.Min(math.Max(v, fn.Lower), fn.Upper)
+			w = math.Min(math.Max(w, fn.MinWeight), fn.MaxWeight)
+		}
+		sum += w * (v - fn.midPoint())
+		weight += w
+	}
+	err = a.NormalizedSum.Add(sum)
+	if err != nil {
+		return a, err
+	}
+	err = a.Weight.Add(weight)
+	if err != nil {
+		return a, err
+	}
+	if !fn.PublicPartitions {
+		err = a.SP.Increment()
+	}
+	return a, err
+}
+
+func (fn *weightedMeanFn) MergeAccumulators(a, b weightedMeanAccum) (weightedMeanAccum, error) {
+	err := a.NormalizedSum.Merge(b.NormalizedSum)
+	if err != nil {
+		return a, err
+	}
+	err = a.Weight.Merge(b.Weight)
+	if err != nil {
+		return a, err
+	}
+	if !fn.PublicPartitions {
+		err = a.SP.Merge(b.SP)
+	}
+	return a, err
+}
+
+// ExtractOutput returns the noisy weighted mean, clamped to [MinValue, MaxValue].
+// If the noisy sum of the weights isn't positive, it returns the midpoint of
+// [MinValue, MaxValue].
+func (fn *weightedMeanFn) ExtractOutput(a weightedMeanAccum) (*float64, error) {
+	if fn.TestMode.isEnabled() {
+		a.NormalizedSum.Noise = noNoise{}
+		a.Weight.Noise = noNoise{}
+	}
+	a.NormalizedSum.Noise = auditNoise(a.NormalizedSum.Noise, "WeightedMean")
+	a.Weight.Noise = auditNoise(a.Weight.Noise, "WeightedMean")
+	shouldKeepPartition := fn.TestMode.isEnabled() || fn.PublicPartitions // If in test mode or public partitions are specified, we always keep the partition.
+	if !shouldKeepPartition {                                             // If not, we need to perform private partition selection.
+		var err error
+		shouldKeepPartition, err = fn.PartitionSelector.shouldKeepPartition(a.SP, fn.partitionSelectorParams())
+		if err != nil || !shouldKeepPartition {
+			return nil, err
+		}
+	}
+	noisedSum, err := a.NormalizedSum.Result()
+	if err != nil {
+		return nil, err
+	}
+	noisedWeight, err := a.Weight.Result()
+	if err != nil {
+		return nil, err
+	}
+	result := fn.midPoint()
+	if noisedWeight > 0 {
+		result += noisedSum / noisedWeight
+	}
+	if fn.clamps() {
+		result = math.Min(math.Max(result, fn.Lower), fn.Upper)
+	}
+	return &result, nil
+}
+
+func (fn *weightedMeanFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+func (fn *weightedMeanFn) partitionSelectorParams() PartitionSelectorParams {
+	return PartitionSelectorParams{
+		Epsilon:                  fn.PartitionSelectionEpsilon,
+		Delta:                    fn.PartitionSelectionDelta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		PreThreshold:             fn.PreThreshold,
+	}
+}
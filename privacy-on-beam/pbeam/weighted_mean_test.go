@@ -0,0 +1,210 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/v3/noise"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
+)
+
+func init() {
+	register.Function1x2[weightedRecord, int, weightedRecord](extractIDFromWeightedRecordFn)
+	register.Function1x2[weightedRecord, int, WeightedValue](weightedRecordToKVFn)
+	register.Function2x1[int, float64, string](formatWeightedMeanFn)
+}
+
+type weightedRecord struct {
+	ID, Partition int
+	Value, Weight float64
+}
+
+func extractIDFromWeightedRecordFn(r weightedRecord) (int, weightedRecord) {
+	return r.ID, r
+}
+
+func weightedRecordToKVFn(r weightedRecord) (int, WeightedValue) {
+	return r.Partition, WeightedValue{Value: r.Value, Weight: r.Weight}
+}
+
+func formatWeightedMeanFn(partition int, mean float64) string {
+	return fmt.Sprintf("%d: %.2f", partition, mean)
+}
+
+// makeWeightedRecords returns n records with consecutive IDs starting from
+// firstID.
+func makeWeightedRecords(firstID, n, partition int, value, weight float64) []weightedRecord {
+	records := make([]weightedRecord, n)
+	for i := range records {
+		records[i] = weightedRecord{ID: firstID + i, Partition: partition, Value: value, Weight: weight}
+	}
+	return records
+}
+
+func TestWeightedMeanPerKeyNoNoise(t *testing.T) {
+	// Partition 0 has 100 values equal to 1 with weight 1 and 100 values equal
+	// to 4 with weight 3, so its weighted mean is (100+1200)/(100+300) = 3.25.
+	// Partition 1 has 50 values equal to 2 with weight 2.
+	var records []weightedRecord
+	records = append(records, makeWeightedRecords(0, 100, 0, 1, 1)...)
+	records = append(records, makeWeightedRecords(100, 100, 0, 4, 3)...)
+	records = append(records, makeWeightedRecords(200, 50, 1, 2, 2)...)
+	p, s, col := ptest.CreateList(records)
+	col = beam.ParDo(s, extractIDFromWeightedRecordFn, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, weightedRecordToKVFn, pcol)
+	got := WeightedMeanPerKey(s, pcol, WeightedMeanParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     5,
+		MinWeight:                    0,
+		MaxWeight:                    5,
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatWeightedMeanFn, got), "0: 3.25", "1: 2.00")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestWeightedMeanPerKeyNoNoise: WeightedMeanPerKey(%v) = %v, error %v", col, got, err)
+	}
+}
+
+func TestWeightedMeanPerKeyClampsValuesAndWeights(t *testing.T) {
+	// Values are clamped to [0, 5] and weights to [1, 2]: the weighted mean is
+	// (100*0*2 + 100*5*1)/(100*2 + 100*1) = 500/300.
+	var records []weightedRecord
+	records = append(records, makeWeightedRecords(0, 100, 0, -10, 10)...)
+	records = append(records, makeWeightedRecords(100, 100, 0, 10, 0)...)
+	p, s, col := ptest.CreateList(records)
+	col = beam.ParDo(s, extractIDFromWeightedRecordFn, col)
+
+	pcol := MakePrivate(s, col, privacySpec(t,
+		PrivacySpecParams{
+			AggregationEpsilon:        1,
+			PartitionSelectionEpsilon: 1,
+			PartitionSelectionDelta:   1e-5,
+			TestMode:                  TestModeWithContributionBounding,
+		}))
+	pcol = ParDo(s, weightedRecordToKVFn, pcol)
+	got := WeightedMeanPerKey(s, pcol, WeightedMeanParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		MinValue:                     0,
+		MaxValue:                     5,
+		MinWeight:                    1,
+		MaxWeight:                    2,
+	})
+
+	passert.Equals(s, beam.ParDo(s, formatWeightedMeanFn, got), "0: 1.67")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestWeightedMeanPerKeyClampsValuesAndWeights: WeightedMeanPerKey(%v) = %v, error %v", col, got, err)
+	}
+}
+
+func TestWeightedMeanPerKeyWithPartitionsNoNoise(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		inMemory bool
+	}{
+		{"public partitions as a PCollection", false},
+		{"in-memory public partitions", true},
+	} {
+		// Partition 1 is not public, and public partition 2 is empty: its
+		// weighted mean is the midpoint of [0, 5].
+		var records []weightedRecord
+		records = append(records, makeWeightedRecords(0, 100, 0, 1, 2)...)
+		records = append(records, makeWeightedRecords(100, 50, 1, 2, 2)...)
+		publicPartitionsSlice := []int{0, 2}
+		p, s, col := ptest.CreateList(records)
+		col = beam.ParDo(s, extractIDFromWeightedRecordFn, col)
+
+		var publicPartitions any
+		if tc.inMemory {
+			publicPartitions = publicPartitionsSlice
+		} else {
+			publicPartitions = beam.CreateList(s, publicPartitionsSlice)
+		}
+
+		pcol := MakePrivate(s, col, privacySpec(t,
+			PrivacySpecParams{
+				AggregationEpsilon: 1,
+				TestMode:           TestModeWithContributionBounding,
+			}))
+		pcol = ParDo(s, weightedRecordToKVFn, pcol)
+		got := WeightedMeanPerKey(s, pcol, WeightedMeanParams{
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinValue:                     0,
+			MaxValue:                     5,
+			MinWeight:                    0,
+			MaxWeight:                    5,
+			PublicPartitions:             publicPartitions,
+		})
+
+		passert.Equals(s, beam.ParDo(s, formatWeightedMeanFn, got), "0: 1.00", "2: 2.50")
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TestWeightedMeanPerKeyWithPartitionsNoNoise with %s: WeightedMeanPerKey(%v) = %v, error %v", tc.desc, col, got, err)
+		}
+	}
+}
+
+func TestCheckWeightedMeanPerKeyParams(t *testing.T) {
+	valid := func() WeightedMeanParams {
+		return WeightedMeanParams{
+			AggregationEpsilon:           1.0,
+			PartitionSelectionParams:     PartitionSelectionParams{Epsilon: 1.0, Delta: 1e-5},
+			MaxPartitionsContributed:     1,
+			MaxContributionsPerPartition: 1,
+			MinValue:                     -5.0,
+			MaxValue:                     5.0,
+			MinWeight:                    0,
+			MaxWeight:                    1,
+		}
+	}
+	for _, tc := range []struct {
+		desc    string
+		modify  func(*WeightedMeanParams)
+		wantErr bool
+	}{
+		{"valid parameters", func(*WeightedMeanParams) {}, false},
+		{"negative aggregationEpsilon", func(p *WeightedMeanParams) { p.AggregationEpsilon = -1 }, true},
+		{"MaxValue equal to MinValue", func(p *WeightedMeanParams) { p.MaxValue = p.MinValue }, true},
+		{"negative MinWeight", func(p *WeightedMeanParams) { p.MinWeight = -1 }, true},
+		{"MaxWeight equal to MinWeight", func(p *WeightedMeanParams) { p.MinWeight, p.MaxWeight = 1, 1 }, true},
+		{"MaxWeight smaller than MinWeight", func(p *WeightedMeanParams) { p.MinWeight, p.MaxWeight = 2, 1 }, true},
+		{"unset MaxContributionsPerPartition", func(p *WeightedMeanParams) { p.MaxContributionsPerPartition = 0 }, true},
+		{"unset MaxPartitionsContributed", func(p *WeightedMeanParams) { p.MaxPartitionsContributed = 0 }, true},
+	} {
+		params := valid()
+		tc.modify(&params)
+		if err := checkWeightedMeanPerKeyParams(params, noise.LaplaceNoise, reflect.TypeOf(0)); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package remotebudget
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// Reference gRPC transport of the Accountant interface. Messages are
+// AllocateRequest and AllocateResponse encoded as JSON, so that clients and
+// servers in other languages can implement the service without generated code.
+
+// ServiceName is the name of the gRPC service of budget accountants.
+const ServiceName = "pbeam.remotebudget.v1.BudgetAccountant"
+
+const allocateMethod = "/" + ServiceName + "/Allocate"
+
+// codecName is the content subtype of the messages, i.e. they are sent with
+// the "application/grpc+remotebudget-json" content type.
+const codecName = "remotebudget-json"
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec is a gRPC codec encoding messages as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return codecName
+}
+
+type grpcClient struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewGRPCClient returns an Accountant calling the budget accountant served
+// by RegisterGRPCServer on the other end of conn.
+func NewGRPCClient(conn grpc.ClientConnInterface) Accountant {
+	return &grpcClient{conn: conn}
+}
+
+func (c *grpcClient) Allocate(ctx context.Context, req *AllocateRequest) (*AllocateResponse, error) {
+	resp := new(AllocateResponse)
+	if err := c.conn.Invoke(ctx, allocateMethod, req, resp, grpc.CallContentSubtype(codecName)); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RegisterGRPCServer registers accountant as the budget accountant service of
+// s.
+func RegisterGRPCServer(s grpc.ServiceRegistrar, accountant Accountant) {
+	s.RegisterService(&serviceDesc, accountant)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*Accountant)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Allocate",
+			Handler:    allocateHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func allocateHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(AllocateRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(Accountant).Allocate(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: allocateMethod,
+	}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return srv.(Accountant).Allocate(ctx, req.(*AllocateRequest))
+	}
+	return interceptor(ctx, req, info, handler)
+}
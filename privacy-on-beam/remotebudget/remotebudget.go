@@ -0,0 +1,171 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package remotebudget lets a pbeam.PrivacySpec consult a central budget
+// accountant for the budget of each aggregation, so that privacy budget can be
+// accounted for across the pipelines of an organization.
+//
+// For example, the following allocates the budget of each aggregation of a
+// pipeline from a budget service reachable with the gRPC connection conn:
+//
+//	accountant := remotebudget.NewGRPCClient(conn)
+//	spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+//		AggregationEpsilon: 1,
+//		BudgetMiddleware: []pbeam.BudgetMiddleware{
+//			remotebudget.Middleware(ctx, accountant, remotebudget.Options{
+//				Principal: "ads-analytics",
+//				Pipeline:  "daily-visits",
+//				RunID:     runID,
+//			}),
+//		},
+//	})
+//
+// The PrivacySpec still enforces its own budget: the accountant can only refuse
+// an allocation or grant less budget than requested.
+package remotebudget
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+)
+
+// AllocateRequest is a request to allocate privacy budget to an aggregation.
+type AllocateRequest struct {
+	// Principal on behalf of which the budget is allocated, e.g. a team.
+	Principal string `json:"principal,omitempty"`
+	// Pipeline and run of the pipeline that the aggregation belongs to.
+	Pipeline string `json:"pipeline,omitempty"`
+	RunID    string `json:"run_id,omitempty"`
+	// Sequence number of the request within the run, starting from 1. Together
+	// with Pipeline and RunID, it identifies the request, so that the
+	// accountant can deduplicate retried requests.
+	Sequence int64 `json:"sequence"`
+	// Budget of the PrivacySpec the aggregation gets budget from:
+	// "aggregation" or "partition_selection".
+	Budget string `json:"budget"`
+	// Budget requested by the aggregation.
+	Epsilon float64 `json:"epsilon"`
+	Delta   float64 `json:"delta"`
+}
+
+// AllocateResponse is the budget allocated by an accountant.
+type AllocateResponse struct {
+	// Budget granted to the aggregation. It must not be larger than the
+	// requested budget.
+	Epsilon float64 `json:"epsilon"`
+	Delta   float64 `json:"delta"`
+}
+
+// Accountant is a central privacy budget accountant.
+type Accountant interface {
+	// Allocate charges the budget of an aggregation to the principal of the
+	// request, and returns the budget granted to the aggregation. It returns an
+	// error if the principal doesn't have enough budget left.
+	Allocate(ctx context.Context, req *AllocateRequest) (*AllocateResponse, error)
+}
+
+// Options identify the budget requests sent by Middleware to an accountant.
+type Options struct {
+	Principal string
+	Pipeline  string
+	RunID     string
+}
+
+// Middleware returns a pbeam.BudgetMiddleware that allocates the budget of
+// each aggregation from accountant, with ctx.
+//
+// The budget requested by an aggregation is first resolved by the
+// PrivacySpec, e.g. a request for the entire budget is replaced by the budget
+// left. The resolved budget is then allocated from accountant, and the
+// aggregation gets the budget granted by accountant.
+//
+// Dry runs are passed through without being allocated: aggregations only use
+// the budget of a dry run to validate their parameters, and then consume the
+// budget they use with a request that is allocated.
+func Middleware(ctx context.Context, accountant Accountant, opts Options) pbeam.BudgetMiddleware {
+	var (
+		mu       sync.Mutex
+		sequence int64
+	)
+	return func(next pbeam.BudgetHandler) pbeam.BudgetHandler {
+		return func(req pbeam.BudgetRequest) (float64, float64, error) {
+			if req.DryRun {
+				return next(req)
+			}
+			dryRun := req
+			dryRun.DryRun = true
+			eps, del, err := next(dryRun)
+			if err != nil {
+				return 0, 0, err
+			}
+			mu.Lock()
+			sequence++
+			allocReq := &AllocateRequest{
+				Principal: opts.Principal,
+				Pipeline:  opts.Pipeline,
+				RunID:     opts.RunID,
+				Sequence:  sequence,
+				Budget:    budgetName(req.Budget),
+				Epsilon:   eps,
+				Delta:     del,
+			}
+			mu.Unlock()
+			resp, err := accountant.Allocate(ctx, allocReq)
+			if err != nil {
+				return 0, 0, fmt.Errorf("couldn't allocate epsilon=%f and delta=%e from the remote accountant: %w", eps, del, err)
+			}
+			if err := checkAllocateResponse(allocReq, resp); err != nil {
+				return 0, 0, err
+			}
+			req.Epsilon, req.Delta = resp.Epsilon, resp.Delta
+			return next(req)
+		}
+	}
+}
+
+// checkAllocateResponse returns an error if resp doesn't grant a valid budget
+// for req.
+func checkAllocateResponse(req *AllocateRequest, resp *AllocateResponse) error {
+	if resp == nil {
+		return fmt.Errorf("remote accountant returned no allocation")
+	}
+	if resp.Epsilon < 0 || resp.Delta < 0 {
+		return fmt.Errorf("remote accountant granted a negative budget: epsilon=%f and delta=%e", resp.Epsilon, resp.Delta)
+	}
+	if resp.Epsilon > req.Epsilon || resp.Delta > req.Delta {
+		return fmt.Errorf("remote accountant granted epsilon=%f and delta=%e, more than the requested epsilon=%f and delta=%e", resp.Epsilon, resp.Delta, req.Epsilon, req.Delta)
+	}
+	if resp.Epsilon == 0 && resp.Delta == 0 {
+		// A request for no budget would consume the entire budget of the PrivacySpec.
+		return fmt.Errorf("remote accountant granted no budget")
+	}
+	return nil
+}
+
+// budgetName returns the name of a budget in AllocateRequest.Budget.
+func budgetName(b pbeam.BudgetType) string {
+	switch b {
+	case pbeam.AggregationBudget:
+		return "aggregation"
+	case pbeam.PartitionSelectionBudget:
+		return "partition_selection"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(b))
+	}
+}
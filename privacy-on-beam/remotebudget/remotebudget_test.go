@@ -0,0 +1,256 @@
+//
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package remotebudget
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam"
+	"github.com/google/differential-privacy/privacy-on-beam/v3/pbeam/testutils"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeAccountant records the requests it receives, and grants a fraction of
+// the requested budget.
+type fakeAccountant struct {
+	mu       sync.Mutex
+	requests []AllocateRequest
+	fraction float64
+	err      error
+}
+
+func (a *fakeAccountant) Allocate(_ context.Context, req *AllocateRequest) (*AllocateResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests = append(a.requests, *req)
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &AllocateResponse{Epsilon: req.Epsilon * a.fraction, Delta: req.Delta * a.fraction}, nil
+}
+
+var testOptions = Options{Principal: "team", Pipeline: "pipeline", RunID: "run"}
+
+func TestMiddleware(t *testing.T) {
+	accountant := &fakeAccountant{fraction: 0.5}
+	spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+		AggregationEpsilon:        1,
+		PartitionSelectionEpsilon: 1,
+		PartitionSelectionDelta:   1e-5,
+		BudgetMiddleware:          []pbeam.BudgetMiddleware{Middleware(context.Background(), accountant, testOptions)},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create PrivacySpec: %v", err)
+	}
+
+	_, s := beam.NewPipelineWithRoot()
+	col := beam.ParDo(s, testutils.PairToKV, beam.CreateList(s, testutils.MakePairsWithFixedV(10, 0)))
+	pbeam.Count(s, pbeam.MakePrivate(s, col, spec), pbeam.CountParams{
+		AggregationEpsilon:       0.5,
+		PartitionSelectionParams: pbeam.PartitionSelectionParams{Epsilon: 0.25, Delta: 1e-6},
+		MaxPartitionsContributed: 1,
+		MaxValue:                 1,
+	})
+
+	wantRequests := []AllocateRequest{
+		{Principal: "team", Pipeline: "pipeline", RunID: "run", Sequence: 1, Budget: "aggregation", Epsilon: 0.5},
+		{Principal: "team", Pipeline: "pipeline", RunID: "run", Sequence: 2, Budget: "partition_selection", Epsilon: 0.25, Delta: 1e-6},
+	}
+	if diff := cmp.Diff(wantRequests, accountant.requests, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("Middleware sent unexpected requests (-want +got):\n%s", diff)
+	}
+	// The PrivacySpec only consumes the budget granted by the accountant.
+	var consumed []float64
+	for _, u := range spec.BudgetUsage() {
+		consumed = append(consumed, u.ConsumedEpsilon, u.ConsumedDelta)
+	}
+	if diff := cmp.Diff([]float64{0.25, 0, 0.125, 5e-7}, consumed, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("BudgetUsage: got diff (-want +got):\n%s", diff)
+	}
+}
+
+// Checks that the budget of an aggregation built on top of another one, e.g.
+// Rate on top of Count, is allocated once.
+func TestMiddlewareAllocatesNestedBudgetOnce(t *testing.T) {
+	accountant := &fakeAccountant{fraction: 0.5}
+	spec, err := pbeam.NewPrivacySpec(pbeam.PrivacySpecParams{
+		AggregationEpsilon: 1,
+		BudgetMiddleware:   []pbeam.BudgetMiddleware{Middleware(context.Background(), accountant, testOptions)},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create PrivacySpec: %v", err)
+	}
+
+	_, s := beam.NewPipelineWithRoot()
+	col := beam.ParDo(s, testutils.PairToKV, beam.CreateList(s, testutils.MakePairsWithFixedV(10, 0)))
+	denominators := beam.ParDo(s, testutils.PairIF64ToKV, beam.CreateList(s, []testutils.PairIF64{{0, 20}}))
+	pbeam.Rate(s, pbeam.MakePrivate(s, col, spec), pbeam.RateParams{
+		AggregationEpsilon:       0.5,
+		MaxPartitionsContributed: 1,
+		MaxValue:                 1,
+		PublicPartitions:         []int{0},
+		Denominators:             denominators,
+	})
+
+	wantRequests := []AllocateRequest{
+		{Principal: "team", Pipeline: "pipeline", RunID: "run", Sequence: 1, Budget: "aggregation", Epsilon: 0.5},
+	}
+	if diff := cmp.Diff(wantRequests, accountant.requests, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("Middleware sent unexpected requests (-want +got):\n%s", diff)
+	}
+	// The PrivacySpec consumes the budget granted by the accountant to Rate.
+	if got := spec.BudgetUsage()[0].ConsumedEpsilon; !cmp.Equal(got, 0.25, cmpopts.EquateApprox(0, 1e-12)) {
+		t.Errorf("BudgetUsage: got ConsumedEpsilon=%f, want 0.25", got)
+	}
+}
+
+func TestMiddlewarePassesDryRunsThrough(t *testing.T) {
+	accountant := &fakeAccountant{fraction: 0.5}
+	var got []pbeam.BudgetRequest
+	next := func(req pbeam.BudgetRequest) (float64, float64, error) {
+		got = append(got, req)
+		return req.Epsilon, req.Delta, nil
+	}
+	handler := Middleware(context.Background(), accountant, testOptions)(next)
+
+	req := pbeam.BudgetRequest{Budget: pbeam.AggregationBudget, Epsilon: 0.5, DryRun: true}
+	eps, _, err := handler(req)
+	if err != nil {
+		t.Fatalf("handler: got error %v", err)
+	}
+	if eps != 0.5 {
+		t.Errorf("handler: got epsilon=%f, want 0.5", eps)
+	}
+	if len(accountant.requests) != 0 {
+		t.Errorf("handler: sent %v to the accountant for a dry run, want no request", accountant.requests)
+	}
+	if diff := cmp.Diff([]pbeam.BudgetRequest{req}, got); diff != "" {
+		t.Errorf("handler sent unexpected requests to next (-want +got):\n%s", diff)
+	}
+}
+
+func TestMiddlewareResolvesEntireBudget(t *testing.T) {
+	accountant := &fakeAccountant{fraction: 1}
+	var got []pbeam.BudgetRequest
+	next := func(req pbeam.BudgetRequest) (float64, float64, error) {
+		got = append(got, req)
+		if req.Epsilon == 0 && req.Delta == 0 {
+			return 2, 1e-5, nil
+		}
+		return req.Epsilon, req.Delta, nil
+	}
+	handler := Middleware(context.Background(), accountant, testOptions)(next)
+
+	eps, del, err := handler(pbeam.BudgetRequest{Budget: pbeam.AggregationBudget})
+	if err != nil {
+		t.Fatalf("handler: got error %v", err)
+	}
+	if eps != 2 || del != 1e-5 {
+		t.Errorf("handler: got epsilon=%f and delta=%e, want 2 and 1e-5", eps, del)
+	}
+	// The entire budget is resolved with a dry run before it is allocated and consumed.
+	want := []pbeam.BudgetRequest{
+		{Budget: pbeam.AggregationBudget, DryRun: true},
+		{Budget: pbeam.AggregationBudget, Epsilon: 2, Delta: 1e-5},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("handler sent unexpected requests to next (-want +got):\n%s", diff)
+	}
+}
+
+func TestMiddlewareRefusedAllocation(t *testing.T) {
+	accountant := &fakeAccountant{err: errors.New("budget exhausted")}
+	var consumed bool
+	next := func(req pbeam.BudgetRequest) (float64, float64, error) {
+		consumed = consumed || !req.DryRun
+		return req.Epsilon, req.Delta, nil
+	}
+	handler := Middleware(context.Background(), accountant, testOptions)(next)
+
+	if _, _, err := handler(pbeam.BudgetRequest{Budget: pbeam.AggregationBudget, Epsilon: 1}); err == nil {
+		t.Errorf("handler: with a refused allocation got no error")
+	}
+	if consumed {
+		t.Errorf("handler: with a refused allocation consumed budget")
+	}
+}
+
+func TestCheckAllocateResponse(t *testing.T) {
+	req := &AllocateRequest{Epsilon: 1, Delta: 1e-5}
+	for _, tc := range []struct {
+		desc    string
+		resp    *AllocateResponse
+		wantErr bool
+	}{
+		{"requested budget", &AllocateResponse{Epsilon: 1, Delta: 1e-5}, false},
+		{"less budget", &AllocateResponse{Epsilon: 0.5, Delta: 0}, false},
+		{"no response", nil, true},
+		{"no budget", &AllocateResponse{}, true},
+		{"negative epsilon", &AllocateResponse{Epsilon: -1, Delta: 1e-5}, true},
+		{"epsilon too large", &AllocateResponse{Epsilon: 2, Delta: 1e-5}, true},
+		{"delta too large", &AllocateResponse{Epsilon: 1, Delta: 1e-4}, true},
+	} {
+		if err := checkAllocateResponse(req, tc.resp); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	accountant := &fakeAccountant{fraction: 0.5}
+	RegisterGRPCServer(server, accountant)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Couldn't dial the server: %v", err)
+	}
+	defer conn.Close()
+
+	req := &AllocateRequest{Principal: "team", Pipeline: "pipeline", RunID: "run", Sequence: 1, Budget: "aggregation", Epsilon: 1, Delta: 1e-5}
+	resp, err := NewGRPCClient(conn).Allocate(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Allocate: got error %v", err)
+	}
+	if diff := cmp.Diff(&AllocateResponse{Epsilon: 0.5, Delta: 5e-6}, resp); diff != "" {
+		t.Errorf("Allocate: got diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]AllocateRequest{*req}, accountant.requests); diff != "" {
+		t.Errorf("Allocate: server got diff (-want +got):\n%s", diff)
+	}
+
+	accountant.mu.Lock()
+	accountant.err = errors.New("budget exhausted")
+	accountant.mu.Unlock()
+	if _, err := NewGRPCClient(conn).Allocate(context.Background(), req); err == nil {
+		t.Errorf("Allocate: with a refused allocation got no error")
+	}
+}